@@ -0,0 +1,162 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package aliasresolver resolves class names of shaded (relocated) libraries by resolving their canonical names, and vice versa.
+// For example, with the alias org.apache.hadoop.thirdparty.protobuf=com.google.protobuf, a reference to
+// org.apache.hadoop.thirdparty.protobuf.Message that no rule claims is resolved as com.google.protobuf.Message,
+// and the other way around.
+package aliasresolver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+)
+
+// Alias says that the classes in Package and its subpackages are relocated copies of the classes in Canonical and its subpackages.
+type Alias struct {
+	Package   string
+	Canonical string
+}
+
+// ReadAliases reads aliases from r, one 'package=canonical' pair per line, e.g.
+// 'org.apache.hadoop.thirdparty.protobuf=com.google.protobuf'.
+// Empty lines and lines starting with '#' are ignored.
+func ReadAliases(r io.Reader) ([]Alias, error) {
+	var ret []Alias
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(line, "=")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: expected package=canonical, got %q", lineNo, line)
+		}
+		a := Alias{strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])}
+		if a.Package == "" || a.Canonical == "" || a.Package == a.Canonical {
+			return nil, fmt.Errorf("line %d: expected two different packages, got %q", lineNo, line)
+		}
+		ret = append(ret, a)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Resolver resolves the aliases of class names using its resolvers.
+// It's meant to be the last resolver in jadeplib.Config, so that it only sees the class names that no other resolver claimed.
+type Resolver struct {
+	aliases   []Alias
+	resolvers []jadeplib.Resolver
+}
+
+// NewResolver returns a new Resolver that resolves aliases using 'resolvers', consulted in order like the resolvers of jadeplib.Config.
+func NewResolver(aliases []Alias, resolvers ...jadeplib.Resolver) *Resolver {
+	return &Resolver{aliases, resolvers}
+}
+
+// Name returns a description of the resolver.
+func (r *Resolver) Name() string {
+	return "PackageAliases"
+}
+
+// Resolve resolves the aliases of classNames, and returns the rules that provide them as the rules that provide classNames.
+// A class name whose aliases are provided by different rules is resolved to all of them.
+func (r *Resolver) Resolve(ctx context.Context, classNames []jadeplib.ClassName, consumingRules map[bazel.Label]map[bazel.Label]bool) (map[jadeplib.ClassName][]*bazel.Rule, error) {
+	aliasesOf := make(map[jadeplib.ClassName][]jadeplib.ClassName)
+	unresolved := make(map[jadeplib.ClassName]bool)
+	for _, cls := range classNames {
+		for _, alias := range r.aliasesOf(cls) {
+			aliasesOf[cls] = append(aliasesOf[cls], alias)
+			unresolved[alias] = true
+		}
+	}
+
+	resolved := make(map[jadeplib.ClassName][]*bazel.Rule)
+	var errors []string
+	for _, res := range r.resolvers {
+		if len(unresolved) == 0 {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var toResolve []jadeplib.ClassName
+		for cls := range unresolved {
+			toResolve = append(toResolve, cls)
+		}
+		sort.Slice(toResolve, func(i, j int) bool { return toResolve[i] < toResolve[j] })
+		rules, err := res.Resolve(ctx, toResolve, consumingRules)
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("%s: %v", res.Name(), err))
+		}
+		for cls, rr := range rules {
+			if unresolved[cls] {
+				resolved[cls] = rr
+				delete(unresolved, cls)
+			}
+		}
+	}
+
+	ret := make(map[jadeplib.ClassName][]*bazel.Rule)
+	for _, cls := range classNames {
+		seen := make(map[bazel.Label]bool)
+		for _, alias := range aliasesOf[cls] {
+			for _, rule := range resolved[alias] {
+				if !seen[rule.Label()] {
+					seen[rule.Label()] = true
+					ret[cls] = append(ret[cls], rule)
+				}
+			}
+		}
+	}
+
+	if len(errors) > 0 {
+		return ret, fmt.Errorf("Errors when resolving using %s:\n%s", r.Name(), strings.Join(errors, "\n"))
+	}
+	return ret, nil
+}
+
+// aliasesOf returns the names of cls under each alias whose package or canonical package contains it.
+func (r *Resolver) aliasesOf(cls jadeplib.ClassName) []jadeplib.ClassName {
+	var ret []jadeplib.ClassName
+	for _, a := range r.aliases {
+		if rest, ok := trimPackage(string(cls), a.Package); ok {
+			ret = append(ret, jadeplib.ClassName(a.Canonical+rest))
+		}
+		if rest, ok := trimPackage(string(cls), a.Canonical); ok {
+			ret = append(ret, jadeplib.ClassName(a.Package+rest))
+		}
+	}
+	return ret
+}
+
+// trimPackage returns what follows pkg in cls, including the leading '.', if cls is in pkg or one of its subpackages.
+func trimPackage(cls, pkg string) (string, bool) {
+	if !strings.HasPrefix(cls, pkg+".") {
+		return "", false
+	}
+	return cls[len(pkg):], true
+}
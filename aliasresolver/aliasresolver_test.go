@@ -0,0 +1,157 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aliasresolver
+
+import (
+	"strings"
+	"testing"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+	"github.com/google/go-cmp/cmp"
+)
+
+type stubResolver struct {
+	response map[jadeplib.ClassName][]*bazel.Rule
+}
+
+func (r *stubResolver) Name() string {
+	return "stub"
+}
+
+func (r *stubResolver) Resolve(ctx context.Context, classNames []jadeplib.ClassName, consumingRules map[bazel.Label]map[bazel.Label]bool) (map[jadeplib.ClassName][]*bazel.Rule, error) {
+	ret := make(map[jadeplib.ClassName][]*bazel.Rule)
+	for _, cls := range classNames {
+		if rules, ok := r.response[cls]; ok {
+			ret[cls] = rules
+		}
+	}
+	return ret, nil
+}
+
+func TestResolve(t *testing.T) {
+	protobuf := bazel.NewRule("java_library", "third_party/protobuf", "protobuf", nil)
+	shaded := bazel.NewRule("java_library", "third_party/hadoop", "shaded_protobuf", nil)
+	aliases := []Alias{{"org.hadoop.shaded.protobuf", "com.google.protobuf"}}
+
+	tests := []struct {
+		desc       string
+		resolvers  []jadeplib.Resolver
+		classNames []jadeplib.ClassName
+		want       map[jadeplib.ClassName][]bazel.Label
+	}{
+		{
+			desc: "Relocated class names resolve to the rules of their canonical names",
+			resolvers: []jadeplib.Resolver{
+				&stubResolver{map[jadeplib.ClassName][]*bazel.Rule{"com.google.protobuf.Message": {protobuf}}},
+			},
+			classNames: []jadeplib.ClassName{"org.hadoop.shaded.protobuf.Message", "org.hadoop.shaded.protobuf.util.Timestamps"},
+			want: map[jadeplib.ClassName][]bazel.Label{
+				"org.hadoop.shaded.protobuf.Message": {"//third_party/protobuf:protobuf"},
+			},
+		},
+		{
+			desc: "Canonical class names resolve to the rules of their relocated names",
+			resolvers: []jadeplib.Resolver{
+				&stubResolver{map[jadeplib.ClassName][]*bazel.Rule{"org.hadoop.shaded.protobuf.Message": {shaded}}},
+			},
+			classNames: []jadeplib.ClassName{"com.google.protobuf.Message"},
+			want: map[jadeplib.ClassName][]bazel.Label{
+				"com.google.protobuf.Message": {"//third_party/hadoop:shaded_protobuf"},
+			},
+		},
+		{
+			desc: "Resolvers are consulted in order",
+			resolvers: []jadeplib.Resolver{
+				&stubResolver{map[jadeplib.ClassName][]*bazel.Rule{"com.google.protobuf.Message": {protobuf}}},
+				&stubResolver{map[jadeplib.ClassName][]*bazel.Rule{"com.google.protobuf.Message": {shaded}}},
+			},
+			classNames: []jadeplib.ClassName{"org.hadoop.shaded.protobuf.Message"},
+			want: map[jadeplib.ClassName][]bazel.Label{
+				"org.hadoop.shaded.protobuf.Message": {"//third_party/protobuf:protobuf"},
+			},
+		},
+		{
+			desc: "Class names outside of aliased packages aren't resolved",
+			resolvers: []jadeplib.Resolver{
+				&stubResolver{map[jadeplib.ClassName][]*bazel.Rule{"com.google.protobuf.Message": {protobuf}}},
+			},
+			classNames: []jadeplib.ClassName{"org.hadoop.shaded.protobufx.Message", "com.google.Message"},
+			want:       map[jadeplib.ClassName][]bazel.Label{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			got, err := NewResolver(aliases, tt.resolvers...).Resolve(context.Background(), tt.classNames, nil)
+			if err != nil {
+				t.Fatalf("Resolve returned error %v, want nil", err)
+			}
+			gotLabels := make(map[jadeplib.ClassName][]bazel.Label)
+			for cls, rules := range got {
+				for _, r := range rules {
+					gotLabels[cls] = append(gotLabels[cls], r.Label())
+				}
+			}
+			if diff := cmp.Diff(tt.want, gotLabels); diff != "" {
+				t.Errorf("Resolve returned diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestReadAliases(t *testing.T) {
+	tests := []struct {
+		desc         string
+		content      string
+		want         []Alias
+		wantErrorHas string
+	}{
+		{
+			desc:    "Comments and empty lines are ignored",
+			content: "# Hadoop\norg.hadoop.shaded.protobuf = com.google.protobuf\n\nshaded.guava=com.google.common\n",
+			want: []Alias{
+				{"org.hadoop.shaded.protobuf", "com.google.protobuf"},
+				{"shaded.guava", "com.google.common"},
+			},
+		},
+		{
+			desc:         "Missing canonical package",
+			content:      "shaded.guava=\n",
+			wantErrorHas: "line 1",
+		},
+		{
+			desc:         "Not a pair",
+			content:      "# Guava\nshaded.guava\n",
+			wantErrorHas: "line 2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			got, err := ReadAliases(strings.NewReader(tt.content))
+			if tt.wantErrorHas == "" && err != nil {
+				t.Errorf("ReadAliases returned error %v, want nil", err)
+			}
+			if tt.wantErrorHas != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErrorHas)) {
+				t.Errorf("ReadAliases returned error %v, want error containing %q", err, tt.wantErrorHas)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("ReadAliases returned diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
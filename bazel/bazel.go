@@ -35,6 +35,22 @@ func (l Label) Split() (pkgName, ruleName string) {
 	return s[:i], s[i+1:]
 }
 
+// RelativeTo returns the label as a human would write it in a BUILD file of package pkgName.
+// Examples (pkgName = "foo"): //foo:bar --> ":bar", //zoo:zoo --> "//zoo", //zoo:bar --> "//zoo:bar"
+func (l Label) RelativeTo(pkgName string) string {
+	pkg, name := l.Split()
+	if pkg == pkgName {
+		return ":" + name
+	}
+	if !strings.HasPrefix(pkg, "@") {
+		pkg = "//" + pkg
+	}
+	if name == path.Base(pkg) {
+		return pkg
+	}
+	return pkg + ":" + name
+}
+
 // ParseRelativeLabel parses a label, not necessarily absolute,
 // relative to some package.
 //
@@ -117,6 +133,32 @@ func (v UnknownAttributeValue) String() string {
 	return "UNKNOWN_ATTRIBUTE_VALUE"
 }
 
+// AttrFromJSON converts an attribute value decoded from JSON to the type a Loader returns,
+// e.g. []interface{} of strings to []string, integral float64s to int, and {} to UnknownAttributeValue.
+func AttrFromJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case float64:
+		if v == float64(int(v)) {
+			return int(v)
+		}
+	case []interface{}:
+		strs := make([]string, 0, len(v))
+		for _, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				return v
+			}
+			strs = append(strs, s)
+		}
+		return strs
+	case map[string]interface{}:
+		if len(v) == 0 {
+			return UnknownAttributeValue{}
+		}
+	}
+	return v
+}
+
 // Rule represents a Bazel Rule.
 type Rule struct {
 	Schema  string                 // string representing the type of rule for example java_library
@@ -211,6 +253,28 @@ func (r *Rule) Label() Label {
 	return Label("//" + r.PkgName + ":" + r.Name())
 }
 
+// GeneratorFunction returns the name of the macro that generated the rule, e.g. "java_library_with_tests",
+// or "" if the rule is instantiated directly in its BUILD file.
+func (r *Rule) GeneratorFunction() string {
+	s, _ := r.Attrs["generator_function"].(string)
+	return s
+}
+
+// SourceLabel returns the label of the call in the BUILD file that instantiates the rule.
+// For a rule generated by a macro whose call has a name attribute, it's a label whose name is the macro's name,
+// e.g. //java:foo for a rule //java:foo_lib generated by 'some_macro(name = "foo")'.
+// Otherwise, it's the rule's label.
+func (r *Rule) SourceLabel() Label {
+	if r.GeneratorFunction() == "" {
+		return r.Label()
+	}
+	name, ok := r.Attrs["generator_name"].(string)
+	if !ok {
+		return r.Label()
+	}
+	return Label("//" + r.PkgName + ":" + name)
+}
+
 // Package represents a Bazel Package.
 type Package struct {
 	Path              string
@@ -218,6 +282,34 @@ type Package struct {
 	Files             map[string]string
 	Rules             map[string]*Rule // maps rule name to Rule
 	PackageGroups     map[string]*PackageGroup
+
+	// DefaultTestonly, DefaultDeprecation and Features are the package's default_testonly, default_deprecation
+	// and features, as set by package().
+	DefaultTestonly    bool
+	DefaultDeprecation string
+	Features           []string
+
+	// DefaultLicenses are the license types set by the package's licenses() call, e.g. "notice".
+	// It's empty if the package doesn't call licenses().
+	DefaultLicenses []string
+}
+
+// ApplyDefaults sets the attributes of rule that aren't set to the package-level defaults of p, the way Bazel does.
+// This is needed for rules that don't come from a loader, e.g. rules Jadep creates.
+func (p *Package) ApplyDefaults(rule *Rule) {
+	if _, ok := rule.Attrs["testonly"]; !ok && p.DefaultTestonly {
+		rule.Attrs["testonly"] = true
+	}
+	if _, ok := rule.Attrs["deprecation"]; !ok && p.DefaultDeprecation != "" {
+		rule.Attrs["deprecation"] = p.DefaultDeprecation
+	}
+	if _, ok := rule.Attrs["visibility"]; !ok && len(p.DefaultVisibility) > 0 {
+		var vis []string
+		for _, l := range p.DefaultVisibility {
+			vis = append(vis, string(l))
+		}
+		rule.Attrs["visibility"] = vis
+	}
 }
 
 // PackageGroup represents a package_group() function call in a BUILD file.
@@ -41,6 +41,30 @@ func TestLabelSplit(t *testing.T) {
 	}
 }
 
+func TestLabelRelativeTo(t *testing.T) {
+	var tests = []struct {
+		label   string
+		pkgName string
+		want    string
+	}{
+		{"//foo:bar", "foo", ":bar"},
+		{"//foo:foo", "foo", ":foo"},
+		{"//foo/bar:bar", "foo", "//foo/bar"},
+		{"//foo/bar:zoo", "foo", "//foo/bar:zoo"},
+		{"//foo/bar", "zoo", "//foo/bar"},
+		{"@r//foo:foo", "foo", "@r//foo"},
+		{"@r//foo:bar", "@r//foo", ":bar"},
+		{"//:bar", "foo", "//:bar"},
+	}
+
+	for _, tt := range tests {
+		got := Label(tt.label).RelativeTo(tt.pkgName)
+		if got != tt.want {
+			t.Errorf("Label(%s).RelativeTo(%q) = %q, want %q", tt.label, tt.pkgName, got, tt.want)
+		}
+	}
+}
+
 func TestParseRelativeLabel(t *testing.T) {
 	tests := []struct {
 		pkgName, s string
@@ -188,3 +212,62 @@ func TestLabelAttr(t *testing.T) {
 		}
 	}
 }
+
+func TestSourceLabel(t *testing.T) {
+	tests := []struct {
+		desc string
+		rule *Rule
+		want Label
+	}{
+		{
+			desc: "not generated by a macro",
+			rule: NewRule("java_library", "x", "foo", nil),
+			want: "//x:foo",
+		},
+		{
+			desc: "generated by a macro with a name",
+			rule: NewRule("java_library", "x", "foo_lib", map[string]interface{}{"generator_function": "some_macro", "generator_name": "foo"}),
+			want: "//x:foo",
+		},
+		{
+			desc: "generated by a macro without a name",
+			rule: NewRule("java_library", "x", "foo_lib", map[string]interface{}{"generator_function": "some_macro", "generator_location": "x/BUILD:7"}),
+			want: "//x:foo_lib",
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.rule.SourceLabel(); got != tt.want {
+			t.Errorf("%s: SourceLabel() = %q, want %q", tt.desc, got, tt.want)
+		}
+	}
+}
+
+func TestApplyDefaults(t *testing.T) {
+	pkg := &Package{
+		DefaultVisibility:  []Label{"//visibility:public"},
+		DefaultTestonly:    true,
+		DefaultDeprecation: "gone",
+	}
+
+	rule := NewRule("java_library", "x", "Foo", nil)
+	pkg.ApplyDefaults(rule)
+	want := NewRule("java_library", "x", "Foo", map[string]interface{}{
+		"testonly":    true,
+		"deprecation": "gone",
+		"visibility":  []string{"//visibility:public"},
+	})
+	if diff := cmp.Diff(rule, want); diff != "" {
+		t.Errorf("ApplyDefaults on a rule without attributes returned diff (-got +want):\n%s", diff)
+	}
+
+	explicit := map[string]interface{}{
+		"testonly":    false,
+		"deprecation": "other",
+		"visibility":  []string{"//visibility:private"},
+	}
+	rule = NewRule("java_library", "x", "Foo", explicit)
+	pkg.ApplyDefaults(rule)
+	if diff := cmp.Diff(rule, NewRule("java_library", "x", "Foo", explicit)); diff != "" {
+		t.Errorf("ApplyDefaults changed explicitly set attributes (-got +want):\n%s", diff)
+	}
+}
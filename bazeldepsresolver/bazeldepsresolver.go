@@ -23,6 +23,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"context"
@@ -178,3 +179,30 @@ func (r *Resolver) Resolve(ctx context.Context, classNames []jadeplib.ClassName,
 
 	return result, nil
 }
+
+// Wrappers maps the labels of the external targets that the in-repo targets under thirdPartyDir wrap, e.g. @guava//jar:guava and
+// the //external:guava bind that points to it, to the in-repo target, e.g. //thirdparty/jvm/guava:guava.
+// It implements jadeplib.WrapperProvider, so that candidates found by other resolvers, e.g. WORKSPACE jars, are suggested through
+// their in-repo wrappers.
+func (r *Resolver) Wrappers() map[bazel.Label]*bazel.Rule {
+	ret := make(map[bazel.Label]*bazel.Rule)
+	for rule := range r.parent {
+		if !isExternal(rule.Label()) {
+			continue
+		}
+		root := rule
+		for r.parent[root] != nil {
+			root = r.parent[root]
+		}
+		if !isExternal(root.Label()) {
+			ret[rule.Label()] = root
+		}
+	}
+	return ret
+}
+
+// isExternal returns true if l is in an external repository, or in the //external package of bind rules.
+func isExternal(l bazel.Label) bool {
+	pkgName, _ := l.Split()
+	return strings.HasPrefix(pkgName, "@") || pkgName == "external"
+}
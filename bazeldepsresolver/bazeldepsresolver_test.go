@@ -54,6 +54,7 @@ func TestEndToEnd(t *testing.T) {
 		newResolverArgs newResolverArgs
 		classNames      []jadeplib.ClassName
 		want            map[jadeplib.ClassName][]bazel.Label
+		wantWrappers    map[bazel.Label]bazel.Label
 	}{
 		{
 			name: "basic",
@@ -85,12 +86,12 @@ func TestEndToEnd(t *testing.T) {
 							"guava": {
 								Schema:  "bind",
 								PkgName: "external",
-								Attrs:   attrs{"actual": "@guava//jar:guava"},
+								Attrs:   attrs{"name": "guava", "actual": "@guava//jar:guava"},
 							},
 							"junit": {
 								Schema:  "bind",
 								PkgName: "external",
-								Attrs:   attrs{"actual": "@junit//jar:junit"},
+								Attrs:   attrs{"name": "junit", "actual": "@junit//jar:junit"},
 							},
 						},
 					},
@@ -100,7 +101,7 @@ func TestEndToEnd(t *testing.T) {
 							"guava": {
 								Schema:  "java_import",
 								PkgName: "@guava//jar",
-								Attrs:   attrs{"jars": []string{"guava.jar"}},
+								Attrs:   attrs{"name": "guava", "jars": []string{"guava.jar"}},
 							},
 						},
 					},
@@ -110,7 +111,7 @@ func TestEndToEnd(t *testing.T) {
 							"junit": {
 								Schema:  "java_import",
 								PkgName: "@junit//jar",
-								Attrs:   attrs{"jars": []string{"junit.jar"}},
+								Attrs:   attrs{"name": "junit", "jars": []string{"junit.jar"}},
 							},
 						},
 					},
@@ -131,6 +132,12 @@ func TestEndToEnd(t *testing.T) {
 				"com.ImmutableList": {"//thirdparty/jvm/guava:guava"},
 				"com.RunWith":       {"//thirdparty/jvm/org/junit:junit"},
 			},
+			wantWrappers: map[bazel.Label]bazel.Label{
+				"//external:guava":  "//thirdparty/jvm/guava:guava",
+				"@guava//jar:guava": "//thirdparty/jvm/guava:guava",
+				"//external:junit":  "//thirdparty/jvm/org/junit:junit",
+				"@junit//jar:junit": "//thirdparty/jvm/org/junit:junit",
+			},
 		},
 	}
 	for _, tt := range tests {
@@ -173,6 +180,14 @@ func TestEndToEnd(t *testing.T) {
 			if diff := cmp.Diff(gotLabels, tt.want); diff != "" {
 				t.Errorf("Resolve(%s) diff: (-got +want)\n%s", tt.classNames, diff)
 			}
+
+			gotWrappers := make(map[bazel.Label]bazel.Label)
+			for l, w := range resolver.Wrappers() {
+				gotWrappers[l] = w.Label()
+			}
+			if diff := cmp.Diff(gotWrappers, tt.wantWrappers); diff != "" {
+				t.Errorf("Wrappers() diff: (-got +want)\n%s", diff)
+			}
 		})
 	}
 }
@@ -0,0 +1,179 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bazelinfo finds the install and output bases of a Bazel workspace, which are needed to load its BUILD files.
+package bazelinfo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"context"
+)
+
+// Bases are the values of 'bazel info install_base' and 'bazel info output_base' in a workspace.
+type Bases struct {
+	InstallBase string `json:"install_base"`
+	OutputBase  string `json:"output_base"`
+}
+
+// Options configure Find.
+type Options struct {
+	// Bazel is the Bazel binary to run 'bazel info' with. If empty, bases are only guessed from symlinks.
+	Bazel string
+
+	// Timeout limits how long 'bazel info' may run, which includes starting a Bazel server. No limit if it's not positive.
+	Timeout time.Duration
+
+	// CacheFile records the bases found by 'bazel info' for each workspace, so that it only runs once per workspace.
+	// Not used if empty.
+	CacheFile string
+}
+
+// Find returns the bases of the workspace in workspaceDir.
+// It uses the bases cached in opts.CacheFile if they still exist, or else runs 'bazel info', and falls back to guessing
+// them from the symlinks that a previous build left in the workspace (see FromSymlinks).
+func Find(ctx context.Context, workspaceDir string, opts Options) (Bases, error) {
+	if b, ok := cached(opts.CacheFile, workspaceDir); ok {
+		return b, nil
+	}
+	var errs []string
+	if opts.Bazel != "" {
+		if opts.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+			defer cancel()
+		}
+		b, err := Info(ctx, opts.Bazel, workspaceDir)
+		if err == nil {
+			if opts.CacheFile != "" {
+				if err := cache(opts.CacheFile, workspaceDir, b); err != nil {
+					log.Printf("WARNING: %v", err)
+				}
+			}
+			return b, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	b, err := FromSymlinks(workspaceDir)
+	if err == nil {
+		return b, nil
+	}
+	errs = append(errs, err.Error())
+	return Bases{}, fmt.Errorf("%s", strings.Join(errs, "\n"))
+}
+
+// Info runs 'bazel info install_base output_base' in workspaceDir.
+func Info(ctx context.Context, bazel, workspaceDir string) (Bases, error) {
+	cmd := exec.CommandContext(ctx, bazel, "info", "install_base", "output_base")
+	cmd.Dir = workspaceDir
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return Bases{}, fmt.Errorf("error running '%s info':\n%v\n%s", bazel, err, strings.TrimSpace(stderr.String()))
+	}
+	return parseInfo(stdout.String())
+}
+
+// parseInfo parses the output of 'bazel info' when it's asked for several keys, e.g. "install_base: /foo".
+func parseInfo(output string) (Bases, error) {
+	var b Bases
+	for _, line := range strings.Split(output, "\n") {
+		i := strings.Index(line, ": ")
+		if i == -1 {
+			continue
+		}
+		switch line[:i] {
+		case "install_base":
+			b.InstallBase = strings.TrimSpace(line[i+2:])
+		case "output_base":
+			b.OutputBase = strings.TrimSpace(line[i+2:])
+		}
+	}
+	if b.InstallBase == "" || b.OutputBase == "" {
+		return Bases{}, fmt.Errorf("'bazel info' didn't report install_base and output_base:\n%s", output)
+	}
+	return b, nil
+}
+
+// FromSymlinks guesses the bases from the bazel-out symlink in workspaceDir, which points into the output base,
+// and the install symlink in the output base. Both only exist after the workspace was built.
+func FromSymlinks(workspaceDir string) (Bases, error) {
+	bazelOut, err := os.Readlink(filepath.Join(workspaceDir, "bazel-out"))
+	if err != nil {
+		return Bases{}, fmt.Errorf("couldn't resolve the bazel-out/ symlink: %v", err)
+	}
+	outputBase := filepath.Dir(filepath.Dir(filepath.Dir(bazelOut)))
+	installBase, err := os.Readlink(filepath.Join(outputBase, "install"))
+	if err != nil {
+		return Bases{}, fmt.Errorf("couldn't resolve the install base symlink: %v", err)
+	}
+	return Bases{InstallBase: installBase, OutputBase: outputBase}, nil
+}
+
+// cached returns the bases of workspaceDir in cacheFile, if both still exist.
+// Upgrading Bazel changes the install base, and 'bazel clean --expunge' removes the output base.
+func cached(cacheFile, workspaceDir string) (Bases, bool) {
+	if cacheFile == "" {
+		return Bases{}, false
+	}
+	b, ok := readCache(cacheFile)[workspaceDir]
+	if !ok || !isDir(b.InstallBase) || !isDir(b.OutputBase) {
+		return Bases{}, false
+	}
+	return b, true
+}
+
+// readCache returns the bases in cacheFile by workspace. Errors result in an empty cache, which only costs a 'bazel info'.
+func readCache(cacheFile string) map[string]Bases {
+	ret := make(map[string]Bases)
+	if b, err := ioutil.ReadFile(cacheFile); err == nil {
+		json.Unmarshal(b, &ret)
+	}
+	return ret
+}
+
+// cache records b as the bases of workspaceDir in cacheFile, creating directories as needed.
+func cache(cacheFile, workspaceDir string, b Bases) error {
+	entries := readCache(cacheFile)
+	entries[workspaceDir] = b
+	content, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(cacheFile), 0755); err != nil {
+		return fmt.Errorf("error caching Bazel's bases in %s:\n%v", cacheFile, err)
+	}
+	if err := ioutil.WriteFile(cacheFile, append(content, '\n'), 0644); err != nil {
+		return fmt.Errorf("error caching Bazel's bases in %s:\n%v", cacheFile, err)
+	}
+	return nil
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
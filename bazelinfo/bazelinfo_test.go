@@ -0,0 +1,152 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bazelinfo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"context"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseInfo(t *testing.T) {
+	got, err := parseInfo("Starting local Bazel server and connecting to it...\ninstall_base: /install/abc\noutput_base: /cache/bazel/_bazel_u/123\n")
+	if err != nil {
+		t.Fatalf("parseInfo returned error %v, want nil", err)
+	}
+	if diff := cmp.Diff(got, Bases{InstallBase: "/install/abc", OutputBase: "/cache/bazel/_bazel_u/123"}); diff != "" {
+		t.Errorf("parseInfo returned diff (-got +want):\n%s", diff)
+	}
+	if _, err := parseInfo("install_base: /install/abc\n"); err == nil {
+		t.Errorf("parseInfo of output without output_base returned nil error, want an error")
+	}
+}
+
+// fakeWorkspace creates a workspace, together with install and output bases, and returns their paths.
+// If built is true, the workspace has the symlinks a build would leave.
+func fakeWorkspace(t *testing.T, tmpDir string, built bool) (workspaceDir string, want Bases) {
+	workspaceDir = filepath.Join(tmpDir, "ws")
+	want = Bases{InstallBase: filepath.Join(tmpDir, "install"), OutputBase: filepath.Join(tmpDir, "output")}
+	execRoot := filepath.Join(want.OutputBase, "execroot", "ws")
+	for _, d := range []string{workspaceDir, want.InstallBase, filepath.Join(execRoot, "bazel-out")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !built {
+		return workspaceDir, want
+	}
+	if err := os.Symlink(filepath.Join(execRoot, "bazel-out"), filepath.Join(workspaceDir, "bazel-out")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(want.InstallBase, filepath.Join(want.OutputBase, "install")); err != nil {
+		t.Fatal(err)
+	}
+	return workspaceDir, want
+}
+
+// fakeBazel writes a script that behaves like 'bazel info install_base output_base', and appends to a log when it runs.
+func fakeBazel(t *testing.T, tmpDir string, b Bases, sleep string) (bazel string, runLog string) {
+	bazel = filepath.Join(tmpDir, "bazel")
+	runLog = filepath.Join(tmpDir, "runs")
+	script := "#!/bin/sh\necho run >> " + runLog + "\nsleep " + sleep + "\necho install_base: " + b.InstallBase + "\necho output_base: " + b.OutputBase + "\n"
+	if err := ioutil.WriteFile(bazel, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return bazel, runLog
+}
+
+func runs(runLog string) int {
+	b, _ := ioutil.ReadFile(runLog)
+	return len(b) / len("run\n")
+}
+
+func TestFind(t *testing.T) {
+	tests := []struct {
+		desc     string
+		built    bool
+		bazel    bool
+		sleep    string
+		wantErr  bool
+		wantRuns int
+	}{
+		{desc: "bazel info in a fresh clone", bazel: true, sleep: "0", wantRuns: 1},
+		{desc: "symlinks without bazel info", built: true},
+		{desc: "symlinks when bazel info times out", built: true, bazel: true, sleep: "2", wantRuns: 1},
+		{desc: "a fresh clone without bazel info", wantErr: true},
+	}
+	for _, tt := range tests {
+		tmpDir, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmpDir)
+		workspaceDir, want := fakeWorkspace(t, tmpDir, tt.built)
+		opts := Options{Timeout: time.Second, CacheFile: filepath.Join(tmpDir, "cache", "bazel_info.json")}
+		var runLog string
+		if tt.bazel {
+			opts.Bazel, runLog = fakeBazel(t, tmpDir, want, tt.sleep)
+		}
+
+		// The second call uses the cache, if the first ran 'bazel info' successfully.
+		for i := 0; i < 2; i++ {
+			got, err := Find(context.Background(), workspaceDir, opts)
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Errorf("%s: Find returned error %v, want error: %t", tt.desc, err, tt.wantErr)
+				continue
+			}
+			if err != nil {
+				continue
+			}
+			if diff := cmp.Diff(got, want); diff != "" {
+				t.Errorf("%s: Find returned diff (-got +want):\n%s", tt.desc, diff)
+			}
+		}
+		if tt.bazel && tt.sleep == "0" {
+			if got := runs(runLog); got != tt.wantRuns {
+				t.Errorf("%s: bazel info ran %d times, want %d", tt.desc, got, tt.wantRuns)
+			}
+		}
+	}
+}
+
+func TestFindIgnoresStaleCache(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	workspaceDir, want := fakeWorkspace(t, tmpDir, false)
+	cacheFile := filepath.Join(tmpDir, "bazel_info.json")
+	if err := cache(cacheFile, workspaceDir, Bases{InstallBase: filepath.Join(tmpDir, "old_install"), OutputBase: want.OutputBase}); err != nil {
+		t.Fatal(err)
+	}
+	bazel, runLog := fakeBazel(t, tmpDir, want, "0")
+
+	got, err := Find(context.Background(), workspaceDir, Options{Bazel: bazel, CacheFile: cacheFile})
+	if err != nil {
+		t.Fatalf("Find returned error %v, want nil", err)
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("Find returned diff (-got +want):\n%s", diff)
+	}
+	if got := runs(runLog); got != 1 {
+		t.Errorf("bazel info ran %d times, want 1", got)
+	}
+}
@@ -0,0 +1,307 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bench measures the latency and quality of Jadep over a corpus of Java files.
+// Quality is measured against a golden file that lists the deps Jadep is expected to add for each file.
+package bench
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/pkgloading"
+)
+
+// Sample is the outcome of running Jadep on a single file of the corpus.
+type Sample struct {
+	// File is the name of the file, relative to the corpus directory.
+	File string
+
+	// Phases maps the name of each phase (e.g., "parse") to the time it took.
+	Phases map[string]time.Duration
+
+	// Added are the deps Jadep would add, taking the top-ranked candidate for each class.
+	Added []bazel.Label
+
+	// Err is set if Jadep couldn't process the file.
+	Err error
+}
+
+// Percentiles summarizes the latencies of a phase.
+type Percentiles struct {
+	P50, P90, P99, Max time.Duration
+}
+
+// Summary aggregates the samples of a run over a corpus.
+type Summary struct {
+	Files  int
+	Errors int
+
+	// Phases maps the name of each phase to the percentiles of its latency.
+	Phases map[string]Percentiles
+
+	// Graded is the number of files that have an entry in the golden file.
+	// Precision and recall are computed over these files only.
+	Graded                                        int
+	TruePositives, FalsePositives, FalseNegatives int
+}
+
+// Precision returns the fraction of added deps that are in the golden file, or 1 if no deps were added.
+func (s *Summary) Precision() float64 {
+	if s.TruePositives+s.FalsePositives == 0 {
+		return 1
+	}
+	return float64(s.TruePositives) / float64(s.TruePositives+s.FalsePositives)
+}
+
+// Recall returns the fraction of deps in the golden file that were added, or 1 if the golden file lists none.
+func (s *Summary) Recall() float64 {
+	if s.TruePositives+s.FalseNegatives == 0 {
+		return 1
+	}
+	return float64(s.TruePositives) / float64(s.TruePositives+s.FalseNegatives)
+}
+
+// Summarize computes latency percentiles of samples, and their precision and recall versus golden.
+// golden maps file names (relative to the corpus directory) to the deps Jadep is expected to add.
+func Summarize(samples []*Sample, golden map[string][]bazel.Label) *Summary {
+	ret := &Summary{Files: len(samples), Phases: make(map[string]Percentiles)}
+	durations := make(map[string][]time.Duration)
+	for _, s := range samples {
+		if s.Err != nil {
+			ret.Errors++
+			continue
+		}
+		for phase, d := range s.Phases {
+			durations[phase] = append(durations[phase], d)
+		}
+		want, ok := golden[s.File]
+		if !ok {
+			continue
+		}
+		ret.Graded++
+		wantSet := make(map[bazel.Label]bool)
+		for _, l := range want {
+			wantSet[l] = true
+		}
+		gotSet := make(map[bazel.Label]bool)
+		for _, l := range s.Added {
+			if gotSet[l] {
+				continue
+			}
+			gotSet[l] = true
+			if wantSet[l] {
+				ret.TruePositives++
+			} else {
+				ret.FalsePositives++
+			}
+		}
+		for l := range wantSet {
+			if !gotSet[l] {
+				ret.FalseNegatives++
+			}
+		}
+	}
+	for phase, ds := range durations {
+		ret.Phases[phase] = percentiles(ds)
+	}
+	return ret
+}
+
+// percentiles returns the percentiles of ds, using the nearest-rank method.
+// ds must not be empty, and is sorted in place.
+func percentiles(ds []time.Duration) Percentiles {
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	rank := func(p int) time.Duration {
+		i := (p*len(ds)+99)/100 - 1
+		if i < 0 {
+			i = 0
+		}
+		return ds[i]
+	}
+	return Percentiles{P50: rank(50), P90: rank(90), P99: rank(99), Max: ds[len(ds)-1]}
+}
+
+// Write writes a human-readable form of s to w.
+func (s *Summary) Write(w io.Writer) {
+	fmt.Fprintf(w, "Files: %d (%d errors)\n", s.Files, s.Errors)
+	var phases []string
+	for p := range s.Phases {
+		phases = append(phases, p)
+	}
+	sort.Strings(phases)
+	for _, p := range phases {
+		pc := s.Phases[p]
+		fmt.Fprintf(w, "%-12s p50 %v\tp90 %v\tp99 %v\tmax %v\n", p, pc.P50, pc.P90, pc.P99, pc.Max)
+	}
+	if s.Graded > 0 {
+		fmt.Fprintf(w, "Graded files: %d\n", s.Graded)
+		fmt.Fprintf(w, "Precision: %.3f (%d/%d)\n", s.Precision(), s.TruePositives, s.TruePositives+s.FalsePositives)
+		fmt.Fprintf(w, "Recall:    %.3f (%d/%d)\n", s.Recall(), s.TruePositives, s.TruePositives+s.FalseNegatives)
+	}
+}
+
+// ReadGolden reads a golden deps file.
+// Each line has a file name relative to the corpus directory, followed by the deps Jadep is expected to add for it, separated by whitespace.
+// A file name with no deps means Jadep is expected to add nothing.
+// Empty lines and lines starting with '#' are ignored.
+func ReadGolden(fileName string) (map[string][]bazel.Label, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("error opening golden deps file %s:\n%v", fileName, err)
+	}
+	defer f.Close()
+	ret := make(map[string][]bazel.Label)
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		file := filepath.FromSlash(fields[0])
+		if ret[file] == nil {
+			ret[file] = []bazel.Label{}
+		}
+		for _, d := range fields[1:] {
+			l, err := bazel.ParseAbsoluteLabel(d)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", fileName, lineNum, err)
+			}
+			ret[file] = append(ret[file], l)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading golden deps file %s:\n%v", fileName, err)
+	}
+	return ret, nil
+}
+
+// CorpusFiles returns the names of the Java files under dir, relative to dir and sorted.
+func CorpusFiles(dir string) ([]string, error) {
+	var ret []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, ".java") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		ret = append(ret, rel)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing corpus %s:\n%v", dir, err)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// RecordingLoader is a Loader that records the packages it loads, so they can be replayed by a ReplayLoader.
+// This makes benchmarks reproducible and independent of the PackageLoader service.
+type RecordingLoader struct {
+	pkgloading.Loader
+
+	mu   sync.Mutex
+	pkgs map[string]*bazel.Package
+}
+
+// Load loads packages using the underlying Loader, and records them.
+func (l *RecordingLoader) Load(ctx context.Context, packages []string) (map[string]*bazel.Package, error) {
+	ret, _, err := l.LoadWithErrors(ctx, packages)
+	return ret, err
+}
+
+// LoadWithErrors is like Load, but also returns the errors of the packages that failed to evaluate, if the underlying Loader reports them.
+// The errors aren't recorded.
+func (l *RecordingLoader) LoadWithErrors(ctx context.Context, packages []string) (map[string]*bazel.Package, []*pkgloading.PackageError, error) {
+	ret, pkgErrs, err := pkgloading.LoadWithErrors(ctx, l.Loader, packages)
+	if err != nil {
+		return nil, nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.pkgs == nil {
+		l.pkgs = make(map[string]*bazel.Package)
+	}
+	for name, pkg := range ret {
+		l.pkgs[name] = pkg
+	}
+	return ret, pkgErrs, nil
+}
+
+// Save writes the recorded packages to fileName, in the format ReplayLoader reads.
+func (l *RecordingLoader) Save(fileName string) error {
+	l.mu.Lock()
+	b, err := json.Marshal(l.pkgs)
+	l.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("error serializing recorded packages:\n%v", err)
+	}
+	if err := ioutil.WriteFile(fileName, b, 0644); err != nil {
+		return fmt.Errorf("error writing recorded packages to %s:\n%v", fileName, err)
+	}
+	return nil
+}
+
+// ReplayLoader is a Loader that returns packages recorded by a RecordingLoader.
+// Packages that weren't recorded aren't returned, as if they didn't exist.
+type ReplayLoader struct {
+	pkgs map[string]*bazel.Package
+}
+
+// NewReplayLoader reads the packages that RecordingLoader.Save wrote to fileName.
+func NewReplayLoader(fileName string) (*ReplayLoader, error) {
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("error reading recorded packages:\n%v", err)
+	}
+	var pkgs map[string]*bazel.Package
+	if err := json.Unmarshal(b, &pkgs); err != nil {
+		return nil, fmt.Errorf("error parsing recorded packages in %s:\n%v", fileName, err)
+	}
+	for _, pkg := range pkgs {
+		for _, r := range pkg.Rules {
+			for name, v := range r.Attrs {
+				r.Attrs[name] = bazel.AttrFromJSON(v)
+			}
+		}
+	}
+	return &ReplayLoader{pkgs}, nil
+}
+
+// Load returns the recorded packages among 'packages'.
+func (l *ReplayLoader) Load(ctx context.Context, packages []string) (map[string]*bazel.Package, error) {
+	ret := make(map[string]*bazel.Package)
+	for _, p := range packages {
+		if pkg, ok := l.pkgs[p]; ok {
+			ret[p] = pkg
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,152 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bench
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/loadertest"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSummarize(t *testing.T) {
+	ms := time.Millisecond
+	samples := []*Sample{
+		{File: "a/A.java", Phases: map[string]time.Duration{"parse": 1 * ms}, Added: []bazel.Label{"//x:X", "//y:Y", "//x:X"}},
+		{File: "a/B.java", Phases: map[string]time.Duration{"parse": 3 * ms}, Added: []bazel.Label{"//z:Z"}},
+		{File: "a/C.java", Phases: map[string]time.Duration{"parse": 2 * ms}},
+		{File: "a/D.java", Err: os.ErrNotExist},
+	}
+	golden := map[string][]bazel.Label{
+		"a/A.java": {"//x:X", "//w:W"},
+		"a/C.java": {},
+		"a/D.java": {"//d:D"},
+	}
+	got := Summarize(samples, golden)
+	want := &Summary{
+		Files:          4,
+		Errors:         1,
+		Phases:         map[string]Percentiles{"parse": {P50: 2 * ms, P90: 3 * ms, P99: 3 * ms, Max: 3 * ms}},
+		Graded:         2,
+		TruePositives:  1,
+		FalsePositives: 1,
+		FalseNegatives: 1,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Summarize returned diff (-want +got):\n%s", diff)
+	}
+	if got.Precision() != 0.5 || got.Recall() != 0.5 {
+		t.Errorf("Precision() = %v, Recall() = %v, want 0.5, 0.5", got.Precision(), got.Recall())
+	}
+}
+
+func TestReadGolden(t *testing.T) {
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	content := `# comment
+a/A.java //x:X //y:Y
+
+a/B.java
+`
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	got, err := ReadGolden(f.Name())
+	if err != nil {
+		t.Fatalf("ReadGolden returned error %v, want nil", err)
+	}
+	want := map[string][]bazel.Label{
+		filepath.FromSlash("a/A.java"): {"//x:X", "//y:Y"},
+		filepath.FromSlash("a/B.java"): {},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ReadGolden returned diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	type Attrs = map[string]interface{}
+	pkgs := map[string]*bazel.Package{
+		"x": {
+			Path:  "/root/x",
+			Files: map[string]string{"Foo.java": ""},
+			Rules: map[string]*bazel.Rule{
+				"Foo": bazel.NewRule("java_library", "x", "Foo", Attrs{"srcs": []string{"Foo.java"}, "testonly": true, "shard_count": 3}),
+			},
+		},
+		"y": {},
+	}
+	ctx := context.Background()
+	recorder := &RecordingLoader{Loader: &loadertest.StubLoader{Pkgs: pkgs}}
+	if _, err := recorder.Load(ctx, []string{"x"}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "pkgs.json")
+	if err := recorder.Save(fileName); err != nil {
+		t.Fatalf("Save returned error %v, want nil", err)
+	}
+
+	replayer, err := NewReplayLoader(fileName)
+	if err != nil {
+		t.Fatalf("NewReplayLoader returned error %v, want nil", err)
+	}
+	got, err := replayer.Load(ctx, []string{"x", "y"})
+	if err != nil {
+		t.Fatalf("Load returned error %v, want nil", err)
+	}
+	want := map[string]*bazel.Package{"x": pkgs["x"]}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Load returned diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestCorpusFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, f := range []string{"b/B.java", "a/A.java", "a/BUILD", "C.java"} {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(f)), os.ModePerm)
+		if err := ioutil.WriteFile(filepath.Join(dir, f), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := CorpusFiles(dir)
+	if err != nil {
+		t.Fatalf("CorpusFiles returned error %v, want nil", err)
+	}
+	want := []string{"C.java", filepath.FromSlash("a/A.java"), filepath.FromSlash("b/B.java")}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("CorpusFiles returned diff (-want +got):\n%s", diff)
+	}
+}
@@ -16,15 +16,19 @@
 package buildozer
 
 import (
-	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 
+	"github.com/bazelbuild/buildtools/build"
 	"github.com/bazelbuild/buildtools/edit"
 	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/filter"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
 )
 
 // Ref returns a token that Buildozer can use to manipulate a function call.
@@ -32,70 +36,527 @@ import (
 // Otherwise, if the macro has a name attribute, the reference looks like a label whose name is the macro's name.
 // Finally, if there's no name attribute, the reference is //<pkg>:<line> where line is where the macro starts in the BUILD file.
 func Ref(rule *bazel.Rule) (string, error) {
-	if _, ok := rule.Attrs["generator_function"]; !ok {
+	if rule.GeneratorFunction() == "" {
 		// Not a macro
 		return string(rule.Label()), nil
 	}
-	name, ok := rule.Attrs["generator_name"].(string)
-	if !ok {
-		loc, _ := rule.Attrs["generator_location"].(string)
-		parts := strings.Split(loc, ":")
-		if len(parts) != 2 {
-			return "", fmt.Errorf("expected rule's generator_location (%q) to have exactly one colon", loc)
+	if _, ok := rule.Attrs["generator_name"].(string); ok {
+		return string(rule.SourceLabel()), nil
+	}
+	loc, _ := rule.Attrs["generator_location"].(string)
+	parts := strings.Split(loc, ":")
+	if len(parts) != 2 {
+		return "", fmt.Errorf("expected rule's generator_location (%q) to have exactly one colon", loc)
+	}
+	return "//" + rule.PkgName + ":%" + parts[1], nil
+}
+
+// PostEditHook, if set, is called after the functions in this package edit BUILD files, e.g. to run a linter or
+// to add license headers. buildFiles are the absolute paths of the edited BUILD files, and newFiles are those of them
+// that were created by the edit.
+// If PostEditHook returns an error, the BUILD files are restored to their contents before the edit, and the edit fails.
+var PostEditHook func(buildFiles, newFiles []string) error
+
+// withPostEditHook runs 'edit', which edits the BUILD files of the packages pkgNames and returns the ones it created,
+// and then runs PostEditHook.
+func withPostEditHook(workspaceRoot string, pkgNames []string, edit func() (newFiles []string, err error)) error {
+	hook := PostEditHook
+	if hook == nil {
+		_, err := edit()
+		return err
+	}
+	type snapshot struct {
+		data []byte
+		mode os.FileMode
+	}
+	var buildFiles []string
+	before := make(map[string]snapshot)
+	seen := make(map[string]bool)
+	for _, p := range pkgNames {
+		f := BuildFileOf(workspaceRoot, p)
+		if seen[f] {
+			continue
+		}
+		seen[f] = true
+		buildFiles = append(buildFiles, f)
+		if info, err := os.Stat(f); err == nil {
+			data, err := ioutil.ReadFile(f)
+			if err != nil {
+				return fmt.Errorf("error reading %s:\n%v", f, err)
+			}
+			before[f] = snapshot{data, info.Mode()}
 		}
-		name = "%" + parts[1]
 	}
-	return "//" + rule.PkgName + ":" + name, nil
+	sort.Strings(buildFiles)
+
+	newFiles, err := edit()
+	if err != nil {
+		return err
+	}
+	if err := hook(buildFiles, newFiles); err != nil {
+		for _, f := range buildFiles {
+			var restoreErr error
+			if s, ok := before[f]; ok {
+				restoreErr = ioutil.WriteFile(f, s.data, s.mode)
+			} else {
+				restoreErr = os.Remove(f)
+			}
+			if restoreErr != nil && !os.IsNotExist(restoreErr) {
+				return fmt.Errorf("post-edit hook rejected the edit of %s, and it couldn't be undone:\n%v\n%v", strings.Join(buildFiles, ", "), err, restoreErr)
+			}
+		}
+		return fmt.Errorf("post-edit hook rejected the edit of %s:\n%v", strings.Join(buildFiles, ", "), err)
+	}
+	return nil
+}
+
+// BuildFileOf returns the absolute path of the BUILD file of the package pkgName, which is named BUILD or BUILD.bazel.
+// The file doesn't necessarily exist.
+func BuildFileOf(workspaceRoot, pkgName string) string {
+	ret := filepath.Join(workspaceRoot, pkgName, "BUILD")
+	if _, err := os.Stat(ret); os.IsNotExist(err) {
+		if alt := ret + ".bazel"; fileExists(alt) {
+			return alt
+		}
+	}
+	return ret
+}
+
+func fileExists(fileName string) bool {
+	_, err := os.Stat(fileName)
+	return err == nil
 }
 
 // NewRule uses Buildozer to create a new rule based on the attributes of 'rule'.
-// Used attributes are Name, PkgName, Schema and srcs.
+// Used attributes are Name, PkgName, Schema, srcs, and if present, deps, visibility, testonly and any other attribute whose value is
+// a list of strings (e.g. licenses) or a string (e.g. size), except the generator_* attributes of rules created by macros.
 func NewRule(workspaceRoot string, rule *bazel.Rule) error {
+	return withPostEditHook(workspaceRoot, []string{rule.PkgName}, func() ([]string, error) {
+		return newRule(workspaceRoot, rule)
+	})
+}
+
+// newRule implements NewRule without running PostEditHook, and returns the BUILD file it created, if any.
+func newRule(workspaceRoot string, rule *bazel.Rule) ([]string, error) {
 	pkgName := rule.PkgName
 	name := rule.Name()
-	buildFile := filepath.Join(workspaceRoot, pkgName, "BUILD")
+	var newFiles []string
+	buildFile := BuildFileOf(workspaceRoot, pkgName)
 	if _, err := os.Stat(buildFile); os.IsNotExist(err) {
 		if err := ioutil.WriteFile(buildFile, nil, 0666); err != nil {
-			return fmt.Errorf("error writing %s:\n%v", buildFile, err)
+			return nil, fmt.Errorf("error writing %s:\n%v", buildFile, err)
 		}
+		newFiles = append(newFiles, buildFile)
 	}
 	err := exec(workspaceRoot, []string{
 		fmt.Sprintf("new %s %s", rule.Schema, name),
 		fmt.Sprintf("//%s:__pkg__", pkgName),
 	}, []int{0})
 	if err != nil {
-		return err
+		return newFiles, err
 	}
-	err = exec(workspaceRoot, []string{
-		fmt.Sprintf("add srcs %s", strings.Join(rule.StringListAttr("srcs"), " ")),
-		fmt.Sprintf("//%s:%s", pkgName, name),
-	}, []int{0})
+	label := fmt.Sprintf("//%s:%s", pkgName, name)
+	cmds := []string{fmt.Sprintf("add srcs %s", strings.Join(rule.StringListAttr("srcs"), " "))}
+	attrs := []string{"deps", "visibility"}
+	var others []string
+	for attr, v := range rule.Attrs {
+		if _, ok := v.([]string); ok && attr != "srcs" && attr != "deps" && attr != "visibility" {
+			others = append(others, attr)
+		}
+	}
+	sort.Strings(others)
+	for _, attr := range append(attrs, others...) {
+		if values := rule.StringListAttr(attr); len(values) > 0 {
+			cmds = append(cmds, fmt.Sprintf("add %s %s", attr, strings.Join(values, " ")))
+		}
+	}
+	var strAttrs []string
+	for attr, v := range rule.Attrs {
+		if _, ok := v.(string); ok && attr != "name" && !strings.HasPrefix(attr, "generator_") {
+			strAttrs = append(strAttrs, attr)
+		}
+	}
+	sort.Strings(strAttrs)
+	for _, attr := range strAttrs {
+		value := rule.Attrs[attr].(string)
+		// Buildozer writes values of attributes it doesn't know to be strings verbatim.
+		if !edit.IsString(attr) {
+			value = strconv.Quote(value)
+		}
+		cmds = append(cmds, fmt.Sprintf("set %s %s", attr, strings.Replace(value, " ", `\ `, -1)))
+	}
+	if rule.BoolAttr("testonly", false) {
+		cmds = append(cmds, "set testonly 1")
+	}
+	for _, cmd := range cmds {
+		if err := exec(workspaceRoot, []string{cmd, label}, []int{0}); err != nil {
+			return newFiles, err
+		}
+	}
+	return newFiles, nil
+}
+
+// AddSrcs uses Buildozer to add 'srcs' (file names relative to rule's package) to the srcs of an existing rule.
+func AddSrcs(workspaceRoot string, rule *bazel.Rule, srcs []string) error {
+	ref, err := Ref(rule)
 	if err != nil {
-		return err
+		return fmt.Errorf("error getting buildozer reference for %v:\n%v", rule, err)
 	}
-	return nil
+	return withPostEditHook(workspaceRoot, []string{rule.PkgName}, func() ([]string, error) {
+		return nil, exec(workspaceRoot, []string{fmt.Sprintf("add srcs %s", strings.Join(srcs, " ")), ref}, []int{0, 3})
+	})
+}
+
+// SetTestClass uses Buildozer to set the test_class attribute of an existing rule.
+func SetTestClass(workspaceRoot string, rule *bazel.Rule, testClass string) error {
+	ref, err := Ref(rule)
+	if err != nil {
+		return fmt.Errorf("error getting buildozer reference for %v:\n%v", rule, err)
+	}
+	return withPostEditHook(workspaceRoot, []string{rule.PkgName}, func() ([]string, error) {
+		return nil, exec(workspaceRoot, []string{"set test_class " + testClass, ref}, []int{0})
+	})
+}
+
+// SplitRule creates the new rules in 'plan', removes their srcs from the rule being split, and makes it export them.
+func SplitRule(workspaceRoot string, plan *jadeplib.SplitPlan) error {
+	ref, err := Ref(plan.Rule)
+	if err != nil {
+		return fmt.Errorf("error getting buildozer reference for %v:\n%v", plan.Rule, err)
+	}
+	pkgNames := []string{plan.Rule.PkgName}
+	for _, r := range plan.NewRules {
+		pkgNames = append(pkgNames, r.PkgName)
+	}
+	return withPostEditHook(workspaceRoot, pkgNames, func() ([]string, error) {
+		var movedSrcs, exports, newFiles []string
+		for _, r := range plan.NewRules {
+			created, err := newRule(workspaceRoot, r)
+			newFiles = append(newFiles, created...)
+			if err != nil {
+				return newFiles, err
+			}
+			movedSrcs = append(movedSrcs, r.StringListAttr("srcs")...)
+			exports = append(exports, ":"+r.Name())
+		}
+		err := exec(workspaceRoot, []string{fmt.Sprintf("remove srcs %s", strings.Join(movedSrcs, " ")), ref}, []int{0, 3})
+		if err != nil {
+			return newFiles, err
+		}
+		return newFiles, exec(workspaceRoot, []string{fmt.Sprintf("add exports %s", strings.Join(exports, " ")), ref}, []int{0, 3})
+	})
+}
+
+// MoveFile moves plan.From out of the srcs of its rules, deleting the rules that have no srcs left, and creates plan.NewRule,
+// or adds its srcs and deps to the existing rule by its name if plan.Extend is set.
+func MoveFile(workspaceRoot string, plan *jadeplib.MovePlan) error {
+	var oldRules []*bazel.Rule
+	for r := range plan.OldSrcs {
+		oldRules = append(oldRules, r)
+	}
+	sort.Slice(oldRules, func(i, j int) bool { return oldRules[i].Label() < oldRules[j].Label() })
+	pkgNames := []string{plan.NewRule.PkgName}
+	for _, r := range oldRules {
+		pkgNames = append(pkgNames, r.PkgName)
+	}
+	return withPostEditHook(workspaceRoot, pkgNames, func() ([]string, error) {
+		for _, r := range oldRules {
+			ref, err := Ref(r)
+			if err != nil {
+				return nil, fmt.Errorf("error getting buildozer reference for %v:\n%v", r, err)
+			}
+			cmd := "remove srcs " + plan.OldSrcs[r]
+			if plan.Deleted(r) {
+				cmd = "delete"
+			}
+			if err := exec(workspaceRoot, []string{cmd, ref}, []int{0, 3}); err != nil {
+				return nil, err
+			}
+		}
+		if !plan.Extend {
+			return newRule(workspaceRoot, plan.NewRule)
+		}
+		var attrs []string
+		for attr, v := range plan.NewRule.Attrs {
+			if _, ok := v.([]string); ok && attr != "visibility" {
+				attrs = append(attrs, attr)
+			}
+		}
+		sort.Strings(attrs)
+		for _, attr := range attrs {
+			if values := plan.NewRule.StringListAttr(attr); len(values) > 0 {
+				if err := exec(workspaceRoot, []string{fmt.Sprintf("add %s %s", attr, strings.Join(values, " ")), string(plan.NewRule.Label())}, []int{0, 3}); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return nil, nil
+	})
+}
+
+// MakeVisible creates or extends plan.Group to list plan.Packages, if it's set, and adds plan.AddVisibility to the visibility of plan.Rule.
+func MakeVisible(workspaceRoot string, plan *jadeplib.VisibilityPlan) error {
+	ref, err := Ref(plan.Rule)
+	if err != nil {
+		return fmt.Errorf("error getting buildozer reference for %v:\n%v", plan.Rule, err)
+	}
+	return withPostEditHook(workspaceRoot, []string{plan.Rule.PkgName}, func() ([]string, error) {
+		if plan.Group != "" {
+			pkgName, name := plan.Group.Split()
+			if plan.NewGroup {
+				if err := exec(workspaceRoot, []string{"new package_group " + name, fmt.Sprintf("//%s:__pkg__", pkgName)}, []int{0}); err != nil {
+					return nil, err
+				}
+			}
+			var specs []string
+			for _, p := range plan.Packages {
+				specs = append(specs, "//"+p)
+			}
+			if err := exec(workspaceRoot, []string{"add packages " + strings.Join(specs, " "), string(plan.Group)}, []int{0, 3}); err != nil {
+				return nil, err
+			}
+		}
+		if err := exec(workspaceRoot, []string{"remove visibility //visibility:private", ref}, []int{0, 3}); err != nil {
+			return nil, err
+		}
+		return nil, exec(workspaceRoot, []string{"add visibility " + strings.Join(plan.AddVisibility, " "), ref}, []int{0, 3})
+	})
+}
+
+// ParseDepsAttributes parses a comma-separated list of kind=attribute pairs, e.g. "kt_jvm_library=associates,my_macro=runtime_deps".
+func ParseDepsAttributes(s string) (map[string]string, error) {
+	ret := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.Split(pair, "=")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("expected kind=attribute, got %q", pair)
+		}
+		ret[parts[0]] = parts[1]
+	}
+	return ret, nil
 }
 
 // AddDepsToRules on (rule -> labels) adds labels to rule.
+// The edited attribute is determined by filter.DepsAttributeByKind, except for umbrella targets whose exports are edited.
 func AddDepsToRules(workspaceRoot string, missingDeps map[*bazel.Rule][]bazel.Label) error {
-	for rule, labels := range missingDeps {
-		labelToModify, err := Ref(rule)
+	return editDeps(workspaceRoot, "add", missingDeps)
+}
+
+// RemoveDepsFromRules on (rule -> labels) removes labels from rule.
+// It undoes AddDepsToRules.
+func RemoveDepsFromRules(workspaceRoot string, deps map[*bazel.Rule][]bazel.Label) error {
+	return editDeps(workspaceRoot, "remove", deps)
+}
+
+// RemoveDepsFromAttributes on (rule -> attribute -> labels) removes labels from the attribute of rule they're mapped to.
+// Unlike RemoveDepsFromRules, the edited attributes don't depend on the kind of rule, e.g. to remove deps from
+// wherever they were found.
+func RemoveDepsFromAttributes(workspaceRoot string, deps map[*bazel.Rule]map[string][]bazel.Label) error {
+	var cmds [][]string
+	var pkgNames []string
+	for _, rule := range sortedRules(deps) {
+		ref, err := Ref(rule)
 		if err != nil {
 			return fmt.Errorf("error getting buildozer reference for %v:\n%v", rule, err)
 		}
-		var deps bytes.Buffer
-		for _, l := range labels {
-			deps.WriteString(string(l))
-			deps.WriteString(" ")
+		var attrs []string
+		for attr, labels := range deps[rule] {
+			if len(labels) > 0 {
+				attrs = append(attrs, attr)
+			}
+		}
+		sort.Strings(attrs)
+		for _, attr := range attrs {
+			var strs []string
+			for _, l := range deps[rule][attr] {
+				strs = append(strs, string(l))
+			}
+			cmds = append(cmds, []string{fmt.Sprintf("remove %s %s", attr, strings.Join(strs, " ")), ref})
 		}
-		err = exec(workspaceRoot, []string{fmt.Sprintf("add deps %s", deps.String()), labelToModify}, []int{0, 3})
+		if len(attrs) > 0 {
+			pkgNames = append(pkgNames, rule.PkgName)
+		}
+	}
+	return withPostEditHook(workspaceRoot, pkgNames, func() ([]string, error) {
+		for _, c := range cmds {
+			if err := exec(workspaceRoot, c, []int{0, 3}); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+}
+
+// sortedRules returns the rules of deps, sorted by label.
+func sortedRules(deps map[*bazel.Rule]map[string][]bazel.Label) []*bazel.Rule {
+	var ret []*bazel.Rule
+	for r := range deps {
+		ret = append(ret, r)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Label() < ret[j].Label() })
+	return ret
+}
+
+// AddDepsCommands returns the Buildozer commands that AddDepsToRules would execute for missingDeps, without executing them.
+// The commands are in the format of Buildozer's -f flag, e.g. "add deps //x:y|//pkg:rule", and are sorted.
+func AddDepsCommands(missingDeps map[*bazel.Rule][]bazel.Label) ([]string, error) {
+	cmds, err := depsCommands("add", missingDeps)
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for _, c := range cmds {
+		ret = append(ret, strings.Join(c, "|"))
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// ProvenanceCommentPrefix starts the comments that AddProvenanceComments attaches to added deps.
+const ProvenanceCommentPrefix = "jadep: for "
+
+// AddProvenanceComments attaches a trailing comment to each dep in addedDeps, naming the class names it was added for
+// according to missingDeps, e.g. "# jadep: for com.foo.Bar".
+// The deps must already have been added, e.g. by AddDepsToRules.
+func AddProvenanceComments(workspaceRoot string, addedDeps map[*bazel.Rule][]bazel.Label, missingDeps map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label) error {
+	cmds, err := provenanceCommentCommands(addedDeps, missingDeps)
+	if err != nil {
+		return err
+	}
+	return withPostEditHook(workspaceRoot, rulePkgNames(addedDeps), func() ([]string, error) {
+		for _, c := range cmds {
+			if err := exec(workspaceRoot, c, []int{0, 3}); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+}
+
+// provenanceCommentCommands returns the Buildozer command lines that AddProvenanceComments executes.
+func provenanceCommentCommands(addedDeps map[*bazel.Rule][]bazel.Label, missingDeps map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label) ([][]string, error) {
+	var ret [][]string
+	for _, rule := range jadeplib.SortedRulesToEdit(addedDeps) {
+		labels := addedDeps[rule]
+		ref, err := Ref(rule)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("error getting buildozer reference for %v:\n%v", rule, err)
 		}
+		for _, l := range labels {
+			var classNames []string
+			for cls, candidates := range missingDeps[rule] {
+				for _, c := range candidates {
+					if c == l {
+						classNames = append(classNames, string(cls))
+						break
+					}
+				}
+			}
+			if len(classNames) == 0 {
+				continue
+			}
+			sort.Strings(classNames)
+			// Buildozer splits commands on unescaped spaces.
+			comment := strings.Replace(ProvenanceCommentPrefix+strings.Join(classNames, ", "), " ", `\ `, -1)
+			ret = append(ret, []string{fmt.Sprintf("comment %s %s %s", filter.DepsAttribute(rule), l, comment), ref})
+		}
+	}
+	return ret, nil
+}
+
+// StripProvenanceComments removes the comments added by AddProvenanceComments from the BUILD file fileName.
+// The file is only rewritten if it has such comments.
+func StripProvenanceComments(fileName string) error {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return fmt.Errorf("error reading %s:\n%v", fileName, err)
+	}
+	f, err := build.Parse(fileName, data)
+	if err != nil {
+		return fmt.Errorf("error parsing %s:\n%v", fileName, err)
+	}
+	changed := false
+	strip := func(comments []build.Comment) []build.Comment {
+		var ret []build.Comment
+		for _, c := range comments {
+			if strings.HasPrefix(strings.TrimSpace(strings.TrimPrefix(c.Token, "#")), ProvenanceCommentPrefix) {
+				changed = true
+				continue
+			}
+			ret = append(ret, c)
+		}
+		return ret
+	}
+	for _, stmt := range f.Stmt {
+		build.Walk(stmt, func(x build.Expr, stk []build.Expr) {
+			c := x.Comment()
+			c.Before = strip(c.Before)
+			c.Suffix = strip(c.Suffix)
+		})
+	}
+	if !changed {
+		return nil
+	}
+	if err := ioutil.WriteFile(fileName, build.Format(f), 0644); err != nil {
+		return fmt.Errorf("error writing %s:\n%v", fileName, err)
 	}
 	return nil
 }
 
+// editDeps applies the Buildozer command 'op' (e.g., "add") to the deps attribute of each rule in 'deps'.
+func editDeps(workspaceRoot, op string, deps map[*bazel.Rule][]bazel.Label) error {
+	cmds, err := depsCommands(op, deps)
+	if err != nil {
+		return err
+	}
+	return withPostEditHook(workspaceRoot, rulePkgNames(deps), func() ([]string, error) {
+		for _, c := range cmds {
+			if err := exec(workspaceRoot, c, []int{0, 3}); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+}
+
+// rulePkgNames returns the names of the packages of the rules in deps that have labels to edit.
+func rulePkgNames(deps map[*bazel.Rule][]bazel.Label) []string {
+	var ret []string
+	for rule, labels := range deps {
+		if len(labels) > 0 {
+			ret = append(ret, rule.PkgName)
+		}
+	}
+	return ret
+}
+
+// depsCommands returns the Buildozer command lines that apply 'op' (e.g., "add") to the deps attribute of each rule in 'deps'.
+// Each command line is a command and the reference of the rule it applies to, e.g. ["add deps //foo:bar", "//target"].
+// Command lines are ordered by rule label, and labels are in the order of 'deps'.
+func depsCommands(op string, deps map[*bazel.Rule][]bazel.Label) ([][]string, error) {
+	var ret [][]string
+	for _, rule := range jadeplib.SortedRulesToEdit(deps) {
+		labels := deps[rule]
+		if len(labels) == 0 {
+			continue
+		}
+		labelToModify, err := Ref(rule)
+		if err != nil {
+			return nil, fmt.Errorf("error getting buildozer reference for %v:\n%v", rule, err)
+		}
+		var strs []string
+		for _, l := range labels {
+			strs = append(strs, string(l))
+		}
+		ret = append(ret, []string{fmt.Sprintf("%s %s %s", op, filter.DepsAttribute(rule), strings.Join(strs, " ")), labelToModify})
+	}
+	return ret, nil
+}
+
 // exec calls Buildozer and returns an error if its exit code isn't one of allowedReturnedCodes.
 // args is a single command line, e.g. ["add deps", "//foo:bar", "//target"].
 func exec(workspaceRoot string, args []string, allowedReturnedCodes []int) error {
@@ -15,12 +15,16 @@
 package buildozer
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
 
 	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/filter"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+	"github.com/google/go-cmp/cmp"
 )
 
 func TestRef(t *testing.T) {
@@ -99,6 +103,34 @@ func TestNewRule(t *testing.T) {
     name = "Foo",
     srcs = ["Foo.java"],
 )
+`,
+			},
+		},
+		{
+			rule: bazel.NewRule("java_library", "third_party/foo", "Foo", Attrs{"srcs": []string{"Foo.java"}, "licenses": []string{"notice"}, "compatible_with": []string{"//buildenv:x"}}),
+			wantFile: file{
+				fileName: "third_party/foo/BUILD",
+				content: `java_library(
+    name = "Foo",
+    srcs = ["Foo.java"],
+    compatible_with = ["//buildenv:x"],
+    licenses = ["notice"],
+)
+`,
+			},
+		},
+		{
+			rule: bazel.NewRule("java_test", "javatests/com", "FooTest", Attrs{"srcs": []string{"FooTest.java"}, "test_class": "com.FooTest", "size": "small", "description": "a test", "runtime_deps": []string{"//third_party/junit"}}),
+			wantFile: file{
+				fileName: "javatests/com/BUILD",
+				content: `java_test(
+    name = "FooTest",
+    size = "small",
+    srcs = ["FooTest.java"],
+    description = "a test",
+    test_class = "com.FooTest",
+    runtime_deps = ["//third_party/junit"],
+)
 `,
 			},
 		},
@@ -148,6 +180,8 @@ func TestAddDepsToRules(t *testing.T) {
 	tests := []struct {
 		desc           string
 		missingDeps    map[*bazel.Rule][]bazel.Label
+		depsAttributes map[string]string
+		umbrellaTags   map[string]bool
 		buildFile      string
 		initialContent string
 		wantContent    string
@@ -175,6 +209,60 @@ java_test(
     name = "FooTest",
     deps = ["//y:BarTest"],
 )
+`,
+		},
+		{
+			desc: "per-kind attributes",
+			missingDeps: map[*bazel.Rule][]bazel.Label{
+				bazel.NewRule("kt_jvm_library", "x", "Foo", nil): {"//y:Bar"},
+				bazel.NewRule("java_library", "x", "Gen", map[string]interface{}{"generator_function": "my_macro", "generator_name": "Gen"}): {"//y:Baz"},
+				bazel.NewRule("java_library", "x", "Lib", nil): {"//y:Zoo"},
+			},
+			depsAttributes: map[string]string{"kt_jvm_library": "associates", "my_macro": "runtime_deps"},
+			buildFile:      "x/BUILD",
+			initialContent: `
+kt_jvm_library(name = "Foo")
+my_macro(name = "Gen")
+java_library(name = "Lib")
+`,
+			wantContent: `kt_jvm_library(
+    name = "Foo",
+    associates = ["//y:Bar"],
+)
+
+my_macro(
+    name = "Gen",
+    runtime_deps = ["//y:Baz"],
+)
+
+java_library(
+    name = "Lib",
+    deps = ["//y:Zoo"],
+)
+`,
+		},
+		{
+			desc: "umbrella targets",
+			missingDeps: map[*bazel.Rule][]bazel.Label{
+				bazel.NewRule("java_library", "x", "Api", map[string]interface{}{"tags": []string{"api"}}): {"//y:Bar"},
+				bazel.NewRule("java_library", "x", "Lib", nil):                                             {"//y:Zoo"},
+			},
+			umbrellaTags: map[string]bool{"api": true},
+			buildFile:    "x/BUILD",
+			initialContent: `
+java_library(name = "Api", tags = ["api"])
+java_library(name = "Lib")
+`,
+			wantContent: `java_library(
+    name = "Api",
+    tags = ["api"],
+    exports = ["//y:Bar"],
+)
+
+java_library(
+    name = "Lib",
+    deps = ["//y:Zoo"],
+)
 `,
 		},
 	}
@@ -195,6 +283,10 @@ java_test(
 			if err != nil {
 				t.Fatal(err)
 			}
+			filter.DepsAttributeByKind = tt.depsAttributes
+			defer func() { filter.DepsAttributeByKind = map[string]string{} }()
+			filter.UmbrellaTags = tt.umbrellaTags
+			defer func() { filter.UmbrellaTags = map[string]bool{} }()
 			err = AddDepsToRules(workspaceRoot, tt.missingDeps)
 			if err != nil {
 				t.Fatalf("AddDepsToRules returned error = %v, want nil", err)
@@ -210,6 +302,628 @@ java_test(
 	}
 }
 
+func TestAddDepsCommands(t *testing.T) {
+	missingDeps := map[*bazel.Rule][]bazel.Label{
+		bazel.NewRule("java_test", "x", "FooTest", nil):  {"//y:BarTest"},
+		bazel.NewRule("java_library", "x", "Foo", nil):   {"//y:Bar1", "//y:Bar2"},
+		bazel.NewRule("java_library", "x", "Empty", nil): nil,
+		bazel.NewRule("java_library", "x", "Gen", map[string]interface{}{"generator_function": "my_macro", "generator_location": "x/BUILD:7"}): {"//y:Baz"},
+	}
+	got, err := AddDepsCommands(missingDeps)
+	if err != nil {
+		t.Fatalf("AddDepsCommands returned error %v, want nil", err)
+	}
+	want := []string{
+		"add deps //y:Bar1 //y:Bar2|//x:Foo",
+		"add deps //y:BarTest|//x:FooTest",
+		"add deps //y:Baz|//x:%7",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("AddDepsCommands returned diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestDepsCommandsOrder(t *testing.T) {
+	deps := map[*bazel.Rule][]bazel.Label{
+		bazel.NewRule("java_library", "x", "c", nil): {"//y:Z", "//y:A"},
+		bazel.NewRule("java_library", "x", "a", nil): {"//y:B"},
+		bazel.NewRule("java_library", "w", "b", nil): {"//y:C"},
+	}
+	want := [][]string{
+		{"remove deps //y:C", "//w:b"},
+		{"remove deps //y:B", "//x:a"},
+		{"remove deps //y:Z //y:A", "//x:c"},
+	}
+	for i := 0; i < 10; i++ {
+		got, err := depsCommands("remove", deps)
+		if err != nil {
+			t.Fatalf("depsCommands returned error %v, want nil", err)
+		}
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Fatalf("depsCommands returned diff (-got +want):\n%s", diff)
+		}
+	}
+}
+
+func TestProvenanceComments(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	workspaceRoot := filepath.Join(tmpDir, "repo")
+	createFiles(t, workspaceRoot, []string{"WORKSPACE", "x/BUILD"})
+	buildFile := filepath.Join(workspaceRoot, "x/BUILD")
+	initialContent := `java_library(
+    name = "Foo",
+    deps = [
+        "//y:Existing",  # Keep me
+    ],
+)
+`
+	if err := ioutil.WriteFile(buildFile, []byte(initialContent), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	rule := bazel.NewRule("java_library", "x", "Foo", nil)
+	addedDeps := map[*bazel.Rule][]bazel.Label{rule: {"//y:Bar", "//y:Baz"}}
+	missingDeps := map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label{
+		rule: {
+			"com.Bar":   {"//y:Bar", "//y:Other"},
+			"com.Bar2":  {"//y:Bar"},
+			"com.Baz":   {"//y:Baz"},
+			"com.Other": {"//y:Other"},
+		},
+	}
+	if err := AddDepsToRules(workspaceRoot, addedDeps); err != nil {
+		t.Fatalf("AddDepsToRules returned error = %v, want nil", err)
+	}
+	if err := AddProvenanceComments(workspaceRoot, addedDeps, missingDeps); err != nil {
+		t.Fatalf("AddProvenanceComments returned error = %v, want nil", err)
+	}
+	b, err := ioutil.ReadFile(buildFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantContent := `java_library(
+    name = "Foo",
+    deps = [
+        "//y:Bar",  # jadep: for com.Bar, com.Bar2
+        "//y:Baz",  # jadep: for com.Baz
+        "//y:Existing",  # Keep me
+    ],
+)
+`
+	if diff := cmp.Diff(wantContent, string(b)); diff != "" {
+		t.Errorf("AddProvenanceComments produced diff (-want +got):\n%s", diff)
+	}
+
+	if err := StripProvenanceComments(buildFile); err != nil {
+		t.Fatalf("StripProvenanceComments returned error = %v, want nil", err)
+	}
+	b, err = ioutil.ReadFile(buildFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantContent = `java_library(
+    name = "Foo",
+    deps = [
+        "//y:Bar",
+        "//y:Baz",
+        "//y:Existing",  # Keep me
+    ],
+)
+`
+	if diff := cmp.Diff(wantContent, string(b)); diff != "" {
+		t.Errorf("StripProvenanceComments produced diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseDepsAttributes(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"", map[string]string{}, false},
+		{"kt_jvm_library=associates, my_macro=runtime_deps", map[string]string{"kt_jvm_library": "associates", "my_macro": "runtime_deps"}, false},
+		{"kt_jvm_library", nil, true},
+		{"=deps", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseDepsAttributes(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseDepsAttributes(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+		}
+		if diff := cmp.Diff(got, tt.want); diff != "" {
+			t.Errorf("ParseDepsAttributes(%q) diff (-got +want):\n%s", tt.in, diff)
+		}
+	}
+}
+
+func TestRemoveDepsFromRules(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Can't create temp directory:\n%v", err)
+	}
+	workspaceRoot := filepath.Join(tmpDir, "repo")
+	defer os.RemoveAll(tmpDir)
+	createFiles(t, workspaceRoot, []string{"WORKSPACE", "x/BUILD"})
+	initialContent := `java_library(
+    name = "Foo",
+    deps = [
+        "//y:Bar1",
+        "//y:Bar2",
+    ],
+)
+`
+	if err := ioutil.WriteFile(filepath.Join(workspaceRoot, "x/BUILD"), []byte(initialContent), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	err = RemoveDepsFromRules(workspaceRoot, map[*bazel.Rule][]bazel.Label{bazel.NewRule("java_library", "x", "Foo", nil): {"//y:Bar2"}})
+	if err != nil {
+		t.Fatalf("RemoveDepsFromRules returned error = %v, want nil", err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(workspaceRoot, "x/BUILD"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantContent := `java_library(
+    name = "Foo",
+    deps = ["//y:Bar1"],
+)
+`
+	if string(b) != wantContent {
+		t.Errorf("RemoveDepsFromRules created file with content\n%s\nbut wanted\n%s", string(b), wantContent)
+	}
+}
+
+// TestRemoveDanglingDepsOfUmbrella tests that a dangling dep is removed from the attribute it's listed in,
+// rather than from the attribute that deps are added to, which is exports for umbrella targets.
+func TestRemoveDanglingDepsOfUmbrella(t *testing.T) {
+	filter.UmbrellaTags["umbrella"] = true
+	defer delete(filter.UmbrellaTags, "umbrella")
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Can't create temp directory:\n%v", err)
+	}
+	workspaceRoot := filepath.Join(tmpDir, "repo")
+	defer os.RemoveAll(tmpDir)
+	createFiles(t, workspaceRoot, []string{"WORKSPACE", "x/BUILD"})
+	initialContent := `java_library(
+    name = "Api",
+    tags = ["umbrella"],
+    exports = ["//y:Impl"],
+    deps = [
+        "//y:Gone",
+        "//y:Other",
+    ],
+)
+`
+	if err := ioutil.WriteFile(filepath.Join(workspaceRoot, "x/BUILD"), []byte(initialContent), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	rule := bazel.NewRule("java_library", "x", "Api", map[string]interface{}{
+		"tags":    []string{"umbrella"},
+		"exports": []string{"//y:Impl"},
+		"deps":    []string{"//y:Gone", "//y:Other"},
+	})
+	byAttr := jadeplib.DepsByAttribute(map[*bazel.Rule][]bazel.Label{rule: {"//y:Gone"}})
+	if err := RemoveDepsFromAttributes(workspaceRoot, byAttr); err != nil {
+		t.Fatalf("RemoveDepsFromAttributes returned error = %v, want nil", err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(workspaceRoot, "x/BUILD"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantContent := `java_library(
+    name = "Api",
+    tags = ["umbrella"],
+    exports = ["//y:Impl"],
+    deps = ["//y:Other"],
+)
+`
+	if string(b) != wantContent {
+		t.Errorf("RemoveDepsFromAttributes created file with content\n%s\nbut wanted\n%s", string(b), wantContent)
+	}
+}
+
+func TestSplitKept(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Can't create temp directory:\n%v", err)
+	}
+	workspaceRoot := filepath.Join(tmpDir, "repo")
+	defer os.RemoveAll(tmpDir)
+	createFiles(t, workspaceRoot, []string{"WORKSPACE", "x/BUILD"})
+	initialContent := `java_library(
+    name = "Foo",
+    deps = [
+        "//y:Bar1",
+        "//y:Bar2",  # keep: loaded by reflection
+    ],
+)
+
+# jadep:ignore
+java_library(
+    name = "Ignored",
+    deps = ["//y:Bar1"],
+)
+`
+	if err := ioutil.WriteFile(filepath.Join(workspaceRoot, "x/BUILD"), []byte(initialContent), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	foo := bazel.NewRule("java_library", "x", "Foo", nil)
+	ignored := bazel.NewRule("java_library", "x", "Ignored", nil)
+	removable, kept, err := SplitKept(workspaceRoot, map[*bazel.Rule][]bazel.Label{
+		foo:     {"//y:Bar1", "//y:Bar2"},
+		ignored: {"//y:Bar1"},
+	})
+	if err != nil {
+		t.Fatalf("SplitKept returned error = %v, want nil", err)
+	}
+	if diff := cmp.Diff(removable, map[*bazel.Rule][]bazel.Label{foo: {"//y:Bar1"}}); diff != "" {
+		t.Errorf("SplitKept returned removable diff (-got +want):\n%s", diff)
+	}
+	if diff := cmp.Diff(kept, map[*bazel.Rule][]bazel.Label{foo: {"//y:Bar2"}, ignored: {"//y:Bar1"}}); diff != "" {
+		t.Errorf("SplitKept returned kept diff (-got +want):\n%s", diff)
+	}
+
+	// RemoveDepsFromRules undoes AddDepsToRules, e.g. when --verify rolls back added deps, so it ignores directives.
+	if err := RemoveDepsFromRules(workspaceRoot, map[*bazel.Rule][]bazel.Label{foo: {"//y:Bar2"}}); err != nil {
+		t.Fatalf("RemoveDepsFromRules returned error = %v, want nil", err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(workspaceRoot, "x/BUILD"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantContent := `java_library(
+    name = "Foo",
+    deps = ["//y:Bar1"],
+)
+
+# jadep:ignore
+java_library(
+    name = "Ignored",
+    deps = ["//y:Bar1"],
+)
+`
+	if string(b) != wantContent {
+		t.Errorf("RemoveDepsFromRules created file with content\n%s\nbut wanted\n%s", string(b), wantContent)
+	}
+}
+
+func TestReadDirectives(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Can't create temp directory:\n%v", err)
+	}
+	workspaceRoot := filepath.Join(tmpDir, "repo")
+	defer os.RemoveAll(tmpDir)
+	createFiles(t, workspaceRoot, []string{"WORKSPACE", "x/BUILD"})
+	content := `java_library(
+    name = "Foo",
+    deps = [
+        ":Local",  # keep
+        "//y:Bar",
+        # keep
+        "//y:Baz",
+    ],
+    runtime_deps = ["//y:Runtime"],  # keeper
+    exports = ["//y:Exported"],  # keep
+)
+
+# jadep:ignore
+java_library(name = "Ignored1")
+
+java_library(
+    name = "Ignored2",  # jadep:ignore: hand-written
+)
+`
+	if err := ioutil.WriteFile(filepath.Join(workspaceRoot, "x/BUILD"), []byte(content), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadDirectives(workspaceRoot, "x")
+	if err != nil {
+		t.Fatalf("ReadDirectives returned error = %v, want nil", err)
+	}
+	want := &Directives{
+		Ignored: map[string]bool{"Ignored1": true, "Ignored2": true},
+		Kept:    map[string]map[bazel.Label]bool{"Foo": {"//x:Local": true, "//y:Baz": true, "//y:Exported": true}},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("ReadDirectives returned diff (-got +want):\n%s", diff)
+	}
+
+	got, err = ReadDirectives(workspaceRoot, "nonexistent")
+	if err != nil {
+		t.Fatalf("ReadDirectives of a package without a BUILD file returned error = %v, want nil", err)
+	}
+	if len(got.Ignored) != 0 || len(got.Kept) != 0 {
+		t.Errorf("ReadDirectives of a package without a BUILD file returned %v, want no directives", got)
+	}
+}
+
+func TestSplitIgnored(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Can't create temp directory:\n%v", err)
+	}
+	workspaceRoot := filepath.Join(tmpDir, "repo")
+	defer os.RemoveAll(tmpDir)
+	createFiles(t, workspaceRoot, []string{"WORKSPACE", "x/BUILD"})
+	content := `# jadep:ignore
+java_library(name = "Ignored")
+
+java_library(name = "Foo")
+`
+	if err := ioutil.WriteFile(filepath.Join(workspaceRoot, "x/BUILD"), []byte(content), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	ignoredRule := bazel.NewRule("java_library", "x", "Ignored", nil)
+	foo := bazel.NewRule("java_library", "x", "Foo", nil)
+	bar := bazel.NewRule("java_library", "y", "Bar", nil)
+
+	editable, ignored, err := SplitIgnored(workspaceRoot, []*bazel.Rule{ignoredRule, foo, bar})
+	if err != nil {
+		t.Fatalf("SplitIgnored returned error = %v, want nil", err)
+	}
+	if diff := cmp.Diff(editable, []*bazel.Rule{foo, bar}); diff != "" {
+		t.Errorf("SplitIgnored returned editable rules diff (-got +want):\n%s", diff)
+	}
+	if diff := cmp.Diff(ignored, []*bazel.Rule{ignoredRule}); diff != "" {
+		t.Errorf("SplitIgnored returned ignored rules diff (-got +want):\n%s", diff)
+	}
+
+	RespectDirectives = false
+	defer func() { RespectDirectives = true }()
+	editable, ignored, err = SplitIgnored(workspaceRoot, []*bazel.Rule{ignoredRule, foo})
+	if err != nil {
+		t.Fatalf("SplitIgnored returned error = %v, want nil", err)
+	}
+	if len(editable) != 2 || len(ignored) != 0 {
+		t.Errorf("SplitIgnored with RespectDirectives = false returned %d editable and %d ignored rules, want 2 and 0", len(editable), len(ignored))
+	}
+}
+
+func TestSplitRule(t *testing.T) {
+	type Attrs = map[string]interface{}
+	plan := &jadeplib.SplitPlan{
+		Rule: bazel.NewRule("java_library", "x", "Foo", nil),
+		NewRules: []*bazel.Rule{
+			bazel.NewRule("java_library", "x", "Foo_a", Attrs{"srcs": []string{"A.java"}, "deps": []string{"//y:Bar"}}),
+			bazel.NewRule("java_library", "x", "Foo_b", Attrs{"srcs": []string{"B.java"}, "deps": []string{"//y:Bar"}}),
+		},
+	}
+	initialContent := `
+java_library(
+    name = "Foo",
+    srcs = ["A.java", "B.java", "C.java"],
+    deps = ["//y:Bar"],
+)
+`
+	wantContent := `java_library(
+    name = "Foo",
+    srcs = ["C.java"],
+    exports = [
+        ":Foo_a",
+        ":Foo_b",
+    ],
+    deps = ["//y:Bar"],
+)
+
+java_library(
+    name = "Foo_a",
+    srcs = ["A.java"],
+    deps = ["//y:Bar"],
+)
+
+java_library(
+    name = "Foo_b",
+    srcs = ["B.java"],
+    deps = ["//y:Bar"],
+)
+`
+
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Can't create temp directory:\n%v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	workspaceRoot := filepath.Join(tmpDir, "repo")
+	createFiles(t, workspaceRoot, []string{"WORKSPACE", "x/BUILD"})
+	if err := ioutil.WriteFile(filepath.Join(workspaceRoot, "x/BUILD"), []byte(initialContent), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SplitRule(workspaceRoot, plan); err != nil {
+		t.Fatalf("SplitRule returned error = %v, want nil", err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(workspaceRoot, "x/BUILD"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != wantContent {
+		t.Errorf("SplitRule created BUILD file with content\n%s\nbut wanted\n%s", string(b), wantContent)
+	}
+}
+
+func TestMoveFile(t *testing.T) {
+	type Attrs = map[string]interface{}
+	oldRule := bazel.NewRule("java_library", "x", "Foo", Attrs{"srcs": []string{"Bar.java", "Foo.java"}, "deps": []string{"//z"}})
+	plan := &jadeplib.MovePlan{
+		From:    "x/Foo.java",
+		To:      "y/Foo.java",
+		OldSrcs: map[*bazel.Rule]string{oldRule: "Foo.java"},
+		NewRule: bazel.NewRule("java_library", "y", "Foo", Attrs{"srcs": []string{"Foo.java"}, "deps": []string{"//z"}}),
+	}
+	initialContent := `
+java_library(
+    name = "Foo",
+    srcs = ["Bar.java", "Foo.java"],
+    deps = ["//z"],
+)
+`
+	wantContent := map[string]string{
+		"x/BUILD": `java_library(
+    name = "Foo",
+    srcs = ["Bar.java"],
+    deps = ["//z"],
+)
+`,
+		"y/BUILD": `java_library(
+    name = "Foo",
+    srcs = ["Foo.java"],
+    deps = ["//z"],
+)
+`,
+	}
+
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Can't create temp directory:\n%v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	workspaceRoot := filepath.Join(tmpDir, "repo")
+	createFiles(t, workspaceRoot, []string{"WORKSPACE", "x/BUILD", "y/Foo.java"})
+	if err := ioutil.WriteFile(filepath.Join(workspaceRoot, "x/BUILD"), []byte(initialContent), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := MoveFile(workspaceRoot, plan); err != nil {
+		t.Fatalf("MoveFile returned error = %v, want nil", err)
+	}
+	for f, want := range wantContent {
+		b, err := ioutil.ReadFile(filepath.Join(workspaceRoot, f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Errorf("MoveFile left %s with content\n%s\nbut wanted\n%s", f, string(b), want)
+		}
+	}
+}
+
+func TestMakeVisible(t *testing.T) {
+	type Attrs = map[string]interface{}
+	tests := []struct {
+		desc           string
+		plan           *jadeplib.VisibilityPlan
+		initialContent string
+		wantContent    string
+	}{
+		{
+			desc: "packages are added to visibility",
+			plan: &jadeplib.VisibilityPlan{
+				Rule:          bazel.NewRule("java_library", "x", "Foo", Attrs{"visibility": []string{"//visibility:private"}}),
+				Packages:      []string{"a", "b"},
+				AddVisibility: []string{"//a:__pkg__", "//b:__pkg__"},
+			},
+			initialContent: `
+java_library(
+    name = "Foo",
+    visibility = ["//visibility:private"],
+)
+`,
+			wantContent: `java_library(
+    name = "Foo",
+    visibility = [
+        "//a:__pkg__",
+        "//b:__pkg__",
+    ],
+)
+`,
+		},
+		{
+			desc: "a new package_group is created",
+			plan: &jadeplib.VisibilityPlan{
+				Rule:          bazel.NewRule("java_library", "x", "Foo", nil),
+				Packages:      []string{"a", "b/c"},
+				Group:         "//x:Foo_users",
+				NewGroup:      true,
+				AddVisibility: []string{":Foo_users"},
+			},
+			initialContent: `
+java_library(
+    name = "Foo",
+)
+`,
+			wantContent: `java_library(
+    name = "Foo",
+    visibility = [":Foo_users"],
+)
+
+package_group(
+    name = "Foo_users",
+    packages = [
+        "//a",
+        "//b/c",
+    ],
+)
+`,
+		},
+		{
+			desc: "an existing package_group is extended",
+			plan: &jadeplib.VisibilityPlan{
+				Rule:          bazel.NewRule("java_library", "x", "Foo", Attrs{"visibility": []string{"//x:friends"}}),
+				Packages:      []string{"a", "b"},
+				Group:         "//x:friends",
+				AddVisibility: []string{":friends"},
+			},
+			initialContent: `
+package_group(
+    name = "friends",
+    packages = ["//c"],
+)
+
+java_library(
+    name = "Foo",
+    visibility = [":friends"],
+)
+`,
+			wantContent: `package_group(
+    name = "friends",
+    packages = [
+        "//a",
+        "//b",
+        "//c",
+    ],
+)
+
+java_library(
+    name = "Foo",
+    visibility = [":friends"],
+)
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			tmpDir, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatalf("Can't create temp directory:\n%v", err)
+			}
+			defer os.RemoveAll(tmpDir)
+			workspaceRoot := filepath.Join(tmpDir, "repo")
+			createFiles(t, workspaceRoot, []string{"WORKSPACE", "x/BUILD"})
+			if err := ioutil.WriteFile(filepath.Join(workspaceRoot, "x/BUILD"), []byte(tt.initialContent), os.ModePerm); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := MakeVisible(workspaceRoot, tt.plan); err != nil {
+				t.Fatalf("MakeVisible returned error = %v, want nil", err)
+			}
+			b, err := ioutil.ReadFile(filepath.Join(workspaceRoot, "x/BUILD"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.wantContent {
+				t.Errorf("MakeVisible left BUILD file with content\n%s\nbut wanted\n%s", string(b), tt.wantContent)
+			}
+		})
+	}
+}
+
 func createFiles(t *testing.T, workDir string, fileNames []string) func() {
 	for _, f := range fileNames {
 		err := os.MkdirAll(filepath.Join(workDir, filepath.Dir(f)), os.ModePerm)
@@ -227,3 +941,56 @@ func createFiles(t *testing.T, workDir string, fileNames []string) func() {
 		}
 	}
 }
+
+func TestPostEditHook(t *testing.T) {
+	defer func(h func(buildFiles, newFiles []string) error) { PostEditHook = h }(PostEditHook)
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	createFiles(t, tmpDir, []string{"WORKSPACE"})
+	for _, d := range []string{"x", "y", "z"} {
+		if err := os.MkdirAll(filepath.Join(tmpDir, d), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	existing := filepath.Join(tmpDir, "x/BUILD")
+	initialContent := "java_library(name = \"Foo\")\n"
+	if err := ioutil.WriteFile(existing, []byte(initialContent), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	var gotBuildFiles, gotNewFiles []string
+	PostEditHook = func(buildFiles, newFiles []string) error {
+		gotBuildFiles, gotNewFiles = buildFiles, newFiles
+		return nil
+	}
+	if err := NewRule(tmpDir, bazel.NewRule("java_library", "y", "Bar", map[string]interface{}{"srcs": []string{"Bar.java"}})); err != nil {
+		t.Fatalf("NewRule returned error: %v", err)
+	}
+	want := []string{filepath.Join(tmpDir, "y/BUILD")}
+	if diff := cmp.Diff(want, gotBuildFiles); diff != "" {
+		t.Errorf("PostEditHook got diff in buildFiles (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(want, gotNewFiles); diff != "" {
+		t.Errorf("PostEditHook got diff in newFiles (-want +got):\n%s", diff)
+	}
+
+	// A rejected edit is undone, including the BUILD files it created.
+	PostEditHook = func(buildFiles, newFiles []string) error {
+		return fmt.Errorf("missing license header")
+	}
+	if err := AddDepsToRules(tmpDir, map[*bazel.Rule][]bazel.Label{bazel.NewRule("java_library", "x", "Foo", nil): {"//y:Bar"}}); err == nil {
+		t.Errorf("AddDepsToRules returned nil error, want the hook's error")
+	}
+	if content, err := ioutil.ReadFile(existing); err != nil || string(content) != initialContent {
+		t.Errorf("x/BUILD = (%q, %v) after a rejected edit, want %q", content, err, initialContent)
+	}
+	if err := NewRule(tmpDir, bazel.NewRule("java_library", "z", "Baz", nil)); err == nil {
+		t.Errorf("NewRule returned nil error, want the hook's error")
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "z/BUILD")); !os.IsNotExist(err) {
+		t.Errorf("z/BUILD exists after a rejected edit created it")
+	}
+}
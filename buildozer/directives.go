@@ -0,0 +1,186 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package buildozer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+)
+
+const (
+	// KeepDirective is the comment that marks a dep that Jadep never removes, following Gazelle's convention,
+	// e.g. `"//foo:bar",  # keep`. Text after "keep:" can explain why, e.g. "# keep: loaded by reflection".
+	KeepDirective = "keep"
+
+	// IgnoreDirective is the comment that marks a rule that Jadep never edits, e.g. on the line before the rule.
+	IgnoreDirective = "jadep:ignore"
+)
+
+// RespectDirectives makes Jadep honor KeepDirective and IgnoreDirective comments in BUILD files.
+// When it's set, RemoveDepsFromRules doesn't remove kept deps, nor the deps of ignored rules.
+var RespectDirectives = true
+
+// Directives are the KeepDirective and IgnoreDirective comments of a BUILD file.
+type Directives struct {
+	// Ignored are the names of the rules with an IgnoreDirective comment, either before the rule or on its name attribute.
+	Ignored map[string]bool
+
+	// Kept maps the names of rules to the labels in their attributes that have a KeepDirective comment, or are in an attribute that has one.
+	Kept map[string]map[bazel.Label]bool
+}
+
+// ReadDirectives returns the directives in the BUILD file of the package pkgName. A package without a BUILD file has none.
+// Rules created by macros are named after the macro call they come from, as in Ref.
+func ReadDirectives(workspaceRoot, pkgName string) (*Directives, error) {
+	ret := &Directives{Ignored: make(map[string]bool), Kept: make(map[string]map[bazel.Label]bool)}
+	fileName := BuildFileOf(workspaceRoot, pkgName)
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s:\n%v", fileName, err)
+	}
+	f, err := build.Parse(fileName, data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s:\n%v", fileName, err)
+	}
+	for _, r := range f.Rules("") {
+		name := r.Name()
+		if hasDirective(r.Call, IgnoreDirective) {
+			ret.Ignored[name] = true
+		}
+		for _, key := range r.AttrKeys() {
+			if key == "name" {
+				if defn := r.AttrDefn(key); hasDirective(defn, IgnoreDirective) || hasDirective(defn.Y, IgnoreDirective) {
+					ret.Ignored[name] = true
+				}
+				continue
+			}
+			list, ok := r.Attr(key).(*build.ListExpr)
+			if !ok {
+				continue
+			}
+			// A KeepDirective on the attribute keeps all of its labels, e.g. after buildifier moves the comment of a single-element list to its end.
+			keepAll := hasDirective(r.AttrDefn(key), KeepDirective) || hasDirective(list, KeepDirective)
+			for _, x := range list.List {
+				s, ok := x.(*build.StringExpr)
+				if !ok || !(keepAll || hasDirective(s, KeepDirective)) {
+					continue
+				}
+				l, err := bazel.ParseRelativeLabel(pkgName, s.Value)
+				if err != nil {
+					continue
+				}
+				if ret.Kept[name] == nil {
+					ret.Kept[name] = make(map[bazel.Label]bool)
+				}
+				ret.Kept[name][l] = true
+			}
+		}
+	}
+	return ret, nil
+}
+
+// hasDirective returns true if one of the comments before or after x is 'directive', possibly followed by ':' and an explanation.
+func hasDirective(x build.Expr, directive string) bool {
+	c := x.Comment()
+	for _, comments := range [][]build.Comment{c.Before, c.Suffix} {
+		for _, comment := range comments {
+			text := strings.TrimSpace(strings.TrimPrefix(comment.Token, "#"))
+			if text == directive || strings.HasPrefix(text, directive+":") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Ignores returns true if rule has an IgnoreDirective.
+func (d *Directives) Ignores(rule *bazel.Rule) bool {
+	return d.Ignored[directiveName(rule)]
+}
+
+// Keeps returns true if dep has a KeepDirective in rule, or if rule has an IgnoreDirective.
+func (d *Directives) Keeps(rule *bazel.Rule, dep bazel.Label) bool {
+	name := directiveName(rule)
+	return d.Ignored[name] || d.Kept[name][dep]
+}
+
+// directiveName returns the name that directives of rule are recorded under: the name of the macro call it comes from, if any.
+func directiveName(rule *bazel.Rule) string {
+	_, name := rule.SourceLabel().Split()
+	return name
+}
+
+// SplitKept splits deps to the ones that Jadep may remove when cleaning up BUILD files, and the ones that the directives
+// in their BUILD files keep. Callers remove only the former with RemoveDepsFromRules, which removes whatever it's given.
+// If RespectDirectives is false, no deps are kept.
+func SplitKept(workspaceRoot string, deps map[*bazel.Rule][]bazel.Label) (removable, kept map[*bazel.Rule][]bazel.Label, err error) {
+	if !RespectDirectives {
+		return deps, nil, nil
+	}
+	removable = make(map[*bazel.Rule][]bazel.Label)
+	kept = make(map[*bazel.Rule][]bazel.Label)
+	directives := make(map[string]*Directives)
+	for rule, labels := range deps {
+		d, ok := directives[rule.PkgName]
+		if !ok {
+			d, err = ReadDirectives(workspaceRoot, rule.PkgName)
+			if err != nil {
+				return nil, nil, err
+			}
+			directives[rule.PkgName] = d
+		}
+		for _, l := range labels {
+			if d.Keeps(rule, l) {
+				kept[rule] = append(kept[rule], l)
+			} else {
+				removable[rule] = append(removable[rule], l)
+			}
+		}
+	}
+	return removable, kept, nil
+}
+
+// SplitIgnored splits rules to the ones that Jadep may edit, and the ones with an IgnoreDirective. Both keep the order of rules.
+// If RespectDirectives is false, no rules are ignored.
+func SplitIgnored(workspaceRoot string, rules []*bazel.Rule) (editable, ignored []*bazel.Rule, err error) {
+	if !RespectDirectives {
+		return rules, nil, nil
+	}
+	directives := make(map[string]*Directives)
+	for _, rule := range rules {
+		d, ok := directives[rule.PkgName]
+		if !ok {
+			d, err = ReadDirectives(workspaceRoot, rule.PkgName)
+			if err != nil {
+				return nil, nil, err
+			}
+			directives[rule.PkgName] = d
+		}
+		if d.Ignores(rule) {
+			ignored = append(ignored, rule)
+		} else {
+			editable = append(editable, rule)
+		}
+	}
+	return editable, ignored, nil
+}
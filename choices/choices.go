@@ -0,0 +1,178 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package choices remembers which label a user chose for an ambiguous class, so the same choice is suggested first next time.
+package choices
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+)
+
+// DefaultFileName is the name of the file, relative to the workspace root, where choices are stored by default.
+const DefaultFileName = ".jadep_choices.json"
+
+// DefaultSkipFileName is the name of the file, relative to the workspace root, that lists the classes
+// the user asked never to be asked about again.
+const DefaultSkipFileName = ".jadep_skip"
+
+// Store is a persistent map from class names to the label a user chose to satisfy them.
+type Store struct {
+	fileName string
+
+	mu      sync.Mutex
+	choices map[jadeplib.ClassName]bazel.Label
+}
+
+// Load reads a Store from fileName. A non-existent file results in an empty Store.
+func Load(fileName string) (*Store, error) {
+	s := &Store{fileName: fileName, choices: make(map[jadeplib.ClassName]bazel.Label)}
+	b, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading previous choices from %s:\n%v", fileName, err)
+	}
+	if err := json.Unmarshal(b, &s.choices); err != nil {
+		return nil, fmt.Errorf("error parsing previous choices from %s:\n%v", fileName, err)
+	}
+	return s, nil
+}
+
+// Prefer moves previously chosen labels to the front of the candidates of each class in missingDepsMap.
+// The order of the other candidates is preserved. The candidates are copied before they're reordered, since the same slice
+// may be shared by several rules or held by the caller.
+func (s *Store) Prefer(missingDepsMap map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, classToRules := range missingDepsMap {
+		for class, labels := range classToRules {
+			chosen, ok := s.choices[class]
+			if !ok {
+				continue
+			}
+			labels = append([]bazel.Label(nil), labels...)
+			sort.SliceStable(labels, func(i, j int) bool { return labels[i] == chosen && labels[j] != chosen })
+			classToRules[class] = labels
+		}
+	}
+}
+
+// Record remembers the choices made for ambiguous classes, i.e. classes that had more than one candidate and
+// exactly one of whose candidates was added.
+// askedDepsMap should only hold the classes the user was asked about; choices made automatically, e.g. by
+// --ambiguity_policy or --auto_apply_threshold, aren't the user's and shouldn't be suggested next time.
+func (s *Store) Record(askedDepsMap map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label, addedDeps map[*bazel.Rule][]bazel.Label) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for rule, classToRules := range askedDepsMap {
+		added := make(map[bazel.Label]bool)
+		for _, l := range addedDeps[rule] {
+			added[l] = true
+		}
+		for class, labels := range classToRules {
+			if len(labels) < 2 {
+				continue
+			}
+			var chosen []bazel.Label
+			for _, l := range labels {
+				if added[l] {
+					chosen = append(chosen, l)
+				}
+			}
+			if len(chosen) == 1 {
+				s.choices[class] = chosen[0]
+			}
+		}
+	}
+}
+
+// Save writes the Store to its file, creating directories as needed.
+func (s *Store) Save() error {
+	s.mu.Lock()
+	b, err := json.MarshalIndent(s.choices, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.fileName), 0755); err != nil {
+		return fmt.Errorf("error saving choices to %s:\n%v", s.fileName, err)
+	}
+	if err := ioutil.WriteFile(s.fileName, append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("error saving choices to %s:\n%v", s.fileName, err)
+	}
+	return nil
+}
+
+// LoadSkipList reads the class names listed in fileName, one per line.
+// Empty lines and lines starting with '#' are ignored. A non-existent file results in an empty list.
+func LoadSkipList(fileName string) ([]jadeplib.ClassName, error) {
+	b, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading skipped classes from %s:\n%v", fileName, err)
+	}
+	var ret []jadeplib.ClassName
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ret = append(ret, jadeplib.ClassName(line))
+	}
+	return ret, nil
+}
+
+// AppendSkipList appends classNames to the skip list in fileName, creating it and its directories as needed.
+func AppendSkipList(fileName string, classNames []jadeplib.ClassName) error {
+	if len(classNames) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return fmt.Errorf("error saving skipped classes to %s:\n%v", fileName, err)
+	}
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error saving skipped classes to %s:\n%v", fileName, err)
+	}
+	for _, cls := range classNames {
+		fmt.Fprintln(f, cls)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error saving skipped classes to %s:\n%v", fileName, err)
+	}
+	return nil
+}
+
+// SkipListRegexps returns regular expressions, in the format of --blacklist, that match exactly classNames.
+func SkipListRegexps(classNames []jadeplib.ClassName) []string {
+	var ret []string
+	for _, cls := range classNames {
+		ret = append(ret, "^"+regexp.QuoteMeta(string(cls))+"$")
+	}
+	return ret
+}
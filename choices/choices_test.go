@@ -0,0 +1,106 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package choices
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRecordAndPrefer(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	fileName := filepath.Join(tmpDir, "sub", DefaultFileName)
+
+	rule := bazel.NewRule("java_library", "x", "Foo", nil)
+	s, err := Load(fileName)
+	if err != nil {
+		t.Fatalf("Load() of non-existent file has error %v, want nil", err)
+	}
+	s.Record(
+		map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label{rule: {
+			"com.A": {"//a:A1", "//a:A2", "//a:A3"},
+			"com.B": {"//b:B"},
+			"com.C": {"//c:C1", "//c:C2"},
+		}},
+		map[*bazel.Rule][]bazel.Label{rule: {"//a:A2", "//b:B"}})
+	if err := s.Save(); err != nil {
+		t.Fatalf("Save() has error %v, want nil", err)
+	}
+
+	s, err = Load(fileName)
+	if err != nil {
+		t.Fatalf("Load() has error %v, want nil", err)
+	}
+	candidatesA := []bazel.Label{"//a:A1", "//a:A3", "//a:A2"}
+	missing := map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label{rule: {
+		"com.A": candidatesA,
+		"com.C": {"//c:C1", "//c:C2"},
+	}}
+	s.Prefer(missing)
+	want := map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label{rule: {
+		"com.A": {"//a:A2", "//a:A1", "//a:A3"},
+		"com.C": {"//c:C1", "//c:C2"},
+	}}
+	if diff := cmp.Diff(missing, want); diff != "" {
+		t.Errorf("Prefer() diff (-got +want):\n%s", diff)
+	}
+	if diff := cmp.Diff(candidatesA, []bazel.Label{"//a:A1", "//a:A3", "//a:A2"}); diff != "" {
+		t.Errorf("Prefer() modified the caller's candidates, diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestSkipList(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	fileName := filepath.Join(tmpDir, "sub", DefaultSkipFileName)
+
+	got, err := LoadSkipList(fileName)
+	if err != nil || len(got) != 0 {
+		t.Fatalf("LoadSkipList(non-existent file) = (%v, %v), want (nil, nil)", got, err)
+	}
+	if err := AppendSkipList(fileName, []jadeplib.ClassName{"com.Foo"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := AppendSkipList(fileName, []jadeplib.ClassName{"com.Foo$Bar"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err = LoadSkipList(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []jadeplib.ClassName{"com.Foo", "com.Foo$Bar"}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("LoadSkipList returned diff (-got +want):\n%s", diff)
+	}
+
+	regexps := SkipListRegexps(got)
+	gotKept := jadeplib.ExcludeClassNames(regexps, []jadeplib.ClassName{"com.Foo", "com.Foo$Bar", "comxFoo", "com.FooBar"})
+	if diff := cmp.Diff(gotKept, []jadeplib.ClassName{"comxFoo", "com.FooBar"}); diff != "" {
+		t.Errorf("ExcludeClassNames(SkipListRegexps(...)) returned diff (-got +want):\n%s", diff)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package classindexresolver resolves class names by querying a remote ClassIndex gRPC service.
+// This allows organizations to host a centrally maintained index of the classes provided by their rules.
+package classindexresolver
+
+import (
+	"fmt"
+	"time"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/grpccreds"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+	"github.com/bazelbuild/tools_jvm_autodeps/pkgloading"
+	"github.com/bazelbuild/tools_jvm_autodeps/resolverutil"
+	"google.golang.org/grpc"
+
+	cipb "github.com/bazelbuild/tools_jvm_autodeps/java/com/google/devtools/javatools/jade/classindex_proto"
+)
+
+// Resolver resolves class names using a ClassIndex service.
+type Resolver struct {
+	stub    cipb.ClassIndexClient
+	timeout time.Duration
+	loader  pkgloading.Loader
+}
+
+// NewResolver returns a new Resolver that sends Lookup RPCs on 'stub' with 'timeout'.
+// The rules returned by the index are loaded using 'loader'; labels of rules that don't exist are dropped.
+func NewResolver(stub cipb.ClassIndexClient, timeout time.Duration, loader pkgloading.Loader) *Resolver {
+	return &Resolver{stub, timeout, loader}
+}
+
+// Name returns a description of the resolver.
+func (r *Resolver) Name() string {
+	return "ClassIndex"
+}
+
+// Resolve looks up class names in the index, and loads the rules it returns.
+func (r *Resolver) Resolve(ctx context.Context, classNames []jadeplib.ClassName, consumingRules map[bazel.Label]map[bazel.Label]bool) (map[jadeplib.ClassName][]*bazel.Rule, error) {
+	req := &cipb.LookupRequest{}
+	for _, cls := range classNames {
+		req.ClassNames = append(req.ClassNames, string(cls))
+	}
+	rctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	resp, err := r.stub.Lookup(rctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("error looking up class names in ClassIndex:\n%v", err)
+	}
+
+	candidates := make(map[jadeplib.ClassName][]bazel.Label)
+	for cls, labels := range resp.GetLabels() {
+		candidates[jadeplib.ClassName(cls)] = nil
+		for _, l := range labels.GetLabels() {
+			lbl, err := bazel.ParseAbsoluteLabel(l)
+			if err != nil {
+				continue
+			}
+			candidates[jadeplib.ClassName(cls)] = append(candidates[jadeplib.ClassName(cls)], lbl)
+		}
+	}
+
+	// Skip LoadRules call for class names that are already satisfied by a consuming rule.
+	alreadySat := resolverutil.SatisfiedByExistingDeps(consumingRules, candidates)
+	for cls := range alreadySat {
+		delete(candidates, cls)
+	}
+
+	var labels []bazel.Label
+	for _, c := range candidates {
+		labels = append(labels, c...)
+	}
+	rules, _, err := pkgloading.LoadRules(ctx, r.loader, labels)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[jadeplib.ClassName][]*bazel.Rule)
+	for cls, labels := range alreadySat {
+		for _, label := range labels {
+			p, n := label.Split()
+			result[cls] = append(result[cls], bazel.NewRule("", p, n, nil))
+		}
+	}
+	for cls, labels := range candidates {
+		result[cls] = nil
+		for _, label := range labels {
+			if rule, ok := rules[label]; ok {
+				result[cls] = append(result[cls], rule)
+			}
+		}
+	}
+	return result, nil
+}
+
+// DialOptions configures how to connect to a ClassIndex service.
+type DialOptions = grpccreds.Options
+
+// Dial connects to a ClassIndex service at 'addr'.
+func Dial(ctx context.Context, addr string, opts DialOptions) (*grpc.ClientConn, error) {
+	dialOpts, err := grpccreds.DialOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := grpc.DialContext(ctx, addr, dialOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to ClassIndex service at %s:\n%v", addr, err)
+	}
+	return conn, nil
+}
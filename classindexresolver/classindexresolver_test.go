@@ -0,0 +1,82 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package classindexresolver
+
+import (
+	"testing"
+	"time"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeptest"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc"
+
+	cipb "github.com/bazelbuild/tools_jvm_autodeps/java/com/google/devtools/javatools/jade/classindex_proto"
+)
+
+// fakeClassIndex is a ClassIndexClient that answers from an in-memory index.
+type fakeClassIndex struct {
+	index map[string][]string
+}
+
+func (f *fakeClassIndex) Lookup(ctx context.Context, in *cipb.LookupRequest, opts ...grpc.CallOption) (*cipb.LookupResponse, error) {
+	resp := &cipb.LookupResponse{Labels: make(map[string]*cipb.Labels)}
+	for _, cls := range in.ClassNames {
+		if labels, ok := f.index[cls]; ok {
+			resp.Labels[cls] = &cipb.Labels{Labels: labels}
+		}
+	}
+	return resp, nil
+}
+
+func TestResolve(t *testing.T) {
+	index := &fakeClassIndex{map[string][]string{
+		"com.Foo":           {"//foo:Foo", "//foo:Deleted"},
+		"com.Satisfied":     {"//sat:Sat"},
+		"java.lang.Builtin": nil,
+	}}
+	loader := jadeptest.NewLoader(jadeptest.Packages(
+		bazel.NewRule("java_library", "foo", "Foo", nil),
+		bazel.NewRule("java_library", "sat", "Sat", nil),
+	))
+	r := NewResolver(index, time.Minute, loader)
+
+	consumingRules := map[bazel.Label]map[bazel.Label]bool{"//x:x": {"//sat:Sat": true}}
+	resolved, err := r.Resolve(context.Background(), []jadeplib.ClassName{"com.Foo", "com.Satisfied", "java.lang.Builtin", "com.Unknown"}, consumingRules)
+	if err != nil {
+		t.Fatalf("Resolve returned error %v", err)
+	}
+	got := make(map[jadeplib.ClassName][]bazel.Label)
+	for cls, rules := range resolved {
+		got[cls] = nil
+		for _, rule := range rules {
+			got[cls] = append(got[cls], rule.Label())
+		}
+	}
+	want := map[jadeplib.ClassName][]bazel.Label{
+		"com.Foo":           {"//foo:Foo"},
+		"com.Satisfied":     {"//sat:Sat"},
+		"java.lang.Builtin": nil,
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("Resolve returned diff (-got +want):\n%s", diff)
+	}
+	// The package of the already satisfied class isn't loaded.
+	if diff := cmp.Diff(loader.Calls(), [][]string{{"foo"}}); diff != "" {
+		t.Errorf("Loaded packages diff (-got +want):\n%s", diff)
+	}
+}
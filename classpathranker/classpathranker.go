@@ -0,0 +1,64 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package classpathranker ranks deps by how much they'd grow the compile classpath of the rule that depends on them,
+// so that the lighter of equivalent candidates is suggested first.
+package classpathranker
+
+import (
+	"sort"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+)
+
+// Ranker is a jadeplib.DepsRanker, jadeplib.BatchDepsRanker and jadeplib.DepsScorer that ranks candidates by their estimated classpath delta,
+// smallest first. Candidates with the same estimate are ranked by Next.
+type Ranker struct {
+	Estimator *jadeplib.ClasspathEstimator
+	Next      jadeplib.DepsRanker
+}
+
+// Less returns true if label1's classpath is smaller than label2's, or if they're as large and Next ranks label1 first.
+// Without a consuming rule, the whole classpath of each label counts.
+func (r *Ranker) Less(ctx context.Context, label1, label2 bazel.Label) bool {
+	d1, d2 := r.Estimator.Delta(nil, label1), r.Estimator.Delta(nil, label2)
+	if d1 != d2 {
+		return d1 < d2
+	}
+	return r.Next.Less(ctx, label1, label2)
+}
+
+// RankDeps ranks candidates by Next, and then by how many targets each would add to the classpath of consumingRule,
+// keeping Next's order between candidates that add as many.
+func (r *Ranker) RankDeps(ctx context.Context, consumingRule *bazel.Rule, class jadeplib.ClassName, candidates []bazel.Label) []bazel.Label {
+	ret := jadeplib.RankDeps(ctx, r.Next, consumingRule, class, candidates)
+	deltas := make(map[bazel.Label]int)
+	for _, l := range ret {
+		deltas[l] = r.Estimator.Delta(consumingRule, l)
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return deltas[ret[i]] < deltas[ret[j]] })
+	return ret
+}
+
+// Score returns label's share of the inverse classpath sizes of candidates, so that a candidate whose classpath is much
+// smaller than those of the others scores close to 1, and candidates with classpaths of the same size score the same.
+func (r *Ranker) Score(ctx context.Context, className jadeplib.ClassName, label bazel.Label, candidates []bazel.Label) float64 {
+	total := 0.0
+	for _, c := range candidates {
+		total += 1 / float64(r.Estimator.Delta(nil, c))
+	}
+	return 1 / float64(r.Estimator.Delta(nil, label)) / total
+}
@@ -0,0 +1,86 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package classpathranker
+
+import (
+	"testing"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+	"github.com/bazelbuild/tools_jvm_autodeps/loadertest"
+	"github.com/bazelbuild/tools_jvm_autodeps/sortingdepsranker"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRanker(t *testing.T) {
+	type Attrs = map[string]interface{}
+	loader := &loadertest.StubLoader{Pkgs: map[string]*bazel.Package{
+		"a": {Rules: map[string]*bazel.Rule{
+			"heavy":  bazel.NewRule("java_library", "a", "heavy", Attrs{"deps": []string{"//b:x", "//b:y"}}),
+			"medium": bazel.NewRule("java_library", "a", "medium", Attrs{"exports": []string{"//b:y"}}),
+			"light":  bazel.NewRule("java_library", "a", "light", nil),
+		}},
+		"b": {Rules: map[string]*bazel.Rule{
+			"x": bazel.NewRule("java_library", "b", "x", nil),
+			"y": bazel.NewRule("java_library", "b", "y", nil),
+		}},
+	}}
+	ctx := context.Background()
+	r := &Ranker{Estimator: jadeplib.NewClasspathEstimator(ctx, loader, 5), Next: &sortingdepsranker.Ranker{}}
+
+	if !r.Less(ctx, "//a:light", "//a:heavy") || r.Less(ctx, "//a:heavy", "//a:medium") {
+		t.Errorf("Less doesn't rank //a:light before //a:medium before //a:heavy")
+	}
+
+	// //w:w already has //b:x and //b:y on its classpath, so //a:heavy and //a:medium add as much as //a:light.
+	consumer := bazel.NewRule("java_library", "w", "w", Attrs{"deps": []string{"//b:x", "//b:y"}})
+	tests := []struct {
+		consumingRule *bazel.Rule
+		want          []bazel.Label
+	}{
+		{nil, []bazel.Label{"//a:light", "//a:medium", "//a:heavy"}},
+		{consumer, []bazel.Label{"//a:heavy", "//a:light", "//a:medium"}},
+	}
+	for _, tt := range tests {
+		got := r.RankDeps(ctx, tt.consumingRule, "com.Foo", []bazel.Label{"//a:medium", "//a:heavy", "//a:light"})
+		if diff := cmp.Diff(got, tt.want); diff != "" {
+			t.Errorf("RankDeps(%v) returned diff (-got +want):\n%s", tt.consumingRule, diff)
+		}
+	}
+}
+
+func TestScore(t *testing.T) {
+	type Attrs = map[string]interface{}
+	loader := &loadertest.StubLoader{Pkgs: map[string]*bazel.Package{
+		"a": {Rules: map[string]*bazel.Rule{
+			"heavy": bazel.NewRule("java_library", "a", "heavy", Attrs{"deps": []string{"//b:x", "//b:y", "//b:z"}}),
+			"light": bazel.NewRule("java_library", "a", "light", nil),
+		}},
+		"b": {Rules: map[string]*bazel.Rule{
+			"x": bazel.NewRule("java_library", "b", "x", nil),
+			"y": bazel.NewRule("java_library", "b", "y", nil),
+			"z": bazel.NewRule("java_library", "b", "z", nil),
+		}},
+	}}
+	ctx := context.Background()
+	r := &Ranker{Estimator: jadeplib.NewClasspathEstimator(ctx, loader, 5), Next: &sortingdepsranker.Ranker{}}
+
+	// //a:heavy's classpath has 4 targets, //a:light's only itself.
+	got := jadeplib.ScoreCandidates(ctx, r, "com.Foo", []bazel.Label{"//a:heavy", "//a:light"})
+	if diff := cmp.Diff(got, []float64{0.2, 0.8}); diff != "" {
+		t.Errorf("ScoreCandidates returned diff (-got +want):\n%s", diff)
+	}
+}
@@ -16,11 +16,18 @@
 package cli
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime/pprof"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -28,13 +35,59 @@ import (
 	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
 	"github.com/bazelbuild/tools_jvm_autodeps/buildozer"
 	"github.com/bazelbuild/tools_jvm_autodeps/color"
+	"github.com/bazelbuild/tools_jvm_autodeps/filter"
 	"github.com/bazelbuild/tools_jvm_autodeps/future"
 	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
 	"github.com/bazelbuild/tools_jvm_autodeps/lang/java/parser"
+	"github.com/bazelbuild/tools_jvm_autodeps/macros"
+	"github.com/bazelbuild/tools_jvm_autodeps/mavenindex"
 	"github.com/bazelbuild/tools_jvm_autodeps/pkgloading"
 	"github.com/bazelbuild/tools_jvm_autodeps/vlog"
 )
 
+// ExpandArgs expands command-line arguments that refer to lists of arguments, and removes duplicates.
+// An argument of the form @<file name> is replaced by the lines of that file (a "response file"),
+// and an argument "-" is replaced by the lines read from 'stdin'.
+// Empty lines are ignored, and the order of first appearance is preserved.
+// This allows, e.g., `git diff --name-only | jadep -` without hitting OS limits on the length of argv.
+// Note that "-" consumes stdin, so it can't be combined with interactive prompts.
+func ExpandArgs(args []string, stdin io.Reader) ([]string, error) {
+	var ret []string
+	seen := make(map[string]bool)
+	add := func(a string) {
+		a = strings.TrimSpace(a)
+		if a != "" && !seen[a] {
+			seen[a] = true
+			ret = append(ret, a)
+		}
+	}
+	for _, arg := range args {
+		var r io.Reader
+		switch {
+		case arg == "-":
+			r = stdin
+		case strings.HasPrefix(arg, "@"):
+			f, err := os.Open(arg[1:])
+			if err != nil {
+				return nil, fmt.Errorf("error opening response file:\n%v", err)
+			}
+			defer f.Close()
+			r = f
+		default:
+			add(arg)
+			continue
+		}
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			add(scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("error reading arguments from %s:\n%v", arg, err)
+		}
+	}
+	return ret, nil
+}
+
 // FilesToParse returns the list of files to parse based on 'arg'.
 // If arg is a label, FilesToParse loads the rule and returns the files referenced in its "srcs" attribute.
 // Otherwise, 'arg' is assumed to be a file name which is returned in absolute form.
@@ -69,24 +122,96 @@ func FilesToParse(arg, workingDir string, loader pkgloading.Loader) ([]string, e
 	return ret, nil
 }
 
+// FilesToParseAbs is like FilesToParse, but it doesn't depend on the working directory, and returns absolute file names.
+// 'arg' is either a label or an absolute file name, and workspaceDir is the absolute path of the workspace root (e.g., from FindWorkspace).
+// It allows a single process (e.g., an editor integration) to process files from multiple workspaces concurrently.
+func FilesToParseAbs(ctx context.Context, workspaceDir string, loader pkgloading.Loader, arg string) ([]string, error) {
+	if err := checkAbsArg(workspaceDir, arg); err != nil {
+		return nil, err
+	}
+	label, err := bazel.ParseAbsoluteLabel(arg)
+	if err != nil {
+		return []string{arg}, nil
+	}
+	rules, _, err := pkgloading.LoadRules(ctx, loader, []bazel.Label{label})
+	if err != nil {
+		return nil, fmt.Errorf("Error while loading %v:\n%v", label, err)
+	}
+	rule := rules[label]
+	if rule == nil {
+		return nil, fmt.Errorf("Rule not found: %v", label)
+	}
+	var ret []string
+	for _, s := range rule.StringListAttr("srcs") {
+		lbl, err := bazel.ParseRelativeLabel(rule.PkgName, s)
+		if err != nil {
+			log.Printf("Illegal label %q in srcs attribute, skipping.", s)
+			continue
+		}
+		p, n := lbl.Split()
+		ret = append(ret, filepath.Join(workspaceDir, filepath.FromSlash(p), filepath.FromSlash(n)))
+	}
+	return ret, nil
+}
+
+// rulesGeneratedBy returns the Java rules in pkgs whose SourceLabel is label, i.e. the rules generated by the macro call named by label.
+func rulesGeneratedBy(pkgs map[string]*bazel.Package, label bazel.Label) []*bazel.Rule {
+	pkgName, _ := label.Split()
+	pkg := pkgs[pkgName]
+	if pkg == nil {
+		return nil
+	}
+	var ret []*bazel.Rule
+	for _, r := range pkg.Rules {
+		if filter.JavaEditableRuleKinds[r.Schema] && r.SourceLabel() == label {
+			ret = append(ret, r)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Label() < ret[j].Label() })
+	return ret
+}
+
+// RulesToFixAbs is like RulesToFix, but it doesn't depend on the working directory.
+// 'arg' is either a label or an absolute file name inside config.WorkspaceDir, which must be absolute.
+func RulesToFixAbs(ctx context.Context, config jadeplib.Config, arg string, namingRules []jadeplib.NamingRule, defaultRuleKind string) ([]*bazel.Rule, error) {
+	if err := checkAbsArg(config.WorkspaceDir, arg); err != nil {
+		return nil, err
+	}
+	return RulesToFix(ctx, config, "", arg, namingRules, defaultRuleKind)
+}
+
+// checkAbsArg returns an error unless workspaceDir is absolute, and arg is a label or an absolute file name.
+func checkAbsArg(workspaceDir, arg string) error {
+	if !filepath.IsAbs(workspaceDir) {
+		return fmt.Errorf("workspace directory %q is not absolute", workspaceDir)
+	}
+	if _, err := bazel.ParseAbsoluteLabel(arg); err != nil && !filepath.IsAbs(arg) {
+		return fmt.Errorf("%q is neither a label nor an absolute file name", arg)
+	}
+	return nil
+}
+
 // RulesToFix returns the set of rules whose 'deps' Jade should manipulate, based on 'arg'.
-// If 'arg' is a label, it will be loaded and returned.
+// If 'arg' is a label, it will be loaded and returned. If it names a macro call rather than a rule, the Java rules the macro generates are returned.
 // Otherwise, 'arg' is assumed to be a file name, and RulesToFix will load its containig package and return any Java rule that 'srcs' it.
 // In this case, 'arg' is treated relative to 'relWorkingDir', which is the working directory relative to the workspace root.
 // For a description of namingRules and defaultRuleKind, see jadeplib.CreateRule.
 func RulesToFix(ctx context.Context, config jadeplib.Config, relWorkingDir, arg string, namingRules []jadeplib.NamingRule, defaultRuleKind string) ([]*bazel.Rule, error) {
 	label, err := bazel.ParseAbsoluteLabel(arg)
 	if err == nil {
-		rules, _, err := pkgloading.LoadRules(ctx, config.Loader, []bazel.Label{label})
+		rules, pkgs, err := pkgloading.LoadRules(ctx, config.Loader, []bazel.Label{label})
 		if err != nil {
 			return nil, fmt.Errorf("Error loading %q:\n%v", label, err)
 		}
 
-		r := rules[label]
-		if r == nil {
-			return nil, fmt.Errorf("Rule not found: %v", label)
+		if r := rules[label]; r != nil {
+			return []*bazel.Rule{r}, nil
 		}
-		return []*bazel.Rule{r}, nil
+		// The label might be the name of a macro call, as written in the BUILD file.
+		if generated := rulesGeneratedBy(pkgs, label); len(generated) > 0 {
+			return macros.Select(Macros, generated), nil
+		}
+		return nil, fmt.Errorf("Rule not found: %v", label)
 	}
 
 	var fileName string
@@ -109,162 +234,1609 @@ func RulesToFix(ctx context.Context, config jadeplib.Config, relWorkingDir, arg
 		return nil, fmt.Errorf("Error from finding rules to fix from %q:\n%v", arg, err)
 	}
 	if len(ret) > 0 {
-		return ret, nil
+		return macros.Select(Macros, ret), nil
+	}
+
+	// package-info.java and module-info.java declare no class, so a rule named after them would be bogus.
+	switch filepath.Base(fileName) {
+	case "package-info.java":
+		if PackageInfoPolicy == PackageInfoPolicySkip {
+			log.Printf("No rule srcs %s; skipping it", fileName)
+			return nil, nil
+		}
+		return packageRules(ctx, config, fileName)
+	case "module-info.java":
+		log.Printf("No rule srcs %s; skipping it, since module descriptors are only fixed in the rules that compile them", fileName)
+		return nil, nil
+	}
+
+	if !EditBuildFiles {
+		log.Printf("No rule srcs %s; skipping it, since BUILD files aren't edited", fileName)
+		return nil, nil
 	}
 
-	// No rules consumes file name - create one,
-	newRule := jadeplib.CreateRule(fileName, namingRules, defaultRuleKind)
+	// No rules consumes file name - create one, or add it to an existing rule, depending on NewRulePolicy.
+	newRule := jadeplib.CreateRuleWithTemplates(fileName, namingRules, defaultRuleKind, NewRuleTemplates)
+	var pkg *bazel.Package
+	if pkgs, err := config.Loader.Load(ctx, []string{newRule.PkgName}); err == nil {
+		pkg = pkgs[newRule.PkgName]
+	}
+	if pkg != nil {
+		existing, err := chooseExistingRule(ctx, newRule, existingRuleCandidates(pkg, newRule.Schema))
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			rules, err := addSrcsToExistingRule(config.WorkspaceDir, existing, newRule.StringListAttr("srcs"))
+			if err != nil {
+				return nil, err
+			}
+			return reloadRules(ctx, config, rules), nil
+		}
+	}
+	// Some packages require attributes that Bazel doesn't default, e.g. licenses in third_party/.
+	jadeplib.ApplyRequiredAttrs(pkg, newRule, NewRuleRequiredAttrs)
+	if testClass := TestClasses(ctx, config.WorkspaceDir, []*bazel.Rule{newRule})[newRule]; testClass != "" {
+		newRule.Attrs["test_class"] = testClass
+	}
 	err = buildozer.NewRule(config.WorkspaceDir, newRule)
 	if err != nil {
 		return nil, err
 	}
-	return []*bazel.Rule{newRule}, nil
+	// The new rule inherits package-level defaults, e.g. it's testonly in a package with default_testonly = 1.
+	if pkg != nil {
+		pkg.ApplyDefaults(newRule)
+	}
+	return reloadRules(ctx, config, []*bazel.Rule{newRule}), nil
 }
 
-// LogRulesToFix prints 'rules'.
-// It is used to announce which rules we're about to fix.
-func LogRulesToFix(rules []*bazel.Rule) {
-	if len(rules) == 0 {
-		return
-	}
-	var strs []string
+// reloadRules reloads the packages of rules after RulesToFix edited their BUILD files, and returns the rules as the loader now sees them,
+// so that filtering (e.g. visibility and sibling rules) and the following arguments of the same run see the edits.
+// config.Loader's cache and config.AnalysisCache forget the packages first. Rules that can't be reloaded, or whose reloaded srcs
+// don't reflect the edit yet, are returned as they are.
+func reloadRules(ctx context.Context, config jadeplib.Config, rules []*bazel.Rule) []*bazel.Rule {
+	pkgNames := make(map[string]bool)
 	for _, r := range rules {
-		strs = append(strs, string(r.Label()))
+		pkgNames[r.PkgName] = true
 	}
-	log.Printf("Fixing: %s", strings.Join(strs, ", "))
+	var toLoad []string
+	for p := range pkgNames {
+		toLoad = append(toLoad, p)
+		if config.AnalysisCache != nil {
+			config.AnalysisCache.ForgetPackage(p)
+		}
+	}
+	if cl, ok := config.Loader.(*pkgloading.CachingLoader); ok {
+		cl.Invalidate(toLoad)
+	}
+	pkgs, err := config.Loader.Load(ctx, toLoad)
+	if err != nil {
+		log.Printf("WARNING: Error reloading %s after editing it:\n%v", strings.Join(toLoad, ", "), err)
+		return rules
+	}
+	ret := make([]*bazel.Rule, len(rules))
+	for i, r := range rules {
+		ret[i] = r
+		if pkg := pkgs[r.PkgName]; pkg != nil {
+			// A loader that doesn't see the edit yet, e.g. a server with a stale view of the workspace, returns the rule without its new srcs.
+			if reloaded := pkg.Rules[r.Name()]; reloaded != nil && reloaded.Schema == r.Schema && hasSrcs(reloaded, r.StringListAttr("srcs")) {
+				ret[i] = reloaded
+			}
+		}
+	}
+	return ret
 }
 
-// Workspace returns the directory path of the workspace in which Jade should operate (workspaceDir) and the working dir relative to it (relWorkingDir).
-// workspaceFlag is what the user specified on the command-line.
-// If workspaceFlag is empty, Workspace() searches for a directory that contains a WORKSPACE file starting at the working directory and moving upwards.
-// relWorkingDir will be empty if workspaceFlag isn't empty (= -workspace was specifief explicitly)
-func Workspace(workspaceFlag string) (workspaceDir, relWorkingDir string, err error) {
-	if workspaceFlag != "" {
-		result, err := filepath.Abs(workspaceFlag)
+// hasSrcs returns true if all of srcs are in rule's srcs.
+func hasSrcs(rule *bazel.Rule, srcs []string) bool {
+	have := make(map[string]bool)
+	for _, src := range rule.StringListAttr("srcs") {
+		have[src] = true
+	}
+	for _, src := range srcs {
+		if !have[src] {
+			return false
+		}
+	}
+	return true
+}
+
+// packageRules returns the Java rules that src the other Java files in the directory of fileName, which is relative to the workspace root.
+func packageRules(ctx context.Context, config jadeplib.Config, fileName string) ([]*bazel.Rule, error) {
+	dir := filepath.Dir(fileName)
+	files, err := ioutil.ReadDir(filepath.Join(config.WorkspaceDir, dir))
+	if err != nil {
+		return nil, fmt.Errorf("error listing the Java files next to %s:\n%v", fileName, err)
+	}
+	seen := make(map[bazel.Label]bool)
+	var ret []*bazel.Rule
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, ".java") || name == "package-info.java" || name == "module-info.java" {
+			continue
+		}
+		rules, err := jadeplib.RulesConsumingFile(ctx, config, filepath.Join(dir, name))
 		if err != nil {
-			return "", "", fmt.Errorf("couldn't make directory absolute: %v", err)
+			return nil, fmt.Errorf("Error from finding rules to fix from %q:\n%v", fileName, err)
 		}
-		if !hasWORKSPACE(result) {
-			return "", "", fmt.Errorf("directory %v has no file named WORKSPACE", result)
+		for _, r := range rules {
+			if !seen[r.Label()] {
+				seen[r.Label()] = true
+				ret = append(ret, r)
+			}
 		}
-		return result, "", nil
 	}
+	if len(ret) == 0 {
+		log.Printf("No rule srcs %s or the other Java files in its directory; skipping it", fileName)
+		return nil, nil
+	}
+	return macros.Select(Macros, ret), nil
+}
 
-	wd, err := os.Getwd()
-	if err != nil {
-		return "", "", fmt.Errorf("couldn't get working directory: %v", err)
+// PackageInfoPolicy determines what RulesToFix does when no rule consumes a package-info.java file.
+// It is one of the PackageInfoPolicy* constants.
+var PackageInfoPolicy = PackageInfoPolicyPackageRules
+
+// Values of PackageInfoPolicy.
+const (
+	// PackageInfoPolicyPackageRules fixes the rules that src the other Java files in the directory of package-info.java,
+	// so the annotations of their Java package resolve in them.
+	PackageInfoPolicyPackageRules = "package_rules"
+
+	// PackageInfoPolicySkip skips package-info.java.
+	PackageInfoPolicySkip = "skip"
+)
+
+// Values of NewRulePolicy.
+const (
+	// NewRulePolicyCreate always creates a new rule for a file that no rule consumes.
+	NewRulePolicyCreate = "create"
+
+	// NewRulePolicyAdd adds the file to the srcs of the existing rule in its package, if there is exactly one rule of the kind that would have been created.
+	// Otherwise, a new rule is created.
+	NewRulePolicyAdd = "add"
+
+	// NewRulePolicyAsk asks the user whether to create a new rule, or to add the file to one of the existing rules in its package of the kind that would have been created.
+	NewRulePolicyAsk = "ask"
+)
+
+// NewRulePolicy determines what RulesToFix does when no rule consumes a file, but its package already has rules that could.
+// It is one of the NewRulePolicy* constants.
+var NewRulePolicy = NewRulePolicyCreate
+
+// EditBuildFiles is false when RulesToFix must not edit BUILD files, e.g. when edits are only recorded in an edit plan.
+// A file that no rule consumes is then skipped, instead of being added to a new or existing rule.
+var EditBuildFiles = true
+
+// NewRuleRequiredAttrs lists the attributes that RulesToFix sets on the rules it creates, depending on their package.
+var NewRuleRequiredAttrs []jadeplib.RequiredAttrs
+
+// NewRuleTemplates maps rule kinds to the attributes that RulesToFix sets on the rules of that kind it creates, e.g. test_class for java_test.
+var NewRuleTemplates map[string]jadeplib.RuleTemplate
+
+// Macros describes how to edit the calls of macros that generate the rules RulesToFix returns.
+// Of the rules a call generates, RulesToFix only returns the one named by the macro's target (see macros.Select).
+var Macros map[string]macros.Macro
+
+// Stdin is where NewRulePolicyAsk reads the user's answers from, e.g. a file of answers for scripted runs.
+var Stdin io.Reader = os.Stdin
+
+// existingRuleCandidates returns the rules of kind 'kind' in pkg that Jadep can edit, sorted by name.
+func existingRuleCandidates(pkg *bazel.Package, kind string) []*bazel.Rule {
+	var ret []*bazel.Rule
+	for _, r := range pkg.Rules {
+		if r.Schema == kind && filter.JavaEditableRuleKinds[r.Schema] {
+			ret = append(ret, r)
+		}
 	}
-	for result := wd; result != string(filepath.Separator); result = filepath.Dir(result) {
-		if hasWORKSPACE(result) {
-			relWorkingDir, err = filepath.Rel(result, wd)
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name() < ret[j].Name() })
+	return ret
+}
+
+// chooseExistingRule returns the rule among candidates that newRule's srcs should be added to, or nil if newRule should be created.
+// The choice is made according to NewRulePolicy. Asking the user is abandoned when ctx is done.
+func chooseExistingRule(ctx context.Context, newRule *bazel.Rule, candidates []*bazel.Rule) (*bazel.Rule, error) {
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+	switch NewRulePolicy {
+	case NewRulePolicyAdd:
+		if len(candidates) == 1 {
+			return candidates[0], nil
+		}
+		return nil, nil
+	case NewRulePolicyAsk:
+		fmt.Println()
+		fmt.Printf("No rule consumes %s. Choose one of the options below:\n", strings.Join(newRule.StringListAttr("srcs"), ", "))
+		for i := len(candidates) - 1; i >= 0; i-- {
+			fmt.Printf("[%v] Add to %v\n", i+1, describeRule(candidates[i]))
+		}
+		fmt.Printf("[0] Create %v\n", newRule.Label())
+		fmt.Print("Hit Enter to create a new rule, or a number to choose: ")
+		for {
+			i, err := jadeplib.ReadAnswer(ctx, Stdin)
 			if err != nil {
-				return "", "", fmt.Errorf("couldn't relative %s to %s", result, wd)
+				if err == io.EOF {
+					return nil, fmt.Errorf("Error reading stdin: %v", err)
+				}
+				return nil, err
+			}
+			if i == "" {
+				return nil, nil
 			}
-			if relWorkingDir == "." {
-				relWorkingDir = ""
+			idx, err := strconv.Atoi(i)
+			if err != nil || idx < 0 || idx > len(candidates) {
+				fmt.Println("Invalid input. Please try again.")
+				continue
 			}
-			return result, relWorkingDir, nil
+			if idx == 0 {
+				return nil, nil
+			}
+			return candidates[idx-1], nil
 		}
 	}
-	return "", "", fmt.Errorf("couldn't find a parent of %v that has a WORKSPACE file", wd)
+	return nil, nil
 }
 
-func hasWORKSPACE(dir string) bool {
-	_, err := os.Stat(filepath.Join(dir, "WORKSPACE"))
-	return !os.IsNotExist(err)
+// addSrcsToExistingRule adds srcs to rule's srcs, and returns a copy of rule that reflects the change.
+// rule itself isn't modified, since it might be cached by the loader.
+func addSrcsToExistingRule(workspaceDir string, rule *bazel.Rule, srcs []string) ([]*bazel.Rule, error) {
+	if err := buildozer.AddSrcs(workspaceDir, rule, srcs); err != nil {
+		return nil, err
+	}
+	attrs := make(map[string]interface{})
+	for k, v := range rule.Attrs {
+		attrs[k] = v
+	}
+	attrs["srcs"] = append(append([]string(nil), rule.StringListAttr("srcs")...), srcs...)
+	return []*bazel.Rule{bazel.NewRule(rule.Schema, rule.PkgName, rule.Name(), attrs)}, nil
 }
 
-// StartProfiler starts CPU profiling and writes the output to outFile.
-func StartProfiler(outFile string) (stopProfiler func()) {
-	if outFile == "" {
-		return func() {}
-	}
-	f, err := os.Create(outFile)
-	if err != nil {
-		log.Fatal(err)
+// LogRulesToFix reports 'rules' to Output.
+// It is used to announce which rules we're about to fix.
+func LogRulesToFix(rules []*bazel.Rule) {
+	if err := Output.RulesToFix(rules); err != nil {
+		log.Printf("WARNING: %v", err)
 	}
-	pprof.StartCPUProfile(f)
-	return pprof.StopCPUProfile
 }
 
-// ReportMissingDeps logs the dependencies that Jadep detected as missing.
-func ReportMissingDeps(missingDeps map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label) {
-	anythingMissing := false
-	for editedRule, classToRule := range missingDeps {
-		log.Printf("Missing dependencies in %s", editedRule.Label())
-		for cls, lbls := range classToRule {
-			var lblsStr []string
-			for _, l := range lbls {
-				lblsStr = append(lblsStr, string(l))
+// PlanSplits returns plans to split those of 'rules' whose srcs declare more than one Java package.
+// See jadeplib.PlanSplitByJavaPackage.
+func PlanSplits(ctx context.Context, workspaceDir string, rules []*bazel.Rule) []*jadeplib.SplitPlan {
+	var plans []*jadeplib.SplitPlan
+	for _, r := range rules {
+		fileToSrc := make(map[string]string)
+		var files []string
+		for _, src := range r.StringListAttr("srcs") {
+			if !strings.HasSuffix(src, ".java") || strings.ContainsAny(src, ":/") {
+				continue
 			}
-			log.Printf("%-50s can be satisfied using:", cls)
-			log.Printf("             %s", strings.Join(lblsStr, ", "))
-			anythingMissing = true
+			f := filepath.Join(workspaceDir, r.PkgName, src)
+			fileToSrc[f] = src
+			files = append(files, f)
+		}
+		javaPackages := make(map[string]string)
+		for f, javaPkg := range parser.JavaPackages(ctx, files) {
+			javaPackages[fileToSrc[f]] = javaPkg
+		}
+		if plan := jadeplib.PlanSplitByJavaPackage(r, javaPackages); plan != nil {
+			plans = append(plans, plan)
 		}
 	}
-	if !anythingMissing {
-		log.Println("Nothing to do.")
+	return plans
+}
+
+// NarrowSplitDeps narrows the deps of the new rules of plans to the ones their own srcs need, parsing the class names they reference.
+// The new rules whose deps can't be narrowed keep all the deps of the rule they're split from. See jadeplib.NarrowSplitDeps.
+// implicitImports and blacklist are as in ClassNamesToResolve.
+func NarrowSplitDeps(ctx context.Context, config jadeplib.Config, plans []*jadeplib.SplitPlan, implicitImports []string, blacklist *jadeplib.ClassNameBlacklist) {
+	for _, plan := range plans {
+		for _, r := range plan.NewRules {
+			if !plan.ApproximateDeps[r.Label()] {
+				continue
+			}
+			var files []string
+			for _, src := range r.StringListAttr("srcs") {
+				files = append(files, filepath.Join(config.WorkspaceDir, r.PkgName, src))
+			}
+			classNames, errs := parser.ReferencedClasses(ctx, files, implicitImports)
+			if len(errs) > 0 {
+				continue
+			}
+			jadeplib.NarrowSplitDeps(ctx, config, plan, r, blacklist.Filter(classNames))
+		}
 	}
 }
 
-// ReportUnresolvedClassnames logs the class names that Jadep couldn't find any BUILD dependencies for.
-func ReportUnresolvedClassnames(unresolvedClassNames []jadeplib.ClassName) {
-	if len(unresolvedClassNames) == 0 {
-		return
+// TestClasses returns the test_class that each of rules should set, but doesn't, according to the package declaration of its test source.
+// Rules for which Bazel infers the right class are omitted. See jadeplib.InferTestClass.
+func TestClasses(ctx context.Context, workspaceDir string, rules []*bazel.Rule) map[*bazel.Rule]string {
+	srcs := make(map[*bazel.Rule]string)
+	var files []string
+	for _, r := range rules {
+		if src := jadeplib.TestSrc(r); src != "" {
+			f := filepath.Join(workspaceDir, r.PkgName, src)
+			srcs[r] = f
+			files = append(files, f)
+		}
 	}
-	printHeader("Couldn't find BUILD rules for class names:", color.BoldMagenta)
-	for _, cls := range unresolvedClassNames {
-		log.Println(color.Magenta("?DEP") + color.DarkGray(" for ") + string(cls))
+	if len(files) == 0 {
+		return nil
+	}
+	javaPackages := parser.JavaPackages(ctx, files)
+	ret := make(map[*bazel.Rule]string)
+	for r, f := range srcs {
+		javaPkg, ok := javaPackages[f]
+		if !ok {
+			continue
+		}
+		if cls := jadeplib.InferTestClass(r, javaPkg); cls != "" {
+			ret[r] = cls
+		}
 	}
+	return ret
 }
 
-// ReportAddedDeps prints which deps this Jadep run added to which consuming rule.
-func ReportAddedDeps(addedDeps map[*bazel.Rule][]bazel.Label) {
-	if len(addedDeps) == 0 {
-		return
+// ReportTestClasses logs the test_class that rules should set, e.g. with --dry_run.
+func ReportTestClasses(testClasses map[*bazel.Rule]string) {
+	var rules []*bazel.Rule
+	for r := range testClasses {
+		rules = append(rules, r)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Label() < rules[j].Label() })
+	for _, r := range rules {
+		log.Printf("%s doesn't set test_class, and Bazel can't infer it from its path; it should be %s", describeRule(r), testClasses[r])
 	}
+}
 
-	for consuming, deps := range addedDeps {
-		printHeader("Added to "+string(consuming.Label()), color.BoldGreen)
-		for _, dep := range deps {
-			log.Println(color.Green("+DEP") + " " + string(dep))
+// SetTestClasses sets the test_class of rules, as returned by TestClasses.
+func SetTestClasses(workspaceDir string, testClasses map[*bazel.Rule]string) error {
+	var rules []*bazel.Rule
+	for r := range testClasses {
+		rules = append(rules, r)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Label() < rules[j].Label() })
+	for _, r := range rules {
+		if err := buildozer.SetTestClass(workspaceDir, r, testClasses[r]); err != nil {
+			return fmt.Errorf("error setting test_class of %s:\n%v", r.Label(), err)
 		}
+		log.Printf("Set test_class of %s to %s", describeRule(r), testClasses[r])
+		r.Attrs["test_class"] = testClasses[r]
 	}
+	return nil
 }
 
-func printHeader(header string, colorizer func(string) string) {
-	log.Println("")
-	log.Println(colorizer(header))
-	log.Println(colorizer(strings.Repeat("-", len(header))))
+// ResourceSuggestion suggests adding a resource that a rule's sources load from the class path to one of the rule's attributes.
+// Such resources aren't classes, so no dependency provides them.
+type ResourceSuggestion struct {
+	Rule *bazel.Rule
+
+	// Resource is the class path of the resource, e.g. "com/google/foo/data.txt".
+	Resource string
+
+	// Label is the file to add, or a filegroup in the file's package that contains it.
+	Label bazel.Label
+
+	// Attr is the attribute to add Label to: "resources" for Java rules, which put it on the class path, and "data" otherwise.
+	Attr string
 }
 
-// ClassNamesToResolve returns the list of class names which should be satisfied with BUILD dependencies.
-// If the user provided a list in --classnames (which is passed in classNamesArg), that list is returned.
-// Otherwise, it parses Java files as described in FilesToParse().
-// blacklist is a list of regular expressions matching names of classes for which we will not look for BUILD rules.
-// See FilesToParse for explanation about 'workingDir' and 'arg'.
-func ClassNamesToResolve(ctx context.Context, workingDir string, loader pkgloading.Loader, arg string, classNamesArg []string, implicitImports *future.Value, blacklist []string) []jadeplib.ClassName {
-	if len(classNamesArg) > 0 {
-		var ret []jadeplib.ClassName
-		for _, c := range classNamesArg {
-			parts := strings.Split(c, ".")
-			if topLevel, idx := parser.ExtractClassNameFromQualifiedName(parts); idx != -1 {
-				ret = append(ret, jadeplib.ClassName(topLevel))
-			} else {
-				ret = append(ret, jadeplib.ClassName(c))
+// ResourceSuggestions returns the resources that the Java srcs of rules load by name, but that the rules don't list in their
+// resources or data. See parser.ReferencedResources.
+// Resources are looked up under each of contentRoots, and under its Maven resources directory (e.g. src/main/resources for src/main/java).
+// Resources that aren't found there, e.g. because a dependency's jar provides them, are skipped.
+func ResourceSuggestions(ctx context.Context, config jadeplib.Config, contentRoots []string, rules []*bazel.Rule) []ResourceSuggestion {
+	var ret []ResourceSuggestion
+	for _, r := range rules {
+		var files []string
+		for _, src := range r.StringListAttr("srcs") {
+			if !strings.HasSuffix(src, ".java") || strings.ContainsAny(src, ":/") {
+				continue
+			}
+			files = append(files, filepath.Join(config.WorkspaceDir, r.PkgName, src))
+		}
+		seen := make(map[string]bool)
+		var resources []string
+		for _, res := range parser.ReferencedResources(ctx, files) {
+			for _, res := range res {
+				if !seen[res] {
+					seen[res] = true
+					resources = append(resources, res)
+				}
+			}
+		}
+		if len(resources) == 0 {
+			continue
+		}
+		sort.Strings(resources)
+
+		listed := make(map[bazel.Label]bool)
+		for _, attr := range []string{"resources", "data"} {
+			for _, l := range r.LabelListAttr(attr) {
+				listed[l] = true
+			}
+		}
+		attr := "data"
+		if strings.HasPrefix(r.Schema, "java_") {
+			attr = "resources"
+		}
+	resourceLoop:
+		for _, res := range resources {
+			lbls, err := resourceLabels(ctx, config, contentRoots, res)
+			if err != nil {
+				log.Printf("WARNING: Error looking up resource %s of %s:\n%v", res, r.Label(), err)
+				continue
+			}
+			if len(lbls) == 0 {
+				vlog.V(2).Printf("Resource %s of %s not found under any content root", res, r.Label())
+				continue
+			}
+			for _, l := range lbls {
+				if listed[l] {
+					continue resourceLoop
+				}
 			}
+			ret = append(ret, ResourceSuggestion{Rule: r, Resource: res, Label: lbls[0], Attr: attr})
 		}
-		return ret
 	}
+	return ret
+}
 
-	filesToParse, err := FilesToParse(arg, workingDir, loader)
-	if err != nil {
-		log.Fatal(err)
+// resourceLabels returns the labels through which a rule can list the file of a class path resource:
+// the filegroups in the file's package that contain it, sorted, followed by the file itself.
+// Returns nil if the file isn't found under contentRoots or isn't in a package.
+func resourceLabels(ctx context.Context, config jadeplib.Config, contentRoots []string, resource string) ([]bazel.Label, error) {
+	var pkgNameCache *pkgloading.PackageNameCache
+	if config.AnalysisCache != nil {
+		pkgNameCache = config.AnalysisCache.PackageNames
 	}
-	stopwatch := time.Now()
-	ret := jadeplib.ExcludeClassNames(blacklist, parser.ReferencedClasses(ctx, filesToParse, implicitImports.Get().([]string)))
-	vlog.V(2).Printf("Class names to resolve:\n%v", ret)
+	for _, root := range resourceRoots(contentRoots) {
+		fileName := filepath.Join(root, filepath.FromSlash(resource))
+		if _, err := os.Stat(filepath.Join(config.WorkspaceDir, fileName)); err != nil {
+			continue
+		}
+		pkgs, fileToPkgName, err := pkgloading.SiblingsWithCache(ctx, config.Loader, config.WorkspaceDir, []string{fileName}, pkgNameCache)
+		if err != nil {
+			return nil, err
+		}
+		pkgName, ok := fileToPkgName[fileName]
+		if !ok {
+			return nil, nil
+		}
+		relFileName, err := filepath.Rel(pkgName, fileName)
+		if err != nil {
+			return nil, err
+		}
+		fileLabel := bazel.Label("//" + filepath.ToSlash(pkgName) + ":" + filepath.ToSlash(relFileName))
+		var ret []bazel.Label
+		if pkg := pkgs[pkgName]; pkg != nil {
+			for _, rule := range pkg.Rules {
+				if rule.Schema == "filegroup" && containsLabel(rule.LabelListAttr("srcs"), fileLabel) {
+					ret = append(ret, rule.Label())
+				}
+			}
+		}
+		sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+		return append(ret, fileLabel), nil
+	}
+	return nil, nil
+}
 
-	log.Printf("Found %d classes in %d Java file(s) (%dms)", len(ret), len(filesToParse), int64(time.Now().Sub(stopwatch)/time.Millisecond))
+// resourceRoots returns the directories, relative to the workspace root, that class path resources are looked up in:
+// each of contentRoots, followed by its Maven resources directory if it's a "java" directory.
+func resourceRoots(contentRoots []string) []string {
+	var ret []string
+	seen := make(map[string]bool)
+	add := func(dir string) {
+		if !seen[dir] {
+			seen[dir] = true
+			ret = append(ret, dir)
+		}
+	}
+	for _, root := range contentRoots {
+		root = filepath.Clean(root)
+		add(root)
+		if filepath.Base(root) == "java" {
+			add(filepath.Join(filepath.Dir(root), "resources"))
+		}
+	}
 	return ret
 }
+
+// ReportResourceSuggestions logs the resources that rules load by name but don't list, and what to add for them instead of a dependency.
+func ReportResourceSuggestions(suggestions []ResourceSuggestion) {
+	for _, s := range suggestions {
+		log.Printf("%s loads the resource %s, which isn't a class; consider adding %s to its %s", describeRule(s.Rule), s.Resource, displayLabel(s.Rule, s.Label), s.Attr)
+	}
+}
+
+// ReportSplitPlans warns about rules whose srcs declare more than one Java package, and describes how to split them.
+func ReportSplitPlans(plans []*jadeplib.SplitPlan) {
+	for _, plan := range plans {
+		log.Printf("WARNING: the srcs of %s declare classes in %d different Java packages. Consider splitting it into:", describeRule(plan.Rule), len(plan.NewRules))
+		for _, r := range plan.NewRules {
+			deps := strings.Join(r.StringListAttr("deps"), ", ")
+			if deps == "" {
+				deps = "none"
+			}
+			if plan.ApproximateDeps[r.Label()] {
+				deps = "all the deps of " + plan.Rule.Label().RelativeTo(r.PkgName) + ", some of which it may not need"
+			}
+			log.Printf("             %s (srcs = %s; deps = %s)", r.Label(), strings.Join(r.StringListAttr("srcs"), ", "), deps)
+		}
+	}
+}
+
+// ApplySplitPlans splits rules according to 'plans' using Buildozer.
+// It returns rulesToFix, in which every rule that was split is replaced by the new rules it was split into.
+func ApplySplitPlans(workspaceDir string, rulesToFix []*bazel.Rule, plans []*jadeplib.SplitPlan) ([]*bazel.Rule, error) {
+	newRules := make(map[*bazel.Rule][]*bazel.Rule)
+	for _, plan := range plans {
+		if err := buildozer.SplitRule(workspaceDir, plan); err != nil {
+			return nil, fmt.Errorf("error splitting %s:\n%v", plan.Rule.Label(), err)
+		}
+		newRules[plan.Rule] = plan.NewRules
+	}
+	var ret []*bazel.Rule
+	for _, r := range rulesToFix {
+		if nr, ok := newRules[r]; ok {
+			ret = append(ret, nr...)
+		} else {
+			ret = append(ret, r)
+		}
+	}
+	return ret, nil
+}
+
+// ReportVisibilityPlans warns about deps that were added to rules that can't see them, and describes how to make them visible.
+func ReportVisibilityPlans(plans []*jadeplib.VisibilityPlan) {
+	for _, plan := range plans {
+		log.Printf("WARNING: %s isn't visible to %d packages that depend on it: %s", describeRule(plan.Rule), len(plan.Packages), strings.Join(plan.Packages, ", "))
+		switch {
+		case plan.NewGroup:
+			log.Printf("             Create package_group %s listing them, and add it to the visibility of %s", plan.Group, plan.Rule.Label())
+		case plan.Group != "":
+			log.Printf("             Add them to package_group %s", plan.Group)
+		default:
+			log.Printf("             Add them to the visibility of %s", plan.Rule.Label())
+		}
+	}
+}
+
+// ApplyVisibilityPlans makes rules visible according to 'plans' using Buildozer.
+func ApplyVisibilityPlans(workspaceDir string, plans []*jadeplib.VisibilityPlan) error {
+	for _, plan := range plans {
+		if err := buildozer.MakeVisible(workspaceDir, plan); err != nil {
+			return fmt.Errorf("error making %s visible:\n%v", plan.Rule.Label(), err)
+		}
+	}
+	return nil
+}
+
+// PlanMove returns a plan to move 'from' out of the rules that src it and into a rule in the package of 'to', after the file moved.
+// Both are relative to the workspace root. It returns nil if no rule srcs 'from'. See jadeplib.PlanMove.
+func PlanMove(ctx context.Context, config jadeplib.Config, from, to string, namingRules []jadeplib.NamingRule, defaultRuleKind string) (*jadeplib.MovePlan, error) {
+	oldRules, err := jadeplib.RulesConsumingFile(ctx, config, from)
+	if err != nil {
+		return nil, fmt.Errorf("error finding the rules that src %s:\n%v", from, err)
+	}
+	if len(oldRules) == 0 {
+		return nil, nil
+	}
+	newPkgName := filepath.ToSlash(filepath.Dir(to))
+	if newPkgName == "." {
+		newPkgName = ""
+	}
+	pkgs, err := config.Loader.Load(ctx, []string{newPkgName})
+	if err != nil {
+		return nil, fmt.Errorf("error loading //%s:\n%v", newPkgName, err)
+	}
+	return jadeplib.PlanMove(from, to, oldRules, pkgs[newPkgName], namingRules, defaultRuleKind, NewRuleTemplates)
+}
+
+// ReportMovePlan describes how plan updates BUILD files.
+func ReportMovePlan(plan *jadeplib.MovePlan) {
+	var oldRules []*bazel.Rule
+	for r := range plan.OldSrcs {
+		oldRules = append(oldRules, r)
+	}
+	sort.Slice(oldRules, func(i, j int) bool { return oldRules[i].Label() < oldRules[j].Label() })
+	log.Printf("%s moved to %s:", plan.From, plan.To)
+	for _, r := range oldRules {
+		if plan.Deleted(r) {
+			log.Printf("             Delete %s, which has no other srcs", describeRule(r))
+		} else {
+			log.Printf("             Remove %s from the srcs of %s", plan.OldSrcs[r], describeRule(r))
+		}
+	}
+	if plan.Extend {
+		log.Printf("             Add %s and its deps to %s", strings.Join(plan.NewRule.StringListAttr("srcs"), ", "), plan.NewRule.Label())
+	} else {
+		log.Printf("             Create %s (srcs = %s)", plan.NewRule.Label(), strings.Join(plan.NewRule.StringListAttr("srcs"), ", "))
+	}
+}
+
+// ApplyMovePlan updates BUILD files according to plan using Buildozer, and drops the packages it edited from config.Loader's cache,
+// so the rules they now define are found.
+func ApplyMovePlan(config jadeplib.Config, plan *jadeplib.MovePlan) error {
+	if err := buildozer.MoveFile(config.WorkspaceDir, plan); err != nil {
+		return fmt.Errorf("error moving %s to %s:\n%v", plan.From, plan.To, err)
+	}
+	if cl, ok := config.Loader.(*pkgloading.CachingLoader); ok {
+		pkgNames := []string{plan.NewRule.PkgName}
+		for r := range plan.OldSrcs {
+			pkgNames = append(pkgNames, r.PkgName)
+		}
+		cl.Invalidate(pkgNames)
+	}
+	return nil
+}
+
+// Workspace returns the directory path of the workspace in which Jade should operate (workspaceDir) and the working dir relative to it (relWorkingDir).
+// workspaceFlag is what the user specified on the command-line.
+// If workspaceFlag is empty, Workspace() searches for a directory that contains a WORKSPACE file starting at the working directory and moving upwards.
+// relWorkingDir will be empty if workspaceFlag isn't empty (= -workspace was specifief explicitly)
+func Workspace(workspaceFlag string) (workspaceDir, relWorkingDir string, err error) {
+	if workspaceFlag != "" {
+		result, err := filepath.Abs(workspaceFlag)
+		if err != nil {
+			return "", "", fmt.Errorf("couldn't make directory absolute: %v", err)
+		}
+		if !hasWORKSPACE(result) {
+			return "", "", fmt.Errorf("directory %v has no file named WORKSPACE", result)
+		}
+		return result, "", nil
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", "", fmt.Errorf("couldn't get working directory: %v", err)
+	}
+	result, err := FindWorkspace(wd)
+	if err != nil {
+		return "", "", err
+	}
+	relWorkingDir, err = filepath.Rel(result, wd)
+	if err != nil {
+		return "", "", fmt.Errorf("couldn't relative %s to %s", result, wd)
+	}
+	if relWorkingDir == "." {
+		relWorkingDir = ""
+	}
+	return result, relWorkingDir, nil
+}
+
+// FindWorkspace returns the closest ancestor of the absolute path 'path' (including itself) that has a WORKSPACE file.
+// Unlike Workspace, it doesn't depend on the working directory, so it can find the workspaces of files from multiple checkouts.
+func FindWorkspace(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("%q is not absolute", path)
+	}
+	for result := filepath.Clean(path); result != string(filepath.Separator); result = filepath.Dir(result) {
+		if hasWORKSPACE(result) {
+			return result, nil
+		}
+	}
+	return "", fmt.Errorf("couldn't find a parent of %v that has a WORKSPACE file", path)
+}
+
+func hasWORKSPACE(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, "WORKSPACE"))
+	return err == nil
+}
+
+// StartProfiler starts CPU profiling and writes the output to outFile.
+func StartProfiler(outFile string) (stopProfiler func()) {
+	if outFile == "" {
+		return func() {}
+	}
+	f, err := os.Create(outFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pprof.StartCPUProfile(f)
+	return pprof.StopCPUProfile
+}
+
+// JavadocOnlyClassNames returns the class names that Java files reference only in Javadoc {@link} and @see tags,
+// i.e., that aren't in codeClassNames.
+// See FilesToParse for explanation about 'workingDir' and 'arg', and ClassNamesToResolve for 'blacklist'.
+func JavadocOnlyClassNames(ctx context.Context, workingDir string, loader pkgloading.Loader, arg string, implicitImports future.Getter, blacklist *jadeplib.ClassNameBlacklist, codeClassNames []jadeplib.ClassName) []jadeplib.ClassName {
+	filesToParse, err := FilesToParse(arg, workingDir, loader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	inCode := make(map[jadeplib.ClassName]bool)
+	for _, c := range codeClassNames {
+		inCode[c] = true
+	}
+	var ret []jadeplib.ClassName
+	for _, c := range blacklist.Filter(parser.JavadocReferencedClasses(ctx, filesToParse, implicitImports.Get().([]string))) {
+		if !inCode[c] {
+			ret = append(ret, c)
+		}
+	}
+	vlog.V(2).Printf("Class names referenced only in Javadoc:\n%v", ret)
+	return ret
+}
+
+// ConstantOnlyClassNames returns the members of classNames that Java files reference only to read constants, which javac inlines.
+// See FilesToParse for explanation about 'workingDir' and 'arg'.
+func ConstantOnlyClassNames(ctx context.Context, workingDir string, loader pkgloading.Loader, arg string, implicitImports future.Getter, classNames []jadeplib.ClassName) []jadeplib.ClassName {
+	filesToParse, err := FilesToParse(arg, workingDir, loader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	wanted := make(map[jadeplib.ClassName]bool)
+	for _, c := range classNames {
+		wanted[c] = true
+	}
+	var ret []jadeplib.ClassName
+	for _, c := range parser.ConstantOnlyClasses(ctx, filesToParse, implicitImports.Get().([]string)) {
+		if wanted[c] {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+// ReportConstantOnlyClassNames prints class names that are referenced only to read constants.
+// skipped indicates whether Jadep won't add deps for them.
+func ReportConstantOnlyClassNames(classNames []jadeplib.ClassName, skipped bool) {
+	if len(classNames) == 0 {
+		return
+	}
+	header := "Referenced only for constants, which javac inlines (use --inlined_constants=skip to not add deps for them):"
+	if skipped {
+		header = "Referenced only for constants, which javac inlines; not adding deps for them:"
+	}
+	printHeader(header, color.BoldMagenta)
+	for _, cls := range classNames {
+		log.Println(color.Magenta("=CONST") + color.DarkGray(" for ") + string(cls))
+	}
+}
+
+// ReportJavadocOnlyClassNames prints class names that are referenced only in Javadoc, and weren't resolved.
+func ReportJavadocOnlyClassNames(classNames []jadeplib.ClassName) {
+	if len(classNames) == 0 {
+		return
+	}
+	printHeader("Referenced only in Javadoc (use --javadoc_refs=include to add deps for them):", color.BoldMagenta)
+	for _, cls := range classNames {
+		log.Println(color.Magenta("?DOC") + color.DarkGray(" for ") + string(cls))
+	}
+}
+
+// serviceFilePrefix is the directory of resource files that declare providers of services loaded by java.util.ServiceLoader.
+const serviceFilePrefix = "META-INF/services/"
+
+// ServiceProviderClassNames returns the implementation classes listed in the META-INF/services/ files among the 'resources' of rules.
+// Classes loaded by java.util.ServiceLoader are runtime dependencies that never appear in Java sources.
+// Files that can't be read (e.g., labels of rules rather than files) are skipped.
+func ServiceProviderClassNames(workspaceDir string, rules []*bazel.Rule) []jadeplib.ClassName {
+	seen := make(map[jadeplib.ClassName]bool)
+	var ret []jadeplib.ClassName
+	for _, rule := range rules {
+		for _, res := range rule.StringListAttr("resources") {
+			lbl, err := bazel.ParseRelativeLabel(rule.PkgName, res)
+			if err != nil {
+				continue
+			}
+			pkgName, name := lbl.Split()
+			if !strings.HasPrefix(name, serviceFilePrefix) && !strings.Contains(name, "/"+serviceFilePrefix) {
+				continue
+			}
+			content, err := ioutil.ReadFile(filepath.Join(workspaceDir, filepath.FromSlash(pkgName), filepath.FromSlash(name)))
+			if err != nil {
+				vlog.V(2).Printf("Skipping service file %s: %v", lbl, err)
+				continue
+			}
+			for _, cls := range parseServiceFile(string(content)) {
+				if !seen[cls] {
+					seen[cls] = true
+					ret = append(ret, cls)
+				}
+			}
+		}
+	}
+	return ret
+}
+
+// parseServiceFile returns the provider classes listed in the content of a META-INF/services/ file.
+// Each line names a class, comments start with '#', and nested classes are reduced to their top-level class.
+func parseServiceFile(content string) []jadeplib.ClassName {
+	var ret []jadeplib.ClassName
+	for _, line := range strings.Split(content, "\n") {
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if i := strings.Index(line, "$"); i != -1 {
+			line = line[:i]
+		}
+		if line != "" {
+			ret = append(ret, jadeplib.ClassName(line))
+		}
+	}
+	return ret
+}
+
+// qualifiedClassNameRegexp matches syntactically valid fully-qualified Java class names, including nested classes written with '$'.
+var qualifiedClassNameRegexp = regexp.MustCompile(`^[\p{L}_$][\p{L}\p{N}_$]*(\.[\p{L}_$][\p{L}\p{N}_$]*)*$`)
+
+// ProcessorClassNames returns the 'processor_class' of the java_plugin rules among rules.
+// An annotation processor is loaded by javac at runtime, so it never appears in Java sources, yet the plugin must provide it
+// through its srcs or deps. Nested classes are reduced to their top-level class.
+// A 'processor_class' that isn't a valid class name is reported and skipped.
+func ProcessorClassNames(rules []*bazel.Rule) []jadeplib.ClassName {
+	var ret []jadeplib.ClassName
+	for _, rule := range rules {
+		if rule.Schema != "java_plugin" {
+			continue
+		}
+		cls, ok := rule.Attrs["processor_class"].(string)
+		if !ok || cls == "" {
+			continue
+		}
+		if !qualifiedClassNameRegexp.MatchString(cls) {
+			log.Printf("WARNING: processor_class of %s is %q, which isn't a valid Java class name", describeRule(rule), cls)
+			continue
+		}
+		if i := strings.Index(cls, "$"); i != -1 {
+			cls = cls[:i]
+		}
+		ret = append(ret, jadeplib.ClassName(cls))
+	}
+	return ret
+}
+
+var (
+	// RelativeLabels makes reports print labels the way they'd be written in the BUILD file of the rule they're reported for,
+	// e.g. ":bar" instead of "//foo:bar" for a rule in package foo. Machine-readable output always uses canonical labels.
+	RelativeLabels = false
+
+	// BasePkg, if not empty, is the package relative to which reports print labels, regardless of the rule they're reported for.
+	BasePkg = ""
+
+	// MaxCandidates, if positive, is the number of candidates reports print for a class; the rest are summarized as "and N more".
+	MaxCandidates = 0
+
+	// CandidatesFile, if not empty, is a file to which reports append every candidate of every class, one per line,
+	// so the ones that MaxCandidates hides can be looked up.
+	CandidatesFile = ""
+
+	// ClasspathEstimator, if not nil, estimates the classpath growth of each candidate, which reports print next to it, e.g. "//a:b (+3)".
+	ClasspathEstimator *jadeplib.ClasspathEstimator
+)
+
+// classpathDelta returns the estimated classpath growth of adding 'label' to consumingRule, as reports print it after the candidate,
+// or "" if ClasspathEstimator is nil.
+func classpathDelta(consumingRule *bazel.Rule, label bazel.Label) string {
+	if ClasspathEstimator == nil {
+		return ""
+	}
+	return fmt.Sprintf(" (+%d)", ClasspathEstimator.Delta(consumingRule, label))
+}
+
+// displayLabel returns the string reports print for 'label', which is reported for consumingRule.
+// consumingRule may be nil if the label isn't reported for any particular rule.
+func displayLabel(consumingRule *bazel.Rule, label bazel.Label) string {
+	if BasePkg != "" {
+		return label.RelativeTo(BasePkg)
+	}
+	if RelativeLabels && consumingRule != nil {
+		return label.RelativeTo(consumingRule.PkgName)
+	}
+	return string(label)
+}
+
+// describeRule returns the label of rule for display.
+// If the rule was generated by a macro, the macro is mentioned too, since that's what the user sees in the BUILD file,
+// e.g. "//x:foo_lib (generated by some_macro //x:foo)".
+func describeRule(rule *bazel.Rule) string {
+	fn := rule.GeneratorFunction()
+	if fn == "" {
+		return string(rule.Label())
+	}
+	if src := rule.SourceLabel(); src != rule.Label() {
+		return fmt.Sprintf("%s (generated by %s %s)", rule.Label(), fn, src)
+	}
+	return fmt.Sprintf("%s (generated by %s)", rule.Label(), fn)
+}
+
+// ReportMissingDeps reports the dependencies that Jadep detected as missing to Output.
+func ReportMissingDeps(missingDeps map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label) {
+	if err := Output.MissingDeps(missingDeps); err != nil {
+		log.Printf("WARNING: %v", err)
+	}
+}
+
+// OutputSink receives the results that Jadep reports: which rules it's fixing, the deps they're missing,
+// and the class names it couldn't find deps for.
+// The sinks in this package report in a stable order, so that the output of two runs can be diffed:
+// rules by label, class names alphabetically, and candidates by rank.
+type OutputSink interface {
+	RulesToFix(rules []*bazel.Rule) error
+	MissingDeps(missingDeps map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label) error
+	UnresolvedClassNames(classNames []jadeplib.ClassName, artifacts map[jadeplib.ClassName][]mavenindex.Artifact) error
+}
+
+// Output is the sink that LogRulesToFix, ReportMissingDeps and ReportUnresolvedClassnames report to.
+// Use MultiSink to report to several sinks at once.
+var Output OutputSink = TextSink{}
+
+// MultiSink reports to each of its sinks, in order.
+// A failing sink doesn't prevent the others from receiving results; the first error is returned.
+type MultiSink []OutputSink
+
+// RulesToFix implements OutputSink.
+func (m MultiSink) RulesToFix(rules []*bazel.Rule) error {
+	var firstErr error
+	for _, s := range m {
+		if err := s.RulesToFix(rules); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// MissingDeps implements OutputSink.
+func (m MultiSink) MissingDeps(missingDeps map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label) error {
+	var firstErr error
+	for _, s := range m {
+		if err := s.MissingDeps(missingDeps); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// UnresolvedClassNames implements OutputSink.
+func (m MultiSink) UnresolvedClassNames(classNames []jadeplib.ClassName, artifacts map[jadeplib.ClassName][]mavenindex.Artifact) error {
+	var firstErr error
+	for _, s := range m {
+		if err := s.UnresolvedClassNames(classNames, artifacts); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// TextSink logs results for humans.
+// Long lists of candidates are grouped by package and truncated according to MaxCandidates.
+type TextSink struct{}
+
+// RulesToFix implements OutputSink.
+func (TextSink) RulesToFix(rules []*bazel.Rule) error {
+	if len(rules) == 0 {
+		return nil
+	}
+	var strs []string
+	for _, r := range rules {
+		strs = append(strs, describeRule(r))
+	}
+	log.Printf("Fixing: %s", strings.Join(strs, ", "))
+	return nil
+}
+
+// MissingDeps implements OutputSink.
+// If CandidatesFile is set, every candidate is also appended to it.
+func (TextSink) MissingDeps(missingDeps map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label) error {
+	anythingMissing := false
+	for _, editedRule := range jadeplib.SortedRules(missingDeps) {
+		classToRule := missingDeps[editedRule]
+		log.Printf("Missing dependencies in %s", describeRule(editedRule))
+		for _, cls := range jadeplib.SortedClassNames(classToRule) {
+			lbls := classToRule[cls]
+			log.Printf("%-50s can be satisfied using:", cls)
+			log.Printf("             %s", formatCandidates(editedRule, lbls))
+			anythingMissing = true
+		}
+	}
+	if !anythingMissing {
+		log.Println("Nothing to do.")
+	}
+	if CandidatesFile != "" {
+		return appendCandidates(CandidatesFile, missingDeps)
+	}
+	return nil
+}
+
+// UnresolvedClassNames implements OutputSink.
+func (TextSink) UnresolvedClassNames(classNames []jadeplib.ClassName, artifacts map[jadeplib.ClassName][]mavenindex.Artifact) error {
+	if len(classNames) == 0 {
+		return nil
+	}
+	printHeader("Couldn't find BUILD rules for class names:", color.BoldMagenta)
+	for _, cls := range classNames {
+		log.Println(color.Magenta("?DEP") + color.DarkGray(" for ") + string(cls))
+		for _, a := range artifacts[cls] {
+			log.Printf("     this class is in artifact %s; add it to your third-party setup", color.Bold(a.String()))
+		}
+	}
+	return nil
+}
+
+// JSONSink writes results to W, one JSON object per line, so they can be consumed by other tools.
+// Labels are always canonical, regardless of RelativeLabels and BasePkg.
+type JSONSink struct {
+	W io.Writer
+}
+
+// jsonRecord is a line written by JSONSink. Type is one of "rules_to_fix", "missing_deps" and "unresolved".
+type jsonRecord struct {
+	Type string `json:"type"`
+
+	Rules []bazel.Label `json:"rules,omitempty"`
+
+	// MissingDeps maps rules to the class names they're missing deps for, and those to candidates, best first.
+	MissingDeps map[bazel.Label]map[jadeplib.ClassName][]bazel.Label `json:"missing_deps,omitempty"`
+
+	Unresolved []jadeplib.ClassName `json:"unresolved,omitempty"`
+
+	// Artifacts maps unresolved class names to the Maven artifacts that contain them.
+	Artifacts map[jadeplib.ClassName][]string `json:"artifacts,omitempty"`
+
+	// ClasspathDeltas maps rules to their candidates, and those to the number of targets they'd add to the rule's classpath.
+	// It's only written if ClasspathEstimator is set.
+	ClasspathDeltas map[bazel.Label]map[bazel.Label]int `json:"classpath_deltas,omitempty"`
+}
+
+// RulesToFix implements OutputSink.
+func (s JSONSink) RulesToFix(rules []*bazel.Rule) error {
+	if len(rules) == 0 {
+		return nil
+	}
+	rec := jsonRecord{Type: "rules_to_fix"}
+	for _, r := range rules {
+		rec.Rules = append(rec.Rules, r.Label())
+	}
+	return s.write(rec)
+}
+
+// MissingDeps implements OutputSink.
+func (s JSONSink) MissingDeps(missingDeps map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label) error {
+	rec := jsonRecord{Type: "missing_deps", MissingDeps: make(map[bazel.Label]map[jadeplib.ClassName][]bazel.Label)}
+	for rule, classToRule := range missingDeps {
+		if len(classToRule) == 0 {
+			continue
+		}
+		rec.MissingDeps[rule.Label()] = classToRule
+		if ClasspathEstimator == nil {
+			continue
+		}
+		if rec.ClasspathDeltas == nil {
+			rec.ClasspathDeltas = make(map[bazel.Label]map[bazel.Label]int)
+		}
+		deltas := make(map[bazel.Label]int)
+		for _, lbls := range classToRule {
+			for _, l := range lbls {
+				deltas[l] = ClasspathEstimator.Delta(rule, l)
+			}
+		}
+		rec.ClasspathDeltas[rule.Label()] = deltas
+	}
+	return s.write(rec)
+}
+
+// UnresolvedClassNames implements OutputSink.
+func (s JSONSink) UnresolvedClassNames(classNames []jadeplib.ClassName, artifacts map[jadeplib.ClassName][]mavenindex.Artifact) error {
+	if len(classNames) == 0 {
+		return nil
+	}
+	rec := jsonRecord{Type: "unresolved", Unresolved: classNames}
+	for _, cls := range classNames {
+		for _, a := range artifacts[cls] {
+			if rec.Artifacts == nil {
+				rec.Artifacts = make(map[jadeplib.ClassName][]string)
+			}
+			rec.Artifacts[cls] = append(rec.Artifacts[cls], a.String())
+		}
+	}
+	return s.write(rec)
+}
+
+func (s JSONSink) write(rec jsonRecord) error {
+	if err := json.NewEncoder(s.W).Encode(rec); err != nil {
+		return fmt.Errorf("error writing %s results as JSON:\n%v", rec.Type, err)
+	}
+	return nil
+}
+
+// formatCandidates returns the candidates for a class as reports print them, in the order of lbls.
+// Candidates in the same package are grouped, e.g. "//a:{b, c}", which keeps lists of shaded or duplicated jars readable.
+// Only the first MaxCandidates candidates are printed, if it's positive, followed by "and N more".
+// If ClasspathEstimator is set, each candidate is followed by its estimated classpath growth.
+func formatCandidates(editedRule *bazel.Rule, lbls []bazel.Label) string {
+	shown := lbls
+	if MaxCandidates > 0 && len(lbls) > MaxCandidates {
+		shown = lbls[:MaxCandidates]
+	}
+
+	// Groups are ordered by their first candidate.
+	var pkgs []string
+	groups := make(map[string][]bazel.Label)
+	for _, l := range shown {
+		pkg := string(l)
+		if i := strings.LastIndex(pkg, ":"); i != -1 {
+			pkg = pkg[:i]
+		}
+		if _, ok := groups[pkg]; !ok {
+			pkgs = append(pkgs, pkg)
+		}
+		groups[pkg] = append(groups[pkg], l)
+	}
+	var parts []string
+	for _, pkg := range pkgs {
+		group := groups[pkg]
+		if len(group) == 1 {
+			parts = append(parts, displayLabel(editedRule, group[0])+classpathDelta(editedRule, group[0]))
+			continue
+		}
+		var names []string
+		for _, l := range group {
+			_, name := l.Split()
+			names = append(names, name+classpathDelta(editedRule, l))
+		}
+		prefix := pkg
+		if strings.HasPrefix(displayLabel(editedRule, group[0]), ":") {
+			prefix = ""
+		}
+		parts = append(parts, fmt.Sprintf("%s:{%s}", prefix, strings.Join(names, ", ")))
+	}
+
+	ret := strings.Join(parts, ", ")
+	if hidden := len(lbls) - len(shown); hidden > 0 {
+		ret += fmt.Sprintf(" and %d more", hidden)
+		if CandidatesFile != "" {
+			ret += fmt.Sprintf(" (see %s)", CandidatesFile)
+		} else {
+			ret += " (use --candidates_file to see all)"
+		}
+	}
+	return ret
+}
+
+// appendCandidates appends to fileName a line for each candidate in missingDeps, of the form "<rule> <class> <candidate>".
+func appendCandidates(fileName string, missingDeps map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label) error {
+	var lines []string
+	for rule, classToRule := range missingDeps {
+		for cls, lbls := range classToRule {
+			for _, l := range lbls {
+				lines = append(lines, fmt.Sprintf("%s %s %s\n", rule.Label(), cls, l))
+			}
+		}
+	}
+	// Lines of the same rule and class stay in the order of their ranking, since the sort is stable and only looks at the prefix.
+	sort.SliceStable(lines, func(i, j int) bool { return candidatesLinePrefix(lines[i]) < candidatesLinePrefix(lines[j]) })
+
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening candidates file:\n%v", err)
+	}
+	for _, line := range lines {
+		if _, err := f.WriteString(line); err != nil {
+			f.Close()
+			return fmt.Errorf("error writing candidates to %s:\n%v", fileName, err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error writing candidates to %s:\n%v", fileName, err)
+	}
+	return nil
+}
+
+// candidatesLinePrefix returns the rule and class of a line written by appendCandidates.
+func candidatesLinePrefix(line string) string {
+	return line[:strings.LastIndex(line, " ")]
+}
+
+// ReportUnresolvedClassnames reports to Output the class names that Jadep couldn't find any BUILD dependencies for.
+func ReportUnresolvedClassnames(unresolvedClassNames []jadeplib.ClassName) {
+	ReportUnresolvedClassnamesWithArtifacts(unresolvedClassNames, nil)
+}
+
+// ReportUnresolvedClassnamesWithArtifacts is like ReportUnresolvedClassnames, but also suggests the Maven artifacts that contain each class name.
+func ReportUnresolvedClassnamesWithArtifacts(unresolvedClassNames []jadeplib.ClassName, artifacts map[jadeplib.ClassName][]mavenindex.Artifact) {
+	if err := Output.UnresolvedClassNames(unresolvedClassNames, artifacts); err != nil {
+		log.Printf("WARNING: %v", err)
+	}
+}
+
+// ReportGeneratedClasses logs the rules that reference classes generated by an annotation processor they don't run,
+// and the plugin to add to them, if known. Generated classes whose processor runs need no deps, so they're only logged verbosely.
+func ReportGeneratedClasses(generated map[*bazel.Rule][]jadeplib.GeneratedClass) {
+	var rules []*bazel.Rule
+	for r := range generated {
+		rules = append(rules, r)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Label() < rules[j].Label() })
+	headerPrinted := false
+	for _, rule := range rules {
+		for _, g := range generated[rule] {
+			if g.Runs {
+				vlog.V(2).Printf("%s is generated by %s, which %s runs", g.ClassName, g.Processor.ProcessorClass, rule.Label())
+				continue
+			}
+			if !headerPrinted {
+				printHeader("Classes generated by annotation processors that their rules don't run:", color.BoldMagenta)
+				headerPrinted = true
+			}
+			suggestion := "add a java_plugin with processor_class = " + g.Processor.ProcessorClass + " to its plugins"
+			if g.Processor.Plugin != "" {
+				suggestion = "add " + displayLabel(rule, g.Processor.Plugin) + " to its plugins"
+			}
+			log.Println(color.Magenta("?PLUGIN") + color.DarkGray(" for ") + string(g.ClassName) + color.DarkGray(" in ") + describeRule(rule) + ": " + suggestion)
+		}
+	}
+}
+
+// ReportClassErrors logs the class names that Jadep couldn't find deps for because of errors, e.g. a package that failed to load.
+func ReportClassErrors(classErrors map[jadeplib.ClassName]error) {
+	if len(classErrors) == 0 {
+		return
+	}
+	var classNames []string
+	for cls := range classErrors {
+		classNames = append(classNames, string(cls))
+	}
+	sort.Strings(classNames)
+	printHeader("Errors finding BUILD rules for class names:", color.BoldMagenta)
+	for _, cls := range classNames {
+		log.Println(color.Magenta("!DEP") + color.DarkGray(" for ") + cls + ": " + classErrors[jadeplib.ClassName(cls)].Error())
+	}
+}
+
+// ReportSkippedFiles prints the files that were skipped, or only partially parsed, because they can't be read or parsed.
+// Class names they reference might be missing dependencies that Jadep didn't add.
+func ReportSkippedFiles(errs []*parser.FileError) {
+	if len(errs) == 0 {
+		return
+	}
+	printHeader("Files that can't be read or fully parsed:", color.BoldMagenta)
+	for _, err := range errs {
+		tag := "SKIP"
+		if err.Partial {
+			tag = "PART"
+		}
+		log.Println(color.Magenta(tag) + " " + err.Error())
+	}
+}
+
+// ReportPackageErrors prints the packages that were skipped because they failed to evaluate, e.g. because of a syntax error in their BUILD file.
+// Rules they define weren't considered, so deps on them might be missing, and rules in them weren't fixed.
+func ReportPackageErrors(errs []*pkgloading.PackageError) {
+	if len(errs) == 0 {
+		return
+	}
+	printHeader("BUILD files that failed to load:", color.BoldMagenta)
+	for _, err := range errs {
+		log.Println(color.Magenta("SKIP") + " " + err.Error())
+	}
+}
+
+// ReportAddedDeps prints which deps this Jadep run added to which consuming rule.
+func ReportAddedDeps(addedDeps map[*bazel.Rule][]bazel.Label) {
+	if len(addedDeps) == 0 {
+		return
+	}
+
+	for _, consuming := range jadeplib.SortedRulesToEdit(addedDeps) {
+		printHeader("Added to "+describeRule(consuming), color.BoldGreen)
+		for _, dep := range addedDeps[consuming] {
+			log.Println(color.Green("+DEP") + " " + displayLabel(consuming, dep))
+		}
+	}
+}
+
+// ReportRejectedCandidates prints the candidates that were rejected because their output jar doesn't contain the class they were suggested for.
+func ReportRejectedCandidates(rejected map[jadeplib.ClassName][]bazel.Label) {
+	var classNames []string
+	for cls := range rejected {
+		classNames = append(classNames, string(cls))
+	}
+	sort.Strings(classNames)
+	for _, cls := range classNames {
+		var lblsStr []string
+		for _, l := range rejected[jadeplib.ClassName(cls)] {
+			lblsStr = append(lblsStr, displayLabel(nil, l))
+		}
+		log.Printf("Rejected candidates for %s, whose jars don't contain it: %s", cls, strings.Join(lblsStr, ", "))
+	}
+}
+
+// ReportVerification prints which rules were verified to build after adding deps, and which had their new deps rolled back.
+func ReportVerification(verified []bazel.Label, rolledBack map[*bazel.Rule][]bazel.Label) {
+	if len(verified) > 0 {
+		printHeader("Verified to build after adding deps:", color.BoldGreen)
+		for _, l := range verified {
+			log.Println(color.Green("OK") + "   " + string(l))
+		}
+	}
+	if len(rolledBack) > 0 {
+		printHeader("Still failing to build; rolled back added deps:", color.BoldMagenta)
+		for _, rule := range jadeplib.SortedRulesToEdit(rolledBack) {
+			for _, dep := range rolledBack[rule] {
+				log.Println(color.Magenta("-DEP") + " " + displayLabel(rule, dep) + color.DarkGray(" from ") + describeRule(rule))
+			}
+		}
+	}
+}
+
+// ReportDanglingDeps prints the deps of rules that don't exist, and whether they were removed.
+// Jadep suggests deps for the classes they were meant to provide, as if they weren't listed.
+func ReportDanglingDeps(dangling map[*bazel.Rule][]bazel.Label, removed bool) {
+	if len(dangling) == 0 {
+		return
+	}
+	if removed {
+		printHeader("Removed deps that don't exist:", color.BoldMagenta)
+	} else {
+		printHeader("Deps that don't exist (remove them with --dangling_deps=remove):", color.BoldMagenta)
+	}
+	for _, rule := range jadeplib.SortedRulesToEdit(dangling) {
+		for _, dep := range dangling[rule] {
+			log.Println(color.Magenta("-DEP") + " " + displayLabel(rule, dep) + color.DarkGray(" from ") + describeRule(rule))
+		}
+	}
+}
+
+// ReportKeptDeps prints the deps that weren't removed from rules, although they should have been for 'reason',
+// because a "# keep" comment, or a "# jadep:ignore" comment on their rule, says so.
+func ReportKeptDeps(kept map[*bazel.Rule][]bazel.Label, reason string) {
+	if len(kept) == 0 {
+		return
+	}
+	printHeader("Deps kept by '# keep' or '# jadep:ignore' comments, although "+reason+":", color.BoldMagenta)
+	for _, rule := range jadeplib.SortedRulesToEdit(kept) {
+		for _, dep := range kept[rule] {
+			log.Println(color.Magenta("=DEP") + " " + displayLabel(rule, dep) + color.DarkGray(" in ") + describeRule(rule))
+		}
+	}
+}
+
+// ReportDuplicateDeps prints the deps of rules that their exports already provide, and whether they were removed.
+func ReportDuplicateDeps(dups map[*bazel.Rule][]jadeplib.DuplicateDep, removed bool) {
+	if len(dups) == 0 {
+		return
+	}
+	if removed {
+		printHeader("Removed deps that exports already provide:", color.BoldMagenta)
+	} else {
+		printHeader("Deps that exports already provide (remove them with --cleanup):", color.BoldMagenta)
+	}
+	for _, rule := range jadeplib.SortedRulesToEdit(jadeplib.DuplicateDepLabels(dups)) {
+		for _, d := range dups[rule] {
+			reason := "also in exports"
+			if d.Export != d.Dep {
+				reason = "exported by " + displayLabel(rule, d.Export)
+			}
+			log.Println(color.Magenta("-DEP") + " " + displayLabel(rule, d.Dep) + color.DarkGray(" from ") + describeRule(rule) + color.DarkGray(" ("+reason+")"))
+		}
+	}
+}
+
+// WhyNot explains why 'label' wasn't suggested as a dependency providing 'cls' to each of rulesToFix.
+// The result maps the label of each rule to fix to an explanation: either the label wasn't returned by any resolver,
+// the rule already has a dependency providing cls, the label was filtered out (e.g. by rule kind, tags, deprecation or visibility),
+// or it was outranked by other candidates.
+func WhyNot(ctx context.Context, config jadeplib.Config, rulesToFix []*bazel.Rule, label bazel.Label, cls jadeplib.ClassName) (map[bazel.Label]string, error) {
+	missing, _, decisions, err := jadeplib.ExplainMissingDeps(ctx, config, rulesToFix, []jadeplib.ClassName{cls})
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[bazel.Label]string)
+	for _, rule := range rulesToFix {
+		lbl := rule.Label()
+		if decisions.AlreadySatisfied[lbl][cls] {
+			ret[lbl] = fmt.Sprintf("%s already depends on a rule providing %s", lbl, cls)
+			continue
+		}
+		resolved := decisions.Resolved[cls]
+		if !containsLabel(resolved, label) {
+			if len(resolved) == 0 {
+				ret[lbl] = fmt.Sprintf("%s wasn't returned by any resolver: no rule providing %s was found", label, cls)
+			} else {
+				ret[lbl] = fmt.Sprintf("%s wasn't returned by any resolver; %s is provided by %s", label, cls, joinLabels(resolved))
+			}
+			continue
+		}
+		if reason, ok := decisions.Rejected[lbl][cls][label]; ok {
+			if reason == jadeplib.NotVisible {
+				reason, err = visibilityExplanation(ctx, config.Loader, label, rule.PkgName)
+				if err != nil {
+					return nil, err
+				}
+			}
+			ret[lbl] = fmt.Sprintf("%s was filtered out: %s", label, reason)
+			continue
+		}
+		candidates := missing[rule][cls]
+		for i, c := range candidates {
+			if c != label {
+				continue
+			}
+			if i == 0 {
+				ret[lbl] = fmt.Sprintf("%s is the top candidate for %s", label, cls)
+			} else {
+				ret[lbl] = fmt.Sprintf("%s was outranked by %s", label, joinLabels(candidates[:i]))
+			}
+		}
+		if _, ok := ret[lbl]; !ok {
+			ret[lbl] = fmt.Sprintf("%s wasn't suggested for %s", label, cls)
+		}
+	}
+	return ret, nil
+}
+
+// visibilityExplanation describes why the rule 'label' isn't visible to the package pkgName,
+// including the package_group()s that were examined.
+func visibilityExplanation(ctx context.Context, loader pkgloading.Loader, label bazel.Label, pkgName string) (string, error) {
+	rules, _, err := pkgloading.LoadRules(ctx, loader, []bazel.Label{label})
+	if err != nil {
+		return "", fmt.Errorf("Error loading %q:\n%v", label, err)
+	}
+	rule := rules[label]
+	if rule == nil {
+		return "", fmt.Errorf("Rule not found: %v", label)
+	}
+	_, path, err := filter.VisibilityPath(ctx, loader, rule, pkgName)
+	if err != nil {
+		return "", err
+	}
+	ret := fmt.Sprintf("not visible to package %s (visibility = [%s])", pkgName, joinLabels(rule.LabelListAttr("visibility")))
+	if len(path) > 0 {
+		ret += fmt.Sprintf("; none of the package_group()s %s grants visibility", joinLabels(path))
+	}
+	return ret, nil
+}
+
+// ReportWhyNot prints the explanations returned by WhyNot.
+func ReportWhyNot(explanations map[bazel.Label]string) {
+	var lbls []string
+	for l := range explanations {
+		lbls = append(lbls, string(l))
+	}
+	sort.Strings(lbls)
+	for _, l := range lbls {
+		printHeader("In "+l, color.BoldMagenta)
+		log.Println(explanations[bazel.Label(l)])
+	}
+}
+
+// Provider is a rule that provides a class name, as reported by 'jadep provides'.
+type Provider struct {
+	Label bazel.Label
+
+	// Resolvers are the names of the resolvers that returned the rule.
+	Resolvers []string
+
+	// Visibility explains whether the rule is visible to the package passed to Providers. Empty if no package was passed.
+	Visibility string
+}
+
+// Providers returns the rules that can provide cls according to any of config.Resolvers, ranked by config.DepsRanker.
+// Unlike MissingDeps, results aren't filtered by kind, tags, visibility, etc.
+// If fromPkg is not empty, the visibility of each rule to the package fromPkg is explained.
+func Providers(ctx context.Context, config jadeplib.Config, cls jadeplib.ClassName, fromPkg string) ([]Provider, error) {
+	resolved := jadeplib.ResolveWithProvenance(ctx, config, []jadeplib.ClassName{cls})[cls]
+	var labels []bazel.Label
+	for l := range resolved {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i] < labels[j] })
+	labels = jadeplib.RankDeps(ctx, config.DepsRanker, nil, cls, labels)
+
+	var rules map[bazel.Label]*bazel.Rule
+	if fromPkg != "" {
+		var err error
+		rules, _, err = pkgloading.LoadRules(ctx, config.Loader, labels)
+		if err != nil {
+			return nil, fmt.Errorf("error loading rules providing %s:\n%v", cls, err)
+		}
+	}
+
+	var ret []Provider
+	for _, l := range labels {
+		p := Provider{Label: l, Resolvers: resolved[l]}
+		if fromPkg != "" {
+			rule := rules[l]
+			if rule == nil {
+				p.Visibility = "rule not found"
+			} else if visible, _, err := filter.VisibilityPath(ctx, config.Loader, rule, fromPkg); err != nil {
+				return nil, err
+			} else if visible {
+				p.Visibility = "visible to package " + fromPkg
+			} else if p.Visibility, err = visibilityExplanation(ctx, config.Loader, l, fromPkg); err != nil {
+				return nil, err
+			}
+		}
+		ret = append(ret, p)
+	}
+	return ret, nil
+}
+
+// ReportProviders prints the rules that provide cls, as returned by Providers.
+func ReportProviders(cls jadeplib.ClassName, providers []Provider) {
+	if len(providers) == 0 {
+		printHeader("No rule provides "+string(cls), color.BoldMagenta)
+		return
+	}
+	printHeader("Rules providing "+string(cls)+":", color.BoldGreen)
+	for _, p := range providers {
+		log.Println(color.Green("PROV") + " " + displayLabel(nil, p.Label) + color.DarkGray(" from "+strings.Join(p.Resolvers, ", ")))
+		if p.Visibility != "" {
+			log.Println("     " + p.Visibility)
+		}
+	}
+}
+
+func containsLabel(labels []bazel.Label, label bazel.Label) bool {
+	for _, l := range labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+func joinLabels(labels []bazel.Label) string {
+	var strs []string
+	for _, l := range labels {
+		strs = append(strs, string(l))
+	}
+	return strings.Join(strs, ", ")
+}
+
+func printHeader(header string, colorizer func(string) string) {
+	log.Println("")
+	log.Println(colorizer(header))
+	log.Println(colorizer(strings.Repeat("-", len(header))))
+}
+
+// ClassNamesToResolve returns the list of class names which should be satisfied with BUILD dependencies.
+// If the user provided a list in --classnames (which is passed in classNamesArg), that list is returned.
+// Otherwise, it parses Java files as described in FilesToParse().
+// blacklist matches names of classes for which we will not look for BUILD rules; it may be nil.
+// implicitImports is a future to the sorted simple names that the files of 'arg' use without importing them,
+// which may depend on the rules that compile them (see jadeplib.RestrictImplicitImports).
+// See FilesToParse for explanation about 'workingDir' and 'arg'.
+func ClassNamesToResolve(ctx context.Context, workingDir string, loader pkgloading.Loader, arg string, classNamesArg []string, implicitImports future.Getter, blacklist *jadeplib.ClassNameBlacklist) []jadeplib.ClassName {
+	ret, _ := ClassNamesToResolveWithErrors(ctx, workingDir, loader, arg, classNamesArg, implicitImports, blacklist)
+	return ret
+}
+
+// ClassNamesToResolveWithErrors is like ClassNamesToResolve, but also returns the files that can't be read or fully parsed.
+func ClassNamesToResolveWithErrors(ctx context.Context, workingDir string, loader pkgloading.Loader, arg string, classNamesArg []string, implicitImports future.Getter, blacklist *jadeplib.ClassNameBlacklist) ([]jadeplib.ClassName, []*parser.FileError) {
+	if len(classNamesArg) > 0 {
+		var ret []jadeplib.ClassName
+		for _, c := range classNamesArg {
+			parts := strings.Split(c, ".")
+			if topLevel, idx := parser.ExtractClassNameFromQualifiedName(parts); idx != -1 {
+				ret = append(ret, jadeplib.ClassName(topLevel))
+			} else {
+				ret = append(ret, jadeplib.ClassName(c))
+			}
+		}
+		return ret, nil
+	}
+
+	filesToParse, err := FilesToParse(arg, workingDir, loader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	stopwatch := time.Now()
+	classNames, errs := parser.ReferencedClasses(ctx, filesToParse, implicitImports.Get().([]string))
+	for _, err := range errs {
+		if err.Partial {
+			log.Printf("WARNING: Only part of a file with syntax errors was parsed: %v", err)
+		} else {
+			log.Printf("WARNING: Skipping file that can't be read or parsed: %v", err)
+		}
+	}
+	ret := blacklist.Filter(classNames)
+	vlog.V(2).Printf("Class names to resolve:\n%v", ret)
+
+	log.Printf("Found %d classes in %d Java file(s) (%dms)", len(ret), len(filesToParse), int64(time.Now().Sub(stopwatch)/time.Millisecond))
+	return ret, errs
+}
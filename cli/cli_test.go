@@ -15,17 +15,26 @@
 package cli
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"context"
 
 	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
 	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeptest"
 	"github.com/bazelbuild/tools_jvm_autodeps/loadertest"
+	"github.com/bazelbuild/tools_jvm_autodeps/macros"
+	"github.com/bazelbuild/tools_jvm_autodeps/mavenindex"
+	"github.com/bazelbuild/tools_jvm_autodeps/pkgloading"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 )
@@ -41,6 +50,32 @@ var (
 	sortSlices = cmpopts.SortSlices(func(a, b string) bool { return a < b })
 )
 
+func TestExpandArgs(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	responseFile := filepath.Join(tmpDir, "args.txt")
+	if err := ioutil.WriteFile(responseFile, []byte("x/B.java\n\n  x/C.java  \n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	args := []string{"x/A.java", "@" + responseFile, "-", "x/A.java"}
+	got, err := ExpandArgs(args, strings.NewReader("//x:D\nx/B.java\n"))
+	if err != nil {
+		t.Fatalf("ExpandArgs(%v) has error %v, want nil", args, err)
+	}
+	want := []string{"x/A.java", "x/B.java", "x/C.java", "//x:D"}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("ExpandArgs(%v) diff (-got +want):\n%s", args, diff)
+	}
+
+	if _, err := ExpandArgs([]string{"@" + filepath.Join(tmpDir, "nonexistent")}, nil); err == nil {
+		t.Errorf("ExpandArgs(@nonexistent) has nil error, want non-nil")
+	}
+}
+
 func TestFilesToParse(t *testing.T) {
 	workspaceRoot := "/blabla/workspace/"
 	tests := []struct {
@@ -159,6 +194,22 @@ func TestRulesToFix(t *testing.T) {
 				bazel.NewRule("java_library", "x", "x", map[string]interface{}{"srcs": []string{"Foo.java"}}),
 			},
 		},
+		{
+			arg: "//x:Foo",
+			existingPkgs: map[string]*bazel.Package{
+				"x": {
+					Rules: map[string]*bazel.Rule{
+						"Foo_lib":  bazel.NewRule("java_library", "x", "Foo_lib", map[string]interface{}{"generator_function": "some_macro", "generator_name": "Foo"}),
+						"Foo_test": bazel.NewRule("java_test", "x", "Foo_test", map[string]interface{}{"generator_function": "some_macro", "generator_name": "Foo"}),
+						"Foo_gen":  bazel.NewRule("genrule", "x", "Foo_gen", map[string]interface{}{"generator_function": "some_macro", "generator_name": "Foo"}),
+					},
+				},
+			},
+			want: []*bazel.Rule{
+				bazel.NewRule("java_library", "x", "Foo_lib", map[string]interface{}{"generator_function": "some_macro", "generator_name": "Foo"}),
+				bazel.NewRule("java_test", "x", "Foo_test", map[string]interface{}{"generator_function": "some_macro", "generator_name": "Foo"}),
+			},
+		},
 		{
 			arg:     "/x/Foo.java",
 			wantErr: fmt.Errorf(`"/x/Foo.java" is not a relative path nor in a subdirectory of %q`, workspaceRoot),
@@ -181,6 +232,34 @@ func TestRulesToFix(t *testing.T) {
 	}
 }
 
+func TestRulesToFixSelectsMacroTargets(t *testing.T) {
+	defer func(m map[string]macros.Macro) { Macros = m }(Macros)
+	Macros = map[string]macros.Macro{"robolectric_test": {Attr: "deps", Target: "{name}_lib"}}
+
+	workspaceRoot, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workspaceRoot)
+	createFiles(t, workspaceRoot, []string{"x/BUILD"})
+	attrs := map[string]interface{}{"generator_function": "robolectric_test", "generator_name": "Foo", "srcs": []string{"FooTest.java"}}
+	lib := bazel.NewRule("java_library", "x", "Foo_lib", attrs)
+	test := bazel.NewRule("android_local_test", "x", "Foo", attrs)
+	config := jadeplib.Config{
+		Loader:       &loadertest.StubLoader{Pkgs: map[string]*bazel.Package{"x": {Rules: map[string]*bazel.Rule{"Foo_lib": lib, "Foo": test}}}},
+		WorkspaceDir: workspaceRoot,
+	}
+	for _, arg := range []string{"x/FooTest.java", filepath.Join(workspaceRoot, "x/FooTest.java")} {
+		got, err := RulesToFix(context.Background(), config, "", arg, nil, "")
+		if err != nil {
+			t.Fatalf("RulesToFix(%s) returned error %v, want nil", arg, err)
+		}
+		if diff := cmp.Diff(got, []*bazel.Rule{lib}); diff != "" {
+			t.Errorf("RulesToFix(%s) returned diff (-got +want):\n%s", arg, diff)
+		}
+	}
+}
+
 func TestRulesToFixCreatesNewRule(t *testing.T) {
 	tmpDir, err := ioutil.TempDir("", "")
 	if err != nil {
@@ -214,6 +293,266 @@ func TestRulesToFixCreatesNewRule(t *testing.T) {
 	}
 }
 
+func TestRulesToFixWithoutEditingBuildFiles(t *testing.T) {
+	defer func(e bool) { EditBuildFiles = e }(EditBuildFiles)
+	EditBuildFiles = false
+
+	workspaceRoot, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workspaceRoot)
+	createFiles(t, workspaceRoot, []string{"WORKSPACE", "x/BUILD"})
+
+	config := jadeplib.Config{Loader: &loadertest.StubLoader{}, WorkspaceDir: workspaceRoot}
+	got, err := RulesToFix(context.Background(), config, "", "x/Foo.java", nil, "java_test")
+	if err != nil || len(got) != 0 {
+		t.Errorf("RulesToFix returned (%v, %v), want no rules and no error", got, err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(workspaceRoot, "x/BUILD"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 0 {
+		t.Errorf("RulesToFix edited the BUILD file to\n%s\nwant it unchanged", b)
+	}
+}
+
+// TestRulesToFixReloadsNewRule tests that RulesToFix returns a new rule as the loader sees it after creating it,
+// and that the rest of the run, e.g. the next arguments, find it.
+func TestRulesToFixReloadsNewRule(t *testing.T) {
+	workspaceRoot, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workspaceRoot)
+	createFiles(t, workspaceRoot, []string{"WORKSPACE", "x/BUILD", "x/Foo.java"})
+
+	stub := &loadertest.StubLoader{Pkgs: map[string]*bazel.Package{"x": {}}}
+	loader := pkgloading.NewCachingLoader(stub)
+	config := jadeplib.Config{Loader: loader, WorkspaceDir: workspaceRoot, AnalysisCache: jadeplib.NewAnalysisCache()}
+	if rules, err := jadeplib.RulesConsumingFile(context.Background(), config, "x/Foo.java"); err != nil || len(rules) != 0 {
+		t.Fatalf("RulesConsumingFile(x/Foo.java) = (%v, %v), want no rules", rules, err)
+	}
+
+	// The loader sees the rule once it's created, with the attributes Bazel adds to it.
+	reloaded := bazel.NewRule("java_library", "x", "Foo", map[string]interface{}{"srcs": []string{"Foo.java"}, "visibility": []string{"//visibility:public"}})
+	stub.Pkgs = map[string]*bazel.Package{"x": {Rules: map[string]*bazel.Rule{"Foo": reloaded}}}
+
+	got, err := RulesToFix(context.Background(), config, "", "x/Foo.java", nil, "java_library")
+	if err != nil {
+		t.Fatalf("RulesToFix returned error %v, want nil", err)
+	}
+	if diff := cmp.Diff(got, []*bazel.Rule{reloaded}); diff != "" {
+		t.Errorf("RulesToFix returned diff (-got +want):\n%s", diff)
+	}
+	rules, err := jadeplib.RulesConsumingFile(context.Background(), config, "x/Foo.java")
+	if err != nil {
+		t.Fatalf("RulesConsumingFile returned error %v, want nil", err)
+	}
+	if diff := cmp.Diff(rules, []*bazel.Rule{reloaded}); diff != "" {
+		t.Errorf("RulesConsumingFile after RulesToFix returned diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestRulesToFixPackageInfo(t *testing.T) {
+	defer func(p string) { PackageInfoPolicy = p }(PackageInfoPolicy)
+	workspaceRoot, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workspaceRoot)
+	createFiles(t, workspaceRoot, []string{"WORKSPACE", "x/BUILD", "x/Bar.java", "x/Foo.java", "x/package-info.java", "x/module-info.java"})
+	bar := bazel.NewRule("java_library", "x", "Bar", map[string]interface{}{"srcs": []string{"Bar.java"}})
+	lib := bazel.NewRule("java_library", "x", "lib", map[string]interface{}{"srcs": []string{"Foo.java"}})
+	config := jadeplib.Config{
+		Loader:       &loadertest.StubLoader{Pkgs: map[string]*bazel.Package{"x": {Rules: map[string]*bazel.Rule{"Bar": bar, "lib": lib}}}},
+		WorkspaceDir: workspaceRoot,
+	}
+
+	tests := []struct {
+		arg    string
+		policy string
+		want   []*bazel.Rule
+	}{
+		{"x/package-info.java", PackageInfoPolicyPackageRules, []*bazel.Rule{bar, lib}},
+		{"x/package-info.java", PackageInfoPolicySkip, nil},
+		{"x/module-info.java", PackageInfoPolicyPackageRules, nil},
+	}
+	for _, tt := range tests {
+		PackageInfoPolicy = tt.policy
+		got, err := RulesToFix(context.Background(), config, "", tt.arg, nil, "java_library")
+		if err != nil {
+			t.Errorf("RulesToFix(%s) with policy %s returned error %v, want nil", tt.arg, tt.policy, err)
+		}
+		if diff := cmp.Diff(got, tt.want); diff != "" {
+			t.Errorf("RulesToFix(%s) with policy %s returned diff (-got +want):\n%s", tt.arg, tt.policy, diff)
+		}
+	}
+	// No rule named package-info or module-info is created.
+	b, err := ioutil.ReadFile(filepath.Join(workspaceRoot, "x/BUILD"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "info") {
+		t.Errorf("RulesToFix created a rule:\n%s", string(b))
+	}
+}
+
+func TestRulesToFixCreatesNewRuleWithPackageDefaults(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Can't create temp directory:\n%v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	workspaceRoot := filepath.Join(tmpDir, "jadep")
+	createFiles(t, workspaceRoot, []string{"WORKSPACE", "x/BUILD"})
+
+	pkgs := map[string]*bazel.Package{"x": {DefaultTestonly: true, DefaultVisibility: []bazel.Label{"//visibility:public"}}}
+	config := jadeplib.Config{Loader: &loadertest.StubLoader{Pkgs: pkgs}, WorkspaceDir: workspaceRoot}
+	got, err := RulesToFix(context.Background(), config, "", "x/Foo.java", nil, "java_library")
+	if err != nil {
+		t.Errorf("RulesToFix returned error %v, want nil", err)
+	}
+	want := []*bazel.Rule{bazel.NewRule("java_library", "x", "Foo", map[string]interface{}{
+		"srcs":       []string{"Foo.java"},
+		"testonly":   true,
+		"visibility": []string{"//visibility:public"},
+	})}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("RulesToFix returned diff (-want +got):\n%s", diff)
+	}
+
+	// Package defaults aren't written to the BUILD file, since Bazel applies them anyway.
+	b, err := ioutil.ReadFile(filepath.Join(workspaceRoot, "x/BUILD"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantBuildContent := `java_library(
+    name = "Foo",
+    srcs = ["Foo.java"],
+)
+`
+	if string(b) != wantBuildContent {
+		t.Errorf("RulesToFix created a BUILD file with content\n%s\nwant\n%s", string(b), wantBuildContent)
+	}
+}
+
+func TestRulesToFixNewRulePolicy(t *testing.T) {
+	type Attrs = map[string]interface{}
+	lib := bazel.NewRule("java_library", "x", "lib", Attrs{"srcs": []string{"A.java"}})
+	lib2 := bazel.NewRule("java_library", "x", "lib2", Attrs{"srcs": []string{"B.java"}})
+	test := bazel.NewRule("java_test", "x", "ATest", Attrs{"srcs": []string{"ATest.java"}})
+	buildFile := `java_library(
+    name = "lib",
+    srcs = ["A.java"],
+)
+
+java_library(
+    name = "lib2",
+    srcs = ["B.java"],
+)
+
+java_test(
+    name = "ATest",
+    srcs = ["ATest.java"],
+)
+`
+	newRule := bazel.NewRule("java_library", "x", "Foo", Attrs{"srcs": []string{"Foo.java"}})
+	libWithFoo := bazel.NewRule("java_library", "x", "lib", Attrs{"srcs": []string{"A.java", "Foo.java"}})
+	lib2WithFoo := bazel.NewRule("java_library", "x", "lib2", Attrs{"srcs": []string{"B.java", "Foo.java"}})
+
+	tests := []struct {
+		desc     string
+		policy   string
+		stdin    string
+		existing []*bazel.Rule
+		want     *bazel.Rule
+	}{
+		{
+			desc:     "create",
+			policy:   NewRulePolicyCreate,
+			existing: []*bazel.Rule{lib},
+			want:     newRule,
+		},
+		{
+			desc:     "add to the only rule",
+			policy:   NewRulePolicyAdd,
+			existing: []*bazel.Rule{lib, test},
+			want:     libWithFoo,
+		},
+		{
+			desc:     "add, but more than one candidate",
+			policy:   NewRulePolicyAdd,
+			existing: []*bazel.Rule{lib, lib2},
+			want:     newRule,
+		},
+		{
+			desc:     "add, but no rule of the same kind",
+			policy:   NewRulePolicyAdd,
+			existing: []*bazel.Rule{test},
+			want:     newRule,
+		},
+		{
+			desc:     "ask, user chooses an existing rule",
+			policy:   NewRulePolicyAsk,
+			stdin:    "2\n",
+			existing: []*bazel.Rule{lib, lib2},
+			want:     lib2WithFoo,
+		},
+		{
+			desc:     "ask, user accepts the default",
+			policy:   NewRulePolicyAsk,
+			stdin:    "\n",
+			existing: []*bazel.Rule{lib, lib2},
+			want:     newRule,
+		},
+	}
+
+	defer func(policy string, stdin io.Reader) {
+		NewRulePolicy, Stdin = policy, stdin
+	}(NewRulePolicy, Stdin)
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			tmpDir, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatalf("Can't create temp directory:\n%v", err)
+			}
+			defer os.RemoveAll(tmpDir)
+			workspaceRoot := filepath.Join(tmpDir, "jadep")
+			createFiles(t, workspaceRoot, []string{"WORKSPACE", "x/BUILD"})
+			if err := ioutil.WriteFile(filepath.Join(workspaceRoot, "x/BUILD"), []byte(buildFile), os.ModePerm); err != nil {
+				t.Fatal(err)
+			}
+
+			rules := make(map[string]*bazel.Rule)
+			for _, r := range tt.existing {
+				rules[r.Name()] = r
+			}
+			config := jadeplib.Config{
+				Loader:       &loadertest.StubLoader{Pkgs: map[string]*bazel.Package{"x": {Rules: rules}}},
+				WorkspaceDir: workspaceRoot,
+			}
+			NewRulePolicy, Stdin = tt.policy, strings.NewReader(tt.stdin)
+			got, err := RulesToFix(context.Background(), config, "", "x/Foo.java", nil, "java_library")
+			if err != nil {
+				t.Fatalf("RulesToFix returned error %v, want nil", err)
+			}
+			if diff := cmp.Diff([]*bazel.Rule{tt.want}, got); diff != "" {
+				t.Errorf("RulesToFix returned diff (-want +got):\n%s", diff)
+			}
+			b, err := ioutil.ReadFile(filepath.Join(workspaceRoot, "x/BUILD"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := strings.Count(string(b), `"Foo.java"`); n != 1 {
+				t.Errorf("RulesToFix wrote Foo.java %d times to the BUILD file, want 1:\n%s", n, b)
+			}
+		})
+	}
+}
+
 func TestRulesToFixCreatesNewRule_absFileName(t *testing.T) {
 	tmpDir, err := ioutil.TempDir("", "")
 	if err != nil {
@@ -333,6 +672,371 @@ func TestWorkspace(t *testing.T) {
 	}
 }
 
+func TestFindWorkspace(t *testing.T) {
+	root, cleanup := jadeptest.Workspace(t, map[string]string{
+		"x/Foo.java":        "",
+		"nested/WORKSPACE":  "",
+		"nested/y/Bar.java": "",
+	})
+	defer cleanup()
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{filepath.Join(root, "x", "Foo.java"), root},
+		{filepath.Join(root, "x"), root},
+		{filepath.Join(root, "nested", "y", "Bar.java"), filepath.Join(root, "nested")},
+	}
+	for _, tt := range tests {
+		got, err := FindWorkspace(tt.path)
+		if err != nil {
+			t.Errorf("FindWorkspace(%s) returned error %v", tt.path, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("FindWorkspace(%s) = %s, want %s", tt.path, got, tt.want)
+		}
+	}
+
+	if _, err := FindWorkspace("x/Foo.java"); err == nil {
+		t.Errorf("FindWorkspace(x/Foo.java) returned nil error, want an error for a relative path")
+	}
+}
+
+func TestFilesToParseAbs(t *testing.T) {
+	workspaceRoot := "/blabla/workspace"
+	loader := jadeptest.NewLoader(jadeptest.Packages(
+		jadeptest.Rule("java_library", "x", "Foo", jadeptest.Srcs("Bar1.java", "subdir/Bar2.java", "//other:Bar3.java")),
+	))
+	tests := []struct {
+		arg     string
+		want    []string
+		wantErr error
+	}{
+		{
+			arg:  "/some/other/path/Foo.java",
+			want: []string{"/some/other/path/Foo.java"},
+		},
+		{
+			arg:  "//x:Foo",
+			want: []string{"/blabla/workspace/x/Bar1.java", "/blabla/workspace/x/subdir/Bar2.java", "/blabla/workspace/other/Bar3.java"},
+		},
+		{
+			arg:     "Foo.java",
+			wantErr: fmt.Errorf(`"Foo.java" is neither a label nor an absolute file name`),
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := FilesToParseAbs(context.Background(), workspaceRoot, loader, tt.arg)
+		if diff := cmp.Diff(tt.wantErr, err, equateErrorMessage); diff != "" {
+			t.Errorf("FilesToParseAbs(%v) returned diff in error (-want +got):\n%s", tt.arg, diff)
+		}
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("FilesToParseAbs(%v) returned diff (-want +got):\n%s", tt.arg, diff)
+		}
+	}
+}
+
+func TestRulesToFixAbs(t *testing.T) {
+	root, cleanup := jadeptest.Workspace(t, map[string]string{"x/BUILD": "", "x/Foo.java": ""})
+	defer cleanup()
+	foo := jadeptest.Rule("java_library", "x", "x", jadeptest.Srcs("Foo.java"))
+	config := jadeptest.Config(root, jadeptest.NewLoader(jadeptest.Packages(foo)))
+
+	got, err := RulesToFixAbs(context.Background(), config, filepath.Join(root, "x", "Foo.java"), nil, "")
+	if err != nil {
+		t.Fatalf("RulesToFixAbs returned error %v", err)
+	}
+	if diff := cmp.Diff(got, []*bazel.Rule{foo}); diff != "" {
+		t.Errorf("RulesToFixAbs returned diff (-got +want):\n%s", diff)
+	}
+
+	if _, err := RulesToFixAbs(context.Background(), config, "x/Foo.java", nil, ""); err == nil {
+		t.Errorf("RulesToFixAbs(x/Foo.java) returned nil error, want an error for a relative path")
+	}
+}
+
+func TestServiceProviderClassNames(t *testing.T) {
+	root, cleanup := jadeptest.Workspace(t, map[string]string{
+		"x/META-INF/services/com.Service":         "# Providers\ncom.impl.First\n  com.impl.Second # trailing comment\n\ncom.impl.Outer$Nested\n",
+		"y/resources/META-INF/services/com.Other": "com.impl.First\ncom.impl.Third\n",
+		"x/config.properties":                     "com.NotAService\n",
+	})
+	defer cleanup()
+	rules := []*bazel.Rule{
+		jadeptest.Rule("java_library", "x", "x", jadeptest.Attr("resources", []string{
+			"META-INF/services/com.Service",
+			"config.properties",
+			"//y:resources/META-INF/services/com.Other",
+			"//z:missing/META-INF/services/com.Missing",
+		})),
+	}
+	got := ServiceProviderClassNames(root, rules)
+	want := []jadeplib.ClassName{"com.impl.First", "com.impl.Second", "com.impl.Outer", "com.impl.Third"}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("ServiceProviderClassNames returned diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestResourceLabels(t *testing.T) {
+	root, cleanup := jadeptest.Workspace(t, map[string]string{
+		"src/main/resources/BUILD":               "",
+		"src/main/resources/com/foo/a.txt":       "",
+		"src/main/resources/com/foo/b.txt":       "",
+		"src/main/java/com/foo/BUILD":            "",
+		"src/main/java/com/foo/c.txt":            "",
+		"unpackaged/src/main/java/com/foo/d.txt": "",
+	})
+	defer cleanup()
+	pkgs := map[string]*bazel.Package{
+		"src/main/resources": {
+			Rules: map[string]*bazel.Rule{
+				"files":  jadeptest.Rule("filegroup", "src/main/resources", "files", jadeptest.Attr("srcs", []string{"com/foo/a.txt"})),
+				"others": jadeptest.Rule("filegroup", "src/main/resources", "others", jadeptest.Attr("srcs", []string{"com/foo/c.txt"})),
+			},
+		},
+		"src/main/java/com/foo": {},
+	}
+	config := jadeplib.Config{Loader: &loadertest.StubLoader{Pkgs: pkgs}, WorkspaceDir: root}
+	contentRoots := []string{"src/main/java", "unpackaged/src/main/java"}
+
+	tests := []struct {
+		resource string
+		want     []bazel.Label
+	}{
+		{"com/foo/a.txt", []bazel.Label{"//src/main/resources:files", "//src/main/resources:com/foo/a.txt"}},
+		{"com/foo/b.txt", []bazel.Label{"//src/main/resources:com/foo/b.txt"}},
+		{"com/foo/c.txt", []bazel.Label{"//src/main/java/com/foo:c.txt"}},
+		{"com/foo/d.txt", nil},
+		{"com/foo/missing.txt", nil},
+	}
+	for _, tt := range tests {
+		got, err := resourceLabels(context.Background(), config, contentRoots, tt.resource)
+		if err != nil {
+			t.Errorf("resourceLabels(%q) returned error: %v", tt.resource, err)
+			continue
+		}
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("resourceLabels(%q) returned diff (-want +got):\n%s", tt.resource, diff)
+		}
+	}
+}
+
+func TestResourceRoots(t *testing.T) {
+	got := resourceRoots([]string{"src/main/java", "src/test/java/", "java", "src/main/resources", "src/main/kotlin"})
+	want := []string{"src/main/java", "src/main/resources", "src/test/java", "src/test/resources", "java", "resources", "src/main/kotlin"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("resourceRoots returned diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestFormatCandidates(t *testing.T) {
+	editedRule := bazel.NewRule("java_library", "x", "x", nil)
+	var tests = []struct {
+		desc          string
+		lbls          []bazel.Label
+		maxCandidates int
+		relative      bool
+		want          string
+	}{
+		{
+			desc: "labels in the same package are grouped, in the order of their first label",
+			lbls: []bazel.Label{"//third_party/guava:guava", "//java/com/google:common", "//third_party/guava:guava_shaded"},
+			want: "//third_party/guava:{guava, guava_shaded}, //java/com/google:common",
+		},
+		{
+			desc:          "only the first candidates are shown",
+			lbls:          []bazel.Label{"//a:a", "//b:b", "//a:c", "//d:d"},
+			maxCandidates: 3,
+			want:          "//a:{a, c}, //b:b and 1 more (use --candidates_file to see all)",
+		},
+		{
+			desc:          "short lists aren't truncated",
+			lbls:          []bazel.Label{"//a:a", "//b:b"},
+			maxCandidates: 2,
+			want:          "//a:a, //b:b",
+		},
+		{
+			desc:     "labels in the package of the edited rule",
+			lbls:     []bazel.Label{"//x:a", "//x:b", "//y:y"},
+			relative: true,
+			want:     ":{a, b}, //y",
+		},
+	}
+	defer func(max int, relative bool) {
+		MaxCandidates, RelativeLabels = max, relative
+	}(MaxCandidates, RelativeLabels)
+	for _, tt := range tests {
+		MaxCandidates, RelativeLabels = tt.maxCandidates, tt.relative
+		if got := formatCandidates(editedRule, tt.lbls); got != tt.want {
+			t.Errorf("%s: formatCandidates(%v) = %q, want %q", tt.desc, tt.lbls, got, tt.want)
+		}
+	}
+}
+
+func TestFormatCandidatesClasspathDelta(t *testing.T) {
+	pkgs := map[string]*bazel.Package{
+		"a": {Rules: map[string]*bazel.Rule{
+			"heavy": bazel.NewRule("java_library", "a", "heavy", map[string]interface{}{"deps": []string{"//b:b", "//c:c"}}),
+			"light": bazel.NewRule("java_library", "a", "light", nil),
+		}},
+	}
+	editedRule := bazel.NewRule("java_library", "x", "x", map[string]interface{}{"deps": []string{"//b:b"}})
+	defer func(e *jadeplib.ClasspathEstimator) { ClasspathEstimator = e }(ClasspathEstimator)
+	ClasspathEstimator = jadeplib.NewClasspathEstimator(context.Background(), &loadertest.StubLoader{Pkgs: pkgs}, 3)
+
+	got := formatCandidates(editedRule, []bazel.Label{"//a:light", "//a:heavy", "//d:d"})
+	want := "//a:{light (+1), heavy (+2)}, //d:d (+1)"
+	if got != want {
+		t.Errorf("formatCandidates = %q, want %q", got, want)
+	}
+}
+
+func TestAppendCandidates(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	fileName := filepath.Join(tmpDir, "candidates")
+	missingDeps := map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label{
+		bazel.NewRule("java_library", "x", "x", nil): {
+			"com.Foo": {"//z:z", "//a:a"},
+			"com.Bar": {"//b:b"},
+		},
+	}
+	for i := 0; i < 2; i++ {
+		if err := appendCandidates(fileName, missingDeps); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Repeat("//x:x com.Bar //b:b\n//x:x com.Foo //z:z\n//x:x com.Foo //a:a\n", 2)
+	if diff := cmp.Diff(string(got), want); diff != "" {
+		t.Errorf("appendCandidates wrote diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestJSONSink(t *testing.T) {
+	rule := bazel.NewRule("java_library", "x", "x", nil)
+	var buf bytes.Buffer
+	sink := JSONSink{W: &buf}
+	if err := sink.RulesToFix([]*bazel.Rule{rule}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.MissingDeps(map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label{rule: {"com.Foo": {"//z:z", "//a:a"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.MissingDeps(map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label{rule: {}}); err != nil {
+		t.Fatal(err)
+	}
+	artifacts := map[jadeplib.ClassName][]mavenindex.Artifact{"com.Bar": {{GroupID: "com", ArtifactID: "bar", Version: "1.0"}}}
+	if err := sink.UnresolvedClassNames([]jadeplib.ClassName{"com.Bar", "com.Baz"}, artifacts); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.UnresolvedClassNames(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := `{"type":"rules_to_fix","rules":["//x:x"]}
+{"type":"missing_deps","missing_deps":{"//x:x":{"com.Foo":["//z:z","//a:a"]}}}
+{"type":"missing_deps"}
+{"type":"unresolved","unresolved":["com.Bar","com.Baz"],"artifacts":{"com.Bar":["com:bar:1.0"]}}
+`
+	if diff := cmp.Diff(buf.String(), want); diff != "" {
+		t.Errorf("JSONSink wrote diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestTextSinkMissingDepsOrder(t *testing.T) {
+	defer func(w io.Writer, flags int) {
+		log.SetOutput(w)
+		log.SetFlags(flags)
+	}(log.Writer(), log.Flags())
+	log.SetFlags(0)
+
+	missingDeps := map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label{
+		bazel.NewRule("java_library", "y", "y", nil): {"com.Foo": {"//z:z"}},
+		bazel.NewRule("java_library", "x", "x", nil): {
+			"com.Zed": {"//z:z"},
+			"com.Bar": {"//b:b", "//a:a"},
+			"com.Foo": {"//z:z"},
+		},
+	}
+	want := `Missing dependencies in //x:x
+com.Bar                                            can be satisfied using:
+             //b:b, //a:a
+com.Foo                                            can be satisfied using:
+             //z:z
+com.Zed                                            can be satisfied using:
+             //z:z
+Missing dependencies in //y:y
+com.Foo                                            can be satisfied using:
+             //z:z
+`
+	for i := 0; i < 10; i++ {
+		var buf bytes.Buffer
+		log.SetOutput(&buf)
+		if err := (TextSink{}).MissingDeps(missingDeps); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(buf.String(), want); diff != "" {
+			t.Fatalf("TextSink.MissingDeps wrote diff (-got +want):\n%s", diff)
+		}
+	}
+}
+
+type recordingSink struct {
+	rules []*bazel.Rule
+	err   error
+}
+
+func (s *recordingSink) RulesToFix(rules []*bazel.Rule) error {
+	s.rules = rules
+	return s.err
+}
+
+func (s *recordingSink) MissingDeps(missingDeps map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label) error {
+	return s.err
+}
+
+func (s *recordingSink) UnresolvedClassNames(classNames []jadeplib.ClassName, artifacts map[jadeplib.ClassName][]mavenindex.Artifact) error {
+	return s.err
+}
+
+func TestMultiSink(t *testing.T) {
+	// A failing sink doesn't prevent later sinks from receiving results.
+	failing := &recordingSink{err: errors.New("failed")}
+	ok := &recordingSink{}
+	rules := []*bazel.Rule{bazel.NewRule("java_library", "x", "x", nil)}
+	err := MultiSink{failing, ok}.RulesToFix(rules)
+	if err == nil || err.Error() != "failed" {
+		t.Errorf("MultiSink.RulesToFix returned error %v, want 'failed'", err)
+	}
+	if diff := cmp.Diff(ok.rules, rules); diff != "" {
+		t.Errorf("MultiSink.RulesToFix reported diff to the second sink (-got +want):\n%s", diff)
+	}
+}
+
+func TestProcessorClassNames(t *testing.T) {
+	rules := []*bazel.Rule{
+		jadeptest.Rule("java_plugin", "x", "processor", jadeptest.Attr("processor_class", "com.x.Processor")),
+		jadeptest.Rule("java_plugin", "x", "nested", jadeptest.Attr("processor_class", "com.x.Outer$Processor")),
+		jadeptest.Rule("java_plugin", "x", "invalid", jadeptest.Attr("processor_class", "com.x.1Processor")),
+		jadeptest.Rule("java_plugin", "x", "no_processor"),
+		jadeptest.Rule("java_library", "x", "lib", jadeptest.Attr("processor_class", "com.x.NotAPlugin")),
+	}
+	got := ProcessorClassNames(rules)
+	want := []jadeplib.ClassName{"com.x.Processor", "com.x.Outer"}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("ProcessorClassNames returned diff (-got +want):\n%s", diff)
+	}
+}
+
 func TestClassNamesToResolve(t *testing.T) {
 	// Test that classNamesToResolve extracts top-level class names from --classnames, if possible.
 	ctx := context.Background()
@@ -358,3 +1062,154 @@ func createFiles(t *testing.T, workDir string, fileNames []string) func() {
 		}
 	}
 }
+
+func TestWhyNot(t *testing.T) {
+	type Attrs = map[string]interface{}
+
+	public := []string{"//visibility:public"}
+	pkgs := map[string]*bazel.Package{
+		"y": {
+			Rules: map[string]*bazel.Rule{
+				"hidden": bazel.NewRule("java_library", "y", "hidden", Attrs{"visibility": []string{":group"}}),
+			},
+			PackageGroups: map[string]*bazel.PackageGroup{
+				"group": {Specs: []string{"z/..."}},
+			},
+		},
+	}
+	resolver := jadeptest.NewResolver(map[jadeplib.ClassName][]*bazel.Rule{
+		"com.Bar": {
+			bazel.NewRule("java_library", "y", "a", Attrs{"visibility": public}),
+			bazel.NewRule("java_library", "y", "b", Attrs{"visibility": public}),
+			bazel.NewRule("java_library", "y", "deprecated", Attrs{"deprecation": "don't", "visibility": public}),
+			pkgs["y"].Rules["hidden"],
+		},
+	})
+	config := jadeptest.Config("", jadeptest.NewLoader(pkgs), resolver)
+	rulesToFix := []*bazel.Rule{bazel.NewRule("java_library", "x", "Foo", nil)}
+
+	tests := []struct {
+		label bazel.Label
+		cls   jadeplib.ClassName
+		want  string
+	}{
+		{"//y:a", "com.Bar", "//y:a is the top candidate for com.Bar"},
+		{"//y:b", "com.Bar", "//y:b was outranked by //y:a"},
+		{"//y:deprecated", "com.Bar", `//y:deprecated was filtered out: deprecated: "don't"`},
+		{"//y:hidden", "com.Bar", "//y:hidden was filtered out: not visible to package x (visibility = [//y:group]); none of the package_group()s //y:group grants visibility"},
+		{"//y:c", "com.Bar", "//y:c wasn't returned by any resolver; com.Bar is provided by //y:a, //y:b, //y:deprecated, //y:hidden"},
+		{"//y:a", "com.Unknown", "//y:a wasn't returned by any resolver: no rule providing com.Unknown was found"},
+	}
+	for _, tt := range tests {
+		got, err := WhyNot(context.Background(), config, rulesToFix, tt.label, tt.cls)
+		if err != nil {
+			t.Errorf("WhyNot(%s, %s) returned error %v", tt.label, tt.cls, err)
+			continue
+		}
+		if diff := cmp.Diff(got, map[bazel.Label]string{"//x:Foo": tt.want}); diff != "" {
+			t.Errorf("WhyNot(%s, %s) returned diff (-got +want):\n%s", tt.label, tt.cls, diff)
+		}
+	}
+}
+
+func TestProviders(t *testing.T) {
+	type Attrs = map[string]interface{}
+
+	pkgs := map[string]*bazel.Package{
+		"y": {
+			Rules: map[string]*bazel.Rule{
+				"a":      bazel.NewRule("java_library", "y", "a", Attrs{"visibility": []string{"//visibility:public"}}),
+				"hidden": bazel.NewRule("java_library", "y", "hidden", Attrs{"visibility": []string{":group"}}),
+			},
+			PackageGroups: map[string]*bazel.PackageGroup{
+				"group": {Specs: []string{"z/..."}},
+			},
+		},
+	}
+	dicts := jadeptest.NewResolver(map[jadeplib.ClassName][]*bazel.Rule{"com.Bar": {pkgs["y"].Rules["hidden"], pkgs["y"].Rules["a"]}})
+	dicts.ResolverName = "Dictionaries"
+	fs := jadeptest.NewResolver(map[jadeplib.ClassName][]*bazel.Rule{"com.Bar": {pkgs["y"].Rules["a"]}})
+	fs.ResolverName = "FileSystem"
+	config := jadeptest.Config("", jadeptest.NewLoader(pkgs), dicts, fs)
+
+	tests := []struct {
+		desc    string
+		cls     jadeplib.ClassName
+		fromPkg string
+		want    []Provider
+	}{
+		{
+			desc: "without a package",
+			cls:  "com.Bar",
+			want: []Provider{
+				{Label: "//y:a", Resolvers: []string{"Dictionaries", "FileSystem"}},
+				{Label: "//y:hidden", Resolvers: []string{"Dictionaries"}},
+			},
+		},
+		{
+			desc:    "visibility to a package",
+			cls:     "com.Bar",
+			fromPkg: "x",
+			want: []Provider{
+				{Label: "//y:a", Resolvers: []string{"Dictionaries", "FileSystem"}, Visibility: "visible to package x"},
+				{Label: "//y:hidden", Resolvers: []string{"Dictionaries"}, Visibility: "not visible to package x (visibility = [//y:group]); none of the package_group()s //y:group grants visibility"},
+			},
+		},
+		{
+			desc: "unknown class",
+			cls:  "com.Unknown",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			got, err := Providers(context.Background(), config, tt.cls, tt.fromPkg)
+			if err != nil {
+				t.Fatalf("Providers returned error %v", err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("Providers returned diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDisplayLabel(t *testing.T) {
+	defer func(relativeLabels bool, basePkg string) { RelativeLabels, BasePkg = relativeLabels, basePkg }(RelativeLabels, BasePkg)
+	consuming := bazel.NewRule("java_library", "x", "Foo", nil)
+
+	tests := []struct {
+		relativeLabels bool
+		basePkg        string
+		consumingRule  *bazel.Rule
+		want           string
+	}{
+		{false, "", consuming, "//x:Bar"},
+		{true, "", consuming, ":Bar"},
+		{true, "", nil, "//x:Bar"},
+		{false, "y", consuming, "//x:Bar"},
+		{false, "x", nil, ":Bar"},
+	}
+	for _, tt := range tests {
+		RelativeLabels, BasePkg = tt.relativeLabels, tt.basePkg
+		if got := displayLabel(tt.consumingRule, "//x:Bar"); got != tt.want {
+			t.Errorf("displayLabel(%v, //x:Bar) with RelativeLabels=%v, BasePkg=%q = %q, want %q", tt.consumingRule, tt.relativeLabels, tt.basePkg, got, tt.want)
+		}
+	}
+}
+
+func TestDescribeRule(t *testing.T) {
+	tests := []struct {
+		rule *bazel.Rule
+		want string
+	}{
+		{bazel.NewRule("java_library", "x", "Foo", nil), "//x:Foo"},
+		{bazel.NewRule("java_library", "x", "Foo_lib", map[string]interface{}{"generator_function": "some_macro", "generator_name": "Foo"}), "//x:Foo_lib (generated by some_macro //x:Foo)"},
+		{bazel.NewRule("java_library", "x", "Foo", map[string]interface{}{"generator_function": "some_macro", "generator_name": "Foo"}), "//x:Foo (generated by some_macro)"},
+		{bazel.NewRule("java_library", "x", "Foo", map[string]interface{}{"generator_function": "some_macro", "generator_location": "x/BUILD:7"}), "//x:Foo (generated by some_macro)"},
+	}
+	for _, tt := range tests {
+		if got := describeRule(tt.rule); got != tt.want {
+			t.Errorf("describeRule(%v) = %q, want %q", tt.rule, got, tt.want)
+		}
+	}
+}
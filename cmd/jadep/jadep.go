@@ -16,11 +16,10 @@
 package main
 
 import (
-	"fmt"
 	"log"
-	"os"
 	"os/user"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"time"
 
@@ -28,13 +27,21 @@ import (
 	"context"
 
 	"github.com/bazelbuild/tools_jvm_autodeps/bazeldepsresolver"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazelinfo"
+	"github.com/bazelbuild/tools_jvm_autodeps/choices"
+	"github.com/bazelbuild/tools_jvm_autodeps/classindexresolver"
 	"github.com/bazelbuild/tools_jvm_autodeps/cli"
 	"github.com/bazelbuild/tools_jvm_autodeps/filter"
+	"github.com/bazelbuild/tools_jvm_autodeps/grpccreds"
 	"github.com/bazelbuild/tools_jvm_autodeps/grpcloader"
 	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
 	"github.com/bazelbuild/tools_jvm_autodeps/jadepmain"
 	"github.com/bazelbuild/tools_jvm_autodeps/pkgloading"
 	"github.com/bazelbuild/tools_jvm_autodeps/sortingdepsranker"
+	"github.com/bazelbuild/tools_jvm_autodeps/verify"
+	"github.com/bazelbuild/tools_jvm_autodeps/workspaceresolver"
+
+	cipb "github.com/bazelbuild/tools_jvm_autodeps/java/com/google/devtools/javatools/jade/classindex_proto"
 )
 
 var flags jadepmain.Flags
@@ -43,8 +50,25 @@ var strContentRoots, strClassNames, strBlacklist string
 var (
 	bazelInstallBase = flag.String("bazel_install_base", "", "the value of 'bazel info install_base'")
 	bazelOutputBase  = flag.String("bazel_output_base", "", "the value of 'bazel info output_base'")
+	bazelInfo        = flag.Bool("bazel_info", true, "Run 'bazel info' to find --bazel_install_base and --bazel_output_base when they aren't passed. When false, or when 'bazel info' fails, they're guessed from the bazel-out/ symlink")
+	bazelBinary      = flag.String("bazel_binary", "bazel", "the Bazel executable --bazel_info runs")
+	bazelInfoTimeout = flag.Duration("bazel_info_timeout", 30*time.Second, "how long to wait for 'bazel info', which might have to start a Bazel server")
+	bazelInfoCache   string
 
 	thirdpartyJvmDir = flag.String("thirdparty_jvm_dir", "thirdparty/jvm", "the directory where https://github.com/johnynek/bazel-deps placed its generated BUILD files")
+
+	workspaceJars = flag.Bool("workspace_jars", true, "Resolve class names to the jars of maven_jar, jvm_maven_import_external and http_jar repositories declared in the WORKSPACE file")
+
+	classIndexAddress    = flag.String("class_index_address", "", "Address of a ClassIndex gRPC service to look up class names in. Disabled when empty")
+	classIndexTLS        = flag.Bool("class_index_tls", false, "Connect to --class_index_address using TLS")
+	classIndexCAFile     = flag.String("class_index_ca_file", "", "PEM file of certificate authorities used to verify the ClassIndex service. Defaults to the system's roots")
+	classIndexServerName = flag.String("class_index_server_name", "", "Overrides the server name used to verify the ClassIndex service's certificate")
+	classIndexTokenFile  = flag.String("class_index_token_file", "", "File containing a bearer token (e.g. an OAuth2 access token) sent with each request to the ClassIndex service. Requires --class_index_tls")
+
+	pkgLoaderTLS        = flag.Bool("pkgloader_tls", false, "Connect to a remote --pkgloader_address using TLS. Local servers (unix:// and localhost:) are always connected to insecurely")
+	pkgLoaderCAFile     = flag.String("pkgloader_ca_file", "", "PEM file of certificate authorities used to verify a remote pkgloader service. Defaults to the system's roots")
+	pkgLoaderServerName = flag.String("pkgloader_server_name", "", "Overrides the server name used to verify a remote pkgloader service's certificate")
+	pkgLoaderTokenFile  = flag.String("pkgloader_token_file", "", "File containing a bearer token sent with each request to a remote pkgloader service. Requires --pkgloader_tls")
 )
 
 func init() {
@@ -56,9 +80,10 @@ func init() {
 
 	flag.StringVar(&flags.Workspace, "workspace", "", "a Bazel WORKSPACE directory to operate in. Defaults to working directory")
 	flag.StringVar(&strContentRoots, "content_roots", "src/main/java,src/test/java", "locations of Java sources relative to -workspace (comma delimited)")
+	flag.StringVar(&bazelInfoCache, "bazel_info_cache", filepath.Join(u.HomeDir, "jadep/bazel_info.json"), "File caching the results of 'bazel info' per workspace. Disabled when empty")
 	flag.BoolVar(&flags.DryRun, "dry_run", false, "only prints missing/unknown deps")
 	flag.StringVar(&strClassNames, "classnames", "", "when present, Jade will find dependencies for these class names instead of parsing the Java file to look for class names without dependencies (comma delimited).")
-	flag.StringVar(&strBlacklist, "blacklist", `.*\.R$`, "a list of regular expressions matching names of classes for which we will not look for BUILD rules (comma delimited).")
+	flag.StringVar(&strBlacklist, "blacklist", `.*\.R$`, "a list of regular expressions matching names of classes for which we will not look for BUILD rules (comma delimited). A regular expression that starts with ! re-includes the classes it matches; when several match a class, the last one wins, e.g. 'com\\.foo\\..*,!com\\.foo\\.api\\..*'")
 	flag.StringVar(&flags.BlacklistedPackageList, "blacklisted_package_list", filepath.Join(u.HomeDir, "jadep/blacklisted_packages.txt"), "File containing BUILD package names that Jade will not load. Usual use-case: package takes too long to load and doesn't contain anything we need.")
 	flag.StringVar(&flags.BuiltinClassList, "builtin_classlist", filepath.Join(u.HomeDir, "jadep/jdk_android_builtin_class_names.txt"), "File containing class names that don't need deps, e.g. JDK classes. One class name per line, sorted.")
 	flag.StringVar(&flags.PkgLoaderExecutable, "pkgloader_executable", filepath.Join(u.HomeDir, "jadep/pkgloader_server.sh"), "path to a package loader server executable. Started when Jade fails to connect to --pkg_loader_bind_location")
@@ -68,14 +93,117 @@ func init() {
 		"Note that other forms, including IP addresses, will not cause Jade to start a server. "+
 		"localhost:0 is unsupported. "+
 		"The defaut is unix://<homedir>/pkgloader.socket")
+	flag.IntVar(&flags.PkgLoaderChunkSize, "pkgloader_chunk_size", 200, "Maximum number of BUILD packages requested from the pkgloader service in a single RPC. Larger requests are split into chunks. 0 means no limit")
+	flag.IntVar(&flags.PkgLoaderChunkParallelism, "pkgloader_chunk_parallelism", 4, "Maximum number of chunks (see --pkgloader_chunk_size) requested from the pkgloader service concurrently")
 	flag.DurationVar(&flags.RPCDeadline, "rpc_deadline", 15*time.Second, "Time before giving up on RPC connections.")
 	flag.StringVar(&flags.Cpuprofile, "cpuprofile", "", "write cpu profile to file")
 	flag.IntVar(&flags.Vlevel, "vlevel", 0, "Enable V-leveled logging at the specified level")
 	flag.BoolVar(&flags.Color, "color", true, "Colorize output. If stdout or stderr are not terminals, the output will not be colorized and this flag will have no effect")
+	flag.StringVar(&flags.MixedPackageRules, "mixed_package_rules", "ignore", "What to do with rules whose srcs declare more than one Java package. "+
+		"One of 'ignore', 'warn' (print a plan to split them into one rule per Java package) or 'split' (apply that plan using Buildozer). "+
+		"Each new rule gets the deps its own srcs need, or all the deps of the original rule when some of its class names can't be resolved")
+	flag.StringVar(&flags.EditEventsWebhook, "edit_events_webhook", "", "When set, each edit Jadep applies (rule, added deps and the class names they were added for) is POSTed as JSON to this URL")
+	flag.Float64Var(&flags.AutoApplyThreshold, "auto_apply_threshold", 0, "When positive, a missing dependency whose top candidate scores above this threshold (between 0 and 1), and strictly above all other candidates, is added without prompting. Candidates are scored by how many rules in the consuming package already depend on them, or by their classpath size with --classpath_delta=rank. Remaining dependencies are prompted for as usual. Ignored with --dry_run")
+	flag.StringVar(&flags.ChoicesFile, "choices_file", "", "File in which the labels chosen for ambiguous classes are remembered, and suggested first in later runs. Defaults to "+choices.DefaultFileName+" in the workspace root")
+	flag.BoolVar(&flags.IgnorePreviousChoices, "ignore_previous_choices", false, "When true, labels chosen in previous runs are not preferred when ranking candidates. New choices are still recorded")
+	flag.BoolVar(&flags.Verify, "verify", false, "When true, edited rules are built after adding deps, and the added deps are removed from rules that still fail to build")
+	flag.StringVar(&flags.VerifyCommand, "verify_command", verify.DefaultCommand, "Command used by --verify to build edited rules. Their labels are appended to it")
+	flag.BoolVar(&flags.VerifyCandidateJars, "verify_candidate_jars", false, "When true, candidates whose output jar in bazel-bin/ was previously built, but doesn't contain the class they were suggested for, are rejected, unless a rule they export provides it. Classes left without candidates are reported as unresolved")
+	flag.StringVar(&flags.DepsAttributes, "deps_attributes", "", "Comma-separated list of kind=attribute pairs, specifying which attribute to add deps to in rules of each kind (or macro), e.g. 'kt_jvm_library=associates'. Kinds not listed have their 'deps' attribute edited")
+	flag.StringVar(&flags.JavadocRefs, "javadoc_refs", "ignore", "What to do with classes referenced only in Javadoc {@link} and @see tags. One of 'ignore', 'report' (list them) or 'include' (add deps for them, e.g. for rules that build Javadoc)")
+	flag.StringVar(&flags.InlinedConstants, "inlined_constants", "add", "What to do with classes referenced only to read constants (e.g. Foo.MAX_VALUE), which javac inlines. One of 'add' (treat them like any other class), 'report' (add deps, but list them) or 'skip' (don't add deps for them)")
+	flag.StringVar(&flags.ReportFile, "report_file", "", "When set, a record of the run (arguments, rules fixed, deps added, unresolved classes and the duration of each phase) is appended to this file as a line of JSON")
+	flag.StringVar(&flags.UmbrellaTags, "umbrella_tags", "", "Comma-separated list of tags that mark umbrella (API) targets. Missing deps of umbrella targets are added to their 'exports' rather than 'deps', so they keep re-exporting their API surface")
+	flag.StringVar(&flags.UmbrellaNamePattern, "umbrella_name_pattern", "", "A regular expression; rules whose names match it are treated as umbrella targets, like those tagged with one of --umbrella_tags")
+	flag.StringVar(&flags.DictionaryPrecedence, "dictionary_precedence", "first", "Which labels to use for a class name that the built-in class list and third-party dictionaries (e.g. bazel-deps) map to different labels. "+
+		"One of 'first' (the built-in list wins), 'last' (third-party dictionaries win) or 'all' (choose among all of them). Conflicts are reported in any case")
+	flag.BoolVar(&flags.ServiceLoaderResources, "service_loader_resources", false, "When true, provider classes listed in META-INF/services/ files among the 'resources' of the rules to fix are resolved too, since java.util.ServiceLoader loads them without any reference in source")
+	flag.BoolVar(&flags.RelativeLabels, "relative_labels", false, "Print labels in reports the way they're written in the BUILD file of the rule they're reported for, e.g. ':bar' instead of '//foo:bar'. --report_file then also includes relative_added_deps")
+	flag.StringVar(&flags.BasePkg, "base_pkg", "", "When set, print labels in reports relative to this package (e.g. 'java/com/foo') instead of the package of the rule they're reported for. Implies --relative_labels")
+	flag.StringVar(&flags.SkipFile, "skip_file", "", "File listing classes, one per line, for which Jadep never looks for BUILD rules. Answering 'n' when asked to choose a dependency adds the class to it. Defaults to "+choices.DefaultSkipFileName+" in the workspace root")
+	flag.StringVar(&flags.LabelBlacklist, "label_blacklist", "", "a list of regular expressions matching labels that are never suggested as dependencies, e.g. '.*:testdata,//experimental/.*' (comma delimited). A regular expression must match the whole label")
+	flag.DurationVar(&flags.DataFilesPollInterval, "data_files_poll_interval", 0, "When positive, --builtin_classlist and --blacklisted_package_list are polled for changes at this interval and reloaded without restarting Jadep, and SIGHUP reloads them immediately. Meant for long-running Jadep processes")
+	flag.StringVar(&flags.NewRulePolicy, "new_rule_policy", "create", "What to do with a file that no rule consumes, when its package already has rules of the kind that would be created. One of 'create' (always create a new rule), 'add' (add the file to the srcs of the existing rule, if there's exactly one) or 'ask'.")
+	flag.StringVar(&flags.NewRuleRequiredAttrs, "new_rule_required_attrs", "", "Attributes to set on rules Jadep creates, so Bazel accepts them. A semicolon-separated list of <package regexp>:<attribute>=<comma-separated values>, e.g. 'third_party/.*:licenses=notice'. 'licenses' isn't set in packages that call licenses().")
+	flag.BoolVar(&flags.PrintBuildozerCommands, "print_buildozer_commands", false, "Instead of adding the chosen deps, print the equivalent Buildozer commands to stdout, one per line, e.g. 'add deps //x:y|//pkg:rule'. They can be applied with 'buildozer -f -'. Rules that Jadep creates or splits are still written.")
+	flag.StringVar(&flags.Corpus, "corpus", "", "'jadep bench' runs Jadep on the Java files under this directory, without editing BUILD files, and reports per-phase latencies")
+	flag.StringVar(&flags.GoldenDeps, "golden_deps", "", "'jadep bench' reports precision and recall versus this file. Each line is a file name relative to --corpus, followed by the deps Jadep should add for it")
+	flag.StringVar(&flags.RecordedPackages, "recorded_packages", "", "When set, BUILD packages are read from this file (written by --record_packages) instead of the PackageLoader service. Makes 'jadep bench' reproducible")
+	flag.StringVar(&flags.RecordPackages, "record_packages", "", "When set, the BUILD packages Jadep loads are written to this file when it exits, to be used with --recorded_packages")
+	flag.IntVar(&flags.ParserConcurrency, "parser_concurrency", runtime.NumCPU(), "Maximum number of Java files to read and parse at once")
+	flag.DurationVar(&flags.ParserFileTimeout, "parser_file_timeout", 0, "When positive, Java files that take longer than this to read and parse are skipped with a warning")
+	flag.StringVar(&flags.MavenIndex, "maven_index", "", "When set, class names that no BUILD rule provides are looked up in this Maven index, and the artifacts that contain them are suggested. Either a local Maven repository, e.g. ~/.m2/repository, or a CSV file whose lines are <class name>,<group>:<artifact>:<version>")
+	flag.DurationVar(&flags.ResolverTimeout, "resolver_timeout", 0, "When positive, a resolver that takes longer than this to resolve a file's class names is abandoned, and the class names are passed to the next resolver. Resolvers that panic are always abandoned this way")
+	flag.StringVar(&flags.FromPkg, "from_pkg", "", "'jadep provides' explains whether each rule it prints is visible to this package, e.g. 'java/com/foo'")
+	flag.BoolVar(&flags.ProvenanceComments, "provenance_comments", false, "Attach a comment to each added dep naming the class names it was added for, e.g. '# jadep: for com.foo.Bar'. 'jadep strip-comments <BUILD file>...' removes them")
+	flag.BoolVar(&flags.VCSChanged, "vcs_changed", false, "Also process the Java files that Git or Mercurial report as modified, added or untracked in the workspace. Renamed files are processed under their new name, and new files get new rules as usual")
+	flag.StringVar(&flags.BuiltinClassLists, "builtin_classlists", "", "Comma-separated list of key=file pairs of additional builtin class lists, e.g. 'jdk8=/path/jdk8.txt,android-21=/path/android21.txt'. A rule uses the list named by its 'jadep_builtins=<key>' tag or by --builtin_classlist_dirs, and --builtin_classlist otherwise. Classes missing from a rule's list aren't treated as builtin")
+	flag.StringVar(&flags.BuiltinClassListDirs, "builtin_classlist_dirs", "", "Comma-separated list of package=key pairs, selecting the --builtin_classlists list of the rules in each package and its subpackages, e.g. 'java/com/legacy=jdk8'")
+	flag.StringVar(&flags.PostEditCommand, "post_edit_command", "", "Command run in the workspace after each edit of BUILD files, with the edited BUILD files appended to it, e.g. a BUILD linter. $JADEP_NEW_BUILD_FILES lists the BUILD files the edit created. If the command fails, the edit is undone and reported as failed")
+	flag.StringVar(&flags.WarmStartCache, "warm_start_cache", "", "File to which Jadep saves the packages it loaded, the classes of rules and the classes of jars when it exits, and from which it restores them when it starts, so a restarted Jadep answers its first queries without reloading them. Packages are revalidated against their BUILD files and files, and jars against their content. Changes to .bzl files aren't detected. Empty disables the cache")
+	flag.StringVar(&flags.Answers, "answers", "", "File to read the answers to prompts from, one per line in the order the prompts are shown, for scripted runs. An empty line accepts the suggestion. When not set, prompts are answered on stdin if it's a terminal")
+	flag.StringVar(&flags.AmbiguityPolicy, "ambiguity_policy", "skip", "What to do with a class that has several candidate dependencies when prompts can't be answered, i.e. stdin isn't a terminal and --answers isn't set. One of 'skip' (add none of them), 'first' (add the top-ranked one) or 'fail'. --new_rule_policy=ask behaves like 'create' in that case")
+	flag.IntVar(&flags.MaxCandidates, "max_candidates", 10, "The number of candidate dependencies reported for a class, e.g. with --dry_run; the rest are summarized as 'and N more'. Zero or less reports all of them")
+	flag.StringVar(&flags.CandidatesFile, "candidates_file", "", "File to which every candidate dependency of every class is appended, one '<rule> <class> <candidate>' per line, including the ones --max_candidates hides")
+	flag.StringVar(&flags.Outputs, "outputs", "text", "Comma-separated list of formats in which the rules being fixed, their missing deps and unresolved class names are reported, each optionally followed by ':<file>' to append to a file. "+
+		"Formats are 'text' (human-readable, to stderr only) and 'json' (a JSON object per line, to stdout by default), e.g. 'text,json:/tmp/jadep.jsonl'. --report_file is written in any case")
+	flag.StringVar(&flags.ReleaseClassLists, "release_classlists", "", "Comma-separated list of release=key pairs, selecting the --builtin_classlists list of rules whose javacopts contain '--release <release>', e.g. '8=jdk8'. Takes precedence over --builtin_classlist_dirs. "+
+		"Like any rule with its own list, such rules don't treat java.lang classes missing from it as implicitly imported, so parsing their files waits until they're found")
+	flag.StringVar(&flags.RuleTemplates, "rule_templates", "", "JSON file mapping rule kinds to attributes that rules of that kind get when Jadep creates them, e.g. "+
+		`{"java_test": {"test_class": "{class}", "size": "small", "runtime_deps": ["//third_party/java/junit"]}}. Values are strings or lists of strings, in which {name}, {package} and {class} are replaced by the new rule's name, package and the class in its src. `+
+		"Defaults to "+jadepmain.DefaultRuleTemplatesFileName+" in the workspace root, if it exists")
+	flag.StringVar(&flags.ResourceRefs, "resource_refs", "ignore", "What to do with class path resources that srcs load by name, e.g. Foo.class.getResource(\"data.txt\"), but that rules don't list. "+
+		"One of 'ignore' or 'report' (suggest the file or filegroup to add to 'resources', looked up under --content_roots and their Maven resources directories)")
+	flag.StringVar(&flags.Macros, "macros", "", "Comma-separated list of macro=attribute[:target] entries, describing how to add deps to the calls of macros whose rules Jadep fixes, "+
+		"e.g. 'robolectric_test=deps:{name}_lib,junit_suite=test_deps'. Deps are added to 'attribute' of the call, as with --deps_attributes. "+
+		"If a call generates several rules, only the one named 'target' is analyzed, where {name} is the name of the call")
+	flag.IntVar(&flags.CycleCheckDepth, "cycle_check_depth", 1, "How many levels of the dependencies of each candidate to follow to drop the candidates that depend on the rule being fixed, "+
+		"since adding them would create a dependency cycle. 1 only checks the candidates' own deps, which are already loaded; deeper levels load BUILD files as needed. 0 disables the check")
+	flag.StringVar(&flags.DanglingDeps, "dangling_deps", "report", "What to do with deps of the rules being fixed that don't exist, i.e. their package loads but doesn't define them. "+
+		"One of 'report' or 'remove' (remove them from the rules, unless --dry_run is set). Either way, deps are suggested for the classes they were meant to provide")
+	flag.IntVar(&flags.ShardCount, "shard_count", 0, "When positive, only the files and rules whose shard (a hash of the argument modulo --shard_count) is --shard_index are processed, "+
+		"so that several machines can each process a slice of a large list of arguments. Combine with --edit_plan, and apply the plans with 'jadep merge-plans'")
+	flag.IntVar(&flags.ShardIndex, "shard_index", 0, "Which shard to process, between 0 and --shard_count - 1. See --shard_count")
+	flag.StringVar(&flags.EditPlan, "edit_plan", "", "When set, the deps Jadep would add to and remove from rules are written to this JSON file instead of editing BUILD files. "+
+		"No other edits are made: files that no rule srcs are skipped, rules aren't split and test_class isn't set, since the plan couldn't be applied on another checkout. With 'jadep merge-plans', the merged plan is written to this file instead of being applied")
+	flag.BoolVar(&flags.Cleanup, "cleanup", false, "Remove deps that a rule's exports already provide, i.e. deps that are also listed in exports or exported by them. Without it, they're only reported. Ignored with --dry_run")
+	flag.DurationVar(&flags.PromptTimeout, "prompt_timeout", 0, "When positive, a prompt that isn't answered within this time is answered according to --prompt_timeout_action, and so are the rest of the prompts for the same file or rule, "+
+		"e.g. for pre-commit hooks where nobody might be watching the terminal. Zero waits forever")
+	flag.StringVar(&flags.PromptTimeoutAction, "prompt_timeout_action", "accept", "How prompts are answered after --prompt_timeout: 'accept' (add the top-ranked candidate) or 'skip' (add none)")
+	flag.StringVar(&flags.PackageAliases, "package_aliases", "", "File mapping the packages of shaded (relocated) libraries to their canonical packages, one 'package=canonical' pair per line, e.g. 'org.apache.hadoop.thirdparty.protobuf=com.google.protobuf'. "+
+		"Class names that no rule provides are resolved again under their aliases in either direction, so a reference to a relocated class gets a dep on the rule that provides its canonical class, and vice versa")
+	flag.StringVar(&flags.PackageInfoPolicy, "package_info_policy", "package_rules", "What to do with a package-info.java that no rule srcs. One of 'package_rules' (add the deps of its annotations to the rules that src the other Java files in its directory) or 'skip'. Jadep never creates rules for package-info.java or module-info.java")
+	flag.StringVar(&flags.HealthSignalsFile, "health_signals_file", "", "JSON file mapping labels to their health in build metadata, e.g. exported by CI: {\"//foo:bar\": {\"broken\": true, \"flakiness\": 0.3, \"owners\": [\"team-foo\"]}}. Broken targets, and targets flakier than --max_flakiness, aren't suggested when a healthy target provides the same class")
+	flag.Float64Var(&flags.MaxFlakiness, "max_flakiness", 0, "Flakiness (between 0 and 1) above which targets in --health_signals_file aren't suggested. Zero ignores flakiness")
+	flag.StringVar(&flags.InvisibleDeps, "invisible_deps", "report", "What to do with deps added to rules that can't see them, which happens when no visible rule provides a class. "+
+		"One of 'ignore', 'report' (print a plan to make them visible, at the end of the run) or 'fix' (apply that plan using Buildozer, unless --dry_run is set)")
+	flag.IntVar(&flags.PackageGroupThreshold, "package_group_threshold", 3, "With --invisible_deps, a rule that at least this many packages need to see is made visible to them through a single package_group, "+
+		"which is created next to it, or extended if its visibility already lists one of its package's package_groups. 0 always adds each package to the rule's visibility")
+	flag.StringVar(&flags.ClasspathDelta, "classpath_delta", "off", "Whether to estimate how many targets each candidate dep adds to the compile classpath of the rule it's suggested for, from the deps and exports of loaded rules. "+
+		"One of 'off', 'report' (print the estimate next to each candidate, e.g. '//foo:bar (+3)') or 'rank' (also prefer the candidates that add the fewest targets)")
+	flag.IntVar(&flags.ClasspathDeltaDepth, "classpath_delta_depth", 3, "How many levels of deps --classpath_delta follows from each candidate. Deeper estimates are more accurate, but load more packages")
+	flag.StringVar(&flags.AnnotationProcessors, "annotation_processors", "", "File describing the classes that annotation processors generate, in addition to those of AutoValue and Dagger, one 'processor_class regexp [plugin]' per line, "+
+		"e.g. 'com.google.auto.value.processor.AutoValueProcessor ^AutoValue_([^_]+) //third_party/java/auto:value_plugin'. The regexp's first group matches the class that generated classes are generated from. "+
+		"References to generated classes aren't reported as unresolved; instead, rules that don't run their processor are reported, along with the plugin to add")
+	flag.StringVar(&flags.ContentRootPrefixes, "content_root_prefixes", "", "Comma-separated list of content_root=java_package pairs, restricting each listed --content_roots root to the Java packages it's paired with and their subpackages, "+
+		"e.g. 'src/main/java=com.mycompany,src/main/java=org.mycompany'. Class names in other packages aren't looked up under that root, which saves file system lookups on large repositories. Roots that aren't listed hold any package")
+	flag.StringVar(&flags.APITags, "api_tags", "", "Comma-separated list of tags that mark API targets, e.g. 'api'. An API target is typically a java_library with no srcs that exports implementation libraries; "+
+		"when it provides a class, it's suggested before the other candidates, so rules depend on the API rather than on the implementation")
+	flag.BoolVar(&flags.RespectKeepComments, "respect_keep_comments", true, "Follow Gazelle's conventions for hand-maintained BUILD entries: deps with a '# keep' comment are never removed, e.g. by --dangling_deps=remove or --cleanup, "+
+		"and rules with a '# jadep:ignore' comment (on the line before them, or on their name) are never fixed. Kept deps are listed in reports")
+	flag.IntVar(&flags.PkgCacheMaxEntries, "pkg_cache_max_entries", 0, "Maximum number of loaded BUILD packages kept in memory; the least recently used ones are evicted and loaded again when needed. 0 means no limit. Useful for long-running 'jadep serve' processes")
+	flag.DurationVar(&flags.PkgCacheErrorTTL, "pkg_cache_error_ttl", 0, "When positive, BUILD packages that failed to load are loaded again when requested after this duration, e.g. once a broken BUILD file is fixed while 'jadep serve' runs. 0 means failures are remembered for the whole run")
+	flag.StringVar(&flags.EditEventsFile, "edit_events_file", "", "When set, each edit Jadep applies is appended to this file as a line of JSON, in the style of Bazel's --build_event_json_file")
 }
 
 func main() {
 	flag.Parse()
+	args := flag.Args()
+	// Flags can also follow a subcommand, e.g. 'jadep provides --from_pkg=foo com.Bar'.
+	if len(args) > 0 && (args[0] == "bench" || args[0] == "provides" || args[0] == "serve" || args[0] == "doctor") {
+		flag.CommandLine.Parse(args[1:])
+		args = append([]string{args[0]}, flag.Args()...)
+	}
 	flags.ContentRoots = strings.Split(strContentRoots, ",")
 	if strClassNames == "" {
 		flags.ClassNames = nil
@@ -84,42 +212,36 @@ func main() {
 	}
 	flags.Blacklist = strings.Split(strBlacklist, ",")
 
+	// 'jadep doctor' reports a missing workspace or Bazel bases itself, together with anything else that's wrong.
+	doctor := len(args) > 0 && args[0] == "doctor"
 	workspaceDir, _, err := cli.Workspace(flags.Workspace)
-	if err != nil {
+	if err != nil && !doctor {
 		log.Fatalf("Can't find root of workspace: %v", err)
 	}
 
 	bazelInstallBase := *bazelInstallBase
 	bazelOutputBase := *bazelOutputBase
-	if bazelInstallBase == "" || bazelOutputBase == "" {
-		install, output, err := guessBazelBases(workspaceDir)
+	if workspaceDir != "" && (bazelInstallBase == "" || bazelOutputBase == "") {
+		opts := bazelinfo.Options{Timeout: *bazelInfoTimeout, CacheFile: bazelInfoCache}
+		if *bazelInfo {
+			opts.Bazel = *bazelBinary
+		}
+		bases, err := bazelinfo.Find(context.Background(), workspaceDir, opts)
 		if err != nil {
-			log.Fatalf("Can't find Bazel install and output bases. Explicitly pass --bazel_install_base and --bazel_output_base.\n%v", err)
+			if !doctor {
+				log.Fatalf("Can't find Bazel install and output bases. Explicitly pass --bazel_install_base and --bazel_output_base.\n%v", err)
+			}
+			log.Printf("WARNING: Can't find Bazel install and output bases. Explicitly pass --bazel_install_base and --bazel_output_base.\n%v", err)
 		}
 		if bazelInstallBase == "" {
-			bazelInstallBase = install
+			bazelInstallBase = bases.InstallBase
 		}
 		if bazelOutputBase == "" {
-			bazelOutputBase = output
+			bazelOutputBase = bases.OutputBase
 		}
 	}
 
-	jadepmain.Main(customization{workspaceDir, bazelInstallBase, bazelOutputBase}, &flags, flag.Args())
-}
-
-// guessBazelBases guesses the output and install bases of the current Bazel workspace.
-// It is a horrible piece of hack and I'm ashamed of it.
-func guessBazelBases(workspaceDir string) (installBase string, outputBase string, err error) {
-	bazelOut, err := os.Readlink(filepath.Join(workspaceDir, "bazel-out"))
-	if err != nil {
-		return "", "", fmt.Errorf("couldn't resolve the bazel-out/ symlink: %v", err)
-	}
-	outputBase = filepath.Dir(filepath.Dir(filepath.Dir(bazelOut)))
-	installBase, err = os.Readlink(filepath.Join(outputBase, "install"))
-	if err != nil {
-		return "", "", fmt.Errorf("couldn't resolve the install base symlink: %v", err)
-	}
-	return installBase, outputBase, nil
+	jadepmain.Main(customization{workspaceDir, bazelInstallBase, bazelOutputBase}, &flags, args)
 }
 
 type customization struct {
@@ -137,16 +259,36 @@ func (c customization) NewDepsRanker(data jadepmain.DataSources) jadeplib.DepsRa
 }
 
 func (c customization) NewResolvers(loader pkgloading.Loader, data interface{}) []jadeplib.Resolver {
+	var ret []jadeplib.Resolver
 	r, err := bazeldepsresolver.NewResolver(context.Background(), c.workspaceDir, *thirdpartyJvmDir, loader)
 	if err != nil {
 		log.Printf("Warning: couldn't create bazel-deps resolver: %v", err)
-		return nil
+	} else {
+		ret = append(ret, r)
+	}
+	if *workspaceJars {
+		r, err := workspaceresolver.NewResolver(c.workspaceDir, filepath.Join(c.bazelOutputBase, "external"))
+		if err != nil {
+			log.Printf("Warning: couldn't create WORKSPACE jars resolver: %v", err)
+		} else {
+			ret = append(ret, r)
+		}
 	}
-	return []jadeplib.Resolver{r}
+	if *classIndexAddress != "" {
+		opts := classindexresolver.DialOptions{TLS: *classIndexTLS, CAFile: *classIndexCAFile, ServerName: *classIndexServerName, TokenFile: *classIndexTokenFile}
+		conn, err := classindexresolver.Dial(context.Background(), *classIndexAddress, opts)
+		if err != nil {
+			log.Printf("Warning: couldn't create ClassIndex resolver: %v", err)
+		} else {
+			ret = append(ret, classindexresolver.NewResolver(cipb.NewClassIndexClient(conn), flags.RPCDeadline, loader))
+		}
+	}
+	return ret
 }
 
 func (c customization) NewLoader(ctx context.Context, flags *jadepmain.Flags, workspaceDir string) (pkgloading.Loader, func(), error) {
-	return grpcloader.Connect(ctx, flags.PkgLoaderExecutable, flags.PkgLoaderAddress, flags.RPCDeadline, workspaceDir, c.bazelInstallBase, c.bazelOutputBase, keys(filter.RuleKindsToLoad))
+	creds := grpccreds.Options{TLS: *pkgLoaderTLS, CAFile: *pkgLoaderCAFile, ServerName: *pkgLoaderServerName, TokenFile: *pkgLoaderTokenFile}
+	return grpcloader.ConnectWithCredentials(ctx, flags.PkgLoaderExecutable, flags.PkgLoaderAddress, flags.RPCDeadline, workspaceDir, c.bazelInstallBase, c.bazelOutputBase, keys(filter.RuleKindsToLoad), creds)
 }
 
 func keys(m map[string]bool) []string {
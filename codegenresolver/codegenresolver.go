@@ -0,0 +1,136 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package codegenresolver resolves class names to the code generation rules that generate them by convention,
+// e.g. java_wrap_cc (SWIG) rules. The Java sources of such classes don't exist on disk, so fsresolver can't find them.
+package codegenresolver
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+	"github.com/bazelbuild/tools_jvm_autodeps/pkgloading"
+)
+
+// GeneratedClassSuffixes maps the kinds of code generation rules to the suffixes they append to their module name
+// to name the classes they generate.
+// A rule's module name is its 'module' attribute if set, or else its name.
+// For example, java_wrap_cc(name = "foo", module = "Foo") generates the classes Foo and FooJNI.
+// Organizations can add their own code generation rule kinds.
+var GeneratedClassSuffixes = map[string][]string{
+	"java_wrap_cc": {"", "JNI", "Swig"},
+}
+
+// Resolver resolves class names to code generation rules, according to GeneratedClassSuffixes.
+// A class name a.b.Foo is resolved to the rules in the package that a/b/Foo.java would belong to, under any of
+// the content roots. If a rule has a 'package' attribute, it must equal the class's Java package, "a.b".
+type Resolver struct {
+	// contentRoots specifies where the Java files are located.
+	contentRoots []string
+	// workspaceDir is a path to the root of a Bazel workspace.
+	workspaceDir string
+
+	// loader loads BUILD files.
+	loader pkgloading.Loader
+
+	// pkgNames caches the packages that directories belong to. If nil, each call to Resolve uses a new cache.
+	pkgNames *pkgloading.PackageNameCache
+}
+
+// NewResolver returns a new Resolver.
+func NewResolver(contentRoots []string, workspaceDir string, loader pkgloading.Loader, pkgNames *pkgloading.PackageNameCache) *Resolver {
+	return &Resolver{contentRoots, workspaceDir, loader, pkgNames}
+}
+
+// Name returns a description of the resolver.
+func (r *Resolver) Name() string {
+	return "code generation conventions"
+}
+
+// Resolve finds the code generation rules that generate the classes in classNames.
+func (r *Resolver) Resolve(ctx context.Context, classNames []jadeplib.ClassName, consumingRules map[bazel.Label]map[bazel.Label]bool) (map[jadeplib.ClassName][]*bazel.Rule, error) {
+	classToFiles := make(map[jadeplib.ClassName][]string)
+	var fileNames []string
+	for _, cls := range classNames {
+		for _, root := range r.contentRoots {
+			f := filepath.Join(append([]string{root}, strings.Split(string(cls), ".")...)...) + ".java"
+			classToFiles[cls] = append(classToFiles[cls], f)
+			fileNames = append(fileNames, f)
+		}
+	}
+
+	packages, fileToPkgName, err := pkgloading.SiblingsWithCache(ctx, r.loader, r.workspaceDir, fileNames, r.pkgNames)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[jadeplib.ClassName][]*bazel.Rule)
+	for _, cls := range classNames {
+		javaPkg, simpleName := splitClassName(cls)
+		seen := make(map[bazel.Label]bool)
+		for _, f := range classToFiles[cls] {
+			pkg := packages[fileToPkgName[f]]
+			if pkg == nil {
+				continue
+			}
+			var rules []*bazel.Rule
+			for _, rule := range pkg.Rules {
+				if !seen[rule.Label()] && generates(rule, javaPkg, simpleName) {
+					seen[rule.Label()] = true
+					rules = append(rules, rule)
+				}
+			}
+			if len(rules) > 0 {
+				sort.Slice(rules, func(i, j int) bool { return rules[i].Label() < rules[j].Label() })
+				result[cls] = append(result[cls], rules...)
+			}
+		}
+	}
+	return result, nil
+}
+
+// generates returns true if rule generates the class simpleName in the Java package javaPkg, according to GeneratedClassSuffixes.
+func generates(rule *bazel.Rule, javaPkg, simpleName string) bool {
+	suffixes, ok := GeneratedClassSuffixes[rule.Schema]
+	if !ok {
+		return false
+	}
+	if p, ok := rule.Attrs["package"].(string); ok && p != javaPkg {
+		return false
+	}
+	module, ok := rule.Attrs["module"].(string)
+	if !ok {
+		module = rule.Name()
+	}
+	for _, s := range suffixes {
+		if strings.EqualFold(simpleName, module+s) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitClassName splits a class name to its Java package and simple name, e.g. "com.foo.Bar" --> "com.foo", "Bar".
+func splitClassName(cls jadeplib.ClassName) (string, string) {
+	s := string(cls)
+	i := strings.LastIndex(s, ".")
+	if i == -1 {
+		return "", s
+	}
+	return s[:i], s[i+1:]
+}
@@ -0,0 +1,126 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codegenresolver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+	"github.com/bazelbuild/tools_jvm_autodeps/loadertest"
+	"github.com/bazelbuild/tools_jvm_autodeps/pkgloaderfakes"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestResolve(t *testing.T) {
+	type Attrs = map[string]interface{}
+
+	var tests = []struct {
+		desc       string
+		classNames []jadeplib.ClassName
+		pkgs       map[string]*bazel.Package
+		want       map[jadeplib.ClassName][]*bazel.Rule
+	}{
+		{
+			desc:       "module attribute",
+			classNames: []jadeplib.ClassName{"com.foo.Foo", "com.foo.FooJNI", "com.foo.FooSwig", "com.foo.Bar"},
+			pkgs: map[string]*bazel.Package{
+				"java/com/foo": pkgloaderfakes.Pkg([]*bazel.Rule{
+					bazel.NewRule("java_wrap_cc", "java/com/foo", "foo_swig", Attrs{"module": "Foo"}),
+				}),
+			},
+			want: map[jadeplib.ClassName][]*bazel.Rule{
+				"com.foo.Foo":     {bazel.NewRule("java_wrap_cc", "java/com/foo", "foo_swig", Attrs{"module": "Foo"})},
+				"com.foo.FooJNI":  {bazel.NewRule("java_wrap_cc", "java/com/foo", "foo_swig", Attrs{"module": "Foo"})},
+				"com.foo.FooSwig": {bazel.NewRule("java_wrap_cc", "java/com/foo", "foo_swig", Attrs{"module": "Foo"})},
+			},
+		},
+		{
+			desc:       "module name defaults to rule name, compared case-insensitively",
+			classNames: []jadeplib.ClassName{"com.foo.FooJNI"},
+			pkgs: map[string]*bazel.Package{
+				"java/com/foo": pkgloaderfakes.Pkg([]*bazel.Rule{
+					bazel.NewRule("java_wrap_cc", "java/com/foo", "foo", nil),
+					pkgloaderfakes.JavaLibrary("java/com/foo", "FooJNI", nil, nil, nil),
+				}),
+			},
+			want: map[jadeplib.ClassName][]*bazel.Rule{
+				"com.foo.FooJNI": {bazel.NewRule("java_wrap_cc", "java/com/foo", "foo", nil)},
+			},
+		},
+		{
+			desc:       "package attribute must match the Java package",
+			classNames: []jadeplib.ClassName{"com.foo.Foo", "com.foo.Bar"},
+			pkgs: map[string]*bazel.Package{
+				"java/com/foo": pkgloaderfakes.Pkg([]*bazel.Rule{
+					bazel.NewRule("java_wrap_cc", "java/com/foo", "Foo", Attrs{"package": "com.other"}),
+					bazel.NewRule("java_wrap_cc", "java/com/foo", "Bar", Attrs{"package": "com.foo"}),
+				}),
+			},
+			want: map[jadeplib.ClassName][]*bazel.Rule{
+				"com.foo.Bar": {bazel.NewRule("java_wrap_cc", "java/com/foo", "Bar", Attrs{"package": "com.foo"})},
+			},
+		},
+		{
+			desc:       "class in a subdirectory of the package",
+			classNames: []jadeplib.ClassName{"com.foo.sub.SubJNI"},
+			pkgs: map[string]*bazel.Package{
+				"java/com/foo": pkgloaderfakes.Pkg([]*bazel.Rule{
+					bazel.NewRule("java_wrap_cc", "java/com/foo", "swig", Attrs{"module": "Sub"}),
+				}),
+			},
+			want: map[jadeplib.ClassName][]*bazel.Rule{
+				"com.foo.sub.SubJNI": {bazel.NewRule("java_wrap_cc", "java/com/foo", "swig", Attrs{"module": "Sub"})},
+			},
+		},
+		{
+			desc:       "no package",
+			classNames: []jadeplib.ClassName{"com.bar.FooJNI"},
+			want:       map[jadeplib.ClassName][]*bazel.Rule{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			workDir, err := ioutil.TempDir("", "jadep")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(workDir)
+			for pkgName := range tt.pkgs {
+				dir := filepath.Join(workDir, filepath.FromSlash(pkgName))
+				if err := os.MkdirAll(dir, 0700); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(filepath.Join(dir, "BUILD"), nil, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			resolver := NewResolver([]string{"java", "javatests"}, workDir, &loadertest.StubLoader{Pkgs: tt.pkgs}, nil)
+			got, err := resolver.Resolve(context.Background(), tt.classNames, nil)
+			if err != nil {
+				t.Fatalf("Resolve(%v) failed: %v", tt.classNames, err)
+			}
+			if diff := cmp.Diff(got, tt.want); diff != "" {
+				t.Errorf("Resolve(%v) diff: (-got +want)\n%s", tt.classNames, diff)
+			}
+		})
+	}
+}
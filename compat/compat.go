@@ -26,6 +26,15 @@ func FileStat(ctx context.Context, name string) (interface{}, error) {
 	return os.Stat(name)
 }
 
+func ReadDirNames(ctx context.Context, name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
+
 func NewLocalSpan(ctx context.Context, name string) (context.Context, func()) {
 	return ctx, func() {}
 }
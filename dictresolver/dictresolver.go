@@ -19,6 +19,9 @@ import (
 	"encoding/csv"
 	"fmt"
 	"io"
+	"log"
+	"path"
+	"strings"
 
 	"context"
 	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
@@ -33,13 +36,13 @@ type Resolver struct {
 	name string
 
 	// dict is a map[jadeplib.ClassName][]bazel.Label. Resolver resolves class name C to the Bazel rules dict[c].
-	dict *future.Value
+	dict future.Getter
 
 	loader pkgloading.Loader
 }
 
 // NewResolver returns a new Resolver.
-func NewResolver(name string, dict *future.Value, loader pkgloading.Loader) *Resolver {
+func NewResolver(name string, dict future.Getter, loader pkgloading.Loader) *Resolver {
 	return &Resolver{name, dict, loader}
 }
 
@@ -50,8 +53,11 @@ func (r *Resolver) Name() string {
 
 // Resolve resolves class names according to an in-memory map.
 func (r *Resolver) Resolve(ctx context.Context, classNames []jadeplib.ClassName, consumingRules map[bazel.Label]map[bazel.Label]bool) (map[jadeplib.ClassName][]*bazel.Rule, error) {
-	dict := r.dict.Get().(map[jadeplib.ClassName][]bazel.Label)
+	return resolve(ctx, r.loader, r.dict.Get().(map[jadeplib.ClassName][]bazel.Label), classNames, consumingRules)
+}
 
+// resolve resolves class names to the rules that dict maps them to.
+func resolve(ctx context.Context, loader pkgloading.Loader, dict map[jadeplib.ClassName][]bazel.Label, classNames []jadeplib.ClassName, consumingRules map[bazel.Label]map[bazel.Label]bool) (map[jadeplib.ClassName][]*bazel.Rule, error) {
 	candidates := make(map[jadeplib.ClassName][]bazel.Label)
 	for _, cls := range classNames {
 		if labels, ok := dict[cls]; ok {
@@ -70,7 +76,7 @@ func (r *Resolver) Resolve(ctx context.Context, classNames []jadeplib.ClassName,
 	for _, c := range candidates {
 		labels = append(labels, c...)
 	}
-	rules, _, err := pkgloading.LoadRules(ctx, r.loader, labels)
+	rules, _, err := pkgloading.LoadRules(ctx, loader, labels)
 	if err != nil {
 		return nil, err
 	}
@@ -95,6 +101,130 @@ func (r *Resolver) Resolve(ctx context.Context, classNames []jadeplib.ClassName,
 	return result, nil
 }
 
+// KeyedResolver resolves class names according to one of several in-memory maps, selected by a key of the rules consuming them.
+// For example, builtin class lists can be keyed by JDK version, so that a rule compiled against an older JDK
+// isn't told that classes introduced in newer JDKs need no deps.
+type KeyedResolver struct {
+	name string
+
+	// dicts maps a key to a map[jadeplib.ClassName][]bazel.Label.
+	dicts map[string]future.Getter
+
+	// defaultDict is used for rules whose key is "", or isn't in dicts.
+	defaultDict future.Getter
+
+	// keyOf returns the key of a consuming rule.
+	keyOf func(*bazel.Rule) string
+
+	loader pkgloading.Loader
+}
+
+// NewKeyedResolver returns a new KeyedResolver.
+func NewKeyedResolver(name string, dicts map[string]future.Getter, defaultDict future.Getter, keyOf func(*bazel.Rule) string, loader pkgloading.Loader) *KeyedResolver {
+	return &KeyedResolver{name, dicts, defaultDict, keyOf, loader}
+}
+
+// Name returns a description of the resolver.
+func (r *KeyedResolver) Name() string {
+	return r.name
+}
+
+// Resolve resolves class names according to the maps selected by the keys of consumingRules.
+// When the consuming rules have different keys, a class name is resolved only if all of their maps contain it,
+// so that it's never treated as resolved for a rule whose map doesn't know it.
+func (r *KeyedResolver) Resolve(ctx context.Context, classNames []jadeplib.ClassName, consumingRules map[bazel.Label]map[bazel.Label]bool) (map[jadeplib.ClassName][]*bazel.Rule, error) {
+	var labels []bazel.Label
+	for l := range consumingRules {
+		labels = append(labels, l)
+	}
+	rules, _, err := pkgloading.LoadRules(ctx, r.loader, labels)
+	if err != nil {
+		return nil, err
+	}
+	selected := make(map[string]future.Getter)
+	for _, rule := range rules {
+		key := r.keyOf(rule)
+		if d, ok := r.dicts[key]; ok {
+			selected[key] = d
+		} else {
+			if key != "" {
+				log.Printf("WARNING: No class list for key %q of %s, using the default one", key, rule.Label())
+			}
+			selected[""] = r.defaultDict
+		}
+	}
+	if len(selected) == 0 {
+		selected[""] = r.defaultDict
+	}
+
+	var dicts []map[jadeplib.ClassName][]bazel.Label
+	for _, d := range selected {
+		dicts = append(dicts, d.Get().(map[jadeplib.ClassName][]bazel.Label))
+	}
+	dict := make(map[jadeplib.ClassName][]bazel.Label)
+	for _, cls := range classNames {
+		if labels, ok := lookupAll(dicts, cls); ok {
+			dict[cls] = labels
+		}
+	}
+	return resolve(ctx, r.loader, dict, classNames, consumingRules)
+}
+
+// lookupAll returns the labels that dicts map cls to, and whether all of dicts contain cls.
+func lookupAll(dicts []map[jadeplib.ClassName][]bazel.Label, cls jadeplib.ClassName) ([]bazel.Label, bool) {
+	var ret []bazel.Label
+	seen := make(map[bazel.Label]bool)
+	for _, d := range dicts {
+		labels, ok := d[cls]
+		if !ok {
+			return nil, false
+		}
+		for _, l := range labels {
+			if !seen[l] {
+				seen[l] = true
+				ret = append(ret, l)
+			}
+		}
+	}
+	return ret, true
+}
+
+// TagKeyPrefix marks the tag of a rule that specifies its key for a KeyedResolver created with RuleKey,
+// e.g. tags = ["jadep_builtins=jdk8"].
+const TagKeyPrefix = "jadep_builtins="
+
+// RuleKey returns a function that computes the key of a rule for a KeyedResolver.
+// The key is taken from a tag of the rule that starts with TagKeyPrefix. Otherwise, dirKeys maps package names to keys,
+// and the key of the closest enclosing package in it is used. Otherwise, the key is "".
+func RuleKey(dirKeys map[string]string) func(*bazel.Rule) string {
+	return RuleKeyWithReleases(dirKeys, nil)
+}
+
+// RuleKeyWithReleases is like RuleKey, but a rule compiled with --release (see jadeplib.JavaRelease) that isn't tagged
+// gets the key that releaseKeys maps the release to, e.g. "8" to "jdk8", before dirKeys are consulted.
+func RuleKeyWithReleases(dirKeys, releaseKeys map[string]string) func(*bazel.Rule) string {
+	return func(rule *bazel.Rule) string {
+		for _, tag := range rule.StringListAttr("tags") {
+			if strings.HasPrefix(tag, TagKeyPrefix) {
+				return strings.TrimPrefix(tag, TagKeyPrefix)
+			}
+		}
+		if release := jadeplib.JavaRelease(rule); release != "" {
+			if key, ok := releaseKeys[release]; ok {
+				return key
+			}
+		}
+		for dir := rule.PkgName; ; dir = path.Dir(dir) {
+			if key, ok := dirKeys[dir]; ok {
+				return key
+			}
+			if dir == "." || dir == "/" || dir == "" {
+				return ""
+			}
+		}
+	}
+}
+
 // ReadDictFromCSV reads a className --> []bazel.Label map from a CSV file.
 // The format is:
 // className,label1,label2,...
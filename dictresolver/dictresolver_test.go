@@ -136,3 +136,85 @@ com.Zee`,
 		})
 	}
 }
+
+func TestKeyedResolver(t *testing.T) {
+	jdk8 := map[jadeplib.ClassName][]bazel.Label{"java.lang.Thread": nil}
+	jdk11 := map[jadeplib.ClassName][]bazel.Label{"java.lang.Thread": nil, "java.net.http.HttpClient": nil}
+	existingPkgs := map[string]*bazel.Package{
+		"old": pkgloaderfakes.Pkg([]*bazel.Rule{bazel.NewRule("java_library", "old", "Old", map[string]interface{}{"tags": []string{"jadep_builtins=jdk8"}})}),
+		"new": pkgloaderfakes.Pkg([]*bazel.Rule{bazel.NewRule("java_library", "new", "New", nil)}),
+	}
+	tests := []struct {
+		desc           string
+		consumingRules map[bazel.Label]map[bazel.Label]bool
+		want           map[jadeplib.ClassName][]*bazel.Rule
+	}{
+		{
+			desc:           "the rule's tag selects the JDK 8 list, which doesn't have HttpClient",
+			consumingRules: map[bazel.Label]map[bazel.Label]bool{"//old:Old": nil},
+			want:           map[jadeplib.ClassName][]*bazel.Rule{"java.lang.Thread": nil},
+		},
+		{
+			desc:           "the rule has no key, so the default list is used",
+			consumingRules: map[bazel.Label]map[bazel.Label]bool{"//new:New": nil},
+			want:           map[jadeplib.ClassName][]*bazel.Rule{"java.lang.Thread": nil, "java.net.http.HttpClient": nil},
+		},
+		{
+			desc:           "class names are resolved only if the lists of all consuming rules have them",
+			consumingRules: map[bazel.Label]map[bazel.Label]bool{"//old:Old": nil, "//new:New": nil},
+			want:           map[jadeplib.ClassName][]*bazel.Rule{"java.lang.Thread": nil},
+		},
+		{
+			desc: "no consuming rules, so the default list is used",
+			want: map[jadeplib.ClassName][]*bazel.Rule{"java.lang.Thread": nil, "java.net.http.HttpClient": nil},
+		},
+	}
+	for _, tt := range tests {
+		loader := &loadertest.StubLoader{Pkgs: existingPkgs}
+		resolver := NewKeyedResolver("keyed", map[string]future.Getter{"jdk8": future.Immediate(jdk8)}, future.Immediate(jdk11), RuleKey(nil), loader)
+		got, err := resolver.Resolve(context.Background(), []jadeplib.ClassName{"java.lang.Thread", "java.net.http.HttpClient"}, tt.consumingRules)
+		if err != nil {
+			t.Fatalf("%s: Resolve returned error: %v", tt.desc, err)
+		}
+		if diff := cmp.Diff(got, tt.want); diff != "" {
+			t.Errorf("%s: Resolve diff: (-got +want)\n%s", tt.desc, diff)
+		}
+	}
+}
+
+func TestRuleKey(t *testing.T) {
+	keyOf := RuleKey(map[string]string{"java/legacy": "jdk8", "java/legacy/modern": "jdk11"})
+	tests := []struct {
+		rule *bazel.Rule
+		want string
+	}{
+		{bazel.NewRule("java_library", "java/legacy/x", "x", nil), "jdk8"},
+		{bazel.NewRule("java_library", "java/legacy/modern/x", "x", nil), "jdk11"},
+		{bazel.NewRule("java_library", "java/legacy", "x", map[string]interface{}{"tags": []string{"manual", "jadep_builtins=android-21"}}), "android-21"},
+		{bazel.NewRule("java_library", "java/other", "x", nil), ""},
+	}
+	for _, tt := range tests {
+		if got := keyOf(tt.rule); got != tt.want {
+			t.Errorf("RuleKey(%v) = %q, want %q", tt.rule, got, tt.want)
+		}
+	}
+}
+
+func TestRuleKeyWithReleases(t *testing.T) {
+	keyOf := RuleKeyWithReleases(map[string]string{"java/legacy": "jdk7"}, map[string]string{"8": "jdk8"})
+	tests := []struct {
+		rule *bazel.Rule
+		want string
+	}{
+		{bazel.NewRule("java_library", "java/x", "x", map[string]interface{}{"javacopts": []string{"--release", "8"}}), "jdk8"},
+		{bazel.NewRule("java_library", "java/legacy", "x", map[string]interface{}{"javacopts": []string{"--release=8"}}), "jdk8"},
+		{bazel.NewRule("java_library", "java/legacy", "x", map[string]interface{}{"javacopts": []string{"--release 11"}}), "jdk7"},
+		{bazel.NewRule("java_library", "java/x", "x", map[string]interface{}{"javacopts": []string{"--release", "8"}, "tags": []string{"jadep_builtins=android-21"}}), "android-21"},
+		{bazel.NewRule("java_library", "java/x", "x", nil), ""},
+	}
+	for _, tt := range tests {
+		if got := keyOf(tt.rule); got != tt.want {
+			t.Errorf("RuleKeyWithReleases(%v) = %q, want %q", tt.rule, got, tt.want)
+		}
+	}
+}
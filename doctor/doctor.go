@@ -0,0 +1,221 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package doctor checks that Jadep's environment is set up correctly, and explains how to fix it when it isn't.
+package doctor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/cli"
+	"github.com/bazelbuild/tools_jvm_autodeps/pkgloading"
+)
+
+// Status is the outcome of a check.
+type Status string
+
+const (
+	// OK means the check passed.
+	OK Status = "OK"
+
+	// Warning means Jadep will work, but its results might be worse, e.g. because an optional data file is missing.
+	Warning Status = "WARNING"
+
+	// Error means Jadep won't work until the problem is fixed.
+	Error Status = "ERROR"
+)
+
+// Result is the result of a single check.
+type Result struct {
+	// Check names the check, e.g. "workspace".
+	Check string `json:"check"`
+
+	Status Status `json:"status"`
+
+	// Detail describes what was found.
+	Detail string `json:"detail,omitempty"`
+
+	// Remediation describes how to fix a check that didn't pass.
+	Remediation string `json:"remediation,omitempty"`
+}
+
+// Environment describes what Jadep would run with.
+type Environment struct {
+	// Workspace is the value of --workspace. When empty, the workspace is found from the working directory.
+	Workspace string
+
+	ContentRoots []string
+
+	BuiltinClassList string
+
+	BlacklistedPackageList string
+
+	// ConnectLoader connects to the PackageLoader service. It's only called if the workspace is found.
+	// The Loader it returns may implement Versioned.
+	ConnectLoader func(ctx context.Context, workspaceDir string) (pkgloading.Loader, func(), error)
+}
+
+// Versioned is implemented by Loaders that know the version of the server they're connected to.
+type Versioned interface {
+	Version(ctx context.Context) (string, error)
+}
+
+// Run checks env, and returns the results of all checks.
+// Checks that need the workspace are skipped if it isn't found.
+func Run(ctx context.Context, env Environment) []Result {
+	var ret []Result
+	workspaceDir, _, err := cli.Workspace(env.Workspace)
+	if err != nil {
+		ret = append(ret, Result{"workspace", Error, err.Error(), "Run Jadep inside a Bazel workspace, or pass --workspace=<directory containing a WORKSPACE file>"})
+	} else {
+		ret = append(ret, Result{Check: "workspace", Status: OK, Detail: workspaceDir})
+	}
+	ret = append(ret, checkDataFile("builtin_classlist", env.BuiltinClassList, Warning, "Without it, Jadep adds deps for JDK and Android classes. Run 'bazel build //:jdk_android_builtin_class_names' in Jadep's repository, and pass the file it generates as --builtin_classlist"))
+	ret = append(ret, checkDataFile("blacklisted_package_list", env.BlacklistedPackageList, Warning, "Without it, Jadep loads every package it needs, however slow. Pass --blacklisted_package_list=<file>, or create an empty one"))
+	if workspaceDir == "" {
+		return ret
+	}
+	ret = append(ret, checkContentRoots(workspaceDir, env.ContentRoots))
+	ret = append(ret, checkWritable(workspaceDir))
+	if env.ConnectLoader != nil {
+		ret = append(ret, checkLoader(ctx, workspaceDir, env.ConnectLoader)...)
+	}
+	return ret
+}
+
+// Failed returns true if any of results is an Error.
+func Failed(results []Result) bool {
+	for _, r := range results {
+		if r.Status == Error {
+			return true
+		}
+	}
+	return false
+}
+
+// Report writes results to w, one per line, each followed by how to fix it if it didn't pass.
+func Report(w io.Writer, results []Result) error {
+	for _, r := range results {
+		line := fmt.Sprintf("%-7s %s", r.Status, r.Check)
+		if r.Detail != "" {
+			line += ": " + r.Detail
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+		if r.Status != OK && r.Remediation != "" {
+			if _, err := fmt.Fprintf(w, "        To fix: %s\n", r.Remediation); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ReportJSON writes results to w as a JSON array, for tooling.
+func ReportJSON(w io.Writer, results []Result) error {
+	if results == nil {
+		results = []Result{}
+	}
+	b, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+// checkDataFile checks that fileName is a readable file.
+// failure is the status of the check when it isn't, and consequence explains why that matters and how to fix it.
+func checkDataFile(check, fileName string, failure Status, consequence string) Result {
+	if fileName == "" {
+		return Result{check, failure, "not set", consequence}
+	}
+	f, err := os.Open(fileName)
+	if err != nil {
+		return Result{check, failure, err.Error(), consequence}
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return Result{check, failure, err.Error(), consequence}
+	}
+	if info.IsDir() {
+		return Result{check, failure, fmt.Sprintf("%s is a directory", fileName), consequence}
+	}
+	return Result{Check: check, Status: OK, Detail: fileName}
+}
+
+// checkContentRoots checks that contentRoots exist in workspaceDir.
+// Some missing is a warning, since the default --content_roots lists roots that not every workspace has; all missing is an error.
+func checkContentRoots(workspaceDir string, contentRoots []string) Result {
+	const check = "content_roots"
+	var found, missing []string
+	for _, r := range contentRoots {
+		if info, err := os.Stat(filepath.Join(workspaceDir, r)); err == nil && info.IsDir() {
+			found = append(found, r)
+		} else {
+			missing = append(missing, r)
+		}
+	}
+	remediation := "Pass --content_roots=<comma-separated directories, relative to the workspace, where Java packages begin>"
+	switch {
+	case len(found) == 0:
+		return Result{check, Error, fmt.Sprintf("none of %v exist in %s", contentRoots, workspaceDir), remediation}
+	case len(missing) > 0:
+		return Result{check, Warning, fmt.Sprintf("%v don't exist in %s", missing, workspaceDir), remediation}
+	}
+	return Result{Check: check, Status: OK, Detail: strings.Join(found, ", ")}
+}
+
+// checkWritable checks that files can be created in workspaceDir, which Buildozer needs in order to edit BUILD files.
+func checkWritable(workspaceDir string) Result {
+	const check = "buildozer_edits"
+	f, err := ioutil.TempFile(workspaceDir, ".jadep-doctor")
+	if err != nil {
+		return Result{check, Error, err.Error(), fmt.Sprintf("Make %s writable, or pass --dry_run or --print_buildozer_commands to only print the edits", workspaceDir)}
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return Result{Check: check, Status: OK, Detail: fmt.Sprintf("%s is writable", workspaceDir)}
+}
+
+// checkLoader connects to the PackageLoader service, queries its version, and loads the root package of workspaceDir.
+func checkLoader(ctx context.Context, workspaceDir string, connect func(ctx context.Context, workspaceDir string) (pkgloading.Loader, func(), error)) []Result {
+	const check = "pkgloader"
+	loader, cleanup, err := connect(ctx, workspaceDir)
+	if err != nil {
+		return []Result{{check, Error, err.Error(), "Check --pkgloader_executable and --pkgloader_address. Jadep starts the server itself when the address is local"}}
+	}
+	defer cleanup()
+	var ret []Result
+	if v, ok := loader.(Versioned); ok {
+		version, err := v.Version(ctx)
+		if err != nil {
+			return []Result{{check, Error, err.Error(), "The server isn't answering. Kill it, and Jadep will start a new one"}}
+		}
+		ret = append(ret, Result{Check: "pkgloader_version", Status: OK, Detail: version})
+	}
+	if _, err := loader.Load(ctx, []string{""}); err != nil {
+		return append(ret, Result{check, Error, err.Error(), "Check that Bazel works in the workspace, and that --bazel_install_base and --bazel_output_base match 'bazel info'"})
+	}
+	return append(ret, Result{Check: check, Status: OK, Detail: "loaded the root package"})
+}
@@ -0,0 +1,241 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doctor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/pkgloading"
+	"github.com/google/go-cmp/cmp"
+)
+
+type fakeLoader struct {
+	version    string
+	versionErr error
+	loadErr    error
+}
+
+func (l *fakeLoader) Load(ctx context.Context, packages []string) (map[string]*bazel.Package, error) {
+	return nil, l.loadErr
+}
+
+func (l *fakeLoader) Version(ctx context.Context) (string, error) {
+	return l.version, l.versionErr
+}
+
+// unversionedLoader doesn't implement Versioned.
+type unversionedLoader struct{}
+
+func (unversionedLoader) Load(ctx context.Context, packages []string) (map[string]*bazel.Package, error) {
+	return nil, nil
+}
+
+func connect(loader pkgloading.Loader, err error) func(context.Context, string) (pkgloading.Loader, func(), error) {
+	return func(context.Context, string) (pkgloading.Loader, func(), error) {
+		return loader, func() {}, err
+	}
+}
+
+// statuses returns the status of each check in results.
+func statuses(results []Result) map[string]Status {
+	ret := make(map[string]Status)
+	for _, r := range results {
+		ret[r.Check] = r.Status
+	}
+	return ret
+}
+
+func TestRun(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	workspaceDir := filepath.Join(tmpDir, "ws")
+	for _, d := range []string{"src/main/java"} {
+		if err := os.MkdirAll(filepath.Join(workspaceDir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	classList := filepath.Join(tmpDir, "classes.txt")
+	for _, f := range []string{filepath.Join(workspaceDir, "WORKSPACE"), classList} {
+		if err := ioutil.WriteFile(f, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		desc string
+		env  Environment
+		want map[string]Status
+	}{
+		{
+			desc: "healthy",
+			env: Environment{
+				Workspace:              workspaceDir,
+				ContentRoots:           []string{"src/main/java"},
+				BuiltinClassList:       classList,
+				BlacklistedPackageList: classList,
+				ConnectLoader:          connect(&fakeLoader{version: "123"}, nil),
+			},
+			want: map[string]Status{
+				"workspace":                OK,
+				"builtin_classlist":        OK,
+				"blacklisted_package_list": OK,
+				"content_roots":            OK,
+				"buildozer_edits":          OK,
+				"pkgloader_version":        OK,
+				"pkgloader":                OK,
+			},
+		},
+		{
+			desc: "no workspace",
+			env: Environment{
+				Workspace:        tmpDir,
+				BuiltinClassList: classList,
+				ConnectLoader:    connect(&fakeLoader{}, nil),
+			},
+			want: map[string]Status{
+				"workspace":                Error,
+				"builtin_classlist":        OK,
+				"blacklisted_package_list": Warning,
+			},
+		},
+		{
+			desc: "missing data files and content roots",
+			env: Environment{
+				Workspace:              workspaceDir,
+				ContentRoots:           []string{"src/main/java", "src/test/java"},
+				BuiltinClassList:       filepath.Join(tmpDir, "nonexistent"),
+				BlacklistedPackageList: tmpDir,
+				ConnectLoader:          connect(unversionedLoader{}, nil),
+			},
+			want: map[string]Status{
+				"workspace":                OK,
+				"builtin_classlist":        Warning,
+				"blacklisted_package_list": Warning,
+				"content_roots":            Warning,
+				"buildozer_edits":          OK,
+				"pkgloader":                OK,
+			},
+		},
+		{
+			desc: "no content roots, and pkgloader unreachable",
+			env: Environment{
+				Workspace:     workspaceDir,
+				ContentRoots:  []string{"java"},
+				ConnectLoader: connect(nil, fmt.Errorf("connection refused")),
+			},
+			want: map[string]Status{
+				"workspace":                OK,
+				"builtin_classlist":        Warning,
+				"blacklisted_package_list": Warning,
+				"content_roots":            Error,
+				"buildozer_edits":          OK,
+				"pkgloader":                Error,
+			},
+		},
+		{
+			desc: "pkgloader doesn't answer",
+			env: Environment{
+				Workspace:        workspaceDir,
+				ContentRoots:     []string{"src/main/java"},
+				BuiltinClassList: classList,
+				ConnectLoader:    connect(&fakeLoader{versionErr: fmt.Errorf("deadline exceeded")}, nil),
+			},
+			want: map[string]Status{
+				"workspace":                OK,
+				"builtin_classlist":        OK,
+				"blacklisted_package_list": Warning,
+				"content_roots":            OK,
+				"buildozer_edits":          OK,
+				"pkgloader":                Error,
+			},
+		},
+		{
+			desc: "pkgloader fails to load",
+			env: Environment{
+				Workspace:        workspaceDir,
+				ContentRoots:     []string{"src/main/java"},
+				BuiltinClassList: classList,
+				ConnectLoader:    connect(&fakeLoader{version: "123", loadErr: fmt.Errorf("no such install base")}, nil),
+			},
+			want: map[string]Status{
+				"workspace":                OK,
+				"builtin_classlist":        OK,
+				"blacklisted_package_list": Warning,
+				"content_roots":            OK,
+				"buildozer_edits":          OK,
+				"pkgloader_version":        OK,
+				"pkgloader":                Error,
+			},
+		},
+	}
+	for _, tt := range tests {
+		results := Run(context.Background(), tt.env)
+		if diff := cmp.Diff(statuses(results), tt.want); diff != "" {
+			t.Errorf("%s: Run returned diff in statuses (-got +want):\n%s", tt.desc, diff)
+		}
+		wantFailed := false
+		for _, s := range tt.want {
+			wantFailed = wantFailed || s == Error
+		}
+		if got := Failed(results); got != wantFailed {
+			t.Errorf("%s: Failed returned %t, want %t", tt.desc, got, wantFailed)
+		}
+		for _, r := range results {
+			if r.Status != OK && r.Remediation == "" {
+				t.Errorf("%s: check %q has status %s but no remediation", tt.desc, r.Check, r.Status)
+			}
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+	results := []Result{
+		{Check: "workspace", Status: OK, Detail: "/ws"},
+		{Check: "content_roots", Status: Warning, Detail: "[java] don't exist in /ws", Remediation: "Pass --content_roots"},
+	}
+	var buf bytes.Buffer
+	if err := Report(&buf, results); err != nil {
+		t.Fatal(err)
+	}
+	want := "OK      workspace: /ws\n" +
+		"WARNING content_roots: [java] don't exist in /ws\n" +
+		"        To fix: Pass --content_roots\n"
+	if diff := cmp.Diff(buf.String(), want); diff != "" {
+		t.Errorf("Report wrote diff (-got +want):\n%s", diff)
+	}
+
+	buf.Reset()
+	if err := ReportJSON(&buf, results); err != nil {
+		t.Fatal(err)
+	}
+	var got []Result
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("ReportJSON wrote invalid JSON %q: %v", buf.String(), err)
+	}
+	if diff := cmp.Diff(got, results); diff != "" {
+		t.Errorf("ReportJSON round trip has diff (-got +want):\n%s", diff)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package editevents publishes the BUILD edits Jadep applies, so that automated changes can be audited.
+package editevents
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+)
+
+// Event describes the dependencies Jadep added to a single rule.
+type Event struct {
+	Time time.Time `json:"time"`
+
+	// Rule is the rule that was edited.
+	Rule bazel.Label `json:"rule"`
+
+	// AddedDeps are the labels that were added to Rule's deps.
+	AddedDeps []bazel.Label `json:"added_deps"`
+
+	// Reasons maps each label in AddedDeps to the class names it was added for.
+	Reasons map[bazel.Label][]jadeplib.ClassName `json:"reasons"`
+}
+
+// Sink publishes Events.
+type Sink interface {
+	Publish(ctx context.Context, events []Event) error
+}
+
+// FromAddedDeps returns an Event for each rule in addedDeps.
+// missingDeps is the result of jadeplib.MissingDeps that addedDeps were chosen from; it's used to fill out Event.Reasons.
+// Events are sorted by rule label.
+func FromAddedDeps(now time.Time, addedDeps map[*bazel.Rule][]bazel.Label, missingDeps map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label) []Event {
+	var ret []Event
+	for rule, labels := range addedDeps {
+		reasons := make(map[bazel.Label][]jadeplib.ClassName)
+		for _, l := range labels {
+			for cls, candidates := range missingDeps[rule] {
+				for _, c := range candidates {
+					if c == l {
+						reasons[l] = append(reasons[l], cls)
+						break
+					}
+				}
+			}
+			sort.Slice(reasons[l], func(i, j int) bool { return reasons[l][i] < reasons[l][j] })
+		}
+		ret = append(ret, Event{Time: now, Rule: rule.Label(), AddedDeps: labels, Reasons: reasons})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Rule < ret[j].Rule })
+	return ret
+}
+
+// WebhookSink publishes events by POSTing them as a JSON array to an HTTP endpoint.
+type WebhookSink struct {
+	URL    string
+	Client *http.Client
+}
+
+// Publish implements Sink.
+func (s *WebhookSink) Publish(ctx context.Context, events []Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("error publishing edit events to %s:\n%v", s.URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("error publishing edit events to %s: %s\n%s", s.URL, resp.Status, msg)
+	}
+	return nil
+}
+
+// StreamSink appends events to a file, one JSON object per line, in the style of Bazel's --build_event_json_file.
+// It can be tailed by a process that forwards the events to a Build Event Protocol service.
+type StreamSink struct {
+	FileName string
+
+	mu sync.Mutex // serializes writes to FileName
+}
+
+// Publish implements Sink.
+func (s *StreamSink) Publish(ctx context.Context, events []Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.FileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return fmt.Errorf("error opening edit event stream:\n%v", err)
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing edit events to %s:\n%v", s.FileName, err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,121 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package editevents
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+	"github.com/google/go-cmp/cmp"
+)
+
+var testTime = time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestFromAddedDeps(t *testing.T) {
+	foo := bazel.NewRule("java_library", "x", "Foo", nil)
+	bar := bazel.NewRule("java_library", "x", "Bar", nil)
+	addedDeps := map[*bazel.Rule][]bazel.Label{
+		foo: {"//y:A"},
+		bar: {"//y:B"},
+	}
+	missingDeps := map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label{
+		foo: {"com.A1": {"//y:A"}, "com.A2": {"//y:A2", "//y:A"}, "com.C": {"//y:C"}},
+		bar: {"com.B": {"//y:B"}},
+	}
+
+	got := FromAddedDeps(testTime, addedDeps, missingDeps)
+	want := []Event{
+		{Time: testTime, Rule: "//x:Bar", AddedDeps: []bazel.Label{"//y:B"}, Reasons: map[bazel.Label][]jadeplib.ClassName{"//y:B": {"com.B"}}},
+		{Time: testTime, Rule: "//x:Foo", AddedDeps: []bazel.Label{"//y:A"}, Reasons: map[bazel.Label][]jadeplib.ClassName{"//y:A": {"com.A1", "com.A2"}}},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("FromAddedDeps() diff (-got +want):\n%s", diff)
+	}
+}
+
+var testEvents = []Event{{Time: testTime, Rule: "//x:Foo", AddedDeps: []bazel.Label{"//y:A"}, Reasons: map[bazel.Label][]jadeplib.ClassName{"//y:A": {"com.A"}}}}
+
+func TestWebhookSink(t *testing.T) {
+	var got []Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("Error decoding request body: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	s := &WebhookSink{URL: server.URL}
+	if err := s.Publish(context.Background(), testEvents); err != nil {
+		t.Fatalf("Publish() has error %v, want nil", err)
+	}
+	if diff := cmp.Diff(got, testEvents); diff != "" {
+		t.Errorf("Webhook received diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestWebhookSinkError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	s := &WebhookSink{URL: server.URL}
+	if err := s.Publish(context.Background(), testEvents); err == nil {
+		t.Errorf("Publish() has nil error, want non-nil")
+	}
+}
+
+func TestStreamSink(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	s := &StreamSink{FileName: filepath.Join(tmpDir, "events.json")}
+	for i := 0; i < 2; i++ {
+		if err := s.Publish(context.Background(), testEvents); err != nil {
+			t.Fatalf("Publish() has error %v, want nil", err)
+		}
+	}
+
+	b, err := ioutil.ReadFile(s.FileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Stream has %d lines, want 2:\n%s", len(lines), b)
+	}
+	for _, l := range lines {
+		var got Event
+		if err := json.Unmarshal([]byte(l), &got); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(got, testEvents[0]); diff != "" {
+			t.Errorf("Stream event diff (-got +want):\n%s", diff)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package editplan records the deps a Jadep run would add to and remove from BUILD rules, instead of editing BUILD files.
+// This allows CI to run Jadep on shards of a large workspace in parallel (see Shard), and to apply the merged plans once.
+package editplan
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/buildozer"
+	"github.com/bazelbuild/tools_jvm_autodeps/filter"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+	"github.com/bazelbuild/tools_jvm_autodeps/pkgloading"
+)
+
+// Plan is a set of edits to the deps of rules.
+type Plan struct {
+	// Shard and ShardCount identify the slice of arguments the plan was computed for. ShardCount is 0 if the run
+	// wasn't sharded, or if the plan merges several shards.
+	Shard      int `json:"shard,omitempty"`
+	ShardCount int `json:"shard_count,omitempty"`
+
+	// Edits are sorted by rule, and there's at most one per rule.
+	Edits []*Edit `json:"edits"`
+}
+
+// Edit describes the deps to add to and remove from a rule.
+type Edit struct {
+	Rule bazel.Label `json:"rule"`
+
+	// AddDeps and RemoveDeps are sorted.
+	AddDeps    []bazel.Label `json:"add_deps,omitempty"`
+	RemoveDeps []bazel.Label `json:"remove_deps,omitempty"`
+
+	// RemoveFrom maps attributes of the rule to the labels of RemoveDeps to remove from them, sorted.
+	// RemoveDeps that it doesn't list are removed from the attribute that deps are added to.
+	RemoveFrom map[string][]bazel.Label `json:"remove_from,omitempty"`
+
+	// Classes maps the class names that AddDeps were chosen for to the dep chosen for each.
+	Classes map[jadeplib.ClassName]bazel.Label `json:"classes,omitempty"`
+}
+
+// Conflict describes edits of different plans that can't both be applied to a rule.
+type Conflict struct {
+	Rule   bazel.Label
+	Reason string
+}
+
+func (c Conflict) String() string {
+	return fmt.Sprintf("%s: %s", c.Rule, c.Reason)
+}
+
+// Shard returns the arguments that belong to shard index out of count. Each argument belongs to exactly one shard,
+// chosen by a hash of the argument, so shards are stable across machines and don't depend on the order of args.
+func Shard(args []string, index, count int) []string {
+	var ret []string
+	for _, a := range args {
+		h := fnv.New32a()
+		h.Write([]byte(a))
+		if int(h.Sum32()%uint32(count)) == index {
+			ret = append(ret, a)
+		}
+	}
+	return ret
+}
+
+// AddDeps records adding depsToAdd to their rules. missingDepsMap is what depsToAdd were chosen from, and records
+// which classes each dep was chosen for.
+func (p *Plan) AddDeps(depsToAdd map[*bazel.Rule][]bazel.Label, missingDepsMap map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label) {
+	for rule, deps := range depsToAdd {
+		e := p.edit(rule.Label())
+		e.AddDeps = addLabels(e.AddDeps, deps)
+		added := make(map[bazel.Label]bool)
+		for _, d := range deps {
+			added[d] = true
+		}
+		for cls, candidates := range missingDepsMap[rule] {
+			for _, c := range candidates {
+				if added[c] {
+					if e.Classes == nil {
+						e.Classes = make(map[jadeplib.ClassName]bazel.Label)
+					}
+					e.Classes[cls] = c
+					break
+				}
+			}
+		}
+	}
+}
+
+// RemoveDeps records removing deps from the attributes of their rules they're mapped to.
+func (p *Plan) RemoveDeps(deps map[*bazel.Rule]map[string][]bazel.Label) {
+	for rule, attrs := range deps {
+		e := p.edit(rule.Label())
+		e.removeFrom(attrs)
+	}
+}
+
+// removeFrom adds the labels of attrs to e.RemoveDeps and e.RemoveFrom.
+func (e *Edit) removeFrom(attrs map[string][]bazel.Label) {
+	for attr, labels := range attrs {
+		if len(labels) == 0 {
+			continue
+		}
+		if e.RemoveFrom == nil {
+			e.RemoveFrom = make(map[string][]bazel.Label)
+		}
+		e.RemoveFrom[attr] = addLabels(e.RemoveFrom[attr], labels)
+		e.RemoveDeps = addLabels(e.RemoveDeps, labels)
+	}
+}
+
+// edit returns the edit of rule, adding one if needed.
+func (p *Plan) edit(rule bazel.Label) *Edit {
+	i := sort.Search(len(p.Edits), func(i int) bool { return p.Edits[i].Rule >= rule })
+	if i < len(p.Edits) && p.Edits[i].Rule == rule {
+		return p.Edits[i]
+	}
+	e := &Edit{Rule: rule}
+	p.Edits = append(p.Edits, nil)
+	copy(p.Edits[i+1:], p.Edits[i:])
+	p.Edits[i] = e
+	return e
+}
+
+// addLabels returns the sorted union of labels and toAdd, where labels is sorted.
+func addLabels(labels []bazel.Label, toAdd []bazel.Label) []bazel.Label {
+	set := make(map[bazel.Label]bool)
+	for _, l := range labels {
+		set[l] = true
+	}
+	for _, l := range toAdd {
+		if !set[l] {
+			set[l] = true
+			labels = append(labels, l)
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i] < labels[j] })
+	return labels
+}
+
+// Merge combines plans into one. The edits of rules that conflict are left out of the result, and returned as conflicts:
+// edits conflict if one plan adds a dep that another removes, or if plans add different deps for the same class.
+// Returns an error if plans are shards of differently-sharded runs, or if two of them are the same shard.
+func Merge(plans []*Plan) (*Plan, []Conflict, error) {
+	shards := make(map[int]bool)
+	shardCount := 0
+	for _, p := range plans {
+		if p.ShardCount == 0 {
+			continue
+		}
+		if shardCount != 0 && p.ShardCount != shardCount {
+			return nil, nil, fmt.Errorf("plans are shards of different runs: shard count %d and %d", shardCount, p.ShardCount)
+		}
+		shardCount = p.ShardCount
+		if shards[p.Shard] {
+			return nil, nil, fmt.Errorf("more than one plan is shard %d", p.Shard)
+		}
+		shards[p.Shard] = true
+	}
+
+	merged := &Plan{}
+	conflicting := make(map[bazel.Label][]string)
+	for _, p := range plans {
+		for _, e := range p.Edits {
+			m := merged.edit(e.Rule)
+			for cls, dep := range e.Classes {
+				if prev, ok := m.Classes[cls]; ok && prev != dep {
+					conflicting[e.Rule] = append(conflicting[e.Rule], fmt.Sprintf("%s is provided by %s in one plan and by %s in another", cls, prev, dep))
+					continue
+				}
+				if m.Classes == nil {
+					m.Classes = make(map[jadeplib.ClassName]bazel.Label)
+				}
+				m.Classes[cls] = dep
+			}
+			m.AddDeps = addLabels(m.AddDeps, e.AddDeps)
+			m.RemoveDeps = addLabels(m.RemoveDeps, e.RemoveDeps)
+			m.removeFrom(e.RemoveFrom)
+		}
+	}
+	var conflicts []Conflict
+	var edits []*Edit
+	for _, m := range merged.Edits {
+		reasons := conflicting[m.Rule]
+		for _, l := range intersection(m.AddDeps, m.RemoveDeps) {
+			reasons = append(reasons, fmt.Sprintf("%s is added by one plan and removed by another", l))
+		}
+		if len(reasons) == 0 {
+			edits = append(edits, m)
+			continue
+		}
+		sort.Strings(reasons)
+		for _, r := range reasons {
+			conflicts = append(conflicts, Conflict{Rule: m.Rule, Reason: r})
+		}
+	}
+	merged.Edits = edits
+	return merged, conflicts, nil
+}
+
+func intersection(a, b []bazel.Label) []bazel.Label {
+	set := make(map[bazel.Label]bool)
+	for _, l := range a {
+		set[l] = true
+	}
+	var ret []bazel.Label
+	for _, l := range b {
+		if set[l] {
+			ret = append(ret, l)
+		}
+	}
+	return ret
+}
+
+// Apply edits the BUILD files in workspaceDir according to p, loading the rules to edit with loader.
+// Deps are removed before others are added. The edits of rules that don't exist are skipped, and returned in an error
+// after the other edits are applied.
+func (p *Plan) Apply(ctx context.Context, loader pkgloading.Loader, workspaceDir string) error {
+	var labels []bazel.Label
+	for _, e := range p.Edits {
+		labels = append(labels, e.Rule)
+	}
+	rules, _, err := pkgloading.LoadRules(ctx, loader, labels)
+	if err != nil {
+		return fmt.Errorf("error loading rules to edit:\n%v", err)
+	}
+	toAdd := make(map[*bazel.Rule][]bazel.Label)
+	toRemove := make(map[*bazel.Rule]map[string][]bazel.Label)
+	var missing []string
+	for _, e := range p.Edits {
+		rule := rules[e.Rule]
+		if rule == nil {
+			missing = append(missing, string(e.Rule))
+			continue
+		}
+		if len(e.AddDeps) > 0 {
+			toAdd[rule] = e.AddDeps
+		}
+		if len(e.RemoveDeps) > 0 {
+			toRemove[rule] = e.removals(rule)
+		}
+	}
+	if err := buildozer.RemoveDepsFromAttributes(workspaceDir, toRemove); err != nil {
+		return err
+	}
+	if err := buildozer.AddDepsToRules(workspaceDir, toAdd); err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("rules to edit don't exist, so their edits weren't applied: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// removals returns the labels of e.RemoveDeps by the attribute of rule to remove them from.
+func (e *Edit) removals(rule *bazel.Rule) map[string][]bazel.Label {
+	ret := make(map[string][]bazel.Label)
+	listed := make(map[bazel.Label]bool)
+	for attr, labels := range e.RemoveFrom {
+		ret[attr] = labels
+		for _, l := range labels {
+			listed[l] = true
+		}
+	}
+	attr := filter.DepsAttribute(rule)
+	for _, l := range e.RemoveDeps {
+		if !listed[l] {
+			ret[attr] = append(ret[attr], l)
+		}
+	}
+	return ret
+}
+
+// Load reads a Plan from fileName.
+func Load(fileName string) (*Plan, error) {
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("error reading edit plan from %s:\n%v", fileName, err)
+	}
+	p := &Plan{}
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, fmt.Errorf("error parsing edit plan from %s:\n%v", fileName, err)
+	}
+	sort.Slice(p.Edits, func(i, j int) bool { return p.Edits[i].Rule < p.Edits[j].Rule })
+	return p, nil
+}
+
+// Save writes p to fileName, creating directories as needed.
+func (p *Plan) Save(fileName string) error {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return fmt.Errorf("error saving edit plan to %s:\n%v", fileName, err)
+	}
+	if err := ioutil.WriteFile(fileName, append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("error saving edit plan to %s:\n%v", fileName, err)
+	}
+	return nil
+}
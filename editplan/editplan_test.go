@@ -0,0 +1,219 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package editplan
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+	"github.com/bazelbuild/tools_jvm_autodeps/loadertest"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestShard(t *testing.T) {
+	var args []string
+	for i := 0; i < 100; i++ {
+		args = append(args, fmt.Sprintf("java/com/foo/Foo%d.java", i))
+	}
+	inTail := make(map[string]bool)
+	for _, a := range args[50:] {
+		inTail[a] = true
+	}
+	seen := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		shard := Shard(args, i, 4)
+		if len(shard) == 0 || len(shard) == len(args) {
+			t.Errorf("Shard(%d, 4) has %d of %d args, want some but not all", i, len(shard), len(args))
+		}
+		var wantTail []string
+		for _, a := range shard {
+			seen[a]++
+			if inTail[a] {
+				wantTail = append(wantTail, a)
+			}
+		}
+		// Whether an arg belongs to a shard doesn't depend on the other args.
+		if diff := cmp.Diff(Shard(args[50:], i, 4), wantTail); diff != "" {
+			t.Errorf("Shard(%d, 4) of the last args returned diff (-got +want):\n%s", i, diff)
+		}
+	}
+	for _, a := range args {
+		if seen[a] != 1 {
+			t.Errorf("%s is in %d shards, want 1", a, seen[a])
+		}
+	}
+}
+
+func TestAddAndRemoveDeps(t *testing.T) {
+	foo := bazel.NewRule("java_library", "x", "foo", nil)
+	bar := bazel.NewRule("java_library", "a", "bar", nil)
+	p := &Plan{}
+	p.AddDeps(
+		map[*bazel.Rule][]bazel.Label{foo: {"//d:d2", "//d:d1"}},
+		map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label{foo: {"com.D1": {"//d:d1"}, "com.D2": {"//d:d3", "//d:d2"}, "com.Skipped": {"//d:d4"}}})
+	p.AddDeps(map[*bazel.Rule][]bazel.Label{bar: {"//d:d1"}, foo: {"//d:d1"}}, nil)
+	p.RemoveDeps(map[*bazel.Rule]map[string][]bazel.Label{foo: {"exports": {"//d:gone"}}})
+
+	want := &Plan{Edits: []*Edit{
+		{Rule: "//a:bar", AddDeps: []bazel.Label{"//d:d1"}},
+		{
+			Rule:       "//x:foo",
+			AddDeps:    []bazel.Label{"//d:d1", "//d:d2"},
+			RemoveDeps: []bazel.Label{"//d:gone"},
+			RemoveFrom: map[string][]bazel.Label{"exports": {"//d:gone"}},
+			Classes:    map[jadeplib.ClassName]bazel.Label{"com.D1": "//d:d1", "com.D2": "//d:d2"},
+		},
+	}}
+	if diff := cmp.Diff(p, want); diff != "" {
+		t.Errorf("Plan has diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		desc          string
+		plans         []*Plan
+		want          *Plan
+		wantConflicts []Conflict
+		wantErr       bool
+	}{
+		{
+			desc: "edits of the same rule are combined",
+			plans: []*Plan{
+				{Shard: 0, ShardCount: 2, Edits: []*Edit{
+					{Rule: "//x:foo", AddDeps: []bazel.Label{"//d:d2"}, Classes: map[jadeplib.ClassName]bazel.Label{"com.D2": "//d:d2"}},
+				}},
+				{Shard: 1, ShardCount: 2, Edits: []*Edit{
+					{Rule: "//a:bar", RemoveDeps: []bazel.Label{"//d:gone"}},
+					{Rule: "//x:foo", AddDeps: []bazel.Label{"//d:d1", "//d:d2"}, Classes: map[jadeplib.ClassName]bazel.Label{"com.D1": "//d:d1", "com.D2": "//d:d2"}},
+				}},
+			},
+			want: &Plan{Edits: []*Edit{
+				{Rule: "//a:bar", RemoveDeps: []bazel.Label{"//d:gone"}},
+				{Rule: "//x:foo", AddDeps: []bazel.Label{"//d:d1", "//d:d2"}, Classes: map[jadeplib.ClassName]bazel.Label{"com.D1": "//d:d1", "com.D2": "//d:d2"}},
+			}},
+		},
+		{
+			desc: "rules with conflicting edits are left out",
+			plans: []*Plan{
+				{Edits: []*Edit{
+					{Rule: "//a:bar", AddDeps: []bazel.Label{"//d:d1"}},
+					{Rule: "//x:foo", AddDeps: []bazel.Label{"//d:d1"}, Classes: map[jadeplib.ClassName]bazel.Label{"com.D": "//d:d1"}},
+					{Rule: "//y:ok", AddDeps: []bazel.Label{"//d:d1"}},
+				}},
+				{Edits: []*Edit{
+					{Rule: "//a:bar", RemoveDeps: []bazel.Label{"//d:d1"}},
+					{Rule: "//x:foo", AddDeps: []bazel.Label{"//d:d2"}, Classes: map[jadeplib.ClassName]bazel.Label{"com.D": "//d:d2"}},
+				}},
+			},
+			want: &Plan{Edits: []*Edit{
+				{Rule: "//y:ok", AddDeps: []bazel.Label{"//d:d1"}},
+			}},
+			wantConflicts: []Conflict{
+				{Rule: "//a:bar", Reason: "//d:d1 is added by one plan and removed by another"},
+				{Rule: "//x:foo", Reason: "com.D is provided by //d:d1 in one plan and by //d:d2 in another"},
+			},
+		},
+		{
+			desc:    "shards of different runs",
+			plans:   []*Plan{{Shard: 0, ShardCount: 2}, {Shard: 1, ShardCount: 3}},
+			wantErr: true,
+		},
+		{
+			desc:    "the same shard twice",
+			plans:   []*Plan{{Shard: 1, ShardCount: 2}, {Shard: 1, ShardCount: 2}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		got, conflicts, err := Merge(tt.plans)
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("%s: Merge() returned error %v, want error: %t", tt.desc, err, tt.wantErr)
+			continue
+		}
+		if diff := cmp.Diff(got, tt.want); diff != "" {
+			t.Errorf("%s: Merge() returned diff in plan (-got +want):\n%s", tt.desc, diff)
+		}
+		if diff := cmp.Diff(conflicts, tt.wantConflicts); diff != "" {
+			t.Errorf("%s: Merge() returned diff in conflicts (-got +want):\n%s", tt.desc, diff)
+		}
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	fileName := filepath.Join(tmpDir, "sub", "plan.json")
+
+	p := &Plan{Shard: 1, ShardCount: 3, Edits: []*Edit{
+		{Rule: "//x:foo", AddDeps: []bazel.Label{"//d:d1"}, RemoveDeps: []bazel.Label{"//d:gone"}, Classes: map[jadeplib.ClassName]bazel.Label{"com.D1": "//d:d1"}},
+	}}
+	if err := p.Save(fileName); err != nil {
+		t.Fatalf("Save() has error %v, want nil", err)
+	}
+	got, err := Load(fileName)
+	if err != nil {
+		t.Fatalf("Load() has error %v, want nil", err)
+	}
+	if diff := cmp.Diff(got, p); diff != "" {
+		t.Errorf("Load() of saved plan returned diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestApplySkipsMissingRules(t *testing.T) {
+	workspaceDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workspaceDir)
+	if err := os.MkdirAll(filepath.Join(workspaceDir, "x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(workspaceDir, "WORKSPACE"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(workspaceDir, "x/BUILD"), []byte("java_library(name = \"foo\")\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loader := &loadertest.StubLoader{Pkgs: map[string]*bazel.Package{
+		"x": {Rules: map[string]*bazel.Rule{"foo": bazel.NewRule("java_library", "x", "foo", nil)}},
+	}}
+	p := &Plan{Edits: []*Edit{
+		{Rule: "//x:foo", AddDeps: []bazel.Label{"//d:d1"}},
+		{Rule: "//x:new", AddDeps: []bazel.Label{"//d:d2"}},
+	}}
+
+	err = p.Apply(context.Background(), loader, workspaceDir)
+	if err == nil || !strings.Contains(err.Error(), "//x:new") {
+		t.Errorf("Apply() returned error %v, want one naming //x:new", err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(workspaceDir, "x/BUILD"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "//d:d1") {
+		t.Errorf("Apply() didn't apply the edit of the existing rule //x:foo; BUILD is\n%s", b)
+	}
+}
@@ -17,6 +17,7 @@ package filter
 
 import (
 	"fmt"
+	"regexp"
 	"strings"
 
 	"context"
@@ -79,26 +80,192 @@ var RuleKindsToLoad = map[string]bool{
 	"proto_library":              true,
 }
 
-// IsValidDependency returns false if dep should not be used as a dependency.
-// It only relies on information inside the rule itself (e.g., kind, tags).
+// UmbrellaTags lists the tags that mark a rule as an umbrella target, i.e., one that re-exports an API surface.
+// Missing dependencies of umbrella targets are added to their 'exports' attribute rather than to their deps.
+var UmbrellaTags = map[string]bool{}
+
+// UmbrellaNamePattern, when not nil, marks rules whose names match it as umbrella targets.
+var UmbrellaNamePattern *regexp.Regexp
+
+// exportingRuleKinds lists the kinds of rules that have an 'exports' attribute.
+var exportingRuleKinds = map[string]bool{
+	"android_library": true,
+	"java_import":     true,
+	"java_library":    true,
+}
+
+// IsProcessorScope returns true if rule can be used by an annotation processor, i.e. by a java_plugin.
+// Annotation processors run inside javac, so Android libraries and neverlink libraries, which aren't available at runtime, can't be used.
+func IsProcessorScope(rule *bazel.Rule) bool {
+	return !strings.HasPrefix(rule.Schema, "android_") && !rule.BoolAttr("neverlink", false)
+}
+
+// IsUmbrella returns true if rule is an umbrella target, according to UmbrellaTags and UmbrellaNamePattern.
+// Only rules whose kind has an 'exports' attribute can be umbrella targets.
+func IsUmbrella(rule *bazel.Rule) bool {
+	if !exportingRuleKinds[rule.Schema] {
+		return false
+	}
+	for _, tag := range rule.StringListAttr("tags") {
+		if UmbrellaTags[tag] {
+			return true
+		}
+	}
+	_, name := rule.Label().Split()
+	return UmbrellaNamePattern != nil && UmbrellaNamePattern.MatchString(name)
+}
+
+// DepsAttributeByKind maps a rule kind to the attribute that Jadep adds the deps of rules of that kind to, e.g. "associates".
+// Kinds that are absent from the map have their deps added to "deps".
+// For rules instantiated by a macro, the macro's name takes precedence over the kind of the rule it generates.
+var DepsAttributeByKind = map[string]string{}
+
+// DepsAttribute returns the attribute that Jadep adds the deps of rule to, according to DepsAttributeByKind.
+// Umbrella targets (see IsUmbrella) re-export their deps, so their 'exports' attribute is returned.
+func DepsAttribute(rule *bazel.Rule) string {
+	if IsUmbrella(rule) {
+		return "exports"
+	}
+	if macro, ok := rule.Attrs["generator_function"].(string); ok {
+		if attr, ok := DepsAttributeByKind[macro]; ok {
+			return attr
+		}
+	}
+	if attr, ok := DepsAttributeByKind[rule.Schema]; ok {
+		return attr
+	}
+	return "deps"
+}
+
+// APITags lists the tags that mark a rule as an API target, i.e. one that consumers should depend on rather than on the
+// implementation libraries it exports. API targets are typically java_library rules with no srcs, only exports.
+// Jadep prefers them over the other candidates that provide a class.
+var APITags = map[string]bool{}
+
+// IsAPITarget returns true if rule is an API target, according to APITags.
+// Only rules whose kind has an 'exports' attribute can be API targets.
+func IsAPITarget(rule *bazel.Rule) bool {
+	if !exportingRuleKinds[rule.Schema] {
+		return false
+	}
+	for _, tag := range rule.StringListAttr("tags") {
+		if APITags[tag] {
+			return true
+		}
+	}
+	return false
+}
+
+// LabelBlacklist lists regular expressions matching labels that are never suggested as dependencies, e.g. ".*:testdata".
+// Use CompileLabelBlacklist to create regular expressions that must match whole labels.
+var LabelBlacklist []*regexp.Regexp
+
+// CompileLabelBlacklist compiles comma-separated patterns, e.g. ".*:testdata,//experimental/.*", into regular expressions
+// that match whole labels.
+func CompileLabelBlacklist(patterns string) ([]*regexp.Regexp, error) {
+	var ret []*regexp.Regexp
+	for _, p := range strings.Split(patterns, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		re, err := regexp.Compile("^(?:" + p + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("error parsing label blacklist pattern %q:\n%v", p, err)
+		}
+		ret = append(ret, re)
+	}
+	return ret, nil
+}
+
+// defaultEnvironment stands for the environments a rule supports when it doesn't set 'restricted_to'.
+const defaultEnvironment = "<default environments>"
+
+// IsValidDependency returns false if dep should not be used as a dependency of consumingRule.
+// It only relies on information inside the rules themselves (e.g., kind, tags, testonly, constraints).
 // For visibility tests, see CheckVisibility().
-func IsValidDependency(dep *bazel.Rule) bool {
+func IsValidDependency(consumingRule, dep *bazel.Rule) bool {
+	return InvalidDependencyReason(consumingRule, dep) == ""
+}
+
+// InvalidDependencyReason explains why IsValidDependency(consumingRule, dep) returns false.
+// It returns "" if dep is a valid dependency of consumingRule.
+// To decide whether dep would break the configuration of consumingRule, it reads compatible_with, restricted_to,
+// target_compatible_with and testonly, which a PackageLoader server must serialize even when they're not explicitly set
+// in a BUILD file (see Serializer.java).
+func InvalidDependencyReason(consumingRule, dep *bazel.Rule) string {
 	if !JavaDependencyRuleKinds[dep.Schema] {
-		return false
+		return fmt.Sprintf("rules of kind %s can't be dependencies of Java rules", dep.Schema)
+	}
+
+	for _, re := range LabelBlacklist {
+		if re.MatchString(string(dep.Label())) {
+			return fmt.Sprintf("matches label blacklist pattern %q", strings.TrimSuffix(strings.TrimPrefix(re.String(), "^(?:"), ")$"))
+		}
 	}
 
 	tags := dep.StringListAttr("tags")
 	for _, tag := range tags {
 		if tag == "avoid_dep" {
-			return false
+			return "tagged avoid_dep"
 		}
 	}
 
-	_, ok := dep.Attrs["deprecation"].(string)
+	deprecation, ok := dep.Attrs["deprecation"].(string)
 	if ok {
-		return false
+		return fmt.Sprintf("deprecated: %q", deprecation)
+	}
+
+	if isTestOnly(dep) && !isTestOnly(consumingRule) {
+		return fmt.Sprintf("testonly, but %s isn't", consumingRule.Label())
 	}
 
+	if !isSubset(environments(consumingRule), environments(dep)) {
+		return fmt.Sprintf("doesn't support all environments of %s", consumingRule.Label())
+	}
+
+	// The consuming rule is only built on platforms satisfying its target_compatible_with, so dep may require
+	// those constraints, but no others.
+	if !isSubset(labelSet(dep.LabelListAttr("target_compatible_with")), labelSet(consumingRule.LabelListAttr("target_compatible_with"))) {
+		return fmt.Sprintf("requires platform constraints that %s doesn't", consumingRule.Label())
+	}
+
+	return ""
+}
+
+// isTestOnly returns true if rule may only be depended on by testonly rules.
+// Test rules are implicitly testonly.
+func isTestOnly(rule *bazel.Rule) bool {
+	return rule.BoolAttr("testonly", strings.HasSuffix(rule.Schema, "_test"))
+}
+
+// environments returns the set of constraint environments a rule supports, according to its 'restricted_to' and 'compatible_with' attributes.
+// A rule that doesn't set 'restricted_to' supports the default environments, represented by defaultEnvironment.
+func environments(rule *bazel.Rule) map[bazel.Label]bool {
+	ret := labelSet(rule.LabelListAttr("restricted_to"))
+	if len(ret) == 0 {
+		ret[defaultEnvironment] = true
+	}
+	for _, l := range rule.LabelListAttr("compatible_with") {
+		ret[l] = true
+	}
+	return ret
+}
+
+func labelSet(labels []bazel.Label) map[bazel.Label]bool {
+	ret := make(map[bazel.Label]bool)
+	for _, l := range labels {
+		ret[l] = true
+	}
+	return ret
+}
+
+// isSubset returns true if every element of a is also in b.
+func isSubset(a, b map[bazel.Label]bool) bool {
+	for l := range a {
+		if !b[l] {
+			return false
+		}
+	}
 	return true
 }
 
@@ -112,6 +279,7 @@ type VisQuery struct {
 // It computes the answer for multiple queries with the minimal amount of package loads possible.
 // We assume the loader is a CachingLoader for performance.
 // The result satisfies result[R, P]==true iff rule R is visibile to package P.
+// If ctx is cancelled, CheckVisibility stops loading package_group()s and returns ctx.Err().
 func CheckVisibility(ctx context.Context, loader pkgloading.Loader, query map[VisQuery]bool) (map[VisQuery]bool, error) {
 	ctx, endSpan := compat.NewLocalSpan(ctx, "Jade: CheckVisibility")
 	defer endSpan()
@@ -136,6 +304,9 @@ func CheckVisibility(ctx context.Context, loader pkgloading.Loader, query map[Vi
 	// Unlike in classical BFS, each layer is handled together to make a minimal number of BUILD package loads.
 	// Whenever we can satisfy a query, we stop walking all nodes that originated from that query (newlyDecided below).
 	for len(nodes) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		pkgGroups, err := pkgloading.LoadPackageGroups(ctx, loader, labels(nodes))
 		if err != nil {
 			return nil, fmt.Errorf("Error loading package_group()s %v:\n%v", labels(nodes), err)
@@ -154,6 +325,13 @@ func CheckVisibility(ctx context.Context, loader pkgloading.Loader, query map[Vi
 					ret[vq] = true
 				case unknown:
 					for _, inc := range pg.Includes {
+						switch constantVisibility(inc) {
+						case yes:
+							ret[vq] = true
+							continue
+						case no:
+							continue
+						}
 						if !visited[vq][inc] {
 							if visited[vq] == nil {
 								visited[vq] = make(map[bazel.Label]bool)
@@ -176,6 +354,70 @@ func CheckVisibility(ctx context.Context, loader pkgloading.Loader, query map[Vi
 	return ret, nil
 }
 
+// VisibilityPath explains whether rule is visible to the package pkgName.
+// If the visibility is granted by a package_group(), path lists the package_group()s leading to it,
+// starting with the one in rule's visibility attribute. Otherwise, path lists all package_group()s that were examined.
+// Unlike CheckVisibility, package_group()s are loaded one at a time, so it is meant for diagnostics rather than bulk queries.
+func VisibilityPath(ctx context.Context, loader pkgloading.Loader, rule *bazel.Rule, pkgName string) (visible bool, path []bazel.Label, err error) {
+	switch localVisibleTo(rule, pkgName) {
+	case yes:
+		return true, nil, nil
+	case no:
+		return false, nil, nil
+	}
+
+	visited := make(map[bazel.Label]bool)
+	var examined []bazel.Label
+	var walk func(pkgGroupLabel bazel.Label, path []bazel.Label) ([]bazel.Label, error)
+	walk = func(pkgGroupLabel bazel.Label, path []bazel.Label) ([]bazel.Label, error) {
+		if visited[pkgGroupLabel] {
+			return nil, nil
+		}
+		visited[pkgGroupLabel] = true
+		examined = append(examined, pkgGroupLabel)
+		path = append(path, pkgGroupLabel)
+		pkgGroups, err := pkgloading.LoadPackageGroups(ctx, loader, []bazel.Label{pkgGroupLabel})
+		if err != nil {
+			return nil, fmt.Errorf("Error loading package_group() %s:\n%v", pkgGroupLabel, err)
+		}
+		pg := pkgGroups[pkgGroupLabel]
+		if pg == nil {
+			return nil, nil
+		}
+		if specVisibleTo(pg.Specs, pkgName) == yes {
+			return path, nil
+		}
+		for _, inc := range pg.Includes {
+			switch constantVisibility(inc) {
+			case yes:
+				return append(path, inc), nil
+			case no:
+				continue
+			}
+			granting, err := walk(inc, path)
+			if granting != nil || err != nil {
+				return granting, err
+			}
+		}
+		return nil, nil
+	}
+
+	for _, v := range rule.LabelListAttr("visibility") {
+		_, visName := v.Split()
+		if visName == pkgVisibilityName || visName == subpackagesVisibilityName || constantVisibility(v) != unknown {
+			continue
+		}
+		granting, err := walk(v, nil)
+		if err != nil {
+			return false, nil, err
+		}
+		if granting != nil {
+			return true, granting, nil
+		}
+	}
+	return false, examined, nil
+}
+
 // tri represents a tri-state: true, false or unknown.
 type tri int
 
@@ -186,9 +428,10 @@ const (
 )
 
 // localVisibleTo checks whether dep is visible to consPkgName without loading BUILD packages.
-// It only considers individual entries in dep's visiblity attribute.
+// It evaluates all the entries in dep's visiblity attribute that don't need loading, i.e. everything but package_group()s.
 // It returns 'yes' if it's certain dep is visible from consPkgName (e.g., it's //visibility:public),
-// 'no' when it isn't (e.g. //visibility:private), and 'unknown' otherwise.
+// 'no' when it isn't (e.g. //visibility:private, or only __pkg__ entries of other packages),
+// and 'unknown' when only the package_group()s in the visibility attribute can tell.
 func localVisibleTo(dep *bazel.Rule, consPkgName string) tri {
 	// Google-specific:
 	if consPkgName == dep.PkgName ||
@@ -197,26 +440,42 @@ func localVisibleTo(dep *bazel.Rule, consPkgName string) tri {
 		return yes
 	}
 
-	vis := dep.LabelListAttr("visibility")
-	if len(vis) == 0 {
-		return no
-	}
-	for _, v := range vis {
-		if v == "//visibility:public" || v == "//visibility:legacy_public" {
+	ret := no
+	for _, v := range dep.LabelListAttr("visibility") {
+		switch constantVisibility(v) {
+		case yes:
 			return yes
-		}
-		if v == "//visibility:private" {
-			return no
+		case no:
+			continue
 		}
 		visPkgName, visName := v.Split()
-		if visName == pkgVisibilityName && visPkgName == consPkgName {
-			return yes
-		}
-		if visName == subpackagesVisibilityName && subPackageOf(consPkgName, visPkgName) {
-			return yes
+		switch visName {
+		case pkgVisibilityName:
+			if visPkgName == consPkgName {
+				return yes
+			}
+		case subpackagesVisibilityName:
+			if subPackageOf(consPkgName, visPkgName) {
+				return yes
+			}
+		default:
+			// A package_group(), which must be loaded.
+			ret = unknown
 		}
 	}
+	return ret
+}
 
+// constantVisibility returns 'yes' for //visibility:public and //visibility:legacy_public, 'no' for //visibility:private,
+// and 'unknown' for any other label.
+// These labels can appear both in visibility attributes and in the includes of package_group()s, and are never loaded.
+func constantVisibility(l bazel.Label) tri {
+	switch l {
+	case "//visibility:public", "//visibility:legacy_public":
+		return yes
+	case "//visibility:private":
+		return no
+	}
 	return unknown
 }
 
@@ -225,7 +484,8 @@ func localVisibleTo(dep *bazel.Rule, consPkgName string) tri {
 // Reminder: the values for 'specs' are detailed in bazel.PackageGroup.Specs in bazel/bazel.go.
 func specVisibleTo(specs []string, consPkgName string) tri {
 	for _, spec := range specs {
-		if spec == "//..." || spec == consPkgName {
+		// "public" and "private" are constants that newer versions of Bazel accept in package_group's packages.
+		if spec == "//..." || spec == "public" || spec == consPkgName {
 			return yes
 		}
 		wildcard := strings.LastIndex(spec, "/...")
@@ -246,7 +506,7 @@ func pkgGroupsInVisibility(query map[VisQuery]bool, visited map[VisQuery]map[baz
 		vis := vq.Rule.LabelListAttr("visibility")
 		for _, pkgGroupLabel := range vis {
 			_, visName := pkgGroupLabel.Split()
-			if visName == pkgVisibilityName || visName == subpackagesVisibilityName {
+			if visName == pkgVisibilityName || visName == subpackagesVisibilityName || constantVisibility(pkgGroupLabel) != unknown {
 				continue
 			}
 			if !visited[vq][pkgGroupLabel] {
@@ -15,6 +15,7 @@
 package filter
 
 import (
+	"regexp"
 	"testing"
 
 	"context"
@@ -33,41 +34,225 @@ var equateErrorMessage = cmp.Comparer(func(x, y error) bool {
 func TestIsValidDependency(t *testing.T) {
 	type Attrs = map[string]interface{}
 
+	library := &bazel.Rule{Schema: "java_library", PkgName: "c"}
+
 	var tests = []struct {
-		desc string
-		dep  *bazel.Rule
-		want bool
+		desc     string
+		consumer *bazel.Rule
+		dep      *bazel.Rule
+		want     bool
 	}{
 		{
 			"allow java_library rules",
+			library,
 			&bazel.Rule{Schema: "java_library"},
 			true,
 		},
 		{
 			"don't allow filegroup() dependencies",
+			library,
 			&bazel.Rule{Schema: "filegroup"},
 			false,
 		},
 		{
 			"don't allow rules with tags=avoid_dep",
+			library,
 			&bazel.Rule{"java_library", "x", Attrs{"tags": []string{"avoid_dep"}}},
 			false,
 		},
 		{
 			"don't allow deprecated rules",
+			library,
 			&bazel.Rule{"java_library", "x", Attrs{"deprecation": "don't use this rule!"}},
 			false,
 		},
+		{
+			"don't allow testonly rules in production rules",
+			library,
+			&bazel.Rule{"java_library", "x", Attrs{"testonly": true}},
+			false,
+		},
+		{
+			"allow testonly rules in testonly rules",
+			&bazel.Rule{"java_library", "c", Attrs{"testonly": true}},
+			&bazel.Rule{"java_library", "x", Attrs{"testonly": true}},
+			true,
+		},
+		{
+			"test rules are implicitly testonly",
+			&bazel.Rule{Schema: "java_test", PkgName: "c"},
+			&bazel.Rule{"java_library", "x", Attrs{"testonly": true}},
+			true,
+		},
+		{
+			"don't allow rules that don't support the consuming rule's environments",
+			&bazel.Rule{"java_library", "c", Attrs{"compatible_with": []string{"//env:android"}}},
+			&bazel.Rule{Schema: "java_library", PkgName: "x"},
+			false,
+		},
+		{
+			"allow rules that support the consuming rule's environments",
+			&bazel.Rule{"java_library", "c", Attrs{"compatible_with": []string{"//env:android"}}},
+			&bazel.Rule{"java_library", "x", Attrs{"compatible_with": []string{"//env:android", "//env:web"}}},
+			true,
+		},
+		{
+			"don't allow restricted rules in unrestricted rules",
+			library,
+			&bazel.Rule{"java_library", "x", Attrs{"restricted_to": []string{"//env:android"}}},
+			false,
+		},
+		{
+			"allow restricted rules in rules restricted to the same environments",
+			&bazel.Rule{"java_library", "c", Attrs{"restricted_to": []string{"//env:android"}}},
+			&bazel.Rule{"java_library", "x", Attrs{"restricted_to": []string{"//env:android"}}},
+			true,
+		},
+		{
+			"don't allow rules that require constraints the consuming rule doesn't have",
+			library,
+			&bazel.Rule{"java_library", "x", Attrs{"target_compatible_with": []string{"//os:linux"}}},
+			false,
+		},
+		{
+			"allow rules whose required constraints the consuming rule also requires",
+			&bazel.Rule{"java_library", "c", Attrs{"target_compatible_with": []string{"//os:linux", "//cpu:x86"}}},
+			&bazel.Rule{"java_library", "x", Attrs{"target_compatible_with": []string{"//os:linux"}}},
+			true,
+		},
+	}
+
+	for _, tt := range tests {
+		got := IsValidDependency(tt.consumer, tt.dep)
+		if got != tt.want {
+			t.Errorf("%s: IsValidDependency(%v, %v) = %v, want %v", tt.desc, tt.consumer, tt.dep, got, tt.want)
+		}
+	}
+}
+
+func TestInvalidDependencyReason(t *testing.T) {
+	type Attrs = map[string]interface{}
+
+	library := &bazel.Rule{"java_library", "c", Attrs{"name": "c"}}
+
+	var tests = []struct {
+		desc string
+		dep  *bazel.Rule
+		want string
+	}{
+		{
+			"valid dependency",
+			&bazel.Rule{Schema: "java_library"},
+			"",
+		},
+		{
+			"wrong kind",
+			&bazel.Rule{Schema: "filegroup"},
+			"rules of kind filegroup can't be dependencies of Java rules",
+		},
+		{
+			"avoid_dep",
+			&bazel.Rule{"java_library", "x", Attrs{"tags": []string{"avoid_dep"}}},
+			"tagged avoid_dep",
+		},
+		{
+			"deprecated",
+			&bazel.Rule{"java_library", "x", Attrs{"deprecation": "use //y instead"}},
+			`deprecated: "use //y instead"`,
+		},
+		{
+			"testonly",
+			&bazel.Rule{"java_library", "x", Attrs{"testonly": true}},
+			"testonly, but //c:c isn't",
+		},
 	}
 
 	for _, tt := range tests {
-		got := IsValidDependency(tt.dep)
+		got := InvalidDependencyReason(library, tt.dep)
 		if got != tt.want {
-			t.Errorf("%s: IsValidDependency(%v) = %v, want %v", tt.desc, tt.dep, got, tt.want)
+			t.Errorf("%s: InvalidDependencyReason(%v, %v) = %q, want %q", tt.desc, library, tt.dep, got, tt.want)
 		}
 	}
 }
 
+func TestIsUmbrella(t *testing.T) {
+	type Attrs = map[string]interface{}
+
+	UmbrellaTags = map[string]bool{"api": true}
+	UmbrellaNamePattern = regexp.MustCompile("_api$")
+	defer func() {
+		UmbrellaTags = map[string]bool{}
+		UmbrellaNamePattern = nil
+	}()
+
+	var tests = []struct {
+		desc string
+		rule *bazel.Rule
+		want bool
+	}{
+		{"tagged", bazel.NewRule("java_library", "x", "Foo", Attrs{"tags": []string{"api"}}), true},
+		{"name matches", bazel.NewRule("java_library", "x", "foo_api", nil), true},
+		{"neither tagged nor matching", bazel.NewRule("java_library", "x", "Foo", Attrs{"tags": []string{"other"}}), false},
+		{"kind without exports", bazel.NewRule("java_binary", "x", "foo_api", nil), false},
+	}
+	for _, tt := range tests {
+		if got := IsUmbrella(tt.rule); got != tt.want {
+			t.Errorf("%s: IsUmbrella(%v) = %v, want %v", tt.desc, tt.rule, got, tt.want)
+		}
+	}
+}
+
+func TestIsAPITarget(t *testing.T) {
+	type Attrs = map[string]interface{}
+
+	APITags = map[string]bool{"api": true}
+	defer func() { APITags = map[string]bool{} }()
+
+	var tests = []struct {
+		desc string
+		rule *bazel.Rule
+		want bool
+	}{
+		{"tagged", bazel.NewRule("java_library", "x", "foo", Attrs{"tags": []string{"api"}, "exports": []string{":foo_impl"}}), true},
+		{"not tagged", bazel.NewRule("java_library", "x", "foo_api", Attrs{"tags": []string{"other"}}), false},
+		{"kind without exports", bazel.NewRule("java_binary", "x", "foo", Attrs{"tags": []string{"api"}}), false},
+	}
+	for _, tt := range tests {
+		if got := IsAPITarget(tt.rule); got != tt.want {
+			t.Errorf("%s: IsAPITarget(%v) = %v, want %v", tt.desc, tt.rule, got, tt.want)
+		}
+	}
+}
+
+func TestLabelBlacklist(t *testing.T) {
+	var err error
+	LabelBlacklist, err = CompileLabelBlacklist(".*:testdata, //experimental/.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { LabelBlacklist = nil }()
+
+	library := bazel.NewRule("java_library", "c", "c", nil)
+	var tests = []struct {
+		dep  *bazel.Rule
+		want string
+	}{
+		{bazel.NewRule("java_library", "x", "testdata", nil), `matches label blacklist pattern ".*:testdata"`},
+		{bazel.NewRule("java_library", "experimental/x", "x", nil), `matches label blacklist pattern "//experimental/.*"`},
+		{bazel.NewRule("java_library", "x", "testdata_utils", nil), ""},
+		{bazel.NewRule("java_library", "x/experimental", "x", nil), ""},
+	}
+	for _, tt := range tests {
+		if got := InvalidDependencyReason(library, tt.dep); got != tt.want {
+			t.Errorf("InvalidDependencyReason(%v, %v) = %q, want %q", library, tt.dep.Label(), got, tt.want)
+		}
+	}
+
+	if _, err := CompileLabelBlacklist("(unclosed"); err == nil {
+		t.Errorf("CompileLabelBlacklist(invalid pattern) returned nil error")
+	}
+}
+
 func TestLocalVisibleTo(t *testing.T) {
 	type Attrs = map[string]interface{}
 
@@ -138,12 +323,35 @@ func TestLocalVisibleTo(t *testing.T) {
 			want:        yes,
 		},
 		{
-			desc: "//y:Dep has visibility=//x:__pkg__, so we don't know whether it's visible from 'x'. " +
-				"(note: localVisibleTo is very simple, and doesn't consider all entries in visibility, so in this case it leaves the decision to other filters)",
+			desc:        "//y:Dep has visibility=//x:__pkg__, so it's not visible from 'x/subx'",
 			consPkgName: "x/subx",
 			dep:         bazel.NewRule("java_library", "y", "Dep", Attrs{"visibility": []string{"//x:__pkg__"}}),
+			want:        no,
+		},
+		{
+			desc:        "None of several __pkg__ and __subpackages__ entries match, so no package needs to be loaded",
+			consPkgName: "w",
+			dep:         bazel.NewRule("java_library", "y", "Dep", Attrs{"visibility": []string{"//x:__pkg__", "//z:__pkg__", "//v:__subpackages__"}}),
+			want:        no,
+		},
+		{
+			desc:        "A matching __pkg__ entry after non-matching ones",
+			consPkgName: "z",
+			dep:         bazel.NewRule("java_library", "y", "Dep", Attrs{"visibility": []string{"//x:__pkg__", ":group", "//z:__pkg__"}}),
+			want:        yes,
+		},
+		{
+			desc:        "Only the package_group() in a mixed list can tell",
+			consPkgName: "w",
+			dep:         bazel.NewRule("java_library", "y", "Dep", Attrs{"visibility": []string{"//x:__pkg__", ":group"}}),
 			want:        unknown,
 		},
+		{
+			desc:        "//visibility:private doesn't hide a rule from the other entries",
+			consPkgName: "x",
+			dep:         bazel.NewRule("java_library", "y", "Dep", Attrs{"visibility": []string{"//visibility:private", "//x:__pkg__"}}),
+			want:        yes,
+		},
 	}
 
 	for _, tt := range tests {
@@ -192,6 +400,12 @@ func TestSpecVisibleTo(t *testing.T) {
 			specs:       []string{"x"},
 			want:        unknown,
 		},
+		{
+			desc:        "The 'public' constant grants visibility to every package",
+			consPkgName: "x",
+			specs:       []string{"private", "public"},
+			want:        yes,
+		},
 	}
 
 	for _, tt := range tests {
@@ -374,6 +588,22 @@ func TestCheckVisibility(t *testing.T) {
 			want:          map[VisQuery]bool{{Rule: yDep1, Pkg: "x1"}: true, {Rule: zDep1, Pkg: "x2"}: true},
 			expectedLoads: [][]string{{"y", "z"}, {"w"}},
 		},
+		{
+			desc: "//y:Dep1 has visibility=//y:group, which includes //visibility:private and //visibility:public. " +
+				"Test that the constants are evaluated without loading the 'visibility' package",
+			existingPkgs: map[string]*bazel.Package{
+				"y": {
+					PackageGroups: map[string]*bazel.PackageGroup{
+						"group": {
+							Includes: []bazel.Label{"//visibility:private", "//visibility:public"},
+						},
+					},
+				},
+			},
+			query:         map[VisQuery]bool{{Rule: yDep1, Pkg: "x"}: true},
+			want:          map[VisQuery]bool{{Rule: yDep1, Pkg: "x"}: true},
+			expectedLoads: [][]string{{"y"}},
+		},
 		{
 			desc:          "Tolerate missing package_groups. //y:Dep1 has visibility=//y:group, but that group doesn't exist.",
 			query:         map[VisQuery]bool{{Rule: yDep1, Pkg: "x"}: true},
@@ -397,6 +627,79 @@ func TestCheckVisibility(t *testing.T) {
 	}
 }
 
+func TestVisibilityPath(t *testing.T) {
+	type Attrs = map[string]interface{}
+
+	pkgs := map[string]*bazel.Package{
+		"y": {
+			PackageGroups: map[string]*bazel.PackageGroup{
+				"group": {
+					Includes: []bazel.Label{"//z:group", "//w:group"},
+				},
+			},
+		},
+		"z": {
+			PackageGroups: map[string]*bazel.PackageGroup{
+				"group": {
+					Specs: []string{"z/..."},
+				},
+			},
+		},
+		"w": {
+			PackageGroups: map[string]*bazel.PackageGroup{
+				"group": {
+					Specs: []string{"x/..."},
+				},
+			},
+		},
+	}
+
+	var tests = []struct {
+		desc        string
+		rule        *bazel.Rule
+		pkg         string
+		wantVisible bool
+		wantPath    []bazel.Label
+	}{
+		{
+			"public rules are visible without examining package groups",
+			bazel.NewRule("java_library", "y", "Dep", Attrs{"visibility": []string{"//visibility:public"}}),
+			"x",
+			true,
+			nil,
+		},
+		{
+			"visibility is granted by a package group included from the one in the visibility attribute",
+			bazel.NewRule("java_library", "y", "Dep", Attrs{"visibility": []string{":group"}}),
+			"x/sub",
+			true,
+			[]bazel.Label{"//y:group", "//w:group"},
+		},
+		{
+			"not visible; all examined package groups are returned",
+			bazel.NewRule("java_library", "y", "Dep", Attrs{"visibility": []string{":group"}}),
+			"v",
+			false,
+			[]bazel.Label{"//y:group", "//z:group", "//w:group"},
+		},
+	}
+
+	for _, tt := range tests {
+		loader := &loadertest.StubLoader{Pkgs: pkgs}
+		gotVisible, gotPath, err := VisibilityPath(context.Background(), loader, tt.rule, tt.pkg)
+		if err != nil {
+			t.Errorf("%s: VisibilityPath returned error %v", tt.desc, err)
+			continue
+		}
+		if gotVisible != tt.wantVisible {
+			t.Errorf("%s: VisibilityPath returned visible = %v, want %v", tt.desc, gotVisible, tt.wantVisible)
+		}
+		if diff := cmp.Diff(tt.wantPath, gotPath); diff != "" {
+			t.Errorf("%s: VisibilityPath returned diff in path (-want +got):\n%s", tt.desc, diff)
+		}
+	}
+}
+
 func TestSubPackageOf(t *testing.T) {
 	var tests = []struct {
 		subpackage string
@@ -19,6 +19,7 @@ import (
 	"log"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"context"
 	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
@@ -38,11 +39,39 @@ type Resolver struct {
 
 	// loader loads BUILD files.
 	loader pkgloading.Loader
+
+	// pkgNames caches the packages that directories belong to. If nil, each call to Resolve uses a new cache.
+	pkgNames *pkgloading.PackageNameCache
+
+	// outside records the class names whose files would be in no package under any content root, so later calls to Resolve,
+	// e.g. for other rules referencing the same class, skip them. It's only filled when pkgNames is set, and lives as long as it.
+	mu      sync.Mutex // guards outside
+	outside map[jadeplib.ClassName]bool
+
+	// packagePrefixes maps content roots to the only Java packages they hold, with their subpackages. See WithPackagePrefixes.
+	packagePrefixes map[string][]string
 }
 
 // NewResolver returns a new Resolver.
 func NewResolver(contentRoots []string, workspaceDir string, loader pkgloading.Loader) *Resolver {
-	return &Resolver{contentRoots, workspaceDir, loader}
+	return NewResolverWithCache(contentRoots, workspaceDir, loader, nil)
+}
+
+// NewResolverWithCache returns a new Resolver that looks up and records the packages of files in pkgNames,
+// which is typically shared with the rest of a Jadep invocation through jadeplib.AnalysisCache.
+func NewResolverWithCache(contentRoots []string, workspaceDir string, loader pkgloading.Loader, pkgNames *pkgloading.PackageNameCache) *Resolver {
+	return &Resolver{contentRoots: contentRoots, workspaceDir: workspaceDir, loader: loader, pkgNames: pkgNames, outside: make(map[jadeplib.ClassName]bool)}
+}
+
+// WithPackagePrefixes restricts content roots to the Java packages in prefixes, and their subpackages, and returns r.
+// For example, with {"src/main/java": {"com.mycompany"}}, com.mycompany.Foo is looked up in src/main/java but org.junit.Test isn't,
+// which saves stat'ing files that can't exist on large repositories. Content roots that aren't in prefixes hold any package.
+func (r *Resolver) WithPackagePrefixes(prefixes map[string][]string) *Resolver {
+	r.packagePrefixes = make(map[string][]string)
+	for root, p := range prefixes {
+		r.packagePrefixes[filepath.Clean(root)] = p
+	}
+	return r
 }
 
 // Name returns a description of the resolver.
@@ -62,16 +91,24 @@ func (r *Resolver) Resolve(ctx context.Context, classNames []jadeplib.ClassName,
 	classToFile := make(map[jadeplib.ClassName][]string)
 	var filenames []string
 
+	r.mu.Lock()
 	for _, cls := range classNames {
-		classToFiles := classToFiles(r.contentRoots, cls)
+		if r.outside[cls] {
+			continue
+		}
+		classToFiles := classToFiles(r.rootsOf(cls), cls)
 		classToFile[cls] = classToFiles
 		filenames = append(filenames, classToFiles...)
 	}
+	r.mu.Unlock()
 
-	packages, fileToPkgName, err := pkgloading.Siblings(ctx, r.loader, r.workspaceDir, filenames)
+	packages, fileToPkgName, err := pkgloading.SiblingsWithCache(ctx, r.loader, r.workspaceDir, filenames, r.pkgNames)
 	if err != nil {
 		return nil, err
 	}
+	if r.pkgNames != nil {
+		r.recordOutside(classToFile, fileToPkgName)
+	}
 
 	result := make(map[jadeplib.ClassName][]*bazel.Rule)
 
@@ -90,15 +127,28 @@ func (r *Resolver) Resolve(ctx context.Context, classNames []jadeplib.ClassName,
 				}
 				graph := make(map[string][]string)
 
+				// Generated files aren't on disk; they're provided through the rules that generate them.
+				generators := make(map[string]bool)
+				for file, owner := range pkg.Files {
+					if owner != "" {
+						graph[file] = append(graph[file], owner)
+						generators[owner] = true
+					}
+				}
+
 				for ruleName, rule := range pkg.Rules {
-					for _, s := range rule.StringListAttr("exports") {
-						graph[s] = append(graph[s], ruleName)
+					// Rules that only export others, e.g. API targets, provide the classes of the rules they export in the same package,
+					// however those are written.
+					for _, l := range rule.LabelListAttr("exports") {
+						if exportedPkg, exportedName := l.Split(); exportedPkg == pkgName {
+							graph[exportedName] = append(graph[exportedName], ruleName)
+						}
 					}
 					for _, src := range rule.StringListAttr("srcs") {
 						if src == relativeFilename {
 							graph[relativeFilename] = append(graph[relativeFilename], ruleName)
 						}
-						if r := pkg.Rules[src]; r != nil && r.Schema == "filegroup" {
+						if r := pkg.Rules[src]; r != nil && (r.Schema == "filegroup" || generators[src]) {
 							graph[src] = append(graph[src], ruleName)
 						}
 					}
@@ -117,6 +167,46 @@ func (r *Resolver) Resolve(ctx context.Context, classNames []jadeplib.ClassName,
 	return result, nil
 }
 
+// recordOutside records the class names in classToFile none of whose files are in a package, according to fileToPkgName.
+func (r *Resolver) recordOutside(classToFile map[jadeplib.ClassName][]string, fileToPkgName map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for cls, files := range classToFile {
+		inPackage := false
+		for _, f := range files {
+			if _, ok := fileToPkgName[f]; ok {
+				inPackage = true
+				break
+			}
+		}
+		if !inPackage {
+			r.outside[cls] = true
+		}
+	}
+}
+
+// rootsOf returns the content roots that can hold cls, according to packagePrefixes.
+func (r *Resolver) rootsOf(cls jadeplib.ClassName) []string {
+	if len(r.packagePrefixes) == 0 {
+		return r.contentRoots
+	}
+	var ret []string
+	for _, root := range r.contentRoots {
+		prefixes, ok := r.packagePrefixes[filepath.Clean(root)]
+		if !ok {
+			ret = append(ret, root)
+			continue
+		}
+		for _, p := range prefixes {
+			if strings.HasPrefix(string(cls), p+".") {
+				ret = append(ret, root)
+				break
+			}
+		}
+	}
+	return ret
+}
+
 // classToFiles converts a class name into a file name by changing
 // package to directory separators and adding the content
 // root to the front of the class name and the ".java" to the back.
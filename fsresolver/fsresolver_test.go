@@ -28,6 +28,7 @@ import (
 	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
 	"github.com/bazelbuild/tools_jvm_autodeps/loadertest"
 	"github.com/bazelbuild/tools_jvm_autodeps/pkgloaderfakes"
+	"github.com/bazelbuild/tools_jvm_autodeps/pkgloading"
 	"github.com/google/go-cmp/cmp"
 )
 
@@ -72,6 +73,28 @@ func TestClassToFiles(t *testing.T) {
 	}
 }
 
+func TestRootsOf(t *testing.T) {
+	resolver := NewResolver([]string{"src/main/java/", "src/test/java", "third_party"}, "", nil).WithPackagePrefixes(map[string][]string{
+		"src/main/java": {"com.mycompany", "org.mycompany"},
+		"src/test/java": {"com.mycompany.testing"},
+	})
+	var tests = []struct {
+		input jadeplib.ClassName
+		want  []string
+	}{
+		{"com.mycompany.Foo", []string{"src/main/java/", "third_party"}},
+		{"org.mycompany.util.Foo", []string{"src/main/java/", "third_party"}},
+		{"com.mycompany.testing.FooTest", []string{"src/main/java/", "src/test/java", "third_party"}},
+		{"com.mycompanyx.Foo", []string{"third_party"}},
+		{"org.junit.Test", []string{"third_party"}},
+	}
+	for _, test := range tests {
+		if diff := cmp.Diff(resolver.rootsOf(test.input), test.want); diff != "" {
+			t.Errorf("rootsOf(%s) returned diff (-got +want):\n%s", test.input, diff)
+		}
+	}
+}
+
 func TestResolve(t *testing.T) {
 	type Attrs = map[string]interface{}
 
@@ -126,6 +149,24 @@ func TestResolve(t *testing.T) {
 				},
 			},
 		},
+		// Exports-only rules provide the classes they export, however the exported labels are written.
+		{
+			[]jadeplib.ClassName{"z.Foo"},
+			map[string]*bazel.Package{
+				"java/z": pkgloaderfakes.Pkg([]*bazel.Rule{
+					pkgloaderfakes.JavaLibrary("java/z", "Foo", []string{"Foo.java"}, nil, nil),
+					pkgloaderfakes.JavaLibrary("java/z", "api", nil, nil, []string{"//java/z:Foo", "//java/other:Foo"}),
+					pkgloaderfakes.JavaLibrary("java/z", "relative_api", nil, nil, []string{":Foo"}),
+				}),
+			},
+			map[jadeplib.ClassName][]*bazel.Rule{
+				"z.Foo": {
+					pkgloaderfakes.JavaLibrary("java/z", "Foo", []string{"Foo.java"}, nil, nil),
+					pkgloaderfakes.JavaLibrary("java/z", "api", nil, nil, []string{"//java/z:Foo", "//java/other:Foo"}),
+					pkgloaderfakes.JavaLibrary("java/z", "relative_api", nil, nil, []string{":Foo"}),
+				},
+			},
+		},
 		// Tests that we only return java_library rules.
 		{
 			[]jadeplib.ClassName{"a.Foo"},
@@ -186,6 +227,22 @@ func TestResolve(t *testing.T) {
 				"x.Foo": {bazel.NewRule("java_library", "java/x", "Foo", Attrs{"srcs": []string{"Bar"}})},
 			},
 		},
+		// Foo.java is generated by a genrule, which a java_library srcs. Assert that we return the java_library.
+		{
+			classnames: []jadeplib.ClassName{"g.Foo"},
+			existingPkgs: map[string]*bazel.Package{
+				"java/g": {
+					Files: map[string]string{"Foo.java": "gen", "Foo.template": ""},
+					Rules: map[string]*bazel.Rule{
+						"gen": bazel.NewRule("genrule", "java/g", "gen", Attrs{"srcs": []string{"Foo.template"}}),
+						"Foo": bazel.NewRule("java_library", "java/g", "Foo", Attrs{"srcs": []string{"gen"}}),
+					},
+				},
+			},
+			want: map[jadeplib.ClassName][]*bazel.Rule{
+				"g.Foo": {bazel.NewRule("java_library", "java/g", "Foo", Attrs{"srcs": []string{"gen"}})},
+			},
+		},
 	}
 	for i, test := range tests {
 		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
@@ -242,6 +299,38 @@ func TestResolvePackageNotReturned(t *testing.T) {
 	}
 }
 
+// TestResolveRemembersClassesOutsidePackages tests that a Resolver with a package name cache remembers the class names whose files
+// are in no package, so that resolving them again doesn't look for their packages.
+func TestResolveRemembersClassesOutsidePackages(t *testing.T) {
+	workDir, err := ioutil.TempDir("", "jadep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+	pkgs := map[string]*bazel.Package{
+		"java/x": pkgloaderfakes.Pkg([]*bazel.Rule{pkgloaderfakes.JavaLibrary("java/x", "Foo", []string{"Foo.java"}, nil, nil)}),
+	}
+	cleanup, err := createBuildFileDir(t, []string{"java/x"}, workDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	resolver := NewResolverWithCache([]string{"java"}, workDir, &loadertest.StubLoader{Pkgs: pkgs}, pkgloading.NewPackageNameCache())
+	for i := 0; i < 2; i++ {
+		got, err := resolver.Resolve(context.Background(), []jadeplib.ClassName{"x.Foo", "org.junit.Test"}, nil)
+		if err != nil {
+			t.Fatalf("Resolve returned error %v, want nil", err)
+		}
+		if len(got) != 1 || len(got["x.Foo"]) != 1 {
+			t.Errorf("Resolve returned %v, want x.Foo resolved to //java/x:Foo", got)
+		}
+	}
+	if diff := cmp.Diff(resolver.outside, map[jadeplib.ClassName]bool{"org.junit.Test": true}); diff != "" {
+		t.Errorf("outside diff: (-got +want)\n%s", diff)
+	}
+}
+
 func BenchmarkResolve(b *testing.B) {
 	existingPkgs := make(map[string]*bazel.Package)
 	for i := 0; i < 100; i++ {
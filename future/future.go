@@ -15,6 +15,13 @@
 // Package future implements future/promise primitives.
 package future
 
+import "sync"
+
+// Getter is implemented by Value and Reloadable.
+type Getter interface {
+	Get() interface{}
+}
+
 // Value implements a future/promise for an arbitrary value.
 type Value struct {
 	value interface{}
@@ -45,3 +52,35 @@ func (f *Value) Get() interface{} {
 func Immediate(value interface{}) *Value {
 	return NewValue(func() interface{} { return value })
 }
+
+// Reloadable is a Value that can be recomputed, e.g. when the file it was read from changes.
+type Reloadable struct {
+	f func() interface{}
+
+	mu      sync.RWMutex
+	current *Value
+}
+
+// NewReloadable returns a new Reloadable, whose value is computed by f().
+// Like NewValue, it calls f() concurrently.
+func NewReloadable(f func() interface{}) *Reloadable {
+	return &Reloadable{f: f, current: NewValue(f)}
+}
+
+// Get returns the most recently computed value. It blocks until the first value is ready.
+func (r *Reloadable) Get() interface{} {
+	r.mu.RLock()
+	v := r.current
+	r.mu.RUnlock()
+	return v.Get()
+}
+
+// Reload calls f() again, and atomically replaces the value with its result once it returns.
+// Until then, Get returns the previous value.
+func (r *Reloadable) Reload() {
+	v := &Value{r.f(), make(chan bool)}
+	close(v.ready)
+	r.mu.Lock()
+	r.current = v
+	r.mu.Unlock()
+}
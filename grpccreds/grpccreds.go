@@ -0,0 +1,84 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package grpccreds configures transport security and authentication for Jadep's gRPC clients.
+package grpccreds
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// Options configures how to connect to a gRPC service.
+type Options struct {
+	// TLS enables transport security. When false, the connection is insecure and TokenFile must be empty.
+	TLS bool
+
+	// CAFile is a PEM file of certificate authorities used to verify the server. If empty, the system's roots are used.
+	CAFile string
+
+	// ServerName overrides the server name used to verify the server's certificate.
+	ServerName string
+
+	// TokenFile is a file containing a bearer token that is sent with each RPC, e.g. an OAuth2 access token.
+	TokenFile string
+}
+
+// DialOptions returns the grpc.DialOptions that implement opts.
+func DialOptions(opts Options) ([]grpc.DialOption, error) {
+	if !opts.TLS {
+		if opts.TokenFile != "" {
+			return nil, fmt.Errorf("refusing to send a token over an insecure connection; enable TLS")
+		}
+		return []grpc.DialOption{grpc.WithInsecure()}, nil
+	}
+
+	var creds credentials.TransportCredentials
+	if opts.CAFile != "" {
+		var err error
+		creds, err = credentials.NewClientTLSFromFile(opts.CAFile, opts.ServerName)
+		if err != nil {
+			return nil, fmt.Errorf("error reading certificate authorities from %s:\n%v", opts.CAFile, err)
+		}
+	} else {
+		creds = credentials.NewTLS(&tls.Config{ServerName: opts.ServerName})
+	}
+	ret := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+
+	if opts.TokenFile != "" {
+		b, err := ioutil.ReadFile(opts.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading token:\n%v", err)
+		}
+		ret = append(ret, grpc.WithPerRPCCredentials(bearerToken(strings.TrimSpace(string(b)))))
+	}
+	return ret, nil
+}
+
+// bearerToken is a credentials.PerRPCCredentials that sends a bearer token in the "authorization" header.
+type bearerToken string
+
+func (t bearerToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+func (t bearerToken) RequireTransportSecurity() bool {
+	return true
+}
@@ -0,0 +1,58 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpccreds
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDialOptions(t *testing.T) {
+	if _, err := DialOptions(Options{TokenFile: "/some/token"}); err == nil {
+		t.Errorf("DialOptions(insecure with token) returned nil error, want an error")
+	}
+	opts, err := DialOptions(Options{TLS: true})
+	if err != nil {
+		t.Fatalf("DialOptions(TLS) returned error %v", err)
+	}
+	if len(opts) != 1 {
+		t.Errorf("DialOptions(TLS) returned %d options, want 1", len(opts))
+	}
+}
+
+func TestDialOptionsToken(t *testing.T) {
+	f, err := ioutil.TempFile("", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("secret\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	opts, err := DialOptions(Options{TLS: true, TokenFile: f.Name()})
+	if err != nil {
+		t.Fatalf("DialOptions(TLS with token) returned error %v", err)
+	}
+	if len(opts) != 2 {
+		t.Errorf("DialOptions(TLS with token) returned %d options, want 2", len(opts))
+	}
+	md, err := bearerToken("secret").GetRequestMetadata(nil)
+	if err != nil || md["authorization"] != "Bearer secret" {
+		t.Errorf("GetRequestMetadata() = (%v, %v), want authorization: Bearer secret", md, err)
+	}
+}
@@ -18,18 +18,23 @@ package grpcloader
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
 	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"context"
 	"github.com/golang/protobuf/proto"
 	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/grpccreds"
+	"github.com/bazelbuild/tools_jvm_autodeps/pkgloading"
 	"github.com/bazelbuild/tools_jvm_autodeps/vlog"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc"
@@ -53,6 +58,12 @@ type Loader struct {
 	bazelInstallBase     string
 	bazelOutputBase      string
 	ruleKindsToSerialize []string
+
+	// versions is used by Version. It's nil when the Loader wasn't created by Connect.
+	versions sgrpc.VersionManagementClient
+
+	// resolveUnsupported is set to 1 once the server turns out not to implement the Resolve RPC.
+	resolveUnsupported int32
 }
 
 // NewLoader creates a new Loader that sends RPCs on 'conn' with 'timeout'.
@@ -90,27 +101,61 @@ func NewLoader(stub sgrpc.PackageLoaderClient, timeout time.Duration, workspaceR
 // 'workspaceRoot' is a root Bazel directory, i.e. contains a WORKSPACE file.
 // 'ruleKindsToSerialize' are the rule kinds to send back from the server; leave empty to get all.
 func Connect(ctx context.Context, executable, addr string, timeout time.Duration, workspaceRoot, bazelInstallBase, bazelOutputBase string, ruleKindsToSerialize []string) (*Loader, func(), error) {
-	conn, proc, err := dialAndStart(ctx, executable, addr, timeout)
+	return ConnectWithCredentials(ctx, executable, addr, timeout, workspaceRoot, bazelInstallBase, bazelOutputBase, ruleKindsToSerialize, grpccreds.Options{})
+}
+
+// ConnectWithCredentials is like Connect, but connects to a remote server (i.e., when 'addr' is neither of the form
+// "unix://<file name>" nor "localhost:<port>") according to 'creds', e.g. over TLS with a bearer token.
+// This allows a team to share a PackageLoader server whose Bazel caches are already warm.
+// Connections to local servers are always insecure, since they never leave the machine.
+func ConnectWithCredentials(ctx context.Context, executable, addr string, timeout time.Duration, workspaceRoot, bazelInstallBase, bazelOutputBase string, ruleKindsToSerialize []string, creds grpccreds.Options) (*Loader, func(), error) {
+	conn, proc, err := dialAndStart(ctx, executable, addr, timeout, creds)
 	if err != nil {
 		return nil, nil, err
 	}
 	if proc != nil {
 		proc.Release()
 	}
-	return NewLoader(sgrpc.NewPackageLoaderClient(conn), timeout, workspaceRoot, bazelInstallBase, bazelOutputBase, ruleKindsToSerialize), func() { conn.Close() }, nil
+	loader := NewLoader(sgrpc.NewPackageLoaderClient(conn), timeout, workspaceRoot, bazelInstallBase, bazelOutputBase, ruleKindsToSerialize)
+	loader.versions = sgrpc.NewVersionManagementClient(conn)
+	return loader, func() { conn.Close() }, nil
+}
+
+// Version returns the version of the server the Loader is connected to, which is the mtime of the executable it was started from.
+func (r *Loader) Version(ctx context.Context) (string, error) {
+	if r.versions == nil {
+		return "", fmt.Errorf("the server's version is only known to Loaders created by Connect")
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	version, err := r.versions.Version(ctx, &spb.Empty{})
+	if err != nil {
+		return "", fmt.Errorf("error querying the server's version:\n%v", err)
+	}
+	return version.GetVersion(), nil
 }
 
 // dialAndStart attempts to connect to 'bindLocation'.
 // If it fails, it starts 'executable' and attempts to connect to it for 'connectionTimeout' duration.
-func dialAndStart(ctx context.Context, executable, bindLocation string, connectionTimeout time.Duration) (*grpc.ClientConn, *os.Process, error) {
+// 'creds' configures connections to remote servers.
+func dialAndStart(ctx context.Context, executable, bindLocation string, connectionTimeout time.Duration, creds grpccreds.Options) (*grpc.ClientConn, *os.Process, error) {
 	log.Printf("Connecting to gRPC server at %s", bindLocation)
 
 	callOpts := []grpc.CallOption{grpc.MaxCallRecvMsgSize(100 * 1 << 20)}
-	dialOpts := []grpc.DialOption{grpc.WithTimeout(time.Second), grpc.WithBlock(), grpc.WithInsecure(), grpc.WithDefaultCallOptions(callOpts...)}
+	dialOpts := []grpc.DialOption{grpc.WithTimeout(time.Second), grpc.WithBlock(), grpc.WithDefaultCallOptions(callOpts...)}
 	dialAddr, bindParam, typ := dialAddr(bindLocation)
 	if typ == uds {
 		dialOpts = append(dialOpts, udsDialerOpt)
 	}
+	if typ == unknown {
+		credOpts, err := grpccreds.DialOptions(creds)
+		if err != nil {
+			return nil, nil, err
+		}
+		dialOpts = append(dialOpts, credOpts...)
+	} else {
+		dialOpts = append(dialOpts, grpc.WithInsecure())
+	}
 
 	conn, err := grpc.Dial(dialAddr, dialOpts...)
 
@@ -268,6 +313,13 @@ func (b *closeableBuffer) Write(p []byte) (n int, err error) {
 
 // Load sends an RPC to a PkgLoader service, requesting it to interpret 'packages' (e.g., "foo/bar" to interpret <root>/foo/bar/BUILD)
 func (r *Loader) Load(ctx context.Context, packages []string) (map[string]*bazel.Package, error) {
+	pkgs, _, err := r.LoadWithErrors(ctx, packages)
+	return pkgs, err
+}
+
+// LoadWithErrors is like Load, but also returns the errors of the packages that the service failed to evaluate,
+// e.g. because of a syntax error in their BUILD file.
+func (r *Loader) LoadWithErrors(ctx context.Context, packages []string) (map[string]*bazel.Package, []*pkgloading.PackageError, error) {
 	req := spb.LoaderRequest{
 		WorkspaceDir:         &r.workspaceRoot,
 		InstallBase:          &r.bazelInstallBase,
@@ -283,10 +335,96 @@ func (r *Loader) Load(ctx context.Context, packages []string) (map[string]*bazel
 		log.Printf("Loading packages took %dms. Request:\n%q", int64(time.Now().Sub(stopwatch)/time.Millisecond), proto.CompactTextString(&req))
 	}
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return DeserializeProto(reply), nil
+	return DeserializeProto(reply), DeserializeErrors(reply), nil
+}
+
+// ResolveFiles sends an RPC to a PkgLoader service, requesting it to find the packages that 'fileNames' belong to and interpret them,
+// in one round trip instead of one per directory searched for a BUILD file plus one to Load.
+// If the server doesn't implement the Resolve RPC, e.g. because it's a remote server older than Jadep,
+// it returns pkgloading.ErrResolveFilesUnsupported, and doesn't ask the server again.
+func (r *Loader) ResolveFiles(ctx context.Context, fileNames []string, excludedPackages map[string]bool) (map[string]*bazel.Package, map[string]string, error) {
+	if atomic.LoadInt32(&r.resolveUnsupported) != 0 {
+		return nil, nil, pkgloading.ErrResolveFilesUnsupported
+	}
+	var excluded []string
+	for p := range excludedPackages {
+		excluded = append(excluded, p)
+	}
+	sort.Strings(excluded)
+	req := spb.ResolveRequest{
+		WorkspaceDir:         &r.workspaceRoot,
+		InstallBase:          &r.bazelInstallBase,
+		OutputBase:           &r.bazelOutputBase,
+		Files:                fileNames,
+		ExcludedPackages:     excluded,
+		RuleKindsToSerialize: r.ruleKindsToSerialize,
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	stopwatch := time.Now()
+	reply, err := r.stub.Resolve(ctx, &req)
+	if vlog.V(2) {
+		log.Printf("Resolving files took %dms. Request:\n%q", int64(time.Now().Sub(stopwatch)/time.Millisecond), proto.CompactTextString(&req))
+	}
+	if status.Code(err) == codes.Unimplemented {
+		atomic.StoreInt32(&r.resolveUnsupported, 1)
+		log.Printf("PackageLoader server doesn't support resolving files, searching for BUILD files locally instead")
+		return nil, nil, pkgloading.ErrResolveFilesUnsupported
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return DeserializeProto(&spb.LoaderResponse{Pkgs: reply.Pkgs}), reply.FileToPackage, nil
+}
+
+// Invalidator drops packages from a cache, e.g. pkgloading.CachingLoader.
+type Invalidator interface {
+	Invalidate(packages []string)
+}
+
+// Watch subscribes to changes of BUILD files in the workspace, and invalidates the changed packages in 'cache'.
+// It blocks until ctx is done, in which case it returns nil, or until the subscription fails.
+// Long-running processes should call Watch in a goroutine to keep their caches consistent with the workspace.
+func (r *Loader) Watch(ctx context.Context, cache Invalidator) error {
+	stream, err := r.stub.Watch(ctx, &spb.WatchRequest{WorkspaceDir: &r.workspaceRoot})
+	if err != nil {
+		return fmt.Errorf("error subscribing to BUILD file changes:\n%v", err)
+	}
+	for {
+		resp, err := stream.Recv()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == io.EOF {
+			return fmt.Errorf("PackageLoader server stopped reporting BUILD file changes")
+		}
+		if err != nil {
+			return fmt.Errorf("error receiving BUILD file changes:\n%v", err)
+		}
+		vlog.V(2).Printf("BUILD files changed, invalidating packages %v", resp.ChangedPackages)
+		cache.Invalidate(resp.ChangedPackages)
+	}
+}
+
+// Invalidate tells the PackageLoader server that 'packages' have changed.
+// The server forwards the hint to all clients watching the workspace.
+func (r *Loader) Invalidate(ctx context.Context, packages []string) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	_, err := r.stub.Invalidate(ctx, &spb.InvalidateRequest{WorkspaceDir: &r.workspaceRoot, Packages: packages})
+	return err
+}
+
+// DeserializeErrors returns the errors of the packages that failed to evaluate, from a response from a PackageLoader gRPC service.
+func DeserializeErrors(proto *spb.LoaderResponse) []*pkgloading.PackageError {
+	var ret []*pkgloading.PackageError
+	for _, e := range proto.Errors {
+		ret = append(ret, &pkgloading.PackageError{PkgName: e.GetPackageName(), Message: e.GetMessage(), Line: int(e.GetLine())})
+	}
+	return ret
 }
 
 // DeserializeProto deserializes a response from a PackageLoader gRPC service.
@@ -335,12 +473,76 @@ func DeserializeProto(proto *spb.LoaderResponse) map[string]*bazel.Package {
 		}
 
 		result[pkgName] = &bazel.Package{
-			Path:              *protoPkg.Path,
-			DefaultVisibility: defaultVisibility,
-			Files:             protoPkg.Files,
-			PackageGroups:     packageGroups,
-			Rules:             rules,
+			Path:               *protoPkg.Path,
+			DefaultVisibility:  defaultVisibility,
+			Files:              protoPkg.Files,
+			PackageGroups:      packageGroups,
+			Rules:              rules,
+			DefaultTestonly:    protoPkg.GetDefaultTestonly(),
+			DefaultDeprecation: protoPkg.GetDefaultDeprecation(),
+			Features:           protoPkg.Features,
+			DefaultLicenses:    protoPkg.DefaultLicenses,
 		}
 	}
 	return result
 }
+
+// SerializeProto is the inverse of DeserializeProto: it serializes pkgs into a response of a PackageLoader gRPC service.
+// It allows fake services to serve packages that tests create in Go.
+func SerializeProto(pkgs map[string]*bazel.Package) *spb.LoaderResponse {
+	ret := &spb.LoaderResponse{Pkgs: make(map[string]*mpb.Pkg)}
+	for pkgName, pkg := range pkgs {
+		protoPkg := &mpb.Pkg{
+			Path:               proto.String(pkg.Path),
+			Files:              pkg.Files,
+			Rules:              make(map[string]*mpb.Rule),
+			DefaultTestonly:    proto.Bool(pkg.DefaultTestonly),
+			DefaultDeprecation: proto.String(pkg.DefaultDeprecation),
+			Features:           pkg.Features,
+			DefaultLicenses:    pkg.DefaultLicenses,
+		}
+		for _, l := range pkg.DefaultVisibility {
+			protoPkg.DefaultVisibility = append(protoPkg.DefaultVisibility, string(l))
+		}
+		for ruleName, rule := range pkg.Rules {
+			attrs := make(map[string]*mpb.Attribute)
+			for attrName, v := range rule.Attrs {
+				if a := serializeAttribute(v); a != nil {
+					attrs[attrName] = a
+				}
+			}
+			protoPkg.Rules[ruleName] = &mpb.Rule{Kind: proto.String(rule.Schema), Attributes: attrs}
+		}
+		if len(pkg.PackageGroups) > 0 {
+			protoPkg.PackageGroups = make(map[string]*mpb.PackageGroup)
+			for grpName, grp := range pkg.PackageGroups {
+				var includes []string
+				for _, inc := range grp.Includes {
+					includes = append(includes, string(inc))
+				}
+				protoPkg.PackageGroups[grpName] = &mpb.PackageGroup{PackageSpecs: grp.Specs, Includes: includes}
+			}
+		}
+		ret.Pkgs[pkgName] = protoPkg
+	}
+	return ret
+}
+
+// serializeAttribute returns the proto of an attribute value, or nil if its type can't be serialized.
+func serializeAttribute(v interface{}) *mpb.Attribute {
+	switch x := v.(type) {
+	case string:
+		return &mpb.Attribute{Value: &mpb.Attribute_S{S: x}}
+	case int32:
+		return &mpb.Attribute{Value: &mpb.Attribute_I{I: x}}
+	case int:
+		return &mpb.Attribute{Value: &mpb.Attribute_I{I: int32(x)}}
+	case bool:
+		return &mpb.Attribute{Value: &mpb.Attribute_B{B: x}}
+	case []string:
+		return &mpb.Attribute{Value: &mpb.Attribute_ListOfStrings{ListOfStrings: &mpb.Strings{Str: x}}}
+	case bazel.UnknownAttributeValue:
+		return &mpb.Attribute{Value: &mpb.Attribute_Unknown{Unknown: true}}
+	}
+	return nil
+}
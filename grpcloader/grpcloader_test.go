@@ -29,6 +29,9 @@ import (
 
 	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
 	"github.com/bazelbuild/tools_jvm_autodeps/compat"
+	"github.com/bazelbuild/tools_jvm_autodeps/grpccreds"
+	"github.com/bazelbuild/tools_jvm_autodeps/pkgloading"
+	"github.com/golang/protobuf/proto"
 	"github.com/google/go-cmp/cmp"
 	"google.golang.org/grpc"
 
@@ -49,7 +52,7 @@ func TestMain(m *testing.M) {
 	}
 	bindLocation := "unix://" + tempFileName("grpc_binding_location")
 	executable := compat.RunfilesPath(*pkgLoaderExecutable)
-	conn, process, err := dialAndStart(context.Background(), executable, bindLocation, 30*time.Second)
+	conn, process, err := dialAndStart(context.Background(), executable, bindLocation, 30*time.Second, grpccreds.Options{})
 	if err != nil {
 		log.Fatalf("Error starting and dialing to gRPC PackageLoader server:\n%v", err)
 	}
@@ -191,7 +194,7 @@ func TestDialAndStartUds(t *testing.T) {
 
 	// Running for the first time: process should be non-nil.
 	{
-		conn, process, err := dialAndStart(context.Background(), executable, bindLocation, 30*time.Second)
+		conn, process, err := dialAndStart(context.Background(), executable, bindLocation, 30*time.Second, grpccreds.Options{})
 		defer conn.Close()
 		defer process.Kill()
 		if conn == nil || process == nil || err != nil {
@@ -201,7 +204,7 @@ func TestDialAndStartUds(t *testing.T) {
 
 	// Running a second time: process should be nil (because we didn't start a server)
 	{
-		conn, process, err := dialAndStart(context.Background(), executable, bindLocation, 30*time.Second)
+		conn, process, err := dialAndStart(context.Background(), executable, bindLocation, 30*time.Second, grpccreds.Options{})
 		defer conn.Close()
 		if conn == nil || process != nil || err != nil {
 			t.Fatalf("dialAndStart = (%v, %v, %v), want (non-nil, nil, nil)", conn, process, err)
@@ -222,7 +225,7 @@ func TestDialAndStartLocalhost(t *testing.T) {
 
 	// Running for the first time: process should be non-nil.
 	{
-		conn, process, err := dialAndStart(context.Background(), executable, bindLocation, 30*time.Second)
+		conn, process, err := dialAndStart(context.Background(), executable, bindLocation, 30*time.Second, grpccreds.Options{})
 		defer conn.Close()
 		defer process.Kill()
 		if conn == nil || process == nil || err != nil {
@@ -232,7 +235,7 @@ func TestDialAndStartLocalhost(t *testing.T) {
 
 	// Running a second time: process should be nil (because we didn't start a server)
 	{
-		conn, process, err := dialAndStart(context.Background(), executable, bindLocation, 30*time.Second)
+		conn, process, err := dialAndStart(context.Background(), executable, bindLocation, 30*time.Second, grpccreds.Options{})
 		defer conn.Close()
 		if conn == nil || process != nil || err != nil {
 			t.Fatalf("dialAndStart = (%v, %v, %v), want (non-nil, nil, nil)", conn, process, err)
@@ -274,7 +277,7 @@ func TestRestartServer(t *testing.T) {
 		if err := os.Chtimes(executable, mtime, mtime); err != nil {
 			t.Fatalf("Error changing mtime on %s to %v:\n%v", executable, mtime, err)
 		}
-		conn, process, err := dialAndStart(context.Background(), executable, bindLocation, timeout)
+		conn, process, err := dialAndStart(context.Background(), executable, bindLocation, timeout, grpccreds.Options{})
 		if conn == nil || process == nil || err != nil {
 			t.Fatalf("dialAndStart = (%v, %v, %v), want (non-nil, non-nil, nil)", conn, process, err)
 		}
@@ -293,7 +296,7 @@ func TestRestartServer(t *testing.T) {
 		if err := os.Chtimes(executable, mtime, mtime); err != nil {
 			t.Fatalf("Error changing mtime on %s to %v:\n%v", executable, mtime, err)
 		}
-		conn, process, err := dialAndStart(context.Background(), executable, bindLocation, timeout)
+		conn, process, err := dialAndStart(context.Background(), executable, bindLocation, timeout, grpccreds.Options{})
 		defer conn.Close()
 		defer process.Kill()
 		if conn == nil || process == nil || err != nil {
@@ -346,6 +349,48 @@ func TestDialAddr(t *testing.T) {
 	}
 }
 
+func TestDeserializeErrors(t *testing.T) {
+	resp := &spb.LoaderResponse{Errors: []*spb.PackageError{
+		{PackageName: proto.String("foo"), Message: proto.String("syntax error at ')'"), Line: proto.Int32(12)},
+		{PackageName: proto.String("bar"), Message: proto.String("missing load()")},
+	}}
+	want := []*pkgloading.PackageError{
+		{PkgName: "foo", Message: "syntax error at ')'", Line: 12},
+		{PkgName: "bar", Message: "missing load()"},
+	}
+	if diff := cmp.Diff(DeserializeErrors(resp), want); diff != "" {
+		t.Errorf("DeserializeErrors returned diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestSerializeProto(t *testing.T) {
+	type Attrs = map[string]interface{}
+
+	pkgs := map[string]*bazel.Package{
+		"foo": {
+			Path:              "/ws/foo",
+			DefaultVisibility: []bazel.Label{"//visibility:public"},
+			Files:             map[string]string{"BUILD": "", "Foo.java": ""},
+			Rules: map[string]*bazel.Rule{
+				"Foo": bazel.NewRule("java_library", "foo", "Foo", Attrs{
+					"srcs":     []string{"Foo.java"},
+					"testonly": true,
+					"size":     int32(3),
+					"select":   bazel.UnknownAttributeValue{},
+				}),
+			},
+			PackageGroups:      map[string]*bazel.PackageGroup{"friends": {Specs: []string{"bar/..."}, Includes: []bazel.Label{"//baz:friends"}}},
+			DefaultTestonly:    true,
+			DefaultDeprecation: "use //bar",
+			Features:           []string{"-layering_check"},
+			DefaultLicenses:    []string{"notice"},
+		},
+	}
+	if diff := cmp.Diff(DeserializeProto(SerializeProto(pkgs)), pkgs); diff != "" {
+		t.Errorf("DeserializeProto(SerializeProto(pkgs)) returned diff (-got +want):\n%s", diff)
+	}
+}
+
 type buildFile struct {
 	Path     string
 	Contents string
@@ -0,0 +1,368 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package grpcloadertest provides a Go implementation of the PackageLoader gRPC service that serves canned packages,
+// with configurable latency and errors. It allows testing how Jadep behaves when its package loader is slow or flaky,
+// without starting the Java server.
+package grpcloadertest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/grpcloader"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	sgrpc "github.com/bazelbuild/tools_jvm_autodeps/java/com/google/devtools/javatools/jade/pkgloader/services_proto"
+	spb "github.com/bazelbuild/tools_jvm_autodeps/java/com/google/devtools/javatools/jade/pkgloader/services_proto"
+)
+
+// Faults configures how a Server misbehaves.
+type Faults struct {
+	// Latency delays every Load call, plus a random duration up to Jitter, plus PerPackage for each requested package.
+	// A call whose deadline passes while it's delayed fails with codes.DeadlineExceeded, as a real server's would.
+	Latency    time.Duration
+	Jitter     time.Duration
+	PerPackage time.Duration
+
+	// ErrorRate is the fraction of Load calls, between 0 and 1, that fail with ErrorCode (codes.Unavailable if unset)
+	// after they're delayed.
+	ErrorRate float64
+	ErrorCode codes.Code
+}
+
+// Server implements the PackageLoader and VersionManagement gRPC services.
+// Requested packages that the server doesn't have are omitted from its responses, like packages without a BUILD file.
+type Server struct {
+	mu        sync.Mutex
+	pkgs      map[string]*bazel.Package
+	pkgErrors map[string]*spb.PackageError
+	faults    Faults
+	rand      *rand.Rand
+	version   string
+	requests  [][]string
+	watchers  map[chan []string]bool
+	server    *grpc.Server
+}
+
+// NewServer returns a Server that serves pkgs, keyed by package name, e.g. as created by pkgloaderfakes.Pkg.
+// Random faults are drawn from a source seeded with seed, so that test runs are reproducible.
+func NewServer(pkgs map[string]*bazel.Package, seed int64) *Server {
+	s := &Server{
+		pkgs:      make(map[string]*bazel.Package),
+		pkgErrors: make(map[string]*spb.PackageError),
+		rand:      rand.New(rand.NewSource(seed)),
+		version:   "grpcloadertest",
+		watchers:  make(map[chan []string]bool),
+	}
+	for name, pkg := range pkgs {
+		s.pkgs[name] = pkg
+	}
+	return s
+}
+
+// SetFaults changes how the server misbehaves, taking effect on the next Load call.
+func (s *Server) SetFaults(f Faults) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = f
+}
+
+// SetPackage replaces the package pkgName with pkg, or removes it if pkg is nil, and notifies watchers that it changed.
+func (s *Server) SetPackage(pkgName string, pkg *bazel.Package) {
+	s.mu.Lock()
+	if pkg == nil {
+		delete(s.pkgs, pkgName)
+	} else {
+		s.pkgs[pkgName] = pkg
+	}
+	s.mu.Unlock()
+	s.notify([]string{pkgName})
+}
+
+// SetPackageError makes the server report that pkgName failed to evaluate with message, at line if it's positive,
+// instead of returning the package.
+func (s *Server) SetPackageError(pkgName, message string, line int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := &spb.PackageError{PackageName: proto.String(pkgName), Message: proto.String(message)}
+	if line > 0 {
+		e.Line = proto.Int32(int32(line))
+	}
+	s.pkgErrors[pkgName] = e
+}
+
+// Requests returns the packages requested by each Load call so far, each sorted, in the order the calls arrived.
+func (s *Server) Requests() [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]string(nil), s.requests...)
+}
+
+// Start serves on addr, e.g. "localhost:0" to pick an unused port, and returns the address it listens on.
+// Clients can dial it with grpc.WithInsecure().
+func (s *Server) Start(addr string) (string, error) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", fmt.Errorf("error listening on %s:\n%v", addr, err)
+	}
+	server := grpc.NewServer()
+	sgrpc.RegisterPackageLoaderServer(server, s)
+	sgrpc.RegisterVersionManagementServer(server, s)
+	s.mu.Lock()
+	s.server = server
+	s.mu.Unlock()
+	go server.Serve(lis)
+	return lis.Addr().String(), nil
+}
+
+// Stop stops serving, and cancels outstanding calls.
+func (s *Server) Stop() {
+	s.mu.Lock()
+	server := s.server
+	s.mu.Unlock()
+	if server != nil {
+		server.Stop()
+	}
+}
+
+// Load implements PackageLoader.Load.
+func (s *Server) Load(ctx context.Context, req *spb.LoaderRequest) (*spb.LoaderResponse, error) {
+	requested := append([]string(nil), req.Packages...)
+	sort.Strings(requested)
+
+	s.mu.Lock()
+	s.requests = append(s.requests, requested)
+	f := s.faults
+	delay := f.Latency + time.Duration(len(requested))*f.PerPackage
+	if f.Jitter > 0 {
+		delay += time.Duration(s.rand.Int63n(int64(f.Jitter)))
+	}
+	fail := f.ErrorRate > 0 && s.rand.Float64() < f.ErrorRate
+	pkgs := make(map[string]*bazel.Package)
+	var pkgErrors []*spb.PackageError
+	for _, name := range requested {
+		if e, ok := s.pkgErrors[name]; ok {
+			pkgErrors = append(pkgErrors, e)
+		} else if pkg, ok := s.pkgs[name]; ok {
+			pkgs[name] = pkg
+		}
+	}
+	s.mu.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+		}
+	}
+	if fail {
+		code := f.ErrorCode
+		if code == codes.OK {
+			code = codes.Unavailable
+		}
+		return nil, status.Errorf(code, "injected failure loading %v", requested)
+	}
+	resp := grpcloader.SerializeProto(pkgs)
+	resp.Errors = pkgErrors
+	return resp, nil
+}
+
+// Resolve implements PackageLoader.Resolve. The package of a file is the closest ancestor directory that the server has a package for.
+// The packages are then loaded as if by Load, so they're recorded in Requests and subject to Faults.
+func (s *Server) Resolve(ctx context.Context, req *spb.ResolveRequest) (*spb.ResolveResponse, error) {
+	excluded := make(map[string]bool)
+	for _, p := range req.ExcludedPackages {
+		excluded[p] = true
+	}
+	fileToPkgName := make(map[string]string)
+	var toLoad []string
+	seen := make(map[string]bool)
+	s.mu.Lock()
+	for _, f := range req.Files {
+		for dir := path.Dir(f); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if _, ok := s.pkgs[dir]; !ok {
+				if _, ok := s.pkgErrors[dir]; !ok {
+					continue
+				}
+			}
+			fileToPkgName[f] = dir
+			if !seen[dir] && !excluded[dir] {
+				seen[dir] = true
+				toLoad = append(toLoad, dir)
+			}
+			break
+		}
+	}
+	s.mu.Unlock()
+
+	loaded, err := s.Load(ctx, &spb.LoaderRequest{Packages: toLoad})
+	if err != nil {
+		return nil, err
+	}
+	return &spb.ResolveResponse{FileToPackage: fileToPkgName, Pkgs: loaded.Pkgs, Errors: loaded.Errors}, nil
+}
+
+// Watch implements PackageLoader.Watch. Changes are reported when SetPackage is called or Invalidate is requested.
+func (s *Server) Watch(req *spb.WatchRequest, stream sgrpc.PackageLoader_WatchServer) error {
+	ch := make(chan []string, 16)
+	s.mu.Lock()
+	s.watchers[ch] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.watchers, ch)
+		s.mu.Unlock()
+	}()
+	for {
+		select {
+		case changed := <-ch:
+			if err := stream.Send(&spb.WatchResponse{ChangedPackages: changed}); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// Invalidate implements PackageLoader.Invalidate.
+func (s *Server) Invalidate(ctx context.Context, req *spb.InvalidateRequest) (*spb.Empty, error) {
+	s.notify(req.Packages)
+	return &spb.Empty{}, nil
+}
+
+func (s *Server) notify(changed []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.watchers {
+		select {
+		case ch <- changed:
+		default:
+			// A watcher that doesn't keep up misses changes, as it would if its stream broke.
+		}
+	}
+}
+
+// Version implements VersionManagement.Version.
+func (s *Server) Version(ctx context.Context, req *spb.Empty) (*spb.VersionResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &spb.VersionResponse{Version: proto.String(s.version)}, nil
+}
+
+// Shutdown implements VersionManagement.Shutdown.
+func (s *Server) Shutdown(ctx context.Context, req *spb.Empty) (*spb.Empty, error) {
+	go s.Stop()
+	return &spb.Empty{}, nil
+}
+
+// fixtureRule and fixturePkg are the JSON format of ReadFixtures.
+type fixtureRule struct {
+	Kind  string                 `json:"kind"`
+	Attrs map[string]interface{} `json:"attrs"`
+}
+
+type fixturePkg struct {
+	Path              string                  `json:"path"`
+	Files             []string                `json:"files"`
+	DefaultVisibility []string                `json:"default_visibility"`
+	Rules             map[string]*fixtureRule `json:"rules"`
+}
+
+// ReadFixtures reads canned packages from a JSON file that maps package names to packages, e.g.
+//
+//	{"java/com/foo": {
+//	  "files": ["BUILD", "Foo.java"],
+//	  "default_visibility": ["//visibility:public"],
+//	  "rules": {"foo": {"kind": "java_library", "attrs": {"srcs": ["Foo.java"], "testonly": true}}}}}
+//
+// Attribute values are strings, booleans, integers or lists of strings. Packages' path defaults to their name.
+func ReadFixtures(fileName string) (map[string]*bazel.Package, error) {
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("error reading package fixtures from %s:\n%v", fileName, err)
+	}
+	var fixtures map[string]*fixturePkg
+	if err := json.Unmarshal(b, &fixtures); err != nil {
+		return nil, fmt.Errorf("error parsing package fixtures from %s:\n%v", fileName, err)
+	}
+	ret := make(map[string]*bazel.Package)
+	for pkgName, f := range fixtures {
+		pkg := &bazel.Package{
+			Path:  f.Path,
+			Files: make(map[string]string),
+			Rules: make(map[string]*bazel.Rule),
+		}
+		if pkg.Path == "" {
+			pkg.Path = pkgName
+		}
+		for _, file := range f.Files {
+			pkg.Files[file] = ""
+		}
+		for _, l := range f.DefaultVisibility {
+			pkg.DefaultVisibility = append(pkg.DefaultVisibility, bazel.Label(l))
+		}
+		for ruleName, r := range f.Rules {
+			attrs := make(map[string]interface{})
+			for attrName, v := range r.Attrs {
+				value, err := fixtureAttribute(v)
+				if err != nil {
+					return nil, fmt.Errorf("error parsing package fixtures from %s: attribute %s of //%s:%s:\n%v", fileName, attrName, pkgName, ruleName, err)
+				}
+				attrs[attrName] = value
+			}
+			pkg.Rules[ruleName] = bazel.NewRule(r.Kind, pkgName, ruleName, attrs)
+		}
+		ret[pkgName] = pkg
+	}
+	return ret, nil
+}
+
+// fixtureAttribute converts a JSON attribute value to the type that grpcloader.DeserializeProto would return.
+func fixtureAttribute(v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case string, bool:
+		return x, nil
+	case float64:
+		if x != float64(int32(x)) {
+			return nil, fmt.Errorf("%v isn't a 32-bit integer", x)
+		}
+		return int32(x), nil
+	case []interface{}:
+		var ret []string
+		for _, e := range x {
+			s, ok := e.(string)
+			if !ok {
+				return nil, fmt.Errorf("lists may only contain strings, got %v", e)
+			}
+			ret = append(ret, s)
+		}
+		return ret, nil
+	}
+	return nil, fmt.Errorf("unsupported value %v", v)
+}
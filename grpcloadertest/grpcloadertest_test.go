@@ -0,0 +1,214 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcloadertest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/grpcloader"
+	"github.com/bazelbuild/tools_jvm_autodeps/pkgloaderfakes"
+	"github.com/bazelbuild/tools_jvm_autodeps/pkgloading"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	sgrpc "github.com/bazelbuild/tools_jvm_autodeps/java/com/google/devtools/javatools/jade/pkgloader/services_proto"
+)
+
+// startServer starts s and returns a Loader connected to it with timeout.
+func startServer(t *testing.T, s *Server, timeout time.Duration) (*grpcloader.Loader, func()) {
+	addr, err := s.Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		s.Stop()
+		t.Fatal(err)
+	}
+	loader := grpcloader.NewLoader(sgrpc.NewPackageLoaderClient(conn), timeout, "/ws", "/", "/", nil)
+	return loader, func() {
+		conn.Close()
+		s.Stop()
+	}
+}
+
+func TestLoad(t *testing.T) {
+	foo := pkgloaderfakes.Pkg([]*bazel.Rule{pkgloaderfakes.JavaLibrary("foo", "Foo", []string{"Foo.java"}, nil, nil)})
+	s := NewServer(map[string]*bazel.Package{"foo": foo, "broken": foo}, 1)
+	s.SetPackageError("broken", "syntax error", 3)
+	loader, stop := startServer(t, s, 5*time.Second)
+	defer stop()
+
+	pkgs, pkgErrs, err := loader.LoadWithErrors(context.Background(), []string{"foo", "missing", "broken"})
+	if err != nil {
+		t.Fatalf("LoadWithErrors returned error %v, want nil", err)
+	}
+	if diff := cmp.Diff(pkgs, map[string]*bazel.Package{"foo": foo}); diff != "" {
+		t.Errorf("LoadWithErrors returned diff in packages (-got +want):\n%s", diff)
+	}
+	if diff := cmp.Diff(pkgErrs, []*pkgloading.PackageError{{PkgName: "broken", Message: "syntax error", Line: 3}}); diff != "" {
+		t.Errorf("LoadWithErrors returned diff in package errors (-got +want):\n%s", diff)
+	}
+	if diff := cmp.Diff(s.Requests(), [][]string{{"broken", "foo", "missing"}}); diff != "" {
+		t.Errorf("Server received diff in requests (-got +want):\n%s", diff)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	tests := []struct {
+		desc     string
+		faults   Faults
+		wantCode codes.Code
+	}{
+		{
+			desc:     "slower than the RPC deadline",
+			faults:   Faults{Latency: time.Second},
+			wantCode: codes.DeadlineExceeded,
+		},
+		{
+			desc:     "slower than the RPC deadline because of the number of packages",
+			faults:   Faults{PerPackage: 100 * time.Millisecond},
+			wantCode: codes.DeadlineExceeded,
+		},
+		{
+			desc:     "always failing",
+			faults:   Faults{ErrorRate: 1},
+			wantCode: codes.Unavailable,
+		},
+		{
+			desc:     "always failing with a code",
+			faults:   Faults{ErrorRate: 1, ErrorCode: codes.ResourceExhausted},
+			wantCode: codes.ResourceExhausted,
+		},
+		{
+			desc:     "slow, but within the deadline",
+			faults:   Faults{Latency: 10 * time.Millisecond, Jitter: 10 * time.Millisecond},
+			wantCode: codes.OK,
+		},
+	}
+	s := NewServer(nil, 1)
+	loader, stop := startServer(t, s, 200*time.Millisecond)
+	defer stop()
+	pkgs := []string{"a", "b", "c", "d", "e"}
+	for _, tt := range tests {
+		s.SetFaults(tt.faults)
+		_, err := loader.Load(context.Background(), pkgs)
+		if got := status.Code(err); got != tt.wantCode {
+			t.Errorf("%s: Load returned error %v, want code %v", tt.desc, err, tt.wantCode)
+		}
+	}
+}
+
+// TestSiblings tests that the packages of files are found and loaded in a single Resolve call, through the loaders Jadep wraps around the gRPC one.
+func TestSiblings(t *testing.T) {
+	foo := pkgloaderfakes.Pkg([]*bazel.Rule{pkgloaderfakes.JavaLibrary("foo", "Foo", []string{"Foo.java"}, nil, nil)})
+	slow := pkgloaderfakes.Pkg(nil)
+	s := NewServer(map[string]*bazel.Package{"foo": foo, "slow": slow}, 1)
+	grpcLoader, stop := startServer(t, s, 5*time.Second)
+	defer stop()
+	loader := pkgloading.NewCachingLoader(&pkgloading.FilteringLoader{Loader: grpcLoader, BlacklistedPackages: map[string]bool{"slow": true}})
+
+	pkgs, fileToPkgName, err := pkgloading.Siblings(context.Background(), loader, "/ws", []string{"foo/Foo.java", "foo/bar/Bar.java", "slow/Slow.java", "nopkg/NoPkg.java"})
+	if err != nil {
+		t.Fatalf("Siblings returned error %v, want nil", err)
+	}
+	if diff := cmp.Diff(pkgs, map[string]*bazel.Package{"foo": foo}); diff != "" {
+		t.Errorf("Siblings returned diff in packages (-got +want):\n%s", diff)
+	}
+	wantFileToPkgName := map[string]string{"foo/Foo.java": "foo", "foo/bar/Bar.java": "foo", "slow/Slow.java": "slow"}
+	if diff := cmp.Diff(fileToPkgName, wantFileToPkgName); diff != "" {
+		t.Errorf("Siblings returned diff in file to package names (-got +want):\n%s", diff)
+	}
+	if diff := cmp.Diff(s.Requests(), [][]string{{"foo"}}); diff != "" {
+		t.Errorf("Server received diff in requests (-got +want):\n%s", diff)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	s := NewServer(nil, 1)
+	loader, stop := startServer(t, s, 5*time.Second)
+	defer stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cache := &recordingInvalidator{invalidated: make(chan []string, 1)}
+	go loader.Watch(ctx, cache)
+
+	// The subscription may not be established yet, so changes are repeated until one is reported.
+	for {
+		s.SetPackage("foo", pkgloaderfakes.Pkg(nil))
+		select {
+		case got := <-cache.invalidated:
+			if diff := cmp.Diff(got, []string{"foo"}); diff != "" {
+				t.Errorf("Watch invalidated diff (-got +want):\n%s", diff)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+type recordingInvalidator struct {
+	invalidated chan []string
+}
+
+func (r *recordingInvalidator) Invalidate(packages []string) {
+	select {
+	case r.invalidated <- packages:
+	default:
+	}
+}
+
+func TestReadFixtures(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	fileName := filepath.Join(tmpDir, "fixtures.json")
+	content := `{"java/com/foo": {
+		"files": ["BUILD", "Foo.java"],
+		"default_visibility": ["//visibility:public"],
+		"rules": {"foo": {"kind": "java_library", "attrs": {"srcs": ["Foo.java"], "testonly": true, "shard_count": 2}}}}}`
+	if err := ioutil.WriteFile(fileName, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ReadFixtures(fileName)
+	if err != nil {
+		t.Fatalf("ReadFixtures returned error %v, want nil", err)
+	}
+	want := map[string]*bazel.Package{
+		"java/com/foo": {
+			Path:              "java/com/foo",
+			Files:             map[string]string{"BUILD": "", "Foo.java": ""},
+			DefaultVisibility: []bazel.Label{"//visibility:public"},
+			Rules: map[string]*bazel.Rule{
+				"foo": bazel.NewRule("java_library", "java/com/foo", "foo", map[string]interface{}{"srcs": []string{"Foo.java"}, "testonly": true, "shard_count": int32(2)}),
+			},
+		},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("ReadFixtures returned diff (-got +want):\n%s", diff)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package healthsignals provides implementations of jadeplib.HealthSignals.
+package healthsignals
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+)
+
+// Nop knows of no target, so every target is healthy.
+type Nop struct{}
+
+// Health returns no health.
+func (Nop) Health(ctx context.Context, labels []bazel.Label) (map[bazel.Label]jadeplib.TargetHealth, error) {
+	return nil, nil
+}
+
+// JSON reports the health of targets as read from a JSON object that maps labels to their health, e.g.
+//
+//	{"//foo:bar": {"broken": true}, "//foo:baz": {"flakiness": 0.3, "owners": ["team-foo"]}}
+//
+// CI systems can export such a file periodically.
+type JSON struct {
+	health map[bazel.Label]jadeplib.TargetHealth
+}
+
+// targetHealth is the JSON form of jadeplib.TargetHealth.
+type targetHealth struct {
+	Broken    bool     `json:"broken"`
+	Flakiness float64  `json:"flakiness"`
+	Owners    []string `json:"owners"`
+}
+
+// ReadJSON reads a JSON object that maps labels to their health from r.
+func ReadJSON(r io.Reader) (*JSON, error) {
+	var raw map[string]targetHealth
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, err
+	}
+	ret := &JSON{health: make(map[bazel.Label]jadeplib.TargetHealth)}
+	for l, h := range raw {
+		label, err := bazel.ParseAbsoluteLabel(l)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label %q: %v", l, err)
+		}
+		if h.Flakiness < 0 || h.Flakiness > 1 {
+			return nil, fmt.Errorf("flakiness of %s must be between 0 and 1, got %v", l, h.Flakiness)
+		}
+		ret.health[label] = jadeplib.TargetHealth{Broken: h.Broken, Flakiness: h.Flakiness, Owners: h.Owners}
+	}
+	return ret, nil
+}
+
+// ReadJSONFile reads the JSON file fileName. See ReadJSON.
+func ReadJSONFile(fileName string) (*JSON, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ret, err := ReadJSON(f)
+	if err != nil {
+		return nil, fmt.Errorf("error reading target health from %s:\n%v", fileName, err)
+	}
+	return ret, nil
+}
+
+// Health returns the health of those of labels that the JSON object lists.
+func (j *JSON) Health(ctx context.Context, labels []bazel.Label) (map[bazel.Label]jadeplib.TargetHealth, error) {
+	ret := make(map[bazel.Label]jadeplib.TargetHealth)
+	for _, l := range labels {
+		if h, ok := j.health[l]; ok {
+			ret[l] = h
+		}
+	}
+	return ret, nil
+}
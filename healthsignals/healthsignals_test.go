@@ -0,0 +1,71 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package healthsignals
+
+import (
+	"strings"
+	"testing"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestJSON(t *testing.T) {
+	content := `{
+  "//foo:bar": {"broken": true},
+  "//foo": {"flakiness": 0.3, "owners": ["team-foo"]}
+}`
+	h, err := ReadJSON(strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("ReadJSON returned error %v, want nil", err)
+	}
+	got, err := h.Health(context.Background(), []bazel.Label{"//foo:bar", "//foo:foo", "//unknown:unknown"})
+	if err != nil {
+		t.Fatalf("Health returned error %v, want nil", err)
+	}
+	want := map[bazel.Label]jadeplib.TargetHealth{
+		"//foo:bar": {Broken: true},
+		"//foo:foo": {Flakiness: 0.3, Owners: []string{"team-foo"}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Health returned diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestReadJSONErrors(t *testing.T) {
+	tests := []struct {
+		content      string
+		wantErrorHas string
+	}{
+		{`["//foo:bar"]`, "cannot unmarshal"},
+		{`{"foo:bar": {"broken": true}}`, "foo:bar"},
+		{`{"//foo:bar": {"flakiness": 30}}`, "between 0 and 1"},
+	}
+	for _, tt := range tests {
+		_, err := ReadJSON(strings.NewReader(tt.content))
+		if err == nil || !strings.Contains(err.Error(), tt.wantErrorHas) {
+			t.Errorf("ReadJSON(%s) returned error %v, want error containing %q", tt.content, err, tt.wantErrorHas)
+		}
+	}
+}
+
+func TestNop(t *testing.T) {
+	got, err := Nop{}.Health(context.Background(), []bazel.Label{"//foo:bar"})
+	if err != nil || len(got) != 0 {
+		t.Errorf("Nop.Health() = %v, %v, want no health and no error", got, err)
+	}
+}
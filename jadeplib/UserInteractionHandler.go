@@ -15,19 +15,120 @@
 package jadeplib
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"context"
 	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
 	"github.com/bazelbuild/tools_jvm_autodeps/color"
 )
 
+// neverAsk is returned by ask when the user chooses to never be asked about a class again.
+const neverAsk = -2
+
+// errPromptTimeout is returned by ask when the user doesn't answer in time.
+var errPromptTimeout = errors.New("no answer before the prompt timed out")
+
+// ReadAnswer reads a line from in, e.g. the user's answer to a prompt, and returns it without surrounding whitespace.
+// It reads no further than the end of the line, so the following answers can be read from in later.
+// If ctx is done before a line is read, ReadAnswer returns ctx.Err(). The read isn't abandoned: the line is returned
+// by the next ReadAnswer from in, so an answer typed after a prompt timed out isn't swallowed or split.
+// This lets a user abandon a prompt with Ctrl-C, when ctx is cancelled on SIGINT.
+func ReadAnswer(ctx context.Context, in io.Reader) (string, error) {
+	r := answerReaderOf(in)
+	r.mu.Lock()
+	if !r.pending {
+		r.pending = true
+		r.want <- struct{}{}
+	}
+	r.mu.Unlock()
+	select {
+	case res := <-r.lines:
+		r.mu.Lock()
+		r.pending = false
+		r.mu.Unlock()
+		return res.line, res.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// answerReader reads the lines of an input in a single long-lived goroutine, one line per request,
+// and feeds them to a channel shared by all the prompts that read the input.
+type answerReader struct {
+	// want requests the goroutine to read the next line.
+	want chan struct{}
+	// lines receives the lines that were read.
+	lines chan answer
+
+	mu sync.Mutex
+	// pending is true if a line was requested but not yet received, e.g. because its prompt timed out.
+	pending bool
+}
+
+type answer struct {
+	line string
+	err  error
+}
+
+var (
+	answerReadersMu sync.Mutex
+	answerReaders   = make(map[io.Reader]*answerReader)
+)
+
+// answerReaderOf returns the answerReader of in, starting its goroutine the first time in is read.
+func answerReaderOf(in io.Reader) *answerReader {
+	answerReadersMu.Lock()
+	defer answerReadersMu.Unlock()
+	if r, ok := answerReaders[in]; ok {
+		return r
+	}
+	r := &answerReader{want: make(chan struct{}, 1), lines: make(chan answer, 1)}
+	answerReaders[in] = r
+	go func() {
+		for range r.want {
+			line, err := readLine(in)
+			r.lines <- answer{strings.TrimSpace(line), err}
+		}
+	}()
+	return r
+}
+
+// readLine reads from r one byte at a time until the end of a line, so no input beyond it is consumed.
+// A last line that isn't terminated by a newline is returned without an error.
+func readLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n > 0 {
+			if b[0] == '\n' {
+				return string(line), nil
+			}
+			line = append(line, b[0])
+		}
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				return string(line), nil
+			}
+			return string(line), err
+		}
+	}
+}
+
 // ask takes in a list of printable interfaces. It returns the
 // input from the user indicating which interfaces is wanted.
+// 0 means none, and neverAsk means none, and don't ask about this class again.
 // ask keeps asking the user for input until a valid input is given.
-// If reading from stdin fails, returns an error.
-func ask(in io.Reader, description string, options []bazel.Label) (int, error) {
+// If reading from stdin fails or ctx is done, returns an error.
+// If timeout is positive and no valid input is given within it, returns errPromptTimeout.
+func ask(ctx context.Context, in io.Reader, description string, options []bazel.Label, timeout time.Duration) (int, error) {
 	if len(options) == 1 {
 		return 1, nil
 	}
@@ -35,15 +136,34 @@ func ask(in io.Reader, description string, options []bazel.Label) (int, error) {
 		fmt.Printf("[%v] %v\n", i+1, options[i])
 	}
 	fmt.Println("[0] None")
+	fmt.Println("[s] Skip this class")
+	fmt.Println("[n] Never ask about this class again")
 
 	fmt.Print(description)
+	readCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		readCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 	for {
-		var i string
-		if _, err := fmt.Fscanln(in, &i); err != nil {
+		i, err := ReadAnswer(readCtx, in)
+		if err != nil {
 			if err == io.EOF {
 				return -1, fmt.Errorf("Error reading stdin: %v", err)
 			}
+			if err == context.DeadlineExceeded && ctx.Err() == nil {
+				return -1, errPromptTimeout
+			}
+			return -1, err
+		}
+		switch i {
+		case "":
 			return 1, nil
+		case "s":
+			return 0, nil
+		case "n":
+			return neverAsk, nil
 		}
 		idx, err := strconv.Atoi(i)
 		if err != nil {
@@ -59,21 +179,80 @@ func ask(in io.Reader, description string, options []bazel.Label) (int, error) {
 
 // SelectDepsToAdd asks the user to choose which deps to add to their rules to satisfy missing dependencies.
 func SelectDepsToAdd(in io.Reader, missingDepsMap map[*bazel.Rule]map[ClassName][]bazel.Label) (map[*bazel.Rule][]bazel.Label, error) {
+	depsToAdd, _, err := SelectDepsToAddOrSkip(in, missingDepsMap)
+	return depsToAdd, err
+}
+
+// SelectDepsToAddOrSkip is like SelectDepsToAdd, but also returns the sorted class names the user asked never to be asked about again.
+func SelectDepsToAddOrSkip(in io.Reader, missingDepsMap map[*bazel.Rule]map[ClassName][]bazel.Label) (map[*bazel.Rule][]bazel.Label, []ClassName, error) {
+	return SelectDepsToAddWithContext(context.Background(), in, missingDepsMap)
+}
+
+// SelectDepsToAddWithContext is like SelectDepsToAddOrSkip, but stops asking and returns ctx.Err() when ctx is done,
+// in which case no deps are returned, so nothing the user already chose is half-applied.
+// Rules are asked about in the order of their labels, and classes in alphabetical order, so the answers to a run can be scripted.
+func SelectDepsToAddWithContext(ctx context.Context, in io.Reader, missingDepsMap map[*bazel.Rule]map[ClassName][]bazel.Label) (map[*bazel.Rule][]bazel.Label, []ClassName, error) {
+	return SelectDepsToAddWithOptions(ctx, in, missingDepsMap, PromptOptions{})
+}
+
+// PromptOptions configures SelectDepsToAddWithOptions.
+type PromptOptions struct {
+	// Timeout is how long to wait for the answer to each prompt. Zero waits forever.
+	// Once a prompt times out, the rest are answered the same way without waiting, since nobody is watching.
+	Timeout time.Duration
+
+	// SkipOnTimeout skips the class of a prompt that timed out. Otherwise, the top-ranked candidate is chosen,
+	// as if the user hit Enter.
+	SkipOnTimeout bool
+}
+
+// SelectDepsToAddWithOptions is like SelectDepsToAddWithContext, but prompts according to opts,
+// e.g. so Jadep can run in a pre-commit hook where nobody might be watching the terminal.
+func SelectDepsToAddWithOptions(ctx context.Context, in io.Reader, missingDepsMap map[*bazel.Rule]map[ClassName][]bazel.Label, opts PromptOptions) (map[*bazel.Rule][]bazel.Label, []ClassName, error) {
 	depsToAdd := make(map[*bazel.Rule][]bazel.Label)
-	for rule, classToRules := range missingDepsMap {
+	neverAskAgain := make(map[ClassName]bool)
+	// The answer of prompts that timed out: none, or the top-ranked candidate.
+	timeoutAnswer := 1
+	if opts.SkipOnTimeout {
+		timeoutAnswer = 0
+	}
+	timedOut := false
+	for _, rule := range SortedRules(missingDepsMap) {
+		classToRules := missingDepsMap[rule]
 		addedDeps := make(map[bazel.Label]bool)
-		for class, rules := range classToRules {
-			if depAlreadySatisfied(addedDeps, rules) {
+		for _, class := range SortedClassNames(classToRules) {
+			rules := classToRules[class]
+			if neverAskAgain[class] || depAlreadySatisfied(addedDeps, rules) {
 				continue
 			}
-			fmt.Println()
-			fmt.Printf("The BUILD rule %s is missing a dependency. Choose one of the options below:\n", rule.Label())
-			description := fmt.Sprintf(`For class:  %s
+			var idx int
+			if timedOut && len(rules) > 1 {
+				idx = timeoutAnswer
+			} else {
+				fmt.Println()
+				fmt.Printf("The BUILD rule %s is missing a dependency. Choose one of the options below:\n", rule.Label())
+				description := fmt.Sprintf(`For class:  %s
 Suggestion: %s
-Hit Enter to accept, or a number to choose: `, color.Bold(string(class)), color.Bold(string(rules[0])))
-			idx, err := ask(in, description, rules)
-			if err != nil {
-				return nil, err
+Hit Enter to accept, a number to choose, 's' to skip or 'n' to never ask again: `, color.Bold(string(class)), color.Bold(string(rules[0])))
+				var err error
+				idx, err = ask(ctx, in, description, rules, opts.Timeout)
+				if err == errPromptTimeout {
+					fmt.Println()
+					timedOut, idx = true, timeoutAnswer
+				} else if err != nil {
+					return nil, nil, err
+				}
+			}
+			if timedOut && len(rules) > 1 {
+				if idx == 0 {
+					fmt.Printf("No answer; skipped class %s of %s\n", class, rule.Label())
+				} else {
+					fmt.Printf("No answer; chose %s for class %s of %s\n", rules[0], class, rule.Label())
+				}
+			}
+			if idx == neverAsk {
+				neverAskAgain[class] = true
+				continue
 			}
 			if idx != 0 {
 				addedDeps[rules[idx-1]] = true
@@ -81,9 +260,157 @@ Hit Enter to accept, or a number to choose: `, color.Bold(string(class)), color.
 			}
 		}
 	}
+	var skipped []ClassName
+	for class := range neverAskAgain {
+		skipped = append(skipped, class)
+	}
+	sort.Slice(skipped, func(i, j int) bool { return skipped[i] < skipped[j] })
+	return depsToAdd, skipped, nil
+}
+
+const (
+	// AmbiguityPolicySkip adds no dependency for classes that have several candidates.
+	AmbiguityPolicySkip = "skip"
+
+	// AmbiguityPolicyFirst adds the top-ranked candidate of classes that have several candidates.
+	AmbiguityPolicyFirst = "first"
+
+	// AmbiguityPolicyFail fails if any class has several candidates.
+	AmbiguityPolicyFail = "fail"
+)
+
+// SelectDepsNonInteractively chooses which deps to add without asking the user, e.g. when there's no terminal to ask on.
+// Classes that have a single candidate are satisfied by it, as SelectDepsToAdd does without asking;
+// classes that have several are handled according to policy, which is one of the AmbiguityPolicy* constants.
+func SelectDepsNonInteractively(missingDepsMap map[*bazel.Rule]map[ClassName][]bazel.Label, policy string) (map[*bazel.Rule][]bazel.Label, error) {
+	depsToAdd := make(map[*bazel.Rule][]bazel.Label)
+	var ambiguous []string
+	for _, rule := range SortedRules(missingDepsMap) {
+		classToRules := missingDepsMap[rule]
+		addedDeps := make(map[bazel.Label]bool)
+		for _, class := range SortedClassNames(classToRules) {
+			rules := classToRules[class]
+			if len(rules) == 0 || depAlreadySatisfied(addedDeps, rules) {
+				continue
+			}
+			if len(rules) > 1 {
+				switch policy {
+				case AmbiguityPolicyFirst:
+				case AmbiguityPolicyFail:
+					ambiguous = append(ambiguous, fmt.Sprintf("%s in %s", class, rule.Label()))
+					continue
+				default:
+					continue
+				}
+			}
+			addedDeps[rules[0]] = true
+			depsToAdd[rule] = append(depsToAdd[rule], rules[0])
+		}
+	}
+	if len(ambiguous) > 0 {
+		return nil, fmt.Errorf("can't choose among several candidates without asking, for: %s", strings.Join(ambiguous, ", "))
+	}
 	return depsToAdd, nil
 }
 
+// SortedRules returns the keys of missingDepsMap, sorted by label.
+// Jadep reports, prompts for and edits rules in this order, so that its output can be compared across runs.
+func SortedRules(missingDepsMap map[*bazel.Rule]map[ClassName][]bazel.Label) []*bazel.Rule {
+	var ret []*bazel.Rule
+	for r := range missingDepsMap {
+		ret = append(ret, r)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Label() < ret[j].Label() })
+	return ret
+}
+
+// SortedClassNames returns the keys of classToRules, sorted.
+func SortedClassNames(classToRules map[ClassName][]bazel.Label) []ClassName {
+	var ret []ClassName
+	for c := range classToRules {
+		ret = append(ret, c)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
+// SortedRulesToEdit returns the keys of deps, e.g. the deps to add to each rule, sorted by label.
+func SortedRulesToEdit(deps map[*bazel.Rule][]bazel.Label) []*bazel.Rule {
+	var ret []*bazel.Rule
+	for r := range deps {
+		ret = append(ret, r)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Label() < ret[j].Label() })
+	return ret
+}
+
+// AutoSelectDeps picks the dependencies that can be added without asking the user.
+// A class's top-ranked candidate is picked when its score exceeds threshold and no other candidate scores as high.
+// Returns the picked dependencies, and the missing dependencies that still need a decision.
+// Classes that are satisfied by a picked dependency are not returned.
+func AutoSelectDeps(ctx context.Context, ranker DepsRanker, threshold float64, missingDepsMap map[*bazel.Rule]map[ClassName][]bazel.Label) (map[*bazel.Rule][]bazel.Label, map[*bazel.Rule]map[ClassName][]bazel.Label) {
+	return AutoSelectDepsInPackages(ctx, ranker, nil, threshold, missingDepsMap)
+}
+
+// AutoSelectDepsInPackages is like AutoSelectDeps, but scores the candidates of each rule in the context of its package in pkgs
+// (see ScoreCandidatesInPackage). Rules whose package isn't in pkgs are scored without one.
+func AutoSelectDepsInPackages(ctx context.Context, ranker DepsRanker, pkgs map[string]*bazel.Package, threshold float64, missingDepsMap map[*bazel.Rule]map[ClassName][]bazel.Label) (map[*bazel.Rule][]bazel.Label, map[*bazel.Rule]map[ClassName][]bazel.Label) {
+	depsToAdd := make(map[*bazel.Rule][]bazel.Label)
+	remaining := make(map[*bazel.Rule]map[ClassName][]bazel.Label)
+	for _, rule := range SortedRules(missingDepsMap) {
+		classToRules := missingDepsMap[rule]
+		addedDeps := make(map[bazel.Label]bool)
+		var undecided []ClassName
+		for _, class := range SortedClassNames(classToRules) {
+			rules := classToRules[class]
+			if len(rules) == 0 {
+				continue
+			}
+			best := bestCandidate(ScoreCandidatesInPackage(ctx, ranker, pkgs[rule.PkgName], class, rules), threshold)
+			if best == -1 {
+				undecided = append(undecided, class)
+				continue
+			}
+			if !addedDeps[rules[best]] {
+				addedDeps[rules[best]] = true
+				depsToAdd[rule] = append(depsToAdd[rule], rules[best])
+			}
+		}
+		for _, class := range undecided {
+			if depAlreadySatisfied(addedDeps, classToRules[class]) {
+				continue
+			}
+			if remaining[rule] == nil {
+				remaining[rule] = make(map[ClassName][]bazel.Label)
+			}
+			remaining[rule][class] = classToRules[class]
+		}
+		if deps := depsToAdd[rule]; len(deps) > 0 {
+			sort.Slice(deps, func(i, j int) bool { return deps[i] < deps[j] })
+		}
+	}
+	return depsToAdd, remaining
+}
+
+// bestCandidate returns the index of the single highest score, if it exceeds threshold, or -1 otherwise.
+func bestCandidate(scores []float64, threshold float64) int {
+	best := -1
+	for i, s := range scores {
+		if best == -1 || s > scores[best] {
+			best = i
+		}
+	}
+	if best == -1 || scores[best] <= threshold {
+		return -1
+	}
+	for i, s := range scores {
+		if i != best && s == scores[best] {
+			return -1
+		}
+	}
+	return best
+}
+
 func depAlreadySatisfied(addedDeps map[bazel.Label]bool, rules []bazel.Label) bool {
 	for _, rule := range rules {
 		if _, ok := addedDeps[rule]; ok {
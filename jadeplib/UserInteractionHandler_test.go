@@ -16,9 +16,14 @@ package jadeplib
 
 import (
 	"bytes"
+	"fmt"
+	"io"
 	"testing"
+	"time"
 
+	"context"
 	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/sortingdepsranker"
 	"github.com/google/go-cmp/cmp"
 )
 
@@ -34,10 +39,12 @@ func TestUserInteractionHandler(t *testing.T) {
 		{"1 1\n 1\n", []bazel.Label{""}, 1},
 		{"e\n 2\n 1\n", []bazel.Label{""}, 1},
 		{"", []bazel.Label{""}, 1},
+		{"s\n", []bazel.Label{"", ""}, 0},
+		{"n\n", []bazel.Label{"", ""}, neverAsk},
 	}
 	for idx, test := range tests {
 		in := bytes.NewReader([]byte(test.input))
-		i, err := ask(in, "description", test.rules)
+		i, err := ask(context.Background(), in, "description", test.rules, 0)
 		if err != nil {
 			t.Errorf("Test case %d returned unexpected error:\n%v", idx, err)
 		}
@@ -49,7 +56,7 @@ func TestUserInteractionHandler(t *testing.T) {
 
 func TestUserInteractionHandlerNoStdin(t *testing.T) {
 	in := bytes.NewReader(nil)
-	_, err := ask(in, "description", []bazel.Label{"", ""})
+	_, err := ask(context.Background(), in, "description", []bazel.Label{"", ""}, 0)
 	wantErr := "Error reading stdin: EOF"
 	if err.Error() != wantErr {
 		t.Errorf("Want error %q, got: %v", wantErr, err)
@@ -95,3 +102,289 @@ func TestSelectDepsToAdd(t *testing.T) {
 		}
 	}
 }
+
+func TestSelectDepsToAddOrSkip(t *testing.T) {
+	ruleA := bazel.NewRule("", "java/a", "Jade", nil)
+	ruleB := bazel.NewRule("", "java/b", "Jade", nil)
+	missingDepsMap := map[*bazel.Rule]map[ClassName][]bazel.Label{
+		ruleA: {"x.Foo": {"//java/x:Foo1", "//java/x:Foo2"}},
+		ruleB: {"x.Foo": {"//java/x:Foo1", "//java/x:Foo2"}},
+	}
+	// The user is asked about x.Foo only once, since they chose to never be asked about it again.
+	in := bytes.NewReader([]byte("n\n1\n"))
+	gotDeps, gotSkipped, err := SelectDepsToAddOrSkip(in, missingDepsMap)
+	if err != nil {
+		t.Fatalf("SelectDepsToAddOrSkip returned unexpected error:\n%v", err)
+	}
+	if len(gotDeps) != 0 {
+		t.Errorf("SelectDepsToAddOrSkip returned deps %v, want none", gotDeps)
+	}
+	if diff := cmp.Diff(gotSkipped, []ClassName{"x.Foo"}); diff != "" {
+		t.Errorf("SelectDepsToAddOrSkip returned skipped class names diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestReadAnswer(t *testing.T) {
+	ctx := context.Background()
+	in := bytes.NewReader([]byte(" 2 \n\nlast"))
+	for _, want := range []string{"2", "", "last"} {
+		got, err := ReadAnswer(ctx, in)
+		if err != nil {
+			t.Fatalf("ReadAnswer returned unexpected error:\n%v", err)
+		}
+		if got != want {
+			t.Errorf("ReadAnswer returned %q, want %q", got, want)
+		}
+	}
+	if _, err := ReadAnswer(ctx, in); err != io.EOF {
+		t.Errorf("ReadAnswer at end of input returned error %v, want EOF", err)
+	}
+}
+
+func TestSelectDepsToAddWithContextCancelled(t *testing.T) {
+	missingDepsMap := map[*bazel.Rule]map[ClassName][]bazel.Label{
+		bazel.NewRule("", "java/a", "Jade", nil): {"x.Foo": {"//java/x:Foo1", "//java/x:Foo2"}},
+	}
+	// The user never answers.
+	r, w := io.Pipe()
+	defer w.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	gotDeps, _, err := SelectDepsToAddWithContext(ctx, r, missingDepsMap)
+	if err != context.Canceled {
+		t.Errorf("SelectDepsToAddWithContext returned error %v, want %v", err, context.Canceled)
+	}
+	if gotDeps != nil {
+		t.Errorf("SelectDepsToAddWithContext returned deps %v, want none", gotDeps)
+	}
+}
+
+func TestSelectDepsToAddWithTimeout(t *testing.T) {
+	ruleA := bazel.NewRule("", "java/a", "Jade", nil)
+	ruleB := bazel.NewRule("", "java/b", "Jade", nil)
+	missingDepsMap := map[*bazel.Rule]map[ClassName][]bazel.Label{
+		ruleA: {"x.Foo": {"//java/x:Foo1", "//java/x:Foo2"}},
+		ruleB: {"x.Bar": {"//java/x:Bar1", "//java/x:Bar2"}, "x.Baz": {"//java/x:Baz"}},
+	}
+	var tests = []struct {
+		desc  string
+		opts  PromptOptions
+		input string
+		want  map[*bazel.Rule][]bazel.Label
+	}{
+		{
+			desc: "Answers before the timeout are used",
+			opts: PromptOptions{Timeout: time.Minute},
+			// The prompt for x.Baz isn't shown, since it has a single candidate.
+			input: "2\ns\n",
+			want:  map[*bazel.Rule][]bazel.Label{ruleA: {"//java/x:Foo2"}, ruleB: {"//java/x:Baz"}},
+		},
+		{
+			desc: "The top-ranked candidate is chosen for every prompt after the first one times out",
+			opts: PromptOptions{Timeout: 10 * time.Millisecond},
+			want: map[*bazel.Rule][]bazel.Label{ruleA: {"//java/x:Foo1"}, ruleB: {"//java/x:Bar1", "//java/x:Baz"}},
+		},
+		{
+			desc: "Classes with several candidates are skipped after the first prompt times out",
+			opts: PromptOptions{Timeout: 10 * time.Millisecond, SkipOnTimeout: true},
+			want: map[*bazel.Rule][]bazel.Label{ruleB: {"//java/x:Baz"}},
+		},
+	}
+	for _, tt := range tests {
+		// After the input, the user stops answering.
+		r, w := io.Pipe()
+		go w.Write([]byte(tt.input))
+		got, _, err := SelectDepsToAddWithOptions(context.Background(), r, missingDepsMap, tt.opts)
+		w.Close()
+		if err != nil {
+			t.Errorf("%s: SelectDepsToAddWithOptions returned unexpected error:\n%v", tt.desc, err)
+			continue
+		}
+		if diff := cmp.Diff(got, tt.want, sortRuleKeys); diff != "" {
+			t.Errorf("%s: SelectDepsToAddWithOptions returned diff (-got +want):\n%s", tt.desc, diff)
+		}
+	}
+}
+
+func TestSelectDepsToAddAfterTimeout(t *testing.T) {
+	rule := bazel.NewRule("", "java/a", "Jade", nil)
+	missingDepsMap := map[*bazel.Rule]map[ClassName][]bazel.Label{
+		rule: {"x.Foo": {"//java/x:Foo1", "//java/x:Foo2"}},
+	}
+	r, w := io.Pipe()
+	defer w.Close()
+	opts := PromptOptions{Timeout: 10 * time.Millisecond, SkipOnTimeout: true}
+	got, _, err := SelectDepsToAddWithOptions(context.Background(), r, missingDepsMap, opts)
+	if err != nil {
+		t.Fatalf("SelectDepsToAddWithOptions returned unexpected error:\n%v", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("SelectDepsToAddWithOptions returned deps %v after the prompt timed out, want none", got)
+	}
+
+	// The user answers the next prompt; the read of the prompt that timed out mustn't swallow it.
+	go w.Write([]byte("2\n"))
+	got, _, err = SelectDepsToAddWithOptions(context.Background(), r, missingDepsMap, PromptOptions{Timeout: time.Minute})
+	if err != nil {
+		t.Fatalf("SelectDepsToAddWithOptions returned unexpected error:\n%v", err)
+	}
+	want := map[*bazel.Rule][]bazel.Label{rule: {"//java/x:Foo2"}}
+	if diff := cmp.Diff(got, want, sortRuleKeys); diff != "" {
+		t.Errorf("SelectDepsToAddWithOptions returned diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestSelectDepsNonInteractively(t *testing.T) {
+	rule := bazel.NewRule("", "java/a", "Jade", nil)
+	missingDepsMap := map[*bazel.Rule]map[ClassName][]bazel.Label{
+		rule: {
+			"b.Foo": {"//java/b:Foo"},
+			"c.Bar": {"//java/c:Bar1", "//java/c:Bar2"},
+			"d.Baz": {"//java/b:Foo", "//java/d:Baz"},
+		},
+	}
+	var tests = []struct {
+		policy  string
+		want    map[*bazel.Rule][]bazel.Label
+		wantErr bool
+	}{
+		{
+			policy: AmbiguityPolicySkip,
+			want:   map[*bazel.Rule][]bazel.Label{rule: {"//java/b:Foo"}},
+		},
+		{
+			policy: AmbiguityPolicyFirst,
+			want:   map[*bazel.Rule][]bazel.Label{rule: {"//java/b:Foo", "//java/c:Bar1"}},
+		},
+		{
+			policy:  AmbiguityPolicyFail,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		got, err := SelectDepsNonInteractively(missingDepsMap, tt.policy)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("SelectDepsNonInteractively(%s) returned error %v, want error: %v", tt.policy, err, tt.wantErr)
+		}
+		if diff := cmp.Diff(got, tt.want, sortRuleKeys); diff != "" {
+			t.Errorf("SelectDepsNonInteractively(%s) returned diff (-got +want):\n%s", tt.policy, diff)
+		}
+	}
+}
+
+// scoringRanker scores labels according to a fixed table.
+type scoringRanker struct {
+	sortingdepsranker.Ranker
+	scores map[bazel.Label]float64
+}
+
+func (r *scoringRanker) Score(ctx context.Context, className ClassName, label bazel.Label, candidates []bazel.Label) float64 {
+	return r.scores[label]
+}
+
+func TestAutoSelectDeps(t *testing.T) {
+	rule := bazel.NewRule("", "java/a", "Jade", nil)
+	var tests = []struct {
+		desc          string
+		ranker        DepsRanker
+		missing       map[ClassName][]bazel.Label
+		wantSelected  map[*bazel.Rule][]bazel.Label
+		wantRemaining map[*bazel.Rule]map[ClassName][]bazel.Label
+	}{
+		{
+			desc:         "Without a scorer, a sole candidate is selected",
+			ranker:       &sortingdepsranker.Ranker{},
+			missing:      map[ClassName][]bazel.Label{"b.Foo": {"//java/b:Foo"}},
+			wantSelected: map[*bazel.Rule][]bazel.Label{rule: {"//java/b:Foo"}},
+		},
+		{
+			desc:          "Without a scorer, multiple candidates are ambiguous",
+			ranker:        &sortingdepsranker.Ranker{},
+			missing:       map[ClassName][]bazel.Label{"b.Foo": {"//java/b:Foo", "//java/b:Foo2"}},
+			wantRemaining: map[*bazel.Rule]map[ClassName][]bazel.Label{rule: {"b.Foo": {"//java/b:Foo", "//java/b:Foo2"}}},
+		},
+		{
+			desc:         "Confident candidate is selected",
+			ranker:       &scoringRanker{scores: map[bazel.Label]float64{"//java/b:Foo": 0.1, "//java/b:Foo2": 0.95}},
+			missing:      map[ClassName][]bazel.Label{"b.Foo": {"//java/b:Foo", "//java/b:Foo2"}},
+			wantSelected: map[*bazel.Rule][]bazel.Label{rule: {"//java/b:Foo2"}},
+		},
+		{
+			desc:          "Candidates with equal scores are ambiguous",
+			ranker:        &scoringRanker{scores: map[bazel.Label]float64{"//java/b:Foo": 0.95, "//java/b:Foo2": 0.95}},
+			missing:       map[ClassName][]bazel.Label{"b.Foo": {"//java/b:Foo", "//java/b:Foo2"}},
+			wantRemaining: map[*bazel.Rule]map[ClassName][]bazel.Label{rule: {"b.Foo": {"//java/b:Foo", "//java/b:Foo2"}}},
+		},
+		{
+			desc:   "Selected deps satisfy ambiguous classes",
+			ranker: &scoringRanker{scores: map[bazel.Label]float64{"//java/b:Foo": 0.95, "//java/c:Bar": 0.5}},
+			missing: map[ClassName][]bazel.Label{
+				"b.Foo": {"//java/b:Foo"},
+				"c.Bar": {"//java/b:Foo", "//java/c:Bar"},
+				"d.Baz": {"//java/d:Baz"},
+			},
+			wantSelected:  map[*bazel.Rule][]bazel.Label{rule: {"//java/b:Foo"}},
+			wantRemaining: map[*bazel.Rule]map[ClassName][]bazel.Label{rule: {"d.Baz": {"//java/d:Baz"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if tt.wantSelected == nil {
+				tt.wantSelected = make(map[*bazel.Rule][]bazel.Label)
+			}
+			if tt.wantRemaining == nil {
+				tt.wantRemaining = make(map[*bazel.Rule]map[ClassName][]bazel.Label)
+			}
+			selected, remaining := AutoSelectDeps(context.Background(), tt.ranker, 0.9, map[*bazel.Rule]map[ClassName][]bazel.Label{rule: tt.missing})
+			if diff := cmp.Diff(selected, tt.wantSelected, sortRuleKeys); diff != "" {
+				t.Errorf("AutoSelectDeps() selected diff (-got +want):\n%s", diff)
+			}
+			if diff := cmp.Diff(remaining, tt.wantRemaining, sortRuleKeys); diff != "" {
+				t.Errorf("AutoSelectDeps() remaining diff (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestAutoSelectDepsInPackages(t *testing.T) {
+	rule := bazel.NewRule("", "java/a", "Jade", nil)
+	pkg := &bazel.Package{Rules: map[string]*bazel.Rule{"Jade": rule}}
+	for i := 0; i < 9; i++ {
+		name := fmt.Sprintf("Other%d", i)
+		pkg.Rules[name] = bazel.NewRule("java_library", "java/a", name, map[string]interface{}{"deps": []string{"//java/b:Foo2"}})
+	}
+	missing := map[*bazel.Rule]map[ClassName][]bazel.Label{rule: {"b.Foo": {"//java/b:Foo", "//java/b:Foo2"}}}
+
+	// 9 rules in java/a depend on //java/b:Foo2 and none on //java/b:Foo, so sortingdepsranker scores it 10/11.
+	selected, remaining := AutoSelectDepsInPackages(context.Background(), &sortingdepsranker.Ranker{}, map[string]*bazel.Package{"java/a": pkg}, 0.9, missing)
+	if diff := cmp.Diff(selected, map[*bazel.Rule][]bazel.Label{rule: {"//java/b:Foo2"}}, sortRuleKeys); diff != "" {
+		t.Errorf("AutoSelectDepsInPackages() selected diff (-got +want):\n%s", diff)
+	}
+	if len(remaining) != 0 {
+		t.Errorf("AutoSelectDepsInPackages() remaining = %v, want none", remaining)
+	}
+
+	// Without the package, the same candidates are ambiguous.
+	selected, _ = AutoSelectDepsInPackages(context.Background(), &sortingdepsranker.Ranker{}, nil, 0.9, missing)
+	if len(selected) != 0 {
+		t.Errorf("AutoSelectDepsInPackages(nil packages) selected %v, want none", selected)
+	}
+}
+
+func TestSortedRulesToEdit(t *testing.T) {
+	deps := map[*bazel.Rule][]bazel.Label{
+		bazel.NewRule("", "x", "b", nil): nil,
+		bazel.NewRule("", "w", "z", nil): nil,
+		bazel.NewRule("", "x", "a", nil): nil,
+	}
+	for i := 0; i < 10; i++ {
+		var got []bazel.Label
+		for _, r := range SortedRulesToEdit(deps) {
+			got = append(got, r.Label())
+		}
+		want := []bazel.Label{"//w:z", "//x:a", "//x:b"}
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Fatalf("SortedRulesToEdit returned diff (-got +want):\n%s", diff)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jadeplib
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/pkgloading"
+)
+
+// AnalysisCache memoizes, for the duration of a single Jadep invocation, which package each file belongs to
+// and which rules consume each file.
+// Finding the rules to fix and resolving class names both map files to packages, and sharing an AnalysisCache
+// between them means each BUILD package is examined once per invocation.
+// Entries are never invalidated on their own, so an AnalysisCache must not outlive the invocation that created it,
+// unless it is Reset, e.g. by a server before each request.
+// AnalysisCache is safe for concurrent use.
+type AnalysisCache struct {
+	// PackageNames maps directories to the names of the packages they belong to.
+	// It can be passed to pkgloading.SiblingsWithCache.
+	PackageNames *pkgloading.PackageNameCache
+
+	mu        sync.Mutex // guards consumers
+	consumers map[string][]*bazel.Rule
+}
+
+// NewAnalysisCache returns an empty AnalysisCache.
+func NewAnalysisCache() *AnalysisCache {
+	return &AnalysisCache{
+		PackageNames: pkgloading.NewPackageNameCache(),
+		consumers:    make(map[string][]*bazel.Rule),
+	}
+}
+
+// rulesConsumingFile returns the memoized result of RulesConsumingFile(fileName), if there is one.
+func (c *AnalysisCache) rulesConsumingFile(fileName string) ([]*bazel.Rule, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rules, ok := c.consumers[fileName]
+	if !ok {
+		return nil, false
+	}
+	// Callers may append to the result, so they get their own copy.
+	return append([]*bazel.Rule(nil), rules...), true
+}
+
+// setRulesConsumingFile memoizes rules as the result of RulesConsumingFile(fileName).
+func (c *AnalysisCache) setRulesConsumingFile(fileName string, rules []*bazel.Rule) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.consumers[fileName] = append([]*bazel.Rule(nil), rules...)
+}
+
+// ForgetPackage drops what c knows about the package pkgName and the files in its directory, e.g. after a rule was added to it
+// or its BUILD file was created. Files in its subdirectories are forgotten too, since they might now belong to it.
+func (c *AnalysisCache) ForgetPackage(pkgName string) {
+	dir := filepath.FromSlash(pkgName)
+	if dir == "" {
+		dir = "."
+	}
+	c.PackageNames.Forget(dir)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for fileName := range c.consumers {
+		if dir == "." || strings.HasPrefix(fileName, dir+string(filepath.Separator)) {
+			delete(c.consumers, fileName)
+		}
+	}
+}
+
+// Reset drops everything c knows, as if it were newly created.
+// Unlike replacing c, this also resets the PackageNames shared with resolvers.
+func (c *AnalysisCache) Reset() {
+	c.PackageNames.Reset()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.consumers = make(map[string][]*bazel.Rule)
+}
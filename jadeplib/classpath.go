@@ -0,0 +1,121 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jadeplib
+
+import (
+	"strings"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/pkgloading"
+	"github.com/bazelbuild/tools_jvm_autodeps/vlog"
+)
+
+// classpathAttrs are the attributes through which a rule's dependencies reach the compile classpath of the rules that depend on it.
+var classpathAttrs = []string{"deps", "exports"}
+
+// ClasspathEstimator estimates how much a candidate dependency would grow the compile classpath of the rule that depends on it,
+// from the rules in loaded packages, so users can pick the lighter of equivalent candidates.
+// It isn't safe for concurrent use.
+type ClasspathEstimator struct {
+	ctx    context.Context
+	loader pkgloading.Loader
+	depth  int
+
+	// closures memoizes closure, and classpaths memoizes the classpath of consuming rules.
+	closures   map[bazel.Label]map[bazel.Label]bool
+	classpaths map[bazel.Label]map[bazel.Label]bool
+}
+
+// NewClasspathEstimator returns a ClasspathEstimator that follows at most depth edges from each candidate, loading packages
+// with loader as needed. Estimates of candidates with deeper dependency graphs are therefore lower bounds.
+func NewClasspathEstimator(ctx context.Context, loader pkgloading.Loader, depth int) *ClasspathEstimator {
+	return &ClasspathEstimator{ctx, loader, depth, make(map[bazel.Label]map[bazel.Label]bool), make(map[bazel.Label]map[bazel.Label]bool)}
+}
+
+// Delta returns the number of targets that depending on candidate would add to the compile classpath of consumingRule:
+// candidate and the targets it reaches through deps and exports, except those that consumingRule already reaches.
+// If consumingRule is nil, it returns the size of candidate's classpath.
+func (e *ClasspathEstimator) Delta(consumingRule *bazel.Rule, candidate bazel.Label) int {
+	var have map[bazel.Label]bool
+	if consumingRule != nil {
+		have = e.classpathOf(consumingRule)
+	}
+	n := 0
+	for l := range e.closure(candidate) {
+		if !have[l] {
+			n++
+		}
+	}
+	return n
+}
+
+// classpathOf returns the targets that rule reaches through classpathAttrs, including itself.
+func (e *ClasspathEstimator) classpathOf(rule *bazel.Rule) map[bazel.Label]bool {
+	if ret, ok := e.classpaths[rule.Label()]; ok {
+		return ret
+	}
+	ret := map[bazel.Label]bool{rule.Label(): true}
+	for _, attr := range classpathAttrs {
+		for _, dep := range rule.LabelListAttr(attr) {
+			for l := range e.closure(dep) {
+				ret[l] = true
+			}
+		}
+	}
+	e.classpaths[rule.Label()] = ret
+	return ret
+}
+
+// closure returns label and the labels it reaches through classpathAttrs, following at most e.depth edges.
+// Rules that can't be loaded count, but their dependencies don't. Rules in external repositories aren't loaded.
+func (e *ClasspathEstimator) closure(label bazel.Label) map[bazel.Label]bool {
+	if ret, ok := e.closures[label]; ok {
+		return ret
+	}
+	ret := map[bazel.Label]bool{label: true}
+	var toVisit []bazel.Label
+	if !strings.HasPrefix(string(label), "@") {
+		toVisit = append(toVisit, label)
+	}
+	for level := 0; level < e.depth && len(toVisit) > 0; level++ {
+		rules, _, err := pkgloading.LoadRules(e.ctx, e.loader, toVisit)
+		if err != nil {
+			vlog.V(2).Printf("Error loading deps of %s; not estimating the classpath through them:\n%v", label, err)
+			break
+		}
+		var next []bazel.Label
+		for _, l := range toVisit {
+			r := rules[l]
+			if r == nil {
+				continue
+			}
+			for _, attr := range classpathAttrs {
+				for _, dep := range r.LabelListAttr(attr) {
+					if ret[dep] {
+						continue
+					}
+					ret[dep] = true
+					if !strings.HasPrefix(string(dep), "@") {
+						next = append(next, dep)
+					}
+				}
+			}
+		}
+		toVisit = next
+	}
+	e.closures[label] = ret
+	return ret
+}
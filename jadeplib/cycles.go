@@ -0,0 +1,116 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jadeplib
+
+import (
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/pkgloading"
+	"github.com/bazelbuild/tools_jvm_autodeps/vlog"
+)
+
+// cycleAttrs are the attributes through which a dependency on a candidate would make a consuming rule part of a cycle.
+var cycleAttrs = []string{"deps", "exports", "runtime_deps"}
+
+// transitiveDeps computes the rules that rules depend on, up to a fixed depth, loading packages as needed.
+// It's used to avoid suggesting a dependency that depends on the rule being fixed, which Bazel would reject as a cycle.
+type transitiveDeps struct {
+	ctx    context.Context
+	loader pkgloading.Loader
+	depth  int
+	memo   map[bazel.Label]map[bazel.Label]bool
+}
+
+func newTransitiveDeps(ctx context.Context, loader pkgloading.Loader, depth int) *transitiveDeps {
+	return &transitiveDeps{ctx, loader, depth, make(map[bazel.Label]map[bazel.Label]bool)}
+}
+
+// of returns the labels that rule depends on through cycleAttrs, following at most t.depth edges.
+// Returns nil if t.depth isn't positive.
+// Rules that can't be loaded are skipped, since their only consequence is that fewer cycles are detected.
+func (t *transitiveDeps) of(rule *bazel.Rule) map[bazel.Label]bool {
+	if t.depth <= 0 {
+		return nil
+	}
+	if _, ok := t.memo[rule.Label()]; !ok {
+		t.load([]*bazel.Rule{rule})
+	}
+	return t.memo[rule.Label()]
+}
+
+// load computes of() for all of rules together, so each level of their dependencies is loaded in a single call,
+// rather than once per rule.
+func (t *transitiveDeps) load(rules []*bazel.Rule) {
+	if t.depth <= 0 {
+		return
+	}
+	// ret and toVisit are keyed by the rules whose deps are computed.
+	ret := make(map[bazel.Label]map[bazel.Label]bool)
+	toVisit := make(map[bazel.Label][]bazel.Label)
+	for _, r := range rules {
+		l := r.Label()
+		if _, ok := t.memo[l]; ok {
+			continue
+		}
+		if _, ok := ret[l]; !ok {
+			ret[l] = make(map[bazel.Label]bool)
+			toVisit[l] = directDeps(r)
+		}
+	}
+	for level := 1; len(toVisit) > 0; level++ {
+		next := make(map[bazel.Label][]bazel.Label)
+		var toLoad []bazel.Label
+		seen := make(map[bazel.Label]bool)
+		for l, deps := range toVisit {
+			for _, d := range deps {
+				if !ret[l][d] {
+					ret[l][d] = true
+					next[l] = append(next[l], d)
+					if !seen[d] {
+						seen[d] = true
+						toLoad = append(toLoad, d)
+					}
+				}
+			}
+		}
+		if level == t.depth || len(toLoad) == 0 {
+			break
+		}
+		loaded, _, err := pkgloading.LoadRules(t.ctx, t.loader, toLoad)
+		if err != nil {
+			vlog.V(2).Printf("Error loading deps of candidates; not looking for cycles through them:\n%v", err)
+			break
+		}
+		toVisit = make(map[bazel.Label][]bazel.Label)
+		for l, deps := range next {
+			for _, d := range deps {
+				if r := loaded[d]; r != nil {
+					toVisit[l] = append(toVisit[l], directDeps(r)...)
+				}
+			}
+		}
+	}
+	for l, deps := range ret {
+		t.memo[l] = deps
+	}
+}
+
+func directDeps(rule *bazel.Rule) []bazel.Label {
+	var ret []bazel.Label
+	for _, attr := range cycleAttrs {
+		ret = append(ret, rule.LabelListAttr(attr)...)
+	}
+	return ret
+}
@@ -0,0 +1,114 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jadeplib
+
+import (
+	"sort"
+	"strings"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/pkgloading"
+)
+
+// DanglingDeps returns the deps of each of rules that don't exist: their package loads, but defines no rule, file or
+// package group by that name. Such deps fail the build, and usually remain after their target was renamed or deleted.
+// Deps in packages that fail to load, or in external repositories, are assumed to exist.
+// Rules without dangling deps are omitted, and each rule's dangling deps are sorted.
+func DanglingDeps(ctx context.Context, loader pkgloading.Loader, rules []*bazel.Rule) (map[*bazel.Rule][]bazel.Label, error) {
+	var pkgNames []string
+	seen := make(map[string]bool)
+	for _, r := range rules {
+		for l := range deps(r) {
+			if pkgName, _ := l.Split(); !seen[pkgName] && !strings.HasPrefix(string(l), "@") {
+				seen[pkgName] = true
+				pkgNames = append(pkgNames, pkgName)
+			}
+		}
+	}
+	if len(pkgNames) == 0 {
+		return nil, nil
+	}
+	sort.Strings(pkgNames)
+	pkgs, err := loader.Load(ctx, pkgNames)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[*bazel.Rule][]bazel.Label)
+	for _, r := range rules {
+		var dangling []bazel.Label
+		for l := range deps(r) {
+			if isDangling(pkgs, l) {
+				dangling = append(dangling, l)
+			}
+		}
+		if len(dangling) > 0 {
+			sort.Slice(dangling, func(i, j int) bool { return dangling[i] < dangling[j] })
+			ret[r] = dangling
+		}
+	}
+	return ret, nil
+}
+
+// DepsByAttribute maps the deps of each rule in deps to the DepsAttributes of the rule that list them, e.g. to remove
+// dangling deps from where they were found. A dep that several attributes list is mapped from each of them.
+func DepsByAttribute(deps map[*bazel.Rule][]bazel.Label) map[*bazel.Rule]map[string][]bazel.Label {
+	ret := make(map[*bazel.Rule]map[string][]bazel.Label)
+	for rule, labels := range deps {
+		for _, attr := range DepsAttributes(rule) {
+			listed := make(map[bazel.Label]bool)
+			for _, d := range rule.StringListAttr(attr) {
+				if l, err := bazel.ParseRelativeLabel(rule.PkgName, d); err == nil {
+					listed[l] = true
+				}
+			}
+			for _, l := range labels {
+				if listed[l] {
+					if ret[rule] == nil {
+						ret[rule] = make(map[string][]bazel.Label)
+					}
+					ret[rule][attr] = append(ret[rule][attr], l)
+				}
+			}
+		}
+	}
+	return ret
+}
+
+// isDangling returns true if the package of label is in pkgs, but doesn't define label.
+func isDangling(pkgs map[string]*bazel.Package, label bazel.Label) bool {
+	if strings.HasPrefix(string(label), "@") {
+		return false
+	}
+	pkgName, name := label.Split()
+	pkg := pkgs[pkgName]
+	if pkg == nil {
+		return false
+	}
+	_, isRule := pkg.Rules[name]
+	_, isFile := pkg.Files[name]
+	_, isGroup := pkg.PackageGroups[name]
+	return !isRule && !isFile && !isGroup
+}
+
+// isDanglingDep returns true if label is one of dangling.
+func isDanglingDep(dangling []bazel.Label, label bazel.Label) bool {
+	for _, l := range dangling {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
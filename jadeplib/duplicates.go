@@ -0,0 +1,118 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jadeplib
+
+import (
+	"sort"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/filter"
+	"github.com/bazelbuild/tools_jvm_autodeps/pkgloading"
+	"github.com/bazelbuild/tools_jvm_autodeps/vlog"
+)
+
+// DuplicateDep is a dep of a rule that the rule's exports already provide, since a rule's exports are also its deps.
+type DuplicateDep struct {
+	Dep bazel.Label
+
+	// Export is the export of the rule that provides Dep: either Dep itself, when it's listed in both deps and exports,
+	// or an export that exports Dep, possibly transitively.
+	Export bazel.Label
+}
+
+// DuplicateDeps returns the deps of each of rules that their exports already provide. Such deps can be removed without changing the build.
+// Umbrella rules are skipped, since Jadep adds their deps to their exports.
+// Rules without duplicate deps are omitted, and each rule's duplicate deps are sorted.
+func DuplicateDeps(ctx context.Context, loader pkgloading.Loader, rules []*bazel.Rule) map[*bazel.Rule][]DuplicateDep {
+	ret := make(map[*bazel.Rule][]DuplicateDep)
+	for _, r := range rules {
+		if filter.IsUmbrella(r) {
+			continue
+		}
+		var exported map[bazel.Label]bazel.Label
+		var dups []DuplicateDep
+		for _, dep := range r.LabelListAttr("deps") {
+			if exported == nil {
+				exported = exportedVia(ctx, loader, r)
+			}
+			if export, ok := exported[dep]; ok {
+				dups = append(dups, DuplicateDep{dep, export})
+			}
+		}
+		if len(dups) > 0 {
+			sort.Slice(dups, func(i, j int) bool { return dups[i].Dep < dups[j].Dep })
+			ret[r] = dups
+		}
+	}
+	return ret
+}
+
+// exportedVia maps the labels that rule exports, transitively, to the export of rule through which each is exported.
+// Rules that can't be loaded are skipped, since their only consequence is that fewer duplicate deps are found.
+func exportedVia(ctx context.Context, loader pkgloading.Loader, rule *bazel.Rule) map[bazel.Label]bazel.Label {
+	ret := make(map[bazel.Label]bazel.Label)
+	var toVisit []bazel.Label
+	for _, l := range rule.LabelListAttr("exports") {
+		if _, ok := ret[l]; !ok {
+			ret[l] = l
+			toVisit = append(toVisit, l)
+		}
+	}
+	for len(toVisit) > 0 {
+		rules, _, err := pkgloading.LoadRules(ctx, loader, toVisit)
+		if err != nil {
+			vlog.V(2).Printf("Error loading rules exported by %s; not looking for duplicate deps through them:\n%v", rule.Label(), err)
+			break
+		}
+		var next []bazel.Label
+		for _, l := range toVisit {
+			r := rules[l]
+			if r == nil {
+				continue
+			}
+			for _, e := range r.LabelListAttr("exports") {
+				if _, ok := ret[e]; !ok {
+					ret[e] = ret[l]
+					next = append(next, e)
+				}
+			}
+		}
+		toVisit = next
+	}
+	return ret
+}
+
+// DuplicateDepLabels returns the labels of the deps in dups.
+func DuplicateDepLabels(dups map[*bazel.Rule][]DuplicateDep) map[*bazel.Rule][]bazel.Label {
+	ret := make(map[*bazel.Rule][]bazel.Label)
+	for r, ds := range dups {
+		for _, d := range ds {
+			ret[r] = append(ret[r], d.Dep)
+		}
+	}
+	return ret
+}
+
+// DuplicateDepsByAttribute returns the labels of the deps in dups by the attribute they're listed in, which is always 'deps',
+// e.g. to remove them with buildozer.RemoveDepsFromAttributes, rather than from the attribute that Jadep adds deps to,
+// which differs for the kinds in filter.DepsAttributeByKind.
+func DuplicateDepsByAttribute(dups map[*bazel.Rule][]DuplicateDep) map[*bazel.Rule]map[string][]bazel.Label {
+	ret := make(map[*bazel.Rule]map[string][]bazel.Label)
+	for r, labels := range DuplicateDepLabels(dups) {
+		ret[r] = map[string][]bazel.Label{"deps": labels}
+	}
+	return ret
+}
@@ -0,0 +1,72 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jadeplib
+
+import (
+	"path/filepath"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/pkgloading"
+	"github.com/bazelbuild/tools_jvm_autodeps/vlog"
+)
+
+// locallySatisfied returns, for each rule in rulesToFix, the class names that are provided by its own srcs or by the srcs of
+// its direct deps. These classes don't need to be resolved for that rule.
+// The classes each rule provides are looked up in config.ProvidedClasses, if set.
+// Errors are logged and ignored, since their only consequence is that resolvers are asked about more classes.
+func locallySatisfied(ctx context.Context, config Config, rulesToFix []*bazel.Rule, depsOfRuleToFix map[bazel.Label]map[bazel.Label]bool, classNames []ClassName) map[bazel.Label]map[ClassName]bool {
+	var depLabels []bazel.Label
+	for _, deps := range depsOfRuleToFix {
+		for l := range deps {
+			depLabels = append(depLabels, l)
+		}
+	}
+	depRules, pkgs, err := pkgloading.LoadRules(ctx, config.Loader, depLabels)
+	if err != nil {
+		vlog.V(2).Printf("Error loading deps of rules to fix; not looking for classes they provide:\n%v", err)
+	}
+
+	cache := config.ProvidedClasses
+	if cache == nil {
+		cache = NewProvidedClasses()
+	}
+	providedBy := func(rule *bazel.Rule) []ClassName {
+		pkgDir := filepath.Join(config.WorkspaceDir, rule.PkgName)
+		if pkg := pkgs[rule.PkgName]; pkg != nil {
+			pkgDir = pkg.Path
+		}
+		return cache.Get(pkgDir, rule)
+	}
+
+	ret := make(map[bazel.Label]map[ClassName]bool)
+	for _, rule := range rulesToFix {
+		var ruleProvides []ClassName
+		ruleProvides = append(ruleProvides, providedBy(rule)...)
+		for l := range depsOfRuleToFix[rule.Label()] {
+			if dep := depRules[l]; dep != nil {
+				ruleProvides = append(ruleProvides, providedBy(dep)...)
+			}
+		}
+		satisfied := make(map[ClassName]bool)
+		for _, cls := range classNames {
+			if providesClass(ruleProvides, cls) {
+				satisfied[cls] = true
+			}
+		}
+		ret[rule.Label()] = satisfied
+	}
+	return ret
+}
@@ -0,0 +1,207 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jadeplib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/pkgloading"
+	"github.com/bazelbuild/tools_jvm_autodeps/vlog"
+)
+
+// AnnotationProcessor describes the classes that an annotation processor generates from the classes it processes.
+// No rule provides such classes, since they only exist while the rule whose srcs they're generated from is compiled.
+type AnnotationProcessor struct {
+	// ProcessorClass is the 'processor_class' of the java_plugin rules that run the processor.
+	ProcessorClass string
+
+	// Generated matches the simple names of the generated classes. Its first group is the simple name of the top-level class
+	// they're generated from, e.g. ^AutoValue_([^_]+) matches AutoValue_Foo_Bar, which is generated from Foo.Bar.
+	Generated *regexp.Regexp
+
+	// Plugin, if not empty, is the java_plugin suggested to rules that reference the generated classes without running the processor.
+	Plugin bazel.Label
+}
+
+// DefaultAnnotationProcessors are the widely used annotation processors whose generated classes Jadep recognizes.
+var DefaultAnnotationProcessors = []AnnotationProcessor{
+	{ProcessorClass: "com.google.auto.value.processor.AutoValueProcessor", Generated: regexp.MustCompile(`^AutoValue_([^_]+)`)},
+	{ProcessorClass: "com.google.auto.value.processor.AutoOneOfProcessor", Generated: regexp.MustCompile(`^AutoOneOf_([^_]+)`)},
+	{ProcessorClass: "com.google.auto.value.processor.AutoBuilderProcessor", Generated: regexp.MustCompile(`^AutoBuilder_([^_]+)`)},
+	{ProcessorClass: "com.google.auto.value.processor.AutoAnnotationProcessor", Generated: regexp.MustCompile(`^AutoAnnotation_([^_]+)`)},
+	{ProcessorClass: "dagger.internal.codegen.ComponentProcessor", Generated: regexp.MustCompile(`^Dagger([A-Z][^_]*)`)},
+	{ProcessorClass: "dagger.internal.codegen.ComponentProcessor", Generated: regexp.MustCompile(`^([^_]+)_(?:Factory|MembersInjector)$`)},
+}
+
+// ReadAnnotationProcessors reads annotation processors from r, one per line: the processor class, the regular expression
+// its generated classes match (see AnnotationProcessor.Generated) and, optionally, the label of the plugin to suggest, separated by spaces, e.g.
+// 'com.google.auto.value.processor.AutoValueProcessor ^AutoValue_([^_]+) //third_party/java/auto:value'.
+// Empty lines and lines starting with '#' are ignored.
+func ReadAnnotationProcessors(r io.Reader) ([]AnnotationProcessor, error) {
+	var ret []AnnotationProcessor
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected 'processor_class regexp [plugin]', got %q", lineNo, line)
+		}
+		re, err := regexp.Compile(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		if re.NumSubexp() < 1 {
+			return nil, fmt.Errorf("line %d: %q has no group matching the class the generated classes are generated from", lineNo, fields[1])
+		}
+		p := AnnotationProcessor{ProcessorClass: fields[0], Generated: re}
+		if len(fields) == 3 {
+			l, err := bazel.ParseAbsoluteLabel(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNo, err)
+			}
+			p.Plugin = l
+		}
+		ret = append(ret, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// GeneratedClass is a class name that an annotation processor generates from the srcs of the rule that references it.
+type GeneratedClass struct {
+	ClassName ClassName
+	Processor AnnotationProcessor
+
+	// Runs is true if the rule runs the processor, either through its plugins or through the exported_plugins of its deps.
+	Runs bool
+}
+
+// GeneratedClasses returns the class names among classNames that an annotation processor generates from the srcs of each of rules.
+// A class name is generated from a rule's srcs if it matches the Generated expression of one of processors, which are tried in order,
+// and the class it's generated from is in a file that the rule srcs, e.g. com.foo.AutoValue_Bar is generated from com/foo/Bar.java.
+// The first candidate of each class name in missingDeps counts as a dep of its rule, since it's the one that's added,
+// and the library that provides a processor's annotations often exports its plugin.
+// Rules that reference no generated classes are omitted.
+func GeneratedClasses(ctx context.Context, loader pkgloading.Loader, rules []*bazel.Rule, classNames []ClassName, processors []AnnotationProcessor, missingDeps map[*bazel.Rule]map[ClassName][]bazel.Label) map[*bazel.Rule][]GeneratedClass {
+	ret := make(map[*bazel.Rule][]GeneratedClass)
+	for _, rule := range rules {
+		srcs := make(map[string]bool)
+		for _, l := range srcLabels(rule) {
+			srcs[labelPath(l)] = true
+		}
+		var generated []GeneratedClass
+		for _, cls := range classNames {
+			for _, p := range processors {
+				if generatedFrom(cls, p, srcs) {
+					generated = append(generated, GeneratedClass{ClassName: cls, Processor: p})
+					break
+				}
+			}
+		}
+		if len(generated) == 0 {
+			continue
+		}
+		var added []bazel.Label
+		for _, lbls := range missingDeps[rule] {
+			if len(lbls) > 0 {
+				added = append(added, lbls[0])
+			}
+		}
+		runs := processorClasses(ctx, loader, rule, added)
+		for i := range generated {
+			generated[i].Runs = runs[generated[i].Processor.ProcessorClass]
+		}
+		sort.Slice(generated, func(i, j int) bool { return generated[i].ClassName < generated[j].ClassName })
+		ret[rule] = generated
+	}
+	return ret
+}
+
+// generatedFrom returns true if p generates cls from a class in one of srcs, which are paths relative to the workspace root.
+func generatedFrom(cls ClassName, p AnnotationProcessor, srcs map[string]bool) bool {
+	s := string(cls)
+	javaPkg, simpleName := "", s
+	if i := strings.LastIndex(s, "."); i != -1 {
+		javaPkg, simpleName = s[:i], s[i+1:]
+	}
+	m := p.Generated.FindStringSubmatch(simpleName)
+	if len(m) < 2 || m[1] == "" {
+		return false
+	}
+	suffix := path.Join(strings.Replace(javaPkg, ".", "/", -1), m[1]+".java")
+	for src := range srcs {
+		if src == suffix || strings.HasSuffix(src, "/"+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// processorClasses returns the processor classes of the plugins that rule runs: its own plugins, and the exported_plugins of its deps,
+// of extraDeps, and of the rules they export. Rules that can't be loaded are skipped, so their plugins are reported as missing.
+func processorClasses(ctx context.Context, loader pkgloading.Loader, rule *bazel.Rule, extraDeps []bazel.Label) map[string]bool {
+	depLabels := append(rule.LabelListAttr("deps"), rule.LabelListAttr("exports")...)
+	depLabels = append(depLabels, extraDeps...)
+	deps, _, err := pkgloading.LoadRules(ctx, loader, depLabels)
+	if err != nil {
+		vlog.V(2).Printf("Error loading deps of %s; not looking for the plugins they export:\n%v", rule.Label(), err)
+	}
+	plugins := rule.LabelListAttr("plugins")
+	exported := newExportedRules(ctx, loader)
+	var withExports []bazel.Label
+	for _, l := range depLabels {
+		if r := deps[l]; r != nil {
+			withExports = append(withExports, l)
+			for e := range exported.of(r) {
+				withExports = append(withExports, e)
+			}
+		}
+	}
+	exporters, _, err := pkgloading.LoadRules(ctx, loader, withExports)
+	if err != nil {
+		vlog.V(2).Printf("Error loading the exports of the deps of %s; not looking for the plugins they export:\n%v", rule.Label(), err)
+	}
+	for _, r := range exporters {
+		plugins = append(plugins, r.LabelListAttr("exported_plugins")...)
+	}
+
+	ret := make(map[string]bool)
+	pluginRules, _, err := pkgloading.LoadRules(ctx, loader, plugins)
+	if err != nil {
+		vlog.V(2).Printf("Error loading the plugins of %s:\n%v", rule.Label(), err)
+		return ret
+	}
+	for _, r := range pluginRules {
+		if cls, ok := r.Attrs["processor_class"].(string); ok {
+			ret[cls] = true
+		}
+	}
+	return ret
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jadeplib
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+)
+
+// HealthSignals reports what build metadata (e.g., the results of continuous builds) knows of the health of targets,
+// so that MissingDeps can avoid suggesting chronically broken targets, and rankers can take health into account.
+// See package healthsignals for implementations.
+type HealthSignals interface {
+	// Health returns the health of those of labels that the backend knows of. Unknown targets are assumed healthy.
+	Health(ctx context.Context, labels []bazel.Label) (map[bazel.Label]TargetHealth, error)
+}
+
+// TargetHealth describes the health of a target.
+type TargetHealth struct {
+	// Broken is true if the last known build of the target failed.
+	Broken bool
+
+	// Flakiness is the fraction of the target's recent builds or test runs that failed nondeterministically, between 0 and 1.
+	Flakiness float64
+
+	// Owners are the people or teams responsible for the target, for display.
+	Owners []string
+}
+
+// unhealthyReason returns why a target of health h shouldn't be suggested, or "" if it can be.
+// If maxFlakiness isn't positive, flakiness doesn't make targets unhealthy.
+func (h TargetHealth) unhealthyReason(maxFlakiness float64) string {
+	if h.Broken {
+		return "broken in its last known build"
+	}
+	if maxFlakiness > 0 && h.Flakiness > maxFlakiness {
+		return fmt.Sprintf("flaky (%.0f%% of recent runs failed)", h.Flakiness*100)
+	}
+	return ""
+}
+
+// dropUnhealthy removes the candidates in missingRuleDeps that config.HealthSignals reports as unhealthy,
+// but only for class names that have a healthy candidate left, like visibility filtering does.
+// If the health of candidates can't be queried, they're all kept.
+func dropUnhealthy(ctx context.Context, config Config, missingRuleDeps map[*bazel.Rule]map[ClassName][]bazel.Label, decisions *Decisions) {
+	if config.HealthSignals == nil || len(missingRuleDeps) == 0 {
+		return
+	}
+	seen := make(map[bazel.Label]bool)
+	var labels []bazel.Label
+	for _, classToLabels := range missingRuleDeps {
+		for _, candidates := range classToLabels {
+			for _, l := range candidates {
+				if !seen[l] {
+					seen[l] = true
+					labels = append(labels, l)
+				}
+			}
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i] < labels[j] })
+	health, err := config.HealthSignals.Health(ctx, labels)
+	if err != nil {
+		log.Printf("WARNING: Error querying the health of candidate dependencies; not filtering them:\n%v", err)
+		return
+	}
+	for consRule, classToLabels := range missingRuleDeps {
+		for cls, candidates := range classToLabels {
+			var healthy []bazel.Label
+			unhealthy := make(map[bazel.Label]string)
+			for _, l := range candidates {
+				if reason := health[l].unhealthyReason(config.MaxFlakiness); reason != "" {
+					unhealthy[l] = reason
+				} else {
+					healthy = append(healthy, l)
+				}
+			}
+			if len(unhealthy) == 0 {
+				continue
+			}
+			if len(healthy) == 0 {
+				log.Printf("No healthy rules provide class %q; returning all results.", cls)
+				continue
+			}
+			for l, reason := range unhealthy {
+				decisions.reject(consRule.Label(), cls, l, reason)
+			}
+			classToLabels[cls] = healthy
+		}
+	}
+}
@@ -13,11 +13,16 @@
 // limitations under the License.
 
 // Package jadeplib finds a list of BUILD labels that provide the requested Java class names.
-package jadeplib
+//
+// Tools that use Jadep programmatically should depend on this package, together with the Loader and Resolver
+// implementations they need, using the canonical import path below.
+package jadeplib // import "github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
+	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
@@ -29,6 +34,7 @@ import (
 	"github.com/bazelbuild/tools_jvm_autodeps/compat"
 	"github.com/bazelbuild/tools_jvm_autodeps/filter"
 	"github.com/bazelbuild/tools_jvm_autodeps/future"
+	"github.com/bazelbuild/tools_jvm_autodeps/graphs"
 	"github.com/bazelbuild/tools_jvm_autodeps/pkgloading"
 	"github.com/bazelbuild/tools_jvm_autodeps/vlog"
 )
@@ -45,6 +51,36 @@ type Config struct {
 	Resolvers []Resolver
 
 	DepsRanker DepsRanker
+
+	// ProvidedClasses caches the classes declared by the srcs of rules, and is shared between calls to MissingDeps.
+	// If nil, MissingDeps scans source files anew on each call.
+	ProvidedClasses *ProvidedClasses
+
+	// AnalysisCache memoizes which packages files belong to and which rules consume them, for the duration of a Jadep invocation.
+	// If nil, RulesConsumingFile looks for the packages of files anew on each call.
+	AnalysisCache *AnalysisCache
+
+	// ResolutionCache memoizes the ranked rules that provide each class name, and is shared between calls to MissingDeps.
+	// It must only be set when Resolvers return the same rules for a class name regardless of the consuming rules.
+	// If nil, MissingDeps resolves and ranks class names anew on each call.
+	ResolutionCache *ResolutionCache
+
+	// CycleCheckDepth is how many levels of the dependencies of each candidate MissingDeps follows, loading packages
+	// as needed, to drop the candidates that depend on the consuming rule, since adding them would create a cycle.
+	// If it's not positive, candidates aren't checked for cycles.
+	CycleCheckDepth int
+
+	// HealthSignals, when not nil, reports the health of candidate dependencies. Unhealthy candidates aren't suggested
+	// when a healthy candidate provides the same class.
+	HealthSignals HealthSignals
+
+	// MaxFlakiness is the flakiness (see TargetHealth) above which candidates are unhealthy.
+	// If it's not positive, only broken candidates are unhealthy.
+	MaxFlakiness float64
+
+	// Wrappers maps the labels of external targets, e.g. @guava//jar:guava, to the in-repo targets that wrap them (see WrapperProvider).
+	// Candidates that have a wrapper are replaced by it, and a dep on an external target counts as a dep on its wrapper.
+	Wrappers map[bazel.Label]*bazel.Rule
 }
 
 // Resolver defines methods to resolve class names to Bazel rules.
@@ -58,12 +94,106 @@ type Resolver interface {
 
 // DepsRanker defines methods to rank dependencies so it's easier for users to choose the right option.
 type DepsRanker interface {
-	// Less is used in a call to sort.Slice() to rank dependencies before asking a user to choose one.
+	// Less is used in a call to sort.SliceStable() to rank dependencies before asking a user to choose one.
 	// Less should position the dependency a user is most likely to choose, first.
 	// In other words, the label that should appear first should satisfy Less(ctx, label, x) == true for all x.
 	Less(ctx context.Context, label1, label2 bazel.Label) bool
 }
 
+// DepsScorer may optionally be implemented by a DepsRanker to assign a confidence score to each candidate dependency.
+// Scores are used to decide whether a dependency can be added without asking the user (see AutoSelectDeps).
+type DepsScorer interface {
+	// Score returns the confidence, between 0 and 1, that label is the right dependency to satisfy className,
+	// given that candidates (which include label) all provide it.
+	Score(ctx context.Context, className ClassName, label bazel.Label, candidates []bazel.Label) float64
+}
+
+// PackageDepsScorer may optionally be implemented by a DepsRanker to score candidates in the context of the package of the
+// rule that will depend on them, e.g. to be confident about the dependency that other rules in that package already use.
+type PackageDepsScorer interface {
+	// ScoreInPackage is like DepsScorer.Score, but receives pkg, the package of the consuming rule, instead of the class name.
+	ScoreInPackage(ctx context.Context, pkg *bazel.Package, label bazel.Label, candidates []bazel.Label) float64
+}
+
+// PackageDepsRanker may optionally be implemented by a DepsRanker to rank dependencies in the context of the package
+// of the rule that will depend on them, e.g. to prefer the dependencies that other rules in that package already use.
+type PackageDepsRanker interface {
+	// LessInPackage is like Less, but also receives pkg, the package of the consuming rule.
+	// It's used to re-rank the candidates of each consuming rule after they're filtered.
+	LessInPackage(ctx context.Context, pkg *bazel.Package, label1, label2 bazel.Label) bool
+}
+
+// BatchDepsRanker may optionally be implemented by a DepsRanker to rank all the candidates for a class name at once,
+// knowing which rule will depend on them. This allows rankers to score candidates in batches, e.g. by querying a service,
+// and to take the consuming rule and class name into account.
+type BatchDepsRanker interface {
+	// RankDeps returns candidates, best first. consumingRule is nil if it isn't known.
+	// It must return a permutation of candidates; otherwise, the ranking is ignored.
+	RankDeps(ctx context.Context, consumingRule *bazel.Rule, class ClassName, candidates []bazel.Label) []bazel.Label
+}
+
+// RankDeps returns candidates for class, ranked best first by ranker. candidates isn't modified.
+// If ranker doesn't implement BatchDepsRanker, candidates are sorted using Less, with ties kept in order.
+func RankDeps(ctx context.Context, ranker DepsRanker, consumingRule *bazel.Rule, class ClassName, candidates []bazel.Label) []bazel.Label {
+	ret := append([]bazel.Label(nil), candidates...)
+	batch, ok := ranker.(BatchDepsRanker)
+	if !ok {
+		rankLabels(ctx, ranker, ret)
+		return ret
+	}
+	ranked := batch.RankDeps(ctx, consumingRule, class, ret)
+	if !isPermutation(ranked, candidates) {
+		log.Printf("WARNING: Ignoring the ranking of candidates for %s, since it doesn't contain exactly the candidates %v: %v", class, candidates, ranked)
+		return append(ret[:0], candidates...)
+	}
+	return ranked
+}
+
+// isPermutation returns true iff a and b contain the same labels, the same number of times.
+func isPermutation(a, b []bazel.Label) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	count := make(map[bazel.Label]int)
+	for _, l := range a {
+		count[l]++
+	}
+	for _, l := range b {
+		count[l]--
+		if count[l] < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// ScoreCandidates returns the score of each of candidates as a dependency for className.
+// If ranker doesn't implement DepsScorer, the confidence is split evenly between candidates, so only a sole candidate
+// is ever certain.
+func ScoreCandidates(ctx context.Context, ranker DepsRanker, className ClassName, candidates []bazel.Label) []float64 {
+	return ScoreCandidatesInPackage(ctx, ranker, nil, className, candidates)
+}
+
+// ScoreCandidatesInPackage is like ScoreCandidates, but scores candidates in the context of pkg, the package of the consuming rule,
+// if ranker implements PackageDepsScorer and pkg isn't nil.
+func ScoreCandidatesInPackage(ctx context.Context, ranker DepsRanker, pkg *bazel.Package, className ClassName, candidates []bazel.Label) []float64 {
+	ret := make([]float64, len(candidates))
+	pkgScorer, inPkg := ranker.(PackageDepsScorer)
+	inPkg = inPkg && pkg != nil
+	scorer, ok := ranker.(DepsScorer)
+	for i, c := range candidates {
+		switch {
+		case inPkg:
+			ret[i] = pkgScorer.ScoreInPackage(ctx, pkg, c, candidates)
+		case ok:
+			ret[i] = scorer.Score(ctx, className, c, candidates)
+		default:
+			ret[i] = 1 / float64(len(candidates))
+		}
+	}
+	return ret
+}
+
 // ClassName is a class name, e.g. com.google.Foo.
 type ClassName string
 
@@ -73,31 +203,185 @@ type ClassName string
 // the set of missing dependencies. A missing dependency is reported as a map
 // ClassName -> []bazel.Label, which details which classnames can be satisfied by which dependencies.
 // It also returns a list of classnames that were unable to be resolved.
+//
+// The result is deterministic: the candidates of each class name are ranked by config.DepsRanker, with ties kept in the
+// order the resolvers returned them in, and unresolved class names are sorted. Go maps have no order, so callers iterating
+// the result should use SortedRules and SortedClassNames to report or edit rules in a stable order.
+//
+// MissingDeps checks for cancellation of ctx between stages, and returns ctx.Err() if it was cancelled.
+// This allows long-running callers (e.g., an editor integration) to abandon requests that have been superseded.
 func MissingDeps(ctx context.Context, config Config, rulesToFix []*bazel.Rule, classNames []ClassName) (map[*bazel.Rule]map[ClassName][]bazel.Label, []ClassName, error) {
+	missing, unresolved, _, err := missingDeps(ctx, config, rulesToFix, classNames, nil)
+	return missing, unresolved, err
+}
+
+// MissingDepsWithErrors is like MissingDeps, but also returns the errors that affected individual class names.
+// A class name is unresolved because resolvers failed, or is missing from the result because the packages needed to
+// check the visibility of its candidates failed to load. Such errors don't stop the other class names from being processed.
+func MissingDepsWithErrors(ctx context.Context, config Config, rulesToFix []*bazel.Rule, classNames []ClassName) (map[*bazel.Rule]map[ClassName][]bazel.Label, []ClassName, map[ClassName]error, error) {
+	return missingDeps(ctx, config, rulesToFix, classNames, nil)
+}
+
+// Decisions records the intermediate decisions MissingDeps makes, to explain why a label was or wasn't suggested.
+type Decisions struct {
+	// Resolved maps class names to the labels resolvers returned for them, before any filtering.
+	Resolved map[ClassName][]bazel.Label
+
+	// AlreadySatisfied[consumingRule][cls] is true if consumingRule already depends on a rule that provides cls,
+	// in which case none of the candidates for cls are suggested.
+	AlreadySatisfied map[bazel.Label]map[ClassName]bool
+
+	// Rejected[consumingRule][cls][candidate] is the reason candidate wasn't suggested for cls in consumingRule.
+	// Candidates that aren't visible to consumingRule are rejected with reason NotVisible, but only when a visible candidate exists.
+	Rejected map[bazel.Label]map[ClassName]map[bazel.Label]string
+}
+
+// NotVisible is the reason recorded in Decisions.Rejected for candidates that aren't visible to the consuming rule.
+const NotVisible = "not visible"
+
+func (d *Decisions) reject(consumingRule bazel.Label, cls ClassName, candidate bazel.Label, reason string) {
+	if d == nil {
+		return
+	}
+	if d.Rejected[consumingRule] == nil {
+		d.Rejected[consumingRule] = make(map[ClassName]map[bazel.Label]string)
+	}
+	if d.Rejected[consumingRule][cls] == nil {
+		d.Rejected[consumingRule][cls] = make(map[bazel.Label]string)
+	}
+	d.Rejected[consumingRule][cls][candidate] = reason
+}
+
+func (d *Decisions) alreadySatisfied(consumingRule bazel.Label, cls ClassName) {
+	if d == nil {
+		return
+	}
+	if d.AlreadySatisfied[consumingRule] == nil {
+		d.AlreadySatisfied[consumingRule] = make(map[ClassName]bool)
+	}
+	d.AlreadySatisfied[consumingRule][cls] = true
+}
+
+// ExplainMissingDeps is like MissingDeps, but also returns the decisions it made while filtering candidates.
+func ExplainMissingDeps(ctx context.Context, config Config, rulesToFix []*bazel.Rule, classNames []ClassName) (map[*bazel.Rule]map[ClassName][]bazel.Label, []ClassName, *Decisions, error) {
+	decisions := &Decisions{
+		Resolved:         make(map[ClassName][]bazel.Label),
+		AlreadySatisfied: make(map[bazel.Label]map[ClassName]bool),
+		Rejected:         make(map[bazel.Label]map[ClassName]map[bazel.Label]string),
+	}
+	missing, unresolved, _, err := missingDeps(ctx, config, rulesToFix, classNames, decisions)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return missing, unresolved, decisions, nil
+}
+
+// missingDeps implements MissingDepsWithErrors. If decisions is not nil, it is filled with the decisions made along the way.
+func missingDeps(ctx context.Context, config Config, rulesToFix []*bazel.Rule, classNames []ClassName, decisions *Decisions) (map[*bazel.Rule]map[ClassName][]bazel.Label, []ClassName, map[ClassName]error, error) {
+	// Deps that don't exist provide no classes, so the classes they were meant to provide are resolved anew.
+	dangling, err := DanglingDeps(ctx, config.Loader, rulesToFix)
+	if err != nil {
+		vlog.V(2).Printf("Error loading deps of rules to fix; not looking for deps that don't exist:\n%v", err)
+	}
+	exported := newExportedRules(ctx, config.Loader)
 	depsOfRuleToFix := make(map[bazel.Label]map[bazel.Label]bool)
 	for _, r := range rulesToFix {
-		depsOfRuleToFix[r.Label()] = deps(r)
+		ruleDeps := deps(r)
+		for _, l := range dangling[r] {
+			delete(ruleDeps, l)
+		}
+		// A rule's exports are also its deps, so the classes they provide need no deps (see DuplicateDeps).
+		for l := range exported.of(r) {
+			ruleDeps[l] = true
+		}
+		addWrappers(ruleDeps, config.Wrappers)
+		depsOfRuleToFix[r.Label()] = ruleDeps
 	}
 
-	resolved, unresClassNames, _ := resolveAll(ctx, config.Resolvers, classNames, depsOfRuleToFix)
+	// Fast path: classes provided by the rules to fix themselves or by their direct deps need no resolving.
+	satisfied := locallySatisfied(ctx, config, rulesToFix, depsOfRuleToFix, classNames)
+	var toResolve []ClassName
+	for _, cls := range classNames {
+		for _, r := range rulesToFix {
+			if !satisfied[r.Label()][cls] {
+				toResolve = append(toResolve, cls)
+				break
+			}
+		}
+	}
+	for lbl, classes := range satisfied {
+		for cls := range classes {
+			decisions.alreadySatisfied(lbl, cls)
+		}
+	}
+	if len(toResolve) == 0 {
+		vlog.V(2).Printf("All class names are provided by the rules to fix or their deps")
+		return make(map[*bazel.Rule]map[ClassName][]bazel.Label), nil, nil, nil
+	}
+
+	resolved, unresClassNames, resolverErrs := resolveRanked(ctx, config, toResolve, depsOfRuleToFix)
+	if err := ctx.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+	preferWrappers(resolved, config.Wrappers)
+	classErrors := make(map[ClassName]error)
+	if len(resolverErrs) > 0 {
+		// Unresolved class names were passed to every resolver, including the ones that failed.
+		err := resolversError(resolverErrs)
+		for _, cls := range unresClassNames {
+			classErrors[cls] = err
+		}
+	}
+	if decisions != nil {
+		for cls, rules := range resolved {
+			for _, r := range rules {
+				decisions.Resolved[cls] = append(decisions.Resolved[cls], r.Label())
+			}
+		}
+	}
 
 	// Initially filter 'resolved' according to tags, rule type, etc.
 	// These do not require loading BUILD packages.
 	ctx, endSpan := compat.NewLocalSpan(ctx, "Jade: MissingDeps construct result")
 	filteredCandidates := make(map[*bazel.Rule]map[ClassName][]*bazel.Rule)
 	visQuery := make(map[filter.VisQuery]bool)
+	transitive := newTransitiveDeps(ctx, config.Loader, config.CycleCheckDepth)
+	var candidates []*bazel.Rule
+	for _, satisfyingRules := range resolved {
+		candidates = append(candidates, satisfyingRules...)
+	}
+	transitive.load(candidates)
 	for _, consumingRule := range rulesToFix {
 		lbl := consumingRule.Label()
 		candidatesForConsRule := make(map[ClassName][]*bazel.Rule)
 		for class, satisfyingRules := range resolved {
+			if satisfied[lbl][class] {
+				continue
+			}
 			if alreadySatisfied(lbl, depsOfRuleToFix[lbl], satisfyingRules) {
+				decisions.alreadySatisfied(lbl, class)
 				continue
 			}
 			for _, satRule := range satisfyingRules {
-				if filter.IsValidDependency(satRule) {
-					candidatesForConsRule[class] = append(candidatesForConsRule[class], satRule)
-					visQuery[filter.VisQuery{Rule: satRule, Pkg: consumingRule.PkgName}] = true
+				if reason := filter.InvalidDependencyReason(consumingRule, satRule); reason != "" {
+					decisions.reject(lbl, class, satRule.Label(), reason)
+					continue
+				}
+				if exported.of(satRule)[lbl] {
+					decisions.reject(lbl, class, satRule.Label(), fmt.Sprintf("exports %s, which would then depend on itself", lbl))
+					continue
+				}
+				if isDanglingDep(dangling[consumingRule], satRule.Label()) {
+					decisions.reject(lbl, class, satRule.Label(), "doesn't exist")
+					continue
 				}
+				if transitive.of(satRule)[lbl] {
+					vlog.V(2).Printf("Filtered because of a cycle: %q depends on %q", satRule.Label(), lbl)
+					decisions.reject(lbl, class, satRule.Label(), fmt.Sprintf("depends on %s, which would create a cycle", lbl))
+					continue
+				}
+				candidatesForConsRule[class] = append(candidatesForConsRule[class], satRule)
+				visQuery[filter.VisQuery{Rule: satRule, Pkg: consumingRule.PkgName}] = true
 			}
 		}
 		filteredCandidates[consumingRule] = candidatesForConsRule
@@ -106,7 +390,16 @@ func MissingDeps(ctx context.Context, config Config, rulesToFix []*bazel.Rule, c
 	// Further filter filteredCandidates according to visiblity and fill out missingRuleDeps for returning.
 	visResult, err := filter.CheckVisibility(ctx, config.Loader, visQuery)
 	if err != nil {
-		return nil, nil, err
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, nil, nil, ctxErr
+		}
+		log.Printf("Error checking visibility; checking each class name separately:\n%v", err)
+		visResult = checkVisibilityPerClass(ctx, config.Loader, filteredCandidates, classErrors)
+		for _, classToSatisfiers := range filteredCandidates {
+			for cls := range classErrors {
+				delete(classToSatisfiers, cls)
+			}
+		}
 	}
 	missingRuleDeps := make(map[*bazel.Rule]map[ClassName][]bazel.Label)
 	for consRule, classToSatisfiers := range filteredCandidates {
@@ -114,14 +407,20 @@ func MissingDeps(ctx context.Context, config Config, rulesToFix []*bazel.Rule, c
 		missingForConsRule := make(map[ClassName][]bazel.Label)
 		for cls, satisfyingRules := range classToSatisfiers {
 			var visible []bazel.Label
+			var invisible []bazel.Label
 			for _, satRule := range satisfyingRules {
 				if visResult[filter.VisQuery{Rule: satRule, Pkg: consPkgName}] {
 					visible = append(visible, satRule.Label())
 				} else {
 					vlog.V(2).Printf("Filtered because of visibility: %q is not visible to %q for class %q", satRule.Label(), consRule.Label(), cls)
+					invisible = append(invisible, satRule.Label())
 				}
 			}
-			if len(visible) == 0 {
+			if len(visible) > 0 {
+				for _, l := range invisible {
+					decisions.reject(consRule.Label(), cls, l, NotVisible)
+				}
+			} else {
 				log.Printf("No rules left for class %q after visibility filtering; returning all results.", cls)
 				for _, satRule := range satisfyingRules {
 					visible = append(visible, satRule.Label())
@@ -134,10 +433,54 @@ func MissingDeps(ctx context.Context, config Config, rulesToFix []*bazel.Rule, c
 		}
 	}
 
-	sortDependencies(ctx, config.DepsRanker, missingRuleDeps)
+	dropUnhealthy(ctx, config, missingRuleDeps, decisions)
+
+	// Candidates are already ranked, and filtering keeps their order.
+	rankForConsumingRules(ctx, config, missingRuleDeps)
+	preferProcessorScope(missingRuleDeps, filteredCandidates)
+	preferAPITargets(missingRuleDeps, filteredCandidates)
 	endSpan()
 
-	return missingRuleDeps, unresClassNames, nil
+	return missingRuleDeps, unresClassNames, classErrors, nil
+}
+
+// checkVisibilityPerClass checks the visibility of the candidates of each class name separately,
+// so that a package that fails to load only affects the class names whose candidates need it.
+// The errors of the class names whose visibility can't be checked are added to classErrors.
+func checkVisibilityPerClass(ctx context.Context, loader pkgloading.Loader, candidates map[*bazel.Rule]map[ClassName][]*bazel.Rule, classErrors map[ClassName]error) map[filter.VisQuery]bool {
+	queries := make(map[ClassName]map[filter.VisQuery]bool)
+	for consRule, classToSatisfiers := range candidates {
+		for cls, satisfyingRules := range classToSatisfiers {
+			if queries[cls] == nil {
+				queries[cls] = make(map[filter.VisQuery]bool)
+			}
+			for _, satRule := range satisfyingRules {
+				queries[cls][filter.VisQuery{Rule: satRule, Pkg: consRule.PkgName}] = true
+			}
+		}
+	}
+	ret := make(map[filter.VisQuery]bool)
+	for cls, q := range queries {
+		res, err := filter.CheckVisibility(ctx, loader, q)
+		if err != nil {
+			classErrors[cls] = fmt.Errorf("error checking visibility of rules providing %s:\n%v", cls, err)
+			continue
+		}
+		for vq, visible := range res {
+			ret[vq] = visible
+		}
+	}
+	return ret
+}
+
+// resolversError combines the errors of failed resolvers into one error.
+func resolversError(errs map[Resolver]error) error {
+	var msgs []string
+	for res, err := range errs {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", res.Name(), err))
+	}
+	sort.Strings(msgs)
+	return fmt.Errorf("resolvers failed:\n%s", strings.Join(msgs, "\n"))
 }
 
 // UnfilteredMissingDeps returns Labels that can be used to satisfy missing dependencies.
@@ -152,42 +495,133 @@ func UnfilteredMissingDeps(ctx context.Context, config Config, classNames []Clas
 		for _, r := range rules {
 			labels = append(labels, r.Label())
 		}
-		sort.Slice(labels, func(i, j int) bool { return config.DepsRanker.Less(ctx, labels[i], labels[j]) })
+		rankLabels(ctx, config.DepsRanker, labels)
 		resolved[cls] = labels
 	}
 	return resolved, unresolved
 }
 
+// ResolveWithProvenance calls every resolver in config.Resolvers on classNames, unlike MissingDeps,
+// which stops at the first resolver that resolves a class name.
+// Returns, for each resolved class name, the labels of the rules that provide it, mapped to the names of the resolvers that returned them.
+// Errors of individual resolvers are logged, and don't stop the remaining resolvers from being called.
+func ResolveWithProvenance(ctx context.Context, config Config, classNames []ClassName) map[ClassName]map[bazel.Label][]string {
+	ret := make(map[ClassName]map[bazel.Label][]string)
+	for _, res := range config.Resolvers {
+		if err := ctx.Err(); err != nil {
+			log.Printf("Not calling remaining resolvers: %v", err)
+			break
+		}
+		resolved, err := res.Resolve(ctx, classNames, nil)
+		if err != nil {
+			log.Printf("Error when resolving using %s: %v", res.Name(), err)
+		}
+		for cls, rules := range resolved {
+			if len(rules) > 0 && ret[cls] == nil {
+				ret[cls] = make(map[bazel.Label][]string)
+			}
+			for _, r := range rules {
+				ret[cls][r.Label()] = append(ret[cls][r.Label()], res.Name())
+			}
+		}
+	}
+	return ret
+}
+
 // RulesConsumingFile returns the set of Java rules whose 'srcs' attribute contains 'fileName'.
 // fileName must be a path relative to config.WorkspaceDir.
+// Only the file's package and its ancestor packages are searched; rules in other packages that consume the file
+// by its label, e.g. through exports_files, aren't found.
+// Results are memoized in config.AnalysisCache, if set.
 func RulesConsumingFile(ctx context.Context, config Config, fileName string) ([]*bazel.Rule, error) {
-	pkgs, _, err := pkgloading.Siblings(ctx, config.Loader, config.WorkspaceDir, []string{fileName})
+	cache := config.AnalysisCache
+	if cache == nil {
+		cache = NewAnalysisCache()
+	}
+	if rules, ok := cache.rulesConsumingFile(fileName); ok {
+		return rules, nil
+	}
+	pkgs, fileToPkgName, err := pkgloading.SiblingsWithCache(ctx, config.Loader, config.WorkspaceDir, []string{fileName}, cache.PackageNames)
+	if err != nil {
+		return nil, err
+	}
+	ownerPkgName, ok := fileToPkgName[fileName]
+	if !ok {
+		return nil, nil
+	}
+	relativeFileName, err := filepath.Rel(ownerPkgName, fileName)
 	if err != nil {
 		return nil, err
 	}
+	fileLabel := bazel.Label("//" + ownerPkgName + ":" + filepath.ToSlash(relativeFileName))
 
-	var ret []*bazel.Rule
-	for consPkgName, consPkg := range pkgs {
-		relativeFileName, err := filepath.Rel(consPkgName, fileName)
-		if err != nil {
-			return nil, err
-		}
-		for _, consRule := range consPkg.Rules {
-			if filter.JavaEditableRuleKinds[consRule.Schema] && srcsFile(consRule, relativeFileName) {
-				ret = append(ret, consRule)
+	// Rules in other packages can consume the file using its label, e.g. srcs = ["//x:Foo.java"].
+	// Look for them in the packages enclosing the file's package.
+	ancestors, err := config.Loader.Load(ctx, pkgloading.AncestorPackages(ctx, config.WorkspaceDir, ownerPkgName, cache.PackageNames))
+	if err != nil {
+		return nil, err
+	}
+
+	// A rule can also consume the file through filegroups, which might be nested, or through the rule that generates it.
+	// srcsGraph maps each label in the srcs of a filegroup to the filegroup, and each generated file to its generating rule.
+	srcsGraph := make(map[string][]string)
+	var rules []*bazel.Rule
+	for _, p := range []map[string]*bazel.Package{pkgs, ancestors} {
+		for pkgName, consPkg := range p {
+			for _, consRule := range consPkg.Rules {
+				rules = append(rules, consRule)
 			}
+			for file, owner := range consPkg.Files {
+				if owner == "" {
+					continue
+				}
+				fileLabel := "//" + pkgName + ":" + file
+				srcsGraph[fileLabel] = append(srcsGraph[fileLabel], "//"+pkgName+":"+owner)
+			}
+		}
+	}
+	for _, r := range rules {
+		if r.Schema != "filegroup" {
+			continue
+		}
+		for _, src := range srcLabels(r) {
+			srcsGraph[string(src)] = append(srcsGraph[string(src)], string(r.Label()))
+		}
+	}
+	consumed := make(map[bazel.Label]bool)
+	graphs.DFS(srcsGraph, string(fileLabel), func(node string) { consumed[bazel.Label(node)] = true })
+
+	var ret []*bazel.Rule
+	for _, consRule := range rules {
+		if filter.JavaEditableRuleKinds[consRule.Schema] && srcsAny(consRule, consumed) {
+			ret = append(ret, consRule)
 		}
 	}
 	sort.Slice(ret, func(i, j int) bool { return ret[i].Label() < ret[j].Label() })
+	// When no rule consumes the file, callers usually create one, so that answer isn't memoized.
+	if len(ret) > 0 {
+		cache.setRulesConsumingFile(fileName, ret)
+	}
 	return ret, nil
 }
 
-// deps returns a set containing the 'deps' attribute of 'rule' in Label form.
+// DepsAttributes returns the attributes that hold the deps of rule: 'deps', and the attribute Jadep adds deps to
+// (see filter.DepsAttribute), e.g. 'exports' for umbrella targets, if it's another one.
+func DepsAttributes(rule *bazel.Rule) []string {
+	if attr := filter.DepsAttribute(rule); attr != "deps" {
+		return []string{"deps", attr}
+	}
+	return []string{"deps"}
+}
+
+// deps returns a set containing the labels in the DepsAttributes of 'rule'.
 func deps(rule *bazel.Rule) map[bazel.Label]bool {
 	ret := make(map[bazel.Label]bool)
-	for _, d := range rule.StringListAttr("deps") {
-		if l, err := bazel.ParseRelativeLabel(rule.PkgName, d); err == nil {
-			ret[l] = true
+	for _, attr := range DepsAttributes(rule) {
+		for _, d := range rule.StringListAttr(attr) {
+			if l, err := bazel.ParseRelativeLabel(rule.PkgName, d); err == nil {
+				ret[l] = true
+			}
 		}
 	}
 	return ret
@@ -195,6 +629,7 @@ func deps(rule *bazel.Rule) map[bazel.Label]bool {
 
 // resolveAll calls all resolvers sequentially, feeding the unresolved classes from resolver[i-1] into resolver[i].
 // Returns a map of resolved classnames -> rules, and a list of unresolved classes.
+// If ctx is cancelled, the remaining resolvers are not called and their class names are reported as unresolved.
 func resolveAll(ctx context.Context, resolvers []Resolver, classNames []ClassName, depsOfRuleToFix map[bazel.Label]map[bazel.Label]bool) (map[ClassName][]*bazel.Rule, []ClassName, map[Resolver]error) {
 	resultResolved := make(map[ClassName][]*bazel.Rule)
 	resultUnresolved := make(map[ClassName]bool)
@@ -206,10 +641,15 @@ func resolveAll(ctx context.Context, resolvers []Resolver, classNames []ClassNam
 		if len(resultUnresolved) == 0 {
 			break
 		}
+		if err := ctx.Err(); err != nil {
+			log.Printf("Not calling remaining resolvers: %v", err)
+			break
+		}
 		var classNames []ClassName
 		for cls := range resultUnresolved {
 			classNames = append(classNames, cls)
 		}
+		sort.Slice(classNames, func(i, j int) bool { return classNames[i] < classNames[j] })
 
 		tctx, endSpan := compat.NewLocalSpan(ctx, "Jade: Resolve ("+res.Name())
 		stopwatch := time.Now()
@@ -237,39 +677,219 @@ func resolveAll(ctx context.Context, resolvers []Resolver, classNames []ClassNam
 	return resultResolved, unresolvedSlice, resultErrors
 }
 
-// sortDependencies sorts the options in missingRuleDeps according to 'ranker'.
-// It mutates missingRulesDeps.
-func sortDependencies(ctx context.Context, ranker DepsRanker, missingRuleDeps map[*bazel.Rule]map[ClassName][]bazel.Label) {
+// resolveRanked is like resolveAll, but also ranks the rules that provide each class name according to config.DepsRanker.
+// Resolutions are reused from, and memoized in, config.ResolutionCache if it's set. A resolution isn't memoized if
+// resolvers failed, or if it contains existing deps of the consuming rules, since resolvers may then have returned
+// only those (see resolverutil.SatisfiedByExistingDeps), which is specific to the consuming rules.
+func resolveRanked(ctx context.Context, config Config, classNames []ClassName, depsOfRuleToFix map[bazel.Label]map[bazel.Label]bool) (map[ClassName][]*bazel.Rule, []ClassName, map[Resolver]error) {
+	cache := config.ResolutionCache
+	resolved := make(map[ClassName][]*bazel.Rule)
+	var unresolved, toResolve []ClassName
+	for _, cls := range classNames {
+		if cache == nil {
+			toResolve = append(toResolve, cls)
+			continue
+		}
+		res, ok := cache.get(cls)
+		switch {
+		case !ok:
+			toResolve = append(toResolve, cls)
+		case !res.resolved:
+			unresolved = append(unresolved, cls)
+		case len(res.rules) > 0:
+			resolved[cls] = res.rules
+		}
+	}
+	if reused := len(classNames) - len(toResolve); reused > 0 {
+		vlog.V(2).Printf("Reusing the resolution of %d class names", reused)
+	}
+	if len(toResolve) == 0 {
+		sort.Slice(unresolved, func(i, j int) bool { return unresolved[i] < unresolved[j] })
+		return resolved, unresolved, nil
+	}
+
+	newlyResolved, newlyUnresolved, resolverErrs := resolveAll(ctx, config.Resolvers, toResolve, depsOfRuleToFix)
 	stopwatch := time.Now()
-	for _, classToLabels := range missingRuleDeps {
+	for cls, rules := range newlyResolved {
+		rankRules(ctx, config.DepsRanker, rules)
+		resolved[cls] = rules
+	}
+	log.Printf("Ranking dependencies (%dms)", int64(time.Now().Sub(stopwatch)/time.Millisecond))
+	unresolved = append(unresolved, newlyUnresolved...)
+	sort.Slice(unresolved, func(i, j int) bool { return unresolved[i] < unresolved[j] })
+
+	// Class names that weren't resolved because ctx was cancelled would be memoized as unresolved.
+	if cache == nil || ctx.Err() != nil {
+		return resolved, unresolved, resolverErrs
+	}
+	isUnresolved := make(map[ClassName]bool)
+	for _, cls := range newlyUnresolved {
+		isUnresolved[cls] = true
+	}
+	for _, cls := range toResolve {
+		if isUnresolved[cls] {
+			if len(resolverErrs) == 0 {
+				cache.set(cls, resolution{})
+			}
+			continue
+		}
+		rules := newlyResolved[cls]
+		if !containsExistingDep(depsOfRuleToFix, rules) {
+			cache.set(cls, resolution{resolved: true, rules: rules})
+		}
+	}
+	return resolved, unresolved, resolverErrs
+}
+
+// containsExistingDep returns true if any of rules is one of the consuming rules, or one of their deps.
+func containsExistingDep(depsOfRuleToFix map[bazel.Label]map[bazel.Label]bool, rules []*bazel.Rule) bool {
+	for consumingRule, deps := range depsOfRuleToFix {
+		if alreadySatisfied(consumingRule, deps, rules) {
+			return true
+		}
+	}
+	return false
+}
+
+// rankLabels sorts labels best first according to ranker.
+// The sort is stable, so labels that ranker considers equal keep the order in which resolvers returned them.
+func rankLabels(ctx context.Context, ranker DepsRanker, labels []bazel.Label) {
+	sort.SliceStable(labels, func(i, j int) bool { return ranker.Less(ctx, labels[i], labels[j]) })
+}
+
+// rankRules is like rankLabels, but sorts rules by their labels.
+func rankRules(ctx context.Context, ranker DepsRanker, rules []*bazel.Rule) {
+	sort.SliceStable(rules, func(i, j int) bool { return ranker.Less(ctx, rules[i].Label(), rules[j].Label()) })
+}
+
+// rankForConsumingRules re-ranks the candidates of each consuming rule in missingRuleDeps, if config.DepsRanker
+// implements BatchDepsRanker or PackageDepsRanker. Otherwise, the candidates are already ranked by Less.
+func rankForConsumingRules(ctx context.Context, config Config, missingRuleDeps map[*bazel.Rule]map[ClassName][]bazel.Label) {
+	if _, ok := config.DepsRanker.(BatchDepsRanker); ok {
+		for consRule, classToLabels := range missingRuleDeps {
+			for cls, labels := range classToLabels {
+				classToLabels[cls] = RankDeps(ctx, config.DepsRanker, consRule, cls, labels)
+			}
+		}
+		return
+	}
+	rankInPackages(ctx, config, missingRuleDeps)
+}
+
+// rankInPackages re-ranks the candidates of each consuming rule in missingRuleDeps in the context of the rule's package,
+// if config.DepsRanker implements PackageDepsRanker.
+// Packages that fail to load keep the ranking of config.DepsRanker.
+func rankInPackages(ctx context.Context, config Config, missingRuleDeps map[*bazel.Rule]map[ClassName][]bazel.Label) {
+	ranker, ok := config.DepsRanker.(PackageDepsRanker)
+	if !ok || len(missingRuleDeps) == 0 {
+		return
+	}
+	pkgNames := make(map[string]bool)
+	for consRule := range missingRuleDeps {
+		pkgNames[consRule.PkgName] = true
+	}
+	var toLoad []string
+	for p := range pkgNames {
+		toLoad = append(toLoad, p)
+	}
+	sort.Strings(toLoad)
+	pkgs, err := config.Loader.Load(ctx, toLoad)
+	if err != nil {
+		log.Printf("WARNING: Error loading consuming packages to rank dependencies; ignoring their rules:\n%v", err)
+		return
+	}
+	for consRule, classToLabels := range missingRuleDeps {
+		pkg := pkgs[consRule.PkgName]
+		if pkg == nil {
+			continue
+		}
 		for _, labels := range classToLabels {
-			sort.Slice(labels, func(i, j int) bool { return ranker.Less(ctx, labels[i], labels[j]) })
+			sort.SliceStable(labels, func(i, j int) bool { return ranker.LessInPackage(ctx, pkg, labels[i], labels[j]) })
 		}
 	}
-	log.Printf("Ranking dependencies (%dms)", int64(time.Now().Sub(stopwatch)/time.Millisecond))
+}
+
+// ClassNameBlacklist is a compiled list of regular expressions matching names of classes for which we will not look for BUILD rules.
+// A pattern that starts with "!" re-includes the classes it matches. When several patterns match a class name,
+// the last one wins, e.g. `com\.foo\..*,!com\.foo\.api\..*` excludes com.foo.Bar but not com.foo.api.Baz.
+// A nil *ClassNameBlacklist excludes nothing.
+type ClassNameBlacklist struct {
+	patterns []classNamePattern
+}
+
+type classNamePattern struct {
+	re      *regexp.Regexp
+	negated bool
+}
+
+// CompileClassNameBlacklist compiles patterns into a ClassNameBlacklist. Empty patterns are ignored.
+// Like regexp.MatchString, a pattern matches a class name if it matches any part of it.
+func CompileClassNameBlacklist(patterns []string) (*ClassNameBlacklist, error) {
+	b := &ClassNameBlacklist{}
+	if err := b.Add(patterns...); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Add compiles patterns and appends them to the blacklist, so they take precedence over existing patterns.
+// If any of the patterns is invalid, the blacklist is left unchanged.
+func (b *ClassNameBlacklist) Add(patterns ...string) error {
+	var compiled []classNamePattern
+	for _, p := range patterns {
+		p = strings.TrimSpace(p)
+		negated := strings.HasPrefix(p, "!")
+		if negated {
+			p = p[1:]
+		}
+		if p == "" {
+			continue
+		}
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return fmt.Errorf("error parsing class name blacklist pattern %q:\n%v", p, err)
+		}
+		compiled = append(compiled, classNamePattern{re, negated})
+	}
+	b.patterns = append(b.patterns, compiled...)
+	return nil
+}
+
+// Excludes returns true if the last pattern matching className isn't negated.
+func (b *ClassNameBlacklist) Excludes(className ClassName) bool {
+	if b == nil {
+		return false
+	}
+	for i := len(b.patterns) - 1; i >= 0; i-- {
+		if b.patterns[i].re.MatchString(string(className)) {
+			return !b.patterns[i].negated
+		}
+	}
+	return false
+}
+
+// Filter returns the members of classNames that the blacklist doesn't exclude.
+func (b *ClassNameBlacklist) Filter(classNames []ClassName) []ClassName {
+	var ret []ClassName
+	for _, c := range classNames {
+		if !b.Excludes(c) {
+			ret = append(ret, c)
+		}
+	}
+	return ret
 }
 
 // ExcludeClassNames filters class names based on blacklisted regular expressions from the user.
+// See ClassNameBlacklist for the format of blacklistRegexps. Invalid regular expressions are reported and ignored.
+// Callers that filter more than once should compile a ClassNameBlacklist up front instead.
 func ExcludeClassNames(blacklistRegexps []string, classNames []ClassName) []ClassName {
-	var newClassNames []ClassName
-	for _, classname := range classNames {
-		found := false
-		for _, regexs := range blacklistRegexps {
-			match, err := regexp.MatchString(regexs, string(classname))
-			if err != nil {
-				fmt.Printf("Error %v occurred during matching", err)
-				continue
-			}
-			if match {
-				found = true
-				break
-			}
-		}
-		if !found {
-			newClassNames = append(newClassNames, classname)
+	b := &ClassNameBlacklist{}
+	for _, p := range blacklistRegexps {
+		if err := b.Add(p); err != nil {
+			log.Printf("WARNING: %v", err)
 		}
 	}
-	return newClassNames
+	return b.Filter(classNames)
 }
 
 // GetKindForNewRule determines if a rule that srcs a  filename is a java_library rule
@@ -299,37 +919,97 @@ func alreadySatisfied(consumingRuleLabel bazel.Label, existingDeps map[bazel.Lab
 	return false
 }
 
-// srcsFile returns true if a rule has relativeFileName in its 'srcs' attribute.
+// srcsAny returns true if a rule has any of 'labels' in its 'srcs' attribute, either as a path relative to the rule's package or as a label.
 // For example, only rules that source the file the user asked about should be edited.
-func srcsFile(rule *bazel.Rule, relativeFileName string) bool {
-	for _, src := range rule.StringListAttr("srcs") {
-		if relativeFileName == src {
+func srcsAny(rule *bazel.Rule, labels map[bazel.Label]bool) bool {
+	for _, l := range srcLabels(rule) {
+		if labels[l] {
 			return true
 		}
 	}
 	return false
 }
 
+// srcLabels returns the 'srcs' of a rule as absolute labels.
+func srcLabels(rule *bazel.Rule) []bazel.Label {
+	var ret []bazel.Label
+	for _, src := range rule.StringListAttr("srcs") {
+		if l, err := bazel.ParseRelativeLabel(rule.PkgName, src); err == nil {
+			ret = append(ret, l)
+		}
+	}
+	return ret
+}
+
 // ImplicitImports returns the set of simple names that Java programs can use without importing, e.g. String, Object, Integer, etc.
 // 'dict' is a future to a map[ClassName][]bazel.Label whose keys are built-in fully-qualified class names.
 // Returns a sorted slice if the input is a sorted slice.
-func ImplicitImports(dict *future.Value) *future.Value {
+func ImplicitImports(dict future.Getter) *future.Value {
 	return future.NewValue(func() interface{} {
-		var ret []string
-		for cls := range dict.Get().(map[ClassName][]bazel.Label) {
-			s := string(cls)
-			if strings.HasPrefix(s, "java.lang.") {
-				simple := s[len("java.lang."):]
-				if !strings.ContainsRune(simple, '.') {
-					ret = append(ret, simple)
-				}
-			}
-		}
+		ret := implicitImportsOf(dict.Get().(map[ClassName][]bazel.Label))
 		sort.Strings(ret)
 		return ret
 	})
 }
 
+// implicitImportsOf returns the simple names of the java.lang classes in dict, in no particular order.
+func implicitImportsOf(dict map[ClassName][]bazel.Label) []string {
+	var ret []string
+	for cls := range dict {
+		s := string(cls)
+		if strings.HasPrefix(s, "java.lang.") {
+			simple := s[len("java.lang."):]
+			if !strings.ContainsRune(simple, '.') {
+				ret = append(ret, simple)
+			}
+		}
+	}
+	return ret
+}
+
+// RestrictImplicitImports returns the names in implicitImports that are also implicit imports according to each of dicts,
+// which are futures to maps as in ImplicitImports.
+// It's used for rules whose builtin class list lacks some of the default java.lang classes, e.g. rules compiled with
+// --release 8, in which a simple name such as Module refers to a class in the same package rather than to java.lang.Module.
+// Returns a sorted slice if implicitImports is sorted.
+func RestrictImplicitImports(implicitImports []string, dicts []future.Getter) []string {
+	if len(dicts) == 0 {
+		return implicitImports
+	}
+	count := make(map[string]int)
+	for _, d := range dicts {
+		for _, name := range implicitImportsOf(d.Get().(map[ClassName][]bazel.Label)) {
+			count[name]++
+		}
+	}
+	var ret []string
+	for _, name := range implicitImports {
+		if count[name] == len(dicts) {
+			ret = append(ret, name)
+		}
+	}
+	return ret
+}
+
+// JavaRelease returns the Java release that rule is compiled for according to the --release option in its javacopts,
+// e.g. "8", or "" if it doesn't specify one. When the option appears more than once, the last one wins, as in javac.
+func JavaRelease(rule *bazel.Rule) string {
+	var opts []string
+	for _, o := range rule.StringListAttr("javacopts") {
+		opts = append(opts, strings.Fields(o)...)
+	}
+	ret := ""
+	for i, o := range opts {
+		switch {
+		case strings.HasPrefix(o, "--release="):
+			ret = strings.TrimPrefix(o, "--release=")
+		case o == "--release" && i+1 < len(opts):
+			ret = opts[i+1]
+		}
+	}
+	return ret
+}
+
 // NamingRule is used by NewRule to create new Bazel rules.
 type NamingRule struct {
 	// FileNameMatcher matches file names for which we should create a new rule of kind RuleKind.
@@ -345,6 +1025,12 @@ type NamingRule struct {
 // The name of the new rule is the file name (without extension).
 // fileName is a file name relative to the workspace root (e.g., should be 'java/com/Foo.java', not 'Foo.java').
 func CreateRule(fileName string, namingRules []NamingRule, defaultRuleKind string) *bazel.Rule {
+	return CreateRuleWithTemplates(fileName, namingRules, defaultRuleKind, nil)
+}
+
+// CreateRuleWithTemplates is like CreateRule, but the new rule also gets the attributes of the template of its kind in templates, if any.
+// Attributes whose placeholders can't be filled in are skipped with a warning.
+func CreateRuleWithTemplates(fileName string, namingRules []NamingRule, defaultRuleKind string, templates map[string]RuleTemplate) *bazel.Rule {
 	kind := defaultRuleKind
 	for _, r := range namingRules {
 		m := r.FileNameMatcher.FindStringSubmatch(fileName)
@@ -359,5 +1045,382 @@ func CreateRule(fileName string, namingRules []NamingRule, defaultRuleKind strin
 	}
 	src := filepath.Base(fileName)
 	name := strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName))
-	return bazel.NewRule(kind, pkgName, name, map[string]interface{}{"srcs": []string{src}})
+	attrs := map[string]interface{}{"srcs": []string{src}}
+	placeholders := map[string]string{"{name}": name, "{package}": pkgName}
+	if cls := classNameOfFile(fileName); cls != "" {
+		placeholders["{class}"] = cls
+	}
+	for attr, value := range templates[kind] {
+		if _, ok := attrs[attr]; ok || attr == "name" {
+			continue
+		}
+		v, err := fillPlaceholders(value, placeholders)
+		if err != nil {
+			log.Printf("WARNING: Not setting %q of new rule //%s:%s: %v", attr, pkgName, name, err)
+			continue
+		}
+		attrs[attr] = v
+	}
+	return bazel.NewRule(kind, pkgName, name, attrs)
+}
+
+// RuleTemplate maps the names of attributes that new rules of some kind get to their values, which are strings or lists of strings,
+// e.g. size = "small" for java_test.
+// Values can refer to the new rule: {name} is replaced by its name, {package} by its package, and {class} by the fully-qualified
+// name of the class in its src, assuming the Java source root is the first "java" or "javatests" directory of its path, as Bazel does.
+type RuleTemplate map[string]interface{}
+
+// ParseRuleTemplates parses a JSON object that maps rule kinds to RuleTemplates, e.g.
+//
+//	{"java_test": {"test_class": "{class}", "size": "small", "runtime_deps": ["//third_party/java/junit"]}}
+func ParseRuleTemplates(content []byte) (map[string]RuleTemplate, error) {
+	var raw map[string]map[string]interface{}
+	if err := json.Unmarshal(content, &raw); err != nil {
+		return nil, fmt.Errorf("error parsing rule templates:\n%v", err)
+	}
+	ret := make(map[string]RuleTemplate)
+	for kind, attrs := range raw {
+		tmpl := make(RuleTemplate)
+		for attr, value := range attrs {
+			switch v := value.(type) {
+			case string:
+				tmpl[attr] = v
+			case []interface{}:
+				var values []string
+				for _, e := range v {
+					s, ok := e.(string)
+					if !ok {
+						return nil, fmt.Errorf("attribute %q of the %s template must be a string or a list of strings, got %v", attr, kind, value)
+					}
+					values = append(values, s)
+				}
+				tmpl[attr] = values
+			default:
+				return nil, fmt.Errorf("attribute %q of the %s template must be a string or a list of strings, got %v", attr, kind, value)
+			}
+		}
+		ret[kind] = tmpl
+	}
+	return ret, nil
+}
+
+// fillPlaceholders returns value, a string or a list of strings, with the placeholders replaced by their values.
+// Returns an error if value has a placeholder of the form {...} that isn't in placeholders.
+func fillPlaceholders(value interface{}, placeholders map[string]string) (interface{}, error) {
+	fill := func(s string) (string, error) {
+		for p, v := range placeholders {
+			s = strings.Replace(s, p, v, -1)
+		}
+		if m := placeholderRegexp.FindString(s); m != "" {
+			return "", fmt.Errorf("can't compute %s", m)
+		}
+		return s, nil
+	}
+	if s, ok := value.(string); ok {
+		return fill(s)
+	}
+	var ret []string
+	for _, s := range value.([]string) {
+		f, err := fill(s)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, f)
+	}
+	return ret, nil
+}
+
+var placeholderRegexp = regexp.MustCompile(`\{(name|package|class)\}`)
+
+// classNameOfFile returns the fully-qualified name of the class in a Java file, e.g. com.foo.FooTest for javatests/com/foo/FooTest.java,
+// assuming the source root is the first "java" or "javatests" directory in fileName, as Bazel does when it infers test_class.
+// Returns "" if fileName isn't under such a directory.
+func classNameOfFile(fileName string) string {
+	parts := strings.Split(strings.TrimSuffix(fileName, filepath.Ext(fileName)), "/")
+	for i, p := range parts[:len(parts)-1] {
+		if p == "java" || p == "javatests" {
+			return strings.Join(parts[i+1:], ".")
+		}
+	}
+	return ""
+}
+
+// TestSrc returns the src of a java_test rule that declares its test class: the one named like the rule, e.g. FooTest.java
+// for a rule named FooTest, or else its only Java src. Returns "" if there's no such src, or rule isn't a java_test.
+func TestSrc(rule *bazel.Rule) string {
+	if rule.Schema != "java_test" {
+		return ""
+	}
+	var javaSrcs []string
+	for _, src := range rule.StringListAttr("srcs") {
+		if !strings.HasSuffix(src, ".java") || strings.ContainsAny(src, ":/") {
+			continue
+		}
+		if strings.TrimSuffix(src, ".java") == rule.Name() {
+			return src
+		}
+		javaSrcs = append(javaSrcs, src)
+	}
+	if len(javaSrcs) == 1 {
+		return javaSrcs[0]
+	}
+	return ""
+}
+
+// InferTestClass returns the test_class that a java_test rule should set, given the Java package that its TestSrc declares.
+// Returns "" if rule doesn't need to set it: it has no TestSrc, already sets test_class, doesn't use the test runner,
+// or Bazel infers the same class from the rule's path, which it does when the path is under a "java" or "javatests" directory.
+func InferTestClass(rule *bazel.Rule, javaPkg string) string {
+	src := TestSrc(rule)
+	if src == "" || !rule.BoolAttr("use_testrunner", true) {
+		return ""
+	}
+	// Packages loaded from Bazel have an empty test_class when it isn't set.
+	if v, ok := rule.Attrs["test_class"]; ok && v != "" {
+		return ""
+	}
+	cls := strings.TrimSuffix(src, ".java")
+	if javaPkg != "" {
+		cls = javaPkg + "." + cls
+	}
+	if classNameOfFile(path.Join(rule.PkgName, rule.Name())+".java") == cls {
+		return ""
+	}
+	return cls
+}
+
+// RequiredAttrs describes attributes that rules in some packages must set for Bazel to accept them, e.g. 'licenses' in third_party/.
+type RequiredAttrs struct {
+	// PkgNameMatcher matches the names of packages whose new rules get Attrs.
+	PkgNameMatcher *regexp.Regexp
+
+	// Attrs maps attribute names to the values new rules get, e.g. "licenses" -> ["notice"].
+	Attrs map[string][]string
+}
+
+// ParseRequiredAttrs parses a semicolon-separated list of <package regexp>:<attribute>=<comma-separated values>,
+// e.g. "third_party/.*:licenses=notice;javatests/.*:tags=manual,small".
+// Package regexps match entire package names.
+func ParseRequiredAttrs(s string) ([]RequiredAttrs, error) {
+	var ret []RequiredAttrs
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		colon := strings.Index(entry, ":")
+		eq := strings.Index(entry, "=")
+		if colon == -1 || eq < colon || entry[colon+1:eq] == "" {
+			return nil, fmt.Errorf("expected <package regexp>:<attribute>=<values>, got %q", entry)
+		}
+		re, err := regexp.Compile("^(?:" + entry[:colon] + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("error compiling package regexp in %q:\n%v", entry, err)
+		}
+		var values []string
+		for _, v := range strings.Split(entry[eq+1:], ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		ret = append(ret, RequiredAttrs{PkgNameMatcher: re, Attrs: map[string][]string{entry[colon+1 : eq]: values}})
+	}
+	return ret, nil
+}
+
+// ApplyRequiredAttrs sets the attributes that 'required' lists for rule's package, unless rule already sets them.
+// When several entries set the same attribute, the first one wins.
+// 'licenses' isn't set if pkg calls licenses(), since Bazel applies those to all the package's rules.
+// pkg can be nil, e.g. when rule will be the first rule of a new package.
+func ApplyRequiredAttrs(pkg *bazel.Package, rule *bazel.Rule, required []RequiredAttrs) {
+	for _, r := range required {
+		if !r.PkgNameMatcher.MatchString(rule.PkgName) {
+			continue
+		}
+		for attr, values := range r.Attrs {
+			if _, ok := rule.Attrs[attr]; ok {
+				continue
+			}
+			if attr == "licenses" && pkg != nil && len(pkg.DefaultLicenses) > 0 {
+				continue
+			}
+			rule.Attrs[attr] = append([]string(nil), values...)
+		}
+	}
+}
+
+// SplitPlan describes how to split a rule whose srcs declare more than one Java package.
+type SplitPlan struct {
+	// Rule is the rule to split.
+	Rule *bazel.Rule
+
+	// NewRules has one new rule per Java package declared by Rule's srcs.
+	// Each new rule srcs the files declaring its Java package, and inherits Rule's kind, deps, visibility and testonly.
+	// Rule keeps the rest of its srcs, and exports the new rules so its dependents don't break.
+	NewRules []*bazel.Rule
+
+	// ApproximateDeps has the labels of the new rules whose deps are all of Rule's deps, rather than the ones their own srcs need.
+	// NarrowSplitDeps removes the new rules whose deps it narrows.
+	ApproximateDeps map[bazel.Label]bool
+}
+
+// PlanSplitByJavaPackage returns a SplitPlan for rule if its srcs declare more than one Java package, or nil otherwise.
+// javaPackages maps file names in rule's srcs (relative to rule's package) to the Java package they declare.
+// srcs that are missing from javaPackages (e.g., non-Java files) remain in rule.
+func PlanSplitByJavaPackage(rule *bazel.Rule, javaPackages map[string]string) *SplitPlan {
+	srcsOfJavaPkg := make(map[string][]string)
+	var javaPkgs []string
+	for _, src := range rule.StringListAttr("srcs") {
+		javaPkg, ok := javaPackages[src]
+		if !ok {
+			continue
+		}
+		if _, ok := srcsOfJavaPkg[javaPkg]; !ok {
+			javaPkgs = append(javaPkgs, javaPkg)
+		}
+		srcsOfJavaPkg[javaPkg] = append(srcsOfJavaPkg[javaPkg], src)
+	}
+	if len(javaPkgs) < 2 {
+		return nil
+	}
+	sort.Strings(javaPkgs)
+
+	names := splitRuleNames(rule.Name(), javaPkgs)
+	plan := &SplitPlan{Rule: rule}
+	for _, javaPkg := range javaPkgs {
+		attrs := map[string]interface{}{"srcs": srcsOfJavaPkg[javaPkg]}
+		for _, a := range []string{"deps", "visibility", "testonly"} {
+			if v, ok := rule.Attrs[a]; ok {
+				attrs[a] = v
+			}
+		}
+		newRule := bazel.NewRule(rule.Schema, rule.PkgName, names[javaPkg], attrs)
+		plan.NewRules = append(plan.NewRules, newRule)
+		if len(newRule.StringListAttr("deps")) > 0 {
+			if plan.ApproximateDeps == nil {
+				plan.ApproximateDeps = make(map[bazel.Label]bool)
+			}
+			plan.ApproximateDeps[newRule.Label()] = true
+		}
+	}
+	return plan
+}
+
+// NarrowSplitDeps narrows the deps of newRule, one of plan.NewRules, to the deps of plan.Rule that provide the class names
+// that newRule's srcs reference: through their own srcs, as resolved by config.Resolvers, or through their exports.
+// Class names that newRule or the other new rules provide need no deps.
+// It returns false, leaving newRule's deps alone, if a class name can't be resolved, since the dep that provides it can't be
+// told apart from the unused ones.
+func NarrowSplitDeps(ctx context.Context, config Config, plan *SplitPlan, newRule *bazel.Rule, classNames []ClassName) bool {
+	depLabels := make(map[bazel.Label]string)
+	var labels []bazel.Label
+	for _, d := range plan.Rule.StringListAttr("deps") {
+		if l, err := bazel.ParseRelativeLabel(plan.Rule.PkgName, d); err == nil {
+			depLabels[l] = d
+			labels = append(labels, l)
+		}
+	}
+	if len(labels) == 0 {
+		delete(plan.ApproximateDeps, newRule.Label())
+		return true
+	}
+	depRules, pkgs, err := pkgloading.LoadRules(ctx, config.Loader, labels)
+	if err != nil {
+		vlog.V(2).Printf("Error loading deps of %s; not narrowing the deps of %s:\n%v", plan.Rule.Label(), newRule.Label(), err)
+		return false
+	}
+	cache := config.ProvidedClasses
+	if cache == nil {
+		cache = NewProvidedClasses()
+	}
+	providedBy := func(rule *bazel.Rule) []ClassName {
+		pkgDir := filepath.Join(config.WorkspaceDir, rule.PkgName)
+		if pkg := pkgs[rule.PkgName]; pkg != nil {
+			pkgDir = pkg.Path
+		}
+		return cache.Get(pkgDir, rule)
+	}
+	var local []ClassName
+	for _, r := range plan.NewRules {
+		local = append(local, providedBy(r)...)
+	}
+
+	used := make(map[bazel.Label]bool)
+	var toResolve []ClassName
+	for _, cls := range classNames {
+		if providesClass(local, cls) {
+			continue
+		}
+		found := false
+		for _, l := range labels {
+			if dep := depRules[l]; dep != nil && providesClass(providedBy(dep), cls) {
+				used[l] = true
+				found = true
+			}
+		}
+		if !found {
+			toResolve = append(toResolve, cls)
+		}
+	}
+	if len(toResolve) > 0 {
+		deps := make(map[bazel.Label]bool)
+		for _, l := range labels {
+			deps[l] = true
+		}
+		resolved, unresolved, _ := resolveRanked(ctx, config, toResolve, map[bazel.Label]map[bazel.Label]bool{newRule.Label(): deps})
+		if len(unresolved) > 0 || ctx.Err() != nil {
+			vlog.V(2).Printf("Not narrowing the deps of %s, since these class names can't be resolved: %v", newRule.Label(), unresolved)
+			return false
+		}
+		exported := newExportedRules(ctx, config.Loader)
+		for _, rules := range resolved {
+			for _, l := range labels {
+				dep := depRules[l]
+				for _, r := range rules {
+					if r.Label() == l || (dep != nil && exported.of(dep)[r.Label()]) {
+						used[l] = true
+					}
+				}
+			}
+		}
+	}
+
+	var narrowed []string
+	for _, l := range labels {
+		if used[l] {
+			narrowed = append(narrowed, depLabels[l])
+		}
+	}
+	if len(narrowed) > 0 {
+		newRule.Attrs["deps"] = narrowed
+	} else {
+		delete(newRule.Attrs, "deps")
+	}
+	delete(plan.ApproximateDeps, newRule.Label())
+	return true
+}
+
+// splitRuleNames names the rules that PlanSplitByJavaPackage creates for each of javaPkgs.
+// A name is the original rule's name followed by the last component of the Java package (e.g., Foo_collect for com.google.common.collect).
+// If two Java packages share their last component, the full package name is used instead.
+func splitRuleNames(ruleName string, javaPkgs []string) map[string]string {
+	lastComponent := func(javaPkg string) string {
+		if javaPkg == "" {
+			return "default"
+		}
+		return javaPkg[strings.LastIndexByte(javaPkg, '.')+1:]
+	}
+	count := make(map[string]int)
+	for _, p := range javaPkgs {
+		count[lastComponent(p)]++
+	}
+	ret := make(map[string]string)
+	for _, p := range javaPkgs {
+		suffix := lastComponent(p)
+		if count[suffix] > 1 {
+			suffix = strings.Replace(p, ".", "_", -1)
+		}
+		ret[p] = ruleName + "_" + suffix
+	}
+	return ret
 }
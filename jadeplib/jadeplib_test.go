@@ -22,12 +22,17 @@ import (
 	"reflect"
 	"regexp"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"context"
 	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/filter"
 	"github.com/bazelbuild/tools_jvm_autodeps/future"
 	"github.com/bazelbuild/tools_jvm_autodeps/pkgloaderfakes"
+	"github.com/bazelbuild/tools_jvm_autodeps/pkgloading"
 	"github.com/bazelbuild/tools_jvm_autodeps/sortingdepsranker"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
@@ -115,6 +120,23 @@ func TestResolveAll(t *testing.T) {
 	}
 }
 
+// TestResolveAllCancelled tests that resolveAll doesn't call resolvers once its context is cancelled.
+func TestResolveAllCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	resolvers := []Resolver{&testResolver{expectedRequested: []ClassName{"unexpected - should not be called"}}}
+	resolved, unresolved, errors := resolveAll(ctx, resolvers, []ClassName{"a"}, nil)
+	if len(resolved) != 0 {
+		t.Errorf("resolveAll(cancelled context) resolved %v, want nothing", resolved)
+	}
+	if diff := cmp.Diff(unresolved, []ClassName{"a"}); diff != "" {
+		t.Errorf("Diff in unresolved (-got +want).\n%s", diff)
+	}
+	if len(errors) != 0 {
+		t.Errorf("resolveAll(cancelled context) returned errors %v, want none (resolvers shouldn't be called)", errors)
+	}
+}
+
 type testResolver struct {
 	// List of classnames we expect this resolver to be called on.
 	expectedRequested []ClassName
@@ -332,6 +354,61 @@ usually means the wrong dep was used.`,
 				bazel.NewRule("java_library", "java", "Foo", Attrs{"srcs": []string{"Foo.java"}}): {"com.Bar": {"//p1:dep1", "//p2:dep2"}},
 			},
 		},
+		{
+			desc:       "A candidate that exports the rule being fixed, directly or through another rule, isn't suggested, since the rule would depend on itself.",
+			fileName:   "java/Foo.java",
+			classNames: []ClassName{"com.Bar"},
+			existingPkgs: map[string]*bazel.Package{
+				"java": pkgloaderfakes.Pkg([]*bazel.Rule{
+					bazel.NewRule("java_plugin", "java", "Foo", Attrs{"srcs": []string{"Foo.java"}}),
+				}),
+				"p2": pkgloaderfakes.Pkg([]*bazel.Rule{
+					bazel.NewRule("java_library", "p2", "exports_foo", Attrs{"exports": []string{"//java:Foo"}}),
+				}),
+			},
+			resolvers: []Resolver{
+				&testResolver{
+					[]ClassName{"com.Bar"},
+					map[ClassName][]*bazel.Rule{
+						"com.Bar": {
+							bazel.NewRule("java_library", "p1", "direct", Attrs{"exports": []string{"//java:Foo"}, "visibility": []string{"//visibility:public"}}),
+							bazel.NewRule("java_library", "p1", "indirect", Attrs{"exports": []string{"//p2:exports_foo"}, "visibility": []string{"//visibility:public"}}),
+							bazel.NewRule("java_library", "p1", "unrelated", Attrs{"exports": []string{"//p2:other"}, "visibility": []string{"//visibility:public"}}),
+						},
+					},
+				},
+			},
+			// Outputs:
+			wantMissing: map[*bazel.Rule]map[ClassName][]bazel.Label{
+				bazel.NewRule("java_plugin", "java", "Foo", Attrs{"srcs": []string{"Foo.java"}}): {"com.Bar": {"//p1:unrelated"}},
+			},
+		},
+		{
+			desc:       "The candidates of a java_plugin that an annotation processor can use come first.",
+			fileName:   "java/Foo.java",
+			classNames: []ClassName{"com.Bar"},
+			existingPkgs: map[string]*bazel.Package{
+				"java": pkgloaderfakes.Pkg([]*bazel.Rule{
+					bazel.NewRule("java_plugin", "java", "Foo", Attrs{"srcs": []string{"Foo.java"}}),
+				}),
+			},
+			resolvers: []Resolver{
+				&testResolver{
+					[]ClassName{"com.Bar"},
+					map[ClassName][]*bazel.Rule{
+						"com.Bar": {
+							bazel.NewRule("android_library", "p1", "android", publicAttr),
+							bazel.NewRule("java_library", "p1", "compile_only", Attrs{"neverlink": true, "visibility": []string{"//visibility:public"}}),
+							bazel.NewRule("java_library", "p2", "runtime", publicAttr),
+						},
+					},
+				},
+			},
+			// Outputs:
+			wantMissing: map[*bazel.Rule]map[ClassName][]bazel.Label{
+				bazel.NewRule("java_plugin", "java", "Foo", Attrs{"srcs": []string{"Foo.java"}}): {"com.Bar": {"//p2:runtime", "//p1:android", "//p1:compile_only"}},
+			},
+		},
 	}
 	for _, test := range tests {
 		test := test
@@ -367,157 +444,1127 @@ usually means the wrong dep was used.`,
 	}
 }
 
-func TestUnfilteredMissingDeps(t *testing.T) {
+func TestExplainMissingDeps(t *testing.T) {
 	type Attrs = map[string]interface{}
 
-	var tests = []struct {
-		desc             string
-		classNames       []ClassName
-		resolvers        []Resolver
-		wantClassToRules map[ClassName][]bazel.Label
-		wantUnresolved   []ClassName
-	}{
-		{
-			desc: "UnfilteredMissingDeps ranks the dependencies before returning them. " +
-				"In this test, the ranker is a simple lexicographic sort." +
-				"Therefore, //p2:dep2 appears after //p1:dep2 in the result, even though it was returned first from the resolver.",
-			classNames: []ClassName{"com.Bar"},
-			resolvers: []Resolver{
-				&testResolver{
-					[]ClassName{"com.Bar"},
-					map[ClassName][]*bazel.Rule{
-						"com.Bar": {
-							bazel.NewRule("java_library", "p2", "dep2", publicAttr),
-							bazel.NewRule("java_library", "p1", "dep1", publicAttr),
-						},
+	consumer := bazel.NewRule("java_library", "java", "Foo", Attrs{"deps": []string{"//p1:dep1"}})
+	config := Config{
+		Loader: &testLoader{},
+		Resolvers: []Resolver{
+			&testResolver{
+				[]ClassName{"com.AlreadySatisfied", "com.Bar"},
+				map[ClassName][]*bazel.Rule{
+					"com.AlreadySatisfied": {bazel.NewRule("java_library", "p1", "dep1", publicAttr)},
+					"com.Bar": {
+						bazel.NewRule("java_library", "p2", "avoided", Attrs{"tags": []string{"avoid_dep"}, "visibility": []string{"//visibility:public"}}),
+						bazel.NewRule("java_library", "p2", "private", Attrs{"visibility": []string{"//visibility:private"}}),
+						bazel.NewRule("java_library", "p2", "public", publicAttr),
 					},
 				},
 			},
-			wantClassToRules: map[ClassName][]bazel.Label{
-				"com.Bar": {"//p1:dep1", "//p2:dep2"},
+		},
+		DepsRanker: &sortingdepsranker.Ranker{},
+	}
+	_, _, got, err := ExplainMissingDeps(context.Background(), config, []*bazel.Rule{consumer}, []ClassName{"com.AlreadySatisfied", "com.Bar"})
+	if err != nil {
+		t.Fatalf("ExplainMissingDeps failed: %v", err)
+	}
+	want := &Decisions{
+		Resolved: map[ClassName][]bazel.Label{
+			"com.AlreadySatisfied": {"//p1:dep1"},
+			"com.Bar":              {"//p2:avoided", "//p2:private", "//p2:public"},
+		},
+		AlreadySatisfied: map[bazel.Label]map[ClassName]bool{
+			"//java:Foo": {"com.AlreadySatisfied": true},
+		},
+		Rejected: map[bazel.Label]map[ClassName]map[bazel.Label]string{
+			"//java:Foo": {"com.Bar": {
+				"//p2:avoided": "tagged avoid_dep",
+				"//p2:private": NotVisible,
+			}},
+		},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("ExplainMissingDeps returned diff in decisions (-got +want):\n%s", diff)
+	}
+}
+
+type stubHealthSignals map[bazel.Label]TargetHealth
+
+func (s stubHealthSignals) Health(ctx context.Context, labels []bazel.Label) (map[bazel.Label]TargetHealth, error) {
+	return s, nil
+}
+
+func TestMissingDepsPrefersAPITargets(t *testing.T) {
+	consumer := bazel.NewRule("java_library", "x", "Foo", nil)
+	config := Config{
+		Loader: &testLoader{},
+		Resolvers: []Resolver{
+			&testResolver{
+				[]ClassName{"com.Bar"},
+				map[ClassName][]*bazel.Rule{
+					"com.Bar": {
+						bazel.NewRule("java_library", "p", "a_impl", publicAttr),
+						bazel.NewRule("java_library", "p", "b_api", map[string]interface{}{"visibility": []string{"//visibility:public"}, "exports": []string{":a_impl"}, "tags": []string{"api"}}),
+					},
+				},
 			},
 		},
+		DepsRanker: &sortingdepsranker.Ranker{},
 	}
 
-	for _, test := range tests {
-		test := test
-		t.Run(test.desc, func(t *testing.T) {
-			config := Config{
-				Resolvers:  test.resolvers,
-				DepsRanker: &sortingdepsranker.Ranker{},
-			}
-			classToRules, unresClasses := UnfilteredMissingDeps(context.Background(), config, test.classNames)
-			if !reflect.DeepEqual(classToRules, test.wantClassToRules) {
-				t.Errorf("UnfilteredMissingDeps returned missing dependencies %s, want %s", classToRules, test.wantClassToRules)
-			}
-			if !reflect.DeepEqual(unresClasses, test.wantUnresolved) {
-				t.Errorf("UnfilteredMissingDeps returned unresolved classnames %s, want %s", unresClasses, test.wantUnresolved)
-			}
-		})
+	tests := []struct {
+		apiTags map[string]bool
+		want    []bazel.Label
+	}{
+		{map[string]bool{}, []bazel.Label{"//p:a_impl", "//p:b_api"}},
+		{map[string]bool{"api": true}, []bazel.Label{"//p:b_api", "//p:a_impl"}},
+	}
+	defer func(tags map[string]bool) { filter.APITags = tags }(filter.APITags)
+	for _, tt := range tests {
+		filter.APITags = tt.apiTags
+		missing, _, err := MissingDeps(context.Background(), config, []*bazel.Rule{consumer}, []ClassName{"com.Bar"})
+		if err != nil {
+			t.Fatalf("MissingDeps(API tags %v) returned error %v, want nil", tt.apiTags, err)
+		}
+		if diff := cmp.Diff(missing[consumer]["com.Bar"], tt.want); diff != "" {
+			t.Errorf("MissingDeps(API tags %v) returned diff (-got +want):\n%s", tt.apiTags, diff)
+		}
 	}
 }
 
-func createWorkspace(t *testing.T) string {
-	root, err := ioutil.TempDir("", "jadep")
-	if err != nil {
-		t.Fatalf("Error called ioutil.TempDir: %v", err)
+func TestMissingDepsPrefersWrappers(t *testing.T) {
+	guavaJar := bazel.NewRule("java_import", "@guava//jar", "guava", publicAttr)
+	guava := bazel.NewRule("java_library", "third_party/guava", "guava", map[string]interface{}{"visibility": []string{"//visibility:public"}, "exports": []string{"@guava//jar:guava"}})
+	config := Config{
+		Loader: &testLoader{},
+		Resolvers: []Resolver{
+			&testResolver{
+				[]ClassName{"com.ImmutableList"},
+				map[ClassName][]*bazel.Rule{"com.ImmutableList": {guavaJar, guava}},
+			},
+		},
+		DepsRanker: &sortingdepsranker.Ranker{},
+		Wrappers:   map[bazel.Label]*bazel.Rule{"@guava//jar:guava": guava},
 	}
-	workDir := filepath.Join(root, "workspace")
-	return workDir
-}
 
-func TestExcludeClassNames(t *testing.T) {
-	var tests = []struct {
-		desc       string
-		blackList  []string
-		classNames []ClassName
-		want       []ClassName
+	tests := []struct {
+		desc     string
+		consumer *bazel.Rule
+		want     map[ClassName][]bazel.Label
 	}{
 		{
-			desc:       "The class name util.R should be excluded leaving an empty string at output.",
-			blackList:  []string{`.*\.R$`},
-			classNames: []ClassName{"util.R"},
-			want:       nil,
+			desc:     "External targets are replaced by their wrappers",
+			consumer: bazel.NewRule("java_library", "x", "Foo", nil),
+			want:     map[ClassName][]bazel.Label{"com.ImmutableList": {"//third_party/guava:guava"}},
+		},
+		{
+			desc:     "A dep on an external target counts as a dep on its wrapper",
+			consumer: bazel.NewRule("java_library", "x", "Foo", map[string]interface{}{"deps": []string{"@guava//jar:guava"}}),
+			want:     nil,
 		},
 	}
-	for _, test := range tests {
-		actual := ExcludeClassNames(test.blackList, test.classNames)
-		if !reflect.DeepEqual(actual, test.want) {
-			t.Errorf("%s: ExcludedClassNames(%s, %s) = %s, want %s", test.desc, test.blackList, test.classNames, actual, test.want)
-		}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			missing, _, err := MissingDeps(context.Background(), config, []*bazel.Rule{tt.consumer}, []ClassName{"com.ImmutableList"})
+			if err != nil {
+				t.Fatalf("MissingDeps returned error %v, want nil", err)
+			}
+			if diff := cmp.Diff(missing[tt.consumer], tt.want); diff != "" {
+				t.Errorf("MissingDeps returned diff (-got +want):\n%s", diff)
+			}
+		})
 	}
 }
 
-func TestGetKindForNewRule(t *testing.T) {
-	var tests = []struct {
-		desc         string
-		filename     string
-		classnames   []ClassName
-		wantRuleType string
+func TestMissingDepsHealthSignals(t *testing.T) {
+	consumer := bazel.NewRule("java_library", "x", "Foo", nil)
+	config := Config{
+		Loader: &testLoader{},
+		Resolvers: []Resolver{
+			&testResolver{
+				[]ClassName{"com.Bar", "com.Baz"},
+				map[ClassName][]*bazel.Rule{
+					"com.Bar": {
+						bazel.NewRule("java_library", "p", "broken", publicAttr),
+						bazel.NewRule("java_library", "p", "flaky", publicAttr),
+						bazel.NewRule("java_library", "p", "healthy", publicAttr),
+					},
+					"com.Baz": {
+						bazel.NewRule("java_library", "p", "broken", publicAttr),
+					},
+				},
+			},
+		},
+		DepsRanker: &sortingdepsranker.Ranker{},
+		HealthSignals: stubHealthSignals{
+			"//p:broken": {Broken: true},
+			"//p:flaky":  {Flakiness: 0.5},
+		},
+	}
+
+	tests := []struct {
+		maxFlakiness float64
+		want         map[ClassName][]bazel.Label
+		wantRejected map[ClassName]map[bazel.Label]string
 	}{
 		{
-			"When a file ends with Test.java but doesn't reference JUnit, we return java_library",
-			"java/com/FooTest.java",
-			[]ClassName{"com.Foo"},
-			"java_library",
+			maxFlakiness: 0,
+			want: map[ClassName][]bazel.Label{
+				"com.Bar": {"//p:flaky", "//p:healthy"},
+				"com.Baz": {"//p:broken"},
+			},
+			wantRejected: map[ClassName]map[bazel.Label]string{
+				"com.Bar": {"//p:broken": "broken in its last known build"},
+			},
 		},
 		{
-			"When a file does not end with Test.java but references JUnit, we return java_library",
-			"java/com/Foo.java",
-			[]ClassName{"org.junit.Test"},
-			"java_library",
+			maxFlakiness: 0.2,
+			want: map[ClassName][]bazel.Label{
+				"com.Bar": {"//p:healthy"},
+				"com.Baz": {"//p:broken"},
+			},
+			wantRejected: map[ClassName]map[bazel.Label]string{
+				"com.Bar": {"//p:broken": "broken in its last known build", "//p:flaky": "flaky (50% of recent runs failed)"},
+			},
 		},
+	}
+	for _, tt := range tests {
+		config.MaxFlakiness = tt.maxFlakiness
+		missing, _, decisions, err := ExplainMissingDeps(context.Background(), config, []*bazel.Rule{consumer}, []ClassName{"com.Bar", "com.Baz"})
+		if err != nil {
+			t.Fatalf("ExplainMissingDeps(max flakiness %v) returned error %v, want nil", tt.maxFlakiness, err)
+		}
+		if diff := cmp.Diff(missing[consumer], tt.want); diff != "" {
+			t.Errorf("ExplainMissingDeps(max flakiness %v) returned diff (-got +want):\n%s", tt.maxFlakiness, diff)
+		}
+		if diff := cmp.Diff(decisions.Rejected["//x:Foo"], tt.wantRejected); diff != "" {
+			t.Errorf("ExplainMissingDeps(max flakiness %v) returned diff in rejected candidates (-got +want):\n%s", tt.maxFlakiness, diff)
+		}
+	}
+}
+
+func TestPlanVisibility(t *testing.T) {
+	type Attrs = map[string]interface{}
+	private := bazel.NewRule("java_library", "p", "private", Attrs{"visibility": []string{"//visibility:private"}})
+	grouped := bazel.NewRule("java_library", "p", "grouped", Attrs{"visibility": []string{"//p:friends", "//q:__pkg__"}})
+	taken := bazel.NewRule("java_library", "p", "taken", nil)
+	pkg := pkgloaderfakes.Pkg([]*bazel.Rule{private, grouped, taken, bazel.NewRule("java_library", "p", "taken_users", nil)})
+	pkg.PackageGroups = map[string]*bazel.PackageGroup{"friends": {Specs: []string{"c"}}}
+	// taken has no visibility attribute, so it's visible to the package's default_visibility, which setting visibility overrides.
+	pkg.DefaultVisibility = []bazel.Label{"//r:__pkg__"}
+	loader := &testLoader{pkgs: map[string]*bazel.Package{"p": pkg}}
+	needs := map[bazel.Label]map[string]bool{
+		"//p:private": {"b": true, "a": true},
+		"//p:grouped": {"a": true, "b": true},
+		"//p:taken":   {"a": true, "b": true},
+		"//p:gone":    {"a": true},
+	}
+
+	tests := []struct {
+		threshold int
+		want      []*VisibilityPlan
+	}{
 		{
-			"When a file does not end with Test.java and doesn't reference JUnit, we return java_library",
-			"java/com/Foo.java",
-			[]ClassName{},
-			"java_library",
+			threshold: 0,
+			want: []*VisibilityPlan{
+				{Rule: grouped, Packages: []string{"a", "b"}, AddVisibility: []string{":friends", "//q:__pkg__", "//a:__pkg__", "//b:__pkg__"}},
+				{Rule: private, Packages: []string{"a", "b"}, AddVisibility: []string{"//a:__pkg__", "//b:__pkg__"}},
+				{Rule: taken, Packages: []string{"a", "b"}, AddVisibility: []string{"//r:__pkg__", "//a:__pkg__", "//b:__pkg__"}},
+			},
 		},
 		{
-			"When a file ends with Test.java and references JUnit, we return java_test",
-			"java/com/FooTest.java",
-			[]ClassName{"org.junit.Test"},
-			"java_test",
+			threshold: 2,
+			want: []*VisibilityPlan{
+				{Rule: grouped, Packages: []string{"a", "b"}, Group: "//p:friends", AddVisibility: []string{":friends", "//q:__pkg__"}},
+				{Rule: private, Packages: []string{"a", "b"}, Group: "//p:private_users", NewGroup: true, AddVisibility: []string{":private_users"}},
+				{Rule: taken, Packages: []string{"a", "b"}, AddVisibility: []string{"//r:__pkg__", "//a:__pkg__", "//b:__pkg__"}},
+			},
 		},
 	}
-	for _, test := range tests {
-		returnedRuleType := GetKindForNewRule(test.filename, test.classnames)
-		if returnedRuleType != test.wantRuleType {
-			t.Errorf("%s: FindPackageName(%s, %s) = %s, want %s", test.desc, test.filename, test.classnames, returnedRuleType, test.wantRuleType)
+	for _, tt := range tests {
+		got, err := PlanVisibility(context.Background(), loader, needs, tt.threshold)
+		if err != nil {
+			t.Fatalf("PlanVisibility(threshold %d) returned error %v, want nil", tt.threshold, err)
+		}
+		if diff := cmp.Diff(got, tt.want); diff != "" {
+			t.Errorf("PlanVisibility(threshold %d) returned diff (-got +want):\n%s", tt.threshold, diff)
 		}
 	}
 }
 
-type testLoader struct {
-	pkgs map[string]*bazel.Package
+func TestInvisibleDeps(t *testing.T) {
+	type Attrs = map[string]interface{}
+	loader := &testLoader{pkgs: map[string]*bazel.Package{
+		"p": pkgloaderfakes.Pkg([]*bazel.Rule{
+			bazel.NewRule("java_library", "p", "public", publicAttr),
+			bazel.NewRule("java_library", "p", "private", Attrs{"visibility": []string{"//visibility:private"}}),
+			bazel.NewRule("java_library", "p", "to_a", Attrs{"visibility": []string{"//a:__pkg__"}}),
+		}),
+	}}
+	a := bazel.NewRule("java_library", "a", "A", nil)
+	b := bazel.NewRule("java_library", "b", "B", nil)
+	got, err := InvisibleDeps(context.Background(), loader, map[*bazel.Rule][]bazel.Label{
+		a: {"//p:public", "//p:private", "//p:to_a"},
+		b: {"//p:private", "//p:to_a"},
+	})
+	if err != nil {
+		t.Fatalf("InvisibleDeps returned error %v, want nil", err)
+	}
+	want := map[bazel.Label]map[string]bool{
+		"//p:private": {"a": true, "b": true},
+		"//p:to_a":    {"b": true},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("InvisibleDeps returned diff (-got +want):\n%s", diff)
+	}
 }
 
-func (l *testLoader) Load(ctx context.Context, packages []string) (map[string]*bazel.Package, error) {
-	result := make(map[string]*bazel.Package)
-	for _, pkgName := range packages {
-		if p, ok := l.pkgs[pkgName]; ok {
-			result[pkgName] = p
+func TestClasspathEstimator(t *testing.T) {
+	type Attrs = map[string]interface{}
+	loader := &testLoader{pkgs: map[string]*bazel.Package{
+		"a": pkgloaderfakes.Pkg([]*bazel.Rule{
+			bazel.NewRule("java_library", "a", "heavy", Attrs{"deps": []string{"//b:x", "//b:y"}, "runtime_deps": []string{"//b:runtime"}}),
+			bazel.NewRule("java_library", "a", "external", Attrs{"exports": []string{"@maven//:guava"}}),
+		}),
+		"b": pkgloaderfakes.Pkg([]*bazel.Rule{
+			bazel.NewRule("java_library", "b", "x", Attrs{"deps": []string{"//c:z"}}),
+			bazel.NewRule("java_library", "b", "y", nil),
+		}),
+		"c": pkgloaderfakes.Pkg([]*bazel.Rule{bazel.NewRule("java_library", "c", "z", nil)}),
+	}}
+	consumer := bazel.NewRule("java_library", "w", "w", Attrs{"deps": []string{"//b:x"}})
+
+	tests := []struct {
+		depth         int
+		consumingRule *bazel.Rule
+		candidate     bazel.Label
+		want          int
+	}{
+		{5, nil, "//a:heavy", 4},
+		{1, nil, "//a:heavy", 3},
+		{5, consumer, "//a:heavy", 2},
+		{5, consumer, "//b:x", 0},
+		{5, nil, "//a:external", 2},
+		{5, nil, "//unknown:lib", 1},
+	}
+	for _, tt := range tests {
+		e := NewClasspathEstimator(context.Background(), loader, tt.depth)
+		if got := e.Delta(tt.consumingRule, tt.candidate); got != tt.want {
+			t.Errorf("Delta(%v, %s) with depth %d = %d, want %d", tt.consumingRule, tt.candidate, tt.depth, got, tt.want)
 		}
 	}
-	return result, nil
 }
 
-func TestImplicitImports(t *testing.T) {
-	in := map[ClassName][]bazel.Label{
-		"java.lang.reflect.Method":   nil,
-		"java.lang.Object":           nil,
-		"java.lang.String":           nil,
-		"java.util.Map":              nil,
-		"javax.annotation.Generated": nil,
+func TestMissingDepsCycles(t *testing.T) {
+	type Attrs = map[string]interface{}
+
+	foo := bazel.NewRule("java_library", "x", "foo", nil)
+	loader := &testLoader{pkgs: map[string]*bazel.Package{
+		"x": pkgloaderfakes.Pkg([]*bazel.Rule{foo}),
+		"p2": pkgloaderfakes.Pkg([]*bazel.Rule{
+			bazel.NewRule("java_library", "p2", "uses_foo", Attrs{"runtime_deps": []string{"//x:foo"}}),
+			bazel.NewRule("java_library", "p2", "uses_uses_foo", Attrs{"deps": []string{":uses_foo"}}),
+		}),
+	}}
+	resolver := &recordingResolver{cannedResponse: map[ClassName][]*bazel.Rule{
+		"com.Bar": {
+			bazel.NewRule("java_library", "p1", "direct", Attrs{"deps": []string{"//x:foo"}, "visibility": []string{"//visibility:public"}}),
+			bazel.NewRule("java_library", "p1", "indirect", Attrs{"exports": []string{"//p2:uses_foo"}, "visibility": []string{"//visibility:public"}}),
+			bazel.NewRule("java_library", "p1", "deep", Attrs{"deps": []string{"//p2:uses_uses_foo"}, "visibility": []string{"//visibility:public"}}),
+			bazel.NewRule("java_library", "p1", "unrelated", Attrs{"deps": []string{"//p2:other"}, "visibility": []string{"//visibility:public"}}),
+		},
+	}}
+
+	tests := []struct {
+		depth int
+		want  []bazel.Label
+	}{
+		{0, []bazel.Label{"//p1:deep", "//p1:direct", "//p1:indirect", "//p1:unrelated"}},
+		{1, []bazel.Label{"//p1:deep", "//p1:indirect", "//p1:unrelated"}},
+		{2, []bazel.Label{"//p1:deep", "//p1:unrelated"}},
+		{3, []bazel.Label{"//p1:unrelated"}},
 	}
-	want := []string{"Object", "String"}
+	for _, tt := range tests {
+		config := Config{
+			Loader:          loader,
+			Resolvers:       []Resolver{resolver},
+			DepsRanker:      &sortingdepsranker.Ranker{},
+			CycleCheckDepth: tt.depth,
+		}
+		missing, _, decisions, err := ExplainMissingDeps(context.Background(), config, []*bazel.Rule{foo}, []ClassName{"com.Bar"})
+		if err != nil {
+			t.Fatalf("ExplainMissingDeps(depth %d) returned error %v, want nil", tt.depth, err)
+		}
+		if diff := cmp.Diff(missing[foo]["com.Bar"], tt.want); diff != "" {
+			t.Errorf("ExplainMissingDeps(depth %d) returned diff in candidates for com.Bar (-got +want):\n%s", tt.depth, diff)
+		}
+		if tt.depth > 0 {
+			if got, want := decisions.Rejected["//x:foo"]["com.Bar"]["//p1:direct"], "depends on //x:foo, which would create a cycle"; got != want {
+				t.Errorf("ExplainMissingDeps(depth %d) rejected //p1:direct with reason %q, want %q", tt.depth, got, want)
+			}
+		}
+	}
+}
 
-	lines := future.NewValue(func() interface{} {
-		return in
-	})
-	got := ImplicitImports(lines).Get()
-	if diff := cmp.Diff(got, want); diff != "" {
-		t.Errorf("Diff in ImplicitImports(%v) (-got +want):\n%s", in, diff)
+// TestMissingDepsCyclesLoadsEachLevelOnce tests that the cycle check loads the dependencies of all candidates together,
+// one level at a time, rather than once per candidate.
+func TestMissingDepsCyclesLoadsEachLevelOnce(t *testing.T) {
+	type Attrs = map[string]interface{}
+
+	foo := bazel.NewRule("java_library", "x", "foo", nil)
+	loader := &countingLoader{testLoader: testLoader{pkgs: map[string]*bazel.Package{
+		"x": pkgloaderfakes.Pkg([]*bazel.Rule{foo}),
+		"p2": pkgloaderfakes.Pkg([]*bazel.Rule{
+			bazel.NewRule("java_library", "p2", "a", Attrs{"deps": []string{"//p3:a"}}),
+			bazel.NewRule("java_library", "p2", "b", Attrs{"deps": []string{"//p3:b"}}),
+		}),
+		"p3": pkgloaderfakes.Pkg([]*bazel.Rule{
+			bazel.NewRule("java_library", "p3", "a", nil),
+			bazel.NewRule("java_library", "p3", "b", Attrs{"deps": []string{"//x:foo"}}),
+		}),
+	}}}
+	resolver := &recordingResolver{cannedResponse: map[ClassName][]*bazel.Rule{
+		"com.A": {bazel.NewRule("java_library", "p1", "a", Attrs{"deps": []string{"//p2:a"}, "visibility": []string{"//visibility:public"}})},
+		"com.B": {bazel.NewRule("java_library", "p1", "b", Attrs{"deps": []string{"//p2:b"}, "visibility": []string{"//visibility:public"}})},
+	}}
+	config := Config{
+		Loader:          loader,
+		Resolvers:       []Resolver{resolver},
+		DepsRanker:      &sortingdepsranker.Ranker{},
+		CycleCheckDepth: 3,
+	}
+	missing, _, err := MissingDeps(context.Background(), config, []*bazel.Rule{foo}, []ClassName{"com.A", "com.B"})
+	if err != nil {
+		t.Fatalf("MissingDeps returned error %v, want nil", err)
+	}
+	want := map[ClassName][]bazel.Label{"com.A": {"//p1:a"}}
+	if diff := cmp.Diff(missing[foo], want); diff != "" {
+		t.Errorf("MissingDeps returned diff (-got +want):\n%s", diff)
+	}
+	for _, pkg := range []string{"p2", "p3"} {
+		if got := loader.loads[pkg]; got != 1 {
+			t.Errorf("MissingDeps loaded package %s %d times, want 1", pkg, got)
+		}
+	}
+}
+
+func TestDanglingDeps(t *testing.T) {
+	type Attrs = map[string]interface{}
+
+	foo := bazel.NewRule("java_library", "x", "foo", Attrs{"deps": []string{"//p1:gone", "//p1:lib", "//p1:lib.jar", "//p1:group", "//unloaded:lib", "@maven//:guava", ":gone_too"}})
+	bar := bazel.NewRule("java_library", "x", "bar", Attrs{"deps": []string{"//p1:lib"}})
+	p1 := pkgloaderfakes.Pkg([]*bazel.Rule{bazel.NewRule("java_import", "p1", "lib", Attrs{"jars": []string{"lib.jar"}})})
+	p1.Files["lib.jar"] = ""
+	p1.PackageGroups = map[string]*bazel.PackageGroup{"group": {}}
+	loader := &testLoader{pkgs: map[string]*bazel.Package{
+		"x":  pkgloaderfakes.Pkg([]*bazel.Rule{foo, bar}),
+		"p1": p1,
+	}}
+
+	got, err := DanglingDeps(context.Background(), loader, []*bazel.Rule{foo, bar})
+	if err != nil {
+		t.Fatalf("DanglingDeps returned error %v, want nil", err)
+	}
+	want := map[*bazel.Rule][]bazel.Label{foo: {"//p1:gone", "//x:gone_too"}}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("DanglingDeps returned diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestMissingDepsReplacesDanglingDeps(t *testing.T) {
+	type Attrs = map[string]interface{}
+
+	foo := bazel.NewRule("java_library", "x", "foo", Attrs{"deps": []string{"//p1:renamed"}})
+	config := Config{
+		Loader: &testLoader{pkgs: map[string]*bazel.Package{
+			"p1": pkgloaderfakes.Pkg([]*bazel.Rule{bazel.NewRule("java_library", "p1", "lib", publicAttr)}),
+		}},
+		Resolvers: []Resolver{&recordingResolver{cannedResponse: map[ClassName][]*bazel.Rule{
+			// An out-of-date index may still return the dangling dep.
+			"com.Lib": {bazel.NewRule("java_library", "p1", "lib", publicAttr), bazel.NewRule("java_library", "p1", "renamed", publicAttr)},
+		}}},
+		DepsRanker: &sortingdepsranker.Ranker{},
+	}
+	missing, _, err := MissingDeps(context.Background(), config, []*bazel.Rule{foo}, []ClassName{"com.Lib"})
+	if err != nil {
+		t.Fatalf("MissingDeps returned error %v, want nil", err)
+	}
+	if diff := cmp.Diff(missing[foo], map[ClassName][]bazel.Label{"com.Lib": {"//p1:lib"}}); diff != "" {
+		t.Errorf("MissingDeps returned diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestDuplicateDeps(t *testing.T) {
+	type Attrs = map[string]interface{}
+
+	foo := bazel.NewRule("java_library", "x", "foo", Attrs{
+		"deps":    []string{"//p1:a", "//p1:b", "//p1:c", "//p1:d", "//p1:other"},
+		"exports": []string{"//p1:a", "//p1:api", "//p1:unloaded"},
+	})
+	bar := bazel.NewRule("java_library", "x", "bar", Attrs{"deps": []string{"//p1:a"}})
+	umbrella := bazel.NewRule("java_library", "x", "umbrella", Attrs{"deps": []string{"//p1:a"}, "exports": []string{"//p1:a"}, "tags": []string{"umbrella"}})
+	loader := &testLoader{pkgs: map[string]*bazel.Package{
+		"p1": pkgloaderfakes.Pkg([]*bazel.Rule{
+			bazel.NewRule("java_library", "p1", "a", nil),
+			bazel.NewRule("java_library", "p1", "api", Attrs{"exports": []string{":b", ":impl"}}),
+			bazel.NewRule("java_library", "p1", "impl", Attrs{"exports": []string{":c"}, "deps": []string{":d"}}),
+		}),
+	}}
+
+	filter.UmbrellaTags["umbrella"] = true
+	defer delete(filter.UmbrellaTags, "umbrella")
+	got := DuplicateDeps(context.Background(), loader, []*bazel.Rule{foo, bar, umbrella})
+	want := map[*bazel.Rule][]DuplicateDep{foo: {
+		{Dep: "//p1:a", Export: "//p1:a"},
+		{Dep: "//p1:b", Export: "//p1:api"},
+		{Dep: "//p1:c", Export: "//p1:api"},
+	}}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("DuplicateDeps returned diff (-got +want):\n%s", diff)
+	}
+	wantByAttr := map[*bazel.Rule]map[string][]bazel.Label{foo: {"deps": {"//p1:a", "//p1:b", "//p1:c"}}}
+	if diff := cmp.Diff(DuplicateDepsByAttribute(got), wantByAttr); diff != "" {
+		t.Errorf("DuplicateDepsByAttribute returned diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestMissingDepsExportsAreDeps(t *testing.T) {
+	type Attrs = map[string]interface{}
+
+	// After --cleanup removed //p2:lib from deps, it's still provided through //p1:api, so it isn't suggested again.
+	foo := bazel.NewRule("java_library", "x", "foo", Attrs{"exports": []string{"//p1:api"}})
+	config := Config{
+		Loader: &testLoader{pkgs: map[string]*bazel.Package{
+			"p1": pkgloaderfakes.Pkg([]*bazel.Rule{bazel.NewRule("java_library", "p1", "api", Attrs{"exports": []string{"//p2:lib"}})}),
+			"p2": pkgloaderfakes.Pkg([]*bazel.Rule{bazel.NewRule("java_library", "p2", "lib", publicAttr)}),
+		}},
+		Resolvers: []Resolver{&recordingResolver{cannedResponse: map[ClassName][]*bazel.Rule{
+			"com.Lib": {bazel.NewRule("java_library", "p2", "lib", publicAttr)},
+		}}},
+		DepsRanker: &sortingdepsranker.Ranker{},
+	}
+	missing, _, err := MissingDeps(context.Background(), config, []*bazel.Rule{foo}, []ClassName{"com.Lib"})
+	if err != nil {
+		t.Fatalf("MissingDeps returned error %v, want nil", err)
+	}
+	if len(missing[foo]) != 0 {
+		t.Errorf("MissingDeps returned %v for %s, want nothing", missing[foo], foo.Label())
+	}
+}
+
+func TestMissingDepsReadsDepsAttributeByKind(t *testing.T) {
+	type Attrs = map[string]interface{}
+	filter.DepsAttributeByKind["kt_jvm_library"] = "associates"
+	defer delete(filter.DepsAttributeByKind, "kt_jvm_library")
+
+	// A previous run added //p2:lib to associates, so it isn't suggested again.
+	foo := bazel.NewRule("kt_jvm_library", "x", "foo", Attrs{"associates": []string{"//p2:lib"}})
+	config := Config{
+		Loader: &testLoader{pkgs: map[string]*bazel.Package{
+			"p2": pkgloaderfakes.Pkg([]*bazel.Rule{bazel.NewRule("java_library", "p2", "lib", publicAttr)}),
+		}},
+		Resolvers: []Resolver{&recordingResolver{cannedResponse: map[ClassName][]*bazel.Rule{
+			"com.Lib": {bazel.NewRule("java_library", "p2", "lib", publicAttr)},
+		}}},
+		DepsRanker: &sortingdepsranker.Ranker{},
+	}
+	missing, _, err := MissingDeps(context.Background(), config, []*bazel.Rule{foo}, []ClassName{"com.Lib"})
+	if err != nil {
+		t.Fatalf("MissingDeps returned error %v, want nil", err)
+	}
+	if len(missing[foo]) != 0 {
+		t.Errorf("MissingDeps returned %v for %s, want nothing", missing[foo], foo.Label())
+	}
+}
+
+func TestMissingDepsFastPath(t *testing.T) {
+	type Attrs = map[string]interface{}
+
+	workDir, err := ioutil.TempDir("", "jadep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+	files := map[string]string{
+		"java/Foo.java":     "package com.foo;\nclass Foo {}",
+		"java/Sib.java":     "/* header */\npackage com.foo;\n\nclass Sib {}",
+		"dep/DepClass.java": "package com.dep;\nclass DepClass {}",
+	}
+	for name, content := range files {
+		fileName := filepath.Join(workDir, name)
+		if err := os.MkdirAll(filepath.Dir(fileName), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fileName, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dep := bazel.NewRule("java_library", "dep", "dep", Attrs{"srcs": []string{"DepClass.java"}})
+	consumer := bazel.NewRule("java_library", "java", "Foo", Attrs{"srcs": []string{"Foo.java", "Sib.java"}, "deps": []string{"//dep"}})
+	loader := &testLoader{pkgs: map[string]*bazel.Package{
+		"dep": {Path: filepath.Join(workDir, "dep"), Rules: map[string]*bazel.Rule{"dep": dep}},
+	}}
+
+	var tests = []struct {
+		desc           string
+		classNames     []ClassName
+		resolver       *testResolver
+		wantMissing    map[*bazel.Rule]map[ClassName][]bazel.Label
+		wantUnresolved []ClassName
+	}{
+		{
+			desc:        "All classes are provided by srcs and deps, so resolvers aren't called",
+			classNames:  []ClassName{"com.foo.Sib", "com.foo.Sib.Nested", "com.dep.DepClass"},
+			resolver:    &testResolver{expectedRequested: []ClassName{"unexpected - should not be called"}},
+			wantMissing: map[*bazel.Rule]map[ClassName][]bazel.Label{},
+		},
+		{
+			desc:       "Only classes that aren't provided locally are resolved",
+			classNames: []ClassName{"com.foo.Sib", "com.Other"},
+			resolver: &testResolver{
+				expectedRequested: []ClassName{"com.Other"},
+				cannedResponse:    map[ClassName][]*bazel.Rule{"com.Other": {bazel.NewRule("java_library", "other", "other", publicAttr)}},
+			},
+			wantMissing: map[*bazel.Rule]map[ClassName][]bazel.Label{consumer: {"com.Other": {"//other:other"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			config := Config{
+				WorkspaceDir: workDir,
+				Loader:       loader,
+				Resolvers:    []Resolver{tt.resolver},
+				DepsRanker:   &sortingdepsranker.Ranker{},
+			}
+			gotMissing, gotUnresolved, err := MissingDeps(context.Background(), config, []*bazel.Rule{consumer}, tt.classNames)
+			if err != nil {
+				t.Fatalf("MissingDeps failed: %v", err)
+			}
+			if diff := cmp.Diff(gotMissing, tt.wantMissing); diff != "" {
+				t.Errorf("MissingDeps returned diff in missing deps (-got +want):\n%s", diff)
+			}
+			if diff := cmp.Diff(gotUnresolved, tt.wantUnresolved); diff != "" {
+				t.Errorf("MissingDeps returned diff in unresolved class names (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProvidedClasses(t *testing.T) {
+	type Attrs = map[string]interface{}
+
+	pkgDir, err := ioutil.TempDir("", "jadep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(pkgDir)
+	write := func(fileName, content string, mtime time.Time) {
+		fileName = filepath.Join(pkgDir, fileName)
+		if err := ioutil.WriteFile(fileName, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(fileName, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	write("Foo.java", "package com.foo;\nclass Foo {}", t0)
+	rule := bazel.NewRule("java_library", "x", "x", Attrs{"srcs": []string{"Foo.java", "Generated.java", "Res.txt"}})
+	p := NewProvidedClasses()
+
+	if diff := cmp.Diff(p.Get(pkgDir, rule), []ClassName{"com.foo.Foo"}); diff != "" {
+		t.Errorf("Get returned diff (-got +want):\n%s", diff)
+	}
+	if !p.Provides(pkgDir, rule, "com.foo.Foo.Nested") {
+		t.Errorf("Provides(com.foo.Foo.Nested) = false, want true")
+	}
+
+	// Changing the package without touching the mtime isn't noticed, showing the cached value is used.
+	write("Foo.java", "package com.bar;\nclass Foo {}", t0)
+	if diff := cmp.Diff(p.Get(pkgDir, rule), []ClassName{"com.foo.Foo"}); diff != "" {
+		t.Errorf("Get with unchanged mtimes returned diff (-got +want):\n%s", diff)
+	}
+
+	// A new mtime invalidates the entry.
+	write("Foo.java", "package com.bar;\nclass Foo {}", t0.Add(time.Second))
+	if diff := cmp.Diff(p.Get(pkgDir, rule), []ClassName{"com.bar.Foo"}); diff != "" {
+		t.Errorf("Get after modification returned diff (-got +want):\n%s", diff)
+	}
+
+	// So does a source file that starts existing.
+	write("Generated.java", "package com.bar;\nclass Generated {}", t0)
+	if diff := cmp.Diff(p.Get(pkgDir, rule), []ClassName{"com.bar.Foo", "com.bar.Generated"}); diff != "" {
+		t.Errorf("Get after adding a file returned diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestMissingDepsCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	config := Config{
+		Loader:     &testLoader{},
+		Resolvers:  []Resolver{&testResolver{expectedRequested: []ClassName{"unexpected - should not be called"}}},
+		DepsRanker: &sortingdepsranker.Ranker{},
+	}
+	rule := bazel.NewRule("java_library", "java", "Foo", nil)
+	_, _, err := MissingDeps(ctx, config, []*bazel.Rule{rule}, []ClassName{"com.Bar"})
+	if err != context.Canceled {
+		t.Errorf("MissingDeps(cancelled context) has error %v, want %v", err, context.Canceled)
+	}
+}
+
+// TestMissingDepsWithErrors tests that errors affecting some class names don't stop the others from being processed.
+func TestMissingDepsWithErrors(t *testing.T) {
+	type Attrs = map[string]interface{}
+
+	bar := bazel.NewRule("java_library", "y", "bar", Attrs{"visibility": []string{"//y:group"}})
+	baz := bazel.NewRule("java_library", "z", "baz", publicAttr)
+	config := Config{
+		// Checking the visibility of //y:bar requires loading package y, which fails.
+		Loader: &failingLoader{failing: map[string]bool{"y": true}},
+		Resolvers: []Resolver{
+			&testResolver{[]ClassName{"com.Bar", "com.Baz", "com.Unknown"}, map[ClassName][]*bazel.Rule{"com.Bar": {bar}, "com.Baz": {baz}}},
+			&testResolver{expectedRequested: []ClassName{"error - this resolver fails"}},
+		},
+		DepsRanker: &sortingdepsranker.Ranker{},
+	}
+	rule := bazel.NewRule("java_library", "x", "Foo", nil)
+
+	missing, unresolved, classErrors, err := MissingDepsWithErrors(context.Background(), config, []*bazel.Rule{rule}, []ClassName{"com.Bar", "com.Baz", "com.Unknown"})
+	if err != nil {
+		t.Fatalf("MissingDepsWithErrors returned error %v, want nil", err)
+	}
+	if diff := cmp.Diff(map[*bazel.Rule]map[ClassName][]bazel.Label{rule: {"com.Baz": {"//z:baz"}}}, missing, sortRuleKeys); diff != "" {
+		t.Errorf("MissingDepsWithErrors returned diff in missing deps (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]ClassName{"com.Unknown"}, unresolved); diff != "" {
+		t.Errorf("MissingDepsWithErrors returned diff in unresolved class names (-want +got):\n%s", diff)
+	}
+	var gotErrClasses []ClassName
+	for cls := range classErrors {
+		gotErrClasses = append(gotErrClasses, cls)
+	}
+	sort.Slice(gotErrClasses, func(i, j int) bool { return gotErrClasses[i] < gotErrClasses[j] })
+	if diff := cmp.Diff([]ClassName{"com.Bar", "com.Unknown"}, gotErrClasses); diff != "" {
+		t.Errorf("MissingDepsWithErrors returned errors for unexpected class names (-want +got):\n%s", diff)
+	}
+}
+
+// failingLoader is a testLoader that fails to load the packages in 'failing'.
+type failingLoader struct {
+	testLoader
+	failing map[string]bool
+}
+
+func (l *failingLoader) Load(ctx context.Context, packages []string) (map[string]*bazel.Package, error) {
+	for _, p := range packages {
+		if l.failing[p] {
+			return nil, fmt.Errorf("error loading package %s", p)
+		}
+	}
+	return l.testLoader.Load(ctx, packages)
+}
+
+func TestUnfilteredMissingDeps(t *testing.T) {
+	type Attrs = map[string]interface{}
+
+	var tests = []struct {
+		desc             string
+		classNames       []ClassName
+		resolvers        []Resolver
+		wantClassToRules map[ClassName][]bazel.Label
+		wantUnresolved   []ClassName
+	}{
+		{
+			desc: "UnfilteredMissingDeps ranks the dependencies before returning them. " +
+				"In this test, the ranker is a simple lexicographic sort." +
+				"Therefore, //p2:dep2 appears after //p1:dep2 in the result, even though it was returned first from the resolver.",
+			classNames: []ClassName{"com.Bar"},
+			resolvers: []Resolver{
+				&testResolver{
+					[]ClassName{"com.Bar"},
+					map[ClassName][]*bazel.Rule{
+						"com.Bar": {
+							bazel.NewRule("java_library", "p2", "dep2", publicAttr),
+							bazel.NewRule("java_library", "p1", "dep1", publicAttr),
+						},
+					},
+				},
+			},
+			wantClassToRules: map[ClassName][]bazel.Label{
+				"com.Bar": {"//p1:dep1", "//p2:dep2"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			config := Config{
+				Resolvers:  test.resolvers,
+				DepsRanker: &sortingdepsranker.Ranker{},
+			}
+			classToRules, unresClasses := UnfilteredMissingDeps(context.Background(), config, test.classNames)
+			if !reflect.DeepEqual(classToRules, test.wantClassToRules) {
+				t.Errorf("UnfilteredMissingDeps returned missing dependencies %s, want %s", classToRules, test.wantClassToRules)
+			}
+			if !reflect.DeepEqual(unresClasses, test.wantUnresolved) {
+				t.Errorf("UnfilteredMissingDeps returned unresolved classnames %s, want %s", unresClasses, test.wantUnresolved)
+			}
+		})
+	}
+}
+
+func TestResolveWithProvenance(t *testing.T) {
+	dep1 := bazel.NewRule("java_library", "p1", "dep1", publicAttr)
+	dep2 := bazel.NewRule("java_library", "p2", "dep2", publicAttr)
+	config := Config{
+		Resolvers: []Resolver{
+			&testResolver{[]ClassName{"com.Bar", "com.Baz", "com.Unknown"}, map[ClassName][]*bazel.Rule{"com.Bar": {dep1}, "com.Baz": {dep2}}},
+			// Unlike resolveAll, class names resolved by the first resolver are passed to the second one as well.
+			&testResolver{[]ClassName{"com.Bar", "com.Baz", "com.Unknown"}, map[ClassName][]*bazel.Rule{"com.Bar": {dep1, dep2}}},
+			&testResolver{expectedRequested: []ClassName{"error - resolvers that fail are skipped"}},
+		},
+	}
+	got := ResolveWithProvenance(context.Background(), config, []ClassName{"com.Bar", "com.Baz", "com.Unknown"})
+	want := map[ClassName]map[bazel.Label][]string{
+		"com.Bar": {"//p1:dep1": {"TestResolver", "TestResolver"}, "//p2:dep2": {"TestResolver"}},
+		"com.Baz": {"//p2:dep2": {"TestResolver"}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ResolveWithProvenance returned diff (-want +got):\n%s", diff)
+	}
+}
+
+func createWorkspace(t *testing.T) string {
+	root, err := ioutil.TempDir("", "jadep")
+	if err != nil {
+		t.Fatalf("Error called ioutil.TempDir: %v", err)
+	}
+	workDir := filepath.Join(root, "workspace")
+	return workDir
+}
+
+func TestExcludeClassNames(t *testing.T) {
+	var tests = []struct {
+		desc       string
+		blackList  []string
+		classNames []ClassName
+		want       []ClassName
+	}{
+		{
+			desc:       "The class name util.R should be excluded leaving an empty string at output.",
+			blackList:  []string{`.*\.R$`},
+			classNames: []ClassName{"util.R"},
+			want:       nil,
+		},
+		{
+			desc:       "A negated pattern re-includes a subset of the excluded classes.",
+			blackList:  []string{`com\.foo\..*`, `!com\.foo\.api\..*`},
+			classNames: []ClassName{"com.foo.Bar", "com.foo.api.Baz", "com.other.Bar"},
+			want:       []ClassName{"com.foo.api.Baz", "com.other.Bar"},
+		},
+		{
+			desc:       "The last matching pattern wins.",
+			blackList:  []string{`!com\.foo\.api\..*`, `com\.foo\..*`},
+			classNames: []ClassName{"com.foo.Bar", "com.foo.api.Baz"},
+			want:       nil,
+		},
+		{
+			desc:       "Empty patterns are ignored rather than matching every class.",
+			blackList:  []string{"", " "},
+			classNames: []ClassName{"com.Foo"},
+			want:       []ClassName{"com.Foo"},
+		},
+		{
+			desc:       "Invalid patterns are ignored.",
+			blackList:  []string{"(unclosed", `.*\.R$`},
+			classNames: []ClassName{"util.R", "util.S"},
+			want:       []ClassName{"util.S"},
+		},
+	}
+	for _, test := range tests {
+		actual := ExcludeClassNames(test.blackList, test.classNames)
+		if !reflect.DeepEqual(actual, test.want) {
+			t.Errorf("%s: ExcludedClassNames(%s, %s) = %s, want %s", test.desc, test.blackList, test.classNames, actual, test.want)
+		}
+	}
+}
+
+func TestCompileClassNameBlacklist(t *testing.T) {
+	if _, err := CompileClassNameBlacklist([]string{`.*\.R$`, "!(unclosed"}); err == nil {
+		t.Errorf("CompileClassNameBlacklist(invalid pattern) returned nil error")
+	}
+
+	b, err := CompileClassNameBlacklist([]string{`com\.foo\..*`, `!com\.foo\.api\..*`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add(`^com\.foo\.api\.Internal$`); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add("(unclosed", "com.Other"); err == nil {
+		t.Errorf("Add(invalid pattern) returned nil error")
+	}
+	got := b.Filter([]ClassName{"com.foo.Bar", "com.foo.api.Baz", "com.foo.api.Internal", "com.Other"})
+	want := []ClassName{"com.foo.api.Baz", "com.Other"}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("Filter returned diff (-got +want):\n%s", diff)
+	}
+
+	var nilBlacklist *ClassNameBlacklist
+	if nilBlacklist.Excludes("com.Foo") {
+		t.Errorf("nil blacklist excludes com.Foo, want false")
+	}
+}
+
+func TestGetKindForNewRule(t *testing.T) {
+	var tests = []struct {
+		desc         string
+		filename     string
+		classnames   []ClassName
+		wantRuleType string
+	}{
+		{
+			"When a file ends with Test.java but doesn't reference JUnit, we return java_library",
+			"java/com/FooTest.java",
+			[]ClassName{"com.Foo"},
+			"java_library",
+		},
+		{
+			"When a file does not end with Test.java but references JUnit, we return java_library",
+			"java/com/Foo.java",
+			[]ClassName{"org.junit.Test"},
+			"java_library",
+		},
+		{
+			"When a file does not end with Test.java and doesn't reference JUnit, we return java_library",
+			"java/com/Foo.java",
+			[]ClassName{},
+			"java_library",
+		},
+		{
+			"When a file ends with Test.java and references JUnit, we return java_test",
+			"java/com/FooTest.java",
+			[]ClassName{"org.junit.Test"},
+			"java_test",
+		},
+	}
+	for _, test := range tests {
+		returnedRuleType := GetKindForNewRule(test.filename, test.classnames)
+		if returnedRuleType != test.wantRuleType {
+			t.Errorf("%s: FindPackageName(%s, %s) = %s, want %s", test.desc, test.filename, test.classnames, returnedRuleType, test.wantRuleType)
+		}
+	}
+}
+
+// recordingResolver returns canned responses, and records the class names it's asked to resolve.
+type recordingResolver struct {
+	cannedResponse map[ClassName][]*bazel.Rule
+	requested      [][]ClassName
+}
+
+func (r *recordingResolver) Name() string {
+	return "RecordingResolver"
+}
+
+func (r *recordingResolver) Resolve(ctx context.Context, classNames []ClassName, consumingRules map[bazel.Label]map[bazel.Label]bool) (map[ClassName][]*bazel.Rule, error) {
+	r.requested = append(r.requested, append([]ClassName(nil), classNames...))
+	ret := make(map[ClassName][]*bazel.Rule)
+	for _, cls := range classNames {
+		if rules, ok := r.cannedResponse[cls]; ok {
+			ret[cls] = rules
+		}
+	}
+	return ret, nil
+}
+
+func TestMissingDepsResolutionCache(t *testing.T) {
+	type Attrs = map[string]interface{}
+
+	dep := bazel.NewRule("java_library", "d", "dep", publicAttr)
+	resolver := &recordingResolver{cannedResponse: map[ClassName][]*bazel.Rule{
+		"com.Bar":   {bazel.NewRule("java_library", "b", "bar", publicAttr), bazel.NewRule("java_library", "a", "bar", publicAttr)},
+		"com.Dep":   {dep},
+		"com.JDK":   nil,
+		"com.Other": {dep},
+	}}
+	config := Config{
+		Loader:          &testLoader{},
+		Resolvers:       []Resolver{resolver},
+		DepsRanker:      pkgRanker{},
+		ResolutionCache: NewResolutionCache(),
+	}
+	foo := bazel.NewRule("java_library", "x", "foo", nil)
+	gwt := bazel.NewRule("java_library", "x", "foo-gwt", Attrs{"deps": []string{"//d:dep"}})
+
+	tests := []struct {
+		rule           *bazel.Rule
+		classNames     []ClassName
+		wantMissing    map[ClassName][]bazel.Label
+		wantUnresolved []ClassName
+		wantRequested  [][]ClassName
+	}{
+		{
+			rule:           foo,
+			classNames:     []ClassName{"com.Bar", "com.Dep", "com.JDK", "com.Unknown"},
+			wantMissing:    map[ClassName][]bazel.Label{"com.Bar": {"//a:bar", "//b:bar"}, "com.Dep": {"//d:dep"}},
+			wantUnresolved: []ClassName{"com.Unknown"},
+			wantRequested:  [][]ClassName{{"com.Bar", "com.Dep", "com.JDK", "com.Unknown"}},
+		},
+		{
+			// Everything is memoized, and only filtering by the existing deps of foo-gwt remains.
+			rule:           gwt,
+			classNames:     []ClassName{"com.Bar", "com.Dep", "com.JDK", "com.Unknown"},
+			wantMissing:    map[ClassName][]bazel.Label{"com.Bar": {"//a:bar", "//b:bar"}},
+			wantUnresolved: []ClassName{"com.Unknown"},
+			wantRequested:  [][]ClassName{{"com.Bar", "com.Dep", "com.JDK", "com.Unknown"}},
+		},
+		{
+			// com.Other resolves to an existing dep of foo-gwt, which isn't memoized.
+			rule:          gwt,
+			classNames:    []ClassName{"com.Other"},
+			wantRequested: [][]ClassName{{"com.Bar", "com.Dep", "com.JDK", "com.Unknown"}, {"com.Other"}},
+		},
+		{
+			rule:          foo,
+			classNames:    []ClassName{"com.Other"},
+			wantMissing:   map[ClassName][]bazel.Label{"com.Other": {"//d:dep"}},
+			wantRequested: [][]ClassName{{"com.Bar", "com.Dep", "com.JDK", "com.Unknown"}, {"com.Other"}, {"com.Other"}},
+		},
+	}
+	for _, tt := range tests {
+		missing, unresolved, err := MissingDeps(context.Background(), config, []*bazel.Rule{tt.rule}, tt.classNames)
+		if err != nil {
+			t.Fatalf("MissingDeps(%s, %v) returned error %v, want nil", tt.rule.Label(), tt.classNames, err)
+		}
+		if diff := cmp.Diff(missing[tt.rule], tt.wantMissing); diff != "" {
+			t.Errorf("MissingDeps(%s, %v) returned diff in missing deps (-got +want):\n%s", tt.rule.Label(), tt.classNames, diff)
+		}
+		if diff := cmp.Diff(unresolved, tt.wantUnresolved); diff != "" {
+			t.Errorf("MissingDeps(%s, %v) returned diff in unresolved class names (-got +want):\n%s", tt.rule.Label(), tt.classNames, diff)
+		}
+		if diff := cmp.Diff(resolver.requested, tt.wantRequested); diff != "" {
+			t.Errorf("After MissingDeps(%s, %v), resolver was asked to resolve diff (-got +want):\n%s", tt.rule.Label(), tt.classNames, diff)
+		}
+	}
+}
+
+func TestMissingDepsRanksInConsumingPackage(t *testing.T) {
+	type Attrs = map[string]interface{}
+
+	resolver := &recordingResolver{cannedResponse: map[ClassName][]*bazel.Rule{
+		"com.Guava": {bazel.NewRule("java_library", "a", "guava", publicAttr), bazel.NewRule("java_library", "b", "guava", publicAttr)},
+	}}
+	foo := bazel.NewRule("java_library", "x", "foo", nil)
+	pkg := &bazel.Package{Rules: map[string]*bazel.Rule{
+		"foo":  foo,
+		"bar":  bazel.NewRule("java_library", "x", "bar", Attrs{"deps": []string{"//b:guava"}}),
+		"baz":  bazel.NewRule("java_library", "x", "baz", Attrs{"exports": []string{"//b:guava"}}),
+		"qux":  bazel.NewRule("java_library", "x", "qux", Attrs{"deps": []string{"//a:guava"}}),
+		"test": bazel.NewRule("java_test", "x", "test", Attrs{"deps": []string{":foo"}}),
+	}}
+
+	tests := []struct {
+		desc   string
+		loader pkgloading.Loader
+		want   []bazel.Label
+	}{
+		{
+			desc:   "more rules in //x depend on //b:guava",
+			loader: &testLoader{pkgs: map[string]*bazel.Package{"x": pkg}},
+			want:   []bazel.Label{"//b:guava", "//a:guava"},
+		},
+		{
+			desc:   "//x isn't loaded, so candidates are ranked lexicographically",
+			loader: &testLoader{},
+			want:   []bazel.Label{"//a:guava", "//b:guava"},
+		},
+	}
+	for _, tt := range tests {
+		config := Config{
+			Loader:     tt.loader,
+			Resolvers:  []Resolver{resolver},
+			DepsRanker: &sortingdepsranker.Ranker{},
+		}
+		missing, _, err := MissingDeps(context.Background(), config, []*bazel.Rule{foo}, []ClassName{"com.Guava"})
+		if err != nil {
+			t.Fatalf("%s: MissingDeps returned error %v, want nil", tt.desc, err)
+		}
+		if diff := cmp.Diff(missing[foo]["com.Guava"], tt.want); diff != "" {
+			t.Errorf("%s: MissingDeps returned diff in candidates for com.Guava (-got +want):\n%s", tt.desc, diff)
+		}
+	}
+}
+
+type testLoader struct {
+	pkgs map[string]*bazel.Package
+}
+
+func (l *testLoader) Load(ctx context.Context, packages []string) (map[string]*bazel.Package, error) {
+	result := make(map[string]*bazel.Package)
+	for _, pkgName := range packages {
+		if p, ok := l.pkgs[pkgName]; ok {
+			result[pkgName] = p
+		}
+	}
+	return result, nil
+}
+
+func TestImplicitImports(t *testing.T) {
+	in := map[ClassName][]bazel.Label{
+		"java.lang.reflect.Method":   nil,
+		"java.lang.Object":           nil,
+		"java.lang.String":           nil,
+		"java.util.Map":              nil,
+		"javax.annotation.Generated": nil,
+	}
+	want := []string{"Object", "String"}
+
+	lines := future.NewValue(func() interface{} {
+		return in
+	})
+	got := ImplicitImports(lines).Get()
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("Diff in ImplicitImports(%v) (-got +want):\n%s", in, diff)
+	}
+}
+
+func TestRestrictImplicitImports(t *testing.T) {
+	jdk8 := future.Immediate(map[ClassName][]bazel.Label{"java.lang.Object": nil, "java.lang.String": nil, "java.lang.Module": nil})
+	jdk7 := future.Immediate(map[ClassName][]bazel.Label{"java.lang.Object": nil, "java.lang.String": nil})
+	implicitImports := []string{"Module", "Object", "Record", "String"}
+
+	if diff := cmp.Diff(RestrictImplicitImports(implicitImports, nil), implicitImports); diff != "" {
+		t.Errorf("RestrictImplicitImports without class lists returned diff (-got +want):\n%s", diff)
+	}
+	if diff := cmp.Diff(RestrictImplicitImports(implicitImports, []future.Getter{jdk8}), []string{"Module", "Object", "String"}); diff != "" {
+		t.Errorf("RestrictImplicitImports with one class list returned diff (-got +want):\n%s", diff)
+	}
+	if diff := cmp.Diff(RestrictImplicitImports(implicitImports, []future.Getter{jdk8, jdk7}), []string{"Object", "String"}); diff != "" {
+		t.Errorf("RestrictImplicitImports with two class lists returned diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestJavaRelease(t *testing.T) {
+	tests := []struct {
+		javacopts []string
+		want      string
+	}{
+		{nil, ""},
+		{[]string{"-Xlint:all"}, ""},
+		{[]string{"--release", "8"}, "8"},
+		{[]string{"--release=11"}, "11"},
+		{[]string{"-Xlint:all --release 8"}, "8"},
+		{[]string{"--release", "8", "--release=11"}, "11"},
+		{[]string{"--release"}, ""},
+	}
+	for _, tt := range tests {
+		rule := bazel.NewRule("java_library", "x", "x", map[string]interface{}{"javacopts": tt.javacopts})
+		if got := JavaRelease(rule); got != tt.want {
+			t.Errorf("JavaRelease(javacopts = %q) = %q, want %q", tt.javacopts, got, tt.want)
+		}
 	}
 }
 
@@ -549,28 +1596,84 @@ func TestRulesConsumingFile(t *testing.T) {
 			existingPkgs: map[string]*bazel.Package{
 				"x": {
 					Rules: map[string]*bazel.Rule{
-						"x":     bazel.NewRule("java_library", "x", "x", map[string]interface{}{"srcs": []string{"Foo.java"}}),
-						"x-gwt": bazel.NewRule("java_library", "x", "x-gwt", map[string]interface{}{"srcs": []string{"Foo.java"}}),
+						"x":     bazel.NewRule("java_library", "x", "x", map[string]interface{}{"srcs": []string{"Foo.java"}}),
+						"x-gwt": bazel.NewRule("java_library", "x", "x-gwt", map[string]interface{}{"srcs": []string{"Foo.java"}}),
+					},
+				},
+			},
+			want: []*bazel.Rule{
+				bazel.NewRule("java_library", "x", "x", map[string]interface{}{"srcs": []string{"Foo.java"}}),
+				bazel.NewRule("java_library", "x", "x-gwt", map[string]interface{}{"srcs": []string{"Foo.java"}}),
+			},
+		},
+		{
+			desc:     "Rule consumes a file in a subdirectory",
+			fileName: "x/subdir/Foo.java",
+			existingPkgs: map[string]*bazel.Package{
+				"x": {
+					Rules: map[string]*bazel.Rule{
+						"x": bazel.NewRule("java_library", "x", "x", map[string]interface{}{"srcs": []string{"subdir/Foo.java"}}),
+					},
+				},
+			},
+			want: []*bazel.Rule{
+				bazel.NewRule("java_library", "x", "x", map[string]interface{}{"srcs": []string{"subdir/Foo.java"}}),
+			},
+		},
+		{
+			desc:     "Rules in enclosing packages consume the file using its label",
+			fileName: "x/y/Foo.java",
+			existingPkgs: map[string]*bazel.Package{
+				"x/y": {
+					Rules: map[string]*bazel.Rule{
+						"y": bazel.NewRule("java_library", "x/y", "y", map[string]interface{}{"srcs": []string{":Foo.java"}}),
+					},
+				},
+				"x": {
+					Rules: map[string]*bazel.Rule{
+						"x":     bazel.NewRule("java_library", "x", "x", map[string]interface{}{"srcs": []string{"//x/y:Foo.java"}}),
+						"other": bazel.NewRule("java_library", "x", "other", map[string]interface{}{"srcs": []string{"//x/y:Bar.java"}}),
+					},
+				},
+			},
+			want: []*bazel.Rule{
+				bazel.NewRule("java_library", "x/y", "y", map[string]interface{}{"srcs": []string{":Foo.java"}}),
+				bazel.NewRule("java_library", "x", "x", map[string]interface{}{"srcs": []string{"//x/y:Foo.java"}}),
+			},
+		},
+		{
+			desc:     "Rules consume the file through nested filegroups",
+			fileName: "x/Foo.java",
+			existingPkgs: map[string]*bazel.Package{
+				"x": {
+					Rules: map[string]*bazel.Rule{
+						"srcs":        bazel.NewRule("filegroup", "x", "srcs", map[string]interface{}{"srcs": []string{"Foo.java", "all_srcs"}}),
+						"all_srcs":    bazel.NewRule("filegroup", "x", "all_srcs", map[string]interface{}{"srcs": []string{":srcs"}}),
+						"x":           bazel.NewRule("java_library", "x", "x", map[string]interface{}{"srcs": []string{":all_srcs"}}),
+						"unrelated":   bazel.NewRule("filegroup", "x", "unrelated", map[string]interface{}{"srcs": []string{"Bar.java"}}),
+						"x_unrelated": bazel.NewRule("java_library", "x", "x_unrelated", map[string]interface{}{"srcs": []string{":unrelated"}}),
 					},
 				},
 			},
 			want: []*bazel.Rule{
-				bazel.NewRule("java_library", "x", "x", map[string]interface{}{"srcs": []string{"Foo.java"}}),
-				bazel.NewRule("java_library", "x", "x-gwt", map[string]interface{}{"srcs": []string{"Foo.java"}}),
+				bazel.NewRule("java_library", "x", "x", map[string]interface{}{"srcs": []string{":all_srcs"}}),
 			},
 		},
 		{
-			desc:     "Rule consumes a file in a subdirectory",
-			fileName: "x/subdir/Foo.java",
+			desc:     "Rules consume a generated file through its generating rule",
+			fileName: "x/Foo.java",
 			existingPkgs: map[string]*bazel.Package{
 				"x": {
+					Files: map[string]string{"Foo.java": "gen", "gen.txt": ""},
 					Rules: map[string]*bazel.Rule{
-						"x": bazel.NewRule("java_library", "x", "x", map[string]interface{}{"srcs": []string{"subdir/Foo.java"}}),
+						"gen":       bazel.NewRule("genrule", "x", "gen", map[string]interface{}{"srcs": []string{"gen.txt"}}),
+						"x":         bazel.NewRule("java_library", "x", "x", map[string]interface{}{"srcs": []string{":gen"}}),
+						"unrelated": bazel.NewRule("java_library", "x", "unrelated", map[string]interface{}{"srcs": []string{"Bar.java"}}),
 					},
 				},
 			},
 			want: []*bazel.Rule{
-				bazel.NewRule("java_library", "x", "x", map[string]interface{}{"srcs": []string{"subdir/Foo.java"}}),
+				bazel.NewRule("java_library", "x", "x", map[string]interface{}{"srcs": []string{":gen"}}),
 			},
 		},
 	}
@@ -598,6 +1701,68 @@ func TestRulesConsumingFile(t *testing.T) {
 	}
 }
 
+// TestRulesConsumingFileAnalysisCache tests that RulesConsumingFile doesn't examine packages again for a file whose
+// consuming rules are memoized in config.AnalysisCache, but does so for files no rule consumes.
+func TestRulesConsumingFileAnalysisCache(t *testing.T) {
+	workDir := createWorkspace(t)
+	cleanup := createBuildFileDir(t, []string{"x"}, workDir)
+	defer cleanup()
+
+	loader := &countingLoader{testLoader: testLoader{map[string]*bazel.Package{
+		"x": {
+			Rules: map[string]*bazel.Rule{
+				"x": bazel.NewRule("java_library", "x", "x", map[string]interface{}{"srcs": []string{"Foo.java"}}),
+			},
+		},
+	}}}
+	config := Config{WorkspaceDir: workDir, Loader: loader, AnalysisCache: NewAnalysisCache()}
+	want := []*bazel.Rule{bazel.NewRule("java_library", "x", "x", map[string]interface{}{"srcs": []string{"Foo.java"}})}
+	for i := 0; i < 2; i++ {
+		got, err := RulesConsumingFile(context.Background(), config, "x/Foo.java")
+		if err != nil {
+			t.Fatalf("RulesConsumingFile returned error: %v", err)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("RulesConsumingFile returned diff (-want +got):\n%s", diff)
+		}
+	}
+	// One call for the package of the file, and one for its (non-existent) enclosing packages.
+	if loader.calls != 2 {
+		t.Errorf("Loader was called %d times, want 2", loader.calls)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := RulesConsumingFile(context.Background(), config, "x/Bar.java"); err != nil {
+			t.Fatalf("RulesConsumingFile returned error: %v", err)
+		}
+	}
+	if loader.calls != 6 {
+		t.Errorf("Loader was called %d times, want 6", loader.calls)
+	}
+}
+
+// countingLoader is a testLoader that counts calls to Load, and how many of them requested each package.
+type countingLoader struct {
+	testLoader
+
+	mu    sync.Mutex // guards calls and loads
+	calls int
+	loads map[string]int
+}
+
+func (l *countingLoader) Load(ctx context.Context, packages []string) (map[string]*bazel.Package, error) {
+	l.mu.Lock()
+	l.calls++
+	if l.loads == nil {
+		l.loads = make(map[string]int)
+	}
+	for _, p := range packages {
+		l.loads[p]++
+	}
+	l.mu.Unlock()
+	return l.testLoader.Load(ctx, packages)
+}
+
 func TestCreateRule(t *testing.T) {
 	type Attrs = map[string]interface{}
 	tests := []struct {
@@ -653,3 +1818,575 @@ func TestCreateRule(t *testing.T) {
 		})
 	}
 }
+
+func TestCreateRuleWithTemplates(t *testing.T) {
+	type Attrs = map[string]interface{}
+	templates, err := ParseRuleTemplates([]byte(`{
+		"java_test": {"test_class": "{class}", "size": "small", "runtime_deps": ["//third_party/junit"], "srcs": ["Other.java"]},
+		"java_library": {"tags": ["{package}:{name}"]}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	namingRules := []NamingRule{{FileNameMatcher: regexp.MustCompile(`Test\.java$`), RuleKind: "java_test"}}
+	tests := []struct {
+		fileName string
+		want     *bazel.Rule
+	}{
+		{
+			fileName: "src/test/java/com/foo/FooTest.java",
+			want: bazel.NewRule("java_test", "src/test/java/com/foo", "FooTest", Attrs{
+				"srcs": []string{"FooTest.java"}, "test_class": "com.foo.FooTest", "size": "small", "runtime_deps": []string{"//third_party/junit"},
+			}),
+		},
+		{
+			// The class can't be computed outside a Java source root, so test_class is left to Bazel.
+			fileName: "tests/FooTest.java",
+			want: bazel.NewRule("java_test", "tests", "FooTest", Attrs{
+				"srcs": []string{"FooTest.java"}, "size": "small", "runtime_deps": []string{"//third_party/junit"},
+			}),
+		},
+		{
+			fileName: "java/com/Foo.java",
+			want:     bazel.NewRule("java_library", "java/com", "Foo", Attrs{"srcs": []string{"Foo.java"}, "tags": []string{"java/com:Foo"}}),
+		},
+	}
+	for _, tt := range tests {
+		got := CreateRuleWithTemplates(tt.fileName, namingRules, "java_library", templates)
+		if diff := cmp.Diff(got, tt.want); diff != "" {
+			t.Errorf("CreateRuleWithTemplates(%q) returned wrong rule: (-got +want).\n%s", tt.fileName, diff)
+		}
+	}
+}
+
+func TestParseRuleTemplatesErrors(t *testing.T) {
+	for _, s := range []string{`[]`, `{"java_test": {"size": 1}}`, `{"java_test": {"tags": ["a", 1]}}`} {
+		if _, err := ParseRuleTemplates([]byte(s)); err == nil {
+			t.Errorf("ParseRuleTemplates(%s) returned nil error, want non-nil", s)
+		}
+	}
+}
+
+func TestInferTestClass(t *testing.T) {
+	type Attrs = map[string]interface{}
+	tests := []struct {
+		desc    string
+		rule    *bazel.Rule
+		javaPkg string
+		want    string
+	}{
+		{
+			desc:    "Bazel can't infer the class outside a java/ or javatests/ directory",
+			rule:    bazel.NewRule("java_test", "tests/foo", "FooTest", Attrs{"srcs": []string{"FooTest.java", "Helper.java"}}),
+			javaPkg: "com.foo",
+			want:    "com.foo.FooTest",
+		},
+		{
+			desc:    "Bazel infers the wrong class when the package doesn't match the directory",
+			rule:    bazel.NewRule("java_test", "javatests/foo", "FooTest", Attrs{"srcs": []string{"FooTest.java"}}),
+			javaPkg: "com.foo",
+			want:    "com.foo.FooTest",
+		},
+		{
+			desc:    "The only Java src declares the class, even if it's named differently than the rule",
+			rule:    bazel.NewRule("java_test", "tests", "test", Attrs{"srcs": []string{"FooTest.java", "data.txt"}}),
+			javaPkg: "com.foo",
+			want:    "com.foo.FooTest",
+		},
+		{
+			desc:    "Bazel infers the right class",
+			rule:    bazel.NewRule("java_test", "javatests/com/foo", "FooTest", Attrs{"srcs": []string{"FooTest.java"}}),
+			javaPkg: "com.foo",
+		},
+		{
+			desc:    "test_class is already set",
+			rule:    bazel.NewRule("java_test", "tests", "FooTest", Attrs{"srcs": []string{"FooTest.java"}, "test_class": "com.foo.AllTests"}),
+			javaPkg: "com.foo",
+		},
+		{
+			desc:    "The test runner isn't used",
+			rule:    bazel.NewRule("java_test", "tests", "FooTest", Attrs{"srcs": []string{"FooTest.java"}, "use_testrunner": false}),
+			javaPkg: "com.foo",
+		},
+		{
+			desc:    "Several Java srcs, none named like the rule",
+			rule:    bazel.NewRule("java_test", "tests", "test", Attrs{"srcs": []string{"FooTest.java", "BarTest.java"}}),
+			javaPkg: "com.foo",
+		},
+		{
+			desc:    "Not a java_test",
+			rule:    bazel.NewRule("java_library", "tests", "FooTest", Attrs{"srcs": []string{"FooTest.java"}}),
+			javaPkg: "com.foo",
+		},
+	}
+	for _, tt := range tests {
+		if got := InferTestClass(tt.rule, tt.javaPkg); got != tt.want {
+			t.Errorf("%s: InferTestClass = %q, want %q", tt.desc, got, tt.want)
+		}
+	}
+}
+
+func TestParseRequiredAttrs(t *testing.T) {
+	got, err := ParseRequiredAttrs("third_party/.*:licenses=notice; javatests/.*:tags=manual, small;")
+	if err != nil {
+		t.Fatalf("ParseRequiredAttrs returned error %v, want nil", err)
+	}
+	var gotStrs []string
+	for _, r := range got {
+		gotStrs = append(gotStrs, fmt.Sprintf("%s %v", r.PkgNameMatcher, r.Attrs))
+	}
+	want := []string{
+		"^(?:third_party/.*)$ map[licenses:[notice]]",
+		"^(?:javatests/.*)$ map[tags:[manual small]]",
+	}
+	if diff := cmp.Diff(want, gotStrs); diff != "" {
+		t.Errorf("ParseRequiredAttrs returned diff (-want +got):\n%s", diff)
+	}
+
+	for _, s := range []string{"third_party", "third_party/.*=notice", "third_party/.*:=notice", "(:licenses=notice"} {
+		if _, err := ParseRequiredAttrs(s); err == nil {
+			t.Errorf("ParseRequiredAttrs(%q) returned nil error, want error", s)
+		}
+	}
+}
+
+func TestApplyRequiredAttrs(t *testing.T) {
+	type Attrs = map[string]interface{}
+	required := []RequiredAttrs{
+		{PkgNameMatcher: regexp.MustCompile("^third_party/.*$"), Attrs: map[string][]string{"licenses": {"notice"}}},
+		{PkgNameMatcher: regexp.MustCompile("^third_party/.*$"), Attrs: map[string][]string{"licenses": {"restricted"}, "compatible_with": {"//buildenv:x"}}},
+	}
+	tests := []struct {
+		desc string
+		pkg  *bazel.Package
+		rule *bazel.Rule
+		want *bazel.Rule
+	}{
+		{
+			desc: "Package doesn't match",
+			rule: bazel.NewRule("java_library", "java/com", "Foo", nil),
+			want: bazel.NewRule("java_library", "java/com", "Foo", nil),
+		},
+		{
+			desc: "First entry wins",
+			rule: bazel.NewRule("java_library", "third_party/foo", "Foo", nil),
+			want: bazel.NewRule("java_library", "third_party/foo", "Foo", Attrs{"licenses": []string{"notice"}, "compatible_with": []string{"//buildenv:x"}}),
+		},
+		{
+			desc: "Package calls licenses()",
+			pkg:  &bazel.Package{DefaultLicenses: []string{"notice"}},
+			rule: bazel.NewRule("java_library", "third_party/foo", "Foo", nil),
+			want: bazel.NewRule("java_library", "third_party/foo", "Foo", Attrs{"compatible_with": []string{"//buildenv:x"}}),
+		},
+		{
+			desc: "Rule already sets the attribute",
+			rule: bazel.NewRule("java_library", "third_party/foo", "Foo", Attrs{"licenses": []string{"unencumbered"}}),
+			want: bazel.NewRule("java_library", "third_party/foo", "Foo", Attrs{"licenses": []string{"unencumbered"}, "compatible_with": []string{"//buildenv:x"}}),
+		},
+	}
+	for _, tt := range tests {
+		ApplyRequiredAttrs(tt.pkg, tt.rule, required)
+		if diff := cmp.Diff(tt.want, tt.rule); diff != "" {
+			t.Errorf("%s: ApplyRequiredAttrs produced diff (-want +got):\n%s", tt.desc, diff)
+		}
+	}
+}
+
+func TestPlanSplitByJavaPackage(t *testing.T) {
+	type Attrs = map[string]interface{}
+	tests := []struct {
+		desc         string
+		rule         *bazel.Rule
+		javaPackages map[string]string
+		want         *SplitPlan
+	}{
+		{
+			desc:         "all srcs declare the same Java package",
+			rule:         bazel.NewRule("java_library", "x", "Foo", Attrs{"srcs": []string{"A.java", "B.java"}}),
+			javaPackages: map[string]string{"A.java": "com.x", "B.java": "com.x"},
+			want:         nil,
+		},
+		{
+			desc:         "srcs declare different Java packages",
+			rule:         bazel.NewRule("java_library", "x", "Foo", Attrs{"srcs": []string{"A.java", "B.java", "C.java", "res.txt"}, "deps": []string{"//y:Bar"}}),
+			javaPackages: map[string]string{"A.java": "com.x.util", "B.java": "com.x", "C.java": "com.x"},
+			want: &SplitPlan{
+				Rule: bazel.NewRule("java_library", "x", "Foo", Attrs{"srcs": []string{"A.java", "B.java", "C.java", "res.txt"}, "deps": []string{"//y:Bar"}}),
+				NewRules: []*bazel.Rule{
+					bazel.NewRule("java_library", "x", "Foo_x", Attrs{"srcs": []string{"B.java", "C.java"}, "deps": []string{"//y:Bar"}}),
+					bazel.NewRule("java_library", "x", "Foo_util", Attrs{"srcs": []string{"A.java"}, "deps": []string{"//y:Bar"}}),
+				},
+				ApproximateDeps: map[bazel.Label]bool{"//x:Foo_x": true, "//x:Foo_util": true},
+			},
+		},
+		{
+			desc:         "Java packages whose last components collide are named in full",
+			rule:         bazel.NewRule("java_library", "x", "Foo", Attrs{"srcs": []string{"A.java", "B.java"}}),
+			javaPackages: map[string]string{"A.java": "com.a.util", "B.java": "com.b.util"},
+			want: &SplitPlan{
+				Rule: bazel.NewRule("java_library", "x", "Foo", Attrs{"srcs": []string{"A.java", "B.java"}}),
+				NewRules: []*bazel.Rule{
+					bazel.NewRule("java_library", "x", "Foo_com_a_util", Attrs{"srcs": []string{"A.java"}}),
+					bazel.NewRule("java_library", "x", "Foo_com_b_util", Attrs{"srcs": []string{"B.java"}}),
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		got := PlanSplitByJavaPackage(tt.rule, tt.javaPackages)
+		if diff := cmp.Diff(got, tt.want); diff != "" {
+			t.Errorf("%s: PlanSplitByJavaPackage() diff (-got +want):\n%s", tt.desc, diff)
+		}
+	}
+}
+
+func TestNarrowSplitDeps(t *testing.T) {
+	type Attrs = map[string]interface{}
+	workspaceDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workspaceDir)
+	if err := os.MkdirAll(filepath.Join(workspaceDir, "x"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"x/A.java": "package com.x.util; class A {}",
+		"x/B.java": "package com.x; class B {}",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(workspaceDir, name), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	impl := bazel.NewRule("java_library", "y", "Impl", nil)
+	loader := &testLoader{map[string]*bazel.Package{"y": {Rules: map[string]*bazel.Rule{
+		"Bar":    bazel.NewRule("java_library", "y", "Bar", nil),
+		"Unused": bazel.NewRule("java_library", "y", "Unused", nil),
+		"Api":    bazel.NewRule("java_library", "y", "Api", Attrs{"exports": []string{":Impl"}}),
+		"Impl":   impl,
+	}}}}
+	resolver := &testResolver{
+		[]ClassName{"com.bar.Bar", "com.impl.Impl"},
+		map[ClassName][]*bazel.Rule{
+			"com.bar.Bar":   {bazel.NewRule("java_library", "y", "Bar", nil)},
+			"com.impl.Impl": {impl},
+		},
+	}
+	config := Config{WorkspaceDir: workspaceDir, Loader: loader, Resolvers: []Resolver{resolver}, DepsRanker: &sortingdepsranker.Ranker{}}
+
+	tests := []struct {
+		desc       string
+		classNames []ClassName
+		wantOK     bool
+		wantDeps   []string
+	}{
+		{
+			desc:       "Deps that provide class names, directly or through exports, are kept",
+			classNames: []ClassName{"com.bar.Bar", "com.impl.Impl", "com.x.B"},
+			wantOK:     true,
+			wantDeps:   []string{"//y:Bar", "//y:Api"},
+		},
+		{
+			desc:       "Deps aren't narrowed if a class name can't be resolved",
+			classNames: []ClassName{"com.bar.Bar", "com.unknown.Unknown"},
+			wantOK:     false,
+			wantDeps:   []string{"//y:Bar", "//y:Unused", "//y:Api"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			rule := bazel.NewRule("java_library", "x", "Foo", Attrs{"srcs": []string{"A.java", "B.java"}, "deps": []string{"//y:Bar", "//y:Unused", "//y:Api"}})
+			plan := PlanSplitByJavaPackage(rule, map[string]string{"A.java": "com.x.util", "B.java": "com.x"})
+			util := plan.NewRules[1]
+			if got := NarrowSplitDeps(context.Background(), config, plan, util, tt.classNames); got != tt.wantOK {
+				t.Errorf("NarrowSplitDeps() = %v, want %v", got, tt.wantOK)
+			}
+			if diff := cmp.Diff(util.StringListAttr("deps"), tt.wantDeps); diff != "" {
+				t.Errorf("NarrowSplitDeps() deps diff (-got +want):\n%s", diff)
+			}
+			if plan.ApproximateDeps[util.Label()] == tt.wantOK {
+				t.Errorf("After NarrowSplitDeps() = %v, ApproximateDeps[%s] = %v", tt.wantOK, util.Label(), plan.ApproximateDeps[util.Label()])
+			}
+		})
+	}
+}
+
+func TestPlanMove(t *testing.T) {
+	type Attrs = map[string]interface{}
+	tests := []struct {
+		desc     string
+		from, to string
+		oldRules []*bazel.Rule
+		newPkg   *bazel.Package
+		want     *MovePlan
+		wantErr  bool
+	}{
+		{
+			desc:     "no rule srcs the file",
+			from:     "x/Foo.java",
+			to:       "y/Foo.java",
+			oldRules: []*bazel.Rule{bazel.NewRule("java_library", "x", "Bar", Attrs{"srcs": []string{"Bar.java"}})},
+			want:     nil,
+		},
+		{
+			desc: "the whole rule moves with all of its attributes",
+			from: "x/Foo.java",
+			to:   "y/Foo.java",
+			oldRules: []*bazel.Rule{
+				bazel.NewRule("java_library", "x", "Foo", Attrs{"srcs": []string{"Foo.java"}, "deps": []string{":Bar", "//y:y"}, "tags": []string{"a"}, "data": []string{"foo.txt"}}),
+			},
+			want: &MovePlan{
+				From:    "x/Foo.java",
+				To:      "y/Foo.java",
+				NewRule: bazel.NewRule("java_library", "y", "Foo", Attrs{"srcs": []string{"Foo.java"}, "deps": []string{"//x:Bar", ":y"}, "tags": []string{"a"}}),
+			},
+		},
+		{
+			desc: "a rule with other srcs stays, and the new rule gets its deps",
+			from: "x/Foo.java",
+			to:   "y/z/Foo.java",
+			oldRules: []*bazel.Rule{
+				bazel.NewRule("java_library", "x", "lib", Attrs{"srcs": []string{"Bar.java", "Foo.java"}, "deps": []string{":Bar"}, "javacopts": []string{"-Xlint"}, "tags": []string{"a"}}),
+			},
+			want: &MovePlan{
+				From:    "x/Foo.java",
+				To:      "y/z/Foo.java",
+				NewRule: bazel.NewRule("java_library", "y/z", "Foo", Attrs{"srcs": []string{"Foo.java"}, "deps": []string{"//x:Bar"}, "javacopts": []string{"-Xlint"}}),
+			},
+		},
+		{
+			desc: "an existing rule of the same kind is extended",
+			from: "x/Foo.java",
+			to:   "y/Foo.java",
+			oldRules: []*bazel.Rule{
+				bazel.NewRule("java_library", "x", "lib", Attrs{"srcs": []string{"Foo.java"}, "deps": []string{"//z"}}),
+			},
+			newPkg: &bazel.Package{Path: "y", Rules: map[string]*bazel.Rule{"lib": bazel.NewRule("java_library", "y", "lib", nil)}},
+			want: &MovePlan{
+				From:    "x/Foo.java",
+				To:      "y/Foo.java",
+				NewRule: bazel.NewRule("java_library", "y", "lib", Attrs{"srcs": []string{"Foo.java"}, "deps": []string{"//z"}}),
+				Extend:  true,
+			},
+		},
+		{
+			desc: "the rule the file moves out of doesn't prevent moving it within its package",
+			from: "x/a/Foo.java",
+			to:   "x/Foo.java",
+			oldRules: []*bazel.Rule{
+				bazel.NewRule("java_library", "x", "Foo", Attrs{"srcs": []string{"a/Foo.java"}}),
+			},
+			newPkg: &bazel.Package{Path: "x", Rules: map[string]*bazel.Rule{"Foo": bazel.NewRule("java_library", "x", "Foo", Attrs{"srcs": []string{"a/Foo.java"}})}},
+			want: &MovePlan{
+				From:    "x/a/Foo.java",
+				To:      "x/Foo.java",
+				NewRule: bazel.NewRule("java_library", "x", "Foo", Attrs{"srcs": []string{"Foo.java"}}),
+			},
+		},
+		{
+			desc: "rules of other kinds take every candidate name",
+			from: "x/Foo.java",
+			to:   "y/Foo.java",
+			oldRules: []*bazel.Rule{
+				bazel.NewRule("java_library", "x", "Foo", Attrs{"srcs": []string{"Foo.java"}}),
+			},
+			newPkg:  &bazel.Package{Path: "y", Rules: map[string]*bazel.Rule{"Foo": bazel.NewRule("java_binary", "y", "Foo", nil)}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		got, err := PlanMove(tt.from, tt.to, tt.oldRules, tt.newPkg, nil, "java_library", nil)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: PlanMove() returned error %v, want error: %v", tt.desc, err, tt.wantErr)
+			continue
+		}
+		// The moved file is the last src of each of oldRules.
+		if tt.want != nil {
+			tt.want.OldSrcs = make(map[*bazel.Rule]string)
+			for _, r := range tt.oldRules {
+				tt.want.OldSrcs[r] = r.StringListAttr("srcs")[len(r.StringListAttr("srcs"))-1]
+			}
+		}
+		if diff := cmp.Diff(got, tt.want, sortRuleKeys); diff != "" {
+			t.Errorf("%s: PlanMove() diff (-got +want):\n%s", tt.desc, diff)
+		}
+	}
+}
+
+// pkgRanker ranks labels by package only, so labels in the same package tie.
+type pkgRanker struct{}
+
+func (pkgRanker) Less(ctx context.Context, label1, label2 bazel.Label) bool {
+	pkg1, _ := label1.Split()
+	pkg2, _ := label2.Split()
+	return pkg1 < pkg2
+}
+
+func TestGeneratedClasses(t *testing.T) {
+	type Attrs = map[string]interface{}
+	loader := &testLoader{pkgs: map[string]*bazel.Package{
+		"third_party/auto": pkgloaderfakes.Pkg([]*bazel.Rule{
+			bazel.NewRule("java_library", "third_party/auto", "value", Attrs{"exported_plugins": []string{":value_plugin"}}),
+			bazel.NewRule("java_plugin", "third_party/auto", "value_plugin", Attrs{"processor_class": "com.google.auto.value.processor.AutoValueProcessor"}),
+		}),
+	}}
+	foo := bazel.NewRule("java_library", "java/com/foo", "foo", Attrs{"srcs": []string{"Foo.java", "FooComponent.java"}, "deps": []string{"//third_party/auto:value"}})
+	bar := bazel.NewRule("java_library", "java/com/bar", "bar", Attrs{"srcs": []string{"Bar.java"}})
+	classNames := []ClassName{"com.bar.AutoValue_Bar", "com.foo.AutoValue_Foo_Builder", "com.foo.DaggerBarComponent", "com.foo.DaggerFooComponent", "com.other.AutoValue_Foo"}
+
+	tests := []struct {
+		desc        string
+		missingDeps map[*bazel.Rule]map[ClassName][]bazel.Label
+		want        map[*bazel.Rule][]GeneratedClass
+	}{
+		{
+			desc: "Processors run through the exported_plugins of deps",
+			want: map[*bazel.Rule][]GeneratedClass{
+				foo: {
+					{"com.foo.AutoValue_Foo_Builder", DefaultAnnotationProcessors[0], true},
+					{"com.foo.DaggerFooComponent", DefaultAnnotationProcessors[4], false},
+				},
+				bar: {
+					{"com.bar.AutoValue_Bar", DefaultAnnotationProcessors[0], false},
+				},
+			},
+		},
+		{
+			desc: "The first candidate of a missing dep counts as a dep",
+			missingDeps: map[*bazel.Rule]map[ClassName][]bazel.Label{
+				bar: {"com.google.auto.value.AutoValue": {"//third_party/auto:value"}},
+			},
+			want: map[*bazel.Rule][]GeneratedClass{
+				foo: {
+					{"com.foo.AutoValue_Foo_Builder", DefaultAnnotationProcessors[0], true},
+					{"com.foo.DaggerFooComponent", DefaultAnnotationProcessors[4], false},
+				},
+				bar: {
+					{"com.bar.AutoValue_Bar", DefaultAnnotationProcessors[0], true},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			got := GeneratedClasses(context.Background(), loader, []*bazel.Rule{foo, bar}, classNames, DefaultAnnotationProcessors, tt.missingDeps)
+			opt := cmp.Comparer(func(x, y *regexp.Regexp) bool { return x.String() == y.String() })
+			if diff := cmp.Diff(got, tt.want, opt); diff != "" {
+				t.Errorf("GeneratedClasses returned diff (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestReadAnnotationProcessors(t *testing.T) {
+	got, err := ReadAnnotationProcessors(strings.NewReader("# Immutables\norg.immutables.processor.ProxyProcessor ^Immutable([A-Z]\\w*) //third_party/immutables:plugin\n\ncom.Processor ^(\\w+)_Generated\n"))
+	if err != nil {
+		t.Fatalf("ReadAnnotationProcessors returned error %v, want nil", err)
+	}
+	want := []AnnotationProcessor{
+		{"org.immutables.processor.ProxyProcessor", regexp.MustCompile(`^Immutable([A-Z]\w*)`), "//third_party/immutables:plugin"},
+		{"com.Processor", regexp.MustCompile(`^(\w+)_Generated`), ""},
+	}
+	opt := cmp.Comparer(func(x, y *regexp.Regexp) bool { return x.String() == y.String() })
+	if diff := cmp.Diff(got, want, opt); diff != "" {
+		t.Errorf("ReadAnnotationProcessors returned diff (-got +want):\n%s", diff)
+	}
+
+	for _, content := range []string{"com.Processor\n", "com.Processor ^Generated\n", "com.Processor ^(\\w+)_Gen :plugin\n", "com.Processor ^(\\w+ //a:b\n"} {
+		if _, err := ReadAnnotationProcessors(strings.NewReader(content)); err == nil {
+			t.Errorf("ReadAnnotationProcessors(%q) returned nil error, want error", content)
+		}
+	}
+}
+
+func TestRankLabelsKeepsTiesInOrder(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		labels := []bazel.Label{"//y:z", "//y:a", "//x:b", "//y:m", "//x:a"}
+		rankLabels(context.Background(), pkgRanker{}, labels)
+		want := []bazel.Label{"//x:b", "//x:a", "//y:z", "//y:a", "//y:m"}
+		if diff := cmp.Diff(labels, want); diff != "" {
+			t.Fatalf("rankLabels returned diff (-got +want):\n%s", diff)
+		}
+	}
+}
+
+// batchRanker ranks candidates in reverse, and records the consuming rule and class name of each call.
+type batchRanker struct {
+	pkgRanker
+	calls []string
+	drop  bool
+}
+
+func (r *batchRanker) RankDeps(ctx context.Context, consumingRule *bazel.Rule, class ClassName, candidates []bazel.Label) []bazel.Label {
+	var consumer bazel.Label
+	if consumingRule != nil {
+		consumer = consumingRule.Label()
+	}
+	r.calls = append(r.calls, fmt.Sprintf("%s %s", consumer, class))
+	var ret []bazel.Label
+	for i := len(candidates) - 1; i >= 0; i-- {
+		ret = append(ret, candidates[i])
+	}
+	if r.drop {
+		ret = ret[1:]
+	}
+	return ret
+}
+
+func TestRankDeps(t *testing.T) {
+	tests := []struct {
+		desc   string
+		ranker DepsRanker
+		want   []bazel.Label
+	}{
+		{
+			desc:   "Less is used by rankers that don't rank in batches",
+			ranker: pkgRanker{},
+			want:   []bazel.Label{"//x:b", "//x:a", "//y:a"},
+		},
+		{
+			desc:   "batch ranking",
+			ranker: &batchRanker{},
+			want:   []bazel.Label{"//x:a", "//x:b", "//y:a"},
+		},
+		{
+			desc:   "a ranking that drops candidates is ignored",
+			ranker: &batchRanker{drop: true},
+			want:   []bazel.Label{"//y:a", "//x:b", "//x:a"},
+		},
+	}
+	for _, tt := range tests {
+		candidates := []bazel.Label{"//y:a", "//x:b", "//x:a"}
+		got := RankDeps(context.Background(), tt.ranker, nil, "com.Foo", candidates)
+		if diff := cmp.Diff(got, tt.want); diff != "" {
+			t.Errorf("%s: RankDeps returned diff (-got +want):\n%s", tt.desc, diff)
+		}
+		if diff := cmp.Diff(candidates, []bazel.Label{"//y:a", "//x:b", "//x:a"}); diff != "" {
+			t.Errorf("%s: RankDeps modified its candidates (-got +want):\n%s", tt.desc, diff)
+		}
+	}
+}
+
+func TestMissingDepsBatchRanking(t *testing.T) {
+	resolver := &recordingResolver{cannedResponse: map[ClassName][]*bazel.Rule{
+		"com.Bar": {bazel.NewRule("java_library", "a", "bar", publicAttr), bazel.NewRule("java_library", "b", "bar", publicAttr)},
+	}}
+	ranker := &batchRanker{}
+	config := Config{
+		Loader:     &testLoader{},
+		Resolvers:  []Resolver{resolver},
+		DepsRanker: ranker,
+	}
+	foo := bazel.NewRule("java_library", "x", "foo", nil)
+	missing, _, err := MissingDeps(context.Background(), config, []*bazel.Rule{foo}, []ClassName{"com.Bar"})
+	if err != nil {
+		t.Fatalf("MissingDeps returned error %v, want nil", err)
+	}
+	if diff := cmp.Diff(missing[foo]["com.Bar"], []bazel.Label{"//b:bar", "//a:bar"}); diff != "" {
+		t.Errorf("MissingDeps returned diff in candidates for com.Bar (-got +want):\n%s", diff)
+	}
+	if diff := cmp.Diff(ranker.calls, []string{"//x:foo com.Bar"}); diff != "" {
+		t.Errorf("MissingDeps called RankDeps with diff (-got +want):\n%s", diff)
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jadeplib
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+)
+
+// MovePlan describes how to update BUILD files after a Java file moved to another package.
+type MovePlan struct {
+	// From and To are the old and new names of the file, relative to the workspace root.
+	From string
+	To   string
+
+	// OldSrcs maps each rule whose srcs listed From to the entry of its srcs that did.
+	// A rule whose only src was From is deleted; the others only lose that entry.
+	OldSrcs map[*bazel.Rule]string
+
+	// NewRule srcs To, and has the kind, deps and other attributes of the rule From moved out of.
+	NewRule *bazel.Rule
+
+	// Extend is true if a rule named like NewRule, of the same kind, already exists in To's package.
+	// NewRule's srcs and deps are then added to it, instead of creating NewRule.
+	Extend bool
+}
+
+// Deleted returns true if 'rule' has no srcs left after the move, and is deleted.
+func (p *MovePlan) Deleted(rule *bazel.Rule) bool {
+	src, ok := p.OldSrcs[rule]
+	srcs := rule.StringListAttr("srcs")
+	return ok && len(srcs) == 1 && srcs[0] == src
+}
+
+// movedLabelAttrs are the label-list attributes that a MovePlan's NewRule inherits.
+// Labels in the old package are written as bare names, so they're made absolute.
+var movedLabelAttrs = map[string]bool{"deps": true, "runtime_deps": true, "exports": true, "plugins": true, "exported_plugins": true}
+
+// inheritedAttrs are the attributes that NewRule inherits when the rule From moved out of keeps other srcs.
+// When the whole rule moves, NewRule inherits all of its attributes except notInheritedAttrs.
+var inheritedAttrs = []string{"deps", "runtime_deps", "plugins", "javacopts", "visibility", "testonly"}
+
+// notInheritedAttrs refer to the old package's files or to the moved class, so they don't carry over to the new package.
+// test_class is set again by the usual flow, according to the package declaration of the moved file.
+var notInheritedAttrs = map[string]bool{"name": true, "srcs": true, "resources": true, "resource_strip_prefix": true, "data": true, "test_class": true, "main_class": true}
+
+// PlanMove returns a MovePlan for the file 'from' that moved to 'to' (both relative to the workspace root).
+// oldRules are the rules whose srcs list 'from', and newPkg is the package in the directory of 'to', or nil if it has no BUILD file yet.
+// namingRules, defaultRuleKind and templates name the new rule, as CreateRuleWithTemplates does.
+// It returns nil if no rule srcs 'from'.
+func PlanMove(from, to string, oldRules []*bazel.Rule, newPkg *bazel.Package, namingRules []NamingRule, defaultRuleKind string, templates map[string]RuleTemplate) (*MovePlan, error) {
+	plan := &MovePlan{From: from, To: to, OldSrcs: make(map[*bazel.Rule]string)}
+	var sources []*bazel.Rule
+	for _, r := range oldRules {
+		for _, src := range r.StringListAttr("srcs") {
+			if l, err := bazel.ParseRelativeLabel(r.PkgName, src); err == nil && labelPath(l) == filepath.ToSlash(from) {
+				plan.OldSrcs[r] = src
+				sources = append(sources, r)
+				break
+			}
+		}
+	}
+	if len(sources) == 0 {
+		return nil, nil
+	}
+	sort.Slice(sources, func(i, j int) bool { return sources[i].Label() < sources[j].Label() })
+	source := sources[0]
+
+	created := CreateRuleWithTemplates(to, namingRules, defaultRuleKind, templates)
+	names := []string{created.Name()}
+	if plan.Deleted(source) {
+		names = []string{source.Name(), created.Name()}
+	}
+	name, extend, err := moveTarget(plan, created.PkgName, newPkg, source.Schema, names)
+	if err != nil {
+		return nil, err
+	}
+	plan.Extend = extend
+
+	attrs := map[string]interface{}{"srcs": created.Attrs["srcs"]}
+	// Templates only apply if the new rule is of the kind they're for; inherited attributes override them.
+	if created.Schema == source.Schema {
+		for attr, v := range created.Attrs {
+			if attr != "name" {
+				attrs[attr] = v
+			}
+		}
+	}
+	inherit := inheritedAttrs
+	if plan.Deleted(source) {
+		inherit = nil
+		for attr := range source.Attrs {
+			if !notInheritedAttrs[attr] && !strings.HasPrefix(attr, "generator_") {
+				inherit = append(inherit, attr)
+			}
+		}
+	}
+	for _, attr := range inherit {
+		v, ok := source.Attrs[attr]
+		if !ok {
+			continue
+		}
+		if movedLabelAttrs[attr] {
+			var labels []string
+			for _, l := range source.LabelListAttr(attr) {
+				labels = append(labels, l.RelativeTo(created.PkgName))
+			}
+			v = labels
+		}
+		attrs[attr] = v
+	}
+	plan.NewRule = bazel.NewRule(source.Schema, created.PkgName, name, attrs)
+	return plan, nil
+}
+
+// labelPath returns the path of the file that l names, relative to the workspace root.
+// Rules in ancestor packages can src a file by its label, e.g. //x:y/Foo.java in //x/y's package.
+func labelPath(l bazel.Label) string {
+	pkgName, name := l.Split()
+	return path.Join(pkgName, name)
+}
+
+// moveTarget returns the first of names that pkg (named pkgName) either has no rule by, or has a rule of 'kind' by, in which case extend is true.
+// Rules that plan deletes don't count, e.g. when a file moves to a subdirectory of its package along with its whole rule.
+func moveTarget(plan *MovePlan, pkgName string, pkg *bazel.Package, kind string, names []string) (name string, extend bool, err error) {
+	deleted := make(map[bazel.Label]bool)
+	for r := range plan.OldSrcs {
+		if plan.Deleted(r) {
+			deleted[r.Label()] = true
+		}
+	}
+	for _, n := range names {
+		if pkg == nil {
+			return n, false, nil
+		}
+		existing, ok := pkg.Rules[n]
+		if !ok || deleted[existing.Label()] {
+			return n, false, nil
+		}
+		if existing.Schema == kind {
+			return n, true, nil
+		}
+	}
+	return "", false, fmt.Errorf("can't create a %s in //%s: rules named %s already exist", kind, pkgName, strings.Join(names, " and "))
+}
@@ -0,0 +1,106 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jadeplib
+
+import (
+	"sort"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/filter"
+	"github.com/bazelbuild/tools_jvm_autodeps/pkgloading"
+	"github.com/bazelbuild/tools_jvm_autodeps/vlog"
+)
+
+// exportedRules computes the rules that rules export, directly or through other rules' exports, loading packages as needed.
+// It's used to avoid suggesting a dependency that exports the rule being fixed, which would make that rule depend on itself,
+// e.g. a java_library that exports the java_plugin it's suggested for.
+type exportedRules struct {
+	ctx    context.Context
+	loader pkgloading.Loader
+	memo   map[bazel.Label]map[bazel.Label]bool
+}
+
+func newExportedRules(ctx context.Context, loader pkgloading.Loader) *exportedRules {
+	return &exportedRules{ctx, loader, make(map[bazel.Label]map[bazel.Label]bool)}
+}
+
+// of returns the labels that rule exports, transitively.
+// Rules that can't be loaded are skipped, since their only consequence is that fewer cycles are detected.
+func (e *exportedRules) of(rule *bazel.Rule) map[bazel.Label]bool {
+	if ret, ok := e.memo[rule.Label()]; ok {
+		return ret
+	}
+	ret := make(map[bazel.Label]bool)
+	toVisit := rule.LabelListAttr("exports")
+	for len(toVisit) > 0 {
+		var next []bazel.Label
+		for _, l := range toVisit {
+			if !ret[l] {
+				ret[l] = true
+				next = append(next, l)
+			}
+		}
+		rules, _, err := pkgloading.LoadRules(e.ctx, e.loader, next)
+		if err != nil {
+			vlog.V(2).Printf("Error loading rules exported by %s; not looking for cycles through them:\n%v", rule.Label(), err)
+			break
+		}
+		toVisit = nil
+		for _, l := range next {
+			if r := rules[l]; r != nil {
+				toVisit = append(toVisit, r.LabelListAttr("exports")...)
+			}
+		}
+	}
+	e.memo[rule.Label()] = ret
+	return ret
+}
+
+// preferProcessorScope moves the candidates that an annotation processor can use (see filter.IsProcessorScope) before the ones
+// it can't, in the candidates of java_plugin rules. The order is otherwise unchanged.
+// candidates maps each consuming rule and class name to the rules of the labels in missingRuleDeps.
+func preferProcessorScope(missingRuleDeps map[*bazel.Rule]map[ClassName][]bazel.Label, candidates map[*bazel.Rule]map[ClassName][]*bazel.Rule) {
+	for consRule, classToLabels := range missingRuleDeps {
+		if consRule.Schema != "java_plugin" {
+			continue
+		}
+		for cls, labels := range classToLabels {
+			inScope := make(map[bazel.Label]bool)
+			for _, r := range candidates[consRule][cls] {
+				inScope[r.Label()] = filter.IsProcessorScope(r)
+			}
+			sort.SliceStable(labels, func(i, j int) bool { return inScope[labels[i]] && !inScope[labels[j]] })
+		}
+	}
+}
+
+// preferAPITargets moves the candidates that are API targets (see filter.IsAPITarget) before the others, so that rules depend
+// on an API rather than on the implementation libraries it exports. The order is otherwise unchanged.
+// candidates maps each consuming rule and class name to the rules of the labels in missingRuleDeps.
+func preferAPITargets(missingRuleDeps map[*bazel.Rule]map[ClassName][]bazel.Label, candidates map[*bazel.Rule]map[ClassName][]*bazel.Rule) {
+	if len(filter.APITags) == 0 {
+		return
+	}
+	for consRule, classToLabels := range missingRuleDeps {
+		for cls, labels := range classToLabels {
+			isAPI := make(map[bazel.Label]bool)
+			for _, r := range candidates[consRule][cls] {
+				isAPI[r.Label()] = filter.IsAPITarget(r)
+			}
+			sort.SliceStable(labels, func(i, j int) bool { return isAPI[labels[i]] && !isAPI[labels[j]] })
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jadeplib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+)
+
+// packageDeclRegexp matches the package declaration of a Java file.
+var packageDeclRegexp = regexp.MustCompile(`(?m)^\s*package\s+([\w.]+)\s*;`)
+
+// ProvidedClasses caches, per rule label, the top-level classes declared by the Java files in the rule's srcs.
+// A source file is assumed to declare a top-level class named after the file, in the package of its package declaration;
+// this cheap scan avoids parsing the file.
+// An entry is invalidated when the set of source files of the rule, or the modification time of any of them, changes.
+// ProvidedClasses is safe for concurrent use.
+type ProvidedClasses struct {
+	mu      sync.Mutex
+	entries map[bazel.Label]*providedClassesEntry
+}
+
+type providedClassesEntry struct {
+	// mtimes maps the source files that were scanned to their modification times.
+	mtimes  map[string]time.Time
+	classes []ClassName
+}
+
+// NewProvidedClasses returns an empty ProvidedClasses.
+func NewProvidedClasses() *ProvidedClasses {
+	return &ProvidedClasses{entries: make(map[bazel.Label]*providedClassesEntry)}
+}
+
+// Get returns the top-level classes declared by the Java files in the srcs of rule, whose package is in directory pkgDir.
+// Source files that don't exist, e.g. because they're generated, are skipped.
+func (p *ProvidedClasses) Get(pkgDir string, rule *bazel.Rule) []ClassName {
+	mtimes := make(map[string]time.Time)
+	for _, src := range srcLabels(rule) {
+		srcPkgName, fileName := src.Split()
+		if srcPkgName != rule.PkgName || !strings.HasSuffix(fileName, ".java") {
+			continue
+		}
+		fileName = filepath.Join(pkgDir, fileName)
+		if info, err := os.Stat(fileName); err == nil {
+			mtimes[fileName] = info.ModTime()
+		}
+	}
+
+	p.mu.Lock()
+	e := p.entries[rule.Label()]
+	p.mu.Unlock()
+	if e != nil && sameMtimes(e.mtimes, mtimes) {
+		return e.classes
+	}
+
+	e = &providedClassesEntry{mtimes: mtimes}
+	for _, src := range srcLabels(rule) {
+		_, fileName := src.Split()
+		fileName = filepath.Join(pkgDir, fileName)
+		if _, ok := mtimes[fileName]; !ok {
+			continue
+		}
+		content, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			continue
+		}
+		simpleName := strings.TrimSuffix(filepath.Base(fileName), ".java")
+		if m := packageDeclRegexp.FindSubmatch(content); m != nil {
+			e.classes = append(e.classes, ClassName(string(m[1])+"."+simpleName))
+		} else {
+			e.classes = append(e.classes, ClassName(simpleName))
+		}
+	}
+	p.mu.Lock()
+	p.entries[rule.Label()] = e
+	p.mu.Unlock()
+	return e.classes
+}
+
+// ProvidedClassesEntry is a copy of a ProvidedClasses entry, e.g. to save it across runs.
+type ProvidedClassesEntry struct {
+	Rule bazel.Label
+	// Mtimes maps the source files that were scanned to their modification times.
+	Mtimes  map[string]time.Time
+	Classes []ClassName
+}
+
+// Entries returns a copy of the entries of p, sorted by rule.
+func (p *ProvidedClasses) Entries() []ProvidedClassesEntry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var ret []ProvidedClassesEntry
+	for l, e := range p.entries {
+		ret = append(ret, ProvidedClassesEntry{Rule: l, Mtimes: e.mtimes, Classes: e.classes})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Rule < ret[j].Rule })
+	return ret
+}
+
+// AddEntries adds entries to p, unless p already has entries for their rules.
+// Like any other entry, they're invalidated by Get when the modification times of the source files change.
+func (p *ProvidedClasses) AddEntries(entries []ProvidedClassesEntry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, e := range entries {
+		if _, ok := p.entries[e.Rule]; !ok {
+			p.entries[e.Rule] = &providedClassesEntry{mtimes: e.Mtimes, classes: e.Classes}
+		}
+	}
+}
+
+// Provides returns true if rule, whose package is in directory pkgDir, declares cls or a class cls is nested in.
+func (p *ProvidedClasses) Provides(pkgDir string, rule *bazel.Rule, cls ClassName) bool {
+	return providesClass(p.Get(pkgDir, rule), cls)
+}
+
+func sameMtimes(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for f, t := range a {
+		if bt, ok := b[f]; !ok || !bt.Equal(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// providesClass returns true if cls is one of 'provided' or nested in one of them.
+func providesClass(provided []ClassName, cls ClassName) bool {
+	for _, p := range provided {
+		if cls == p || strings.HasPrefix(string(cls), string(p)+".") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jadeplib
+
+import (
+	"sync"
+
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+)
+
+// ResolutionCache memoizes, for the duration of a single Jadep invocation, the ranked rules that provide each class name.
+// When several rules consume the same files (e.g., foo and foo-gwt) and several arguments cover them, a class name
+// is then resolved and ranked once, and only the filtering specific to each consuming rule (existing deps, rule kinds,
+// visibility) is repeated.
+// Entries are never invalidated, so a ResolutionCache must not outlive the invocation that created it.
+// ResolutionCache is safe for concurrent use.
+type ResolutionCache struct {
+	mu      sync.Mutex // guards entries
+	entries map[ClassName]resolution
+}
+
+// resolution is what resolvers returned for a class name.
+type resolution struct {
+	// resolved is false if no resolver resolved the class name.
+	resolved bool
+
+	// rules provide the class name, best first. It's empty for class names that need no deps, e.g. JDK classes.
+	rules []*bazel.Rule
+}
+
+// NewResolutionCache returns an empty ResolutionCache.
+func NewResolutionCache() *ResolutionCache {
+	return &ResolutionCache{entries: make(map[ClassName]resolution)}
+}
+
+// get returns the memoized resolution of cls, if there is one.
+func (c *ResolutionCache) get(cls ClassName) (resolution, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res, ok := c.entries[cls]
+	return res, ok
+}
+
+// set memoizes res as the resolution of cls.
+func (c *ResolutionCache) set(cls ClassName, res resolution) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[cls] = res
+}
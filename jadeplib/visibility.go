@@ -0,0 +1,182 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jadeplib
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/filter"
+	"github.com/bazelbuild/tools_jvm_autodeps/pkgloading"
+)
+
+// VisibilityPlan describes how to make a rule visible to the packages that depend on it, but can't see it.
+// Jadep adds such deps when no visible rule provides a class.
+type VisibilityPlan struct {
+	// Rule is the rule to make visible.
+	Rule *bazel.Rule
+
+	// Packages are the names of the packages that need to see Rule, sorted.
+	Packages []string
+
+	// Group is the package_group in Rule's package that grants Packages visibility to Rule, when there are many of them.
+	// It's empty if Packages are added to Rule's visibility one by one, as //<package>:__pkg__.
+	Group bazel.Label
+
+	// NewGroup is true if Group doesn't exist yet, and is created.
+	NewGroup bool
+
+	// AddVisibility are the entries to add to Rule's visibility, relative to Rule's package.
+	// Rule's current visibility is repeated, since it may come from its package's default_visibility, which setting
+	// visibility on Rule overrides. //visibility:private is removed.
+	AddVisibility []string
+}
+
+// InvisibleDeps returns the deps in depsToAdd that aren't visible to the rules they're added to,
+// mapped to the packages of those rules.
+func InvisibleDeps(ctx context.Context, loader pkgloading.Loader, depsToAdd map[*bazel.Rule][]bazel.Label) (map[bazel.Label]map[string]bool, error) {
+	var labels []bazel.Label
+	for _, deps := range depsToAdd {
+		labels = append(labels, deps...)
+	}
+	deps, _, err := pkgloading.LoadRules(ctx, loader, labels)
+	if err != nil {
+		return nil, fmt.Errorf("error loading the deps to add:\n%v", err)
+	}
+	query := make(map[filter.VisQuery]bool)
+	for consRule, labels := range depsToAdd {
+		for _, l := range labels {
+			if dep := deps[l]; dep != nil {
+				query[filter.VisQuery{Rule: dep, Pkg: consRule.PkgName}] = true
+			}
+		}
+	}
+	visible, err := filter.CheckVisibility(ctx, loader, query)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[bazel.Label]map[string]bool)
+	for vq := range query {
+		if visible[vq] {
+			continue
+		}
+		l := vq.Rule.Label()
+		if ret[l] == nil {
+			ret[l] = make(map[string]bool)
+		}
+		ret[l][vq.Pkg] = true
+	}
+	return ret, nil
+}
+
+// PlanVisibility returns plans that make each rule in needs visible to the packages it maps to, sorted by rule.
+// A rule that at least groupThreshold packages need to see gets a single package_group for them: the first package_group
+// of its own package in its visibility is extended, or a new one named "<rule>_users" is created. Otherwise, or if
+// groupThreshold isn't positive, each package is added to the rule's visibility separately.
+func PlanVisibility(ctx context.Context, loader pkgloading.Loader, needs map[bazel.Label]map[string]bool, groupThreshold int) ([]*VisibilityPlan, error) {
+	var labels []bazel.Label
+	for l := range needs {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i] < labels[j] })
+	rules, pkgs, err := pkgloading.LoadRules(ctx, loader, labels)
+	if err != nil {
+		return nil, fmt.Errorf("error loading rules to make visible:\n%v", err)
+	}
+	var ret []*VisibilityPlan
+	for _, l := range labels {
+		rule := rules[l]
+		if rule == nil {
+			log.Printf("WARNING: Not making %s visible: rule not found", l)
+			continue
+		}
+		plan := &VisibilityPlan{Rule: rule}
+		for p := range needs[l] {
+			plan.Packages = append(plan.Packages, p)
+		}
+		sort.Strings(plan.Packages)
+		if groupThreshold > 0 && len(plan.Packages) >= groupThreshold {
+			plan.Group, plan.NewGroup = visibilityGroup(pkgs[rule.PkgName], rule)
+		}
+		var add []string
+		for _, v := range visibility(pkgs[rule.PkgName], rule) {
+			if v != "//visibility:private" {
+				add = append(add, v.RelativeTo(rule.PkgName))
+			}
+		}
+		if plan.Group != "" {
+			add = append(add, plan.Group.RelativeTo(rule.PkgName))
+		} else {
+			for _, p := range plan.Packages {
+				add = append(add, fmt.Sprintf("//%s:__pkg__", p))
+			}
+		}
+		plan.AddVisibility = dedup(add)
+		ret = append(ret, plan)
+	}
+	return ret, nil
+}
+
+// visibilityGroup returns the package_group that grants visibility to rule: the first package_group of pkg in rule's
+// visibility, or a new one named after rule. It returns "" if the name of the new group is taken.
+func visibilityGroup(pkg *bazel.Package, rule *bazel.Rule) (group bazel.Label, isNew bool) {
+	if pkg == nil {
+		return "", false
+	}
+	var existing []bazel.Label
+	for _, v := range visibility(pkg, rule) {
+		if pkgName, name := v.Split(); pkgName == rule.PkgName && pkg.PackageGroups[name] != nil {
+			existing = append(existing, v)
+		}
+	}
+	if len(existing) > 0 {
+		sort.Slice(existing, func(i, j int) bool { return existing[i] < existing[j] })
+		return existing[0], false
+	}
+	name := rule.Name() + "_users"
+	_, isRule := pkg.Rules[name]
+	_, isGroup := pkg.PackageGroups[name]
+	_, isFile := pkg.Files[name]
+	if isRule || isGroup || isFile {
+		log.Printf("WARNING: Can't create package_group %s in //%s, since the name is taken; adding packages to the visibility of %s instead", name, rule.PkgName, rule.Label())
+		return "", false
+	}
+	return bazel.Label(fmt.Sprintf("//%s:%s", rule.PkgName, name)), true
+}
+
+// visibility returns the visibility of rule: its visibility attribute if it's set, or else the default_visibility of pkg,
+// its package. The loader only reports attributes that are set explicitly.
+func visibility(pkg *bazel.Package, rule *bazel.Rule) []bazel.Label {
+	if _, ok := rule.Attrs["visibility"]; ok || pkg == nil {
+		return rule.LabelListAttr("visibility")
+	}
+	return pkg.DefaultVisibility
+}
+
+// dedup returns the distinct strings of ss, in order of first appearance.
+func dedup(ss []string) []string {
+	seen := make(map[string]bool)
+	var ret []string
+	for _, s := range ss {
+		if !seen[s] {
+			seen[s] = true
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
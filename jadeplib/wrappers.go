@@ -0,0 +1,60 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jadeplib
+
+import (
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+)
+
+// WrapperProvider may optionally be implemented by a Resolver that knows which in-repo targets wrap external targets,
+// e.g. a //third_party java_library that exports an @repo//jar java_import, directly or through a bind's actual.
+// Jadep collects the wrappers into Config.Wrappers.
+type WrapperProvider interface {
+	// Wrappers maps the labels of external targets to the in-repo targets that wrap them.
+	Wrappers() map[bazel.Label]*bazel.Rule
+}
+
+// preferWrappers replaces the candidates in resolved that config.Wrappers wraps with their wrappers, so that suggestions
+// follow the workspace's convention of depending on external jars through their wrappers.
+// A wrapper takes the place of the first candidate it wraps, and appears once. The order is otherwise unchanged.
+func preferWrappers(resolved map[ClassName][]*bazel.Rule, wrappers map[bazel.Label]*bazel.Rule) {
+	if len(wrappers) == 0 {
+		return
+	}
+	for cls, rules := range resolved {
+		seen := make(map[bazel.Label]bool)
+		var ret []*bazel.Rule
+		for _, r := range rules {
+			if w := wrappers[r.Label()]; w != nil {
+				r = w
+			}
+			if !seen[r.Label()] {
+				seen[r.Label()] = true
+				ret = append(ret, r)
+			}
+		}
+		resolved[cls] = ret
+	}
+}
+
+// addWrappers adds to deps the wrappers of the external targets in deps, since a rule that depends on an external target
+// already has the classes its wrapper provides.
+func addWrappers(deps map[bazel.Label]bool, wrappers map[bazel.Label]*bazel.Rule) {
+	for l := range deps {
+		if w := wrappers[l]; w != nil {
+			deps[w.Label()] = true
+		}
+	}
+}
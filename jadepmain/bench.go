@@ -0,0 +1,113 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jadepmain
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/bench"
+	"github.com/bazelbuild/tools_jvm_autodeps/future"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+)
+
+// runBench runs Jadep on each Java file under --corpus without editing any BUILD file, and prints per-phase latencies.
+// If --golden_deps is set, it also prints the precision and recall of the deps Jadep would add.
+func runBench(ctx context.Context, config jadeplib.Config, flags *Flags, blacklist *jadeplib.ClassNameBlacklist, implicitImports future.Getter) {
+	if flags.Corpus == "" {
+		log.Fatalln("Usage: jadep bench --corpus=<directory> [--golden_deps=<file>]")
+	}
+	corpus, err := filepath.Abs(flags.Corpus)
+	if err != nil {
+		log.Fatal(err)
+	}
+	files, err := bench.CorpusFiles(corpus)
+	if err != nil {
+		log.Fatal(err)
+	}
+	golden := make(map[string][]bazel.Label)
+	if flags.GoldenDeps != "" {
+		golden, err = bench.ReadGolden(flags.GoldenDeps)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	var samples []*bench.Sample
+	for _, f := range files {
+		s := benchFile(ctx, config, flags, blacklist, implicitImports, corpus, f)
+		if s.Err != nil {
+			log.Printf("WARNING: %s: %v", f, s.Err)
+		}
+		samples = append(samples, s)
+	}
+	bench.Summarize(samples, golden).Write(os.Stdout)
+}
+
+// benchFile runs Jadep's pipeline on a single file of the corpus, and returns how long each phase took and which deps it would add.
+// The top-ranked candidate of each class is taken, as if the user accepted all suggestions.
+func benchFile(ctx context.Context, config jadeplib.Config, flags *Flags, blacklist *jadeplib.ClassNameBlacklist, implicitImports future.Getter, corpus, file string) *bench.Sample {
+	s := &bench.Sample{File: file, Phases: make(map[string]time.Duration)}
+	absFile := filepath.Join(corpus, file)
+	relFile, err := filepath.Rel(config.WorkspaceDir, absFile)
+	if err != nil || strings.HasPrefix(relFile, "..") {
+		s.Err = fmt.Errorf("file is not in workspace %s", config.WorkspaceDir)
+		return s
+	}
+
+	start := time.Now()
+	stopwatch := start
+	lap := func(phase string) {
+		now := time.Now()
+		s.Phases[phase] = now.Sub(stopwatch)
+		stopwatch = now
+	}
+	classNames, skipped := classNamesToResolve(ctx, config, flags, blacklist, config.WorkspaceDir, implicitImports, absFile)
+	lap("parse")
+	if len(skipped) > 0 {
+		s.Err = skipped[0]
+		return s
+	}
+	rules, err := jadeplib.RulesConsumingFile(ctx, config, relFile)
+	lap("find_rules")
+	if err != nil {
+		s.Err = err
+		return s
+	}
+	if len(rules) == 0 {
+		s.Err = fmt.Errorf("no rule consumes the file")
+		return s
+	}
+	missingDeps, _, err := jadeplib.MissingDeps(ctx, config, rules, classNames)
+	lap("resolve")
+	if err != nil {
+		s.Err = err
+		return s
+	}
+	s.Phases["total"] = time.Now().Sub(start)
+	for _, classToRules := range missingDeps {
+		for _, candidates := range classToRules {
+			if len(candidates) > 0 {
+				s.Added = append(s.Added, candidates[0])
+			}
+		}
+	}
+	return s
+}
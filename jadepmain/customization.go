@@ -38,6 +38,30 @@ type Customization interface {
 	NewLoader(ctx context.Context, flags *Flags, workspaceDir string) (pkgloading.Loader, func(), error)
 }
 
+// EditHook may optionally be implemented by a Customization to check or amend the BUILD files Jadep edits,
+// e.g. to run an organization's BUILD linter, or to add license headers to new BUILD files.
+type EditHook interface {
+	// AfterEdit is called after Jadep edits buildFiles, of which newFiles were created by the edit.
+	// Returning an error restores the BUILD files and fails the edit. See buildozer.PostEditHook.
+	AfterEdit(buildFiles, newFiles []string) error
+}
+
+// ClassNameFilter may optionally be implemented by a Customization to post-process the class names Jadep extracts
+// from each Java file, before they're resolved.
+type ClassNameFilter interface {
+	// FilterClassNames returns the class names to resolve for fileName, given the ones Jadep extracted from it.
+	// It may drop, rewrite or add class names, e.g. to map shaded packages (com.company.shaded.guava.*)
+	// back to the ones they were shaded from (com.google.common.*). See parser.ClassNamesFilter.
+	FilterClassNames(fileName string, classNames []jadeplib.ClassName) []jadeplib.ClassName
+}
+
+// HealthSignalsBackend may optionally be implemented by a Customization to report the health of candidate dependencies
+// from an organization's build metadata, e.g. a CI system. --health_signals_file takes precedence over it.
+type HealthSignalsBackend interface {
+	// NewHealthSignals returns the jadeplib.HealthSignals to query, or nil to not filter candidates by health.
+	NewHealthSignals(DataSources) jadeplib.HealthSignals
+}
+
 // DataSources is customized by users of jadepmain.Main to pass information between Customization.LoadDataSources and NewDepsRanker, NewResolvers.
 type DataSources interface{}
 
@@ -81,4 +105,223 @@ type Flags struct {
 
 	// See corresponding flag in jadep.go
 	Color bool
+
+	// See corresponding flag in jadep.go
+	MixedPackageRules string
+
+	// See corresponding flag in jadep.go
+	EditEventsWebhook string
+
+	// See corresponding flag in jadep.go
+	EditEventsFile string
+
+	// See corresponding flag in jadep.go
+	AutoApplyThreshold float64
+
+	// See corresponding flag in jadep.go
+	ChoicesFile string
+
+	// See corresponding flag in jadep.go
+	IgnorePreviousChoices bool
+
+	// See corresponding flag in jadep.go
+	Verify bool
+
+	// See corresponding flag in jadep.go
+	VerifyCommand string
+
+	// See corresponding flag in jadep.go
+	VerifyCandidateJars bool
+
+	// See corresponding flag in jadep.go
+	DepsAttributes string
+
+	// See corresponding flag in jadep.go
+	JavadocRefs string
+
+	// See corresponding flag in jadep.go
+	InlinedConstants string
+
+	// See corresponding flag in jadep.go
+	ReportFile string
+
+	// See corresponding flag in jadep.go
+	UmbrellaTags string
+
+	// See corresponding flag in jadep.go
+	UmbrellaNamePattern string
+
+	// See corresponding flag in jadep.go
+	PkgLoaderChunkSize int
+
+	// See corresponding flag in jadep.go
+	PkgLoaderChunkParallelism int
+
+	// See corresponding flag in jadep.go
+	DictionaryPrecedence string
+
+	// See corresponding flag in jadep.go
+	ServiceLoaderResources bool
+
+	// See corresponding flag in jadep.go
+	RelativeLabels bool
+
+	// See corresponding flag in jadep.go
+	BasePkg string
+
+	// See corresponding flag in jadep.go
+	SkipFile string
+
+	// See corresponding flag in jadep.go
+	LabelBlacklist string
+
+	// See corresponding flag in jadep.go
+	DataFilesPollInterval time.Duration
+
+	// See corresponding flag in jadep.go
+	NewRulePolicy string
+
+	// See corresponding flag in jadep.go
+	NewRuleRequiredAttrs string
+
+	// See corresponding flag in jadep.go
+	PrintBuildozerCommands bool
+
+	// See corresponding flag in jadep.go
+	Corpus string
+
+	// See corresponding flag in jadep.go
+	GoldenDeps string
+
+	// See corresponding flag in jadep.go
+	RecordedPackages string
+
+	// See corresponding flag in jadep.go
+	RecordPackages string
+
+	// See corresponding flag in jadep.go
+	ParserConcurrency int
+
+	// See corresponding flag in jadep.go
+	ParserFileTimeout time.Duration
+
+	// See corresponding flag in jadep.go
+	MavenIndex string
+
+	// See corresponding flag in jadep.go
+	ResolverTimeout time.Duration
+
+	// See corresponding flag in jadep.go
+	FromPkg string
+
+	// See corresponding flag in jadep.go
+	ProvenanceComments bool
+
+	// See corresponding flag in jadep.go
+	VCSChanged bool
+
+	// See corresponding flag in jadep.go
+	BuiltinClassLists string
+
+	// See corresponding flag in jadep.go
+	BuiltinClassListDirs string
+
+	// See corresponding flag in jadep.go
+	PostEditCommand string
+
+	// See corresponding flag in jadep.go
+	WarmStartCache string
+
+	// See corresponding flag in jadep.go
+	Answers string
+
+	// See corresponding flag in jadep.go
+	AmbiguityPolicy string
+
+	// See corresponding flag in jadep.go
+	MaxCandidates int
+
+	// See corresponding flag in jadep.go
+	CandidatesFile string
+
+	// See corresponding flag in jadep.go
+	Outputs string
+
+	// See corresponding flag in jadep.go
+	ReleaseClassLists string
+
+	// See corresponding flag in jadep.go
+	RuleTemplates string
+
+	// See corresponding flag in jadep.go
+	ResourceRefs string
+
+	// See corresponding flag in jadep.go
+	Macros string
+
+	// See corresponding flag in jadep.go
+	CycleCheckDepth int
+
+	// See corresponding flag in jadep.go
+	DanglingDeps string
+
+	// See corresponding flag in jadep.go
+	ShardCount int
+
+	// See corresponding flag in jadep.go
+	ShardIndex int
+
+	// See corresponding flag in jadep.go
+	EditPlan string
+
+	// See corresponding flag in jadep.go
+	Cleanup bool
+
+	// See corresponding flag in jadep.go
+	PromptTimeout time.Duration
+
+	// See corresponding flag in jadep.go
+	PromptTimeoutAction string
+
+	// See corresponding flag in jadep.go
+	PackageAliases string
+
+	// See corresponding flag in jadep.go
+	PackageInfoPolicy string
+
+	// See corresponding flag in jadep.go
+	HealthSignalsFile string
+
+	// See corresponding flag in jadep.go
+	MaxFlakiness float64
+
+	// See corresponding flag in jadep.go
+	InvisibleDeps string
+
+	// See corresponding flag in jadep.go
+	PackageGroupThreshold int
+
+	// See corresponding flag in jadep.go
+	ClasspathDelta string
+
+	// See corresponding flag in jadep.go
+	ClasspathDeltaDepth int
+
+	// See corresponding flag in jadep.go
+	AnnotationProcessors string
+
+	// See corresponding flag in jadep.go
+	ContentRootPrefixes string
+
+	// See corresponding flag in jadep.go
+	APITags string
+
+	// See corresponding flag in jadep.go
+	RespectKeepComments bool
+
+	// See corresponding flag in jadep.go
+	PkgCacheMaxEntries int
+
+	// See corresponding flag in jadep.go
+	PkgCacheErrorTTL time.Duration
 }
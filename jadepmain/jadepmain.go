@@ -17,26 +17,58 @@
 package jadepmain
 
 import (
+	"bytes"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"os/exec"
+	"os/signal"
 	"os/user"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
 	"strings"
+	"syscall"
+	"time"
 
 	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/aliasresolver"
 	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/bench"
 	"github.com/bazelbuild/tools_jvm_autodeps/buildozer"
+	"github.com/bazelbuild/tools_jvm_autodeps/choices"
+	"github.com/bazelbuild/tools_jvm_autodeps/classpathranker"
 	"github.com/bazelbuild/tools_jvm_autodeps/cli"
+	"github.com/bazelbuild/tools_jvm_autodeps/codegenresolver"
 	"github.com/bazelbuild/tools_jvm_autodeps/color"
 	"github.com/bazelbuild/tools_jvm_autodeps/dictresolver"
+	"github.com/bazelbuild/tools_jvm_autodeps/doctor"
+	"github.com/bazelbuild/tools_jvm_autodeps/editevents"
+	"github.com/bazelbuild/tools_jvm_autodeps/editplan"
+	"github.com/bazelbuild/tools_jvm_autodeps/filter"
 	"github.com/bazelbuild/tools_jvm_autodeps/fsresolver"
 	"github.com/bazelbuild/tools_jvm_autodeps/future"
+	"github.com/bazelbuild/tools_jvm_autodeps/healthsignals"
 	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+	"github.com/bazelbuild/tools_jvm_autodeps/jarverifier"
+	"github.com/bazelbuild/tools_jvm_autodeps/lang/java/parser"
 	"github.com/bazelbuild/tools_jvm_autodeps/lang/java/ruleconsts"
+	"github.com/bazelbuild/tools_jvm_autodeps/macros"
+	"github.com/bazelbuild/tools_jvm_autodeps/mavenindex"
+	"github.com/bazelbuild/tools_jvm_autodeps/multiresolver"
 	"github.com/bazelbuild/tools_jvm_autodeps/pkgloading"
+	"github.com/bazelbuild/tools_jvm_autodeps/reload"
+	"github.com/bazelbuild/tools_jvm_autodeps/resolverutil"
+	"github.com/bazelbuild/tools_jvm_autodeps/runreport"
+	"github.com/bazelbuild/tools_jvm_autodeps/stdioserver"
+	"github.com/bazelbuild/tools_jvm_autodeps/vcs"
+	"github.com/bazelbuild/tools_jvm_autodeps/verify"
 	"github.com/bazelbuild/tools_jvm_autodeps/vlog"
+	"github.com/bazelbuild/tools_jvm_autodeps/warmstart"
 )
 
 // Main is an entry point to Jadep program.
@@ -47,80 +79,1287 @@ func Main(custom Customization, flags *Flags, args []string) {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	vlog.Level = flags.Vlevel
 	color.Enabled = flags.Color
-	ctx := context.Background()
+	cli.RelativeLabels = flags.RelativeLabels
+	cli.BasePkg = flags.BasePkg
+	cli.MaxCandidates = flags.MaxCandidates
+	cli.CandidatesFile = flags.CandidatesFile
+	if flags.ParserConcurrency > 0 {
+		parser.Concurrency = flags.ParserConcurrency
+	}
+	parser.FileTimeout = flags.ParserFileTimeout
+	if f, ok := custom.(ClassNameFilter); ok {
+		parser.ClassNamesFilter = f.FilterClassNames
+	}
+	switch flags.NewRulePolicy {
+	case "":
+	case cli.NewRulePolicyCreate, cli.NewRulePolicyAdd, cli.NewRulePolicyAsk:
+		cli.NewRulePolicy = flags.NewRulePolicy
+	default:
+		log.Fatalf("--new_rule_policy must be one of %q, %q or %q, got %q", cli.NewRulePolicyCreate, cli.NewRulePolicyAdd, cli.NewRulePolicyAsk, flags.NewRulePolicy)
+	}
+	if flags.MaxFlakiness < 0 || flags.MaxFlakiness > 1 {
+		log.Fatalf("--max_flakiness must be between 0 and 1, got %v", flags.MaxFlakiness)
+	}
+	switch flags.PackageInfoPolicy {
+	case "":
+	case cli.PackageInfoPolicyPackageRules, cli.PackageInfoPolicySkip:
+		cli.PackageInfoPolicy = flags.PackageInfoPolicy
+	default:
+		log.Fatalf("--package_info_policy must be one of %q or %q, got %q", cli.PackageInfoPolicyPackageRules, cli.PackageInfoPolicySkip, flags.PackageInfoPolicy)
+	}
+	switch flags.AmbiguityPolicy {
+	case jadeplib.AmbiguityPolicySkip, jadeplib.AmbiguityPolicyFirst, jadeplib.AmbiguityPolicyFail:
+	default:
+		log.Fatalf("--ambiguity_policy must be one of %q, %q or %q, got %q", jadeplib.AmbiguityPolicySkip, jadeplib.AmbiguityPolicyFirst, jadeplib.AmbiguityPolicyFail, flags.AmbiguityPolicy)
+	}
+	if flags.ShardCount > 0 && (flags.ShardIndex < 0 || flags.ShardIndex >= flags.ShardCount) {
+		log.Fatalf("--shard_index must be between 0 and --shard_count - 1 (%d), got %d", flags.ShardCount-1, flags.ShardIndex)
+	}
+	switch flags.PromptTimeoutAction {
+	case "accept", "skip":
+	default:
+		log.Fatalf("--prompt_timeout_action must be one of \"accept\" or \"skip\", got %q", flags.PromptTimeoutAction)
+	}
+	switch flags.DanglingDeps {
+	case "report", "remove":
+	default:
+		log.Fatalf("--dangling_deps must be one of \"report\" or \"remove\", got %q", flags.DanglingDeps)
+	}
+	switch flags.InvisibleDeps {
+	case "ignore", "report", "fix":
+	default:
+		log.Fatalf("--invisible_deps must be one of \"ignore\", \"report\" or \"fix\", got %q", flags.InvisibleDeps)
+	}
+	switch flags.ClasspathDelta {
+	case "", "off", "report", "rank":
+	default:
+		log.Fatalf("--classpath_delta must be one of \"off\", \"report\" or \"rank\", got %q", flags.ClasspathDelta)
+	}
+	if flags.ClasspathDeltaDepth < 1 {
+		log.Fatalf("--classpath_delta_depth must be positive, got %d", flags.ClasspathDeltaDepth)
+	}
+	ctx := cancelOnInterrupt(context.Background())
 	stopProfiler := cli.StartProfiler(flags.Cpuprofile)
 	defer stopProfiler()
-	if len(args) == 0 {
+	var whyNotArgs []string
+	if len(args) > 0 && args[0] == "why-not" {
+		if len(args) != 4 {
+			log.Fatalln("Usage: jadep why-not <label> <class name> <Java file or rule>")
+		}
+		whyNotArgs, args = args[1:3], args[3:]
+	}
+	var providesArgs []string
+	if len(args) > 0 && args[0] == "provides" {
+		if len(args) < 2 {
+			log.Fatalln("Usage: jadep provides <class name>...")
+		}
+		providesArgs, args = args[1:], nil
+	}
+	// 'jadep merge-plans' combines the edit plans of sharded runs (see --edit_plan), and applies them.
+	var mergePlansArgs []string
+	if len(args) > 0 && args[0] == "merge-plans" {
+		if len(args) < 2 {
+			log.Fatalln("Usage: jadep merge-plans <edit plan>...")
+		}
+		mergePlansArgs, args = args[1:], nil
+	}
+	// 'jadep move-fix' updates BUILD files after Java files moved between packages (see moveFiles), and then fixes the moved files.
+	var moves []vcs.Rename
+	moveFix := len(args) > 0 && args[0] == "move-fix"
+	if moveFix {
+		if len(args)%2 != 1 {
+			log.Fatalln("Usage: jadep move-fix [<old Java file> <new Java file>]...")
+		}
+		for i := 1; i < len(args); i += 2 {
+			moves = append(moves, vcs.Rename{From: args[i], To: args[i+1]})
+		}
+		if len(moves) == 0 {
+			renamed, err := vcsRenamedFiles(ctx, flags.Workspace)
+			if err != nil {
+				log.Fatalf("Error finding moved files:\n%v", err)
+			}
+			if len(renamed) == 0 {
+				log.Println("No moved Java files to process.")
+				return
+			}
+			moves = renamed
+		}
+		args = nil
+		for _, m := range moves {
+			args = append(args, m.To)
+		}
+	}
+	// 'jadep doctor' checks Jadep's environment, and explains how to fix what's wrong with it.
+	if len(args) > 0 && args[0] == "doctor" {
+		if len(args) != 1 {
+			log.Fatalln("Usage: jadep doctor")
+		}
+		runDoctor(ctx, custom, flags)
+		return
+	}
+	if len(args) > 0 && args[0] == "strip-comments" {
+		buildFiles, err := cli.ExpandArgs(args[1:], os.Stdin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(buildFiles) == 0 {
+			log.Fatalln("Usage: jadep strip-comments <BUILD file>...")
+		}
+		for _, f := range buildFiles {
+			if err := buildozer.StripProvenanceComments(f); err != nil {
+				log.Printf("WARNING: %v", err)
+			}
+		}
+		return
+	}
+	// 'jadep serve' answers requests of editors on stdin and stdout. See package stdioserver.
+	serve := len(args) > 0 && args[0] == "serve"
+	if serve {
+		if len(args) != 1 {
+			log.Fatalln("Usage: jadep serve")
+		}
+		args = nil
+	}
+	benchmark := len(args) > 0 && args[0] == "bench"
+	if benchmark {
+		args = args[1:]
+	}
+	args, err := cli.ExpandArgs(args, os.Stdin)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var prompts io.Reader
+	closePrompts := func() {}
+	// When serving, stdin carries requests rather than answers to prompts.
+	if !serve {
+		prompts, closePrompts, err = promptInput(flags.Answers)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	defer closePrompts()
+	promptOpts := jadeplib.PromptOptions{Timeout: flags.PromptTimeout, SkipOnTimeout: flags.PromptTimeoutAction == "skip"}
+	if prompts != nil {
+		cli.Stdin = prompts
+	} else if cli.NewRulePolicy == cli.NewRulePolicyAsk {
+		vlog.V(2).Printf("Prompts can't be answered; creating new rules instead of asking")
+		cli.NewRulePolicy = cli.NewRulePolicyCreate
+	}
+	if flags.VCSChanged && !benchmark && !serve && !moveFix && providesArgs == nil && mergePlansArgs == nil {
+		changed, err := vcsChangedFiles(ctx, flags.Workspace)
+		if err != nil {
+			log.Fatalf("Error finding changed files:\n%v", err)
+		}
+		if len(changed) == 0 && len(args) == 0 {
+			log.Println("No changed Java files to process.")
+			return
+		}
+		args = append(args, changed...)
+	}
+	if len(args) == 0 && !benchmark && !serve && providesArgs == nil && mergePlansArgs == nil {
 		log.Fatalln("Must provide at least one Java file or BUILD rule to process.")
 	}
+	if flags.ShardCount > 0 {
+		all := len(args)
+		args = editplan.Shard(args, flags.ShardIndex, flags.ShardCount)
+		log.Printf("Processing shard %d of %d: %d of %d files and rules", flags.ShardIndex, flags.ShardCount, len(args), all)
+	}
 	vlog.V(3).Printf("Processing files/rules: %v", args)
+	requiredAttrs, err := jadeplib.ParseRequiredAttrs(flags.NewRuleRequiredAttrs)
+	if err != nil {
+		log.Fatalf("Error parsing --new_rule_required_attrs: %v", err)
+	}
+	cli.NewRuleRequiredAttrs = requiredAttrs
+	depsAttributes, err := buildozer.ParseDepsAttributes(flags.DepsAttributes)
+	if err != nil {
+		log.Fatalf("Error parsing --deps_attributes: %v", err)
+	}
+	for kind, attr := range depsAttributes {
+		filter.DepsAttributeByKind[kind] = attr
+	}
+	cli.Macros, err = macros.Parse(flags.Macros)
+	if err != nil {
+		log.Fatalf("Error parsing --macros: %v", err)
+	}
+	for macro, attr := range macros.DepsAttributes(cli.Macros) {
+		filter.DepsAttributeByKind[macro] = attr
+	}
+	for _, tag := range strings.Split(flags.UmbrellaTags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			filter.UmbrellaTags[tag] = true
+		}
+	}
+	buildozer.RespectDirectives = flags.RespectKeepComments
+	for _, tag := range strings.Split(flags.APITags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			filter.APITags[tag] = true
+		}
+	}
+	if flags.UmbrellaNamePattern != "" {
+		filter.UmbrellaNamePattern, err = regexp.Compile(flags.UmbrellaNamePattern)
+		if err != nil {
+			log.Fatalf("Error parsing --umbrella_name_pattern: %v", err)
+		}
+	}
+	filter.LabelBlacklist, err = filter.CompileLabelBlacklist(flags.LabelBlacklist)
+	if err != nil {
+		log.Fatalf("Error parsing --label_blacklist: %v", err)
+	}
+	blacklist, err := jadeplib.CompileClassNameBlacklist(flags.Blacklist)
+	if err != nil {
+		log.Fatalf("Error parsing --blacklist: %v", err)
+	}
 	wd, relWorkingDir, err := cli.Workspace(flags.Workspace)
 	if err != nil {
 		log.Fatalf("Can't find root of workspace: %v", err)
 	}
-	config := jadeplib.Config{WorkspaceDir: wd}
+	config := jadeplib.Config{WorkspaceDir: wd, ProvidedClasses: jadeplib.NewProvidedClasses(), AnalysisCache: jadeplib.NewAnalysisCache()}
+	buildozer.PostEditHook = postEditHook(custom, wd, flags.PostEditCommand)
+	cli.NewRuleTemplates, err = loadRuleTemplates(flags.RuleTemplates, wd)
+	if err != nil {
+		log.Fatalf("Error reading --rule_templates: %v", err)
+	}
 
+	// Data read from files is reloaded when the files change, if --data_files_poll_interval is set.
+	watcher := &reload.Watcher{}
 	blacklistedPackageList := readFileLines(flags.BlacklistedPackageList)
 	builtinClassList := readDictFromCSV(flags.BuiltinClassList)
-	implicitImports := jadeplib.ImplicitImports(builtinClassList)
+	implicitImports := future.NewReloadable(func() interface{} { return jadeplib.ImplicitImports(builtinClassList).Get() })
+	watcher.Add([]string{flags.BuiltinClassList}, builtinClassList.Reload, implicitImports.Reload)
 
 	dataSources := custom.LoadDataSources(ctx)
 
 	var cleanup func()
-	config.Loader, cleanup = newLoader(ctx, custom, flags, config.WorkspaceDir, blacklistedPackageList.Get().([]string))
+	config.Loader, cleanup = newLoader(ctx, custom, flags, config.WorkspaceDir, blacklistedPackageList, watcher)
 	defer cleanup()
+	if flags.DataFilesPollInterval > 0 {
+		watchDataFiles(ctx, watcher, flags.DataFilesPollInterval)
+	}
 
 	config.DepsRanker = custom.NewDepsRanker(dataSources)
+	if flags.ClasspathDelta == "report" || flags.ClasspathDelta == "rank" {
+		estimator := jadeplib.NewClasspathEstimator(ctx, config.Loader, flags.ClasspathDeltaDepth)
+		cli.ClasspathEstimator = estimator
+		if flags.ClasspathDelta == "rank" {
+			config.DepsRanker = &classpathranker.Ranker{Estimator: estimator, Next: config.DepsRanker}
+		}
+	}
+	config.CycleCheckDepth = flags.CycleCheckDepth
+	config.MaxFlakiness = flags.MaxFlakiness
+	if flags.HealthSignalsFile != "" {
+		health, err := healthsignals.ReadJSONFile(flags.HealthSignalsFile)
+		if err != nil {
+			log.Fatalf("Error reading --health_signals_file: %v", err)
+		}
+		config.HealthSignals = health
+	} else if b, ok := custom.(HealthSignalsBackend); ok {
+		config.HealthSignals = b.NewHealthSignals(dataSources)
+	}
 
+	precedence, err := multiresolver.ParsePrecedence(flags.DictionaryPrecedence)
+	if err != nil {
+		log.Fatalf("Error parsing --dictionary_precedence: %v", err)
+	}
+	// The built-in list and the customized resolvers (e.g., third-party dictionaries) are consulted together,
+	// so that class names they disagree on are reported.
+	builtinLists, err := newBuiltinClassLists(flags, watcher)
+	if err != nil {
+		log.Fatal(err)
+	}
+	builtinResolver := newBuiltinResolver(builtinLists, builtinClassList, config.Loader)
+	dictionaries := []jadeplib.Resolver{builtinResolver}
+	dictionaries = append(dictionaries, custom.NewResolvers(config.Loader, dataSources)...)
+	config.Wrappers = collectWrappers(dictionaries)
+	// Each resolver is sandboxed, so one that panics or hangs only loses its own results.
+	for i, r := range dictionaries {
+		dictionaries[i] = resolverutil.Sandbox(r, flags.ResolverTimeout)
+	}
+	packagePrefixes, err := parsePackagePrefixes(flags.ContentRootPrefixes)
+	if err != nil {
+		log.Fatalf("Error parsing --content_root_prefixes: %v", err)
+	}
+	fsResolver := fsresolver.NewResolverWithCache(flags.ContentRoots, config.WorkspaceDir, config.Loader, config.AnalysisCache.PackageNames).WithPackagePrefixes(packagePrefixes)
 	config.Resolvers = []jadeplib.Resolver{
-		dictresolver.NewResolver("Built-in JDK/Android", builtinClassList, config.Loader),
-		fsresolver.NewResolver(flags.ContentRoots, config.WorkspaceDir, config.Loader),
+		multiresolver.NewResolver("Dictionaries", precedence, dictionaries...),
+		resolverutil.Sandbox(fsResolver, flags.ResolverTimeout),
+		resolverutil.Sandbox(codegenresolver.NewResolver(flags.ContentRoots, config.WorkspaceDir, config.Loader, config.AnalysisCache.PackageNames), flags.ResolverTimeout),
+	}
+	if flags.PackageAliases != "" {
+		aliases, err := readPackageAliases(flags.PackageAliases)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Consulted last, so aliases only apply to class names that no rule provides under their own name.
+		config.Resolvers = append(config.Resolvers, aliasresolver.NewResolver(aliases, config.Resolvers...))
+	}
+	processors := jadeplib.DefaultAnnotationProcessors
+	if flags.AnnotationProcessors != "" {
+		custom, err := readAnnotationProcessors(flags.AnnotationProcessors)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Tried first, so they override the defaults, e.g. to set the plugin to suggest.
+		processors = append(custom, processors...)
+	}
+
+	if whyNotArgs != nil {
+		whyNot(ctx, config, relWorkingDir, whyNotArgs[0], jadeplib.ClassName(whyNotArgs[1]), args[0])
+		return
+	}
+	if providesArgs != nil {
+		provides(ctx, config, providesArgs, flags.FromPkg)
+		return
+	}
+	if mergePlansArgs != nil {
+		mergePlans(ctx, config, flags, mergePlansArgs)
+		return
+	}
+
+	editSinks := newEditSinks(flags)
+	choiceStore := loadChoices(flags, config.WorkspaceDir)
+	skipFile := flags.SkipFile
+	if skipFile == "" {
+		skipFile = filepath.Join(config.WorkspaceDir, choices.DefaultSkipFileName)
+	}
+	if skipped, err := choices.LoadSkipList(skipFile); err != nil {
+		log.Printf("WARNING: %v", err)
+	} else if err := blacklist.Add(choices.SkipListRegexps(skipped)...); err != nil {
+		log.Printf("WARNING: %v", err)
+	}
+	if serve {
+		server := &stdioserver.Server{Config: config, ImplicitImports: implicitImports, Blacklist: blacklist}
+		if err := server.Serve(ctx, os.Stdin, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	// Class names referenced by several arguments are resolved once per invocation. Built-in class lists selected per rule
+	// make resolution specific to the consuming rules, and a server outlives the BUILD files it resolved against.
+	if builtinLists == nil {
+		config.ResolutionCache = jadeplib.NewResolutionCache()
+	}
+	if benchmark {
+		runBench(ctx, config, flags, blacklist, implicitImports)
+		return
+	}
+	var jarVerifier *jarverifier.Verifier
+	if flags.VerifyCandidateJars {
+		jarVerifier = jarverifier.New(filepath.Join(config.WorkspaceDir, "bazel-bin"), config.Loader)
+	}
+	if flags.WarmStartCache != "" {
+		caches := warmstart.Caches{ProvidedClasses: config.ProvidedClasses, JarVerifier: jarVerifier}
+		caches.Loader, _ = config.Loader.(*pkgloading.CachingLoader)
+		restoreWarmStartCache(flags.WarmStartCache, config.WorkspaceDir, caches)
+		defer func() {
+			if err := warmstart.Save(flags.WarmStartCache, config.WorkspaceDir, caches); err != nil {
+				log.Printf("WARNING: %v", err)
+			}
+		}()
+	}
+
+	mavenIndex := loadMavenIndex(flags.MavenIndex)
+
+	if moveFix {
+		args = moveFiles(ctx, config, relWorkingDir, moves, args, flags.DryRun)
+	}
+
+	report := runreport.New(time.Now(), args)
+	if flags.ReportFile != "" {
+		defer func() {
+			if err := report.AppendTo(flags.ReportFile); err != nil {
+				log.Printf("WARNING: %v", err)
+			}
+		}()
+	}
+	outputs, closeOutputs, err := newOutputSinks(flags.Outputs)
+	if err != nil {
+		log.Fatalf("Error parsing --outputs: %v", err)
+	}
+	defer closeOutputs()
+	cli.Output = append(outputs, reportSink{report})
+
+	var plan *editplan.Plan
+	if flags.EditPlan != "" {
+		plan = &editplan.Plan{}
+		cli.EditBuildFiles = false
+		if flags.ShardCount > 0 {
+			plan.Shard, plan.ShardCount = flags.ShardIndex, flags.ShardCount
+		}
+		defer func() {
+			if err := plan.Save(flags.EditPlan); err != nil {
+				log.Printf("WARNING: %v", err)
+			}
+		}()
 	}
-	config.Resolvers = append(config.Resolvers, custom.NewResolvers(config.Loader, dataSources)...)
 
+	// Deps added to rules that can't see them are made visible at the end, so that packages that need to see the same rule
+	// can share a package_group.
+	invisible := make(map[bazel.Label]map[string]bool)
+
+	// Files skipped because they can't be parsed are summarized at the end, since they're easy to miss in the output of each argument.
+	var allSkipped []*parser.FileError
+
+	type parseResult struct {
+		classNames []jadeplib.ClassName
+		skipped    []*parser.FileError
+	}
 	for _, arg := range args {
+		if ctx.Err() != nil {
+			log.Println("Interrupted; the remaining files and rules aren't processed.")
+			break
+		}
+		arg := arg
+		target := report.NewTarget(arg)
+		// With per-rule class lists, which classes are implicitly imported depends on the rules to fix,
+		// e.g. on their --release, so parsing waits for them.
+		argImplicitImports := future.Getter(implicitImports)
+		rulesFound := make(chan []*bazel.Rule, 1)
+		if builtinLists != nil {
+			argImplicitImports = future.NewValue(func() interface{} {
+				return builtinLists.implicitImports(implicitImports.Get().([]string), <-rulesFound)
+			})
+		}
+		// Parsing Java files doesn't depend on the rules to fix, so it runs while their packages are loaded.
+		parsed := future.NewValue(func() interface{} {
+			defer report.StartPhase("parse")()
+			classNames, skipped := classNamesToResolve(ctx, config, flags, blacklist, filepath.Join(config.WorkspaceDir, relWorkingDir), argImplicitImports, arg)
+			return parseResult{classNames, skipped}
+		})
+		endPhase := report.StartPhase("find_rules")
 		rulesToFix, err := cli.RulesToFix(ctx, config, relWorkingDir, arg, ruleconsts.NewRuleNamingRules, ruleconsts.DefaultNewRuleKind)
+		endPhase()
+		rulesFound <- rulesToFix
 		if err != nil {
 			log.Fatal(err)
 		}
+		rulesToFix = withoutIgnoredRules(config.WorkspaceDir, rulesToFix)
 		cli.LogRulesToFix(rulesToFix)
-		classNamesToResolve := cli.ClassNamesToResolve(ctx, filepath.Join(config.WorkspaceDir, relWorkingDir), config.Loader, arg, flags.ClassNames, implicitImports, flags.Blacklist)
-		missingDepsMap, unresClasses, err := jadeplib.MissingDeps(ctx, config, rulesToFix, classNamesToResolve)
+		if flags.MixedPackageRules != "ignore" {
+			plans := cli.PlanSplits(ctx, config.WorkspaceDir, rulesToFix)
+			cli.NarrowSplitDeps(ctx, config, plans, argImplicitImports.Get().([]string), blacklist)
+			cli.ReportSplitPlans(plans)
+			// An edit plan only records deps, so rules aren't split when making one.
+			if flags.MixedPackageRules == "split" && !flags.DryRun && plan == nil && len(plans) > 0 {
+				rulesToFix, err = cli.ApplySplitPlans(config.WorkspaceDir, rulesToFix, plans)
+				if err != nil {
+					log.Printf("WARNING: Error splitting rules:\n%v", err)
+					target.Error = err.Error()
+					continue
+				}
+				cli.LogRulesToFix(rulesToFix)
+			}
+		}
+		if testClasses := cli.TestClasses(ctx, config.WorkspaceDir, rulesToFix); len(testClasses) > 0 {
+			if flags.DryRun || flags.PrintBuildozerCommands || plan != nil {
+				cli.ReportTestClasses(testClasses)
+			} else if err := cli.SetTestClasses(config.WorkspaceDir, testClasses); err != nil {
+				log.Printf("WARNING: %v", err)
+			}
+		}
+		if dangling, err := jadeplib.DanglingDeps(ctx, config.Loader, rulesToFix); err != nil {
+			log.Printf("WARNING: Error looking for deps that don't exist:\n%v", err)
+		} else {
+			dangling, kept := removableDeps(config.WorkspaceDir, dangling)
+			cli.ReportKeptDeps(kept, "they don't exist")
+			remove := flags.DanglingDeps == "remove" && !flags.DryRun && !flags.PrintBuildozerCommands && len(dangling) > 0
+			if remove && plan != nil {
+				plan.RemoveDeps(jadeplib.DepsByAttribute(dangling))
+			} else if remove {
+				if err := buildozer.RemoveDepsFromAttributes(config.WorkspaceDir, jadeplib.DepsByAttribute(dangling)); err != nil {
+					log.Printf("WARNING: Error removing deps that don't exist:\n%v", err)
+					remove = false
+				}
+			}
+			cli.ReportDanglingDeps(dangling, remove)
+		}
+		if dups := jadeplib.DuplicateDeps(ctx, config.Loader, rulesToFix); len(dups) > 0 {
+			removable, kept := removableDeps(config.WorkspaceDir, jadeplib.DuplicateDepLabels(dups))
+			cli.ReportKeptDeps(kept, "exports already provide them")
+			dups = removableDuplicates(dups, removable)
+			remove := len(dups) > 0 && flags.Cleanup && !flags.DryRun && !flags.PrintBuildozerCommands
+			if remove && plan != nil {
+				plan.RemoveDeps(jadeplib.DuplicateDepsByAttribute(dups))
+			} else if remove {
+				if err := buildozer.RemoveDepsFromAttributes(config.WorkspaceDir, jadeplib.DuplicateDepsByAttribute(dups)); err != nil {
+					log.Printf("WARNING: Error removing deps that exports already provide:\n%v", err)
+					remove = false
+				}
+			}
+			cli.ReportDuplicateDeps(dups, remove)
+		}
+		if flags.ResourceRefs == "report" {
+			cli.ReportResourceSuggestions(cli.ResourceSuggestions(ctx, config, flags.ContentRoots, rulesToFix))
+		}
+		parseRes := parsed.Get().(parseResult)
+		classNamesToResolve := parseRes.classNames
+		target.SetSkippedFiles(parseRes.skipped)
+		allSkipped = append(allSkipped, parseRes.skipped...)
+		if flags.ServiceLoaderResources && len(flags.ClassNames) == 0 {
+			classNamesToResolve = append(classNamesToResolve, cli.ServiceProviderClassNames(config.WorkspaceDir, rulesToFix)...)
+		}
+		if len(flags.ClassNames) == 0 {
+			classNamesToResolve = append(classNamesToResolve, cli.ProcessorClassNames(rulesToFix)...)
+		}
+		endPhase = report.StartPhase("resolve")
+		missingDepsMap, unresClasses, classErrors, err := jadeplib.MissingDepsWithErrors(ctx, config, rulesToFix, classNamesToResolve)
+		endPhase()
 		if err != nil {
 			log.Printf("WARNING: Error computing missing dependencies:\n%v.", err)
+			target.Error = err.Error()
 			continue
 		}
+		target.SetClassErrors(classErrors)
+		if jarVerifier != nil {
+			rejected, unresolvable := jarVerifier.Filter(ctx, missingDepsMap)
+			cli.ReportRejectedCandidates(rejected)
+			unresClasses = append(unresClasses, unresolvable...)
+		}
+		if choiceStore != nil && !flags.IgnorePreviousChoices {
+			choiceStore.Prefer(missingDepsMap)
+		}
+		generated := jadeplib.GeneratedClasses(ctx, config.Loader, rulesToFix, unresClasses, processors, missingDepsMap)
+		unresClasses = withoutGenerated(unresClasses, generated)
 
 		if flags.DryRun {
 			cli.ReportMissingDeps(missingDepsMap)
 		} else {
 			// for each rule that's missing deps, which deps to add
-			depsToAdd, err := jadeplib.SelectDepsToAdd(os.Stdin, missingDepsMap)
+			depsToAdd, asked, neverAsk, err := selectDepsToAdd(ctx, config, flags.AutoApplyThreshold, prompts, promptOpts, flags.AmbiguityPolicy, missingDepsMap)
 			if err != nil {
 				log.Printf("WARNING: Error asking user to choose dependencies to add:\n%v", err)
+				target.Error = err.Error()
 				continue
 			}
-			err = buildozer.AddDepsToRules(config.WorkspaceDir, depsToAdd)
-			if err != nil {
-				log.Printf("WARNING: error adding missing deps to rules:\n%v", err)
-				continue
+			if err := choices.AppendSkipList(skipFile, neverAsk); err != nil {
+				log.Printf("WARNING: %v", err)
+			}
+			if err := blacklist.Add(choices.SkipListRegexps(neverAsk)...); err != nil {
+				log.Printf("WARNING: %v", err)
+			}
+			if flags.PrintBuildozerCommands {
+				if err := printBuildozerCommands(depsToAdd); err != nil {
+					log.Printf("WARNING: %v", err)
+					target.Error = err.Error()
+				}
+			} else if plan != nil {
+				plan.AddDeps(depsToAdd, missingDepsMap)
+			} else {
+				endPhase = report.StartPhase("edit")
+				err = buildozer.AddDepsToRules(config.WorkspaceDir, depsToAdd)
+				endPhase()
+				if err != nil {
+					log.Printf("WARNING: error adding missing deps to rules:\n%v", err)
+					target.Error = err.Error()
+					continue
+				}
+				if flags.Verify {
+					endPhase = report.StartPhase("verify")
+					depsToAdd = verifyAddedDeps(ctx, config.WorkspaceDir, flags.VerifyCommand, depsToAdd)
+					endPhase()
+				}
+				if flags.ProvenanceComments {
+					if err := buildozer.AddProvenanceComments(config.WorkspaceDir, depsToAdd, missingDepsMap); err != nil {
+						log.Printf("WARNING: error adding provenance comments:\n%v", err)
+					}
+				}
+				target.SetAddedDeps(depsToAdd)
+				if flags.RelativeLabels || flags.BasePkg != "" {
+					target.SetRelativeAddedDeps(flags.BasePkg)
+				}
+				cli.ReportAddedDeps(depsToAdd)
+				if choiceStore != nil {
+					choiceStore.Record(asked, depsToAdd)
+					if err := choiceStore.Save(); err != nil {
+						log.Printf("WARNING: %v", err)
+					}
+				}
+				publishEditEvents(ctx, editSinks, depsToAdd, missingDepsMap)
 			}
-			cli.ReportAddedDeps(depsToAdd)
+			// Only deps that were kept after --verify need to be visible.
+			if flags.InvisibleDeps != "ignore" {
+				addInvisibleDeps(ctx, config.Loader, depsToAdd, invisible)
+			}
+		}
+		cli.ReportGeneratedClasses(generated)
+		cli.ReportUnresolvedClassnamesWithArtifacts(unresClasses, mavenArtifacts(mavenIndex, unresClasses))
+		cli.ReportClassErrors(classErrors)
+	}
+	fixVisibility(ctx, config, flags, invisible)
+	cli.ReportSkippedFiles(allSkipped)
+	if caching, ok := config.Loader.(*pkgloading.CachingLoader); ok {
+		pkgErrs := caching.PackageErrors()
+		report.SetSkippedPackages(pkgErrs)
+		cli.ReportPackageErrors(pkgErrs)
+	}
+}
+
+// addInvisibleDeps adds the deps in depsToAdd that aren't visible to the rules they're added to, to invisible.
+func addInvisibleDeps(ctx context.Context, loader pkgloading.Loader, depsToAdd map[*bazel.Rule][]bazel.Label, invisible map[bazel.Label]map[string]bool) {
+	deps, err := jadeplib.InvisibleDeps(ctx, loader, depsToAdd)
+	if err != nil {
+		log.Printf("WARNING: Error checking the visibility of the deps to add:\n%v", err)
+		return
+	}
+	for l, pkgNames := range deps {
+		if invisible[l] == nil {
+			invisible[l] = make(map[string]bool)
+		}
+		for p := range pkgNames {
+			invisible[l][p] = true
+		}
+	}
+}
+
+// fixVisibility reports how to make the rules in invisible visible to the packages that depend on them,
+// and does so with --invisible_deps=fix, unless the deps were only recorded in an edit plan.
+func fixVisibility(ctx context.Context, config jadeplib.Config, flags *Flags, invisible map[bazel.Label]map[string]bool) {
+	if len(invisible) == 0 {
+		return
+	}
+	plans, err := jadeplib.PlanVisibility(ctx, config.Loader, invisible, flags.PackageGroupThreshold)
+	if err != nil {
+		log.Printf("WARNING: %v", err)
+		return
+	}
+	cli.ReportVisibilityPlans(plans)
+	if flags.InvisibleDeps != "fix" || flags.DryRun || flags.PrintBuildozerCommands || flags.EditPlan != "" {
+		return
+	}
+	if err := cli.ApplyVisibilityPlans(config.WorkspaceDir, plans); err != nil {
+		log.Printf("WARNING: %v", err)
+	}
+}
+
+// loadMavenIndex starts loading the Maven index at path in the background.
+// Returns nil if path is empty.
+func loadMavenIndex(path string) *future.Value {
+	if path == "" {
+		return nil
+	}
+	return future.NewValue(func() interface{} {
+		idx, err := mavenindex.Load(path)
+		if err != nil {
+			log.Printf("WARNING: Not suggesting Maven artifacts for unresolved class names:\n%v", err)
+			return (*mavenindex.Index)(nil)
+		}
+		return idx
+	})
+}
+
+// mavenArtifacts returns the Maven artifacts that contain each of classNames, according to the index loaded by loadMavenIndex.
+func mavenArtifacts(mavenIndex *future.Value, classNames []jadeplib.ClassName) map[jadeplib.ClassName][]mavenindex.Artifact {
+	if mavenIndex == nil || len(classNames) == 0 {
+		return nil
+	}
+	idx := mavenIndex.Get().(*mavenindex.Index)
+	if idx == nil {
+		return nil
+	}
+	return idx.Lookup(classNames)
+}
+
+// mergePlans merges the edit plans in fileNames, and applies the result, or writes it to --edit_plan if it's set.
+// Nothing is applied if any of the plans conflict.
+func mergePlans(ctx context.Context, config jadeplib.Config, flags *Flags, fileNames []string) {
+	var plans []*editplan.Plan
+	for _, f := range fileNames {
+		p, err := editplan.Load(f)
+		if err != nil {
+			log.Fatal(err)
+		}
+		plans = append(plans, p)
+	}
+	merged, conflicts, err := editplan.Merge(plans)
+	if err != nil {
+		log.Fatalf("Error merging edit plans:\n%v", err)
+	}
+	if len(conflicts) > 0 {
+		for _, c := range conflicts {
+			log.Printf("CONFLICT %v", c)
+		}
+		log.Fatalf("Edit plans conflict in %d places; not applying them", len(conflicts))
+	}
+	if flags.EditPlan != "" {
+		if err := merged.Save(flags.EditPlan); err != nil {
+			log.Fatal(err)
 		}
-		cli.ReportUnresolvedClassnames(unresClasses)
+		return
 	}
+	if flags.DryRun {
+		for _, e := range merged.Edits {
+			log.Printf("%s: add %v, remove %v", e.Rule, e.AddDeps, e.RemoveDeps)
+		}
+		return
+	}
+	if err := merged.Apply(ctx, config.Loader, config.WorkspaceDir); err != nil {
+		log.Fatalf("Error applying edit plans:\n%v", err)
+	}
+	log.Printf("Applied the edits of %d plans to %d rules", len(plans), len(merged.Edits))
 }
 
-func newLoader(ctx context.Context, custom Customization, flags *Flags, workspaceDir string, blacklistedPackageList []string) (pkgloading.Loader, func()) {
+// runDoctor checks Jadep's environment, and reports the results in the formats of --outputs.
+// A 'json' output with a file name overwrites the file. Exits with an error if any check failed.
+func runDoctor(ctx context.Context, custom Customization, flags *Flags) {
 	if flags.PkgLoaderAddress == "" {
 		flags.PkgLoaderAddress = defaultPkgLoaderAddress()
 	}
-	rpcLoader, cleanup, err := custom.NewLoader(ctx, flags, workspaceDir)
+	results := doctor.Run(ctx, doctor.Environment{
+		Workspace:              flags.Workspace,
+		ContentRoots:           flags.ContentRoots,
+		BuiltinClassList:       flags.BuiltinClassList,
+		BlacklistedPackageList: flags.BlacklistedPackageList,
+		ConnectLoader: func(ctx context.Context, workspaceDir string) (pkgloading.Loader, func(), error) {
+			return custom.NewLoader(ctx, flags, workspaceDir)
+		},
+	})
+	for _, s := range strings.Split(flags.Outputs, ",") {
+		format, fileName := s, ""
+		if i := strings.Index(s, ":"); i != -1 {
+			format, fileName = s[:i], s[i+1:]
+		}
+		var err error
+		switch {
+		case format == "text":
+			err = doctor.Report(os.Stdout, results)
+		case format == "json" && fileName == "":
+			err = doctor.ReportJSON(os.Stdout, results)
+		case format == "json":
+			var buf bytes.Buffer
+			if err = doctor.ReportJSON(&buf, results); err == nil {
+				err = ioutil.WriteFile(fileName, buf.Bytes(), 0644)
+			}
+		}
+		if err != nil {
+			log.Fatalf("Error reporting the results of 'jadep doctor':\n%v", err)
+		}
+	}
+	if doctor.Failed(results) {
+		log.Fatalln("Jadep's environment has errors; see above for how to fix them")
+	}
+}
+
+// printBuildozerCommands prints the Buildozer commands that add depsToAdd to stdout.
+func printBuildozerCommands(depsToAdd map[*bazel.Rule][]bazel.Label) error {
+	cmds, err := buildozer.AddDepsCommands(depsToAdd)
+	if err != nil {
+		return fmt.Errorf("error computing Buildozer commands:\n%v", err)
+	}
+	for _, c := range cmds {
+		fmt.Println(c)
+	}
+	return nil
+}
+
+// classNamesToResolve returns the class names that 'arg' needs dependencies for, taking into account --inlined_constants and --javadoc_refs.
+// workingDir is the directory relative to which 'arg' is interpreted.
+// blacklist excludes class names, and is the compiled form of --blacklist.
+// Also returns the files that were skipped because they can't be read or parsed.
+func classNamesToResolve(ctx context.Context, config jadeplib.Config, flags *Flags, blacklist *jadeplib.ClassNameBlacklist, workingDir string, implicitImports future.Getter, arg string) ([]jadeplib.ClassName, []*parser.FileError) {
+	ret, skipped := cli.ClassNamesToResolveWithErrors(ctx, workingDir, config.Loader, arg, flags.ClassNames, implicitImports, blacklist)
+	if len(flags.ClassNames) > 0 {
+		return ret, skipped
+	}
+	if flags.InlinedConstants != "add" {
+		constantOnly := cli.ConstantOnlyClassNames(ctx, workingDir, config.Loader, arg, implicitImports, ret)
+		skip := flags.InlinedConstants == "skip"
+		if skip {
+			ret = excludeClassNames(ret, constantOnly)
+		}
+		cli.ReportConstantOnlyClassNames(constantOnly, skip)
+	}
+	if flags.JavadocRefs != "ignore" {
+		javadocOnly := cli.JavadocOnlyClassNames(ctx, workingDir, config.Loader, arg, implicitImports, blacklist, ret)
+		if flags.JavadocRefs == "include" {
+			ret = append(ret, javadocOnly...)
+		} else {
+			cli.ReportJavadocOnlyClassNames(javadocOnly)
+		}
+	}
+	return ret, skipped
+}
+
+// vcsChangedFiles returns the absolute paths of the Java files that version control reports as modified or added
+// in the working copy of the workspace, skipping files outside the workspace.
+func vcsChangedFiles(ctx context.Context, workspaceFlag string) ([]string, error) {
+	wd, _, err := cli.Workspace(workspaceFlag)
+	if err != nil {
+		return nil, err
+	}
+	changed, err := vcs.ChangedJavaFiles(ctx, wd)
 	if err != nil {
-		log.Fatalf("Error connecting to PackageLoader service:\n%v", err)
+		return nil, err
 	}
-	filteringLoader := &pkgloading.FilteringLoader{rpcLoader, listToSet(blacklistedPackageList)}
-	return pkgloading.NewCachingLoader(filteringLoader), cleanup
+	var ret []string
+	for _, f := range changed {
+		if strings.HasPrefix(f, wd+string(filepath.Separator)) {
+			ret = append(ret, f)
+		}
+	}
+	return ret, nil
+}
+
+// vcsRenamedFiles returns the Java files that version control reports as renamed in the working copy of the workspace,
+// by their absolute paths, skipping files moved from or to outside the workspace.
+func vcsRenamedFiles(ctx context.Context, workspaceFlag string) ([]vcs.Rename, error) {
+	wd, _, err := cli.Workspace(workspaceFlag)
+	if err != nil {
+		return nil, err
+	}
+	renamed, err := vcs.RenamedJavaFiles(ctx, wd)
+	if err != nil {
+		return nil, err
+	}
+	var ret []vcs.Rename
+	for _, r := range renamed {
+		if strings.HasPrefix(r.From, wd+string(filepath.Separator)) && strings.HasPrefix(r.To, wd+string(filepath.Separator)) {
+			ret = append(ret, r)
+		}
+	}
+	return ret, nil
+}
+
+// moveFiles moves each of moves whose new file is in args out of the rules that src the old file, and into a rule in the package
+// of the new file, which gets the deps and attributes of the rule the file moved out of.
+// It returns the arguments to fix as usual: args, followed by the rules that the files moved out of and that remain.
+// Paths are absolute or relative to relWorkingDir. With dryRun, it only reports the moves.
+func moveFiles(ctx context.Context, config jadeplib.Config, relWorkingDir string, moves []vcs.Rename, args []string, dryRun bool) []string {
+	inArgs := make(map[string]bool)
+	for _, arg := range args {
+		inArgs[arg] = true
+	}
+	// A rule that a file moves out of may be deleted when another file moves out of it later.
+	remaining := make(map[bazel.Label]bool)
+	for _, m := range moves {
+		if !inArgs[m.To] {
+			continue
+		}
+		from, err := workspaceRelative(config.WorkspaceDir, relWorkingDir, m.From)
+		if err != nil {
+			log.Printf("WARNING: %v", err)
+			continue
+		}
+		to, err := workspaceRelative(config.WorkspaceDir, relWorkingDir, m.To)
+		if err != nil {
+			log.Printf("WARNING: %v", err)
+			continue
+		}
+		plan, err := cli.PlanMove(ctx, config, from, to, ruleconsts.NewRuleNamingRules, ruleconsts.DefaultNewRuleKind)
+		if err != nil {
+			log.Printf("WARNING: Not moving %s to %s:\n%v", from, to, err)
+			continue
+		}
+		if plan == nil {
+			log.Printf("No rule srcs %s; fixing %s as a new file", from, to)
+			continue
+		}
+		cli.ReportMovePlan(plan)
+		if dryRun {
+			continue
+		}
+		if err := cli.ApplyMovePlan(config, plan); err != nil {
+			log.Printf("WARNING: %v", err)
+			continue
+		}
+		for r := range plan.OldSrcs {
+			remaining[r.Label()] = !plan.Deleted(r)
+		}
+	}
+	var oldRules []string
+	for l, ok := range remaining {
+		if ok {
+			oldRules = append(oldRules, string(l))
+		}
+	}
+	sort.Strings(oldRules)
+	return append(args, oldRules...)
+}
+
+// workspaceRelative returns the path of fileName relative to the workspace root wd.
+// fileName is either absolute or relative to relWorkingDir.
+func workspaceRelative(wd, relWorkingDir, fileName string) (string, error) {
+	if !filepath.IsAbs(fileName) {
+		return filepath.Join(relWorkingDir, fileName), nil
+	}
+	rel, err := filepath.Rel(wd, fileName)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("%s is outside of the workspace %s", fileName, wd)
+	}
+	return rel, nil
+}
+
+// whyNot explains why 'label' wasn't suggested for 'cls' in the rules that 'arg' designates.
+// Unlike the main flow, it never creates a rule when no rule srcs 'arg'.
+func whyNot(ctx context.Context, config jadeplib.Config, relWorkingDir, label string, cls jadeplib.ClassName, arg string) {
+	lbl, err := bazel.ParseAbsoluteLabel(label)
+	if err != nil {
+		log.Fatalf("Error parsing label %q: %v", label, err)
+	}
+	var rulesToFix []*bazel.Rule
+	if _, err := bazel.ParseAbsoluteLabel(arg); err == nil {
+		rulesToFix, err = cli.RulesToFix(ctx, config, relWorkingDir, arg, nil, "")
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		fileName := filepath.Join(relWorkingDir, arg)
+		if filepath.IsAbs(arg) {
+			if fileName, err = filepath.Rel(config.WorkspaceDir, arg); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if rulesToFix, err = jadeplib.RulesConsumingFile(ctx, config, fileName); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(rulesToFix) == 0 {
+		log.Fatalf("No rule srcs %s", arg)
+	}
+	explanations, err := cli.WhyNot(ctx, config, rulesToFix, lbl, cls)
+	if err != nil {
+		log.Fatalf("Error explaining %s:\n%v", lbl, err)
+	}
+	cli.ReportWhyNot(explanations)
+}
+
+// provides prints the rules that provide each of classNames, and which resolvers returned them.
+// If fromPkg is not empty, it also explains whether each rule is visible to the package fromPkg.
+func provides(ctx context.Context, config jadeplib.Config, classNames []string, fromPkg string) {
+	for _, cls := range classNames {
+		providers, err := cli.Providers(ctx, config, jadeplib.ClassName(cls), fromPkg)
+		if err != nil {
+			log.Fatalf("Error finding rules providing %s:\n%v", cls, err)
+		}
+		cli.ReportProviders(jadeplib.ClassName(cls), providers)
+	}
+}
+
+// newLoader returns the Loader Jadep uses. Packages in blacklistedPackageList are never loaded; the list is reloaded by watcher.
+// The returned function closes the Loader, and logs the statistics of its package cache with --vlevel=1 or higher, e.g. when 'jadep serve' exits.
+func newLoader(ctx context.Context, custom Customization, flags *Flags, workspaceDir string, blacklistedPackageList *future.Reloadable, watcher *reload.Watcher) (pkgloading.Loader, func()) {
+	if flags.PkgLoaderAddress == "" {
+		flags.PkgLoaderAddress = defaultPkgLoaderAddress()
+	}
+	var rpcLoader pkgloading.Loader
+	var cleanup func()
+	if flags.RecordedPackages != "" {
+		replayLoader, err := bench.NewReplayLoader(flags.RecordedPackages)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rpcLoader, cleanup = replayLoader, func() {}
+	} else {
+		var err error
+		rpcLoader, cleanup, err = custom.NewLoader(ctx, flags, workspaceDir)
+		if err != nil {
+			log.Fatalf("Error connecting to PackageLoader service:\n%v", err)
+		}
+	}
+	if flags.RecordPackages != "" {
+		recordingLoader := &bench.RecordingLoader{Loader: rpcLoader}
+		rpcLoader = recordingLoader
+		closeLoader := cleanup
+		cleanup = func() {
+			if err := recordingLoader.Save(flags.RecordPackages); err != nil {
+				log.Printf("WARNING: %v", err)
+			}
+			closeLoader()
+		}
+	}
+	filteringLoader := &pkgloading.FilteringLoader{Loader: rpcLoader, BlacklistedPackages: listToSet(blacklistedPackageList.Get().([]string))}
+	watcher.Add([]string{flags.BlacklistedPackageList}, blacklistedPackageList.Reload, func() {
+		filteringLoader.SetBlacklistedPackages(listToSet(blacklistedPackageList.Get().([]string)))
+	})
+	opts := pkgloading.CachingLoaderOptions{
+		MaxEntries:       flags.PkgCacheMaxEntries,
+		ErrorTTL:         flags.PkgCacheErrorTTL,
+		ChunkSize:        flags.PkgLoaderChunkSize,
+		ChunkParallelism: flags.PkgLoaderChunkParallelism,
+	}
+	cachingLoader := pkgloading.NewCachingLoaderWithOptions(filteringLoader, opts)
+	closeLoader := cleanup
+	cleanup = func() {
+		s := cachingLoader.Stats()
+		vlog.V(1).Printf("Package cache: %d entries, %d hits, %d misses (%.1f%% hit rate), %d evictions", s.Entries, s.Hits, s.Misses, 100*s.HitRate(), s.Evictions)
+		closeLoader()
+	}
+	return cachingLoader, cleanup
+}
+
+// restoreWarmStartCache restores caches from the warm-start cache file fileName, and logs what was restored.
+func restoreWarmStartCache(fileName, workspaceDir string, caches warmstart.Caches) {
+	stopwatch := time.Now()
+	stats, err := warmstart.Load(fileName, workspaceDir, caches)
+	if err != nil {
+		log.Printf("WARNING: Ignoring warm-start cache: %v", err)
+		return
+	}
+	log.Printf("Restored %d packages (%d stale), classes of %d rules and %d jars (%d stale) from warm-start cache (%dms)",
+		stats.Packages, stats.StalePackages, stats.Rules, stats.Jars, stats.StaleJars, int64(time.Now().Sub(stopwatch)/time.Millisecond))
+}
+
+// excludeClassNames returns the members of classNames that aren't in toExclude.
+func excludeClassNames(classNames, toExclude []jadeplib.ClassName) []jadeplib.ClassName {
+	excluded := make(map[jadeplib.ClassName]bool)
+	for _, c := range toExclude {
+		excluded[c] = true
+	}
+	var ret []jadeplib.ClassName
+	for _, c := range classNames {
+		if !excluded[c] {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+// DefaultRuleTemplatesFileName is the name of the file, relative to the workspace root, that rule templates are read from
+// when --rule_templates isn't set. It's fine for it not to exist.
+const DefaultRuleTemplatesFileName = ".jadep_rule_templates.json"
+
+// loadRuleTemplates reads the templates of the attributes of new rules from fileName, or from DefaultRuleTemplatesFileName if it's empty.
+// See jadeplib.ParseRuleTemplates for the format.
+func loadRuleTemplates(fileName, workspaceDir string) (map[string]jadeplib.RuleTemplate, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if fileName == "" {
+		content, err = ioutil.ReadFile(filepath.Join(workspaceDir, DefaultRuleTemplatesFileName))
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return jadeplib.ParseRuleTemplates(content)
+}
+
+// loadChoices loads the user's previous choices for ambiguous classes.
+// Returns nil if they can't be loaded, in which case choices are neither used nor recorded.
+func loadChoices(flags *Flags, workspaceDir string) *choices.Store {
+	fileName := flags.ChoicesFile
+	if fileName == "" {
+		fileName = filepath.Join(workspaceDir, choices.DefaultFileName)
+	}
+	s, err := choices.Load(fileName)
+	if err != nil {
+		log.Printf("WARNING: %v", err)
+		return nil
+	}
+	return s
+}
+
+// selectDepsToAdd chooses the deps to add to each rule.
+// When autoApplyThreshold is positive, deps whose score exceeds it are chosen without asking the user, who is only asked about the rest.
+// The user's answers are read from prompts, waiting for them as promptOpts says; if it's nil, the user isn't asked, and ambiguityPolicy decides instead.
+// Also returns the missing deps the user was asked about, and the class names the user asked never to be asked about again.
+func selectDepsToAdd(ctx context.Context, config jadeplib.Config, autoApplyThreshold float64, prompts io.Reader, promptOpts jadeplib.PromptOptions, ambiguityPolicy string, missingDepsMap map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label) (map[*bazel.Rule][]bazel.Label, map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label, []jadeplib.ClassName, error) {
+	choose := func(missing map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label) (map[*bazel.Rule][]bazel.Label, map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label, []jadeplib.ClassName, error) {
+		if prompts == nil {
+			deps, err := jadeplib.SelectDepsNonInteractively(missing, ambiguityPolicy)
+			return deps, nil, nil, err
+		}
+		deps, neverAsk, err := jadeplib.SelectDepsToAddWithOptions(ctx, prompts, missing, promptOpts)
+		return deps, missing, neverAsk, err
+	}
+	if autoApplyThreshold <= 0 {
+		return choose(missingDepsMap)
+	}
+	depsToAdd, remaining := jadeplib.AutoSelectDepsInPackages(ctx, config.DepsRanker, consumingPackages(ctx, config.Loader, missingDepsMap), autoApplyThreshold, missingDepsMap)
+	if len(remaining) == 0 {
+		return depsToAdd, nil, nil, nil
+	}
+	chosen, asked, neverAsk, err := choose(remaining)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for rule, deps := range chosen {
+		depsToAdd[rule] = append(depsToAdd[rule], deps...)
+	}
+	return depsToAdd, asked, neverAsk, nil
+}
+
+// consumingPackages loads the packages of the rules in missingDepsMap, so that candidates can be scored in their context.
+// Returns nil if they can't be loaded.
+func consumingPackages(ctx context.Context, loader pkgloading.Loader, missingDepsMap map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label) map[string]*bazel.Package {
+	pkgNames := make(map[string]bool)
+	for rule := range missingDepsMap {
+		pkgNames[rule.PkgName] = true
+	}
+	var toLoad []string
+	for p := range pkgNames {
+		toLoad = append(toLoad, p)
+	}
+	sort.Strings(toLoad)
+	pkgs, err := loader.Load(ctx, toLoad)
+	if err != nil {
+		log.Printf("WARNING: Error loading consuming packages to score dependencies; scoring without them:\n%v", err)
+		return nil
+	}
+	return pkgs
+}
+
+// promptInput returns where the answers to prompts are read from: answersFile if it's set, or else stdin if it's a terminal.
+// Returns nil if prompts can't be answered, e.g. when Jadep runs in CI.
+// The returned function closes answersFile.
+func promptInput(answersFile string) (io.Reader, func(), error) {
+	if answersFile != "" {
+		f, err := os.Open(answersFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error opening --answers file:\n%v", err)
+		}
+		return f, func() { f.Close() }, nil
+	}
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return nil, func() {}, nil
+	}
+	return os.Stdin, func() {}, nil
+}
+
+// cancelOnInterrupt returns a context that's cancelled when the user hits Ctrl-C.
+// This abandons a prompt in progress before any BUILD file is edited for the current file or rule, and stops processing the rest.
+// Hitting Ctrl-C again exits immediately.
+func cancelOnInterrupt(ctx context.Context) context.Context {
+	ctx, cancel := context.WithCancel(ctx)
+	sigint := make(chan os.Signal, 1)
+	signal.Notify(sigint, os.Interrupt)
+	go func() {
+		<-sigint
+		fmt.Println()
+		cancel()
+		<-sigint
+		os.Exit(130)
+	}()
+	return ctx
+}
+
+// verifyAddedDeps builds the rules in depsToAdd, and removes the added deps from rules that still fail to build.
+// It returns the deps that were kept.
+func verifyAddedDeps(ctx context.Context, workspaceDir, command string, depsToAdd map[*bazel.Rule][]bazel.Label) map[*bazel.Rule][]bazel.Label {
+	var targets []bazel.Label
+	for rule := range depsToAdd {
+		targets = append(targets, rule.Label())
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i] < targets[j] })
+	failed, err := verify.Build(ctx, workspaceDir, command, targets)
+	if err != nil {
+		log.Printf("WARNING: Error verifying edited rules, keeping added deps:\n%v", err)
+		return depsToAdd
+	}
+	kept := make(map[*bazel.Rule][]bazel.Label)
+	rolledBack := make(map[*bazel.Rule][]bazel.Label)
+	var verified []bazel.Label
+	for rule, deps := range depsToAdd {
+		if failed[rule.Label()] {
+			rolledBack[rule] = deps
+		} else {
+			kept[rule] = deps
+			verified = append(verified, rule.Label())
+		}
+	}
+	sort.Slice(verified, func(i, j int) bool { return verified[i] < verified[j] })
+	if err := buildozer.RemoveDepsFromRules(workspaceDir, rolledBack); err != nil {
+		log.Printf("WARNING: Error rolling back added deps:\n%v", err)
+	}
+	cli.ReportVerification(verified, rolledBack)
+	return kept
+}
+
+// newEditSinks returns the sinks to which edit events are published, according to flags.
+func newEditSinks(flags *Flags) []editevents.Sink {
+	var ret []editevents.Sink
+	if flags.EditEventsWebhook != "" {
+		ret = append(ret, &editevents.WebhookSink{URL: flags.EditEventsWebhook, Client: &http.Client{Timeout: flags.RPCDeadline}})
+	}
+	if flags.EditEventsFile != "" {
+		ret = append(ret, &editevents.StreamSink{FileName: flags.EditEventsFile})
+	}
+	return ret
+}
+
+// publishEditEvents publishes the deps that were added to rules to all sinks.
+// Failures are logged but otherwise ignored, since the edits have already been applied.
+func publishEditEvents(ctx context.Context, sinks []editevents.Sink, addedDeps map[*bazel.Rule][]bazel.Label, missingDeps map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label) {
+	if len(sinks) == 0 {
+		return
+	}
+	events := editevents.FromAddedDeps(time.Now(), addedDeps, missingDeps)
+	for _, s := range sinks {
+		if err := s.Publish(ctx, events); err != nil {
+			log.Printf("WARNING: %v", err)
+		}
+	}
+}
+
+// newOutputSinks returns the sinks described by the --outputs flag, and a function that closes the files they write to.
+func newOutputSinks(spec string) (cli.MultiSink, func(), error) {
+	var ret cli.MultiSink
+	var files []*os.File
+	closeFiles := func() {
+		for _, f := range files {
+			if err := f.Close(); err != nil {
+				log.Printf("WARNING: %v", err)
+			}
+		}
+	}
+	for _, s := range strings.Split(spec, ",") {
+		if s == "" {
+			continue
+		}
+		format, fileName := s, ""
+		if i := strings.Index(s, ":"); i != -1 {
+			format, fileName = s[:i], s[i+1:]
+		}
+		switch format {
+		case "text":
+			if fileName != "" {
+				closeFiles()
+				return nil, nil, fmt.Errorf("the 'text' output can't be written to a file, got %q", s)
+			}
+			ret = append(ret, cli.TextSink{})
+		case "json":
+			if fileName == "" {
+				ret = append(ret, cli.JSONSink{W: os.Stdout})
+				continue
+			}
+			f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				closeFiles()
+				return nil, nil, fmt.Errorf("error opening output file:\n%v", err)
+			}
+			files = append(files, f)
+			ret = append(ret, cli.JSONSink{W: f})
+		default:
+			closeFiles()
+			return nil, nil, fmt.Errorf("unknown output format %q, want 'text' or 'json'", format)
+		}
+	}
+	return ret, closeFiles, nil
+}
+
+// reportSink records the rules being fixed and the unresolved class names in the --report_file target that's being processed.
+type reportSink struct {
+	report *runreport.Report
+}
+
+func (s reportSink) target() *runreport.Target {
+	return s.report.Targets[len(s.report.Targets)-1]
+}
+
+// RulesToFix implements cli.OutputSink.
+func (s reportSink) RulesToFix(rules []*bazel.Rule) error {
+	s.target().SetRulesFixed(rules)
+	return nil
+}
+
+// MissingDeps implements cli.OutputSink.
+// The report only records the deps that were added.
+func (s reportSink) MissingDeps(missingDeps map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label) error {
+	return nil
+}
+
+// UnresolvedClassNames implements cli.OutputSink.
+func (s reportSink) UnresolvedClassNames(classNames []jadeplib.ClassName, artifacts map[jadeplib.ClassName][]mavenindex.Artifact) error {
+	s.target().Unresolved = classNames
+	return nil
 }
 
 func defaultPkgLoaderAddress() string {
@@ -131,8 +1370,21 @@ func defaultPkgLoaderAddress() string {
 	return "unix://" + filepath.Join(u.HomeDir, "pkgloader.socket")
 }
 
-func readFileLines(fileName string) *future.Value {
-	return future.NewValue(func() interface{} {
+// watchDataFiles reloads the data files registered in watcher when they change, until ctx is done.
+// SIGHUP reloads them immediately.
+func watchDataFiles(ctx context.Context, watcher *reload.Watcher, pollInterval time.Duration) {
+	go watcher.Run(ctx, pollInterval)
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			watcher.ReloadAll()
+		}
+	}()
+}
+
+func readFileLines(fileName string) *future.Reloadable {
+	return future.NewReloadable(func() interface{} {
 		content, err := ioutil.ReadFile(fileName)
 		if err != nil {
 			log.Printf("WARNING: Error while reading %q: %v", fileName, err)
@@ -142,10 +1394,238 @@ func readFileLines(fileName string) *future.Value {
 	})
 }
 
+// builtinClassLists are the class lists that --builtin_classlists selects per rule.
+type builtinClassLists struct {
+	dicts map[string]future.Getter
+	keyOf func(*bazel.Rule) string
+}
+
+// newBuiltinClassLists parses --builtin_classlists, --builtin_classlist_dirs and --release_classlists.
+// Returns nil if --builtin_classlists isn't set.
+func newBuiltinClassLists(flags *Flags, watcher *reload.Watcher) (*builtinClassLists, error) {
+	if flags.BuiltinClassLists == "" {
+		return nil, nil
+	}
+	files, err := parseKeyValues(flags.BuiltinClassLists)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing --builtin_classlists: %v", err)
+	}
+	dirKeys, err := parseKeyValues(flags.BuiltinClassListDirs)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing --builtin_classlist_dirs: %v", err)
+	}
+	releaseKeys, err := parseKeyValues(flags.ReleaseClassLists)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing --release_classlists: %v", err)
+	}
+	dicts := make(map[string]future.Getter)
+	for key, fileName := range files {
+		dict := readDictFromCSV(fileName)
+		watcher.Add([]string{fileName}, dict.Reload)
+		dicts[key] = dict
+	}
+	return &builtinClassLists{dicts, dictresolver.RuleKeyWithReleases(dirKeys, releaseKeys)}, nil
+}
+
+// implicitImports returns the implicit imports of the Java files that rules compile:
+// those of 'implicitImports' (which come from --builtin_classlist) that the class list of each of the rules has too.
+func (l *builtinClassLists) implicitImports(implicitImports []string, rules []*bazel.Rule) []string {
+	var dicts []future.Getter
+	seen := make(map[string]bool)
+	for _, r := range rules {
+		key := l.keyOf(r)
+		if d, ok := l.dicts[key]; ok && !seen[key] {
+			seen[key] = true
+			dicts = append(dicts, d)
+		}
+	}
+	return jadeplib.RestrictImplicitImports(implicitImports, dicts)
+}
+
+// newBuiltinResolver returns the resolver of class names that need no deps, e.g. JDK classes.
+// If lists isn't nil, the class list is selected per rule (see dictresolver.RuleKeyWithReleases),
+// and builtinClassList is used for rules that don't select any.
+func newBuiltinResolver(lists *builtinClassLists, builtinClassList *future.Reloadable, loader pkgloading.Loader) jadeplib.Resolver {
+	const name = "Built-in JDK/Android"
+	if lists == nil {
+		return dictresolver.NewResolver(name, builtinClassList, loader)
+	}
+	return dictresolver.NewKeyedResolver(name, lists.dicts, builtinClassList, lists.keyOf, loader)
+}
+
+// postEditHook returns a function that runs 'command' and the customization's EditHook, if it implements one,
+// after BUILD files are edited. It returns nil if there's nothing to run.
+// 'command' is run in workspaceDir with the edited BUILD files appended to it, and the environment variable
+// JADEP_NEW_BUILD_FILES set to the space-separated BUILD files the edit created. A non-zero exit status rejects the edit.
+func postEditHook(custom Customization, workspaceDir, command string) func(buildFiles, newFiles []string) error {
+	hook, _ := custom.(EditHook)
+	args := strings.Fields(command)
+	if hook == nil && len(args) == 0 {
+		return nil
+	}
+	return func(buildFiles, newFiles []string) error {
+		if len(args) > 0 {
+			cmd := exec.Command(args[0], append(args[1:], buildFiles...)...)
+			cmd.Dir = workspaceDir
+			cmd.Env = append(os.Environ(), "JADEP_NEW_BUILD_FILES="+strings.Join(newFiles, " "))
+			if output, err := cmd.CombinedOutput(); err != nil {
+				return fmt.Errorf("%q failed: %v\n%s", command, err, output)
+			}
+		}
+		if hook != nil {
+			return hook.AfterEdit(buildFiles, newFiles)
+		}
+		return nil
+	}
+}
+
+// readPackageAliases reads the --package_aliases file.
+func readPackageAliases(fileName string) ([]aliasresolver.Alias, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("error opening --package_aliases file:\n%v", err)
+	}
+	defer f.Close()
+	aliases, err := aliasresolver.ReadAliases(f)
+	if err != nil {
+		return nil, fmt.Errorf("error reading --package_aliases file %s:\n%v", fileName, err)
+	}
+	return aliases, nil
+}
+
+// collectWrappers merges the wrappers of external targets known to the resolvers that implement jadeplib.WrapperProvider.
+// Resolvers listed first win when they disagree on the wrapper of a target.
+func collectWrappers(resolvers []jadeplib.Resolver) map[bazel.Label]*bazel.Rule {
+	ret := make(map[bazel.Label]*bazel.Rule)
+	for _, r := range resolvers {
+		wp, ok := r.(jadeplib.WrapperProvider)
+		if !ok {
+			continue
+		}
+		for l, w := range wp.Wrappers() {
+			if _, ok := ret[l]; !ok {
+				ret[l] = w
+			}
+		}
+	}
+	return ret
+}
+
+// withoutIgnoredRules returns the rules among rules that don't have a "# jadep:ignore" comment, and logs the others.
+// If the BUILD files of the rules can't be read, all of them are returned.
+func withoutIgnoredRules(workspaceDir string, rules []*bazel.Rule) []*bazel.Rule {
+	editable, ignored, err := buildozer.SplitIgnored(workspaceDir, rules)
+	if err != nil {
+		log.Printf("WARNING: Error looking for '# jadep:ignore' comments:\n%v", err)
+		return rules
+	}
+	for _, r := range ignored {
+		log.Printf("Not fixing %s, which has a '# %s' comment", r.Label(), buildozer.IgnoreDirective)
+	}
+	return editable
+}
+
+// removableDeps splits deps to the ones that may be removed, and the ones that "# keep" and "# jadep:ignore" comments keep.
+// If the BUILD files of the rules can't be read, no deps are removable, and all of them are returned as kept so that they're still reported.
+func removableDeps(workspaceDir string, deps map[*bazel.Rule][]bazel.Label) (removable, kept map[*bazel.Rule][]bazel.Label) {
+	removable, kept, err := buildozer.SplitKept(workspaceDir, deps)
+	if err != nil {
+		log.Printf("WARNING: Error looking for '# keep' comments; not removing deps:\n%v", err)
+		return nil, deps
+	}
+	return removable, kept
+}
+
+// removableDuplicates returns the duplicate deps in dups whose labels are in removable.
+func removableDuplicates(dups map[*bazel.Rule][]jadeplib.DuplicateDep, removable map[*bazel.Rule][]bazel.Label) map[*bazel.Rule][]jadeplib.DuplicateDep {
+	ret := make(map[*bazel.Rule][]jadeplib.DuplicateDep)
+	for rule, ds := range dups {
+		ok := make(map[bazel.Label]bool)
+		for _, l := range removable[rule] {
+			ok[l] = true
+		}
+		for _, d := range ds {
+			if ok[d.Dep] {
+				ret[rule] = append(ret[rule], d)
+			}
+		}
+	}
+	return ret
+}
+
+// readAnnotationProcessors reads the --annotation_processors file.
+func readAnnotationProcessors(fileName string) ([]jadeplib.AnnotationProcessor, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("error opening --annotation_processors file:\n%v", err)
+	}
+	defer f.Close()
+	processors, err := jadeplib.ReadAnnotationProcessors(f)
+	if err != nil {
+		return nil, fmt.Errorf("error reading --annotation_processors file %s:\n%v", fileName, err)
+	}
+	return processors, nil
+}
+
+// withoutGenerated returns the class names in classNames that aren't generated from the srcs of the rules in generated.
+func withoutGenerated(classNames []jadeplib.ClassName, generated map[*bazel.Rule][]jadeplib.GeneratedClass) []jadeplib.ClassName {
+	if len(generated) == 0 {
+		return classNames
+	}
+	isGenerated := make(map[jadeplib.ClassName]bool)
+	for _, gs := range generated {
+		for _, g := range gs {
+			isGenerated[g.ClassName] = true
+		}
+	}
+	var ret []jadeplib.ClassName
+	for _, cls := range classNames {
+		if !isGenerated[cls] {
+			ret = append(ret, cls)
+		}
+	}
+	return ret
+}
+
+// parsePackagePrefixes parses a comma-separated list of content_root=java_package pairs, e.g. --content_root_prefixes.
+// A content root can be listed several times to map it to several packages.
+func parsePackagePrefixes(s string) (map[string][]string, error) {
+	ret := make(map[string][]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.Split(pair, "=")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("expected content_root=java_package, got %q", pair)
+		}
+		ret[parts[0]] = append(ret[parts[0]], parts[1])
+	}
+	return ret, nil
+}
+
+// parseKeyValues parses a comma-separated list of key=value pairs.
+func parseKeyValues(s string) (map[string]string, error) {
+	ret := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.Split(pair, "=")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", pair)
+		}
+		ret[parts[0]] = parts[1]
+	}
+	return ret, nil
+}
+
 // readDictFromCSV reads a CSV whose first column is a class name, and the rest of the columns are Bazel rules that resolve it.
-// The return type is a future that wraps a map[jadeplib.ClassName][]bazel.Label
-func readDictFromCSV(fileName string) *future.Value {
-	return future.NewValue(func() interface{} {
+// The return type is a reloadable future that wraps a map[jadeplib.ClassName][]bazel.Label
+func readDictFromCSV(fileName string) *future.Reloadable {
+	return future.NewReloadable(func() interface{} {
 		f, err := os.Open(fileName)
 		if err != nil {
 			log.Printf("Error opening %s: %v", fileName, err)
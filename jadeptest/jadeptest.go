@@ -0,0 +1,200 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package jadeptest provides hermetic fakes and fixtures for testing code built on Jadep,
+// such as an organization's jadepmain.Customization and resolvers.
+package jadeptest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+	"github.com/bazelbuild/tools_jvm_autodeps/pkgloaderfakes"
+	"github.com/bazelbuild/tools_jvm_autodeps/sortingdepsranker"
+)
+
+// Loader is an in-memory pkgloading.Loader. It is safe for concurrent use.
+type Loader struct {
+	// Pkgs maps package names to the packages Load returns for them. Packages that are absent are silently not returned.
+	Pkgs map[string]*bazel.Package
+
+	// Errs maps package names to errors. Load fails if any of the requested packages is in Errs.
+	Errs map[string]error
+
+	mu    sync.Mutex
+	calls [][]string
+}
+
+// NewLoader returns a Loader for pkgs, keyed by package name.
+func NewLoader(pkgs map[string]*bazel.Package) *Loader {
+	return &Loader{Pkgs: pkgs}
+}
+
+// Load returns the packages that are both in 'packages' and in l.Pkgs.
+func (l *Loader) Load(ctx context.Context, packages []string) (map[string]*bazel.Package, error) {
+	sorted := append([]string(nil), packages...)
+	sort.Strings(sorted)
+	l.mu.Lock()
+	l.calls = append(l.calls, sorted)
+	l.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	result := make(map[string]*bazel.Package)
+	for _, p := range packages {
+		if err, ok := l.Errs[p]; ok {
+			return nil, fmt.Errorf("Error loading %s: %v", p, err)
+		}
+		if pkg, ok := l.Pkgs[p]; ok {
+			result[p] = pkg
+		}
+	}
+	return result, nil
+}
+
+// Calls returns the 'packages' argument of each call to Load so far (after sorting), in order.
+func (l *Loader) Calls() [][]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([][]string(nil), l.calls...)
+}
+
+// Resolver is a jadeplib.Resolver that resolves class names according to an in-memory map.
+// It is safe for concurrent use.
+type Resolver struct {
+	// ResolverName is returned by Name. Defaults to "jadeptest.Resolver".
+	ResolverName string
+
+	// Classes maps class names to the rules Resolve returns for them.
+	Classes map[jadeplib.ClassName][]*bazel.Rule
+
+	mu       sync.Mutex
+	requests [][]jadeplib.ClassName
+}
+
+// NewResolver returns a Resolver that resolves class names according to 'classes'.
+func NewResolver(classes map[jadeplib.ClassName][]*bazel.Rule) *Resolver {
+	return &Resolver{Classes: classes}
+}
+
+// Name returns a description of the resolver.
+func (r *Resolver) Name() string {
+	if r.ResolverName == "" {
+		return "jadeptest.Resolver"
+	}
+	return r.ResolverName
+}
+
+// Resolve returns the rules r.Classes maps each of classNames to. Class names that are absent from r.Classes are unresolved.
+func (r *Resolver) Resolve(ctx context.Context, classNames []jadeplib.ClassName, consumingRules map[bazel.Label]map[bazel.Label]bool) (map[jadeplib.ClassName][]*bazel.Rule, error) {
+	sorted := append([]jadeplib.ClassName(nil), classNames...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	r.mu.Lock()
+	r.requests = append(r.requests, sorted)
+	r.mu.Unlock()
+
+	result := make(map[jadeplib.ClassName][]*bazel.Rule)
+	for _, cls := range classNames {
+		if rules, ok := r.Classes[cls]; ok {
+			result[cls] = rules
+		}
+	}
+	return result, nil
+}
+
+// Requests returns the class names passed to each call to Resolve so far (after sorting), in order.
+func (r *Resolver) Requests() [][]jadeplib.ClassName {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][]jadeplib.ClassName(nil), r.requests...)
+}
+
+// Package creates a Bazel package from rules, as if it were returned by a PackageLoader server.
+// All rules must belong to the same package.
+func Package(rules ...*bazel.Rule) *bazel.Package {
+	return pkgloaderfakes.Pkg(rules)
+}
+
+// Packages creates a map from package name to package, suitable for Loader.Pkgs, grouping rules by their package.
+func Packages(rules ...*bazel.Rule) map[string]*bazel.Package {
+	byPkg := make(map[string][]*bazel.Rule)
+	for _, r := range rules {
+		byPkg[r.PkgName] = append(byPkg[r.PkgName], r)
+	}
+	ret := make(map[string]*bazel.Package)
+	for pkgName, rules := range byPkg {
+		ret[pkgName] = Package(rules...)
+	}
+	return ret
+}
+
+// Rule creates a bazel.Rule and applies modifiers to it, e.g. Rule("java_library", "x", "Foo", Srcs("Foo.java")).
+func Rule(kind, pkgName, name string, modifiers ...pkgloaderfakes.RuleModifier) *bazel.Rule {
+	return pkgloaderfakes.Rule(kind, pkgName, name, modifiers...)
+}
+
+// Attr, Srcs, Deps and Exports are modifiers for Rule.
+var (
+	Attr    = pkgloaderfakes.Attr
+	Srcs    = pkgloaderfakes.Srcs
+	Deps    = pkgloaderfakes.Deps
+	Exports = pkgloaderfakes.Exports
+)
+
+// Workspace creates a temporary Bazel workspace containing a WORKSPACE file and 'files', which maps paths relative to the workspace root to their content.
+// It returns the absolute path of the workspace root, and a function that deletes it.
+func Workspace(t testing.TB, files map[string]string) (root string, cleanup func()) {
+	tmpDir, err := ioutil.TempDir("", "jadeptest")
+	if err != nil {
+		t.Fatalf("Error creating temp directory: %v", err)
+	}
+	root = filepath.Join(tmpDir, "workspace")
+	cleanup = func() { os.RemoveAll(tmpDir) }
+	all := map[string]string{"WORKSPACE": ""}
+	for name, content := range files {
+		all[name] = content
+	}
+	for name, content := range all {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			cleanup()
+			t.Fatalf("Error creating directory for %s: %v", name, err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			cleanup()
+			t.Fatalf("Error writing %s: %v", name, err)
+		}
+	}
+	return root, cleanup
+}
+
+// Config returns a jadeplib.Config for the workspace at workspaceDir, which loads packages using loader and
+// resolves class names using resolvers, in order. Candidates are ranked by sortingdepsranker.
+func Config(workspaceDir string, loader *Loader, resolvers ...jadeplib.Resolver) jadeplib.Config {
+	return jadeplib.Config{
+		WorkspaceDir: workspaceDir,
+		Loader:       loader,
+		Resolvers:    resolvers,
+		DepsRanker:   &sortingdepsranker.Ranker{},
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package jarverifier checks that candidate dependencies actually provide the classes they were suggested for,
+// by listing the classes in their previously built output jars.
+package jarverifier
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+	"github.com/bazelbuild/tools_jvm_autodeps/listclassesinjar"
+	"github.com/bazelbuild/tools_jvm_autodeps/pkgloading"
+)
+
+// Verifier rejects candidates whose output jar was built and doesn't contain the class they were suggested for.
+// Candidates whose jars don't exist (e.g., because they were never built) are not rejected.
+// A candidate that exports other rules is rejected only if none of their jars contains the class either,
+// so that libraries that only re-export others (and whose own jar is empty) are kept.
+type Verifier struct {
+	// binDir is Bazel's output directory, e.g. <workspace>/bazel-bin.
+	binDir string
+	// loader loads the rules of candidates to follow their exports. If nil, exports aren't followed.
+	loader pkgloading.Loader
+
+	mu sync.Mutex
+	// jars caches the classes in each jar; a nil value means the jar doesn't exist or couldn't be read.
+	jars map[string]map[jadeplib.ClassName]bool
+}
+
+// New returns a new Verifier that looks for output jars under binDir, and loads candidates with loader to follow their exports.
+func New(binDir string, loader pkgloading.Loader) *Verifier {
+	return &Verifier{binDir: binDir, loader: loader, jars: make(map[string]map[jadeplib.ClassName]bool)}
+}
+
+// Filter removes from missingDepsMap the candidates whose output jar doesn't contain the class they'd satisfy.
+// Classes left without candidates are removed as well, and returned so that they can be reported as unresolved.
+// Also returns the rejected candidates of each class.
+func (v *Verifier) Filter(ctx context.Context, missingDepsMap map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label) (map[jadeplib.ClassName][]bazel.Label, []jadeplib.ClassName) {
+	rejected := make(map[jadeplib.ClassName][]bazel.Label)
+	unresolved := make(map[jadeplib.ClassName]bool)
+	for rule, classToRules := range missingDepsMap {
+		for class, labels := range classToRules {
+			var kept []bazel.Label
+			for _, l := range labels {
+				if v.provides(ctx, l, class, make(map[bazel.Label]bool)) {
+					kept = append(kept, l)
+				} else {
+					rejected[class] = append(rejected[class], l)
+				}
+			}
+			if len(kept) == 0 {
+				delete(classToRules, class)
+				unresolved[class] = true
+			} else {
+				classToRules[class] = kept
+			}
+		}
+		if len(classToRules) == 0 {
+			delete(missingDepsMap, rule)
+		}
+	}
+	var ret []jadeplib.ClassName
+	for c := range unresolved {
+		ret = append(ret, c)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return rejected, ret
+}
+
+// provides returns false iff label's output jar exists and doesn't contain className or any of its outer classes,
+// and the same holds for the rules label exports. visited holds the labels already checked.
+func (v *Verifier) provides(ctx context.Context, label bazel.Label, className jadeplib.ClassName, visited map[bazel.Label]bool) bool {
+	if visited[label] {
+		return false
+	}
+	visited[label] = true
+	jar, ok := v.outputJar(label)
+	if !ok {
+		return true
+	}
+	classes := v.classes(jar)
+	if classes == nil || contains(classes, className) {
+		return true
+	}
+	if v.loader == nil {
+		return false
+	}
+	exports, err := v.exports(ctx, label)
+	if err != nil {
+		// We can't tell what label exports, so don't reject it.
+		return true
+	}
+	for _, e := range exports {
+		if v.provides(ctx, e, className, visited) {
+			return true
+		}
+	}
+	return false
+}
+
+// contains returns true if classes contains className or any of its outer classes.
+func contains(classes map[jadeplib.ClassName]bool, className jadeplib.ClassName) bool {
+	c := string(className)
+	for {
+		if classes[jadeplib.ClassName(c)] {
+			return true
+		}
+		i := strings.LastIndex(c, ".")
+		if i == -1 {
+			return false
+		}
+		c = c[:i]
+	}
+}
+
+// exports returns the labels that the rule named label exports.
+func (v *Verifier) exports(ctx context.Context, label bazel.Label) ([]bazel.Label, error) {
+	pkgName, ruleName := label.Split()
+	pkgs, err := v.loader.Load(ctx, []string{pkgName})
+	if err != nil {
+		return nil, err
+	}
+	pkg := pkgs[pkgName]
+	if pkg == nil || pkg.Rules[ruleName] == nil {
+		return nil, fmt.Errorf("rule %s not found", label)
+	}
+	return pkg.Rules[ruleName].LabelListAttr("exports"), nil
+}
+
+// outputJar returns the path of the jar Bazel builds for a java_library named label.
+// Labels in external repositories are not supported.
+func (v *Verifier) outputJar(label bazel.Label) (string, bool) {
+	pkgName, ruleName := label.Split()
+	if strings.HasPrefix(string(label), "@") || ruleName == "" {
+		return "", false
+	}
+	return filepath.Join(v.binDir, pkgName, "lib"+ruleName+".jar"), true
+}
+
+// classes returns the classes in jar, or nil if it doesn't exist or can't be read.
+func (v *Verifier) classes(jar string) map[jadeplib.ClassName]bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c, ok := v.jars[jar]; ok {
+		return c
+	}
+	var result map[jadeplib.ClassName]bool
+	if _, err := os.Stat(jar); err == nil {
+		if classNames, err := listclassesinjar.List(jar); err == nil {
+			result = make(map[jadeplib.ClassName]bool)
+			for _, c := range classNames {
+				result[c] = true
+			}
+		}
+	}
+	v.jars[jar] = result
+	return result
+}
+
+// Jars returns the classes in each jar v has listed. Jars that don't exist or couldn't be read are omitted.
+func (v *Verifier) Jars() map[string][]jadeplib.ClassName {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	ret := make(map[string][]jadeplib.ClassName)
+	for jar, classes := range v.jars {
+		if classes == nil {
+			continue
+		}
+		var list []jadeplib.ClassName
+		for c := range classes {
+			list = append(list, c)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+		ret[jar] = list
+	}
+	return ret
+}
+
+// AddJars adds the classes of jars that were listed elsewhere, e.g. by a previous run, so v doesn't list them again.
+// Jars v has already listed are left untouched.
+func (v *Verifier) AddJars(jars map[string][]jadeplib.ClassName) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for jar, classNames := range jars {
+		if _, ok := v.jars[jar]; ok {
+			continue
+		}
+		classes := make(map[jadeplib.ClassName]bool)
+		for _, c := range classNames {
+			classes[c] = true
+		}
+		v.jars[jar] = classes
+	}
+}
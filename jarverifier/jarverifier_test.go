@@ -0,0 +1,99 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jarverifier
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+	"github.com/bazelbuild/tools_jvm_autodeps/loadertest"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFilter(t *testing.T) {
+	binDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(binDir)
+	writeJar(t, filepath.Join(binDir, "x/libFoo.jar"), "com/Foo.class", "com/Foo$Inner.class")
+	writeJar(t, filepath.Join(binDir, "x/libStale.jar"), "com/Other.class")
+	// //x:Exports has no srcs, so its own jar is empty.
+	writeJar(t, filepath.Join(binDir, "x/libExports.jar"))
+	loader := &loadertest.StubLoader{Pkgs: map[string]*bazel.Package{"x": {Rules: map[string]*bazel.Rule{
+		"Exports": bazel.NewRule("java_library", "x", "Exports", map[string]interface{}{"exports": []string{":Foo"}}),
+		"Foo":     bazel.NewRule("java_library", "x", "Foo", nil),
+		"Stale":   bazel.NewRule("java_library", "x", "Stale", nil),
+	}}}}
+
+	rule := bazel.NewRule("java_library", "y", "Y", nil)
+	missing := map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label{rule: {
+		"com.Foo":       {"//x:Stale", "//x:Foo"},
+		"com.Foo.Inner": {"//x:Foo"},
+		"com.Bar":       {"//x:NeverBuilt", "//x:Stale"},
+		"com.Baz":       {"//x:Stale"},
+		"com.Foo.Other": {"//x:Exports"},
+		"com.Qux":       {"//x:Exports"},
+	}}
+	rejected, unresolved := New(binDir, loader).Filter(context.Background(), missing)
+
+	wantMissing := map[*bazel.Rule]map[jadeplib.ClassName][]bazel.Label{rule: {
+		"com.Foo":       {"//x:Foo"},
+		"com.Foo.Inner": {"//x:Foo"},
+		"com.Bar":       {"//x:NeverBuilt"},
+		"com.Foo.Other": {"//x:Exports"},
+	}}
+	if diff := cmp.Diff(missing, wantMissing); diff != "" {
+		t.Errorf("Filter() left missing deps diff (-got +want):\n%s", diff)
+	}
+	wantRejected := map[jadeplib.ClassName][]bazel.Label{
+		"com.Foo": {"//x:Stale"},
+		"com.Bar": {"//x:Stale"},
+		"com.Baz": {"//x:Stale"},
+		"com.Qux": {"//x:Exports"},
+	}
+	if diff := cmp.Diff(rejected, wantRejected); diff != "" {
+		t.Errorf("Filter() rejected diff (-got +want):\n%s", diff)
+	}
+	if diff := cmp.Diff(unresolved, []jadeplib.ClassName{"com.Baz", "com.Qux"}); diff != "" {
+		t.Errorf("Filter() unresolved diff (-got +want):\n%s", diff)
+	}
+}
+
+func writeJar(t *testing.T, fileName string, entries ...string) {
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := zip.NewWriter(f)
+	for _, e := range entries {
+		if _, err := w.Create(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
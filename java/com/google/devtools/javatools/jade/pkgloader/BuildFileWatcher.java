@@ -0,0 +1,149 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package com.google.devtools.javatools.jade.pkgloader;
+
+import static java.nio.file.StandardWatchEventKinds.ENTRY_CREATE;
+import static java.nio.file.StandardWatchEventKinds.ENTRY_DELETE;
+import static java.nio.file.StandardWatchEventKinds.ENTRY_MODIFY;
+
+import com.google.common.collect.ImmutableSet;
+import java.io.IOException;
+import java.nio.file.FileSystems;
+import java.nio.file.FileVisitResult;
+import java.nio.file.Files;
+import java.nio.file.Path;
+import java.nio.file.SimpleFileVisitor;
+import java.nio.file.WatchEvent;
+import java.nio.file.WatchKey;
+import java.nio.file.WatchService;
+import java.nio.file.attribute.BasicFileAttributes;
+import java.util.Map;
+import java.util.concurrent.ConcurrentHashMap;
+import java.util.concurrent.CopyOnWriteArrayList;
+import java.util.logging.Level;
+import java.util.logging.Logger;
+
+/**
+ * BuildFileWatcher notifies listeners when BUILD files in a workspace are created, modified or
+ * deleted.
+ *
+ * <p>Listeners are also notified of changes reported through {@link #notifyListeners}, which
+ * allows clients to forward hints about changes the watcher can't observe.
+ */
+class BuildFileWatcher {
+
+  private static final Logger logger = Logger.getLogger("BuildFileWatcher");
+
+  private static final ImmutableSet<String> BUILD_FILE_NAMES =
+      ImmutableSet.of("BUILD", "BUILD.bazel");
+
+  /** Listener is notified with the names of packages whose BUILD files changed. */
+  interface Listener {
+    void packagesChanged(ImmutableSet<String> packages);
+  }
+
+  private final Path workspaceRoot;
+  private final WatchService watchService;
+  private final Map<WatchKey, Path> watchedDirs = new ConcurrentHashMap<>();
+  private final CopyOnWriteArrayList<Listener> listeners = new CopyOnWriteArrayList<>();
+
+  private BuildFileWatcher(Path workspaceRoot, WatchService watchService) {
+    this.workspaceRoot = workspaceRoot;
+    this.watchService = watchService;
+  }
+
+  /** start starts watching the directories under workspaceRoot in a background thread. */
+  static BuildFileWatcher start(Path workspaceRoot) throws IOException {
+    BuildFileWatcher watcher =
+        new BuildFileWatcher(workspaceRoot, FileSystems.getDefault().newWatchService());
+    watcher.registerRecursively(workspaceRoot);
+    Thread thread = new Thread(watcher::processEvents, "BuildFileWatcher " + workspaceRoot);
+    thread.setDaemon(true);
+    thread.start();
+    return watcher;
+  }
+
+  void addListener(Listener listener) {
+    listeners.add(listener);
+  }
+
+  void removeListener(Listener listener) {
+    listeners.remove(listener);
+  }
+
+  void notifyListeners(ImmutableSet<String> packages) {
+    if (packages.isEmpty()) {
+      return;
+    }
+    for (Listener listener : listeners) {
+      listener.packagesChanged(packages);
+    }
+  }
+
+  /** packageName returns the name of the package whose BUILD file is in dir, e.g. "java/Foo". */
+  static String packageName(Path workspaceRoot, Path dir) {
+    return workspaceRoot.relativize(dir).toString().replace('\\', '/');
+  }
+
+  private void registerRecursively(Path root) throws IOException {
+    Files.walkFileTree(
+        root,
+        new SimpleFileVisitor<Path>() {
+          @Override
+          public FileVisitResult preVisitDirectory(Path dir, BasicFileAttributes attrs)
+              throws IOException {
+            String name = dir.getFileName() == null ? "" : dir.getFileName().toString();
+            if (!dir.equals(workspaceRoot) && (name.startsWith(".") || name.startsWith("bazel-"))) {
+              return FileVisitResult.SKIP_SUBTREE;
+            }
+            watchedDirs.put(
+                dir.register(watchService, ENTRY_CREATE, ENTRY_DELETE, ENTRY_MODIFY), dir);
+            return FileVisitResult.CONTINUE;
+          }
+        });
+  }
+
+  private void processEvents() {
+    while (true) {
+      WatchKey key;
+      try {
+        key = watchService.take();
+      } catch (InterruptedException e) {
+        return;
+      }
+      Path dir = watchedDirs.get(key);
+      ImmutableSet.Builder<String> changed = ImmutableSet.builder();
+      for (WatchEvent<?> event : key.pollEvents()) {
+        if (dir == null || !(event.context() instanceof Path)) {
+          continue;
+        }
+        Path child = dir.resolve((Path) event.context());
+        if (BUILD_FILE_NAMES.contains(child.getFileName().toString())) {
+          changed.add(packageName(workspaceRoot, dir));
+        } else if (event.kind() == ENTRY_CREATE && Files.isDirectory(child)) {
+          try {
+            registerRecursively(child);
+          } catch (IOException e) {
+            logger.log(Level.WARNING, "Can't watch new directory " + child, e);
+          }
+        }
+      }
+      if (!key.reset()) {
+        watchedDirs.remove(key);
+      }
+      notifyListeners(changed.build());
+    }
+  }
+}
@@ -14,20 +14,27 @@
 
 package com.google.devtools.javatools.jade.pkgloader;
 
+import com.google.common.collect.ImmutableSet;
 import com.google.common.util.concurrent.ThreadFactoryBuilder;
 import com.google.devtools.build.lib.vfs.JavaIoFileSystem;
 import com.google.devtools.build.lib.vfs.DigestHashFunction;
 import com.google.protos.java.com.google.devtools.javatools.jade.pkgloader.services.PackageLoaderGrpc.PackageLoaderImplBase;
 import com.google.protos.java.com.google.devtools.javatools.jade.pkgloader.services.Services.Empty;
+import com.google.protos.java.com.google.devtools.javatools.jade.pkgloader.services.Services.InvalidateRequest;
 import com.google.protos.java.com.google.devtools.javatools.jade.pkgloader.services.Services.LoaderRequest;
 import com.google.protos.java.com.google.devtools.javatools.jade.pkgloader.services.Services.LoaderResponse;
+import com.google.protos.java.com.google.devtools.javatools.jade.pkgloader.services.Services.ResolveRequest;
+import com.google.protos.java.com.google.devtools.javatools.jade.pkgloader.services.Services.ResolveResponse;
 import com.google.protos.java.com.google.devtools.javatools.jade.pkgloader.services.Services.VersionResponse;
+import com.google.protos.java.com.google.devtools.javatools.jade.pkgloader.services.Services.WatchRequest;
+import com.google.protos.java.com.google.devtools.javatools.jade.pkgloader.services.Services.WatchResponse;
 import com.google.protos.java.com.google.devtools.javatools.jade.pkgloader.services.VersionManagementGrpc.VersionManagementImplBase;
 import io.grpc.Server;
 import io.grpc.ServerBuilder;
 import io.grpc.ServerServiceDefinition;
 import io.grpc.netty.NettyServerBuilder;
 import io.grpc.protobuf.services.ProtoReflectionService;
+import io.grpc.stub.ServerCallStreamObserver;
 import io.grpc.stub.StreamObserver;
 import io.netty.channel.EventLoopGroup;
 import io.netty.channel.epoll.EpollEventLoopGroup;
@@ -42,6 +49,7 @@ import java.net.InetSocketAddress;
 import java.nio.file.Files;
 import java.nio.file.Path;
 import java.nio.file.Paths;
+import java.util.concurrent.ConcurrentHashMap;
 import java.util.concurrent.ThreadFactory;
 import java.util.logging.Level;
 import java.util.logging.Logger;
@@ -86,11 +94,67 @@ public class GrpcLocalServer {
   private static String version = "";
 
   private static class PackageLoaderImpl extends PackageLoaderImplBase {
+    /** Watchers of BUILD files, keyed by workspace directory. Created on the first Watch call. */
+    private final ConcurrentHashMap<String, BuildFileWatcher> watchers = new ConcurrentHashMap<>();
+
     @Override
     public void load(LoaderRequest request, StreamObserver<LoaderResponse> responseObserver) {
       responseObserver.onNext(Lib.load(PACKAGE_LOADER_FACTORY, FILESYSTEM, request));
       responseObserver.onCompleted();
     }
+
+    @Override
+    public void resolve(ResolveRequest request, StreamObserver<ResolveResponse> responseObserver) {
+      responseObserver.onNext(Lib.resolve(PACKAGE_LOADER_FACTORY, FILESYSTEM, request));
+      responseObserver.onCompleted();
+    }
+
+    @Override
+    public void watch(WatchRequest request, StreamObserver<WatchResponse> responseObserver) {
+      BuildFileWatcher watcher;
+      try {
+        watcher = watcher(request.getWorkspaceDir());
+      } catch (IOException e) {
+        logger.log(Level.WARNING, "Can't watch " + request.getWorkspaceDir(), e);
+        responseObserver.onError(e);
+        return;
+      }
+      BuildFileWatcher.Listener listener =
+          packages -> {
+            synchronized (responseObserver) {
+              responseObserver.onNext(
+                  WatchResponse.newBuilder().addAllChangedPackages(packages).build());
+            }
+          };
+      ((ServerCallStreamObserver<WatchResponse>) responseObserver)
+          .setOnCancelHandler(() -> watcher.removeListener(listener));
+      watcher.addListener(listener);
+    }
+
+    @Override
+    public void invalidate(InvalidateRequest request, StreamObserver<Empty> responseObserver) {
+      BuildFileWatcher watcher = watchers.get(request.getWorkspaceDir());
+      if (watcher != null) {
+        watcher.notifyListeners(ImmutableSet.copyOf(request.getPackagesList()));
+      }
+      responseObserver.onNext(Empty.getDefaultInstance());
+      responseObserver.onCompleted();
+    }
+
+    private BuildFileWatcher watcher(String workspaceDir) throws IOException {
+      BuildFileWatcher watcher = watchers.get(workspaceDir);
+      if (watcher != null) {
+        return watcher;
+      }
+      synchronized (watchers) {
+        watcher = watchers.get(workspaceDir);
+        if (watcher == null) {
+          watcher = BuildFileWatcher.start(Paths.get(workspaceDir));
+          watchers.put(workspaceDir, watcher);
+        }
+        return watcher;
+      }
+    }
   }
 
   private static class VersionManagementImpl extends VersionManagementImplBase {
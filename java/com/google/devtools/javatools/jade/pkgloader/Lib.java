@@ -19,22 +19,38 @@ import com.google.common.collect.ImmutableMap;
 import com.google.common.collect.ImmutableSet;
 import com.google.devtools.build.lib.cmdline.LabelSyntaxException;
 import com.google.devtools.build.lib.cmdline.PackageIdentifier;
+import com.google.devtools.build.lib.packages.BuildFileNotFoundException;
 import com.google.devtools.build.lib.packages.NoSuchPackageException;
 import com.google.devtools.build.lib.skyframe.packages.PackageLoader;
 import com.google.devtools.build.lib.vfs.FileSystem;
+import com.google.devtools.build.lib.vfs.Path;
+import com.google.devtools.build.lib.vfs.PathFragment;
 import com.google.protos.java.com.google.devtools.javatools.jade.pkgloader.services.Services.LoaderRequest;
 import com.google.protos.java.com.google.devtools.javatools.jade.pkgloader.services.Services.LoaderResponse;
+import com.google.protos.java.com.google.devtools.javatools.jade.pkgloader.services.Services.PackageError;
+import com.google.protos.java.com.google.devtools.javatools.jade.pkgloader.services.Services.ResolveRequest;
+import com.google.protos.java.com.google.devtools.javatools.jade.pkgloader.services.Services.ResolveResponse;
+import java.util.ArrayList;
 import java.util.HashMap;
 import java.util.HashSet;
+import java.util.LinkedHashSet;
+import java.util.List;
+import java.util.Map;
 import java.util.Set;
 import java.util.logging.Level;
 import java.util.logging.Logger;
+import java.util.regex.Matcher;
+import java.util.regex.Pattern;
 
 /** `pkgloader` allows clients to load Bazel packages without calling Bazel. */
 public class Lib {
 
   private static final Logger logger = Logger.getLogger("Lib");
 
+  /** Matches the location of an error in a BUILD file, e.g. "/src/foo/BUILD:12:3: ". */
+  private static final Pattern BUILD_FILE_LOCATION =
+      Pattern.compile("/BUILD(?:\\.bazel)?:(\\d+)(?::\\d+)?: ");
+
   /** load loads packages according to 'request', in the file system 'fileSystem'. */
   static LoaderResponse load(
       PackageLoaderFactory packageLoaderFactory, FileSystem fileSystem, LoaderRequest request) {
@@ -73,11 +89,95 @@ public class Lib {
             response.putPkgs(
                 pkgNames.get(pkgId),
                 Serializer.serialize(pkg.get(), ruleKindsToSerialize));
-          } catch (NoSuchPackageException e) {
+          } catch (BuildFileNotFoundException e) {
             logger.log(Level.FINE, String.format("No such package: %s", pkgId), e);
+          } catch (NoSuchPackageException e) {
+            logger.log(Level.FINE, String.format("Error loading package: %s", pkgId), e);
+            response.addErrors(packageError(pkgNames.get(pkgId), e.getMessage()));
           }
         });
     logger.info("End of 'load'");
     return response.build();
   }
+
+  /**
+   * resolve finds the packages that the files of 'request' belong to, and loads them, in the file
+   * system 'fileSystem'.
+   */
+  static ResolveResponse resolve(
+      PackageLoaderFactory packageLoaderFactory, FileSystem fileSystem, ResolveRequest request) {
+    logger.info("Start of 'resolve'");
+    Path workspaceRoot = fileSystem.getPath(request.getWorkspaceDir());
+    HashMap<PathFragment, String> dirToPkgName = new HashMap<>();
+    ResolveResponse.Builder response = ResolveResponse.newBuilder();
+    Set<String> pkgNames = new LinkedHashSet<>();
+    for (String file : request.getFilesList()) {
+      String pkgName = findPackageName(workspaceRoot, file, dirToPkgName);
+      if (!pkgName.isEmpty()) {
+        response.putFileToPackage(file, pkgName);
+        pkgNames.add(pkgName);
+      }
+    }
+    pkgNames.removeAll(request.getExcludedPackagesList());
+
+    LoaderResponse loaded =
+        load(
+            packageLoaderFactory,
+            fileSystem,
+            LoaderRequest.newBuilder()
+                .setWorkspaceDir(request.getWorkspaceDir())
+                .setInstallBase(request.getInstallBase())
+                .setOutputBase(request.getOutputBase())
+                .addAllPackages(pkgNames)
+                .addAllRuleKindsToSerialize(request.getRuleKindsToSerializeList())
+                .build());
+    response.putAllPkgs(loaded.getPkgsMap()).addAllErrors(loaded.getErrorsList());
+    logger.info("End of 'resolve'");
+    return response.build();
+  }
+
+  /**
+   * findPackageName returns the name of the package that 'file' is in, i.e. its closest ancestor
+   * directory with a BUILD file, or "" if there's none below the workspace root. Directories
+   * visited along the way are recorded in 'cache', so files sharing ancestors don't stat() them
+   * again.
+   */
+  private static String findPackageName(
+      Path workspaceRoot, String file, Map<PathFragment, String> cache) {
+    PathFragment path = PathFragment.create(file);
+    if (path.isAbsolute() || path.containsUplevelReferences()) {
+      return "";
+    }
+    List<PathFragment> visited = new ArrayList<>();
+    String result = "";
+    for (PathFragment dir = path.getParentDirectory();
+        dir != null && !dir.isEmpty();
+        dir = dir.getParentDirectory()) {
+      String cached = cache.get(dir);
+      if (cached != null) {
+        result = cached;
+        break;
+      }
+      visited.add(dir);
+      if (workspaceRoot.getRelative(dir).getRelative("BUILD").exists()) {
+        result = dir.getPathString();
+        break;
+      }
+    }
+    for (PathFragment dir : visited) {
+      cache.put(dir, result);
+    }
+    return result;
+  }
+
+  /** packageError describes the error 'message' that package 'pkgName' failed to evaluate with. */
+  static PackageError packageError(String pkgName, String message) {
+    PackageError.Builder error = PackageError.newBuilder().setPackageName(pkgName);
+    Matcher m = BUILD_FILE_LOCATION.matcher(message);
+    if (m.find()) {
+      error.setLine(Integer.parseInt(m.group(1)));
+      message = message.substring(m.end());
+    }
+    return error.setMessage(message).build();
+  }
 }
@@ -32,6 +32,7 @@ import com.google.devtools.build.lib.packages.Attribute.ComputedDefault;
 import com.google.devtools.build.lib.packages.BuildType.Selector;
 import com.google.devtools.build.lib.packages.BuildType.SelectorList;
 import com.google.devtools.build.lib.packages.InputFile;
+import com.google.devtools.build.lib.packages.License;
 import com.google.devtools.build.lib.packages.OutputFile;
 import com.google.devtools.build.lib.packages.Package;
 import com.google.devtools.build.lib.packages.PackageGroup;
@@ -43,6 +44,7 @@ import com.google.protos.java.com.google.devtools.javatools.jade.pkgloader.messa
 import com.google.protos.java.com.google.devtools.javatools.jade.pkgloader.messages.Messages.Attribute;
 import java.util.Collection;
 import java.util.List;
+import java.util.Locale;
 import java.util.Set;
 import java.util.logging.Level;
 import java.util.logging.Logger;
@@ -51,11 +53,15 @@ import java.util.logging.Logger;
 public class Serializer {
   private static final Logger logger = Logger.getLogger(Serializer.class.getName());
 
+  // Keep in sync with the constraint attributes that filter.InvalidDependencyReason reads in filter/filter.go.
   private static boolean shouldSerializeImplicitAttribute(String name) {
     switch (name) {
       case "testonly":
       case "visibility":
       case "deprecation":
+      case "compatible_with":
+      case "restricted_to":
+      case "target_compatible_with":
         return true;
       default:
         return false;
@@ -71,6 +77,17 @@ public class Serializer {
       result.addDefaultVisibility(label.toString());
     }
 
+    result.setDefaultTestonly(pkg.getDefaultTestOnly());
+    if (pkg.getDefaultDeprecation() != null) {
+      result.setDefaultDeprecation(pkg.getDefaultDeprecation());
+    }
+    result.addAllFeatures(pkg.getFeatures());
+    if (!pkg.getDefaultLicense().equals(License.NO_LICENSE)) {
+      for (License.LicenseType type : pkg.getDefaultLicense().getLicenseTypes()) {
+        result.addDefaultLicenses(type.name().toLowerCase(Locale.ROOT));
+      }
+    }
+
     pkg.getTargets()
         .forEach(
             (name, target) -> {
@@ -0,0 +1,54 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package com.google.devtools.javatools.jade.pkgloader;
+
+import static com.google.common.truth.Truth.assertThat;
+
+import com.google.common.collect.ImmutableSet;
+import java.nio.file.Files;
+import java.nio.file.Path;
+import java.util.ArrayList;
+import java.util.List;
+import org.junit.Test;
+import org.junit.runner.RunWith;
+import org.junit.runners.JUnit4;
+
+@RunWith(JUnit4.class)
+public class BuildFileWatcherTest {
+
+  @Test
+  public void packageName() throws Exception {
+    Path root = Files.createTempDirectory("workspace");
+    assertThat(BuildFileWatcher.packageName(root, root.resolve("java/com/Foo")))
+        .isEqualTo("java/com/Foo");
+    assertThat(BuildFileWatcher.packageName(root, root)).isEmpty();
+  }
+
+  @Test
+  public void hintsAreForwardedToListeners() throws Exception {
+    Path root = Files.createTempDirectory("workspace");
+    BuildFileWatcher watcher = BuildFileWatcher.start(root);
+    List<ImmutableSet<String>> got = new ArrayList<>();
+    BuildFileWatcher.Listener listener = got::add;
+    watcher.addListener(listener);
+
+    watcher.notifyListeners(ImmutableSet.of("java/com/Foo"));
+    watcher.notifyListeners(ImmutableSet.of());
+    watcher.removeListener(listener);
+    watcher.notifyListeners(ImmutableSet.of("java/com/Bar"));
+
+    assertThat(got).containsExactly(ImmutableSet.of("java/com/Foo"));
+  }
+}
@@ -24,6 +24,9 @@ import com.google.devtools.build.lib.vfs.Path;
 import com.google.devtools.build.lib.vfs.inmemoryfs.InMemoryFileSystem;
 import com.google.protos.java.com.google.devtools.javatools.jade.pkgloader.services.Services.LoaderRequest;
 import com.google.protos.java.com.google.devtools.javatools.jade.pkgloader.services.Services.LoaderResponse;
+import com.google.protos.java.com.google.devtools.javatools.jade.pkgloader.services.Services.PackageError;
+import com.google.protos.java.com.google.devtools.javatools.jade.pkgloader.services.Services.ResolveRequest;
+import com.google.protos.java.com.google.devtools.javatools.jade.pkgloader.services.Services.ResolveResponse;
 import java.io.IOException;
 import org.junit.Before;
 import org.junit.Test;
@@ -66,4 +69,68 @@ public class LibTest {
     assertThat(response.getPkgsMap()).hasSize(1);
     assertThat(response.getPkgsMap()).containsKey("foo/bar");
   }
+
+  @Test
+  public void packageErrors() throws Exception {
+    workspaceRoot.getRelative("foo/broken").createDirectoryAndParents();
+    FileSystemUtils.writeLinesAs(
+        workspaceRoot.getRelative("foo/broken/BUILD"), UTF_8, "sh_library(name = 'Foo')", "(");
+
+    LoaderRequest request =
+        LoaderRequest.newBuilder()
+            .setWorkspaceDir(workspaceRoot.getPathString())
+            .setInstallBase(installBase.getPathString())
+            .setOutputBase(outputBase.getPathString())
+            .addPackages("foo/broken")
+            .addPackages("foo/nonexistent")
+            .build();
+    LoaderResponse response = Lib.load(PACKAGE_LOADER_FACTORY, FILESYSTEM, request);
+
+    assertThat(response.getPkgsMap()).isEmpty();
+    assertThat(response.getErrorsList()).hasSize(1);
+    assertThat(response.getErrors(0).getPackageName()).isEqualTo("foo/broken");
+  }
+
+  @Test
+  public void resolve() throws Exception {
+    workspaceRoot.getRelative("foo/bar/baz").createDirectoryAndParents();
+    workspaceRoot.getRelative("slow").createDirectoryAndParents();
+    workspaceRoot.getRelative("nopkg").createDirectoryAndParents();
+    FileSystemUtils.writeLinesAs(
+        workspaceRoot.getRelative("foo/bar/BUILD"), UTF_8, "sh_library(name = 'Foo')");
+    FileSystemUtils.writeLinesAs(
+        workspaceRoot.getRelative("slow/BUILD"), UTF_8, "sh_library(name = 'Slow')");
+
+    ResolveRequest request =
+        ResolveRequest.newBuilder()
+            .setWorkspaceDir(workspaceRoot.getPathString())
+            .setInstallBase(installBase.getPathString())
+            .setOutputBase(outputBase.getPathString())
+            .addFiles("foo/bar/Bar.java")
+            .addFiles("foo/bar/baz/Baz.java")
+            .addFiles("slow/Slow.java")
+            .addFiles("nopkg/NoPkg.java")
+            .addExcludedPackages("slow")
+            .build();
+    ResolveResponse response = Lib.resolve(PACKAGE_LOADER_FACTORY, FILESYSTEM, request);
+
+    assertThat(response.getFileToPackageMap())
+        .containsExactly(
+            "foo/bar/Bar.java", "foo/bar",
+            "foo/bar/baz/Baz.java", "foo/bar",
+            "slow/Slow.java", "slow");
+    assertThat(response.getPkgsMap().keySet()).containsExactly("foo/bar");
+  }
+
+  @Test
+  public void packageErrorLocation() {
+    PackageError error =
+        Lib.packageError("foo", "/workspace/foo/BUILD:12:3: syntax error at ')'");
+    assertThat(error.getLine()).isEqualTo(12);
+    assertThat(error.getMessage()).isEqualTo("syntax error at ')'");
+
+    error = Lib.packageError("foo", "error loading package 'foo'");
+    assertThat(error.hasLine()).isFalse();
+    assertThat(error.getMessage()).isEqualTo("error loading package 'foo'");
+  }
 }
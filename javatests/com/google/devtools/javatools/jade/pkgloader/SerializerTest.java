@@ -212,6 +212,29 @@ public class SerializerTest {
     assertThat(pkg.getRulesMap().get("Foo").getAttributesMap().get("testonly").getB()).isTrue();
   }
 
+  /** Package-level defaults are also serialized on their own, for rules Jadep creates. */
+  @Test
+  public void packageDefaults() throws Exception {
+    workspaceRoot.getRelative("x").createDirectory();
+    FileSystemUtils.writeLinesAs(
+        workspaceRoot.getRelative("x/BUILD"),
+        UTF_8,
+        "package(default_testonly = 1, default_deprecation = 'gone', features = ['-f'])");
+    Messages.Pkg pkg = loadAndSerialize("x");
+    assertThat(pkg.getDefaultTestonly()).isTrue();
+    assertThat(pkg.getDefaultDeprecation()).isEqualTo("gone");
+    assertThat(pkg.getFeaturesList()).containsExactly("-f");
+  }
+
+  @Test
+  public void packageLicenses() throws Exception {
+    workspaceRoot.getRelative("x").createDirectory();
+    FileSystemUtils.writeLinesAs(
+        workspaceRoot.getRelative("x/BUILD"), UTF_8, "licenses(['notice'])");
+    Messages.Pkg pkg = loadAndSerialize("x");
+    assertThat(pkg.getDefaultLicensesList()).containsExactly("notice");
+  }
+
   /** Google-specific: everything under javatests/ is considered testonly=1. */
   @Test
   public void testonlyTrueInJavatests() throws Exception {
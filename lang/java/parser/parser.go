@@ -17,15 +17,22 @@ package parser
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"path"
+	"regexp"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 	"unicode"
 
 	"github.com/bazelbuild/tools_jvm_autodeps/thirdparty/golang/parsers/ast"
 	"github.com/bazelbuild/tools_jvm_autodeps/thirdparty/golang/parsers/node"
+	"github.com/bazelbuild/tools_jvm_autodeps/thirdparty/golang/parsers/parsers"
 	"context"
 	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
 	"github.com/bazelbuild/tools_jvm_autodeps/lang/java/parser/xrefs"
@@ -36,54 +43,336 @@ import (
 	_ "github.com/bazelbuild/tools_jvm_autodeps/thirdparty/golang/parsers/java"
 )
 
-// ReferencedClasses returns the set of class names that the provided Java source files reference.
-// This includes (a) imports (b) simple names we think are class names, which are assumed to be in the same package (c) fully-qualified names.
-// implicitImports is a sorted slice of classes that do not require an import. In Java, these are the classes in java.lang, such as "System" and "Integer".
-func ReferencedClasses(ctx context.Context, javaFileNames []string, implicitImports []string) []jadeplib.ClassName {
+// Concurrency is the maximum number of files that the functions in this package read and parse at once.
+var Concurrency = runtime.NumCPU()
+
+// FileTimeout bounds the time spent reading and parsing a single file. Zero means no bound.
+// A file that times out is reported as a FileError, and its parsing is cancelled. Parsing that doesn't stop on cancellation goes on
+// in the background, and keeps counting towards Concurrency until it's done.
+var FileTimeout time.Duration
+
+// ClassNamesFilter, when not nil, post-processes the class names that ReferencedClasses and JavadocReferencedClasses
+// extract from each file, before the files' class names are merged. It may drop, rewrite or add class names,
+// e.g. to map shaded packages (com.company.shaded.guava.*) back to the ones they were shaded from (com.google.common.*).
+var ClassNamesFilter func(fileName string, classNames []jadeplib.ClassName) []jadeplib.ClassName
+
+// FileError describes why a file couldn't be read or parsed.
+type FileError struct {
+	FileName string
+
+	// Line and Offset locate the syntax error in the file, if Err is a syntax error. Otherwise, they're 0.
+	// Offset is in bytes from the beginning of the file.
+	Line   int
+	Offset int
+
+	// Partial is true if the file was processed despite the error, e.g. the parser recovered from a syntax error.
+	Partial bool
+
+	Err error
+}
+
+// newFileError returns a FileError for fileName, locating err in the file if it's a syntax error.
+func newFileError(fileName string, err error) *FileError {
+	ret := &FileError{FileName: fileName, Err: err}
+	if se, ok := err.(parsers.SyntaxError); ok {
+		ret.Line, ret.Offset = se.Line, se.Offset
+	}
+	return ret
+}
+
+// Description describes the error without its location.
+func (e *FileError) Description() string {
+	if se, ok := e.Err.(parsers.SyntaxError); ok {
+		return se.Description
+	}
+	return e.Err.Error()
+}
+
+func (e *FileError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", e.FileName, e.Line, e.Description())
+	}
+	return fmt.Sprintf("%s: %v", e.FileName, e.Err)
+}
+
+// forEachFile calls f on the content of each of fileNames, on at most Concurrency files at once.
+// Returns f's results, keyed by file name, and the files that couldn't be read, or for which f failed or timed out.
+// f can return both a non-nil result and an error for a file it could only partially process.
+// The context passed to f is cancelled when its file times out.
+func forEachFile(ctx context.Context, fileNames []string, f func(ctx context.Context, fileName, source string) (interface{}, error)) (map[string]interface{}, []*FileError) {
+	concurrency := Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
 	var mu sync.Mutex
 	var wg sync.WaitGroup
-	var result []jadeplib.ClassName
-	classNameSeen := make(map[string]bool)
-	for _, fileName := range javaFileNames {
+	results := make(map[string]interface{})
+	var errs []*FileError
+	for _, fileName := range fileNames {
 		fileName := fileName
+		sem <- struct{}{}
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			source, err := ioutil.ReadFile(fileName)
-			if err != nil {
-				log.Printf("Error reading %q:\n%v", fileName, err)
-				return
-			}
-
-			classes, err := referencedClasses(ctx, fileName, string(source), implicitImports)
+			res, err := processFile(ctx, fileName, f, func() { <-sem })
+			mu.Lock()
+			defer mu.Unlock()
 			if err != nil {
-				log.Printf("Error parsing %q:\n%v", fileName, err)
-				return
+				fe := newFileError(fileName, err)
+				fe.Partial = res != nil
+				errs = append(errs, fe)
 			}
-
-			mu.Lock()
-			for _, c := range classes {
-				if !classNameSeen[c] {
-					classNameSeen[c] = true
-					result = append(result, jadeplib.ClassName(c))
-				}
+			if res != nil {
+				results[fileName] = res
 			}
-			mu.Unlock()
 		}()
 	}
 	wg.Wait()
+	sort.Slice(errs, func(i, j int) bool { return errs[i].FileName < errs[j].FileName })
+	return results, errs
+}
 
+// processFile reads fileName and calls f on its content, giving up after FileTimeout.
+// release is called once f returns, even if processFile gave up on it before, so a file keeps its slot of Concurrency until it's done.
+func processFile(ctx context.Context, fileName string, f func(ctx context.Context, fileName, source string) (interface{}, error), release func()) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		release()
+		return nil, err
+	}
+	fileCtx := ctx
+	if FileTimeout > 0 {
+		var cancel context.CancelFunc
+		fileCtx, cancel = context.WithTimeout(ctx, FileTimeout)
+		defer cancel()
+	}
+	type result struct {
+		res interface{}
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer release()
+		source, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			done <- result{nil, err}
+			return
+		}
+		res, err := f(fileCtx, fileName, string(source))
+		done <- result{res, err}
+	}()
+	select {
+	case r := <-done:
+		return r.res, r.err
+	case <-fileCtx.Done():
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("timed out after %v", FileTimeout)
+	}
+}
+
+// mergeClassNames returns the class names in results (which map file names to []string), without duplicates.
+// Class names are ordered by the first file in fileNames that references them.
+func mergeClassNames(fileNames []string, results map[string]interface{}) []jadeplib.ClassName {
+	var ret []jadeplib.ClassName
+	seen := make(map[string]bool)
+	for _, fileName := range fileNames {
+		classes, _ := results[fileName].([]string)
+		for _, c := range classes {
+			if !seen[c] {
+				seen[c] = true
+				ret = append(ret, jadeplib.ClassName(c))
+			}
+		}
+	}
+	return ret
+}
+
+// filterClassNames applies ClassNamesFilter, if it's set, to the class names extracted from fileName.
+func filterClassNames(fileName string, classes []string) []string {
+	if ClassNamesFilter == nil {
+		return classes
+	}
+	in := make([]jadeplib.ClassName, len(classes))
+	for i, c := range classes {
+		in[i] = jadeplib.ClassName(c)
+	}
+	out := ClassNamesFilter(fileName, in)
+	ret := make([]string, len(out))
+	for i, c := range out {
+		ret[i] = string(c)
+	}
+	return ret
+}
+
+// logFileErrors logs errs.
+func logFileErrors(errs []*FileError) {
+	for _, err := range errs {
+		log.Printf("Error reading or parsing %v", err)
+	}
+}
+
+// ReferencedClasses returns the set of class names that the provided Java source files reference.
+// This includes (a) imports (b) simple names we think are class names, which are assumed to be in the same package (c) fully-qualified names.
+// implicitImports is a sorted slice of classes that do not require an import. In Java, these are the classes in java.lang, such as "System" and "Integer".
+// Files with syntax errors contribute the class names that could be parsed, and, like files that can't be read, are returned as FileErrors.
+func ReferencedClasses(ctx context.Context, javaFileNames []string, implicitImports []string) ([]jadeplib.ClassName, []*FileError) {
+	results, errs := forEachFile(ctx, javaFileNames, func(ctx context.Context, fileName, source string) (interface{}, error) {
+		classes, err := referencedClasses(ctx, fileName, source, implicitImports)
+		if err != nil && len(classes) == 0 {
+			return nil, err
+		}
+		return filterClassNames(fileName, classes), err
+	})
+	return mergeClassNames(javaFileNames, results), errs
+}
+
+// JavaPackages returns the Java package that each of the provided Java source files declares, e.g. "com.google.common.collect".
+// Files that don't declare a package map to "".
+// Files that can't be read or parsed are logged and omitted from the result.
+// Like the other functions of this package, it reads and parses at most Concurrency files at once.
+func JavaPackages(ctx context.Context, javaFileNames []string) map[string]string {
+	results, errs := forEachFile(ctx, javaFileNames, func(ctx context.Context, fileName, source string) (interface{}, error) {
+		tree, err := ast.Build(ctx, lpb.Language_JAVA, fileName, source, ast.Options{})
+		if err != nil {
+			return nil, err
+		}
+		return packageName(tree), nil
+	})
+	logFileErrors(errs)
+	result := make(map[string]string)
+	for fileName, pkg := range results {
+		result[fileName] = pkg.(string)
+	}
 	return result
 }
 
-// referencedClasses returns the set of class names that a Java source code references.
+// JavadocReferencedClasses returns the set of class names that the Javadoc of the provided Java source files references,
+// through {@link}, {@linkplain} and @see tags.
+// Classes referenced through imports are returned as well, although ReferencedClasses also returns them.
+// implicitImports is as in ReferencedClasses.
+func JavadocReferencedClasses(ctx context.Context, javaFileNames []string, implicitImports []string) []jadeplib.ClassName {
+	results, errs := forEachFile(ctx, javaFileNames, func(ctx context.Context, fileName, source string) (interface{}, error) {
+		classes, err := javadocReferencedClasses(ctx, fileName, source, implicitImports)
+		if err != nil {
+			return nil, err
+		}
+		return filterClassNames(fileName, classes), nil
+	})
+	logFileErrors(errs)
+	return mergeClassNames(javaFileNames, results)
+}
+
+// javadocTagRegexp matches the class part of references in Javadoc tags.
+// For example, it captures "com.Foo" in "{@link com.Foo#bar()}", and "Foo" in "@see Foo".
+var javadocTagRegexp = regexp.MustCompile(`(?:\{@link(?:plain)?|@see)\s+([\w.]+)`)
+
+// javadocReferencedClasses returns the set of class names that the Javadoc in a Java source code references.
+// Simple names are resolved using the file's imports, and otherwise assumed to be in the file's package.
 // An error is returned if the source can't be parsed.
-// The path parameter is only used for tagging, not for reading a file.
-func referencedClasses(ctx context.Context, path, source string, builtInClasses []string) ([]string, error) {
+func javadocReferencedClasses(ctx context.Context, path, source string, builtInClasses []string) ([]string, error) {
 	tree, err := ast.Build(ctx, lpb.Language_JAVA, path, source, ast.Options{})
 	if err != nil {
 		return nil, err
 	}
+	pkg := packageName(tree)
+	var declared map[string]bool
+	if rootST := xrefs.NewResolver(tree).SymbolTables[tree.Root()]; rootST != nil {
+		declared = make(map[string]bool)
+		for className := range rootST.Types {
+			declared[className] = true
+		}
+	}
+	imports := importedClassNames(tree)
+
+	seen := make(map[string]bool)
+	var result []string
+	tree.ForEach(node.OneOf(node.JavaTraditionalComment), func(n ast.Node) {
+		text := n.Text()
+		if !strings.HasPrefix(text, "/**") {
+			return
+		}
+		for _, m := range javadocTagRegexp.FindAllStringSubmatch(text, -1) {
+			className, idx := ExtractClassNameFromQualifiedName(strings.Split(strings.TrimSuffix(m[1], "."), "."))
+			if idx < 0 {
+				continue
+			}
+			if idx == 0 {
+				if c, ok := imports[className]; ok {
+					className = c
+				} else if declared[className] || isBuiltin(builtInClasses, className) {
+					continue
+				} else if pkg != "" {
+					className = pkg + "." + className
+				}
+			}
+			if !seen[className] {
+				seen[className] = true
+				result = append(result, className)
+			}
+		}
+	})
+	return result, nil
+}
+
+// importedClassNames maps the simple names of the classes that a parsed Java source code imports by single-type imports
+// to their fully-qualified names.
+func importedClassNames(tree *ast.Tree) map[string]string {
+	imports := make(map[string]string)
+	tree.ForEach(node.OneOf(node.JavaImport), func(n ast.Node) {
+		name := n.Child(node.OneOf(node.JavaName, node.JavaNameStar))
+		if name.Type() == node.JavaNameStar || n.FirstChildOfType(node.JavaStatic).IsValid() {
+			return
+		}
+		ids := idsToStrs(name.ChildrenOfType(node.JavaIdentifier))
+		if className, idx := ExtractClassNameFromQualifiedName(ids); idx >= 0 {
+			imports[ids[idx]] = className
+		}
+	})
+	return imports
+}
+
+// referencedClasses returns the set of class names that a Java source code references.
+// The parser recovers from syntax errors where it can, so a source with syntax errors still contributes the class names
+// in the parts that could be parsed. If it can't be parsed at all, the class names of its import statements are returned.
+// In both cases, the first syntax error is returned as well.
+// The path parameter is only used for tagging, not for reading a file.
+func referencedClasses(ctx context.Context, path, source string, builtInClasses []string) ([]string, error) {
+	var firstErr error
+	tree, err := ast.Build(ctx, lpb.Language_JAVA, path, source, ast.Options{
+		ShouldTryToRecover: func(se parsers.SyntaxError) bool {
+			if firstErr == nil {
+				firstErr = se
+			}
+			return true
+		},
+	})
+	if err != nil {
+		return importedClasses(source), err
+	}
+	return referencedClassesInTree(tree, builtInClasses), firstErr
+}
+
+// importRegexp matches non-wildcard import statements, capturing the imported name.
+var importRegexp = regexp.MustCompile(`(?m)^\s*import\s+(?:static\s+)?([\w.]+)\s*;`)
+
+// importedClasses returns the class names that a Java source code imports, without parsing it.
+// It's used for sources that can't be parsed.
+func importedClasses(source string) []string {
+	var ret []string
+	seen := make(map[string]bool)
+	for _, m := range importRegexp.FindAllStringSubmatch(source, -1) {
+		if className, idx := ExtractClassNameFromQualifiedName(strings.Split(m[1], ".")); idx >= 0 && !seen[className] {
+			seen[className] = true
+			ret = append(ret, className)
+		}
+	}
+	return ret
+}
+
+// referencedClassesInTree returns the set of class names that a parsed Java source code references.
+func referencedClassesInTree(tree *ast.Tree, builtInClasses []string) []string {
 	pkg := packageName(tree)
 	resolver := xrefs.NewResolver(tree)
 	bindings := resolver.Resolve()
@@ -111,12 +400,22 @@ func referencedClasses(ctx context.Context, path, source string, builtInClasses
 				// Symbol is defined somewhere in this class, no need to report it.
 				break
 			}
-			className, idx := ExtractClassNameFromQualifiedName(idsToStrs(ids))
+			if n.Type() == node.JavaExprName && len(ids) == 1 {
+				// A simple expression name is a variable, e.g. a statically imported constant in @Retention(RUNTIME).
+				break
+			}
+			parts := idsToStrs(ids)
+			className, idx := ExtractClassNameFromQualifiedName(parts)
+			if idx < 0 && n.Type() == node.JavaTypeName {
+				parts = append(parts, annotatedTypeNameParts(n)...)
+				className, idx = ExtractClassNameFromQualifiedName(parts)
+			}
 			if idx < 0 {
-				if n.Type() != node.JavaTypeName {
+				// Like type names, the qualifiers of constructor references (org.g_Foo::new) must be classes.
+				if n.Type() != node.JavaTypeName && !xrefs.IsConstructorReference(n.Parent()) {
 					break
 				}
-				className = joinIDs(ids)
+				className = strings.Join(parts, ".")
 			}
 			if idx == 0 {
 				if isBuiltin(builtInClasses, className) {
@@ -151,9 +450,282 @@ func referencedClasses(ctx context.Context, path, source string, builtInClasses
 	}
 
 	tree.ForEach(node.Any, visit)
+	return result
+}
+
+// annotatedTypeNameParts returns the identifiers that continue the type name n past type-use annotations.
+// For example, in com.google.@Nullable Foo.@Nullable Bar, n is com.google, and the returned identifiers are Foo and Bar.
+func annotatedTypeNameParts(n ast.Node) []string {
+	var ret []string
+	for c := n.Parent(); c.Type() == node.JavaClassType && c.Parent().Type() == node.JavaClassType; c = c.Parent() {
+		s := c.NextSibling()
+		for s.Type() == node.JavaAnnotation {
+			s = s.NextSibling()
+		}
+		if s.Type() != node.JavaIdentifier {
+			break
+		}
+		ret = append(ret, s.Text())
+	}
+	return ret
+}
+
+// ConstantOnlyClasses returns the classes that the provided Java source files reference, but only to read constants,
+// e.g. Foo.BAR or "import static com.Foo.BAR".
+// javac inlines compile-time constants, so such classes are not needed at runtime.
+// A field is assumed to be a constant when its name is in UPPER_SNAKE_CASE, since the types of fields declared in other
+// files are unknown.
+// implicitImports is as in ReferencedClasses.
+func ConstantOnlyClasses(ctx context.Context, javaFileNames []string, implicitImports []string) []jadeplib.ClassName {
+	results, errs := forEachFile(ctx, javaFileNames, func(ctx context.Context, fileName, source string) (interface{}, error) {
+		return constantOnlyClasses(ctx, fileName, source, implicitImports)
+	})
+	logFileErrors(errs)
+	constantOnly := make(map[string]bool)
+	for _, classes := range results {
+		// A class is constant-only if it's constant-only in every file that references it.
+		for c, only := range classes.(map[string]bool) {
+			if prev, ok := constantOnly[c]; ok {
+				constantOnly[c] = prev && only
+			} else {
+				constantOnly[c] = only
+			}
+		}
+	}
+
+	var result []jadeplib.ClassName
+	for c, only := range constantOnly {
+		if only {
+			result = append(result, jadeplib.ClassName(c))
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
+
+// constantOnlyClasses returns, for each class name that a Java source code references, whether all its uses read constants.
+// Uses are matched to class names by their simple names, which works for both imported and fully-qualified names.
+// Plain imports aren't uses.
+func constantOnlyClasses(ctx context.Context, path, source string, builtInClasses []string) (map[string]bool, error) {
+	tree, err := ast.Build(ctx, lpb.Language_JAVA, path, source, ast.Options{})
+	if err != nil {
+		return nil, err
+	}
+	constantUses := make(map[string]bool)
+	otherUses := make(map[string]bool)
+	record := func(ids []string, isType bool) {
+		_, idx := ExtractClassNameFromQualifiedName(ids)
+		if idx < 0 {
+			return
+		}
+		if !isType && idx+1 < len(ids) && looksLikeConstantName(ids[idx+1]) {
+			constantUses[ids[idx]] = true
+		} else {
+			otherUses[ids[idx]] = true
+		}
+	}
+	tree.ForEach(node.Any, func(n ast.Node) {
+		switch n.Type() {
+		case node.JavaTypeName, node.JavaTypeOrExprName, node.JavaExprName:
+			record(idsToStrs(n.ChildrenOfType(node.JavaIdentifier)), n.Type() == node.JavaTypeName)
+		case node.JavaImport:
+			if !n.FirstChildOfType(node.JavaStatic).IsValid() {
+				return
+			}
+			name := n.Child(node.OneOf(node.JavaName, node.JavaNameStar))
+			// Static on-demand imports might bring in methods, so they're not constant uses.
+			record(idsToStrs(name.ChildrenOfType(node.JavaIdentifier)), name.Type() == node.JavaNameStar)
+		}
+	})
+
+	result := make(map[string]bool)
+	for _, c := range referencedClassesInTree(tree, builtInClasses) {
+		simpleName := c[strings.LastIndex(c, ".")+1:]
+		result[c] = constantUses[simpleName] && !otherUses[simpleName]
+	}
 	return result, nil
 }
 
+// looksLikeConstantName returns true if 's' has the form ^[A-Z][A-Z0-9_]*$, e.g. MAX_VALUE.
+func looksLikeConstantName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		if unicode.IsUpper(r) || (i > 0 && (unicode.IsDigit(r) || r == '_')) {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// ReferencedResources returns the class path resources that each of the provided Java source files loads by name,
+// e.g. "com/google/foo/data.txt" for Foo.class.getResource("data.txt") in package com.google.foo.
+// Recognized calls are Class.getResource[AsStream], ClassLoader.getResource[s|AsStream], ClassLoader.getSystemResource[s|AsStream],
+// Guava's Resources.getResource and ResourceBundle.getBundle, whose base name is looked up as a .properties file.
+// Only names given as string literals are returned, since others are unknown until runtime.
+// Files that can't be read or parsed are logged and omitted from the result, as are files that load no resources.
+func ReferencedResources(ctx context.Context, javaFileNames []string) map[string][]string {
+	results, errs := forEachFile(ctx, javaFileNames, func(ctx context.Context, fileName, source string) (interface{}, error) {
+		return referencedResources(ctx, fileName, source)
+	})
+	logFileErrors(errs)
+	result := make(map[string][]string)
+	for fileName, res := range results {
+		if res := res.([]string); len(res) > 0 {
+			result[fileName] = res
+		}
+	}
+	return result
+}
+
+// referencedResources returns the sorted class path resources that a Java source code loads by name. See ReferencedResources.
+func referencedResources(ctx context.Context, path, source string) ([]string, error) {
+	tree, err := ast.Build(ctx, lpb.Language_JAVA, path, source, ast.Options{})
+	if err != nil {
+		return nil, err
+	}
+	pkg := packageName(tree)
+	imports := importedClassNames(tree)
+	seen := make(map[string]bool)
+	var result []string
+	tree.ForEach(node.OneOf(node.JavaMethodInvocation), func(n ast.Node) {
+		if res := loadedResource(n, pkg, imports); res != "" && !seen[res] {
+			seen[res] = true
+			result = append(result, res)
+		}
+	})
+	sort.Strings(result)
+	return result, nil
+}
+
+// notComment selects all nodes except comments.
+func notComment(t node.Type) bool {
+	return t.Category() != node.Comment
+}
+
+// loadedResource returns the class path resource that the method invocation n loads, or "" if it doesn't load one,
+// or if the resource can't be determined statically.
+// pkg is the Java package of the file, and imports is as returned by importedClassNames.
+func loadedResource(n ast.Node, pkg string, imports map[string]string) string {
+	var receiver ast.Node
+	if c := n.Child(notComment); c.Type() != node.JavaMethodName {
+		receiver = c
+	}
+	args := n.FirstChildOfType(node.JavaArgs).Children(notComment)
+	if len(args) == 0 {
+		return ""
+	}
+	name, ok := stringLiteral(args[len(args)-1])
+	if !ok {
+		return ""
+	}
+	switch n.FirstChildOfType(node.JavaMethodName).Text() {
+	case "getResource", "getResourceAsStream", "getResources":
+		if lastIdentifier(receiver) == "Resources" {
+			// Guava's Resources.getResource(String) and Resources.getResource(Class, String).
+			switch {
+			case len(args) == 1:
+				return absoluteResource(name)
+			case len(args) == 2 && args[0].Type() == node.JavaClassLiteral:
+				return relativeResource(classLiteralPackage(args[0], pkg, imports), name)
+			}
+			return ""
+		}
+		if len(args) != 1 || !receiver.IsValid() {
+			return ""
+		}
+		switch receiver.Type() {
+		case node.JavaClassLiteral:
+			return relativeResource(classLiteralPackage(receiver, pkg, imports), name)
+		case node.JavaMethodInvocation:
+			switch receiver.FirstChildOfType(node.JavaMethodName).Text() {
+			case "getClass":
+				return relativeResource(pkg, name)
+			case "getClassLoader", "getContextClassLoader", "getSystemClassLoader":
+				return absoluteResource(name)
+			}
+		case node.JavaTypeOrExprName:
+			if strings.Contains(strings.ToLower(lastIdentifier(receiver)), "loader") {
+				return absoluteResource(name)
+			}
+		}
+	case "getSystemResource", "getSystemResourceAsStream", "getSystemResources":
+		if len(args) == 1 {
+			return absoluteResource(name)
+		}
+	case "getBundle":
+		if lastIdentifier(receiver) == "ResourceBundle" {
+			return absoluteResource(strings.Replace(name, ".", "/", -1) + ".properties")
+		}
+	}
+	return ""
+}
+
+// lastIdentifier returns the text of the last identifier of a qualified name node, e.g. "Resources" in com.google.common.io.Resources.
+// Returns "" for other nodes.
+func lastIdentifier(n ast.Node) string {
+	if !n.IsValid() || (n.Type() != node.JavaTypeOrExprName && n.Type() != node.JavaExprName) {
+		return ""
+	}
+	return n.LastChildOfType(node.JavaIdentifier).Text()
+}
+
+// classLiteralPackage returns the Java package of the class in a class literal, e.g. "com.google" for com.google.Foo.class.
+// Simple names are resolved using imports, and otherwise assumed to be in pkg.
+func classLiteralPackage(n ast.Node, pkg string, imports map[string]string) string {
+	parts := idsToStrs(n.FirstChildOfType(node.JavaTypeName).ChildrenOfType(node.JavaIdentifier))
+	className, idx := ExtractClassNameFromQualifiedName(parts)
+	if idx < 0 {
+		return pkg
+	}
+	if idx == 0 {
+		c, ok := imports[className]
+		if !ok {
+			return pkg
+		}
+		className = c
+	}
+	if i := strings.LastIndex(className, "."); i >= 0 {
+		return className[:i]
+	}
+	return ""
+}
+
+// stringLiteral returns the value of n if it's a string literal.
+func stringLiteral(n ast.Node) (string, bool) {
+	text := n.Text()
+	if n.Type() != node.JavaLiteral || !strings.HasPrefix(text, `"`) || strings.HasPrefix(text, `"""`) {
+		return "", false
+	}
+	s, err := strconv.Unquote(text)
+	return s, err == nil
+}
+
+// relativeResource resolves a resource name the way Class.getResource does: names starting with "/" are absolute,
+// and others are relative to the directory of the Java package pkg.
+// Returns "" if the name escapes the class path root.
+func relativeResource(pkg, name string) string {
+	if name == "" {
+		return ""
+	}
+	if strings.HasPrefix(name, "/") || pkg == "" {
+		return absoluteResource(name)
+	}
+	return absoluteResource(strings.Replace(pkg, ".", "/", -1) + "/" + name)
+}
+
+// absoluteResource cleans a resource name that is relative to the class path root.
+// Returns "" if the name is empty or escapes the class path root.
+func absoluteResource(name string) string {
+	name = path.Clean(strings.TrimPrefix(name, "/"))
+	if name == "." || name == ".." || strings.HasPrefix(name, "../") {
+		return ""
+	}
+	return name
+}
+
 // isBuiltin returns true iff 's' is in 'strings'.
 // 'strings' is assumed to be sorted.
 // It is intended to filter out built-in class names, such as String, Object, etc.
@@ -15,10 +15,17 @@
 package parser
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/bazelbuild/tools_jvm_autodeps/thirdparty/golang/parsers/parsers"
 	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 )
@@ -96,6 +103,63 @@ func TestClasses(t *testing.T) {
 					}`,
 			want: []string{"VisibleForTesting", "Module", "Bla"},
 		},
+		{
+			desc: "Class literals in nested annotations and arrays of annotation values",
+			source: `package com.foo;
+					@Component(modules = {ModuleA.class, com.bar.ModuleB.class}, dependencies = @Dep(value = Parent.class))
+					@Retention(RUNTIME)
+					@Repeated({@Tag(type = TagType.class), @Tag(Other.CONSTANT)})
+					class Dummy { }`,
+			want: []string{
+				"com.foo.Component", "com.foo.ModuleA", "com.bar.ModuleB", "com.foo.Dep", "com.foo.Parent", "com.foo.Retention",
+				"com.foo.Repeated", "com.foo.Tag", "com.foo.TagType", "com.foo.Other",
+			},
+		},
+		{
+			desc: "Annotations on type uses",
+			source: `class Dummy {
+						List<@Nullable String> names;
+						com.google.@Nullable Foo.@Nullable Bar foo;
+						void method(@Nonnull Object o) throws @Critical Exception { }
+					}`,
+			want: []string{"List", "Nullable", "String", "com.google.Foo", "Nonnull", "Critical", "Exception"},
+		},
+		{
+			desc: "Multiple annotations on type uses in expressions",
+			source: `class Dummy {
+						Object method(Object o) {
+							java.lang.@Nullable @Interned String s = new @Interned Foo();
+							Map<@Key String, com.bar.@A @B Bar> m = new HashMap<@Key String, com.bar.@A @B Bar>();
+							Baz b = (@NonNull Baz) o;
+							boolean tainted = o instanceof @Tainted Qux;
+							return new @Fresh Result @Dim [0];
+						}
+					}`,
+			want: []string{
+				"Object", "java.lang.String", "Nullable", "Interned", "Foo", "Map", "Key", "String", "com.bar.Bar", "A", "B",
+				"HashMap", "Baz", "NonNull", "Tainted", "Qux", "Fresh", "Result", "Dim",
+			},
+		},
+		{
+			desc: "Annotations on packages",
+			source: `@ParametersAreNonnullByDefault
+					@Generated(by = Generator.class)
+					package com.foo;
+					import javax.annotation.ParametersAreNonnullByDefault;`,
+			want: []string{"javax.annotation.ParametersAreNonnullByDefault", "com.foo.Generated", "com.foo.Generator"},
+		},
+		{
+			desc: "Annotations and services in modules",
+			source: `import com.foo.spi.Service;
+					@Deprecated(since = Versions.class)
+					module com.foo {
+						requires com.bar;
+						exports com.foo.api;
+						uses Service;
+						provides Service with com.foo.impl.ServiceImpl;
+					}`,
+			want: []string{"com.foo.spi.Service", "Deprecated", "Versions", "com.foo.impl.ServiceImpl"},
+		},
 		{
 			desc: "Ignore inner classes and self",
 			source: `package com.company;
@@ -223,6 +287,43 @@ func TestClasses(t *testing.T) {
 					}`,
 			want: []string{"Function"},
 		},
+		{
+			desc: "Method and constructor references, including qualified forms and array constructor references",
+			source: `package com.foo;
+					class A {
+						class Local {}
+						void m() {
+							Function a = Foo::bar;
+							Supplier b = com.bar.Baz::new;
+							IntFunction c = Qux[]::new;
+							IntFunction d = com.bar.Quux[]::new;
+							Function e = ImmutableList::<String>of;
+							Function f = com.bar.Generic<String>::size;
+							Supplier g = Local::new;
+							IntFunction h = Local[]::new;
+							IntFunction i = int[]::new;
+							Runnable j = this::m;
+							Runnable k = variable::m;
+							Function l = Object::toString;
+						}
+					}`,
+			want: []string{
+				"com.foo.Function", "com.foo.Supplier", "com.foo.IntFunction", "com.foo.Runnable",
+				"com.foo.Foo", "com.bar.Baz", "com.foo.Qux", "com.bar.Quux", "com.foo.ImmutableList", "com.bar.Generic",
+			},
+		},
+		{
+			desc: "The qualifier of a constructor reference must be a class, so it's returned even if it doesn't look like one (org.g_Foo). " +
+				"The qualifier of a method reference might be an expression, so it's ignored (org.g_Bar).",
+			source: `package org;
+					class A {
+						void f() {
+							Supplier a = org.g_Foo::new;
+							Runnable b = org.g_Bar::run;
+						}
+					}`,
+			want: []string{"org.Supplier", "org.Runnable", "org.g_Foo"},
+		},
 		{
 			desc: "When an expression must be a class because of the grammar (org.g_Foo), but it doesn't look like a class name to us, we return it as is. If we can't tell from the grammar, we ignore it (org.g_Bar).",
 			source: `package org;
@@ -293,6 +394,145 @@ func TestClasses(t *testing.T) {
 	}
 }
 
+func TestJavadocReferencedClasses(t *testing.T) {
+	src := `package com.google;
+
+import java.util.List;
+import static com.google.common.truth.Truth.assertThat;
+
+/**
+ * Uses {@link List} and {@linkplain com.google.common.collect.ImmutableList#of() lists}.
+ *
+ * @see Helper#help(String)
+ * @see Inner
+ * @see Object
+ * @see #foo()
+ */
+class A {
+	class Inner {}
+
+	/* {@link NotJavadoc} */
+	// {@link NotJavadocEither}
+	void foo() {}
+}
+`
+	want := []string{"java.util.List", "com.google.common.collect.ImmutableList", "com.google.Helper"}
+	got, err := javadocReferencedClasses(context.Background(), testPath, src, []string{"Object", "String"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(got, want, cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+		t.Errorf("Result from javadocReferencedClasses() differs: (-got +want)\n%s", diff)
+	}
+}
+
+func TestConstantOnlyClasses(t *testing.T) {
+	src := `package com.google;
+
+import com.google.common.Constants;
+import com.google.common.Mixed;
+import static com.google.common.Static.MAX;
+import static com.google.common.Methods.create;
+
+class A {
+	int a = Constants.FOO + MAX;
+	String b = Mixed.BAR;
+	Mixed c = Mixed.create();
+	Object d = create();
+	int e = com.google.other.Qualified.LIMIT_2;
+}
+`
+	want := map[string]bool{
+		"com.google.common.Constants": true,
+		"com.google.common.Mixed":     false,
+		"com.google.common.Static":    true,
+		"com.google.common.Methods":   false,
+		"com.google.other.Qualified":  true,
+	}
+	got, err := constantOnlyClasses(context.Background(), testPath, src, []string{"Object", "String"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("Result from constantOnlyClasses() differs: (-got +want)\n%s", diff)
+	}
+}
+
+func TestReferencedResources(t *testing.T) {
+	src := `package com.google;
+
+import com.google.common.io.Resources;
+import com.google.other.Other;
+import java.util.ResourceBundle;
+
+class A {
+	void foo(ClassLoader loader, String dynamic) {
+		A.class.getResource("a.txt");
+		getClass().getResourceAsStream("/root.txt");
+		Other.class.getResource("../b.txt");
+		getClass().getClassLoader().getResource("c/d.txt");
+		Thread.currentThread().getContextClassLoader().getResources("e.txt");
+		loader.getResourceAsStream("f.txt");
+		ClassLoader.getSystemResource("g.txt");
+		Resources.getResource("h.txt");
+		Resources.getResource(A.class, "i.txt");
+		ResourceBundle.getBundle("com.google.Messages");
+		A.class.getResource("a.txt");
+		A.class.getResource(dynamic);
+		A.class.getResource("prefix" + dynamic);
+		unknown.getResource("j.txt");
+		getResource("k.txt");
+	}
+}
+`
+	want := []string{
+		"c/d.txt",
+		"com/google/Messages.properties",
+		"com/google/a.txt",
+		"com/google/i.txt",
+		"com/b.txt",
+		"e.txt",
+		"f.txt",
+		"g.txt",
+		"h.txt",
+		"root.txt",
+	}
+	got, err := referencedResources(context.Background(), testPath, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("Result from referencedResources() differs: (-got +want)\n%s", diff)
+	}
+}
+
+func TestRelativeResource(t *testing.T) {
+	tests := []struct {
+		pkg, name, want string
+	}{
+		{"com.google", "a.txt", "com/google/a.txt"},
+		{"com.google", "/a.txt", "a.txt"},
+		{"com.google", "../a.txt", "com/a.txt"},
+		{"com.google", "../../../a.txt", ""},
+		{"", "a.txt", "a.txt"},
+		{"com.google", "", ""},
+	}
+	for _, tt := range tests {
+		if got := relativeResource(tt.pkg, tt.name); got != tt.want {
+			t.Errorf("relativeResource(%q, %q) = %q, want %q", tt.pkg, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLooksLikeConstantName(t *testing.T) {
+	tests := map[string]bool{"MAX_VALUE": true, "X": true, "LIMIT_2": true, "Foo": false, "foo": false, "_X": false, "": false}
+	for in, want := range tests {
+		if got := looksLikeConstantName(in); got != want {
+			t.Errorf("looksLikeConstantName(%q) = %v, want %v", in, got, want)
+		}
+	}
+}
+
 func TestReferencedClassesIgnoresBuiltin(t *testing.T) {
 	src := `class A{
 				void f() {
@@ -314,6 +554,37 @@ func TestReferencedClassesIgnoresBuiltin(t *testing.T) {
 	}
 }
 
+func TestFilterClassNames(t *testing.T) {
+	classes := []string{"com.company.shaded.guava.collect.ImmutableList", "com.Foo", "com.Generated"}
+	if diff := cmp.Diff(filterClassNames("A.java", classes), classes); diff != "" {
+		t.Errorf("filterClassNames without a filter returned diff (-got +want):\n%s", diff)
+	}
+
+	var gotFileName string
+	ClassNamesFilter = func(fileName string, classNames []jadeplib.ClassName) []jadeplib.ClassName {
+		gotFileName = fileName
+		var ret []jadeplib.ClassName
+		for _, c := range classNames {
+			switch {
+			case c == "com.Generated":
+			case strings.HasPrefix(string(c), "com.company.shaded.guava."):
+				ret = append(ret, "com.google.common."+c[len("com.company.shaded.guava."):])
+			default:
+				ret = append(ret, c)
+			}
+		}
+		return append(ret, "com.Added")
+	}
+	defer func() { ClassNamesFilter = nil }()
+	want := []string{"com.google.common.collect.ImmutableList", "com.Foo", "com.Added"}
+	if diff := cmp.Diff(filterClassNames("A.java", classes), want); diff != "" {
+		t.Errorf("filterClassNames returned diff (-got +want):\n%s", diff)
+	}
+	if gotFileName != "A.java" {
+		t.Errorf("ClassNamesFilter was called with file name %q, want %q", gotFileName, "A.java")
+	}
+}
+
 func TestReferencedClassesSyntaxError(t *testing.T) {
 	src := `class A{
 				void f() {
@@ -327,6 +598,143 @@ func TestReferencedClassesSyntaxError(t *testing.T) {
 	}
 }
 
+func TestForEachFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var fileNames []string
+	for _, name := range []string{"a", "slow", "b", "c", "d"} {
+		f := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(f, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		fileNames = append(fileNames, f)
+	}
+	missing := filepath.Join(dir, "missing")
+	fileNames = append(fileNames, missing)
+
+	defer func(concurrency int, timeout time.Duration) {
+		Concurrency, FileTimeout = concurrency, timeout
+	}(Concurrency, FileTimeout)
+	Concurrency, FileTimeout = 2, 100*time.Millisecond
+
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	release := make(chan struct{})
+	defer close(release)
+	results, errs := forEachFile(context.Background(), fileNames, func(ctx context.Context, fileName, source string) (interface{}, error) {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+		if source == "slow" {
+			// Ignores cancellation, so it keeps running after it times out.
+			<-release
+		}
+		return source, nil
+	})
+
+	want := map[string]interface{}{fileNames[0]: "a", fileNames[2]: "b", fileNames[3]: "c", fileNames[4]: "d"}
+	if diff := cmp.Diff(want, results); diff != "" {
+		t.Errorf("forEachFile returned diff in results (-want +got):\n%s", diff)
+	}
+	var gotErrFiles []string
+	for _, e := range errs {
+		gotErrFiles = append(gotErrFiles, e.FileName)
+	}
+	if diff := cmp.Diff([]string{missing, fileNames[1]}, gotErrFiles); diff != "" {
+		t.Errorf("forEachFile returned diff in errors (-want +got):\n%s", diff)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// The timed-out file keeps its slot while it runs in the background.
+	if maxRunning > Concurrency {
+		t.Errorf("forEachFile processed %d files at once, want at most %d", maxRunning, Concurrency)
+	}
+}
+
+func TestFileError(t *testing.T) {
+	syntaxErr := newFileError("x/A.java", parsers.SyntaxError{Description: "syntax error", Line: 3, Offset: 28})
+	if syntaxErr.Line != 3 || syntaxErr.Offset != 28 {
+		t.Errorf("newFileError(syntax error) has Line %d, Offset %d, want 3, 28", syntaxErr.Line, syntaxErr.Offset)
+	}
+	if got, want := syntaxErr.Error(), "x/A.java:3: syntax error"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+
+	readErr := newFileError("x/B.java", os.ErrNotExist)
+	if readErr.Line != 0 || readErr.Offset != 0 {
+		t.Errorf("newFileError(read error) has Line %d, Offset %d, want 0, 0", readErr.Line, readErr.Offset)
+	}
+	if got, want := readErr.Error(), "x/B.java: "+os.ErrNotExist.Error(); got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
+
+func TestForEachFilePartialResults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var fileNames []string
+	for _, name := range []string{"ok", "partial", "broken"} {
+		f := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(f, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		fileNames = append(fileNames, f)
+	}
+
+	syntaxErr := parsers.SyntaxError{Description: "syntax error", Line: 1, Offset: 2}
+	results, errs := forEachFile(context.Background(), fileNames, func(ctx context.Context, fileName, source string) (interface{}, error) {
+		switch source {
+		case "partial":
+			return source, syntaxErr
+		case "broken":
+			return nil, syntaxErr
+		}
+		return source, nil
+	})
+
+	want := map[string]interface{}{fileNames[0]: "ok", fileNames[1]: "partial"}
+	if diff := cmp.Diff(want, results); diff != "" {
+		t.Errorf("forEachFile returned diff in results (-want +got):\n%s", diff)
+	}
+	gotPartial := make(map[string]bool)
+	for _, e := range errs {
+		gotPartial[e.FileName] = e.Partial
+	}
+	if diff := cmp.Diff(map[string]bool{fileNames[1]: true, fileNames[2]: false}, gotPartial); diff != "" {
+		t.Errorf("forEachFile returned diff in errors' Partial (-want +got):\n%s", diff)
+	}
+}
+
+func TestImportedClasses(t *testing.T) {
+	source := `package com.google;
+import com.google.Foo;
+  import com.google.foo.Bar.Inner;
+import static com.google.Static.MAX;
+import com.google.wildcard.*;
+import com.google.Foo;
+class Broken {
+  void f( {
+`
+	want := []string{"com.google.Foo", "com.google.foo.Bar", "com.google.Static"}
+	if diff := cmp.Diff(want, importedClasses(source)); diff != "" {
+		t.Errorf("importedClasses returned diff (-want +got):\n%s", diff)
+	}
+}
+
 func TestExtractClassNameFromQualifiedName(t *testing.T) {
 	tests := []struct {
 		parts   []string
@@ -174,8 +174,8 @@ func isContainer(n node.Type) bool {
 // resolveTypes builds a map from usages of types (e.g. new Foo()) to their definitions
 // (e.g. class Foo { ... }).
 // The keys of the resulting map are the individual node.JavaIdentifier nodes.
-// Only nodes which are definitely types (i.e. node.JavaTypeName) are mapped; all other types
-// are mapped in resolveNonTypes().
+// Only nodes which are definitely types (i.e. node.JavaTypeName, and the qualifiers of constructor references) are mapped;
+// all other types are mapped in resolveNonTypes().
 //
 // bindings is used to return the output.
 func (r *Resolver) resolveTypes(bindings map[ast.Node]ast.Node) {
@@ -189,7 +189,10 @@ func (r *Resolver) resolveTypes(bindings map[ast.Node]ast.Node) {
 			}
 		}
 		switch n.Type() {
-		case node.JavaTypeName:
+		case node.JavaTypeName, node.JavaTypeOrExprName:
+			if n.Type() == node.JavaTypeOrExprName && !IsConstructorReference(n.Parent()) {
+				break
+			}
 			ids := n.ChildrenOfType(node.JavaIdentifier)
 			typeNode := typeInScope(stack, ids[0].Text())
 			if typeNode.IsValid() {
@@ -237,6 +240,10 @@ func (r *Resolver) resolveNonTypes(bindings map[ast.Node]ast.Node) {
 			}
 
 		case node.JavaTypeOrExprName, node.JavaExprName:
+			if IsConstructorReference(n.Parent()) {
+				// Mapped in resolveTypes(), since it can only be a type.
+				break
+			}
 			ids := n.ChildrenOfType(node.JavaIdentifier)
 			id0Text := ids[0].Text()
 			if typ := typeInScope(stack, id0Text); typ.IsValid() {
@@ -261,6 +268,14 @@ func (r *Resolver) resolveNonTypes(bindings map[ast.Node]ast.Node) {
 	walk(r.tree.Root(), before, after)
 }
 
+// IsConstructorReference returns true if n is a constructor reference, e.g. Foo::new or Foo[]::new.
+// The grammar can't tell whether the qualifier of a method reference (Foo in Foo::bar) is a type or an expression,
+// and parses it as a node.JavaTypeOrExprName, but the qualifier of a constructor reference is always a type.
+func IsConstructorReference(n ast.Node) bool {
+	// Method references end with the method's identifier; constructor references end with 'new', which isn't a node.
+	return n.Type() == node.JavaMethodReference && !n.FirstChildOfType(node.JavaIdentifier).IsValid()
+}
+
 // typeInScope returns a type named 'id' in the closest lexical scope.
 // 'scopes' is a stack of symbol tables, the last entry being the closest to us.
 // If there's no such type, returns an invalid node.
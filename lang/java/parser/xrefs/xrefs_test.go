@@ -278,6 +278,19 @@ func TestResolveTypes(t *testing.T) {
 					}`,
 			want: map[string]string{"«&1»": "«1»", "«&2»": "«2»"},
 		},
+		{
+			desc: "Resolves the qualifiers of constructor references, including array constructor references",
+			source: `class A {
+						«1»class Foo {
+							«2»class Bar {}
+						}
+						void f() {
+							Supplier a = «&1»Foo.«&2»Bar::new;
+							IntFunction b = «&3»Foo[]::new;
+						}
+					}`,
+			want: map[string]string{"«&1»": "«1»", "«&2»": "«2»", "«&3»": "«1»"},
+		},
 	}
 
 	ctx := context.Background()
@@ -436,6 +449,23 @@ func TestResolve(t *testing.T) {
 				"«&2»": "«2»",
 			},
 		},
+		{
+			desc: "The qualifiers of method references are resolved to types and fields, and those of constructor references to types.",
+			source: `class A {
+						«1»class Foo {}
+						Runnable «2»bar;
+						void f() {
+							Function a = «&1»Foo::hashCode;
+							Runnable b = «&2»bar::run;
+							Supplier c = «&3»Foo::new;
+						}
+					}`,
+			want: map[string]string{
+				"«&1»": "«1»",
+				"«&2»": "«2»",
+				"«&3»": "«1»",
+			},
+		},
 	}
 
 	ctx := context.Background()
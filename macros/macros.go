@@ -0,0 +1,114 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package macros describes how Jadep edits the rules that macros generate.
+//
+// A rule generated by a macro doesn't appear in its BUILD file, so Jadep adds deps to the macro call instead
+// (see buildozer.Ref). A macro may pass its deps to an attribute with a different name, and may generate several
+// rules from the same srcs, e.g. a java_library and an android_local_test that depends on it. A Macro names the
+// attribute of the call that deps go to, and which of the generated rules Jadep analyzes, so that it computes
+// the deps of a call once.
+package macros
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+)
+
+// Macro describes how Jadep edits the calls of a macro.
+type Macro struct {
+	// Attr is the attribute of a call that deps are added to, e.g. "test_deps".
+	// If empty, it's the deps attribute of the kind of the generated rule.
+	Attr string
+
+	// Target is the name of the generated rule that Jadep analyzes for a call, where "{name}" stands for the name
+	// of the call, e.g. "{name}_lib". If empty, or if a call generated no rule by that name, Jadep analyzes all of them.
+	Target string
+}
+
+// Parse parses a comma-separated list of macro=attribute[:target] entries,
+// e.g. "robolectric_test=deps:{name}_lib,junit_suite=test_deps". Either the attribute or the target may be empty.
+func Parse(s string) (map[string]Macro, error) {
+	ret := make(map[string]Macro)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("expected macro=attribute[:target], got %q", entry)
+		}
+		var m Macro
+		if i := strings.Index(parts[1], ":"); i != -1 {
+			m = Macro{Attr: parts[1][:i], Target: parts[1][i+1:]}
+		} else {
+			m = Macro{Attr: parts[1]}
+		}
+		if m.Attr == "" && m.Target == "" {
+			return nil, fmt.Errorf("expected an attribute or a target for macro %q", parts[0])
+		}
+		ret[parts[0]] = m
+	}
+	return ret, nil
+}
+
+// Select returns the rules of 'rules' that Jadep should analyze.
+// Of the rules generated by the same call of a macro in 'macros', only the one named by the macro's Target is kept,
+// if it's among 'rules'. Other rules are kept as is. The order of 'rules' is preserved.
+func Select(macros map[string]Macro, rules []*bazel.Rule) []*bazel.Rule {
+	// calls are the macro calls whose target is in 'rules'.
+	calls := make(map[bazel.Label]bool)
+	for _, r := range rules {
+		if isTarget(macros, r) {
+			calls[r.SourceLabel()] = true
+		}
+	}
+	if len(calls) == 0 {
+		return rules
+	}
+	var ret []*bazel.Rule
+	for _, r := range rules {
+		if _, ok := macros[r.GeneratorFunction()]; ok && calls[r.SourceLabel()] && !isTarget(macros, r) {
+			continue
+		}
+		ret = append(ret, r)
+	}
+	return ret
+}
+
+// isTarget returns true if rule was generated by a named call of a macro in 'macros', and is the rule named by its Target.
+func isTarget(macros map[string]Macro, rule *bazel.Rule) bool {
+	m, ok := macros[rule.GeneratorFunction()]
+	callName, named := rule.Attrs["generator_name"].(string)
+	if !ok || !named || m.Target == "" {
+		return false
+	}
+	_, name := rule.Label().Split()
+	return name == strings.Replace(m.Target, "{name}", callName, -1)
+}
+
+// DepsAttributes returns the attributes that calls of 'macros' have their deps added to, by macro name,
+// in the form of filter.DepsAttributeByKind.
+func DepsAttributes(macros map[string]Macro) map[string]string {
+	ret := make(map[string]string)
+	for name, m := range macros {
+		if m.Attr != "" {
+			ret[name] = m.Attr
+		}
+	}
+	return ret
+}
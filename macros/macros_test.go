@@ -0,0 +1,82 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package macros
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParse(t *testing.T) {
+	got, err := Parse("robolectric_test=deps:{name}_lib, junit_suite=test_deps,only_target=:{name}")
+	if err != nil {
+		t.Fatalf("Parse returned error %v, want nil", err)
+	}
+	want := map[string]Macro{
+		"robolectric_test": {Attr: "deps", Target: "{name}_lib"},
+		"junit_suite":      {Attr: "test_deps"},
+		"only_target":      {Target: "{name}"},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("Parse returned diff (-got +want):\n%s", diff)
+	}
+	if diff := cmp.Diff(DepsAttributes(got), map[string]string{"robolectric_test": "deps", "junit_suite": "test_deps"}); diff != "" {
+		t.Errorf("DepsAttributes returned diff (-got +want):\n%s", diff)
+	}
+
+	for _, in := range []string{"foo", "=deps", "foo=", "foo=:"} {
+		if _, err := Parse(in); err == nil || !strings.Contains(err.Error(), "expected") {
+			t.Errorf("Parse(%q) returned error %v, want one containing %q", in, err, "expected")
+		}
+	}
+}
+
+func TestSelect(t *testing.T) {
+	type Attrs = map[string]interface{}
+	generated := func(name, macro, call string) *bazel.Rule {
+		return bazel.NewRule("java_library", "x", name, Attrs{"generator_function": macro, "generator_name": call, "generator_location": "x/BUILD:3"})
+	}
+	macros := map[string]Macro{
+		"robolectric_test": {Attr: "deps", Target: "{name}_lib"},
+		"junit_suite":      {Attr: "test_deps"},
+	}
+	fooTest := generated("foo", "robolectric_test", "foo")
+	fooLib := generated("foo_lib", "robolectric_test", "foo")
+	barTest := generated("bar", "robolectric_test", "bar")
+	suite1 := generated("suite_Test1", "junit_suite", "suite")
+	suite2 := generated("suite_Test2", "junit_suite", "suite")
+	other := generated("other_lib", "other_macro", "other")
+	plain := bazel.NewRule("java_library", "x", "plain", nil)
+
+	tests := []struct {
+		desc  string
+		rules []*bazel.Rule
+		want  []*bazel.Rule
+	}{
+		{"The target of a call is kept", []*bazel.Rule{fooTest, plain, fooLib}, []*bazel.Rule{plain, fooLib}},
+		{"Calls whose target isn't among the rules keep all of them", []*bazel.Rule{barTest, fooTest}, []*bazel.Rule{barTest, fooTest}},
+		{"Macros without a target keep all of their rules", []*bazel.Rule{suite1, suite2, fooLib}, []*bazel.Rule{suite1, suite2, fooLib}},
+		{"Unknown macros keep all of their rules", []*bazel.Rule{other, plain}, []*bazel.Rule{other, plain}},
+		{"Nothing", nil, nil},
+	}
+	for _, tt := range tests {
+		if diff := cmp.Diff(Select(macros, tt.rules), tt.want); diff != "" {
+			t.Errorf("%s: Select returned diff (-got +want):\n%s", tt.desc, diff)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mavenindex maps class names to the Maven artifacts that provide them.
+// It's used to suggest third-party artifacts for class names that no BUILD rule provides.
+package mavenindex
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+	"github.com/bazelbuild/tools_jvm_autodeps/listclassesinjar"
+)
+
+// Artifact identifies a Maven artifact.
+type Artifact struct {
+	GroupID    string
+	ArtifactID string
+	Version    string
+}
+
+// String returns the coordinates of the artifact, e.g. com.google.guava:guava:24.0-jre.
+func (a Artifact) String() string {
+	return a.GroupID + ":" + a.ArtifactID + ":" + a.Version
+}
+
+// ParseArtifact parses coordinates of the form group:artifact:version.
+func ParseArtifact(coords string) (Artifact, error) {
+	parts := strings.Split(coords, ":")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return Artifact{}, fmt.Errorf("Maven coordinates must have the form group:artifact:version, got %q", coords)
+	}
+	return Artifact{parts[0], parts[1], parts[2]}, nil
+}
+
+// Index maps class names to the artifacts that contain them.
+type Index struct {
+	classes map[jadeplib.ClassName][]Artifact
+}
+
+// Lookup returns the artifacts that contain each of classNames, sorted by coordinates.
+// Class names that no artifact contains are omitted.
+func (idx *Index) Lookup(classNames []jadeplib.ClassName) map[jadeplib.ClassName][]Artifact {
+	ret := make(map[jadeplib.ClassName][]Artifact)
+	for _, cls := range classNames {
+		if artifacts := idx.classes[cls]; len(artifacts) > 0 {
+			ret[cls] = artifacts
+		}
+	}
+	return ret
+}
+
+func (idx *Index) add(cls jadeplib.ClassName, a Artifact) {
+	artifacts := idx.classes[cls]
+	i := sort.Search(len(artifacts), func(i int) bool { return artifacts[i].String() >= a.String() })
+	if i < len(artifacts) && artifacts[i] == a {
+		return
+	}
+	artifacts = append(artifacts, Artifact{})
+	copy(artifacts[i+1:], artifacts[i:])
+	artifacts[i] = a
+	idx.classes[cls] = artifacts
+}
+
+// Load reads an index from path.
+// If path is a directory, it's scanned as a local Maven repository (see ScanRepository).
+// Otherwise, it's read as an index file (see ReadIndexFile).
+func Load(path string) (*Index, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading Maven index:\n%v", err)
+	}
+	if info.IsDir() {
+		return ScanRepository(path)
+	}
+	return ReadIndexFile(path)
+}
+
+// ReadIndexFile reads an index from a CSV file whose lines have the form <class name>,<group>:<artifact>:<version>.
+// Such a file can be exported from an index of a Maven repository, e.g. Maven Central.
+func ReadIndexFile(fileName string) (*Index, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("error opening Maven index file:\n%v", err)
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 2
+	idx := &Index{classes: make(map[jadeplib.ClassName][]Artifact)}
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading Maven index file %s:\n%v", fileName, err)
+		}
+		a, err := ParseArtifact(record[1])
+		if err != nil {
+			return nil, fmt.Errorf("error reading Maven index file %s:\n%v", fileName, err)
+		}
+		idx.add(jadeplib.ClassName(record[0]), a)
+	}
+	return idx, nil
+}
+
+// ScanRepository indexes the jars in a local Maven repository, such as ~/.m2/repository.
+// Only the latest version of each artifact is indexed, and jars with classifiers (e.g. -sources.jar) are ignored.
+// Jars that can't be read are skipped.
+func ScanRepository(root string) (*Index, error) {
+	latest := make(map[string]Artifact)
+	jars := make(map[Artifact]string)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, ".jar") {
+			return nil
+		}
+		a, ok := artifactFromPath(root, path)
+		if !ok {
+			return nil
+		}
+		jars[a] = path
+		key := a.GroupID + ":" + a.ArtifactID
+		if prev, ok := latest[key]; !ok || compareVersions(prev.Version, a.Version) < 0 {
+			latest[key] = a
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error scanning Maven repository %s:\n%v", root, err)
+	}
+
+	idx := &Index{classes: make(map[jadeplib.ClassName][]Artifact)}
+	for _, a := range latest {
+		classes, err := listclassesinjar.List(jars[a])
+		if err != nil {
+			log.Printf("WARNING: Skipping %v: %v", a, err)
+			continue
+		}
+		for _, cls := range classes {
+			idx.add(cls, a)
+		}
+	}
+	return idx, nil
+}
+
+// artifactFromPath returns the artifact of a jar in a Maven repository, e.g. <root>/com/google/guava/guava/24.0-jre/guava-24.0-jre.jar.
+// Returns false if the path doesn't follow the repository layout, or if the jar has a classifier.
+func artifactFromPath(root, path string) (Artifact, bool) {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return Artifact{}, false
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if len(parts) < 4 {
+		return Artifact{}, false
+	}
+	n := len(parts)
+	a := Artifact{
+		GroupID:    strings.Join(parts[:n-3], "."),
+		ArtifactID: parts[n-3],
+		Version:    parts[n-2],
+	}
+	if parts[n-1] != a.ArtifactID+"-"+a.Version+".jar" {
+		return Artifact{}, false
+	}
+	return a, true
+}
+
+// compareVersions compares two Maven versions, returning -1, 0 or 1.
+// Versions are compared component by component, numerically when both components are numbers, e.g. 1.10 > 1.9.
+func compareVersions(a, b string) int {
+	split := func(s string) []string {
+		return strings.FieldsFunc(s, func(r rune) bool { return r == '.' || r == '-' })
+	}
+	pa, pb := split(a), split(b)
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		na, errA := strconv.Atoi(pa[i])
+		nb, errB := strconv.Atoi(pb[i])
+		switch {
+		case errA == nil && errB == nil:
+			if na != nb {
+				if na < nb {
+					return -1
+				}
+				return 1
+			}
+		case pa[i] != pb[i]:
+			if pa[i] < pb[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(pa) < len(pb):
+		return -1
+	case len(pa) > len(pb):
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,141 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mavenindex
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestScanRepository(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	jars := map[string][]string{
+		"com/google/guava/guava/9.0/guava-9.0.jar":                   {"com/google/common/collect/ImmutableList.class", "com/google/common/base/Old.class"},
+		"com/google/guava/guava/24.0-jre/guava-24.0-jre.jar":         {"com/google/common/collect/ImmutableList.class", "com/google/common/base/Optional$1.class"},
+		"com/google/guava/guava/24.0-jre/guava-24.0-jre-sources.jar": {"com/google/common/base/Sources.class"},
+		"junit/junit/4.12/junit-4.12.jar":                            {"org/junit/Test.class"},
+		"misplaced.jar":                                              {"com/foo/Misplaced.class"},
+	}
+	for name, classFiles := range jars {
+		writeJar(t, filepath.Join(root, name), classFiles)
+	}
+
+	idx, err := ScanRepository(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := idx.Lookup([]jadeplib.ClassName{"com.google.common.collect.ImmutableList", "com.google.common.base.Old", "com.google.common.base.Sources", "org.junit.Test", "com.foo.Misplaced"})
+	want := map[jadeplib.ClassName][]Artifact{
+		"com.google.common.collect.ImmutableList": {{"com.google.guava", "guava", "24.0-jre"}},
+		"org.junit.Test": {{"junit", "junit", "4.12"}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Lookup returned diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestReadIndexFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	content := "org.junit.Test,junit:junit:4.12\n" +
+		"javax.inject.Inject,javax.inject:javax.inject:1\n" +
+		"javax.inject.Inject,jakarta.inject:jakarta.inject-api:1.0\n" +
+		"org.junit.Test,junit:junit:4.12\n"
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	idx, err := ReadIndexFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := idx.Lookup([]jadeplib.ClassName{"org.junit.Test", "javax.inject.Inject", "com.Unknown"})
+	want := map[jadeplib.ClassName][]Artifact{
+		"org.junit.Test":      {{"junit", "junit", "4.12"}},
+		"javax.inject.Inject": {{"jakarta.inject", "jakarta.inject-api", "1.0"}, {"javax.inject", "javax.inject", "1"}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Lookup returned diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestReadIndexFileMalformed(t *testing.T) {
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("org.junit.Test,junit:junit\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if _, err := ReadIndexFile(f.Name()); err == nil {
+		t.Errorf("ReadIndexFile succeeded on malformed coordinates, want error")
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.9", "1.10", -1},
+		{"24.0-jre", "9.0", 1},
+		{"1.0", "1.0.1", -1},
+		{"1.0-beta", "1.0-alpha", 1},
+	}
+	for _, tt := range tests {
+		if got := compareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func writeJar(t *testing.T, fileName string, classFiles []string) {
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := zip.NewWriter(f)
+	for _, cf := range classFiles {
+		if _, err := w.Create(cf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
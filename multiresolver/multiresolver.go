@@ -0,0 +1,169 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package multiresolver combines resolvers that are consulted for the same class names, such as dictionaries of third-party classes.
+// Unlike the chain of resolvers in jadeplib.Config, where the first resolver to claim a class name wins silently,
+// it reports class names that its resolvers disagree on.
+package multiresolver
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+)
+
+// Precedence decides which candidates are returned for a class name that more than one resolver claims.
+type Precedence string
+
+const (
+	// First returns the candidates of the first resolver that claims a class name.
+	First Precedence = "first"
+
+	// Last returns the candidates of the last resolver that claims a class name.
+	Last Precedence = "last"
+
+	// All returns the candidates of every resolver that claims a class name, and lets the user choose among them.
+	All Precedence = "all"
+)
+
+// ParsePrecedence parses the name of a Precedence.
+func ParsePrecedence(s string) (Precedence, error) {
+	switch p := Precedence(s); p {
+	case First, Last, All:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown precedence %q, want one of %q, %q or %q", s, First, Last, All)
+}
+
+// Conflict describes a class name that resolvers resolved to different labels.
+type Conflict struct {
+	ClassName jadeplib.ClassName
+
+	// Labels maps the name of each resolver that claimed ClassName to the labels it resolved ClassName to.
+	Labels map[string][]bazel.Label
+}
+
+func (c Conflict) String() string {
+	var provenances []string
+	for name, labels := range c.Labels {
+		var strs []string
+		for _, l := range labels {
+			strs = append(strs, string(l))
+		}
+		provenances = append(provenances, fmt.Sprintf("[%s] according to %s", strings.Join(strs, ", "), name))
+	}
+	sort.Strings(provenances)
+	return fmt.Sprintf("%s is provided by %s", c.ClassName, strings.Join(provenances, " and by "))
+}
+
+// Resolver resolves class names using all of its resolvers, and merges their results according to a Precedence.
+type Resolver struct {
+	name       string
+	resolvers  []jadeplib.Resolver
+	precedence Precedence
+
+	// OnConflict is called for each class name that resolvers disagree on.
+	// It defaults to logging a warning.
+	OnConflict func(Conflict)
+}
+
+// NewResolver returns a new Resolver that consults 'resolvers' in order.
+func NewResolver(name string, precedence Precedence, resolvers ...jadeplib.Resolver) *Resolver {
+	return &Resolver{name, resolvers, precedence, logConflict}
+}
+
+func logConflict(c Conflict) {
+	log.Printf("WARNING: %v", c)
+}
+
+// Name returns a description of the resolver.
+func (r *Resolver) Name() string {
+	return r.name
+}
+
+// Resolve calls all resolvers with the same class names, and reports class names they resolve to different labels.
+// Errors from individual resolvers don't prevent using the results of the others; they're returned together.
+func (r *Resolver) Resolve(ctx context.Context, classNames []jadeplib.ClassName, consumingRules map[bazel.Label]map[bazel.Label]bool) (map[jadeplib.ClassName][]*bazel.Rule, error) {
+	var results []map[jadeplib.ClassName][]*bazel.Rule
+	var errors []string
+	for _, res := range r.resolvers {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		resolved, err := res.Resolve(ctx, classNames, consumingRules)
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("%s: %v", res.Name(), err))
+		}
+		results = append(results, resolved)
+	}
+
+	ret := make(map[jadeplib.ClassName][]*bazel.Rule)
+	for _, cls := range classNames {
+		var claimedBy []int
+		for i, resolved := range results {
+			if _, ok := resolved[cls]; ok {
+				claimedBy = append(claimedBy, i)
+			}
+		}
+		if len(claimedBy) == 0 {
+			continue
+		}
+		if conflict, ok := r.conflict(cls, results, claimedBy); ok {
+			r.OnConflict(conflict)
+		}
+		switch r.precedence {
+		case Last:
+			ret[cls] = results[claimedBy[len(claimedBy)-1]][cls]
+		case All:
+			seen := make(map[bazel.Label]bool)
+			ret[cls] = nil
+			for _, i := range claimedBy {
+				for _, rule := range results[i][cls] {
+					if !seen[rule.Label()] {
+						seen[rule.Label()] = true
+						ret[cls] = append(ret[cls], rule)
+					}
+				}
+			}
+		default:
+			ret[cls] = results[claimedBy[0]][cls]
+		}
+	}
+
+	if len(errors) > 0 {
+		return ret, fmt.Errorf("Errors when resolving using %s:\n%s", r.name, strings.Join(errors, "\n"))
+	}
+	return ret, nil
+}
+
+// conflict returns a Conflict if the resolvers in claimedBy resolved cls to different sets of labels.
+func (r *Resolver) conflict(cls jadeplib.ClassName, results []map[jadeplib.ClassName][]*bazel.Rule, claimedBy []int) (Conflict, bool) {
+	c := Conflict{ClassName: cls, Labels: make(map[string][]bazel.Label)}
+	distinct := make(map[string]bool)
+	for _, i := range claimedBy {
+		var labels []bazel.Label
+		for _, rule := range results[i][cls] {
+			labels = append(labels, rule.Label())
+		}
+		sort.Slice(labels, func(a, b int) bool { return labels[a] < labels[b] })
+		c.Labels[r.resolvers[i].Name()] = labels
+		distinct[fmt.Sprint(labels)] = true
+	}
+	return c, len(distinct) > 1
+}
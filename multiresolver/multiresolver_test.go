@@ -0,0 +1,106 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package multiresolver
+
+import (
+	"testing"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+	"github.com/google/go-cmp/cmp"
+)
+
+type stubResolver struct {
+	name     string
+	response map[jadeplib.ClassName][]*bazel.Rule
+}
+
+func (r *stubResolver) Name() string {
+	return r.name
+}
+
+func (r *stubResolver) Resolve(ctx context.Context, classNames []jadeplib.ClassName, consumingRules map[bazel.Label]map[bazel.Label]bool) (map[jadeplib.ClassName][]*bazel.Rule, error) {
+	return r.response, nil
+}
+
+func TestResolve(t *testing.T) {
+	builtin := &stubResolver{"builtin", map[jadeplib.ClassName][]*bazel.Rule{
+		"javax.annotation.Nullable": nil,
+		"com.Same":                  {bazel.NewRule("java_library", "x", "Same", nil)},
+	}}
+	thirdParty := &stubResolver{"third-party", map[jadeplib.ClassName][]*bazel.Rule{
+		"javax.annotation.Nullable": {bazel.NewRule("java_library", "thirdparty/jvm/jsr305", "jsr305", nil)},
+		"com.Same":                  {bazel.NewRule("java_library", "x", "Same", nil)},
+		"com.OnlyThirdParty":        {bazel.NewRule("java_library", "y", "Only", nil)},
+	}}
+	classNames := []jadeplib.ClassName{"javax.annotation.Nullable", "com.Same", "com.OnlyThirdParty", "com.Unresolved"}
+
+	tests := []struct {
+		precedence Precedence
+		want       map[jadeplib.ClassName][]bazel.Label
+	}{
+		{
+			First,
+			map[jadeplib.ClassName][]bazel.Label{"javax.annotation.Nullable": nil, "com.Same": {"//x:Same"}, "com.OnlyThirdParty": {"//y:Only"}},
+		},
+		{
+			Last,
+			map[jadeplib.ClassName][]bazel.Label{"javax.annotation.Nullable": {"//thirdparty/jvm/jsr305:jsr305"}, "com.Same": {"//x:Same"}, "com.OnlyThirdParty": {"//y:Only"}},
+		},
+		{
+			All,
+			map[jadeplib.ClassName][]bazel.Label{"javax.annotation.Nullable": {"//thirdparty/jvm/jsr305:jsr305"}, "com.Same": {"//x:Same"}, "com.OnlyThirdParty": {"//y:Only"}},
+		},
+	}
+	for _, tt := range tests {
+		r := NewResolver("dicts", tt.precedence, builtin, thirdParty)
+		var conflicts []Conflict
+		r.OnConflict = func(c Conflict) { conflicts = append(conflicts, c) }
+		resolved, err := r.Resolve(context.Background(), classNames, nil)
+		if err != nil {
+			t.Errorf("%s: Resolve returned error %v", tt.precedence, err)
+			continue
+		}
+		got := make(map[jadeplib.ClassName][]bazel.Label)
+		for cls, rules := range resolved {
+			got[cls] = nil
+			for _, rule := range rules {
+				got[cls] = append(got[cls], rule.Label())
+			}
+		}
+		if diff := cmp.Diff(got, tt.want); diff != "" {
+			t.Errorf("%s: Resolve returned diff (-got +want):\n%s", tt.precedence, diff)
+		}
+		wantConflicts := []Conflict{{
+			ClassName: "javax.annotation.Nullable",
+			Labels:    map[string][]bazel.Label{"builtin": nil, "third-party": {"//thirdparty/jvm/jsr305:jsr305"}},
+		}}
+		if diff := cmp.Diff(conflicts, wantConflicts); diff != "" {
+			t.Errorf("%s: Resolve reported diff in conflicts (-got +want):\n%s", tt.precedence, diff)
+		}
+	}
+}
+
+func TestConflictString(t *testing.T) {
+	c := Conflict{
+		ClassName: "com.Foo",
+		Labels:    map[string][]bazel.Label{"b": {"//b:b"}, "a": {"//a:a1", "//a:a2"}},
+	}
+	want := "com.Foo is provided by [//a:a1, //a:a2] according to a and by [//b:b] according to b"
+	if got := c.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
@@ -16,10 +16,15 @@
 package pkgloading
 
 import (
+	"container/list"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"context"
 	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
@@ -32,6 +37,61 @@ type Loader interface {
 	Load(ctx context.Context, packages []string) (map[string]*bazel.Package, error)
 }
 
+// ErrorReportingLoader is a Loader that also reports the packages that exist but failed to evaluate,
+// e.g. because their BUILD file has a syntax error or a missing load().
+// Load omits such packages from its result without failing, as if they didn't exist.
+type ErrorReportingLoader interface {
+	Loader
+
+	// LoadWithErrors is like Load, but also returns the errors of the packages that failed to evaluate.
+	LoadWithErrors(ctx context.Context, packages []string) (map[string]*bazel.Package, []*PackageError, error)
+}
+
+// FileResolvingLoader is a Loader that can also find the packages that files belong to, and load them, in a single call.
+// It saves a round trip per file when the loader is closer to the file system than Jadep is, e.g. when it's a server
+// that can see the workspace.
+type FileResolvingLoader interface {
+	Loader
+
+	// ResolveFiles returns the packages that define fileNames (relative to the workspace root) keyed by name, and the name of the package of each file.
+	// Files that don't belong to any package are omitted from fileToPkgName.
+	// Packages in excludedPackages are named in fileToPkgName, but not loaded.
+	// It returns ErrResolveFilesUnsupported if the loader can't resolve files after all, in which case callers should find the packages themselves.
+	ResolveFiles(ctx context.Context, fileNames []string, excludedPackages map[string]bool) (packages map[string]*bazel.Package, fileToPkgName map[string]string, err error)
+}
+
+// ErrResolveFilesUnsupported is returned by FileResolvingLoader.ResolveFiles when the loader can't resolve files,
+// e.g. because it wraps a Loader that isn't a FileResolvingLoader, or because its server is too old.
+var ErrResolveFilesUnsupported = errors.New("loader doesn't support resolving files")
+
+// PackageError describes why a package failed to evaluate.
+type PackageError struct {
+	// PkgName is the name of the package, e.g. "foo/bar".
+	PkgName string
+
+	Message string
+
+	// Line is the line of the BUILD file that the error is at, or 0 if it's unknown.
+	Line int
+}
+
+// Error returns a description of the error, e.g. "//foo: BUILD:12: syntax error".
+func (e *PackageError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("//%s: BUILD:%d: %s", e.PkgName, e.Line, e.Message)
+	}
+	return fmt.Sprintf("//%s: %s", e.PkgName, e.Message)
+}
+
+// LoadWithErrors calls loader.LoadWithErrors if loader is an ErrorReportingLoader, and loader.Load otherwise.
+func LoadWithErrors(ctx context.Context, loader Loader, packages []string) (map[string]*bazel.Package, []*PackageError, error) {
+	if l, ok := loader.(ErrorReportingLoader); ok {
+		return l.LoadWithErrors(ctx, packages)
+	}
+	pkgs, err := loader.Load(ctx, packages)
+	return pkgs, nil, err
+}
+
 // CachingLoader is a concurrent duplicate-supressing cache for results from a loader.
 // It wraps another loader L, and guarantees each requested package is loaded exactly once.
 //
@@ -41,42 +101,131 @@ type Loader interface {
 // Notice that 'b' is only requested once.
 // As a corollary, Load(P) will not call the underlying L.Load() at all if all of the packages in P have been previously loaded.
 //
-// Note that if an error occurred when loading a set of packages, the failure will be cached and no loading will be re-attempted.
+// Note that if an error occurred when loading a set of packages, the failure will be cached and no loading will be re-attempted,
+// unless CachingLoaderOptions.ErrorTTL is set.
 // In particular, it's possible to poison the cache for P by loading [P, BadPkg] first.
+// The exception is a load that failed because its context was cancelled; such failures are not cached, and a later Load will retry them.
+//
+// Long-running processes should bound the cache using CachingLoaderOptions.MaxEntries, and call Invalidate when BUILD files change.
 //
 // CachingLoader is concurrency-safe as long as the underlying loader's Load function is concurrency-safe.
 type CachingLoader struct {
 	loader Loader
-	mu     sync.Mutex // guards cache
-	cache  map[string]*entry
+	opts   CachingLoaderOptions
+	now    func() time.Time
+
+	mu    sync.Mutex // guards cache, lru and stats
+	cache map[string]*entry
+	lru   *list.List // of *entry, most recently used first
+	stats CacheStats
+}
+
+// CachingLoaderOptions configures the eviction policy of a CachingLoader, and how it calls the underlying loader.
+// The zero value caches everything forever, and requests all missing packages in a single call.
+type CachingLoaderOptions struct {
+	// MaxEntries is the number of packages above which the least-recently used packages are evicted.
+	// Packages that are being loaded are never evicted. Zero means no limit.
+	MaxEntries int
+
+	// ErrorTTL is the duration after which a failed load is attempted again. Zero means failures are cached forever.
+	ErrorTTL time.Duration
+
+	// ChunkSize is the maximum number of packages requested in a single call to the underlying loader.
+	// Larger requests are split into chunks, which bounds the size of RPCs and the memory a PackageLoader server needs to answer them.
+	// Packages become available to concurrent Load calls as soon as their chunk is loaded. Zero means no limit.
+	ChunkSize int
+
+	// ChunkParallelism is the maximum number of chunks loaded concurrently by a single Load call. Zero means one at a time.
+	ChunkParallelism int
+}
+
+// CacheStats are counters describing the use of a CachingLoader.
+type CacheStats struct {
+	// Entries is the number of packages currently in the cache.
+	Entries int
+
+	// Hits and Misses count requested packages that were and weren't found in the cache, respectively.
+	Hits, Misses int64
+
+	// Evictions counts packages that were evicted to keep the cache below CachingLoaderOptions.MaxEntries.
+	Evictions int64
+}
+
+// HitRate returns the fraction of requested packages that were found in the cache.
+func (s CacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
 }
 
 // NewCachingLoader returns a new CachingLoader wrapped around a loader.
 func NewCachingLoader(loader Loader) *CachingLoader {
-	return &CachingLoader{loader: loader, cache: make(map[string]*entry)}
+	return NewCachingLoaderWithOptions(loader, CachingLoaderOptions{})
+}
+
+// NewCachingLoaderWithOptions returns a new CachingLoader wrapped around a loader, which evicts packages according to opts.
+func NewCachingLoaderWithOptions(loader Loader, opts CachingLoaderOptions) *CachingLoader {
+	return &CachingLoader{loader: loader, opts: opts, now: time.Now, cache: make(map[string]*entry), lru: list.New()}
 }
 
 type entry struct {
-	pkgName string
-	res     result
-	ready   chan struct{} // closed when res is ready
+	pkgName  string
+	res      result
+	loadedAt time.Time
+	ready    chan struct{} // closed when res and loadedAt are ready
+	elem     *list.Element
+
+	// cancelled is set, before ready is closed, if the load was abandoned because the context of the call that made it was done.
+	// Such entries are removed from the cache, and other calls waiting for them load them again.
+	cancelled bool
+}
+
+func (e *entry) isReady() bool {
+	select {
+	case <-e.ready:
+		return true
+	default:
+		return false
+	}
 }
 
 type result struct {
 	value *bazel.Package
 	err   error
+
+	// pkgErr is set if the package exists but failed to evaluate.
+	pkgErr *PackageError
 }
 
 // Load loads packages using an underlying loader.
 // It will load each package at most once, and is safe to call concurrently.
 // The returned error is a concatentation of all errors from calls to the underlying loader that occurred in order to load 'packages'.
+// If ctx is done while waiting for packages that another call is loading, Load returns ctx.Err() without waiting for them.
+// If instead the other call's context is done first, Load loads the packages it abandoned itself.
 func (l *CachingLoader) Load(ctx context.Context, packages []string) (map[string]*bazel.Package, error) {
+	pkgs, _, err := l.LoadWithErrors(ctx, packages)
+	return pkgs, err
+}
+
+// LoadWithErrors is like Load, but also returns the errors of the requested packages that failed to evaluate,
+// if the underlying loader reports them (see ErrorReportingLoader). These errors are cached like packages are.
+func (l *CachingLoader) LoadWithErrors(ctx context.Context, packages []string) (map[string]*bazel.Package, []*PackageError, error) {
 	var work, all []*entry
 	l.mu.Lock()
 	for _, p := range packages {
 		e, ok := l.cache[p]
-		if !ok {
+		if ok && l.expired(e) {
+			l.remove(e)
+			ok = false
+		}
+		if ok {
+			l.stats.Hits++
+			l.lru.MoveToFront(e.elem)
+		} else {
+			l.stats.Misses++
 			e = &entry{pkgName: p, ready: make(chan struct{})}
+			e.elem = l.lru.PushFront(e)
 			l.cache[p] = e
 			work = append(work, e)
 		}
@@ -85,33 +234,241 @@ func (l *CachingLoader) Load(ctx context.Context, packages []string) (map[string
 	l.mu.Unlock()
 
 	if len(work) > 0 {
-		var pkgsToLoad []string
-		for _, e := range work {
-			pkgsToLoad = append(pkgsToLoad, e.pkgName)
-		}
-		result, err := l.loader.Load(ctx, pkgsToLoad)
-		for _, e := range work {
-			e.res.value = result[e.pkgName]
-			e.res.err = err
-			close(e.ready)
-		}
+		l.loadInChunks(ctx, work)
 	}
 
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
 	result := make(map[string]*bazel.Package)
 	var errors []interface{}
+	var pkgErrs []*PackageError
+	var retry []string
 	for _, e := range all {
-		<-e.ready
+		select {
+		case <-e.ready:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+		if e.cancelled {
+			// Another call's context was done while it loaded e, but ctx isn't.
+			retry = append(retry, e.pkgName)
+			continue
+		}
 		if e.res.value != nil {
 			result[e.pkgName] = e.res.value
 		}
 		if e.res.err != nil {
 			errors = append(errors, e.res.err)
 		}
+		if e.res.pkgErr != nil {
+			pkgErrs = append(pkgErrs, e.res.pkgErr)
+		}
 	}
 	if len(errors) != 0 {
-		return nil, fmt.Errorf("Errors when loading packages: %v", errors)
+		return nil, nil, fmt.Errorf("Errors when loading packages: %v", errors)
+	}
+	if len(retry) > 0 {
+		pkgs, errs, err := l.LoadWithErrors(ctx, retry)
+		if err != nil {
+			return nil, nil, err
+		}
+		for name, pkg := range pkgs {
+			result[name] = pkg
+		}
+		pkgErrs = append(pkgErrs, errs...)
+	}
+	return result, pkgErrs, nil
+}
+
+// loadInChunks loads the packages of 'work' using the underlying loader, in chunks of at most ChunkSize packages,
+// at most ChunkParallelism of them at a time. It makes each entry ready when its chunk is loaded.
+func (l *CachingLoader) loadInChunks(ctx context.Context, work []*entry) {
+	size := l.opts.ChunkSize
+	if size <= 0 {
+		size = len(work)
+	}
+	parallelism := l.opts.ChunkParallelism
+	if parallelism <= 0 {
+		parallelism = 1
+	}
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for start := 0; start < len(work); start += size {
+		end := start + size
+		if end > len(work) {
+			end = len(work)
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(chunk []*entry) {
+			defer wg.Done()
+			l.loadChunk(ctx, chunk)
+			<-sem
+		}(work[start:end])
+	}
+	wg.Wait()
+}
+
+// loadChunk loads the packages of 'chunk' in a single call to the underlying loader, and makes their entries ready.
+func (l *CachingLoader) loadChunk(ctx context.Context, chunk []*entry) {
+	var pkgsToLoad []string
+	for _, e := range chunk {
+		pkgsToLoad = append(pkgsToLoad, e.pkgName)
+	}
+	result, pkgErrs, err := LoadWithErrors(ctx, l.loader, pkgsToLoad)
+	pkgErrByName := make(map[string]*PackageError)
+	for _, e := range pkgErrs {
+		pkgErrByName[e.PkgName] = e
+	}
+	cancelled := err != nil && ctx.Err() != nil
+	if cancelled {
+		// Don't poison the cache with cancellations; whoever asks for these packages next will load them again.
+		l.mu.Lock()
+		for _, e := range chunk {
+			l.remove(e)
+		}
+		l.mu.Unlock()
+	}
+	now := l.now()
+	for _, e := range chunk {
+		e.res.value = result[e.pkgName]
+		e.res.err = err
+		e.res.pkgErr = pkgErrByName[e.pkgName]
+		e.loadedAt = now
+		e.cancelled = cancelled
+		close(e.ready)
+	}
+	l.mu.Lock()
+	l.evict()
+	l.mu.Unlock()
+}
+
+// Invalidate removes packages from the cache, so the next Load of each of them will call the underlying loader.
+// Calls to Load that are already waiting for these packages are unaffected.
+func (l *CachingLoader) Invalidate(packages []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, p := range packages {
+		if e, ok := l.cache[p]; ok {
+			l.remove(e)
+		}
+	}
+}
+
+// Packages returns the packages that were loaded successfully and are still in the cache.
+func (l *CachingLoader) Packages() map[string]*bazel.Package {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ret := make(map[string]*bazel.Package)
+	for p, e := range l.cache {
+		if e.isReady() && e.res.err == nil && e.res.value != nil {
+			ret[p] = e.res.value
+		}
+	}
+	return ret
+}
+
+// PackageErrors returns the errors of the packages that failed to evaluate and are still in the cache, sorted by package name.
+// Reports can use them to explain which packages were skipped.
+func (l *CachingLoader) PackageErrors() []*PackageError {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var ret []*PackageError
+	for _, e := range l.cache {
+		if e.isReady() && e.res.pkgErr != nil {
+			ret = append(ret, e.res.pkgErr)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].PkgName < ret[j].PkgName })
+	return ret
+}
+
+// Prime adds packages to the cache as if the underlying loader had loaded them, e.g. packages saved by a previous run.
+// Packages that are already in the cache are left untouched.
+func (l *CachingLoader) Prime(pkgs map[string]*bazel.Package) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	for p, pkg := range pkgs {
+		if _, ok := l.cache[p]; ok {
+			continue
+		}
+		e := &entry{pkgName: p, res: result{value: pkg}, loadedAt: now, ready: make(chan struct{})}
+		close(e.ready)
+		e.elem = l.lru.PushFront(e)
+		l.cache[p] = e
+	}
+	l.evict()
+}
+
+// ResolveFiles resolves files using the underlying loader if it's a FileResolvingLoader, and caches the packages it returns.
+// Packages that were already cached are returned from the cache.
+func (l *CachingLoader) ResolveFiles(ctx context.Context, fileNames []string, excludedPackages map[string]bool) (map[string]*bazel.Package, map[string]string, error) {
+	r, ok := l.loader.(FileResolvingLoader)
+	if !ok {
+		return nil, nil, ErrResolveFilesUnsupported
+	}
+	resolved, fileToPkgName, err := r.ResolveFiles(ctx, fileNames, excludedPackages)
+	if err != nil {
+		return nil, nil, err
+	}
+	l.Prime(resolved)
+	var pkgs []string
+	seen := make(map[string]bool)
+	for _, p := range fileToPkgName {
+		if !seen[p] && !excludedPackages[p] {
+			seen[p] = true
+			pkgs = append(pkgs, p)
+		}
+	}
+	sort.Strings(pkgs)
+	// Packages that the underlying loader didn't return, e.g. because they failed to evaluate, are loaded as usual so their errors are recorded.
+	packages, err := l.Load(ctx, pkgs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return packages, fileToPkgName, nil
+}
+
+// Stats returns a snapshot of the cache's counters.
+func (l *CachingLoader) Stats() CacheStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := l.stats
+	s.Entries = len(l.cache)
+	return s
+}
+
+// expired returns true if e holds a failure older than ErrorTTL.
+// Must be called with l.mu held.
+func (l *CachingLoader) expired(e *entry) bool {
+	return l.opts.ErrorTTL > 0 && e.isReady() && e.res.err != nil && l.now().Sub(e.loadedAt) > l.opts.ErrorTTL
+}
+
+// remove removes e from the cache, unless it was already replaced by a newer entry.
+// Must be called with l.mu held.
+func (l *CachingLoader) remove(e *entry) {
+	if l.cache[e.pkgName] == e {
+		delete(l.cache, e.pkgName)
+	}
+	l.lru.Remove(e.elem)
+}
+
+// evict removes the least-recently used loaded packages until the cache has at most MaxEntries packages.
+// Must be called with l.mu held.
+func (l *CachingLoader) evict() {
+	if l.opts.MaxEntries <= 0 {
+		return
+	}
+	for el := l.lru.Back(); el != nil && len(l.cache) > l.opts.MaxEntries; {
+		prev := el.Prev()
+		if e := el.Value.(*entry); e.isReady() {
+			l.remove(e)
+			l.stats.Evictions++
+		}
+		el = prev
 	}
-	return result, nil
 }
 
 // LoadRules loads the packages containing labels and returns the bazel.Rules represented by them.
@@ -175,18 +532,38 @@ func distinctPkgs(labels []bazel.Label) []string {
 // Siblings returns all the targets in all the packages that define the files in 'fileNames'.
 // For example, if fileNames = {'foo/bar/Bar.java'}, and there's a BUILD file in foo/bar/, we return all the targets in the package defined by that BUILD file.
 func Siblings(ctx context.Context, loader Loader, workspaceDir string, fileNames []string) (packages map[string]*bazel.Package, fileToPkgName map[string]string, err error) {
+	return SiblingsWithCache(ctx, loader, workspaceDir, fileNames, nil)
+}
+
+// SiblingsWithCache is like Siblings, but looks up and records the packages that directories belong to in cache,
+// so that callers sharing a cache don't search the file system for the same BUILD files twice.
+// If cache is nil, a new one is used for this call only.
+func SiblingsWithCache(ctx context.Context, loader Loader, workspaceDir string, fileNames []string, cache *PackageNameCache) (packages map[string]*bazel.Package, fileToPkgName map[string]string, err error) {
 	tctx, endSpan := compat.NewLocalSpan(ctx, "Jade: Find BUILD packages of files")
 	var wg sync.WaitGroup
 	var mu sync.Mutex
 	var pkgs []string
 	pkgsSet := make(map[string]bool)
 	fileToPkgName = make(map[string]string)
+	if cache == nil {
+		cache = NewPackageNameCache()
+	}
+	if r, ok := loader.(FileResolvingLoader); ok {
+		packages, fileToPkgName, err := resolveFiles(ctx, r, fileNames, cache)
+		if err != ErrResolveFilesUnsupported {
+			endSpan()
+			return packages, fileToPkgName, err
+		}
+	}
 	for _, f := range fileNames {
 		f := f
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			if p := findPackageName(tctx, workspaceDir, f); p != "" {
+			if tctx.Err() != nil {
+				return
+			}
+			if p := findPackageName(tctx, workspaceDir, f, cache); p != "" {
 				mu.Lock()
 				fileToPkgName[f] = p
 				if !pkgsSet[p] {
@@ -199,18 +576,183 @@ func Siblings(ctx context.Context, loader Loader, workspaceDir string, fileNames
 	}
 	wg.Wait()
 	endSpan()
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
 	packages, err = loader.Load(ctx, pkgs)
 	return packages, fileToPkgName, err
 }
 
+// resolveFiles is like SiblingsWithCache, but lets loader find the packages of the files whose directories aren't in cache,
+// and load them in the same call.
+func resolveFiles(ctx context.Context, loader FileResolvingLoader, fileNames []string, cache *PackageNameCache) (map[string]*bazel.Package, map[string]string, error) {
+	fileToPkgName := make(map[string]string)
+	var pkgs, toResolve []string
+	for _, f := range fileNames {
+		if p, ok := cache.get(filepath.Dir(f)); !ok {
+			toResolve = append(toResolve, f)
+		} else if p != "" {
+			fileToPkgName[f] = p
+			pkgs = append(pkgs, p)
+		}
+	}
+	packages := make(map[string]*bazel.Package)
+	if len(toResolve) > 0 {
+		resolved, resolvedFileToPkgName, err := loader.ResolveFiles(ctx, toResolve, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, f := range toResolve {
+			p := resolvedFileToPkgName[f]
+			cache.put([]string{filepath.Dir(f)}, p)
+			if p != "" {
+				fileToPkgName[f] = p
+			}
+		}
+		for name, pkg := range resolved {
+			packages[name] = pkg
+		}
+	}
+	if len(pkgs) > 0 {
+		loaded, err := loader.Load(ctx, pkgs)
+		if err != nil {
+			return nil, nil, err
+		}
+		for name, pkg := range loaded {
+			packages[name] = pkg
+		}
+	}
+	return packages, fileToPkgName, nil
+}
+
 // findPackageName finds the name of the package that the file is in.
-func findPackageName(ctx context.Context, workspaceDir string, filename string) string {
-	for dir := filepath.Dir(filename); dir != "."; dir = filepath.Dir(dir) {
-		if _, err := compat.FileStat(ctx, filepath.Join(workspaceDir, dir, "BUILD")); !os.IsNotExist(err) {
-			return dir
+// It walks up from the file's directory until it finds a BUILD file, stopping at the workspace root.
+// Directories visited along the way are recorded in 'cache', so files sharing ancestors don't look them up again.
+func findPackageName(ctx context.Context, workspaceDir string, filename string, cache *PackageNameCache) string {
+	var visited []string
+	result := ""
+	for dir := filepath.Dir(filename); !atWorkspaceBoundary(dir); dir = filepath.Dir(dir) {
+		if p, ok := cache.get(dir); ok {
+			result = p
+			break
+		}
+		visited = append(visited, dir)
+		if cache.hasBuildFile(ctx, workspaceDir, dir) {
+			result = dir
+			break
+		}
+	}
+	cache.put(visited, result)
+	return result
+}
+
+// AncestorPackages returns the names of the packages whose directories enclose pkgName's directory, nearest first.
+// The workspace root isn't considered a package, in line with Siblings.
+// Directories are looked up through cache, as in SiblingsWithCache.
+func AncestorPackages(ctx context.Context, workspaceDir, pkgName string, cache *PackageNameCache) []string {
+	var ret []string
+	for p := findPackageName(ctx, workspaceDir, pkgName, cache); p != ""; p = findPackageName(ctx, workspaceDir, p, cache) {
+		ret = append(ret, filepath.ToSlash(p))
+	}
+	return ret
+}
+
+// atWorkspaceBoundary returns true if findPackageName should stop walking up at 'dir'.
+// That's the case when dir is the workspace root itself, or when it isn't inside the workspace at all (e.g., "/" or "..").
+func atWorkspaceBoundary(dir string) bool {
+	return dir == "." || filepath.IsAbs(dir) || dir == ".." || strings.HasPrefix(dir, ".."+string(filepath.Separator))
+}
+
+// PackageNameCache maps directories (relative to the workspace root) to the name of the package they belong to,
+// or to "" if they don't belong to any package.
+// It also records the entries of the directories it lists to look for BUILD files, so that the many directories that class names
+// map to but don't exist, e.g. src/main/java/org/junit for org.junit.Test, are known to be missing without touching the file system.
+// Entries are never invalidated, so a cache should live no longer than a single Jadep invocation.
+// It is safe for concurrent use.
+type PackageNameCache struct {
+	mu    sync.Mutex // guards names and listings
+	names map[string]string
+
+	// listings maps directories to the names of their entries, or to nil if they don't exist.
+	listings map[string]map[string]bool
+}
+
+// NewPackageNameCache returns an empty PackageNameCache.
+func NewPackageNameCache() *PackageNameCache {
+	return &PackageNameCache{names: make(map[string]string), listings: make(map[string]map[string]bool)}
+}
+
+// hasBuildFile returns true if dir, relative to workspaceDir, has a BUILD file.
+// Each directory is listed at most once, and a directory whose parent was listed without it isn't looked up at all.
+func (c *PackageNameCache) hasBuildFile(ctx context.Context, workspaceDir, dir string) bool {
+	c.mu.Lock()
+	entries, ok := c.listings[dir]
+	if !ok {
+		if parent, listed := c.listings[filepath.Dir(dir)]; listed && !parent[filepath.Base(dir)] {
+			ok = true
+		}
+	}
+	c.mu.Unlock()
+	if ok {
+		return entries["BUILD"]
+	}
+
+	names, err := compat.ReadDirNames(ctx, filepath.Join(workspaceDir, dir))
+	if err != nil && !os.IsNotExist(err) {
+		// Directories that can't be listed might still be traversable, so fall back to looking for the BUILD file itself.
+		_, err := compat.FileStat(ctx, filepath.Join(workspaceDir, dir, "BUILD"))
+		return !os.IsNotExist(err)
+	}
+	if err == nil {
+		entries = make(map[string]bool)
+		for _, n := range names {
+			entries[n] = true
+		}
+	}
+	c.mu.Lock()
+	c.listings[dir] = entries
+	c.mu.Unlock()
+	return entries["BUILD"]
+}
+
+// Forget drops what c knows about dir, e.g. after a BUILD file was created in it: the packages of dir and its subdirectories,
+// and the listings of dir and its ancestors, which might not have had dir or its BUILD file yet.
+func (c *PackageNameCache) Forget(dir string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for d := range c.names {
+		if dir == "." || d == dir || strings.HasPrefix(d, dir+string(filepath.Separator)) {
+			delete(c.names, d)
 		}
 	}
-	return ""
+	for d := dir; !atWorkspaceBoundary(d); d = filepath.Dir(d) {
+		delete(c.listings, d)
+	}
+	delete(c.listings, ".")
+}
+
+// Reset drops everything c knows, e.g. before a long-lived server answers a request, since any BUILD file might have changed since.
+func (c *PackageNameCache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.names = make(map[string]string)
+	c.listings = make(map[string]map[string]bool)
+}
+
+func (c *PackageNameCache) get(dir string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.names[dir]
+	return p, ok
+}
+
+// put records that all of 'dirs' belong to the package named pkgName.
+func (c *PackageNameCache) put(dirs []string, pkgName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, d := range dirs {
+		c.names[d] = pkgName
+	}
 }
 
 // FilteringLoader is a Loader that loads using another Loader, after filtering the list of requested packages.
@@ -220,17 +762,71 @@ type FilteringLoader struct {
 
 	// blacklistedPackages is a set of packages we will not load.
 	// The underlying Loader will not be asked to load packages in this set.
+	// Use SetBlacklistedPackages to change it once the FilteringLoader is in use.
 	BlacklistedPackages map[string]bool
+
+	mu sync.RWMutex // guards BlacklistedPackages
+}
+
+// SetBlacklistedPackages atomically replaces the set of packages we will not load.
+// Packages that were already loaded, e.g. by a CachingLoader wrapping l, are not affected.
+func (l *FilteringLoader) SetBlacklistedPackages(blacklistedPackages map[string]bool) {
+	l.mu.Lock()
+	l.BlacklistedPackages = blacklistedPackages
+	l.mu.Unlock()
 }
 
 // Load sends an RPC to a PkgLoader service, requesting it to interpret 'packages' (e.g., "foo/bar" to interpret <root>/foo/bar/BUILD)
+// If all of 'packages' are blacklisted, the underlying Loader isn't called at all.
 func (l *FilteringLoader) Load(ctx context.Context, packages []string) (map[string]*bazel.Package, error) {
+	filtered := l.filter(packages)
+	if len(filtered) == 0 && len(packages) > 0 {
+		return make(map[string]*bazel.Package), nil
+	}
+	return l.Loader.Load(ctx, filtered)
+}
+
+// LoadWithErrors is like Load, but also returns the errors of the packages that failed to evaluate, if the underlying loader reports them.
+func (l *FilteringLoader) LoadWithErrors(ctx context.Context, packages []string) (map[string]*bazel.Package, []*PackageError, error) {
+	filtered := l.filter(packages)
+	if len(filtered) == 0 && len(packages) > 0 {
+		return make(map[string]*bazel.Package), nil, nil
+	}
+	return LoadWithErrors(ctx, l.Loader, filtered)
+}
+
+// ResolveFiles resolves files using the underlying loader if it's a FileResolvingLoader, without loading blacklisted packages.
+func (l *FilteringLoader) ResolveFiles(ctx context.Context, fileNames []string, excludedPackages map[string]bool) (map[string]*bazel.Package, map[string]string, error) {
+	r, ok := l.Loader.(FileResolvingLoader)
+	if !ok {
+		return nil, nil, ErrResolveFilesUnsupported
+	}
+	l.mu.RLock()
+	// SetBlacklistedPackages replaces the map rather than modifying it, so it's safe to use after unlocking.
+	excluded := l.BlacklistedPackages
+	l.mu.RUnlock()
+	if len(excludedPackages) > 0 {
+		merged := make(map[string]bool)
+		for p := range excluded {
+			merged[p] = true
+		}
+		for p := range excludedPackages {
+			merged[p] = true
+		}
+		excluded = merged
+	}
+	return r.ResolveFiles(ctx, fileNames, excluded)
+}
+
+// filter returns the packages that aren't blacklisted.
+func (l *FilteringLoader) filter(packages []string) []string {
 	var filtered []string
+	l.mu.RLock()
 	for _, p := range packages {
 		if !l.BlacklistedPackages[p] {
 			filtered = append(filtered, p)
 		}
 	}
-
-	return l.Loader.Load(ctx, filtered)
+	l.mu.RUnlock()
+	return filtered
 }
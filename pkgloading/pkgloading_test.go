@@ -15,10 +15,13 @@
 package pkgloading
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"context"
 	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
@@ -145,6 +148,12 @@ func TestFindPackageName(t *testing.T) {
 			filename:    "java/com/Jade.java",
 			wantPkgName: "",
 		},
+		{
+			desc:             "Files outside the workspace are not in any package.",
+			filename:         "../java/com/Jade.java",
+			existingPackages: []string{"java/com"},
+			wantPkgName:      "",
+		},
 	}
 	for _, test := range tests {
 		test := test
@@ -157,7 +166,7 @@ func TestFindPackageName(t *testing.T) {
 				}
 			}
 			defer os.RemoveAll(workspaceDir)
-			actual := findPackageName(context.Background(), workspaceDir, test.filename)
+			actual := findPackageName(context.Background(), workspaceDir, test.filename, NewPackageNameCache())
 			if actual != test.wantPkgName {
 				t.Errorf("%s: findPackageName(%s) = %s, want %s", test.desc, test.filename, actual, test.wantPkgName)
 			}
@@ -165,6 +174,145 @@ func TestFindPackageName(t *testing.T) {
 	}
 }
 
+// TestFindPackageNameCache tests that findPackageName consults and fills its directory cache,
+// so files sharing ancestors don't stat() the same directories again.
+func TestFindPackageNameCache(t *testing.T) {
+	tmpRoot, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpRoot)
+
+	cache := NewPackageNameCache()
+	cache.put([]string{"java/com"}, "java")
+
+	// There's no BUILD file on disk, so the result must come from the cache.
+	if got := findPackageName(context.Background(), tmpRoot, "java/com/x/y/Foo.java", cache); got != "java" {
+		t.Errorf("findPackageName(java/com/x/y/Foo.java) = %q, want %q", got, "java")
+	}
+	want := map[string]string{
+		"java/com":     "java",
+		"java/com/x":   "java",
+		"java/com/x/y": "java",
+	}
+	if diff := cmp.Diff(cache.names, want); diff != "" {
+		t.Errorf("cache diff: (-got +want)\n%s", diff)
+	}
+}
+
+// TestFindPackageNameListings tests that findPackageName lists each directory once, and doesn't look up directories
+// that a listed parent doesn't contain.
+func TestFindPackageNameListings(t *testing.T) {
+	tmpRoot, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpRoot)
+	if err := os.MkdirAll(filepath.Join(tmpRoot, "java/com"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpRoot, "java/com/BUILD"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := NewPackageNameCache()
+	if got := findPackageName(context.Background(), tmpRoot, "java/com/x/y/Foo.java", cache); got != "java/com" {
+		t.Errorf("findPackageName(java/com/x/y/Foo.java) = %q, want %q", got, "java/com")
+	}
+	if got := findPackageName(context.Background(), tmpRoot, "java/com/z/Bar.java", cache); got != "java/com" {
+		t.Errorf("findPackageName(java/com/z/Bar.java) = %q, want %q", got, "java/com")
+	}
+	want := map[string]map[string]bool{
+		"java/com/x/y": nil,
+		"java/com/x":   nil,
+		"java/com":     {"BUILD": true},
+	}
+	if diff := cmp.Diff(cache.listings, want); diff != "" {
+		t.Errorf("listings diff: (-got +want)\n%s", diff)
+	}
+}
+
+// TestPackageNameCacheForget tests that a BUILD file created after its directory was looked up is found once the cache forgets the directory.
+func TestPackageNameCacheForget(t *testing.T) {
+	tmpRoot, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpRoot)
+	if err := os.MkdirAll(filepath.Join(tmpRoot, "java/com/x"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpRoot, "java/com/BUILD"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := NewPackageNameCache()
+	if got := findPackageName(context.Background(), tmpRoot, "java/com/x/Foo.java", cache); got != "java/com" {
+		t.Errorf("findPackageName(java/com/x/Foo.java) = %q, want %q", got, "java/com")
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpRoot, "java/com/x/BUILD"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if got := findPackageName(context.Background(), tmpRoot, "java/com/x/Foo.java", cache); got != "java/com" {
+		t.Errorf("findPackageName(java/com/x/Foo.java) before Forget = %q, want the cached %q", got, "java/com")
+	}
+	cache.Forget("java/com/x")
+	if got := findPackageName(context.Background(), tmpRoot, "java/com/x/Foo.java", cache); got != "java/com/x" {
+		t.Errorf("findPackageName(java/com/x/Foo.java) after Forget = %q, want %q", got, "java/com/x")
+	}
+	if got := findPackageName(context.Background(), tmpRoot, "java/com/Bar.java", cache); got != "java/com" {
+		t.Errorf("findPackageName(java/com/Bar.java) after Forget = %q, want %q", got, "java/com")
+	}
+}
+
+func TestPackageNameCacheReset(t *testing.T) {
+	tmpRoot, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpRoot)
+	if err := os.MkdirAll(filepath.Join(tmpRoot, "java/com/x"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := NewPackageNameCache()
+	if got := findPackageName(context.Background(), tmpRoot, "java/com/x/Foo.java", cache); got != "" {
+		t.Errorf("findPackageName(java/com/x/Foo.java) = %q, want none", got)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpRoot, "java/com/BUILD"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	cache.Reset()
+	if got := findPackageName(context.Background(), tmpRoot, "java/com/x/Foo.java", cache); got != "java/com" {
+		t.Errorf("findPackageName(java/com/x/Foo.java) after Reset = %q, want %q", got, "java/com")
+	}
+}
+
+func TestAncestorPackages(t *testing.T) {
+	tmpRoot, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpRoot)
+	for _, dir := range []string{"", "java", "java/com/x"} {
+		if err := os.MkdirAll(filepath.Join(tmpRoot, dir), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(tmpRoot, dir, "BUILD"), nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cache := NewPackageNameCache()
+	got := AncestorPackages(context.Background(), tmpRoot, "java/com/x/y/z", cache)
+	if diff := cmp.Diff(got, []string{"java/com/x", "java"}); diff != "" {
+		t.Errorf("AncestorPackages(java/com/x/y/z) diff (-got +want):\n%s", diff)
+	}
+	if p, ok := cache.get("java/com"); !ok || p != "java" {
+		t.Errorf("cache.get(java/com) = %q, %v, want %q, true", p, ok, "java")
+	}
+}
+
 func TestCachingLoaderLoad(t *testing.T) {
 	var tests = []struct {
 		desc string
@@ -241,9 +389,185 @@ func TestCachingLoaderLoadNonExistingPackage(t *testing.T) {
 	}
 }
 
+// cancellingLoader is a Loader that fails with ctx.Err() when ctx is done, and otherwise delegates to a StubLoader.
+type cancellingLoader struct {
+	loadertest.StubLoader
+}
+
+func (l *cancellingLoader) Load(ctx context.Context, packages []string) (map[string]*bazel.Package, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return l.StubLoader.Load(ctx, packages)
+}
+
+// TestCachingLoaderDoesntCacheCancellation tests that loads that failed because their context was cancelled
+// are attempted again by later calls to Load.
+func TestCachingLoaderDoesntCacheCancellation(t *testing.T) {
+	l := &cancellingLoader{loadertest.StubLoader{Pkgs: map[string]*bazel.Package{"a": {}}}}
+	cl := NewCachingLoader(l)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := cl.Load(ctx, []string{"a"}); err != context.Canceled {
+		t.Errorf("Load(a) with a cancelled context has error %v, want %v", err, context.Canceled)
+	}
+
+	got, err := cl.Load(context.Background(), []string{"a"})
+	if err != nil {
+		t.Errorf("Load(a) has error %v, expected nil", err)
+	}
+	if diff := cmp.Diff(got, map[string]*bazel.Package{"a": {}}); diff != "" {
+		t.Errorf("Load() diff: (-got +want)\n%s", diff)
+	}
+}
+
+// blockingLoader is a Loader whose first call blocks until its context is done, and fails with ctx.Err().
+// Later calls delegate to a StubLoader.
+type blockingLoader struct {
+	loadertest.StubLoader
+	started chan struct{}
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (l *blockingLoader) Load(ctx context.Context, packages []string) (map[string]*bazel.Package, error) {
+	l.mu.Lock()
+	l.calls++
+	first := l.calls == 1
+	l.mu.Unlock()
+	if first {
+		close(l.started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return l.StubLoader.Load(ctx, packages)
+}
+
+// TestCachingLoaderRetriesCancellationOfOtherCalls tests that a call waiting for packages that another call is loading
+// loads them itself if the other call's context is cancelled.
+func TestCachingLoaderRetriesCancellationOfOtherCalls(t *testing.T) {
+	l := &blockingLoader{StubLoader: loadertest.StubLoader{Pkgs: map[string]*bazel.Package{"a": {}}}, started: make(chan struct{})}
+	cl := NewCachingLoader(l)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	firstDone := make(chan error)
+	go func() {
+		_, err := cl.Load(ctx, []string{"a"})
+		firstDone <- err
+	}()
+	<-l.started
+
+	type loadResult struct {
+		pkgs map[string]*bazel.Package
+		err  error
+	}
+	secondDone := make(chan loadResult)
+	go func() {
+		pkgs, err := cl.Load(context.Background(), []string{"a"})
+		secondDone <- loadResult{pkgs, err}
+	}()
+	// Cancel the first call once the second is waiting for it.
+	for cl.Stats().Hits == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	if err := <-firstDone; err != context.Canceled {
+		t.Errorf("Load(a) with a cancelled context has error %v, want %v", err, context.Canceled)
+	}
+	got := <-secondDone
+	if got.err != nil {
+		t.Errorf("Load(a) waiting for a cancelled load has error %v, want nil", got.err)
+	}
+	if diff := cmp.Diff(got.pkgs, map[string]*bazel.Package{"a": {}}); diff != "" {
+		t.Errorf("Load() diff: (-got +want)\n%s", diff)
+	}
+}
+
+func TestCachingLoaderEvictsLeastRecentlyUsed(t *testing.T) {
+	l := &loadertest.StubLoader{Pkgs: map[string]*bazel.Package{"a": {}, "b": {}, "c": {}}}
+	cl := NewCachingLoaderWithOptions(l, CachingLoaderOptions{MaxEntries: 2})
+	for _, pkgs := range [][]string{{"a"}, {"b"}, {"a"}, {"c"}, {"a"}, {"b"}} {
+		if _, err := cl.Load(context.Background(), pkgs); err != nil {
+			t.Errorf("Load(%v) has error %v, expected nil", pkgs, err)
+		}
+	}
+	// Loading 'c' evicts 'b', which was used less recently than 'a'.
+	wantUnderlyingLoadCalls := [][]string{{"a"}, {"b"}, {"c"}, {"b"}}
+	if diff := cmp.Diff(l.RecordedCalls, wantUnderlyingLoadCalls); diff != "" {
+		t.Errorf("Recorded calls diff: (-got +want)\n%s", diff)
+	}
+	wantStats := CacheStats{Entries: 2, Hits: 2, Misses: 4, Evictions: 2}
+	if diff := cmp.Diff(cl.Stats(), wantStats); diff != "" {
+		t.Errorf("Stats() diff: (-got +want)\n%s", diff)
+	}
+}
+
+// failingLoader is a Loader that always fails, and counts its calls.
+type failingLoader struct {
+	calls int
+}
+
+func (l *failingLoader) Load(ctx context.Context, packages []string) (map[string]*bazel.Package, error) {
+	l.calls++
+	return nil, fmt.Errorf("failed")
+}
+
+func TestCachingLoaderErrorTTL(t *testing.T) {
+	l := &failingLoader{}
+	cl := NewCachingLoaderWithOptions(l, CachingLoaderOptions{ErrorTTL: time.Minute})
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	cl.now = func() time.Time { return now }
+
+	for _, d := range []time.Duration{0, 30 * time.Second, 2 * time.Minute} {
+		now = now.Add(d)
+		if _, err := cl.Load(context.Background(), []string{"a"}); err == nil {
+			t.Errorf("Load(a) has nil error, want non-nil")
+		}
+	}
+	// The second Load is served from the cache; the third happens after the failure expired.
+	if l.calls != 2 {
+		t.Errorf("Underlying loader was called %d times, want 2", l.calls)
+	}
+}
+
+func TestCachingLoaderInvalidate(t *testing.T) {
+	l := &loadertest.StubLoader{Pkgs: map[string]*bazel.Package{"a": {}, "b": {}}}
+	cl := NewCachingLoader(l)
+	if _, err := cl.Load(context.Background(), []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	cl.Invalidate([]string{"a", "nonexistent"})
+	if _, err := cl.Load(context.Background(), []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	wantUnderlyingLoadCalls := [][]string{{"a", "b"}, {"a"}}
+	if diff := cmp.Diff(l.RecordedCalls, wantUnderlyingLoadCalls); diff != "" {
+		t.Errorf("Recorded calls diff: (-got +want)\n%s", diff)
+	}
+}
+
+func TestCachingLoaderChunks(t *testing.T) {
+	l := &loadertest.StubLoader{Pkgs: map[string]*bazel.Package{"a": {}, "b": {}, "c": {}, "d": {}, "e": {}}}
+	cl := NewCachingLoaderWithOptions(l, CachingLoaderOptions{ChunkSize: 2})
+	got, err := cl.Load(context.Background(), []string{"a", "b", "c", "d", "e"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 5 {
+		t.Errorf("Load returned %d packages, want 5", len(got))
+	}
+	wantUnderlyingLoadCalls := [][]string{{"a", "b"}, {"c", "d"}, {"e"}}
+	if diff := cmp.Diff(l.RecordedCalls, wantUnderlyingLoadCalls); diff != "" {
+		t.Errorf("Recorded calls diff: (-got +want)\n%s", diff)
+	}
+}
+
 func TestFilteringLoader(t *testing.T) {
 	l := &loadertest.StubLoader{}
-	fl := &FilteringLoader{l, map[string]bool{"third_party/maven/repository/central": true}}
+	fl := &FilteringLoader{Loader: l, BlacklistedPackages: map[string]bool{"third_party/maven/repository/central": true}}
 
 	in := []string{"a", "b", "third_party/maven/repository/central"}
 	_, err := fl.Load(context.Background(), in)
@@ -255,3 +579,152 @@ func TestFilteringLoader(t *testing.T) {
 		t.Errorf("Recorded calls diff: (-got +want)\n%s", diff)
 	}
 }
+
+// brokenPkgsLoader is an ErrorReportingLoader that reports its packages as failing to evaluate.
+type brokenPkgsLoader struct {
+	loadertest.StubLoader
+	errs map[string]*PackageError
+}
+
+func (l *brokenPkgsLoader) LoadWithErrors(ctx context.Context, packages []string) (map[string]*bazel.Package, []*PackageError, error) {
+	pkgs, err := l.StubLoader.Load(ctx, packages)
+	var errs []*PackageError
+	for _, p := range packages {
+		if e, ok := l.errs[p]; ok {
+			errs = append(errs, e)
+		}
+	}
+	return pkgs, errs, err
+}
+
+func TestCachingLoaderPackageErrors(t *testing.T) {
+	broken := &PackageError{PkgName: "broken", Message: "syntax error", Line: 12}
+	noLine := &PackageError{PkgName: "a/noline", Message: "missing load()"}
+	l := &brokenPkgsLoader{
+		StubLoader: loadertest.StubLoader{Pkgs: map[string]*bazel.Package{"ok": {}}},
+		errs:       map[string]*PackageError{"broken": broken, "a/noline": noLine},
+	}
+	cl := NewCachingLoader(&FilteringLoader{Loader: l})
+	for i := 0; i < 2; i++ {
+		pkgs, errs, err := cl.LoadWithErrors(context.Background(), []string{"ok", "broken"})
+		if err != nil {
+			t.Fatalf("LoadWithErrors returned error %v, want nil", err)
+		}
+		if diff := cmp.Diff(pkgs, map[string]*bazel.Package{"ok": {}}); diff != "" {
+			t.Errorf("LoadWithErrors returned diff in packages (-got +want):\n%s", diff)
+		}
+		if diff := cmp.Diff(errs, []*PackageError{broken}); diff != "" {
+			t.Errorf("LoadWithErrors returned diff in errors (-got +want):\n%s", diff)
+		}
+	}
+	if _, err := cl.Load(context.Background(), []string{"a/noline"}); err != nil {
+		t.Fatalf("Load returned error %v, want nil", err)
+	}
+	if diff := cmp.Diff(l.RecordedCalls, [][]string{{"broken", "ok"}, {"a/noline"}}); diff != "" {
+		t.Errorf("Recorded calls diff: (-got +want)\n%s", diff)
+	}
+	if diff := cmp.Diff(cl.PackageErrors(), []*PackageError{noLine, broken}); diff != "" {
+		t.Errorf("PackageErrors returned diff (-got +want):\n%s", diff)
+	}
+
+	var got []string
+	for _, e := range cl.PackageErrors() {
+		got = append(got, e.Error())
+	}
+	want := []string{"//a/noline: missing load()", "//broken: BUILD:12: syntax error"}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("Error() returned diff (-got +want):\n%s", diff)
+	}
+}
+
+// resolvingLoader is a FileResolvingLoader whose files are in the package named by their directory, if it's in Pkgs.
+type resolvingLoader struct {
+	loadertest.StubLoader
+	unsupported   bool
+	resolveCalls  [][]string
+	excludedCalls []map[string]bool
+}
+
+func (l *resolvingLoader) ResolveFiles(ctx context.Context, fileNames []string, excludedPackages map[string]bool) (map[string]*bazel.Package, map[string]string, error) {
+	if l.unsupported {
+		return nil, nil, ErrResolveFilesUnsupported
+	}
+	l.resolveCalls = append(l.resolveCalls, fileNames)
+	l.excludedCalls = append(l.excludedCalls, excludedPackages)
+	pkgs := make(map[string]*bazel.Package)
+	fileToPkgName := make(map[string]string)
+	for _, f := range fileNames {
+		dir := filepath.Dir(f)
+		if pkg, ok := l.Pkgs[dir]; ok {
+			fileToPkgName[f] = dir
+			if !excludedPackages[dir] {
+				pkgs[dir] = pkg
+			}
+		}
+	}
+	return pkgs, fileToPkgName, nil
+}
+
+func TestSiblingsResolvesFiles(t *testing.T) {
+	foo := &bazel.Package{Path: "foo"}
+	bar := &bazel.Package{Path: "bar"}
+	slow := &bazel.Package{Path: "slow"}
+	l := &resolvingLoader{StubLoader: loadertest.StubLoader{Pkgs: map[string]*bazel.Package{"foo": foo, "bar": bar, "slow": slow}}}
+	loader := NewCachingLoader(&FilteringLoader{Loader: l, BlacklistedPackages: map[string]bool{"slow": true}})
+	cache := NewPackageNameCache()
+	cache.put([]string{"bar"}, "bar")
+
+	pkgs, fileToPkgName, err := SiblingsWithCache(context.Background(), loader, "/nonexistent", []string{"foo/Foo.java", "bar/Bar.java", "slow/Slow.java", "nopkg/NoPkg.java"}, cache)
+	if err != nil {
+		t.Fatalf("SiblingsWithCache returned error %v, want nil", err)
+	}
+	if diff := cmp.Diff(pkgs, map[string]*bazel.Package{"foo": foo, "bar": bar}); diff != "" {
+		t.Errorf("SiblingsWithCache returned diff in packages (-got +want):\n%s", diff)
+	}
+	wantFileToPkgName := map[string]string{"foo/Foo.java": "foo", "bar/Bar.java": "bar", "slow/Slow.java": "slow"}
+	if diff := cmp.Diff(fileToPkgName, wantFileToPkgName); diff != "" {
+		t.Errorf("SiblingsWithCache returned diff in file to package names (-got +want):\n%s", diff)
+	}
+	// Files in directories that are already in the cache aren't resolved, and their packages are loaded as usual.
+	if diff := cmp.Diff(l.resolveCalls, [][]string{{"foo/Foo.java", "slow/Slow.java", "nopkg/NoPkg.java"}}); diff != "" {
+		t.Errorf("ResolveFiles calls diff (-got +want):\n%s", diff)
+	}
+	if diff := cmp.Diff(l.excludedCalls, []map[string]bool{{"slow": true}}); diff != "" {
+		t.Errorf("ResolveFiles excluded packages diff (-got +want):\n%s", diff)
+	}
+	if diff := cmp.Diff(l.RecordedCalls, [][]string{{"bar"}}); diff != "" {
+		t.Errorf("Load calls diff (-got +want):\n%s", diff)
+	}
+	wantCache := map[string]string{"foo": "foo", "bar": "bar", "slow": "slow", "nopkg": ""}
+	if diff := cmp.Diff(cache.names, wantCache); diff != "" {
+		t.Errorf("cache diff: (-got +want)\n%s", diff)
+	}
+}
+
+// TestSiblingsResolveFilesUnsupported tests that Siblings searches for BUILD files itself when the loader can't resolve files.
+func TestSiblingsResolveFilesUnsupported(t *testing.T) {
+	workspaceDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workspaceDir)
+	if err := os.MkdirAll(filepath.Join(workspaceDir, "foo"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(workspaceDir, "foo", "BUILD"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	foo := &bazel.Package{Path: "foo"}
+	l := &resolvingLoader{StubLoader: loadertest.StubLoader{Pkgs: map[string]*bazel.Package{"foo": foo}}, unsupported: true}
+
+	pkgs, fileToPkgName, err := Siblings(context.Background(), NewCachingLoader(l), workspaceDir, []string{"foo/Foo.java"})
+	if err != nil {
+		t.Fatalf("Siblings returned error %v, want nil", err)
+	}
+	if diff := cmp.Diff(pkgs, map[string]*bazel.Package{"foo": foo}); diff != "" {
+		t.Errorf("Siblings returned diff in packages (-got +want):\n%s", diff)
+	}
+	if diff := cmp.Diff(fileToPkgName, map[string]string{"foo/Foo.java": "foo"}); diff != "" {
+		t.Errorf("Siblings returned diff in file to package names (-got +want):\n%s", diff)
+	}
+}
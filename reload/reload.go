@@ -0,0 +1,116 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package reload keeps data read from files up to date in long-running processes, by reloading it when the files change.
+package reload
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"context"
+)
+
+// Watcher calls reload functions, e.g. future.Reloadable.Reload, when the files they read change.
+// It's safe for concurrent use.
+type Watcher struct {
+	mu      sync.Mutex
+	entries []*entry
+}
+
+type entry struct {
+	fileNames []string
+
+	// mtimes are the modification times of fileNames when they were last loaded. Missing files have a zero time.
+	mtimes []time.Time
+
+	reloads []func()
+}
+
+// Add registers reload functions to call, in order, when any of fileNames changes.
+// Data derived from the files should be reloaded by a later function than the data it's derived from.
+func (w *Watcher) Add(fileNames []string, reloads ...func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.entries = append(w.entries, &entry{fileNames, mtimes(fileNames), reloads})
+}
+
+// Check calls the reload functions of files that changed since they were added or last reloaded.
+// Returns the number of file sets that were reloaded.
+func (w *Watcher) Check() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	reloaded := 0
+	for _, e := range w.entries {
+		current := mtimes(e.fileNames)
+		if sameTimes(current, e.mtimes) {
+			continue
+		}
+		e.mtimes = current
+		log.Printf("Reloading %v", e.fileNames)
+		for _, f := range e.reloads {
+			f()
+		}
+		reloaded++
+	}
+	return reloaded
+}
+
+// ReloadAll calls all reload functions, whether or not their files changed.
+func (w *Watcher) ReloadAll() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, e := range w.entries {
+		e.mtimes = mtimes(e.fileNames)
+		for _, f := range e.reloads {
+			f()
+		}
+	}
+	log.Printf("Reloaded %d file set(s)", len(w.entries))
+}
+
+// Run calls Check every 'interval', until ctx is done.
+func (w *Watcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.Check()
+		}
+	}
+}
+
+func mtimes(fileNames []string) []time.Time {
+	ret := make([]time.Time, len(fileNames))
+	for i, f := range fileNames {
+		if info, err := os.Stat(f); err == nil {
+			ret[i] = info.ModTime()
+		}
+	}
+	return ret
+}
+
+func sameTimes(a, b []time.Time) bool {
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,78 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reload
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bazelbuild/tools_jvm_autodeps/future"
+)
+
+func TestWatcher(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	fileName := filepath.Join(tmpDir, "dict.csv")
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	write := func(content string, mtime time.Time) {
+		if err := ioutil.WriteFile(fileName, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(fileName, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("v1", t0)
+
+	content := future.NewReloadable(func() interface{} {
+		b, _ := ioutil.ReadFile(fileName)
+		return string(b)
+	})
+	// derived is reloaded after content, so it sees the new content.
+	derived := future.NewReloadable(func() interface{} { return content.Get().(string) + "!" })
+	w := &Watcher{}
+	w.Add([]string{fileName}, content.Reload, derived.Reload)
+
+	if got := w.Check(); got != 0 {
+		t.Errorf("Check() with unchanged files = %d, want 0", got)
+	}
+	if got := derived.Get(); got != "v1!" {
+		t.Errorf("derived.Get() = %q, want %q", got, "v1!")
+	}
+
+	write("v2", t0.Add(time.Second))
+	if got := w.Check(); got != 1 {
+		t.Errorf("Check() after a change = %d, want 1", got)
+	}
+	if got := derived.Get(); got != "v2!" {
+		t.Errorf("derived.Get() after Check() = %q, want %q", got, "v2!")
+	}
+
+	// ReloadAll reloads even when modification times don't change.
+	write("v3", t0.Add(time.Second))
+	if got := w.Check(); got != 0 {
+		t.Errorf("Check() with unchanged modification times = %d, want 0", got)
+	}
+	w.ReloadAll()
+	if got := derived.Get(); got != "v3!" {
+		t.Errorf("derived.Get() after ReloadAll() = %q, want %q", got, "v3!")
+	}
+}
@@ -16,6 +16,11 @@
 package resolverutil
 
 import (
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"context"
 	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
 	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
 )
@@ -53,3 +58,56 @@ classLoop:
 
 	return alreadySatisfied
 }
+
+// Sandbox wraps a resolver so that a panic in its Resolve method, or a call that takes longer than timeout, is returned
+// as an error of this resolver instead of crashing or stalling Jadep.
+// A timeout <= 0 means no timeout.
+// On timeout, the context passed to the wrapped resolver is cancelled, but the call isn't waited for.
+func Sandbox(r jadeplib.Resolver, timeout time.Duration) jadeplib.Resolver {
+	return &sandboxedResolver{r, timeout}
+}
+
+type sandboxedResolver struct {
+	resolver jadeplib.Resolver
+	timeout  time.Duration
+}
+
+// Name returns the name of the wrapped resolver.
+func (s *sandboxedResolver) Name() string {
+	return s.resolver.Name()
+}
+
+// Resolve calls the wrapped resolver in a separate goroutine, converting panics and timeouts to errors.
+func (s *sandboxedResolver) Resolve(ctx context.Context, classNames []jadeplib.ClassName, consumingRules map[bazel.Label]map[bazel.Label]bool) (map[jadeplib.ClassName][]*bazel.Rule, error) {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	type result struct {
+		resolved map[jadeplib.ClassName][]*bazel.Rule
+		err      error
+	}
+	// Buffered, so the goroutine doesn't leak when we stop waiting for it.
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				done <- result{nil, fmt.Errorf("resolver %s panicked: %v\n%s", s.resolver.Name(), p, debug.Stack())}
+			}
+		}()
+		resolved, err := s.resolver.Resolve(ctx, classNames, consumingRules)
+		done <- result{resolved, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.resolved, res.err
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("resolver %s timed out after %v", s.resolver.Name(), s.timeout)
+		}
+		return nil, fmt.Errorf("resolver %s was cancelled:\n%v", s.resolver.Name(), ctx.Err())
+	}
+}
@@ -15,8 +15,11 @@
 package resolverutil
 
 import (
+	"strings"
 	"testing"
+	"time"
 
+	"context"
 	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
 	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
 	"github.com/google/go-cmp/cmp"
@@ -86,3 +89,65 @@ func TestSatisfiedByExistingDeps(t *testing.T) {
 		})
 	}
 }
+
+func TestSandbox(t *testing.T) {
+	rule := bazel.NewRule("java_library", "x", "Foo", nil)
+	tests := []struct {
+		desc         string
+		resolve      func(ctx context.Context) (map[jadeplib.ClassName][]*bazel.Rule, error)
+		want         map[jadeplib.ClassName][]*bazel.Rule
+		wantErrorHas string
+	}{
+		{
+			desc: "Results are passed through",
+			resolve: func(ctx context.Context) (map[jadeplib.ClassName][]*bazel.Rule, error) {
+				return map[jadeplib.ClassName][]*bazel.Rule{"x.Foo": {rule}}, nil
+			},
+			want: map[jadeplib.ClassName][]*bazel.Rule{"x.Foo": {rule}},
+		},
+		{
+			desc: "Panics become errors",
+			resolve: func(ctx context.Context) (map[jadeplib.ClassName][]*bazel.Rule, error) {
+				panic("boom")
+			},
+			wantErrorHas: "resolver fake panicked: boom",
+		},
+		{
+			desc: "Slow resolvers time out",
+			resolve: func(ctx context.Context) (map[jadeplib.ClassName][]*bazel.Rule, error) {
+				<-ctx.Done()
+				time.Sleep(time.Second)
+				return map[jadeplib.ClassName][]*bazel.Rule{"x.Foo": {rule}}, nil
+			},
+			wantErrorHas: "resolver fake timed out after 10ms",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			r := Sandbox(&funcResolver{tt.resolve}, 10*time.Millisecond)
+			got, err := r.Resolve(context.Background(), []jadeplib.ClassName{"x.Foo"}, nil)
+			if tt.wantErrorHas == "" && err != nil {
+				t.Errorf("Resolve returned error %v, want nil", err)
+			}
+			if tt.wantErrorHas != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErrorHas)) {
+				t.Errorf("Resolve returned error %v, want error containing %q", err, tt.wantErrorHas)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("Resolve returned diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+type funcResolver struct {
+	resolve func(ctx context.Context) (map[jadeplib.ClassName][]*bazel.Rule, error)
+}
+
+func (r *funcResolver) Name() string {
+	return "fake"
+}
+
+func (r *funcResolver) Resolve(ctx context.Context, classNames []jadeplib.ClassName, consumingRules map[bazel.Label]map[bazel.Label]bool) (map[jadeplib.ClassName][]*bazel.Rule, error) {
+	return r.resolve(ctx)
+}
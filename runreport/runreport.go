@@ -0,0 +1,203 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package runreport records what a Jadep run did, and appends it to a report file for auditing.
+package runreport
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+	"github.com/bazelbuild/tools_jvm_autodeps/lang/java/parser"
+	"github.com/bazelbuild/tools_jvm_autodeps/pkgloading"
+)
+
+// Report describes a single Jadep run.
+type Report struct {
+	Time time.Time `json:"time"`
+
+	// Args are the files and rules Jadep was asked to fix.
+	Args []string `json:"args"`
+
+	// Targets describes what happened to each of Args, in order.
+	Targets []*Target `json:"targets"`
+
+	// PhaseMillis is the total time spent in each phase of the run, in milliseconds.
+	PhaseMillis map[string]int64 `json:"phase_ms"`
+
+	// SkippedPackages are the packages that failed to evaluate, e.g. because of a syntax error in their BUILD file.
+	SkippedPackages []SkippedPackage `json:"skipped_packages,omitempty"`
+
+	mu sync.Mutex // guards PhaseMillis
+}
+
+// Target describes what Jadep did for one of its arguments.
+type Target struct {
+	Arg string `json:"arg"`
+
+	// RulesFixed are the rules whose missing deps were computed.
+	RulesFixed []bazel.Label `json:"rules_fixed,omitempty"`
+
+	// AddedDeps maps each edited rule to the deps that were added to it.
+	AddedDeps map[bazel.Label][]bazel.Label `json:"added_deps,omitempty"`
+
+	// RelativeAddedDeps is AddedDeps with the added deps written as they appear in BUILD files, e.g. ":bar".
+	// It's only populated when relative labels were requested; AddedDeps always holds canonical labels.
+	RelativeAddedDeps map[bazel.Label][]string `json:"relative_added_deps,omitempty"`
+
+	// Unresolved are class names for which no rule was found.
+	Unresolved []jadeplib.ClassName `json:"unresolved,omitempty"`
+
+	// ClassErrors maps class names to the errors that prevented finding deps for them, e.g. a package that failed to load.
+	ClassErrors map[jadeplib.ClassName]string `json:"class_errors,omitempty"`
+
+	// SkippedFiles are the files that were skipped, or only partially parsed, because they can't be read or parsed.
+	SkippedFiles []SkippedFile `json:"skipped_files,omitempty"`
+
+	// Error describes why processing this argument stopped early, if it did.
+	Error string `json:"error,omitempty"`
+}
+
+// SkippedFile describes a file that was skipped, or only partially parsed, because it can't be read or parsed.
+type SkippedFile struct {
+	File string `json:"file"`
+
+	// Line and Offset locate the syntax error in the file, if there is one.
+	// Offset is in bytes from the beginning of the file.
+	Line   int `json:"line,omitempty"`
+	Offset int `json:"offset,omitempty"`
+
+	// Partial is true if the file wasn't skipped, but only the class names in its parts that could be parsed were used.
+	Partial bool `json:"partial,omitempty"`
+
+	Error string `json:"error"`
+}
+
+// SkippedPackage describes a package that failed to evaluate, and whose rules were therefore not considered.
+type SkippedPackage struct {
+	Package string `json:"package"`
+
+	// Line is the line of the BUILD file that the error is at, if it's known.
+	Line int `json:"line,omitempty"`
+
+	Error string `json:"error"`
+}
+
+// New returns a new Report of a run that started at 'now'.
+func New(now time.Time, args []string) *Report {
+	return &Report{Time: now, Args: args, PhaseMillis: make(map[string]int64)}
+}
+
+// NewTarget adds a Target for 'arg' to the report and returns it.
+func (r *Report) NewTarget(arg string) *Target {
+	t := &Target{Arg: arg}
+	r.Targets = append(r.Targets, t)
+	return t
+}
+
+// StartPhase starts timing a phase of the run, e.g. "parse". The returned function ends it.
+// Phases with the same name accumulate their durations.
+func (r *Report) StartPhase(name string) func() {
+	stopwatch := time.Now()
+	return func() {
+		r.mu.Lock()
+		r.PhaseMillis[name] += int64(time.Now().Sub(stopwatch) / time.Millisecond)
+		r.mu.Unlock()
+	}
+}
+
+// SetSkippedPackages records the packages that failed to evaluate.
+func (r *Report) SetSkippedPackages(errs []*pkgloading.PackageError) {
+	r.SkippedPackages = nil
+	for _, e := range errs {
+		r.SkippedPackages = append(r.SkippedPackages, SkippedPackage{Package: e.PkgName, Line: e.Line, Error: e.Message})
+	}
+}
+
+// SetRulesFixed records the rules whose missing deps were computed.
+func (t *Target) SetRulesFixed(rules []*bazel.Rule) {
+	t.RulesFixed = nil
+	for _, r := range rules {
+		t.RulesFixed = append(t.RulesFixed, r.Label())
+	}
+}
+
+// SetAddedDeps records the deps that were added to each rule.
+func (t *Target) SetAddedDeps(addedDeps map[*bazel.Rule][]bazel.Label) {
+	t.AddedDeps = make(map[bazel.Label][]bazel.Label)
+	for rule, deps := range addedDeps {
+		sorted := append([]bazel.Label(nil), deps...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		t.AddedDeps[rule.Label()] = sorted
+	}
+}
+
+// SetRelativeAddedDeps populates RelativeAddedDeps from AddedDeps.
+// Deps are made relative to basePkg, or to the package of the rule they were added to if basePkg is empty.
+func (t *Target) SetRelativeAddedDeps(basePkg string) {
+	t.RelativeAddedDeps = make(map[bazel.Label][]string)
+	for rule, deps := range t.AddedDeps {
+		pkg := basePkg
+		if pkg == "" {
+			pkg, _ = rule.Split()
+		}
+		for _, d := range deps {
+			t.RelativeAddedDeps[rule] = append(t.RelativeAddedDeps[rule], d.RelativeTo(pkg))
+		}
+	}
+}
+
+// SetSkippedFiles records the files that were skipped, or only partially parsed, because they can't be read or parsed.
+func (t *Target) SetSkippedFiles(errs []*parser.FileError) {
+	t.SkippedFiles = nil
+	for _, e := range errs {
+		t.SkippedFiles = append(t.SkippedFiles, SkippedFile{File: e.FileName, Line: e.Line, Offset: e.Offset, Partial: e.Partial, Error: e.Description()})
+	}
+}
+
+// SetClassErrors records the errors that affected individual class names.
+func (t *Target) SetClassErrors(errs map[jadeplib.ClassName]error) {
+	t.ClassErrors = nil
+	for cls, err := range errs {
+		if t.ClassErrors == nil {
+			t.ClassErrors = make(map[jadeplib.ClassName]string)
+		}
+		t.ClassErrors[cls] = err.Error()
+	}
+}
+
+// AppendTo appends the report to fileName as a single line of JSON.
+func (r *Report) AppendTo(fileName string) error {
+	r.mu.Lock()
+	b, err := json.Marshal(r)
+	r.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("error serializing run report:\n%v", err)
+	}
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening report file %s:\n%v", fileName, err)
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing report file %s:\n%v", fileName, err)
+	}
+	return f.Close()
+}
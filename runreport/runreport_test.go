@@ -0,0 +1,165 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runreport
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+	"github.com/bazelbuild/tools_jvm_autodeps/lang/java/parser"
+	"github.com/bazelbuild/tools_jvm_autodeps/pkgloading"
+	"github.com/bazelbuild/tools_jvm_autodeps/thirdparty/golang/parsers/parsers"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestAppendTo(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	fileName := filepath.Join(tmpDir, "report.jsonl")
+
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	rule := bazel.NewRule("java_library", "x", "Foo", nil)
+	for i := 0; i < 2; i++ {
+		r := New(now, []string{"x/Foo.java"})
+		endPhase := r.StartPhase("parse")
+		endPhase()
+		target := r.NewTarget("x/Foo.java")
+		target.SetRulesFixed([]*bazel.Rule{rule})
+		target.SetAddedDeps(map[*bazel.Rule][]bazel.Label{rule: {"//y:B", "//y:A"}})
+		target.Unresolved = []jadeplib.ClassName{"com.Unknown"}
+		if err := r.AppendTo(fileName); err != nil {
+			t.Fatalf("AppendTo() has error %v, want nil", err)
+		}
+	}
+
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Report file has %d lines, want 2:\n%s", len(lines), b)
+	}
+	want := &Report{
+		Time: now,
+		Args: []string{"x/Foo.java"},
+		Targets: []*Target{{
+			Arg:        "x/Foo.java",
+			RulesFixed: []bazel.Label{"//x:Foo"},
+			AddedDeps:  map[bazel.Label][]bazel.Label{"//x:Foo": {"//y:A", "//y:B"}},
+			Unresolved: []jadeplib.ClassName{"com.Unknown"},
+		}},
+	}
+	for _, l := range lines {
+		got := &Report{}
+		if err := json.Unmarshal([]byte(l), got); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(got, want, cmpopts.IgnoreUnexported(Report{}), cmpopts.IgnoreFields(Report{}, "PhaseMillis")); diff != "" {
+			t.Errorf("Report diff (-got +want):\n%s", diff)
+		}
+		if _, ok := got.PhaseMillis["parse"]; !ok {
+			t.Errorf("Report has phases %v, want 'parse' among them", got.PhaseMillis)
+		}
+	}
+}
+
+func TestSetRelativeAddedDeps(t *testing.T) {
+	rule := bazel.NewRule("java_library", "x", "Foo", nil)
+	var tests = []struct {
+		desc    string
+		basePkg string
+		want    map[bazel.Label][]string
+	}{
+		{
+			desc: "relative to the consuming rule",
+			want: map[bazel.Label][]string{"//x:Foo": {":A", "//y:B", "//y"}},
+		},
+		{
+			desc:    "relative to a base package",
+			basePkg: "y",
+			want:    map[bazel.Label][]string{"//x:Foo": {"//x:A", ":B", ":y"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			target := &Target{}
+			target.SetAddedDeps(map[*bazel.Rule][]bazel.Label{rule: {"//x:A", "//y:y", "//y:B"}})
+			target.SetRelativeAddedDeps(tt.basePkg)
+			if diff := cmp.Diff(target.RelativeAddedDeps, tt.want); diff != "" {
+				t.Errorf("RelativeAddedDeps diff (-got +want):\n%s", diff)
+			}
+			if diff := cmp.Diff(target.AddedDeps, map[bazel.Label][]bazel.Label{"//x:Foo": {"//x:A", "//y:B", "//y:y"}}); diff != "" {
+				t.Errorf("AddedDeps diff (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSetClassErrors(t *testing.T) {
+	target := &Target{}
+	target.SetClassErrors(map[jadeplib.ClassName]error{"com.Bar": errors.New("error loading package y")})
+	want := map[jadeplib.ClassName]string{"com.Bar": "error loading package y"}
+	if diff := cmp.Diff(want, target.ClassErrors); diff != "" {
+		t.Errorf("ClassErrors diff (-want +got):\n%s", diff)
+	}
+
+	target.SetClassErrors(nil)
+	if target.ClassErrors != nil {
+		t.Errorf("SetClassErrors(nil) left ClassErrors = %v, want nil", target.ClassErrors)
+	}
+}
+
+func TestSetSkippedFiles(t *testing.T) {
+	target := &Target{}
+	target.SetSkippedFiles([]*parser.FileError{
+		{FileName: "x/A.java", Line: 3, Offset: 28, Partial: true, Err: parsers.SyntaxError{Description: "syntax error", Line: 3, Offset: 28}},
+		{FileName: "x/B.java", Err: os.ErrNotExist},
+	})
+	want := []SkippedFile{
+		{File: "x/A.java", Line: 3, Offset: 28, Partial: true, Error: "syntax error"},
+		{File: "x/B.java", Error: os.ErrNotExist.Error()},
+	}
+	if diff := cmp.Diff(want, target.SkippedFiles); diff != "" {
+		t.Errorf("SkippedFiles diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestSetSkippedPackages(t *testing.T) {
+	r := New(time.Time{}, nil)
+	r.SetSkippedPackages([]*pkgloading.PackageError{
+		{PkgName: "x", Message: "syntax error", Line: 12},
+		{PkgName: "y", Message: "missing load()"},
+	})
+	want := []SkippedPackage{
+		{Package: "x", Line: 12, Error: "syntax error"},
+		{Package: "y", Error: "missing load()"},
+	}
+	if diff := cmp.Diff(want, r.SkippedPackages); diff != "" {
+		t.Errorf("SkippedPackages diff (-want +got):\n%s", diff)
+	}
+}
@@ -12,7 +12,8 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// Package sortingdepsranker ranks deps by simply sorting labels lexicographically.
+// Package sortingdepsranker ranks deps by simply sorting labels lexicographically,
+// after those that other rules in the consuming package already depend on.
 package sortingdepsranker
 
 import (
@@ -21,9 +22,55 @@ import (
 )
 
 // Ranker is a jadeplib.DepsRanker that ranks labels by their lexicographic order.
+// It's also a jadeplib.PackageDepsScorer, which is confident about the labels that the consuming package already depends on.
+// Outside of a package, the lexicographic order says nothing about which label is right, so it doesn't implement jadeplib.DepsScorer.
 type Ranker struct{}
 
 // Less returns true iff label1 < label2.
 func (r *Ranker) Less(ctx context.Context, label1, label2 bazel.Label) bool {
 	return label1 < label2
 }
+
+// LessInPackage returns true iff more rules in pkg depend on label1 than on label2, or, if as many do, iff label1 < label2.
+// Consistency within a package is usually the right call, e.g. a package whose rules depend on //third_party/guava
+// shouldn't get a dependency on another target that provides the same classes.
+func (r *Ranker) LessInPackage(ctx context.Context, pkg *bazel.Package, label1, label2 bazel.Label) bool {
+	d1, d2 := dependents(pkg, label1), dependents(pkg, label2)
+	if d1 != d2 {
+		return d1 > d2
+	}
+	return label1 < label2
+}
+
+// ScoreInPackage returns the share of label among the dependents in pkg of all candidates, counting one more dependent for each
+// candidate, e.g. 0.9 for a label that 8 rules in pkg depend on when none depends on the only other candidate.
+// Like LessInPackage, it assumes that a package consistently uses one of equivalent deps.
+func (r *Ranker) ScoreInPackage(ctx context.Context, pkg *bazel.Package, label bazel.Label, candidates []bazel.Label) float64 {
+	total := 0
+	for _, c := range candidates {
+		total += dependents(pkg, c) + 1
+	}
+	return float64(dependents(pkg, label)+1) / float64(total)
+}
+
+// dependents returns the number of rules in pkg that have label in their deps or exports.
+func dependents(pkg *bazel.Package, label bazel.Label) int {
+	n := 0
+	for _, rule := range pkg.Rules {
+		if dependsOn(rule, label) {
+			n++
+		}
+	}
+	return n
+}
+
+func dependsOn(rule *bazel.Rule, label bazel.Label) bool {
+	for _, attr := range []string{"deps", "exports"} {
+		for _, d := range rule.StringListAttr(attr) {
+			if l, err := bazel.ParseRelativeLabel(rule.PkgName, d); err == nil && l == label {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,151 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stdioserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+)
+
+// Client is a reference client of the protocol Server implements.
+// It sends one request at a time, and is safe for concurrent use.
+// Clients in other languages only need to reimplement WriteMessage, ReadMessage and Call.
+type Client struct {
+	mu     sync.Mutex // guards the fields below, and serializes requests
+	w      io.Writer
+	r      *bufio.Reader
+	nextID int64
+
+	// wait, if not nil, is called by Close after closing w, e.g. to wait for the server process to exit.
+	wait func() error
+}
+
+// NewClient returns a Client that writes requests to w and reads responses from r.
+// If w is an io.Closer, Close closes it.
+func NewClient(r io.Reader, w io.Writer) *Client {
+	return &Client{w: w, r: bufio.NewReader(r), nextID: 1}
+}
+
+// Start runs the Jadep executable at 'executable' as a server, e.g. "jadep serve --workspace=/src",
+// and returns a Client connected to its stdin and stdout. The server's stderr is forwarded to this process's stderr.
+// Close stops the server.
+func Start(ctx context.Context, executable string, args ...string) (*Client, error) {
+	cmd := exec.CommandContext(ctx, executable, args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error starting %s:\n%v", executable, err)
+	}
+	c := NewClient(stdout, stdin)
+	c.wait = cmd.Wait
+	return c, nil
+}
+
+// Close closes the connection to the server, which makes it exit, and waits for it if the Client was created by Start.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if closer, ok := c.w.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+	if c.wait != nil {
+		return c.wait()
+	}
+	return nil
+}
+
+// Call sends a request to run method with params, and decodes its result into result, unless it's nil.
+// An error that the server returns for the request is returned as an error.
+func (c *Client) Call(method string, params, result interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	req := Request{ID: c.nextID, Method: method}
+	c.nextID++
+	if params != nil {
+		data, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		req.Params = data
+	}
+	if err := WriteMessage(c.w, req); err != nil {
+		return fmt.Errorf("error sending %s request:\n%v", method, err)
+	}
+	var resp Response
+	if err := ReadMessage(c.r, &resp); err != nil {
+		return fmt.Errorf("error receiving %s response:\n%v", method, err)
+	}
+	if resp.ID != req.ID {
+		return fmt.Errorf("got response to request %d, want %d", resp.ID, req.ID)
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(resp.Result, result)
+}
+
+// ClassesForFile returns the class names that the Java file (or the srcs of the rule) 'file' references.
+func (c *Client) ClassesForFile(file string) (*ClassesForFileResult, error) {
+	var ret ClassesForFileResult
+	if err := c.Call("classes_for_file", ClassesForFileParams{File: file}, &ret); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+// MissingDeps returns the deps that the rules designated by arg are missing.
+// If classNames is not empty, they're resolved instead of the class names that the files of arg reference.
+func (c *Client) MissingDeps(arg string, classNames ...jadeplib.ClassName) (*MissingDepsResult, error) {
+	params := MissingDepsParams{Arg: arg}
+	for _, cls := range classNames {
+		params.ClassNames = append(params.ClassNames, string(cls))
+	}
+	var ret MissingDepsResult
+	if err := c.Call("missing_deps", params, &ret); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+// ApplyEdits adds addDeps to, and removes removeDeps from, the deps of rules. Either may be nil.
+func (c *Client) ApplyEdits(addDeps, removeDeps map[bazel.Label][]bazel.Label) (*ApplyEditsResult, error) {
+	var ret ApplyEditsResult
+	if err := c.Call("apply_edits", ApplyEditsParams{AddDeps: addDeps, RemoveDeps: removeDeps}, &ret); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
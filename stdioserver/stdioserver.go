@@ -0,0 +1,441 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package stdioserver exposes Jadep's core operations to another process over Jadep's stdin and stdout,
+// so that editors written in any language can embed Jadep without gRPC or Go bindings.
+//
+// Each message is a 4-byte big-endian length, followed by that many bytes of JSON.
+// The client writes Requests, and the server answers each one with a Response carrying the same ID, in order.
+// The server stops when its stdin is closed. Jadep's logs go to stderr, never to stdout.
+//
+// Methods, with the types of their params and results:
+//
+//	classes_for_file  ClassesForFileParams  ClassesForFileResult  The class names that Java files reference.
+//	missing_deps      MissingDepsParams     MissingDepsResult     The deps that rules are missing. Never edits BUILD files.
+//	apply_edits       ApplyEditsParams      ApplyEditsResult      Adds and removes deps of rules.
+//
+// For example, a client writes the 4 bytes 00 00 00 43, then
+//
+//	{"id":1,"method":"classes_for_file","params":{"file":"x/Foo.java"}}
+//
+// and the server answers
+//
+//	{"id":1,"result":{"class_names":["com.Bar"]}}
+//
+// Client is a reference client.
+package stdioserver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/buildozer"
+	"github.com/bazelbuild/tools_jvm_autodeps/cli"
+	"github.com/bazelbuild/tools_jvm_autodeps/future"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+	"github.com/bazelbuild/tools_jvm_autodeps/lang/java/parser"
+	"github.com/bazelbuild/tools_jvm_autodeps/pkgloading"
+)
+
+// MaxMessageSize bounds the length of a message, so that a corrupt length prefix doesn't exhaust memory.
+const MaxMessageSize = 64 << 20
+
+// Request asks the server to run Method with Params.
+type Request struct {
+	// ID is echoed in the Response, so clients can match the two.
+	ID int64 `json:"id"`
+
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// Response is the answer to the Request with the same ID.
+// Exactly one of Result and Error is set.
+type Response struct {
+	ID     int64           `json:"id"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// ClassesForFileParams are the params of classes_for_file.
+type ClassesForFileParams struct {
+	// File is a Java file, or a rule whose srcs are parsed, as on Jadep's command line.
+	// Relative file names are relative to the workspace root.
+	File string `json:"file"`
+}
+
+// ClassesForFileResult is the result of classes_for_file.
+type ClassesForFileResult struct {
+	ClassNames []jadeplib.ClassName `json:"class_names"`
+
+	// SkippedFiles describes the files that couldn't be read or fully parsed.
+	SkippedFiles []string `json:"skipped_files,omitempty"`
+}
+
+// MissingDepsParams are the params of missing_deps.
+type MissingDepsParams struct {
+	// Arg is a Java file or a rule, as in ClassesForFileParams.File.
+	// A file that no rule srcs is an error, since missing_deps doesn't create rules.
+	Arg string `json:"arg"`
+
+	// ClassNames, if set, are resolved instead of the class names Arg's files reference,
+	// e.g. for editors that already parsed the file.
+	ClassNames []string `json:"class_names,omitempty"`
+}
+
+// MissingDepsResult is the result of missing_deps.
+type MissingDepsResult struct {
+	// Rules are the rules that srcs Arg, sorted by label, with the candidate deps for each class name they're missing.
+	Rules []RuleMissingDeps `json:"rules"`
+
+	Unresolved []jadeplib.ClassName `json:"unresolved,omitempty"`
+
+	// ClassErrors describes the errors that affected individual class names.
+	ClassErrors map[jadeplib.ClassName]string `json:"class_errors,omitempty"`
+}
+
+// RuleMissingDeps lists the candidate deps of each class name that Rule is missing, best first.
+type RuleMissingDeps struct {
+	Rule        bazel.Label                          `json:"rule"`
+	MissingDeps map[jadeplib.ClassName][]bazel.Label `json:"missing_deps"`
+}
+
+// ApplyEditsParams are the params of apply_edits.
+type ApplyEditsParams struct {
+	// AddDeps maps rules to the deps to add to them.
+	AddDeps map[bazel.Label][]bazel.Label `json:"add_deps,omitempty"`
+
+	// RemoveDeps maps rules to the deps to remove from them.
+	RemoveDeps map[bazel.Label][]bazel.Label `json:"remove_deps,omitempty"`
+}
+
+// ApplyEditsResult is the result of apply_edits.
+type ApplyEditsResult struct {
+	// EditedRules are the rules whose BUILD files were edited, sorted.
+	EditedRules []bazel.Label `json:"edited_rules"`
+}
+
+// WriteMessage writes the JSON encoding of v to w, prefixed by its length.
+func WriteMessage(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(data) > MaxMessageSize {
+		return fmt.Errorf("message of %d bytes exceeds the maximum of %d", len(data), MaxMessageSize)
+	}
+	var prefix [4]byte
+	binary.BigEndian.PutUint32(prefix[:], uint32(len(data)))
+	if _, err := w.Write(prefix[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// ReadMessage reads a length-prefixed JSON message from r into v.
+// Returns io.EOF if r ends before the message starts, and io.ErrUnexpectedEOF if it ends in the middle of it.
+func ReadMessage(r io.Reader, v interface{}) error {
+	data, err := readFrame(r)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("error decoding message:\n%v", err)
+	}
+	return nil
+}
+
+// readFrame reads the bytes of a length-prefixed message from r. See ReadMessage.
+func readFrame(r io.Reader) ([]byte, error) {
+	var prefix [4]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(prefix[:])
+	if n > MaxMessageSize {
+		return nil, fmt.Errorf("message of %d bytes exceeds the maximum of %d", n, MaxMessageSize)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// Server answers Requests using the same configuration as Jadep's command line.
+type Server struct {
+	Config jadeplib.Config
+
+	// ImplicitImports is a future to the sorted class names that Java files use without importing. See jadeplib.ImplicitImports.
+	ImplicitImports future.Getter
+
+	// Blacklist excludes class names from classes_for_file and missing_deps. It may be nil.
+	Blacklist *jadeplib.ClassNameBlacklist
+}
+
+// Serve answers the Requests read from r by writing Responses to w, one at a time, until r ends or ctx is done.
+// Errors of individual requests are returned in their Responses; Serve only fails if r or w do, or if ctx is done.
+func (s *Server) Serve(ctx context.Context, r io.Reader, w io.Writer) error {
+	br := bufio.NewReader(r)
+	for ctx.Err() == nil {
+		data, err := readFrame(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading request:\n%v", err)
+		}
+		// A request that isn't valid JSON is answered with an error, since the next one can still be framed.
+		var req Request
+		var result interface{}
+		if err = json.Unmarshal(data, &req); err != nil {
+			err = fmt.Errorf("error decoding request:\n%v", err)
+		} else {
+			result, err = s.handle(ctx, req)
+		}
+		resp := Response{ID: req.ID}
+		if err == nil {
+			resp.Result, err = json.Marshal(result)
+		}
+		if err != nil {
+			resp.Error = err.Error()
+			resp.Result = nil
+		}
+		if err := WriteMessage(w, resp); err != nil {
+			return fmt.Errorf("error writing response:\n%v", err)
+		}
+	}
+	return ctx.Err()
+}
+
+// handle runs the method of req.
+func (s *Server) handle(ctx context.Context, req Request) (interface{}, error) {
+	// Files and BUILD files may have changed since the previous request, e.g. in the user's editor,
+	// so nothing memoized for it is trusted. The cache is reset rather than replaced, since resolvers share it.
+	if s.Config.AnalysisCache != nil {
+		s.Config.AnalysisCache.Reset()
+	}
+	switch req.Method {
+	case "classes_for_file":
+		var params ClassesForFileParams
+		if err := decodeParams(req, &params); err != nil {
+			return nil, err
+		}
+		return s.classesForFile(ctx, params)
+	case "missing_deps":
+		var params MissingDepsParams
+		if err := decodeParams(req, &params); err != nil {
+			return nil, err
+		}
+		return s.missingDeps(ctx, params)
+	case "apply_edits":
+		var params ApplyEditsParams
+		if err := decodeParams(req, &params); err != nil {
+			return nil, err
+		}
+		return s.applyEdits(ctx, params)
+	}
+	return nil, fmt.Errorf("unknown method %q", req.Method)
+}
+
+func decodeParams(req Request, params interface{}) error {
+	if len(req.Params) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(req.Params, params); err != nil {
+		return fmt.Errorf("error decoding params of %s:\n%v", req.Method, err)
+	}
+	return nil
+}
+
+func (s *Server) classesForFile(ctx context.Context, params ClassesForFileParams) (*ClassesForFileResult, error) {
+	if params.File == "" {
+		return nil, fmt.Errorf("missing file")
+	}
+	classNames, skipped, err := s.referencedClasses(ctx, params.File)
+	if err != nil {
+		return nil, err
+	}
+	ret := &ClassesForFileResult{ClassNames: classNames}
+	for _, e := range skipped {
+		ret.SkippedFiles = append(ret.SkippedFiles, e.Error())
+	}
+	return ret, nil
+}
+
+// referencedClasses returns the class names that the Java files designated by arg reference, without blacklisted ones.
+func (s *Server) referencedClasses(ctx context.Context, arg string) ([]jadeplib.ClassName, []*parser.FileError, error) {
+	files, err := cli.FilesToParseAbs(ctx, s.Config.WorkspaceDir, s.Config.Loader, s.absArg(arg))
+	if err != nil {
+		return nil, nil, err
+	}
+	classNames, skipped := parser.ReferencedClasses(ctx, files, s.ImplicitImports.Get().([]string))
+	return s.Blacklist.Filter(classNames), skipped, nil
+}
+
+// absArg returns arg, with file names made absolute relative to the workspace root.
+func (s *Server) absArg(arg string) string {
+	if _, err := bazel.ParseAbsoluteLabel(arg); err == nil || filepath.IsAbs(arg) {
+		return arg
+	}
+	return filepath.Join(s.Config.WorkspaceDir, arg)
+}
+
+func (s *Server) missingDeps(ctx context.Context, params MissingDepsParams) (*MissingDepsResult, error) {
+	if params.Arg == "" {
+		return nil, fmt.Errorf("missing arg")
+	}
+	rules, err := s.existingRulesToFix(ctx, params.Arg)
+	if err != nil {
+		return nil, err
+	}
+	var classNames []jadeplib.ClassName
+	if len(params.ClassNames) > 0 {
+		classNames = cli.ClassNamesToResolve(ctx, s.Config.WorkspaceDir, s.Config.Loader, params.Arg, params.ClassNames, s.ImplicitImports, s.Blacklist)
+	} else if classNames, _, err = s.referencedClasses(ctx, params.Arg); err != nil {
+		return nil, err
+	}
+	missing, unresolved, classErrors, err := jadeplib.MissingDepsWithErrors(ctx, s.Config, rules, classNames)
+	if err != nil {
+		return nil, err
+	}
+	ret := &MissingDepsResult{Rules: []RuleMissingDeps{}, Unresolved: unresolved}
+	for _, r := range rules {
+		deps := missing[r]
+		if deps == nil {
+			deps = make(map[jadeplib.ClassName][]bazel.Label)
+		}
+		ret.Rules = append(ret.Rules, RuleMissingDeps{Rule: r.Label(), MissingDeps: deps})
+	}
+	sort.Slice(ret.Rules, func(i, j int) bool { return ret.Rules[i].Rule < ret.Rules[j].Rule })
+	for cls, err := range classErrors {
+		if ret.ClassErrors == nil {
+			ret.ClassErrors = make(map[jadeplib.ClassName]string)
+		}
+		ret.ClassErrors[cls] = err.Error()
+	}
+	return ret, nil
+}
+
+// existingRulesToFix returns the rules that arg designates. Unlike cli.RulesToFix, it never creates a rule.
+func (s *Server) existingRulesToFix(ctx context.Context, arg string) ([]*bazel.Rule, error) {
+	if _, err := bazel.ParseAbsoluteLabel(arg); err == nil {
+		return cli.RulesToFixAbs(ctx, s.Config, arg, nil, "")
+	}
+	fileName, err := filepath.Rel(s.Config.WorkspaceDir, s.absArg(arg))
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(fileName, "..") {
+		return nil, fmt.Errorf("%q is not in the workspace %q", arg, s.Config.WorkspaceDir)
+	}
+	rules, err := jadeplib.RulesConsumingFile(ctx, s.Config, fileName)
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("no rule srcs %s", arg)
+	}
+	return rules, nil
+}
+
+func (s *Server) applyEdits(ctx context.Context, params ApplyEditsParams) (*ApplyEditsResult, error) {
+	var labels []bazel.Label
+	for l := range params.AddDeps {
+		labels = append(labels, l)
+	}
+	for l := range params.RemoveDeps {
+		labels = append(labels, l)
+	}
+	rules, _, err := pkgloading.LoadRules(ctx, s.Config.Loader, labels)
+	if err != nil {
+		return nil, fmt.Errorf("error loading rules to edit:\n%v", err)
+	}
+	byRule := func(deps map[bazel.Label][]bazel.Label) (map[*bazel.Rule][]bazel.Label, error) {
+		ret := make(map[*bazel.Rule][]bazel.Label)
+		for l, d := range deps {
+			r := rules[l]
+			if r == nil {
+				return nil, fmt.Errorf("Rule not found: %v", l)
+			}
+			ret[r] = d
+		}
+		return ret, nil
+	}
+	add, err := byRule(params.AddDeps)
+	if err != nil {
+		return nil, err
+	}
+	remove, err := byRule(params.RemoveDeps)
+	if err != nil {
+		return nil, err
+	}
+	// The server outlives edits, so the edited packages must be reloaded the next time they're needed,
+	// even if only some of the edits were applied.
+	defer s.invalidate(rules)
+	if len(add) > 0 {
+		if err := buildozer.AddDepsToRules(s.Config.WorkspaceDir, add); err != nil {
+			return nil, fmt.Errorf("error adding deps:\n%v", err)
+		}
+	}
+	if len(remove) > 0 {
+		if err := buildozer.RemoveDepsFromRules(s.Config.WorkspaceDir, remove); err != nil {
+			return nil, fmt.Errorf("error removing deps:\n%v", err)
+		}
+	}
+
+	ret := &ApplyEditsResult{EditedRules: []bazel.Label{}}
+	for l := range rules {
+		ret.EditedRules = append(ret.EditedRules, l)
+	}
+	sort.Slice(ret.EditedRules, func(i, j int) bool { return ret.EditedRules[i] < ret.EditedRules[j] })
+	log.Printf("Edited %d rule(s)", len(ret.EditedRules))
+	return ret, nil
+}
+
+// invalidate drops the packages of rules from the caches of s.Config.
+func (s *Server) invalidate(rules map[bazel.Label]*bazel.Rule) {
+	pkgs := make(map[string]bool)
+	for _, r := range rules {
+		pkgs[r.PkgName] = true
+	}
+	var pkgNames []string
+	for p := range pkgs {
+		pkgNames = append(pkgNames, p)
+		if s.Config.AnalysisCache != nil {
+			s.Config.AnalysisCache.ForgetPackage(p)
+		}
+	}
+	if cache, ok := s.Config.Loader.(invalidator); ok {
+		cache.Invalidate(pkgNames)
+	}
+}
+
+// invalidator drops packages from a cache, e.g. pkgloading.CachingLoader.
+type invalidator interface {
+	Invalidate(packages []string)
+}
@@ -0,0 +1,164 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stdioserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeptest"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	in := Request{ID: 7, Method: "classes_for_file", Params: []byte(`{"file":"x/Foo.java"}`)}
+	if err := WriteMessage(&buf, in); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := binary.BigEndian.Uint32(buf.Bytes()[:4]), uint32(buf.Len()-4); got != want {
+		t.Errorf("Length prefix is %d, want %d", got, want)
+	}
+	var out Request
+	if err := ReadMessage(&buf, &out); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(out, in); diff != "" {
+		t.Errorf("ReadMessage returned diff (-got +want):\n%s", diff)
+	}
+	if err := ReadMessage(&buf, &out); err != io.EOF {
+		t.Errorf("ReadMessage at the end of input returned %v, want io.EOF", err)
+	}
+}
+
+func TestReadMessageErrors(t *testing.T) {
+	tests := []struct {
+		desc    string
+		input   []byte
+		wantErr string
+	}{
+		{"truncated body", []byte{0, 0, 0, 10, '{', '}'}, io.ErrUnexpectedEOF.Error()},
+		{"truncated prefix", []byte{0, 0}, io.ErrUnexpectedEOF.Error()},
+		{"too large", []byte{0xff, 0xff, 0xff, 0xff}, "exceeds the maximum"},
+		{"not JSON", []byte{0, 0, 0, 3, 'f', 'o', 'o'}, "error decoding message"},
+	}
+	for _, tt := range tests {
+		var v Request
+		err := ReadMessage(bytes.NewReader(tt.input), &v)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: ReadMessage returned error %v, want one containing %q", tt.desc, err, tt.wantErr)
+		}
+	}
+}
+
+// connect runs s in the background, and returns a Client connected to it.
+// The returned function closes the client and returns the error Serve returned.
+func connect(t *testing.T, s *Server) (*Client, func() error) {
+	requestsR, requestsW := io.Pipe()
+	responsesR, responsesW := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := s.Serve(context.Background(), requestsR, responsesW)
+		responsesW.Close()
+		done <- err
+	}()
+	c := NewClient(responsesR, requestsW)
+	return c, func() error {
+		if err := c.Close(); err != nil {
+			t.Errorf("Close returned error %v", err)
+		}
+		return <-done
+	}
+}
+
+func TestServe(t *testing.T) {
+	public := map[string]interface{}{"visibility": []string{"//visibility:public"}}
+	toFix := bazel.NewRule("java_library", "x", "x", nil)
+	bar := bazel.NewRule("java_library", "y", "bar", public)
+	loader := jadeptest.NewLoader(jadeptest.Packages(toFix, bar))
+	resolver := jadeptest.NewResolver(map[jadeplib.ClassName][]*bazel.Rule{"com.Bar": {bar}})
+	s := &Server{Config: jadeptest.Config("/workspace", loader, resolver)}
+	c, stop := connect(t, s)
+
+	got, err := c.MissingDeps("//x:x", "com.Bar.Nested", "com.Unknown")
+	if err != nil {
+		t.Fatalf("MissingDeps returned error %v", err)
+	}
+	want := &MissingDepsResult{
+		Rules: []RuleMissingDeps{
+			{Rule: "//x:x", MissingDeps: map[jadeplib.ClassName][]bazel.Label{"com.Bar": {"//y:bar"}}},
+		},
+		Unresolved: []jadeplib.ClassName{"com.Unknown"},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("MissingDeps returned diff (-got +want):\n%s", diff)
+	}
+
+	errTests := []struct {
+		method  string
+		params  interface{}
+		wantErr string
+	}{
+		{"no_such_method", nil, `unknown method "no_such_method"`},
+		{"missing_deps", MissingDepsParams{}, "missing arg"},
+		{"missing_deps", map[string]int{"arg": 1}, "error decoding params of missing_deps"},
+		{"missing_deps", MissingDepsParams{Arg: "//x:nonexistent", ClassNames: []string{"com.Bar"}}, "Rule not found: //x:nonexistent"},
+		{"apply_edits", ApplyEditsParams{AddDeps: map[bazel.Label][]bazel.Label{"//x:nonexistent": {"//y:bar"}}}, "Rule not found: //x:nonexistent"},
+	}
+	for _, tt := range errTests {
+		err := c.Call(tt.method, tt.params, nil)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("Call(%s, %v) returned error %v, want one containing %q", tt.method, tt.params, err, tt.wantErr)
+		}
+	}
+
+	if err := stop(); err != nil {
+		t.Errorf("Serve returned error %v, want nil after the client closed", err)
+	}
+}
+
+func TestServeInvalidRequest(t *testing.T) {
+	var in bytes.Buffer
+	in.Write([]byte{0, 0, 0, 3, 'f', 'o', 'o'})
+	WriteMessage(&in, Request{ID: 2, Method: "no_such_method"})
+	var out bytes.Buffer
+	if err := (&Server{}).Serve(context.Background(), &in, &out); err != nil {
+		t.Fatalf("Serve returned error %v", err)
+	}
+	var got []Response
+	for {
+		var resp Response
+		if err := ReadMessage(&out, &resp); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		resp.Error = strings.SplitN(resp.Error, ":", 2)[0]
+		got = append(got, resp)
+	}
+	want := []Response{
+		{ID: 0, Error: "error decoding request"},
+		{ID: 2, Error: `unknown method "no_such_method"`},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("Serve returned diff in responses (-got +want):\n%s", diff)
+	}
+}
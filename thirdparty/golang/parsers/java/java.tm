@@ -361,9 +361,9 @@ ReferenceType<NoModifiers, NoName> -> Type :
 
 # This is a class type without starting Modifiers and ending TypeArguments.
 ClassRefNoName :
-    ((QualifiedName -> TypeName) TypeArguments -> ClassType) '.' Annotation? Identifier
-  | ((QualifiedName -> TypeName) -> ClassType) '.' Annotation Identifier
-  | (ClassRefNoName TypeArguments? -> ClassType) '.' Annotation? Identifier
+    ((QualifiedName -> TypeName) TypeArguments -> ClassType) '.' Annotations? Identifier
+  | ((QualifiedName -> TypeName) -> ClassType) '.' Annotations Identifier
+  | (ClassRefNoName TypeArguments? -> ClassType) '.' Annotations? Identifier
 ;
 
 # Class and reference types can often be found in positions where simple
@@ -1083,7 +1083,7 @@ MethodReference -> MethodReference :
 ;
 
 MethodReferenceLookahead :
-    TypeArguments ('.' Annotation? Identifier TypeArguments?)+? Dims? '::' ;
+    TypeArguments ('.' Annotations? Identifier TypeArguments?)+? Dims? '::' ;
 
 MethodReferenceType :
     PrimitiveType<+NoModifiers> Dims                       -> ArrayType
@@ -1097,8 +1097,8 @@ MethodReferenceType :
 # TypeArguments.
 ClassType2 -> ClassType :
     (QualifiedName -> TypeName) (?= MethodReferenceLookahead) TypeArguments
-  | ((QualifiedName -> TypeName) -> ClassType) '.' Annotation Identifier TypeArguments?
-  | ClassType2 '.' Annotation? Identifier TypeArguments?
+  | ((QualifiedName -> TypeName) -> ClassType) '.' Annotations Identifier TypeArguments?
+  | ClassType2 '.' Annotations? Identifier TypeArguments?
 ;
 
 ArrayCreationExpression -> NewArray :
@@ -0,0 +1,215 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package vcs finds the files that are changed in a working copy, according to its version control system.
+package vcs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"context"
+)
+
+// ChangedJavaFiles returns the absolute paths of the Java files that are modified, added or untracked in the
+// Git or Mercurial working copy that contains dir.
+// A renamed file is reported under its new name, and deleted files are never reported.
+func ChangedJavaFiles(ctx context.Context, dir string) ([]string, error) {
+	root, kind, err := findRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	switch kind {
+	case "git":
+		out, err := run(ctx, root, "git", "status", "--porcelain", "-z", "--untracked-files=all")
+		if err != nil {
+			return nil, err
+		}
+		files = parseGitStatus(out)
+	case "hg":
+		out, err := run(ctx, root, "hg", "status", "--modified", "--added", "--unknown", "--print0", "--config", "ui.relative-paths=false")
+		if err != nil {
+			return nil, err
+		}
+		files = parseHgStatus(out)
+	}
+	var ret []string
+	for _, f := range files {
+		if strings.HasSuffix(f, ".java") {
+			ret = append(ret, filepath.Join(root, filepath.FromSlash(f)))
+		}
+	}
+	return ret, nil
+}
+
+// Rename is a file that was moved from From to To.
+type Rename struct {
+	From string
+	To   string
+}
+
+// RenamedJavaFiles returns the Java files that the Git or Mercurial working copy that contains dir reports as renamed,
+// with absolute paths. Git only reports renames that are staged, e.g. by 'git mv' or 'git add -A'.
+func RenamedJavaFiles(ctx context.Context, dir string) ([]Rename, error) {
+	root, kind, err := findRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	var renames []Rename
+	switch kind {
+	case "git":
+		out, err := run(ctx, root, "git", "status", "--porcelain", "-z", "--untracked-files=no")
+		if err != nil {
+			return nil, err
+		}
+		renames = parseGitRenames(out)
+	case "hg":
+		out, err := run(ctx, root, "hg", "status", "--added", "--removed", "--copies", "--print0", "--config", "ui.relative-paths=false")
+		if err != nil {
+			return nil, err
+		}
+		renames = parseHgRenames(out)
+	}
+	var ret []Rename
+	for _, r := range renames {
+		if strings.HasSuffix(r.From, ".java") && strings.HasSuffix(r.To, ".java") {
+			ret = append(ret, Rename{filepath.Join(root, filepath.FromSlash(r.From)), filepath.Join(root, filepath.FromSlash(r.To))})
+		}
+	}
+	return ret, nil
+}
+
+// findRoot returns the closest ancestor of dir (including itself) that is the root of a Git or Mercurial working copy,
+// and which of the two it is.
+func findRoot(dir string) (root, kind string, err error) {
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return "", "", err
+	}
+	for d := dir; ; d = filepath.Dir(d) {
+		for _, k := range []string{"git", "hg"} {
+			if _, err := os.Stat(filepath.Join(d, "."+k)); err == nil {
+				return d, k, nil
+			}
+		}
+		if d == filepath.Dir(d) {
+			return "", "", fmt.Errorf("%s is not in a Git or Mercurial working copy", dir)
+		}
+	}
+}
+
+// run runs a VCS command in dir and returns its standard output.
+func run(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("error running %q:\n%v\n%s", strings.Join(args, " "), err, stderr.String())
+	}
+	return out, nil
+}
+
+// parseGitStatus returns the files listed in the output of 'git status --porcelain -z', except deleted ones.
+// Each entry is "XY <path>", where X and Y are the status of the index and the working tree.
+// Renamed and copied entries are followed by an additional entry with the original path, which is skipped.
+func parseGitStatus(out []byte) []string {
+	var ret []string
+	entries := strings.Split(string(out), "\x00")
+	for i := 0; i < len(entries); i++ {
+		e := entries[i]
+		if len(e) < 4 {
+			continue
+		}
+		status, path := e[:2], e[3:]
+		if status[0] == 'R' || status[0] == 'C' {
+			i++
+		}
+		if status[0] == 'D' || status[1] == 'D' {
+			continue
+		}
+		ret = append(ret, path)
+	}
+	return ret
+}
+
+// parseHgStatus returns the files listed in the output of 'hg status --print0', which are "<status> <path>" entries.
+// Mercurial reports a renamed file as an added file under its new name.
+func parseHgStatus(out []byte) []string {
+	var ret []string
+	for _, e := range strings.Split(string(out), "\x00") {
+		if len(e) < 3 {
+			continue
+		}
+		if e[0] == 'R' || e[0] == '!' {
+			continue
+		}
+		ret = append(ret, e[2:])
+	}
+	return ret
+}
+
+// parseGitRenames returns the renamed files listed in the output of 'git status --porcelain -z',
+// whose "R  <new path>" entries are followed by an entry with the original path.
+func parseGitRenames(out []byte) []Rename {
+	var ret []Rename
+	entries := strings.Split(string(out), "\x00")
+	for i := 0; i < len(entries); i++ {
+		e := entries[i]
+		if len(e) < 4 {
+			continue
+		}
+		status, path := e[:2], e[3:]
+		if status[0] != 'R' && status[0] != 'C' {
+			continue
+		}
+		i++
+		if status[0] == 'R' && i < len(entries) {
+			ret = append(ret, Rename{From: entries[i], To: path})
+		}
+	}
+	return ret
+}
+
+// parseHgRenames returns the renamed files listed in the output of 'hg status --added --removed --copies --print0',
+// where an added file is followed by a "  <source>" entry if it was copied. A copy is a rename if its source was removed.
+func parseHgRenames(out []byte) []Rename {
+	var copies []Rename
+	removed := make(map[string]bool)
+	entries := strings.Split(string(out), "\x00")
+	for i, e := range entries {
+		if len(e) < 3 {
+			continue
+		}
+		switch {
+		case e[0] == 'R':
+			removed[e[2:]] = true
+		case e[0] == 'A' && i+1 < len(entries) && strings.HasPrefix(entries[i+1], "  "):
+			copies = append(copies, Rename{From: entries[i+1][2:], To: e[2:]})
+		}
+	}
+	var ret []Rename
+	for _, c := range copies {
+		if removed[c.From] {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,108 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vcs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseGitStatus(t *testing.T) {
+	var tests = []struct {
+		desc string
+		out  string
+		want []string
+	}{
+		{
+			desc: "clean working copy",
+			out:  "",
+			want: nil,
+		},
+		{
+			desc: "modified, added and untracked files",
+			out:  " M java/x/Foo.java\x00A  java/x/Bar.java\x00?? java/y/New.java\x00MM java/y/Both.java\x00",
+			want: []string{"java/x/Foo.java", "java/x/Bar.java", "java/y/New.java", "java/y/Both.java"},
+		},
+		{
+			desc: "deleted files are skipped",
+			out:  "D  java/x/Gone.java\x00 D java/x/Removed.java\x00 M java/x/Foo.java\x00",
+			want: []string{"java/x/Foo.java"},
+		},
+		{
+			desc: "renamed files are reported under their new name",
+			out:  "R  java/y/Foo.java\x00java/x/Foo.java\x00 M java/x/Bar.java\x00",
+			want: []string{"java/y/Foo.java", "java/x/Bar.java"},
+		},
+		{
+			desc: "paths with spaces",
+			out:  "?? java/x/My File.java\x00",
+			want: []string{"java/x/My File.java"},
+		},
+	}
+	for _, tt := range tests {
+		if diff := cmp.Diff(tt.want, parseGitStatus([]byte(tt.out))); diff != "" {
+			t.Errorf("%s: parseGitStatus returned diff (-want +got):\n%s", tt.desc, diff)
+		}
+	}
+}
+
+func TestParseHgStatus(t *testing.T) {
+	out := "M java/x/Foo.java\x00A java/y/Foo.java\x00? java/y/New.java\x00R java/x/Old.java\x00"
+	want := []string{"java/x/Foo.java", "java/y/Foo.java", "java/y/New.java"}
+	if diff := cmp.Diff(want, parseHgStatus([]byte(out))); diff != "" {
+		t.Errorf("parseHgStatus returned diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseGitRenames(t *testing.T) {
+	out := "R  java/y/Foo.java\x00java/x/Foo.java\x00 M java/x/Bar.java\x00C  java/z/Copy.java\x00java/x/Bar.java\x00A  java/y/New.java\x00"
+	want := []Rename{{From: "java/x/Foo.java", To: "java/y/Foo.java"}}
+	if diff := cmp.Diff(want, parseGitRenames([]byte(out))); diff != "" {
+		t.Errorf("parseGitRenames returned diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseHgRenames(t *testing.T) {
+	out := "A java/y/Foo.java\x00  java/x/Foo.java\x00A java/z/Copy.java\x00  java/x/Bar.java\x00A java/y/New.java\x00R java/x/Foo.java\x00"
+	want := []Rename{{From: "java/x/Foo.java", To: "java/y/Foo.java"}}
+	if diff := cmp.Diff(want, parseHgRenames([]byte(out))); diff != "" {
+		t.Errorf("parseHgRenames returned diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestFindRoot(t *testing.T) {
+	tmpRoot, err := ioutil.TempDir("", "vcs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpRoot)
+	for _, d := range []string{".hg", "java/x"} {
+		if err := os.MkdirAll(filepath.Join(tmpRoot, d), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	root, kind, err := findRoot(filepath.Join(tmpRoot, "java/x"))
+	if err != nil {
+		t.Fatalf("findRoot returned error: %v", err)
+	}
+	if root != tmpRoot || kind != "hg" {
+		t.Errorf("findRoot(java/x) = (%q, %q), want (%q, %q)", root, kind, tmpRoot, "hg")
+	}
+}
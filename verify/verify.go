@@ -0,0 +1,91 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package verify builds the targets Jadep edited, to find out whether the added deps fixed them.
+package verify
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+)
+
+// DefaultCommand is the command used to build edited targets, unless overridden by the user.
+const DefaultCommand = "bazel build --keep_going"
+
+// labelRegexp matches absolute labels, e.g. //java/com/foo:Bar.
+var labelRegexp = regexp.MustCompile(`//[^\s:'"]*:[^\s:'"]+`)
+
+// Build runs 'command' in workspaceDir, with 'targets' appended to it, and returns the targets that failed to build.
+// Failing targets are identified by parsing the command's output. If the command fails but no target can be
+// identified, all targets are considered to have failed.
+// An error is returned only if the command couldn't be started.
+func Build(ctx context.Context, workspaceDir, command string, targets []bazel.Label) (map[bazel.Label]bool, error) {
+	if len(targets) == 0 {
+		return nil, nil
+	}
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty verification command")
+	}
+	for _, t := range targets {
+		args = append(args, string(t))
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = workspaceDir
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Run()
+	if err == nil {
+		return nil, nil
+	}
+	if _, ok := err.(*exec.ExitError); !ok {
+		return nil, fmt.Errorf("error running %q:\n%v", command, err)
+	}
+	failed := ParseFailures(output.String(), targets)
+	if len(failed) == 0 {
+		failed = make(map[bazel.Label]bool)
+		for _, t := range targets {
+			failed[t] = true
+		}
+	}
+	return failed, nil
+}
+
+// ParseFailures returns the targets that are mentioned in error lines of Bazel's output,
+// e.g. "ERROR: ... in java_library rule //foo:bar: ..." or "Target //foo:bar failed to build".
+func ParseFailures(output string, targets []bazel.Label) map[bazel.Label]bool {
+	want := make(map[bazel.Label]bool)
+	for _, t := range targets {
+		want[t] = true
+	}
+	ret := make(map[bazel.Label]bool)
+	for _, line := range strings.Split(output, "\n") {
+		if !strings.HasPrefix(line, "ERROR:") && !strings.Contains(line, "failed to build") {
+			continue
+		}
+		for _, m := range labelRegexp.FindAllString(line, -1) {
+			if l := bazel.Label(strings.TrimRight(m, ".,;")); want[l] {
+				ret[l] = true
+			}
+		}
+	}
+	return ret
+}
@@ -0,0 +1,84 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"testing"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseFailures(t *testing.T) {
+	targets := []bazel.Label{"//java/x:Foo", "//java/x:Bar", "//java/y:Baz"}
+	var tests = []struct {
+		desc   string
+		output string
+		want   map[bazel.Label]bool
+	}{
+		{
+			desc:   "no errors",
+			output: "INFO: Build completed successfully, 3 total actions\n",
+			want:   map[bazel.Label]bool{},
+		},
+		{
+			desc: "analysis error and failed target",
+			output: `ERROR: /ws/java/x/BUILD:3:1: in java_library rule //java/x:Foo: target '//java/z:Z' is not visible
+Target //java/y:Baz failed to build
+INFO: Elapsed time: 0.1s`,
+			want: map[bazel.Label]bool{"//java/x:Foo": true, "//java/y:Baz": true},
+		},
+		{
+			desc:   "labels that weren't built are ignored",
+			output: "ERROR: /ws/java/x/BUILD:3:1: in java_library rule //java/other:Other: failed.\n",
+			want:   map[bazel.Label]bool{},
+		},
+		{
+			desc:   "labels mentioned outside error lines are ignored",
+			output: "INFO: Analyzed target //java/x:Bar (1 packages loaded).\n",
+			want:   map[bazel.Label]bool{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			got := ParseFailures(tt.output, targets)
+			if diff := cmp.Diff(got, tt.want); diff != "" {
+				t.Errorf("ParseFailures() diff (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestBuild(t *testing.T) {
+	targets := []bazel.Label{"//java/x:Foo", "//java/x:Bar"}
+	var tests = []struct {
+		command string
+		want    map[bazel.Label]bool
+	}{
+		{"true", nil},
+		{"false", map[bazel.Label]bool{"//java/x:Foo": true, "//java/x:Bar": true}},
+	}
+	for _, tt := range tests {
+		got, err := Build(context.Background(), ".", tt.command, targets)
+		if err != nil {
+			t.Errorf("Build(%q) has error %v, want nil", tt.command, err)
+			continue
+		}
+		if diff := cmp.Diff(got, tt.want); diff != "" {
+			t.Errorf("Build(%q) diff (-got +want):\n%s", tt.command, diff)
+		}
+	}
+}
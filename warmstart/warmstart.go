@@ -0,0 +1,230 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package warmstart saves the caches Jadep warms up while it runs to a file, and restores them when Jadep starts again,
+// so a restarted Jadep answers its first queries without reloading packages and relisting jars.
+//
+// Saved packages are validated against a digest of their BUILD file and of the names of their files,
+// and saved jars against a digest of their content. Changes to .bzl files are not detected.
+package warmstart
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/buildozer"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+	"github.com/bazelbuild/tools_jvm_autodeps/jarverifier"
+	"github.com/bazelbuild/tools_jvm_autodeps/pkgloading"
+)
+
+// version is incremented whenever the format of the cache file changes. Files of other versions are ignored.
+const version = 1
+
+// Caches are the caches that Save saves and Load restores. Nil caches are skipped.
+type Caches struct {
+	Loader          *pkgloading.CachingLoader
+	ProvidedClasses *jadeplib.ProvidedClasses
+	JarVerifier     *jarverifier.Verifier
+}
+
+// Stats count the entries Load restored, and the ones it dropped because they're stale.
+type Stats struct {
+	Packages, StalePackages int
+	Rules                   int
+	Jars, StaleJars         int
+}
+
+// cacheFile is the content of a warm-start cache file.
+type cacheFile struct {
+	Version      int
+	WorkspaceDir string
+
+	Packages        map[string]savedPackage
+	ProvidedClasses []jadeplib.ProvidedClassesEntry
+	Jars            map[string]savedJar
+}
+
+type savedPackage struct {
+	Digest  string
+	Package *bazel.Package
+}
+
+type savedJar struct {
+	Digest  string
+	Classes []jadeplib.ClassName
+}
+
+// Save writes the contents of caches to fileName, along with the digests Load validates them against.
+// Packages that aren't in workspaceDir (e.g., in external repositories) aren't saved.
+func Save(fileName, workspaceDir string, caches Caches) error {
+	f := cacheFile{
+		Version:      version,
+		WorkspaceDir: workspaceDir,
+		Packages:     make(map[string]savedPackage),
+		Jars:         make(map[string]savedJar),
+	}
+	if caches.Loader != nil {
+		for pkgName, pkg := range caches.Loader.Packages() {
+			if digest, err := packageDigest(workspaceDir, pkgName); err == nil {
+				f.Packages[pkgName] = savedPackage{digest, pkg}
+			}
+		}
+	}
+	if caches.ProvidedClasses != nil {
+		f.ProvidedClasses = caches.ProvidedClasses.Entries()
+	}
+	if caches.JarVerifier != nil {
+		for jar, classes := range caches.JarVerifier.Jars() {
+			if digest, err := fileDigest(jar); err == nil {
+				f.Jars[jar] = savedJar{digest, classes}
+			}
+		}
+	}
+
+	b, err := json.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("error serializing warm-start cache:\n%v", err)
+	}
+	// Write to a temporary file and rename it, so a Jadep that starts concurrently never reads a partial file.
+	tmp := fileName + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return fmt.Errorf("error writing warm-start cache to %s:\n%v", tmp, err)
+	}
+	if err := os.Rename(tmp, fileName); err != nil {
+		return fmt.Errorf("error writing warm-start cache to %s:\n%v", fileName, err)
+	}
+	return nil
+}
+
+// Load restores into caches the entries that Save wrote to fileName, and that are still valid.
+// A file that doesn't exist is not an error, since the first run has nothing to restore.
+// A file that was written by a different version of Jadep, or for a different workspace, is an error.
+func Load(fileName, workspaceDir string, caches Caches) (Stats, error) {
+	var stats Stats
+	b, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return stats, nil
+	}
+	if err != nil {
+		return stats, fmt.Errorf("error reading warm-start cache:\n%v", err)
+	}
+	var f cacheFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return stats, fmt.Errorf("error parsing warm-start cache %s:\n%v", fileName, err)
+	}
+	if f.Version != version {
+		return stats, fmt.Errorf("warm-start cache %s has version %d, want %d", fileName, f.Version, version)
+	}
+	if f.WorkspaceDir != workspaceDir {
+		return stats, fmt.Errorf("warm-start cache %s was saved for workspace %s, not %s", fileName, f.WorkspaceDir, workspaceDir)
+	}
+
+	if caches.Loader != nil {
+		pkgs := make(map[string]*bazel.Package)
+		for pkgName, saved := range f.Packages {
+			if saved.Package == nil {
+				continue
+			}
+			if digest, err := packageDigest(workspaceDir, pkgName); err != nil || digest != saved.Digest {
+				stats.StalePackages++
+				continue
+			}
+			for _, r := range saved.Package.Rules {
+				for name, v := range r.Attrs {
+					r.Attrs[name] = bazel.AttrFromJSON(v)
+				}
+			}
+			pkgs[pkgName] = saved.Package
+		}
+		caches.Loader.Prime(pkgs)
+		stats.Packages = len(pkgs)
+	}
+	if caches.ProvidedClasses != nil {
+		caches.ProvidedClasses.AddEntries(f.ProvidedClasses)
+		stats.Rules = len(f.ProvidedClasses)
+	}
+	if caches.JarVerifier != nil {
+		jars := make(map[string][]jadeplib.ClassName)
+		for jar, saved := range f.Jars {
+			if digest, err := fileDigest(jar); err != nil || digest != saved.Digest {
+				stats.StaleJars++
+				continue
+			}
+			jars[jar] = saved.Classes
+		}
+		caches.JarVerifier.AddJars(jars)
+		stats.Jars = len(jars)
+	}
+	return stats, nil
+}
+
+// packageDigest returns a digest of the BUILD file of pkgName and of the names of the files that belong to it,
+// so that a package is considered stale when its BUILD file changes, or when files are added to or removed from it
+// (which may change the results of its globs).
+func packageDigest(workspaceDir, pkgName string) (string, error) {
+	dir := filepath.Join(workspaceDir, pkgName)
+	h := sha256.New()
+	content, err := ioutil.ReadFile(buildozer.BuildFileOf(workspaceDir, pkgName))
+	if err != nil {
+		return "", err
+	}
+	h.Write(content)
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			// Subpackages don't belong to the package.
+			if _, err := os.Stat(buildozer.BuildFileOf(dir, rel)); err == nil {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		fmt.Fprintf(h, "\x00%s", filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fileDigest returns a digest of the content of fileName.
+func fileDigest(fileName string) (string, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,194 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package warmstart
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+	"github.com/bazelbuild/tools_jvm_autodeps/jarverifier"
+	"github.com/bazelbuild/tools_jvm_autodeps/loadertest"
+	"github.com/bazelbuild/tools_jvm_autodeps/pkgloading"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSaveLoad(t *testing.T) {
+	ctx := context.Background()
+	workDir, err := ioutil.TempDir("", "jadep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+	writeFile(t, filepath.Join(workDir, "x/BUILD"), "java_library(name = 'Foo')")
+	writeFile(t, filepath.Join(workDir, "x/Foo.java"), "package x;")
+	writeFile(t, filepath.Join(workDir, "x/sub/BUILD.bazel"), "")
+	jar := filepath.Join(workDir, "bazel-bin/x/libFoo.jar")
+	writeFile(t, jar, "jar content")
+
+	pkg := &bazel.Package{
+		Path:  filepath.Join(workDir, "x"),
+		Files: map[string]string{"Foo.java": ""},
+		Rules: map[string]*bazel.Rule{
+			"Foo": bazel.NewRule("java_library", "x", "Foo", map[string]interface{}{
+				"srcs":     []string{"Foo.java"},
+				"testonly": true,
+				"size":     3,
+				"deps":     bazel.UnknownAttributeValue{},
+			}),
+		},
+	}
+	mtime := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	provided := []jadeplib.ProvidedClassesEntry{{
+		Rule:    "//x:Foo",
+		Mtimes:  map[string]time.Time{filepath.Join(workDir, "x/Foo.java"): mtime},
+		Classes: []jadeplib.ClassName{"x.Foo"},
+	}}
+	jars := map[string][]jadeplib.ClassName{jar: {"x.Foo", "x.Foo$Bar"}}
+
+	// Warm up caches and save them.
+	loader := pkgloading.NewCachingLoader(&loadertest.StubLoader{Pkgs: map[string]*bazel.Package{"x": pkg}})
+	if _, err := loader.Load(ctx, []string{"x"}); err != nil {
+		t.Fatal(err)
+	}
+	providedClasses := jadeplib.NewProvidedClasses()
+	providedClasses.AddEntries(provided)
+	verifier := jarverifier.New(filepath.Join(workDir, "bazel-bin"), nil)
+	verifier.AddJars(jars)
+	cacheFile := filepath.Join(workDir, "warm_start_cache")
+	if err := Save(cacheFile, workDir, Caches{loader, providedClasses, verifier}); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	// Restore them in a new run.
+	stubLoader := &loadertest.StubLoader{}
+	loader = pkgloading.NewCachingLoader(stubLoader)
+	providedClasses = jadeplib.NewProvidedClasses()
+	verifier = jarverifier.New(filepath.Join(workDir, "bazel-bin"), nil)
+	stats, err := Load(cacheFile, workDir, Caches{loader, providedClasses, verifier})
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if diff := cmp.Diff(stats, Stats{Packages: 1, Rules: 1, Jars: 1}); diff != "" {
+		t.Errorf("Load returned diff in stats (-got +want):\n%s", diff)
+	}
+	got, err := loader.Load(ctx, []string{"x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(got, map[string]*bazel.Package{"x": pkg}); diff != "" {
+		t.Errorf("Restored packages diff (-got +want):\n%s", diff)
+	}
+	if len(stubLoader.RecordedCalls) != 0 {
+		t.Errorf("Restored loader called the underlying loader with %v, want no calls", stubLoader.RecordedCalls)
+	}
+	if diff := cmp.Diff(providedClasses.Entries(), provided); diff != "" {
+		t.Errorf("Restored provided classes diff (-got +want):\n%s", diff)
+	}
+	if diff := cmp.Diff(verifier.Jars(), jars); diff != "" {
+		t.Errorf("Restored jars diff (-got +want):\n%s", diff)
+	}
+
+	// Adding a file to the package and rebuilding the jar make them stale. Files of subpackages don't matter.
+	writeFile(t, filepath.Join(workDir, "x/sub/Sub.java"), "")
+	stats, err = Load(cacheFile, workDir, Caches{Loader: pkgloading.NewCachingLoader(stubLoader)})
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if diff := cmp.Diff(stats, Stats{Packages: 1}); diff != "" {
+		t.Errorf("Load after changing a subpackage returned diff in stats (-got +want):\n%s", diff)
+	}
+	writeFile(t, filepath.Join(workDir, "x/Bar.java"), "package x;")
+	writeFile(t, jar, "rebuilt jar content")
+	stats, err = Load(cacheFile, workDir, Caches{pkgloading.NewCachingLoader(stubLoader), jadeplib.NewProvidedClasses(), jarverifier.New(workDir, nil)})
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if diff := cmp.Diff(stats, Stats{StalePackages: 1, Rules: 1, StaleJars: 1}); diff != "" {
+		t.Errorf("Load after changes returned diff in stats (-got +want):\n%s", diff)
+	}
+}
+
+func TestSaveLoadBuildBazel(t *testing.T) {
+	ctx := context.Background()
+	workDir, err := ioutil.TempDir("", "jadep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+	writeFile(t, filepath.Join(workDir, "x/BUILD.bazel"), "java_library(name = 'Foo')")
+	writeFile(t, filepath.Join(workDir, "x/Foo.java"), "package x;")
+
+	pkg := &bazel.Package{
+		Path:  filepath.Join(workDir, "x"),
+		Files: map[string]string{"Foo.java": ""},
+		Rules: map[string]*bazel.Rule{"Foo": bazel.NewRule("java_library", "x", "Foo", nil)},
+	}
+	loader := pkgloading.NewCachingLoader(&loadertest.StubLoader{Pkgs: map[string]*bazel.Package{"x": pkg}})
+	if _, err := loader.Load(ctx, []string{"x"}); err != nil {
+		t.Fatal(err)
+	}
+	cacheFile := filepath.Join(workDir, "warm_start_cache")
+	if err := Save(cacheFile, workDir, Caches{Loader: loader}); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	stats, err := Load(cacheFile, workDir, Caches{Loader: pkgloading.NewCachingLoader(&loadertest.StubLoader{})})
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if diff := cmp.Diff(stats, Stats{Packages: 1}); diff != "" {
+		t.Errorf("Load returned diff in stats (-got +want):\n%s", diff)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	workDir, err := ioutil.TempDir("", "jadep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	if _, err := Load(filepath.Join(workDir, "does_not_exist"), workDir, Caches{}); err != nil {
+		t.Errorf("Load(non-existent file) returned error %v, want nil", err)
+	}
+
+	cacheFile := filepath.Join(workDir, "warm_start_cache")
+	if err := Save(cacheFile, workDir, Caches{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(cacheFile, filepath.Join(workDir, "other"), Caches{}); err == nil {
+		t.Errorf("Load(cache of another workspace) returned nil error")
+	}
+
+	writeFile(t, cacheFile, `{"Version": 0}`)
+	if _, err := Load(cacheFile, workDir, Caches{}); err == nil {
+		t.Errorf("Load(cache of another version) returned nil error")
+	}
+}
+
+func writeFile(t *testing.T, fileName, content string) {
+	if err := os.MkdirAll(filepath.Dir(fileName), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fileName, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package workspaceresolver resolves Java class names to jars of repositories declared in the WORKSPACE file,
+// using maven_jar, jvm_maven_import_external or http_jar. It's meant for workspaces that use neither
+// https://github.com/johnynek/bazel-deps/ nor rules_jvm_external.
+// NewResolver lists the jars Bazel downloaded for these repositories under <output_base>/external, and maps
+// their classes to the @<repository>//jar labels the repository rules define.
+package workspaceresolver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"context"
+	"github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+	"github.com/bazelbuild/tools_jvm_autodeps/listclassesinjar"
+)
+
+// RepositoryRuleKinds are the WORKSPACE rules whose jars are indexed. Each of them defines a java_import named @<name>//jar.
+var RepositoryRuleKinds = map[string]bool{
+	"maven_jar":                 true,
+	"jvm_maven_import_external": true,
+	"http_jar":                  true,
+}
+
+// Repository is a jar repository declared in a WORKSPACE file.
+type Repository struct {
+	// Name is the name of the repository, e.g. "com_google_guava_guava".
+	Name string
+
+	// Kind is the repository rule that declared it, e.g. "maven_jar".
+	Kind string
+}
+
+// Label returns the label of the java_import rule the repository defines, e.g. @com_google_guava_guava//jar:jar.
+func (r Repository) Label() bazel.Label {
+	return bazel.Label("@" + r.Name + "//jar:jar")
+}
+
+// ParseWorkspace returns the jar repositories declared in the WORKSPACE file whose content is 'data'.
+// fileName is only used in error messages.
+func ParseWorkspace(fileName string, data []byte) ([]Repository, error) {
+	f, err := build.Parse(fileName, data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s:\n%v", fileName, err)
+	}
+	var ret []Repository
+	for _, r := range f.Rules("") {
+		if !RepositoryRuleKinds[r.Kind()] {
+			continue
+		}
+		if name := r.Name(); name != "" {
+			ret = append(ret, Repository{Name: name, Kind: r.Kind()})
+		}
+	}
+	return ret, nil
+}
+
+// Resolver resolves class names to the jars of repositories declared in a WORKSPACE file.
+type Resolver struct {
+	classToRule map[jadeplib.ClassName]*bazel.Rule
+}
+
+// NewResolver returns a new Resolver for the WORKSPACE file in workspaceDir.
+// externalDir is the directory into which Bazel fetches external repositories, i.e. <output_base>/external.
+// Repositories that haven't been fetched yet are skipped.
+func NewResolver(workspaceDir, externalDir string) (*Resolver, error) {
+	stopwatch := time.Now()
+	fileName := filepath.Join(workspaceDir, "WORKSPACE")
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s:\n%v", fileName, err)
+	}
+	repos, err := ParseWorkspace(fileName, data)
+	if err != nil {
+		return nil, err
+	}
+
+	classToRule := make(map[jadeplib.ClassName]*bazel.Rule)
+	for _, repo := range repos {
+		jars := repositoryJars(filepath.Join(externalDir, repo.Name))
+		if len(jars) == 0 {
+			continue
+		}
+		pkgName, ruleName := repo.Label().Split()
+		rule := bazel.NewRule("java_import", pkgName, ruleName, map[string]interface{}{"visibility": []string{"//visibility:public"}})
+		for _, jar := range jars {
+			cls, err := listclassesinjar.List(jar)
+			if err != nil {
+				log.Printf("Warning: unable to list classes in jar %s", jar)
+			}
+			for _, c := range cls {
+				classToRule[c] = rule
+			}
+		}
+	}
+	log.Printf("Created WORKSPACE jars resolver (%dms)", int64(time.Now().Sub(stopwatch)/time.Millisecond))
+	return &Resolver{classToRule}, nil
+}
+
+// repositoryJars returns the class jars under the directory of a fetched repository.
+// Source jars are skipped.
+func repositoryJars(repoDir string) []string {
+	var ret []string
+	filepath.Walk(repoDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !info.IsDir() && strings.HasSuffix(path, ".jar") && !strings.HasSuffix(path, "-sources.jar") {
+			ret = append(ret, path)
+		}
+		return nil
+	})
+	return ret
+}
+
+// Name returns a description of the resolver.
+func (r *Resolver) Name() string {
+	return "WORKSPACE jars"
+}
+
+// Resolve resolves class names according to an in-memory map.
+func (r *Resolver) Resolve(ctx context.Context, classNames []jadeplib.ClassName, consumingRules map[bazel.Label]map[bazel.Label]bool) (map[jadeplib.ClassName][]*bazel.Rule, error) {
+	result := make(map[jadeplib.ClassName][]*bazel.Rule)
+	for _, cls := range classNames {
+		if rule := r.classToRule[cls]; rule != nil {
+			result[cls] = append(result[cls], rule)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2018 The Jadep Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workspaceresolver
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"context"
+	"github.com/bazelbuild/tools_jvm_autodeps/bazel"
+	"github.com/bazelbuild/tools_jvm_autodeps/jadeplib"
+	"github.com/google/go-cmp/cmp"
+)
+
+const workspaceFile = `
+workspace(name = "x")
+
+maven_jar(
+    name = "com_google_guava_guava",
+    artifact = "com.google.guava:guava:24.0-jre",
+)
+
+load("@bazel_tools//tools/build_defs/repo:jvm.bzl", "jvm_maven_import_external")
+
+jvm_maven_import_external(
+    name = "junit_junit",
+    artifact = "junit:junit:4.12",
+    server_urls = ["http://central.maven.org/maven2"],
+)
+
+http_jar(
+    name = "not_fetched",
+    url = "http://example.com/not_fetched.jar",
+)
+
+http_archive(
+    name = "io_bazel_rules_go",
+    url = "http://example.com/rules_go.tar.gz",
+)
+`
+
+func TestParseWorkspace(t *testing.T) {
+	got, err := ParseWorkspace("WORKSPACE", []byte(workspaceFile))
+	if err != nil {
+		t.Fatalf("ParseWorkspace returned error %v, want nil", err)
+	}
+	want := []Repository{
+		{"com_google_guava_guava", "maven_jar"},
+		{"junit_junit", "jvm_maven_import_external"},
+		{"not_fetched", "http_jar"},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("ParseWorkspace diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "workspaceresolver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	workspaceDir := filepath.Join(tmpDir, "workspace")
+	externalDir := filepath.Join(tmpDir, "output_base", "external")
+
+	if err := os.MkdirAll(workspaceDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(workspaceDir, "WORKSPACE"), []byte(workspaceFile), 0600); err != nil {
+		t.Fatal(err)
+	}
+	jars := map[string][]string{
+		"com_google_guava_guava/jar/guava-24.0-jre.jar":         {"com/google/common/collect/ImmutableList.class"},
+		"com_google_guava_guava/jar/guava-24.0-jre-sources.jar": {"com/google/common/collect/Sources.class"},
+		"junit_junit/junit-4.12.jar":                            {"org/junit/Test.class"},
+		"io_bazel_rules_go/rules_go.jar":                        {"com/Undeclared.class"},
+	}
+	for fileName, files := range jars {
+		if err := writeZipFile(filepath.Join(externalDir, fileName), files); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resolver, err := NewResolver(workspaceDir, externalDir)
+	if err != nil {
+		t.Fatalf("NewResolver returned error %v, want nil", err)
+	}
+	classNames := []jadeplib.ClassName{"com.google.common.collect.ImmutableList", "com.google.common.collect.Sources", "org.junit.Test", "com.Undeclared"}
+	got, err := resolver.Resolve(context.Background(), classNames, nil)
+	if err != nil {
+		t.Fatalf("Resolve returned error %v, want nil", err)
+	}
+
+	gotLabels := make(map[jadeplib.ClassName][]bazel.Label)
+	for cls, rules := range got {
+		for _, r := range rules {
+			gotLabels[cls] = append(gotLabels[cls], r.Label())
+		}
+	}
+	want := map[jadeplib.ClassName][]bazel.Label{
+		"com.google.common.collect.ImmutableList": {"@com_google_guava_guava//jar:jar"},
+		"org.junit.Test": {"@junit_junit//jar:jar"},
+	}
+	if diff := cmp.Diff(gotLabels, want); diff != "" {
+		t.Errorf("Resolve(%s) diff: (-got +want)\n%s", classNames, diff)
+	}
+}
+
+func writeZipFile(fileName string, zipFileNames []string) error {
+	if err := os.MkdirAll(filepath.Dir(fileName), 0700); err != nil {
+		return err
+	}
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := zip.NewWriter(f)
+	for _, name := range zipFileNames {
+		if _, err := w.Create(name); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}